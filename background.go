@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// PassOptions holds the options of the tasks which a Store runs in the
+// background in passes, such as a Scrubber or a SizeMonitor.
+type PassOptions struct {
+	// Interval is the time between the starts of two passes.  If a pass
+	// takes longer than that, the next one starts as soon as it ends.  If
+	// not set, the task's default interval is used.
+	Interval time.Duration
+	// OnPassDone, if set, is called at the end of each pass with the IDs
+	// of the items which were handled during it: the layers which were
+	// verified by a Scrubber, or the containers whose layers were measured
+	// by a SizeMonitor.
+	OnPassDone func(ids []string)
+}
+
+// setDefaults checks the options, and sets the interval to defaultInterval
+// if it isn't set.
+func (o *PassOptions) setDefaults(defaultInterval time.Duration) error {
+	if o.Interval < 0 {
+		return errors.Errorf("invalid interval %v", o.Interval)
+	}
+	if o.Interval == 0 {
+		o.Interval = defaultInterval
+	}
+	return nil
+}
+
+// backgroundPasses runs the passes of a task in the background, until it is
+// stopped.
+type backgroundPasses struct {
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func newBackgroundPasses() *backgroundPasses {
+	return &backgroundPasses{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+// run calls pass, and options.OnPassDone with the IDs it returns, every
+// options.Interval until the task is stopped.  The errors returned by pass
+// are logged, after what.
+func (b *backgroundPasses) run(options PassOptions, what string, pass func() ([]string, error)) {
+	defer close(b.done)
+	for {
+		start := time.Now()
+		ids, err := pass()
+		if err != nil {
+			logrus.Warnf("%s: %v", what, err)
+		}
+		if options.OnPassDone != nil {
+			options.OnPassDone(ids)
+		}
+		if !b.wait(options.Interval - time.Since(start)) {
+			return
+		}
+	}
+}
+
+// Stop stops the task, and waits for the pass which is running, if there is
+// one, to end.
+func (b *backgroundPasses) Stop() {
+	b.stopOnce.Do(func() {
+		close(b.stop)
+	})
+	<-b.done
+}
+
+// wait waits for d to pass, and returns false if the task was stopped in the
+// meantime.
+func (b *backgroundPasses) wait(d time.Duration) bool {
+	if d <= 0 {
+		select {
+		case <-b.stop:
+			return false
+		default:
+			return true
+		}
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-b.stop:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,224 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/storage/pkg/mount"
+	"github.com/containers/storage/pkg/stringutils"
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ReadOnlyBind describes a directory which is bind mounted, read-only, into
+// the file system of an image or of a container when it is mounted, e.g. to
+// share a cache among them.
+type ReadOnlyBind struct {
+	// Name identifies the bind among the ones of the image or container.
+	Name string `json:"name"`
+	// Source is the directory which is mounted.  It must be under one
+	// of the store's BindRoots.
+	Source string `json:"source"`
+	// Destination is where Source is mounted, relative to the root of
+	// the image's or container's file system.  It must be a directory
+	// which exists there, since the file system may be read-only, and
+	// creating it would change the container's layer.
+	Destination string `json:"destination"`
+}
+
+func copyReadOnlyBinds(binds []ReadOnlyBind) []ReadOnlyBind {
+	if binds == nil {
+		return nil
+	}
+	return append([]ReadOnlyBind{}, binds...)
+}
+
+// checkBindSource checks that source is a directory under one of the
+// store's BindRoots, once symbolic links are resolved.
+func (s *store) checkBindSource(source string) error {
+	if !filepath.IsAbs(source) {
+		return errors.Errorf("bind source %q is not an absolute path", source)
+	}
+	resolved, err := filepath.EvalSymlinks(source)
+	if err != nil {
+		return errors.Wrapf(err, "checking bind source %q", source)
+	}
+	st, err := os.Stat(resolved)
+	if err != nil {
+		return errors.Wrapf(err, "checking bind source %q", source)
+	}
+	if !st.IsDir() {
+		return errors.Errorf("bind source %q is not a directory", source)
+	}
+	for _, root := range s.bindRoots {
+		root, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(root, resolved)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+			return nil
+		}
+	}
+	return errors.Errorf("bind source %q is not under any of the allowed bind roots", source)
+}
+
+// validateBinds checks that binds can be set on an image or a container.
+func (s *store) validateBinds(binds []ReadOnlyBind) error {
+	names := make(map[string]bool)
+	for _, bind := range binds {
+		if bind.Name == "" {
+			return errors.New("binds must have a name")
+		}
+		if names[bind.Name] {
+			return errors.Errorf("more than one bind is named %q", bind.Name)
+		}
+		names[bind.Name] = true
+		if filepath.Clean("/"+bind.Destination) == "/" {
+			return errors.Errorf("bind %q can't be mounted at the root", bind.Name)
+		}
+		if err := s.checkBindSource(bind.Source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mountBinds bind mounts the sources of binds, read-only, at their
+// destinations under mountPoint.  If one of them can't be mounted, the ones
+// which were are unmounted.
+func (s *store) mountBinds(mountPoint string, binds []ReadOnlyBind) (err error) {
+	mounted := 0
+	defer func() {
+		if err != nil {
+			if err2 := unmountBinds(mountPoint, binds[:mounted]); err2 != nil {
+				logrus.Errorf("Unmounting the binds under %q: %v", mountPoint, err2)
+			}
+		}
+	}()
+	for _, bind := range binds {
+		if err := s.checkBindSource(bind.Source); err != nil {
+			return err
+		}
+		dest, err := securejoin.SecureJoin(mountPoint, bind.Destination)
+		if err != nil {
+			return err
+		}
+		st, err := os.Stat(dest)
+		if err != nil {
+			return errors.Wrapf(err, "checking the destination of bind %q", bind.Name)
+		}
+		if !st.IsDir() {
+			return errors.Errorf("the destination of bind %q is not a directory", bind.Name)
+		}
+		if err := mount.Mount(bind.Source, dest, "bind", "bind,ro"); err != nil {
+			return errors.Wrapf(err, "mounting bind %q", bind.Name)
+		}
+		mounted++
+	}
+	return nil
+}
+
+// unmountBinds unmounts the binds which are mounted under mountPoint, in the
+// reverse order of their mounting.
+func unmountBinds(mountPoint string, binds []ReadOnlyBind) error {
+	var firstErr error
+	for i := len(binds) - 1; i >= 0; i-- {
+		dest, err := securejoin.SecureJoin(mountPoint, binds[i].Destination)
+		if err == nil {
+			var mounted bool
+			if mounted, err = mount.Mounted(dest); err == nil && mounted {
+				err = mount.Unmount(dest)
+			}
+		}
+		if err != nil && firstErr == nil {
+			firstErr = errors.Wrapf(err, "unmounting bind %q", binds[i].Name)
+		}
+	}
+	return firstErr
+}
+
+// layerBinds returns the binds of the images whose top layer is the layer
+// with the specified ID, and of the containers whose layer it is, so that
+// they can be unmounted however the layer was mounted.
+func (s *store) layerBinds(layerID string) ([]ReadOnlyBind, error) {
+	var binds []ReadOnlyBind
+	istore, err := s.ImageStore()
+	if err != nil {
+		return nil, err
+	}
+	istores, err := s.ROImageStores()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range append([]ROImageStore{istore}, istores...) {
+		store := s
+		store.RLock()
+		defer store.Unlock()
+		if err := store.ReloadIfChanged(); err != nil {
+			return nil, err
+		}
+		images, err := store.Images()
+		if err != nil {
+			return nil, err
+		}
+		for _, image := range images {
+			if image.TopLayer == layerID || stringutils.InSlice(image.MappedTopLayers, layerID) {
+				binds = append(binds, image.Binds...)
+			}
+		}
+	}
+	rcstore, err := s.ContainerStore()
+	if err != nil {
+		return nil, err
+	}
+	rcstore.RLock()
+	defer rcstore.Unlock()
+	if err := rcstore.ReloadIfChanged(); err != nil {
+		return nil, err
+	}
+	containers, err := rcstore.Containers()
+	if err != nil {
+		return nil, err
+	}
+	for _, container := range containers {
+		if container.LayerID == layerID {
+			binds = append(binds, container.Binds...)
+		}
+	}
+	return binds, nil
+}
+
+func (s *store) SetImageBinds(id string, binds []ReadOnlyBind) error {
+	if err := s.validateBinds(binds); err != nil {
+		return err
+	}
+	ristore, err := s.ImageStore()
+	if err != nil {
+		return err
+	}
+	ristore.Lock()
+	defer ristore.Unlock()
+	if err := ristore.ReloadIfChanged(); err != nil {
+		return err
+	}
+	return ristore.SetBinds(id, binds)
+}
+
+func (s *store) SetContainerBinds(id string, binds []ReadOnlyBind) error {
+	if err := s.validateBinds(binds); err != nil {
+		return err
+	}
+	rcstore, err := s.ContainerStore()
+	if err != nil {
+		return err
+	}
+	rcstore.Lock()
+	defer rcstore.Unlock()
+	if err := rcstore.ReloadIfChanged(); err != nil {
+		return err
+	}
+	return rcstore.SetBinds(id, binds)
+}
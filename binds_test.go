@@ -0,0 +1,137 @@
+// +build linux
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/storage/pkg/mount"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestBindStore returns a store whose only bind root is a directory
+// holding a "cache" directory with one file in it.
+func newTestBindStore(t *testing.T) (Store, string) {
+	if os.Geteuid() != 0 {
+		t.Skip("bind mounts require root")
+	}
+	bindRoot, err := ioutil.TempDir("", "testStorageBinds")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(bindRoot) })
+	require.NoError(t, os.MkdirAll(filepath.Join(bindRoot, "cache"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(bindRoot, "cache", "data"), []byte("cached"), 0644))
+	store := newTestStore(t, func(options *StoreOptions) {
+		options.BindRoots = []string{bindRoot}
+	})
+	return store, bindRoot
+}
+
+func TestBindsValidation(t *testing.T) {
+	store, bindRoot := newTestBindStore(t)
+	layer, _, err := store.PutLayer("", "", nil, "", false, nil, makeTestLayerTar(t, map[string]string{"file": "contents"}))
+	require.NoError(t, err)
+	image, err := store.CreateImage("", nil, layer.ID, "", nil)
+	require.NoError(t, err)
+
+	outside, err := ioutil.TempDir("", "testStorageBindsOutside")
+	require.NoError(t, err)
+	defer os.RemoveAll(outside)
+	require.NoError(t, os.Symlink(outside, filepath.Join(bindRoot, "link")))
+
+	for _, binds := range [][]ReadOnlyBind{
+		{{Name: "outside", Source: outside, Destination: "/cache"}},
+		{{Name: "link", Source: filepath.Join(bindRoot, "link"), Destination: "/cache"}},
+		{{Name: "missing", Source: filepath.Join(bindRoot, "missing"), Destination: "/cache"}},
+		{{Name: "relative", Source: "binds/cache", Destination: "/cache"}},
+		{{Name: "file", Source: filepath.Join(bindRoot, "cache", "data"), Destination: "/cache"}},
+		{{Name: "root", Source: filepath.Join(bindRoot, "cache"), Destination: "/../"}},
+		{{Source: filepath.Join(bindRoot, "cache"), Destination: "/cache"}},
+		{
+			{Name: "cache", Source: filepath.Join(bindRoot, "cache"), Destination: "/a"},
+			{Name: "cache", Source: filepath.Join(bindRoot, "cache"), Destination: "/b"},
+		},
+	} {
+		assert.Error(t, store.SetImageBinds(image.ID, binds), "binds %+v", binds)
+	}
+	image, err = store.Image(image.ID)
+	require.NoError(t, err)
+	assert.Empty(t, image.Binds)
+
+	require.NoError(t, store.SetImageBinds(image.ID, []ReadOnlyBind{{Name: "cache", Source: filepath.Join(bindRoot, "cache"), Destination: "/var/cache"}}))
+	image, err = store.Image(image.ID)
+	require.NoError(t, err)
+	assert.Len(t, image.Binds, 1)
+}
+
+func TestBindsMount(t *testing.T) {
+	store, bindRoot := newTestBindStore(t)
+	layer, _, err := store.PutLayer("", "", nil, "", false, nil, makeTestLayerTar(t, map[string]string{"var/cache/placeholder": "contents"}))
+	require.NoError(t, err)
+	image, err := store.CreateImage("", nil, layer.ID, "", nil)
+	require.NoError(t, err)
+	binds := []ReadOnlyBind{{Name: "cache", Source: filepath.Join(bindRoot, "cache"), Destination: "/var/cache"}}
+	require.NoError(t, store.SetImageBinds(image.ID, binds))
+
+	checkBind := func(mountPoint string) {
+		dest := filepath.Join(mountPoint, "var", "cache")
+		mounted, err := mount.Mounted(dest)
+		require.NoError(t, err)
+		require.True(t, mounted)
+		data, err := ioutil.ReadFile(filepath.Join(dest, "data"))
+		require.NoError(t, err)
+		assert.Equal(t, "cached", string(data))
+		assert.Error(t, ioutil.WriteFile(filepath.Join(dest, "new"), []byte("new"), 0644))
+	}
+	checkNoBind := func(mountPoint string) {
+		mounted, err := mount.Mounted(filepath.Join(mountPoint, "var", "cache"))
+		require.NoError(t, err)
+		assert.False(t, mounted)
+	}
+
+	// the image gets its binds
+	mountPoint, err := store.MountImage(image.ID, nil, "")
+	require.NoError(t, err)
+	checkBind(mountPoint)
+	_, err = store.UnmountImage(image.ID, false)
+	require.NoError(t, err)
+	checkNoBind(mountPoint)
+
+	// a container inherits them, and keeps them until its last unmount
+	container, err := store.CreateContainer("", nil, image.ID, "", "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, binds, container.Binds)
+	mountPoint, err = store.Mount(container.ID, "")
+	require.NoError(t, err)
+	checkBind(mountPoint)
+	_, err = store.Mount(container.ID, "")
+	require.NoError(t, err)
+	_, err = store.Unmount(container.ID, false)
+	require.NoError(t, err)
+	checkBind(mountPoint)
+	_, err = store.Unmount(container.ID, false)
+	require.NoError(t, err)
+	checkNoBind(mountPoint)
+
+	// a container can be created without them
+	container, err = store.CreateContainer("", nil, image.ID, "", "", &ContainerOptions{Binds: []ReadOnlyBind{}})
+	require.NoError(t, err)
+	assert.Empty(t, container.Binds)
+	mountPoint, err = store.Mount(container.ID, "")
+	require.NoError(t, err)
+	checkNoBind(mountPoint)
+	_, err = store.Unmount(container.ID, false)
+	require.NoError(t, err)
+
+	// destinations aren't created
+	require.NoError(t, store.SetImageBinds(image.ID, []ReadOnlyBind{{Name: "cache", Source: filepath.Join(bindRoot, "cache"), Destination: "/missing"}}))
+	_, err = store.MountImage(image.ID, nil, "")
+	assert.True(t, os.IsNotExist(errors.Cause(err)), "unexpected error %v", err)
+	mounted, err := store.Mounted(layer.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 0, mounted)
+}
@@ -49,6 +49,12 @@ func container(flags *mflag.FlagSet, action string, m storage.Store, args []stri
 			} else {
 				fmt.Printf("Size: %d\n", size)
 			}
+			usage, err := m.ContainerDiskUsage(container.ID)
+			if err != nil {
+				fmt.Printf("Disk usage unknown: %+v\n", err)
+			} else {
+				fmt.Printf("Disk usage: %d\n", usage)
+			}
 			fmt.Printf("Layer: %s\n", container.LayerID)
 			for _, name := range container.BigDataNames {
 				fmt.Printf("Data: %s\n", name)
@@ -157,6 +157,22 @@ func layerParentOwners(flags *mflag.FlagSet, action string, m storage.Store, arg
 	return 0
 }
 
+func verifyLayer(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	failed := false
+	for _, arg := range args {
+		if err := m.VerifyLayer(arg); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", arg, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("%s: OK\n", arg)
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
 func init() {
 	commands = append(commands,
 		command{
@@ -179,6 +195,13 @@ func init() {
 				flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
 			},
 		},
+		command{
+			names:       []string{"verify-layer"},
+			optionsHelp: "layerNameOrID [...]",
+			usage:       "Check a layer's contents against its recorded digests",
+			action:      verifyLayer,
+			minArgs:     1,
+		},
 		command{
 			names:       []string{"list-layer-data", "listlayerdata"},
 			optionsHelp: "[options [...]] layerNameOrID",
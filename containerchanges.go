@@ -0,0 +1,27 @@
+package storage
+
+import (
+	drivers "github.com/containers/storage/drivers"
+	"github.com/containers/storage/pkg/archive"
+	"github.com/pkg/errors"
+)
+
+func (s *store) StreamContainerChanges(id string) (<-chan archive.Change, func(), error) {
+	container, err := s.Container(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	driver, err := s.GraphDriver()
+	if err != nil {
+		return nil, nil, err
+	}
+	upper, ok := driver.(drivers.UpperDirDriver)
+	if !ok {
+		return nil, nil, errors.Wrapf(ErrNotSupported, "watching the changes of containers with the %q driver", driver.String())
+	}
+	dir, err := upper.UpperDir(container.LayerID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return watchChanges(dir)
+}
@@ -0,0 +1,242 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/containers/storage/pkg/archive"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// changeWatchMask is the set of inotify events which are watched for in each
+// directory.
+const changeWatchMask = unix.IN_CREATE | unix.IN_DELETE | unix.IN_MODIFY | unix.IN_ATTRIB |
+	unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_ONLYDIR | unix.IN_DONT_FOLLOW | unix.IN_EXCL_UNLINK
+
+// inotifyAddWatch adds an inotify watch.  It can be replaced by tests.
+var inotifyAddWatch = unix.InotifyAddWatch
+
+// changeWatcher reports the changes made under a directory, using an inotify
+// watch on each of its subdirectories.
+type changeWatcher struct {
+	root      string
+	fd        int
+	file      *os.File
+	watches   map[int]string
+	changes   chan archive.Change
+	last      archive.Change
+	done      chan struct{}
+	stopOnce  sync.Once
+	closeOnce sync.Once
+	warnOnce  sync.Once
+}
+
+// watchChanges starts watching root for changes, which are sent to the
+// returned channel until the returned function is called, at which point
+// the channel is closed.  The channel is also closed if root is removed.
+// Consecutive identical changes are only sent once.  Directories which
+// can't be watched, for example because the limit of inotify watches was
+// reached, are reported once as modified, so that their contents can be
+// compared by other means, and so is the root if the kernel dropped events.
+func watchChanges(root string) (<-chan archive.Change, func(), error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		if err == unix.EMFILE {
+			return nil, nil, errors.Wrapf(err, "creating an inotify instance to watch %q, the limit of instances was reached", root)
+		}
+		return nil, nil, errors.Wrapf(err, "creating an inotify instance to watch %q", root)
+	}
+	w := &changeWatcher{
+		root:    root,
+		fd:      fd,
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		watches: make(map[int]string),
+		changes: make(chan archive.Change, 64),
+		done:    make(chan struct{}),
+	}
+	var pending []archive.Change
+	if err := w.addTree("", func(change archive.Change) bool {
+		pending = append(pending, change)
+		return true
+	}, false); err != nil {
+		w.close()
+		return nil, nil, err
+	}
+	go w.run(pending)
+	return w.changes, w.stop, nil
+}
+
+// stop stops the watcher, and closes its channel.
+func (w *changeWatcher) stop() {
+	w.stopOnce.Do(func() {
+		close(w.done)
+	})
+	w.close()
+}
+
+func (w *changeWatcher) close() {
+	w.closeOnce.Do(func() {
+		w.file.Close()
+	})
+}
+
+// send sends change, unless it is the same as the last one sent, and
+// returns false if the watcher was stopped.
+func (w *changeWatcher) send(change archive.Change) bool {
+	if change == w.last {
+		return true
+	}
+	select {
+	case w.changes <- change:
+		w.last = change
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+// addTree adds watches on the directory at the path rel, relative to the
+// root, and on its subdirectories.  If report is set, everything under the
+// directory is reported as added.  The directories which can't be watched
+// because the limit of watches was reached are reported as modified.
+func (w *changeWatcher) addTree(rel string, emit func(archive.Change) bool, report bool) error {
+	top := filepath.Join(w.root, rel)
+	return filepath.Walk(top, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				// removed since it was created
+				return nil
+			}
+			return err
+		}
+		relPath, err := filepath.Rel(w.root, path)
+		if err != nil {
+			return err
+		}
+		if relPath == "." {
+			relPath = ""
+		}
+		if report && path != top {
+			if !emit(w.change(relPath, archive.ChangeAdd)) {
+				return errStopWalk
+			}
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		wd, err := inotifyAddWatch(w.fd, path, changeWatchMask)
+		if err != nil {
+			if err == unix.ENOSPC && relPath != "" {
+				w.warnOnce.Do(func() {
+					logrus.Warnf("Watching the changes under %q: the limit of inotify watches was reached, directories which can't be watched are reported as modified", w.root)
+				})
+				if !emit(archive.Change{Path: "/" + relPath, Kind: archive.ChangeModify}) {
+					return errStopWalk
+				}
+				return filepath.SkipDir
+			}
+			if os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return errors.Wrapf(err, "watching %q", path)
+		}
+		w.watches[wd] = relPath
+		return nil
+	})
+}
+
+// errStopWalk stops addTree when the watcher is stopped.
+var errStopWalk = errors.New("watcher stopped")
+
+// change returns the change of the specified kind for the file at the path
+// rel, relative to the root, reporting whiteouts as deletions of the files
+// they hide.
+func (w *changeWatcher) change(rel string, kind archive.ChangeType) archive.Change {
+	if kind == archive.ChangeAdd {
+		dir, base := filepath.Split(rel)
+		if strings.HasPrefix(base, archive.WhiteoutPrefix) && !strings.HasPrefix(base, archive.WhiteoutMetaPrefix) {
+			return archive.Change{Path: "/" + filepath.Join(dir, strings.TrimPrefix(base, archive.WhiteoutPrefix)), Kind: archive.ChangeDelete}
+		}
+		var st unix.Stat_t
+		if err := unix.Lstat(filepath.Join(w.root, rel), &st); err == nil && st.Mode&unix.S_IFMT == unix.S_IFCHR && st.Rdev == 0 {
+			kind = archive.ChangeDelete
+		}
+	}
+	return archive.Change{Path: "/" + rel, Kind: kind}
+}
+
+// run reads the events and sends the changes, after the ones in pending.
+func (w *changeWatcher) run(pending []archive.Change) {
+	defer close(w.changes)
+	defer w.close()
+	for _, change := range pending {
+		if !w.send(change) {
+			return
+		}
+	}
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			select {
+			case <-w.done:
+			default:
+				logrus.Errorf("Reading the changes under %q: %v", w.root, err)
+			}
+			return
+		}
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + unix.SizeofInotifyEvent
+			name := string(bytes.TrimRight(buf[nameStart:nameStart+int(event.Len)], "\x00"))
+			offset = nameStart + int(event.Len)
+			if !w.handle(int(event.Wd), event.Mask, name) {
+				return
+			}
+		}
+	}
+}
+
+// handle sends the changes for an event, and returns false if the watcher
+// must stop.
+func (w *changeWatcher) handle(wd int, mask uint32, name string) bool {
+	if mask&unix.IN_Q_OVERFLOW != 0 {
+		return w.send(archive.Change{Path: "/", Kind: archive.ChangeModify})
+	}
+	dir, ok := w.watches[wd]
+	if mask&unix.IN_IGNORED != 0 {
+		delete(w.watches, wd)
+		// the root was removed
+		return !ok || dir != ""
+	}
+	if !ok {
+		return true
+	}
+	rel := filepath.Join(dir, name)
+	switch {
+	case mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0:
+		if !w.send(w.change(rel, archive.ChangeAdd)) {
+			return false
+		}
+		if mask&unix.IN_ISDIR != 0 {
+			if err := w.addTree(rel, w.send, true); err != nil {
+				if err == errStopWalk {
+					return false
+				}
+				logrus.Warnf("Watching the changes under %q: %v", w.root, err)
+				return w.send(archive.Change{Path: "/" + rel, Kind: archive.ChangeModify})
+			}
+		}
+	case mask&(unix.IN_DELETE|unix.IN_MOVED_FROM) != 0:
+		return w.send(archive.Change{Path: "/" + rel, Kind: archive.ChangeDelete})
+	case mask&(unix.IN_MODIFY|unix.IN_ATTRIB) != 0:
+		return w.send(archive.Change{Path: "/" + rel, Kind: archive.ChangeModify})
+	}
+	return true
+}
@@ -0,0 +1,138 @@
+// +build linux
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containers/storage/pkg/archive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// waitForChanges reads changes until all of the expected ones were received,
+// and returns all of the ones which were.
+func waitForChanges(t *testing.T, changes <-chan archive.Change, expected ...archive.Change) []archive.Change {
+	var received []archive.Change
+	missing := make(map[archive.Change]bool)
+	for _, change := range expected {
+		missing[change] = true
+	}
+	timeout := time.After(time.Minute)
+	for len(missing) > 0 {
+		select {
+		case change, ok := <-changes:
+			require.True(t, ok, "the channel was closed before receiving %v", missing)
+			received = append(received, change)
+			delete(missing, change)
+		case <-timeout:
+			t.Fatalf("timed out waiting for %v, received %v", missing, received)
+		}
+	}
+	return received
+}
+
+func TestStreamContainerChanges(t *testing.T) {
+	store := newTestStore(t)
+
+	container, err := store.CreateContainer("", nil, "", "", "", nil)
+	require.NoError(t, err)
+	dir, err := store.Mount(container.ID, "")
+	require.NoError(t, err)
+	defer func() {
+		_, _ = store.Unmount(container.ID, true)
+	}()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "existing"), 0755))
+
+	changes, cancel, err := store.StreamContainerChanges(container.ID)
+	require.NoError(t, err)
+	defer cancel()
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "file"), []byte("new"), 0644))
+	waitForChanges(t, changes,
+		archive.Change{Path: "/file", Kind: archive.ChangeAdd},
+		archive.Change{Path: "/file", Kind: archive.ChangeModify})
+
+	// directories which existed when the watch started, and the ones
+	// created since then, are watched
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "existing", "a"), []byte("a"), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "new", "sub"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "new", "sub", "b"), []byte("b"), 0644))
+	waitForChanges(t, changes,
+		archive.Change{Path: "/existing/a", Kind: archive.ChangeAdd},
+		archive.Change{Path: "/new", Kind: archive.ChangeAdd},
+		archive.Change{Path: "/new/sub", Kind: archive.ChangeAdd},
+		archive.Change{Path: "/new/sub/b", Kind: archive.ChangeAdd})
+
+	require.NoError(t, os.Chmod(filepath.Join(dir, "file"), 0600))
+	require.NoError(t, os.Rename(filepath.Join(dir, "file"), filepath.Join(dir, "renamed")))
+	require.NoError(t, os.Remove(filepath.Join(dir, "existing", "a")))
+	waitForChanges(t, changes,
+		archive.Change{Path: "/file", Kind: archive.ChangeModify},
+		archive.Change{Path: "/file", Kind: archive.ChangeDelete},
+		archive.Change{Path: "/renamed", Kind: archive.ChangeAdd},
+		archive.Change{Path: "/existing/a", Kind: archive.ChangeDelete})
+
+	// whiteouts are deletions of the files they hide
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, archive.WhiteoutPrefix+"hidden"), nil, 0644))
+	deleted := []archive.Change{{Path: "/hidden", Kind: archive.ChangeDelete}}
+	if os.Geteuid() == 0 {
+		require.NoError(t, unix.Mknod(filepath.Join(dir, "overlay-hidden"), unix.S_IFCHR, 0))
+		deleted = append(deleted, archive.Change{Path: "/overlay-hidden", Kind: archive.ChangeDelete})
+	}
+	waitForChanges(t, changes, deleted...)
+
+	cancel()
+	for range changes {
+	}
+}
+
+func TestStreamContainerChangesWatchLimit(t *testing.T) {
+	store := newTestStore(t)
+
+	container, err := store.CreateContainer("", nil, "", "", "", nil)
+	require.NoError(t, err)
+	dir, err := store.Mount(container.ID, "")
+	require.NoError(t, err)
+	defer func() {
+		_, _ = store.Unmount(container.ID, true)
+	}()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "unwatched", "sub"), 0755))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "watched"), 0755))
+
+	// pretend that the limit is reached for one of the directories
+	defer func(f func(int, string, uint32) (int, error)) {
+		inotifyAddWatch = f
+	}(inotifyAddWatch)
+	inotifyAddWatch = func(fd int, path string, mask uint32) (int, error) {
+		if filepath.Base(path) == "unwatched" || filepath.Base(path) == "late" {
+			return -1, unix.ENOSPC
+		}
+		return unix.InotifyAddWatch(fd, path, mask)
+	}
+
+	changes, cancel, err := store.StreamContainerChanges(container.ID)
+	require.NoError(t, err)
+	defer cancel()
+	waitForChanges(t, changes, archive.Change{Path: "/unwatched", Kind: archive.ChangeModify})
+
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "late"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "watched", "file"), nil, 0644))
+	received := waitForChanges(t, changes,
+		archive.Change{Path: "/late", Kind: archive.ChangeAdd},
+		archive.Change{Path: "/late", Kind: archive.ChangeModify},
+		archive.Change{Path: "/watched/file", Kind: archive.ChangeAdd})
+	assert.NotContains(t, received, archive.Change{Path: "/unwatched/sub", Kind: archive.ChangeModify})
+
+	// without a watch on the root, there is nothing to report
+	inotifyAddWatch = func(fd int, path string, mask uint32) (int, error) {
+		return -1, unix.ENOSPC
+	}
+	_, _, err = store.StreamContainerChanges(container.ID)
+	assert.Error(t, err)
+}
@@ -0,0 +1,13 @@
+// +build !linux
+
+package storage
+
+import (
+	"github.com/containers/storage/pkg/archive"
+	"github.com/pkg/errors"
+)
+
+// watchChanges is not supported on this platform.
+func watchChanges(root string) (<-chan archive.Change, func(), error) {
+	return nil, nil, errors.Wrapf(ErrNotSupported, "watching %q for changes", root)
+}
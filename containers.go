@@ -65,6 +65,10 @@ type Container struct {
 	GIDMap []idtools.IDMap `json:"gidmap,omitempty"`
 
 	Flags map[string]interface{} `json:"flags,omitempty"`
+
+	// Binds are the directories which are bind mounted, read-only, into
+	// the container's layer when it is mounted.
+	Binds []ReadOnlyBind `json:"binds,omitempty"`
 }
 
 // ContainerStore provides bookkeeping for information about Containers.
@@ -86,6 +90,10 @@ type ContainerStore interface {
 	// with the specified ID.
 	SetNames(id string, names []string) error
 
+	// SetBinds replaces the list of directories which are bind mounted
+	// into the container's layer when it is mounted.
+	SetBinds(id string, binds []ReadOnlyBind) error
+
 	// Get retrieves information about a container given an ID or name.
 	Get(id string) (*Container, error)
 
@@ -131,6 +139,7 @@ func copyContainer(c *Container) *Container {
 		UIDMap:         copyIDMap(c.UIDMap),
 		GIDMap:         copyIDMap(c.GIDMap),
 		Flags:          copyStringInterfaceMap(c.Flags),
+		Binds:          copyReadOnlyBinds(c.Binds),
 	}
 }
 
@@ -338,6 +347,7 @@ func (r *containerStore) Create(id string, names []string, image, layer, metadat
 			Flags:          copyStringInterfaceMap(options.Flags),
 			UIDMap:         copyIDMap(options.UIDMap),
 			GIDMap:         copyIDMap(options.GIDMap),
+			Binds:          copyReadOnlyBinds(options.Binds),
 		}
 		r.containers = append(r.containers, container)
 		r.byid[id] = container
@@ -367,6 +377,14 @@ func (r *containerStore) SetMetadata(id, metadata string) error {
 	return ErrContainerUnknown
 }
 
+func (r *containerStore) SetBinds(id string, binds []ReadOnlyBind) error {
+	if container, ok := r.lookup(id); ok {
+		container.Binds = copyReadOnlyBinds(binds)
+		return r.Save()
+	}
+	return ErrContainerUnknown
+}
+
 func (r *containerStore) removeName(container *Container, name string) {
 	container.Names = stringSliceWithoutValue(container.Names, name)
 }
@@ -0,0 +1,335 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	drivers "github.com/containers/storage/drivers"
+	"github.com/containers/storage/pkg/chunked/compressor"
+	"github.com/containers/storage/pkg/stringid"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// DedupOptions is used for passing options to a Store's DedupLayers() method.
+type DedupOptions struct {
+	// Layers, if set, lists the IDs of the layers whose files are
+	// deduplicated.  If not set, all of the layers in the read-write layer
+	// store are.
+	Layers []string
+	// MinSize is the size of the smallest files which are deduplicated.
+	// Empty files never are.
+	MinSize int64
+	// DryRun, if set, causes the files which would be replaced with hard
+	// links to be counted, without replacing them.
+	DryRun bool
+}
+
+// DedupReport describes what a Store's DedupLayers() method did.
+type DedupReport struct {
+	// Layers lists the IDs of the layers whose files were compared.
+	Layers []string
+	// SkippedLayers maps the IDs of the layers which were left alone to
+	// the reason why they were.
+	SkippedLayers map[string]string
+	// Files is the number of files which were replaced with hard links to
+	// identical files in other layers.
+	Files int
+	// BytesSaved is the total size of those files.
+	BytesSaved int64
+}
+
+// dedupAttributes are the attributes of a file which hard links to it share,
+// and the ones which tell if two paths are already links to the same file.
+type dedupAttributes struct {
+	device, inode uint64
+	links         uint64
+	uid, gid      uint32
+	// xattrs is the list of the extended attributes of the file, sorted
+	// and encoded, so that it can be compared.
+	xattrs string
+}
+
+// dedupKey identifies the files which can be replaced with hard links to one
+// another, if their contents are indeed the same.
+type dedupKey struct {
+	digest   digest.Digest
+	size     int64
+	mode     os.FileMode
+	modTime  int64
+	uid, gid uint32
+	xattrs   string
+}
+
+// dedupFile is the first file found with a dedupKey, which the others are
+// linked to.
+type dedupFile struct {
+	path          string
+	device, inode uint64
+	// layers is the set of layers which have a path linked to the file,
+	// which can't be given another one, since the copies of the layer
+	// would then link them together too.
+	layers map[string]bool
+}
+
+func (s *store) DedupLayers(options DedupOptions) (DedupReport, error) {
+	report := DedupReport{SkippedLayers: make(map[string]string)}
+	if options.MinSize < 0 {
+		return report, errors.Errorf("invalid minimum size %d", options.MinSize)
+	}
+	driver, err := s.GraphDriver()
+	if err != nil {
+		return report, err
+	}
+	upper, ok := driver.(drivers.UpperDirDriver)
+	if !ok {
+		return report, errors.Wrapf(ErrNotSupported, "deduplicating the files of layers with the %q driver", driver.String())
+	}
+	rlstore, err := s.LayerStore()
+	if err != nil {
+		return report, err
+	}
+	rcstore, err := s.ContainerStore()
+	if err != nil {
+		return report, err
+	}
+
+	// The layer store is locked for writing, so that the layers can't be
+	// mounted while their files are replaced.
+	rlstore.Lock()
+	defer rlstore.Unlock()
+	if err := rlstore.ReloadIfChanged(); err != nil {
+		return report, err
+	}
+	rcstore.RLock()
+	defer rcstore.Unlock()
+	if err := rcstore.ReloadIfChanged(); err != nil {
+		return report, err
+	}
+
+	var layers []Layer
+	if options.Layers == nil {
+		if layers, err = rlstore.Layers(); err != nil {
+			return report, err
+		}
+	} else {
+		for _, id := range options.Layers {
+			layer, err := rlstore.Get(id)
+			if err != nil {
+				return report, errors.Wrapf(err, "layer %q", id)
+			}
+			layers = append(layers, *layer)
+		}
+	}
+	containers, err := rcstore.Containers()
+	if err != nil {
+		return report, err
+	}
+	containerLayers := make(map[string]bool, len(containers))
+	for _, container := range containers {
+		containerLayers[container.LayerID] = true
+	}
+
+	files := make(map[dedupKey]*dedupFile)
+	for i := range layers {
+		layer := &layers[i]
+		// The files of the layers which can be written to are left
+		// alone, so that a change to one of them can't show up in
+		// another layer.
+		switch {
+		case containerLayers[layer.ID]:
+			report.SkippedLayers[layer.ID] = "used by a container"
+			continue
+		case layer.MountCount > 0:
+			report.SkippedLayers[layer.ID] = "mounted"
+			continue
+		case layer.Flags[incompleteFlag] != nil, layer.Flags[lazyFlag] != nil:
+			report.SkippedLayers[layer.ID] = "not populated"
+			continue
+		}
+		dir, err := upper.UpperDir(layer.ID)
+		if err != nil {
+			return report, err
+		}
+		digests := chunkedManifestDigests(rlstore, layer.ID)
+		report.Layers = append(report.Layers, layer.ID)
+		err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() || info.Size() == 0 || info.Size() < options.MinSize {
+				return err
+			}
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			return s.dedupFile(layer.ID, path, info, digests[filepath.Clean("/"+rel)], files, options.DryRun, &report)
+		})
+		if err != nil {
+			return report, errors.Wrapf(err, "deduplicating the files of layer %q", layer.ID)
+		}
+	}
+	return report, nil
+}
+
+// dedupFile replaces the file at path, in the layer with the specified ID,
+// with a hard link to the first file in files which is identical to it, or
+// records it in files if it's the first one.  manifestDigest, if set, is the
+// digest of its contents recorded in the layer's chunked manifest.
+func (s *store) dedupFile(layerID, path string, info os.FileInfo, manifestDigest digest.Digest, files map[dedupKey]*dedupFile, dryRun bool, report *DedupReport) error {
+	attributes, err := dedupFileAttributes(path, info)
+	if err != nil {
+		return err
+	}
+	key := dedupKey{
+		digest:  manifestDigest,
+		size:    info.Size(),
+		mode:    info.Mode(),
+		modTime: info.ModTime().UnixNano(),
+		uid:     attributes.uid,
+		gid:     attributes.gid,
+		xattrs:  attributes.xattrs,
+	}
+	if key.digest == "" {
+		if key.digest, err = fileDigest(path); err != nil {
+			return err
+		}
+	}
+	canonical, ok := files[key]
+	if !ok {
+		files[key] = &dedupFile{
+			path:   path,
+			device: attributes.device,
+			inode:  attributes.inode,
+			layers: map[string]bool{layerID: true},
+		}
+		return nil
+	}
+	switch {
+	case canonical.device == attributes.device && canonical.inode == attributes.inode:
+		// already linked to it
+		canonical.layers[layerID] = true
+		return nil
+	case canonical.layers[layerID]:
+		return nil
+	case canonical.device != attributes.device:
+		return nil
+	case attributes.links > 1:
+		// the other links would keep the file anyway, and they
+		// could be there for a reason
+		return nil
+	}
+	// the digest could come from a manifest which doesn't match the file
+	same, err := sameFileContents(canonical.path, path)
+	if err != nil || !same {
+		return err
+	}
+	if !dryRun {
+		tmp := filepath.Join(filepath.Dir(path), ".dedup-"+stringid.GenerateRandomID())
+		if err := os.Link(canonical.path, tmp); err != nil {
+			logrus.Debugf("Linking %q to %q: %v", path, canonical.path, err)
+			return nil
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	canonical.layers[layerID] = true
+	report.Files++
+	report.BytesSaved += info.Size()
+	return nil
+}
+
+// chunkedManifestDigests returns the digests of the regular files of a layer
+// which are recorded in its chunked manifest, if it has one, keyed by their
+// cleaned absolute names.
+func chunkedManifestDigests(rlstore LayerStore, id string) map[string]digest.Digest {
+	rc, err := rlstore.BigData(id, chunkedManifestBigDataKey)
+	if err != nil {
+		return nil
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		logrus.Debugf("Reading the chunked manifest of layer %q: %v", id, err)
+		return nil
+	}
+	files, err := compressor.ParseManifestFiles(data)
+	if err != nil {
+		logrus.Debugf("Parsing the chunked manifest of layer %q: %v", id, err)
+		return nil
+	}
+	digests := make(map[string]digest.Digest)
+	for _, file := range files {
+		// the digests computed with hashers registered with
+		// compressor.RegisterChunkHasher can't be compared
+		if d, err := digest.Parse(file.Digest); err == nil {
+			digests[filepath.Clean("/"+file.Name)] = d
+		}
+	}
+	return digests
+}
+
+// fileDigest computes the digest of the contents of a file.
+func fileDigest(path string) (digest.Digest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return digest.Canonical.FromReader(f)
+}
+
+// sameFileContents compares the contents of two files.
+func sameFileContents(path1, path2 string) (bool, error) {
+	f1, err := os.Open(path1)
+	if err != nil {
+		return false, err
+	}
+	defer f1.Close()
+	f2, err := os.Open(path2)
+	if err != nil {
+		return false, err
+	}
+	defer f2.Close()
+	buf1 := make([]byte, 32*1024)
+	buf2 := make([]byte, 32*1024)
+	for {
+		n1, err1 := io.ReadFull(f1, buf1)
+		n2, err2 := io.ReadFull(f2, buf2)
+		if n1 != n2 || !bytes.Equal(buf1[:n1], buf2[:n2]) {
+			return false, nil
+		}
+		if err1 == io.EOF || err1 == io.ErrUnexpectedEOF {
+			return err2 == io.EOF || err2 == io.ErrUnexpectedEOF, nil
+		}
+		if err1 != nil {
+			return false, err1
+		}
+		if err2 != nil {
+			return false, err2
+		}
+	}
+}
+
+// encodeXattrs encodes extended attributes so that they can be compared.
+func encodeXattrs(xattrs map[string][]byte) string {
+	names := make([]string, 0, len(xattrs))
+	for name := range xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name)
+		b.WriteByte(0)
+		b.Write(xattrs[name])
+		b.WriteByte(0)
+	}
+	return b.String()
+}
@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/containers/storage/pkg/system"
+	"github.com/pkg/errors"
+)
+
+// dedupFileAttributes reads the attributes of a file which DedupLayers()
+// compares.
+func dedupFileAttributes(path string, info os.FileInfo) (dedupAttributes, error) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return dedupAttributes{}, errors.Errorf("reading the attributes of %q", path)
+	}
+	names, err := system.Llistxattr(path)
+	if err != nil && !errors.Is(err, syscall.ENOTSUP) {
+		return dedupAttributes{}, err
+	}
+	xattrs := make(map[string][]byte, len(names))
+	for _, name := range names {
+		value, err := system.Lgetxattr(path, name)
+		if err != nil {
+			return dedupAttributes{}, err
+		}
+		xattrs[name] = value
+	}
+	return dedupAttributes{
+		device: uint64(st.Dev),
+		inode:  st.Ino,
+		links:  uint64(st.Nlink),
+		uid:    st.Uid,
+		gid:    st.Gid,
+		xattrs: encodeXattrs(xattrs),
+	}, nil
+}
@@ -0,0 +1,101 @@
+// +build linux
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDedupLayers(t *testing.T) {
+	store := newTestStore(t)
+
+	shared := strings.Repeat("shared", 1000)
+	first, _, err := store.PutLayer("", "", nil, "", false, nil, makeTestLayerTar(t, map[string]string{
+		"shared": shared,
+		"small":  "small",
+		"first":  "first",
+	}))
+	require.NoError(t, err)
+	second, _, err := store.PutLayer("", "", nil, "", false, nil, makeTestLayerTar(t, map[string]string{
+		"shared":      shared,
+		"shared-copy": shared,
+		"small":       "small",
+		"second":      "second",
+		"not-shared":  strings.Repeat("x", len(shared)),
+		"other-owner": shared,
+	}))
+	require.NoError(t, err)
+	// a manifest whose digest doesn't match the file doesn't fool it
+	manifest := `{"version":1,"entries":[{"type":"reg","name":"not-shared","digest":"` + digest.FromString(shared).String() + `"}]}`
+	require.NoError(t, store.SetLayerBigData(second.ID, chunkedManifestBigDataKey, strings.NewReader(manifest)))
+	image, err := store.CreateImage("", nil, second.ID, "", nil)
+	require.NoError(t, err)
+	container, err := store.CreateContainer("", nil, image.ID, "", "", nil)
+	require.NoError(t, err)
+
+	path := func(id, name string) string {
+		return filepath.Join(store.GraphRoot(), "vfs", "dir", id, name)
+	}
+	linked := func(id1, name1, id2, name2 string) bool {
+		info1, err := os.Lstat(path(id1, name1))
+		require.NoError(t, err)
+		info2, err := os.Lstat(path(id2, name2))
+		require.NoError(t, err)
+		return os.SameFile(info1, info2)
+	}
+	require.NoError(t, os.Lchown(path(second.ID, "other-owner"), 1, 1))
+
+	_, err = store.DedupLayers(DedupOptions{Layers: []string{"no-such-layer"}})
+	require.Error(t, err)
+	_, err = store.DedupLayers(DedupOptions{MinSize: -1})
+	require.Error(t, err)
+
+	options := DedupOptions{MinSize: 10, DryRun: true}
+	report, err := store.DedupLayers(options)
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Files)
+	assert.Equal(t, int64(len(shared)), report.BytesSaved)
+	assert.ElementsMatch(t, []string{first.ID, second.ID}, report.Layers)
+	assert.Equal(t, map[string]string{container.LayerID: "used by a container"}, report.SkippedLayers)
+	assert.False(t, linked(first.ID, "shared", second.ID, "shared"))
+
+	options.DryRun = false
+	report, err = store.DedupLayers(options)
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Files)
+	assert.Equal(t, int64(len(shared)), report.BytesSaved)
+	assert.True(t, linked(first.ID, "shared", second.ID, "shared"))
+	// not two files of the same layer
+	assert.False(t, linked(second.ID, "shared", second.ID, "shared-copy"))
+	// not files below the minimum size, with different owners, or with different contents
+	assert.False(t, linked(first.ID, "small", second.ID, "small"))
+	assert.False(t, linked(first.ID, "shared", second.ID, "other-owner"))
+	assert.False(t, linked(first.ID, "shared", second.ID, "not-shared"))
+	// not the files of a container's layer
+	assert.False(t, linked(first.ID, "shared", container.LayerID, "shared"))
+	data, err := ioutil.ReadFile(path(second.ID, "shared"))
+	require.NoError(t, err)
+	assert.Equal(t, shared, string(data))
+	require.NoError(t, store.VerifyLayer(second.ID))
+
+	// the files which are already linked aren't counted again
+	report, err = store.DedupLayers(options)
+	require.NoError(t, err)
+	assert.Zero(t, report.Files)
+	assert.Zero(t, report.BytesSaved)
+
+	options.MinSize = 0
+	report, err = store.DedupLayers(options)
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Files)
+	assert.Equal(t, int64(len("small")), report.BytesSaved)
+	assert.True(t, linked(first.ID, "small", second.ID, "small"))
+}
@@ -0,0 +1,15 @@
+// +build !linux
+
+package storage
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// dedupFileAttributes reads the attributes of a file which DedupLayers()
+// compares.
+func dedupFileAttributes(path string, info os.FileInfo) (dedupAttributes, error) {
+	return dedupAttributes{}, errors.Wrapf(ErrNotSupported, "reading the attributes of %q", path)
+}
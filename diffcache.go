@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containers/storage/pkg/archive"
+	"github.com/containers/storage/pkg/ioutils"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// DiffCacheOptions is used for passing options to a Store's DiffWithCache()
+// method.
+type DiffCacheOptions struct {
+	DiffOptions
+	// MaxAge, if not zero, is how long a cached diff which isn't used is
+	// kept.
+	MaxAge time.Duration
+	// MaxSize, if positive, is the total size of the cached diffs above
+	// which the ones which were used least recently are removed.
+	MaxSize int64
+}
+
+// diffCacheTempPrefix is the prefix of the names of the files which diffs
+// are written to before they are added to the cache.
+const diffCacheTempPrefix = ".tmp-"
+
+// diffCacheMetadata is what we record alongside a cached diff.
+type diffCacheMetadata struct {
+	Layer  string        `json:"layer"`
+	Digest digest.Digest `json:"digest"`
+}
+
+func (s *store) diffCacheDir() string {
+	return filepath.Join(s.metadataDir(s.graphRoot), s.graphDriverName+"-diff-cache")
+}
+
+// diffCacheKey returns the name of the cache entry for the diff between a
+// layer and its parent using the specified compression.  The layer's digests
+// are part of it, so that a new entry is used once the layer's contents are
+// replaced.
+func diffCacheKey(layer *Layer, compression archive.Compression) string {
+	digester := digest.Canonical.Digester()
+	fmt.Fprintf(digester.Hash(), "%s\n%s\n%s\n%d\n%d\n", layer.ID, layer.UncompressedDigest, layer.CompressedDigest, layer.UncompressedSize, compression)
+	return digester.Digest().Encoded()
+}
+
+// openCachedDiff opens a cached diff, and returns it with its digest and size.
+func openCachedDiff(path string) (*os.File, digest.Digest, int64, error) {
+	data, err := ioutil.ReadFile(path + ".json")
+	if err != nil {
+		return nil, "", -1, err
+	}
+	var metadata diffCacheMetadata
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, "", -1, err
+	}
+	if err := metadata.Digest.Validate(); err != nil {
+		return nil, "", -1, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", -1, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, "", -1, err
+	}
+	return f, metadata.Digest, st.Size(), nil
+}
+
+func (s *store) DiffWithCache(from, to string, options *DiffCacheOptions) (io.ReadCloser, digest.Digest, int64, error) {
+	if options == nil {
+		options = &DiffCacheOptions{}
+	}
+	layer, err := s.Layer(to)
+	if err != nil {
+		return nil, "", -1, err
+	}
+	compression := layer.CompressionType
+	if options.Compression != nil {
+		compression = *options.Compression
+	}
+	dir := s.diffCacheDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, "", -1, err
+	}
+
+	// We can only tell that a cached diff is still current if the layer's
+	// contents were recorded when they were applied, and if it is
+	// compared to its parent.
+	cachePath := ""
+	if layer.UncompressedDigest != "" && (from == "" || from == layer.Parent) {
+		cachePath = filepath.Join(dir, diffCacheKey(layer, compression))
+		f, d, size, err := openCachedDiff(cachePath)
+		if err == nil {
+			now := time.Now()
+			if err := os.Chtimes(cachePath, now, now); err != nil {
+				logrus.Debugf("Failed to update the last use time of %q: %v", cachePath, err)
+			}
+			s.evictDiffCache(options)
+			return f, d, size, nil
+		}
+		if !os.IsNotExist(err) {
+			logrus.Debugf("Ignoring the cached diff %q: %v", cachePath, err)
+		}
+	}
+
+	diff, err := s.Diff(from, layer.ID, &options.DiffOptions)
+	if err != nil {
+		return nil, "", -1, err
+	}
+	defer diff.Close()
+	f, err := ioutil.TempFile(dir, diffCacheTempPrefix)
+	if err != nil {
+		return nil, "", -1, err
+	}
+	succeeded := false
+	defer func() {
+		if !succeeded {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	digester := digest.Canonical.Digester()
+	size, err := io.Copy(io.MultiWriter(f, digester.Hash()), diff)
+	if err != nil {
+		return nil, "", -1, errors.Wrapf(err, "generating the diff for layer %q", layer.ID)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, "", -1, err
+	}
+
+	if cachePath == "" {
+		// We only needed the file to compute the digest and the size.
+		if err := os.Remove(f.Name()); err != nil {
+			return nil, "", -1, err
+		}
+	} else {
+		metadata, err := json.Marshal(diffCacheMetadata{Layer: layer.ID, Digest: digester.Digest()})
+		if err != nil {
+			return nil, "", -1, err
+		}
+		if err := ioutils.AtomicWriteFile(cachePath+".json", metadata, 0600); err != nil {
+			return nil, "", -1, err
+		}
+		if err := os.Rename(f.Name(), cachePath); err != nil {
+			return nil, "", -1, err
+		}
+		s.evictDiffCache(options)
+	}
+	succeeded = true
+	return f, digester.Digest(), size, nil
+}
+
+// evictDiffCache removes the cached diffs which haven't been used for longer
+// than options.MaxAge, and then the ones which were used least recently,
+// until the total size of those which are left isn't over options.MaxSize.
+// Failures are logged rather than returned, since they don't keep the diff
+// which was asked for from being returned.
+func (s *store) evictDiffCache(options *DiffCacheOptions) {
+	if options.MaxAge == 0 && options.MaxSize <= 0 {
+		return
+	}
+	dir := s.diffCacheDir()
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		logrus.Debugf("Failed to list the cached diffs in %q: %v", dir, err)
+		return
+	}
+	var cached []os.FileInfo
+	var total int64
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() || strings.HasPrefix(entry.Name(), diffCacheTempPrefix) || strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		cached = append(cached, entry)
+		total += entry.Size()
+	}
+	sort.Slice(cached, func(i, j int) bool {
+		return cached[i].ModTime().Before(cached[j].ModTime())
+	})
+	now := time.Now()
+	for _, entry := range cached {
+		expired := options.MaxAge != 0 && now.Sub(entry.ModTime()) > options.MaxAge
+		if !expired && (options.MaxSize <= 0 || total <= options.MaxSize) {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			logrus.Debugf("Failed to remove the cached diff %q: %v", path, err)
+			continue
+		}
+		if err := os.Remove(path + ".json"); err != nil && !os.IsNotExist(err) {
+			logrus.Debugf("Failed to remove the metadata of the cached diff %q: %v", path, err)
+		}
+		total -= entry.Size()
+	}
+}
@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containers/storage/pkg/archive"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// cachedDiffs returns the paths of the diffs in the store's diff cache.
+func cachedDiffs(t *testing.T, s Store) []string {
+	paths, err := filepath.Glob(filepath.Join(s.(*store).diffCacheDir(), "*"))
+	require.NoError(t, err)
+	var diffs []string
+	for _, path := range paths {
+		if !strings.HasSuffix(path, ".json") {
+			diffs = append(diffs, path)
+		}
+	}
+	return diffs
+}
+
+func readDiffWithCache(t *testing.T, s Store, id string, options *DiffCacheOptions) ([]byte, digest.Digest) {
+	rc, d, size, err := s.DiffWithCache("", id, options)
+	require.NoError(t, err)
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), size)
+	return data, d
+}
+
+func TestDiffWithCache(t *testing.T) {
+	s := newTestStore(t)
+	layer, _, err := s.PutLayer("", "", nil, "", false, nil, makeTestLayerTar(t, map[string]string{"file": "contents"}))
+	require.NoError(t, err)
+	gzip := archive.Gzip
+	options := &DiffCacheOptions{DiffOptions: DiffOptions{Compression: &gzip}}
+
+	first, d := readDiffWithCache(t, s, layer.ID, options)
+	assert.Equal(t, digest.FromBytes(first), d)
+	diffs := cachedDiffs(t, s)
+	require.Len(t, diffs, 1)
+
+	// The second call returns what was cached, instead of a new diff.
+	require.NoError(t, ioutil.WriteFile(diffs[0], []byte("cached"), 0600))
+	cached, cachedDigest := readDiffWithCache(t, s, layer.ID, options)
+	assert.Equal(t, "cached", string(cached))
+	assert.Equal(t, d, cachedDigest)
+
+	// Other compression settings are cached separately.
+	uncompressed := archive.Uncompressed
+	_, _ = readDiffWithCache(t, s, layer.ID, &DiffCacheOptions{DiffOptions: DiffOptions{Compression: &uncompressed}})
+	assert.Len(t, cachedDiffs(t, s), 2)
+
+	// Once the layer's contents change, the cached diff isn't used.
+	_, err = s.ApplyDiff(layer.ID, makeTestLayerTar(t, map[string]string{"other": "new contents"}))
+	require.NoError(t, err)
+	changed, d := readDiffWithCache(t, s, layer.ID, options)
+	assert.Equal(t, digest.FromBytes(changed), d)
+	assert.NotEqual(t, first, changed)
+	assert.Len(t, cachedDiffs(t, s), 3)
+
+	// Diffs which are too old, then the least recently used ones, are removed.
+	old := time.Now().Add(-time.Hour)
+	for _, path := range cachedDiffs(t, s) {
+		require.NoError(t, os.Chtimes(path, old, old))
+	}
+	_, _ = readDiffWithCache(t, s, layer.ID, &DiffCacheOptions{DiffOptions: options.DiffOptions, MaxAge: time.Minute})
+	assert.Len(t, cachedDiffs(t, s), 1)
+
+	other, _, err := s.PutLayer("", "", nil, "", false, nil, makeTestLayerTar(t, map[string]string{"file": "other contents"}))
+	require.NoError(t, err)
+	_, _ = readDiffWithCache(t, s, other.ID, options)
+	require.Len(t, cachedDiffs(t, s), 2)
+	for _, path := range cachedDiffs(t, s) {
+		require.NoError(t, os.Chtimes(path, old, old))
+	}
+	_, _ = readDiffWithCache(t, s, other.ID, &DiffCacheOptions{DiffOptions: options.DiffOptions, MaxSize: 1})
+	assert.Empty(t, cachedDiffs(t, s))
+	_, _ = readDiffWithCache(t, s, layer.ID, options)
+	_, _ = readDiffWithCache(t, s, other.ID, options)
+	var total int64
+	for _, path := range cachedDiffs(t, s) {
+		st, err := os.Stat(path)
+		require.NoError(t, err)
+		total += st.Size()
+	}
+	_, _ = readDiffWithCache(t, s, other.ID, &DiffCacheOptions{DiffOptions: options.DiffOptions, MaxSize: total - 1})
+	assert.Len(t, cachedDiffs(t, s), 1)
+	_, _ = readDiffWithCache(t, s, other.ID, options)
+	assert.Len(t, cachedDiffs(t, s), 1, "the diff which was used last was removed")
+
+	// Writeable layers aren't cached.
+	container, err := s.CreateLayer("", layer.ID, nil, "", true, nil)
+	require.NoError(t, err)
+	_, _ = readDiffWithCache(t, s, container.ID, options)
+	assert.Len(t, cachedDiffs(t, s), 1)
+}
@@ -578,6 +578,11 @@ func (a *Driver) ApplyDiff(id, parent string, options graphdriver.ApplyDiffOpts)
 	if err = a.applyDiff(id, options.Mappings, options.Diff); err != nil {
 		return
 	}
+	if options.Sync != nil {
+		if err = options.Sync(path.Join(a.rootPath(), "diff", id)); err != nil {
+			return
+		}
+	}
 
 	return directory.Size(path.Join(a.rootPath(), "diff", id))
 }
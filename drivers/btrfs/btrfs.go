@@ -46,8 +46,21 @@ func init() {
 }
 
 type btrfsOptions struct {
-	minSpace uint64
-	size     uint64
+	minSpace    uint64
+	size        uint64
+	compression string
+}
+
+// compressionXattr is the extended attribute through which the compression
+// property of a subvolume is set, as with "btrfs property set".
+const compressionXattr = "btrfs.compression"
+
+// compressionLevels has the range of the levels which can be requested for
+// each compression algorithm, as in "zstd:3".
+var compressionLevels = map[string][2]int{
+	"zlib": {1, 9},
+	"lzo":  {0, 0},
+	"zstd": {1, 15},
 }
 
 // Init returns a new BTRFS driver.
@@ -113,6 +126,11 @@ func parseOptions(opt []string) (btrfsOptions, bool, error) {
 			}
 			userDiskQuota = true
 			options.minSpace = uint64(minSpace)
+		case "btrfs.compression":
+			if err := validateCompression(val); err != nil {
+				return options, userDiskQuota, err
+			}
+			options.compression = val
 		case "btrfs.mountopt":
 			return options, userDiskQuota, fmt.Errorf("btrfs driver does not support mount options")
 		default:
@@ -122,6 +140,50 @@ func parseOptions(opt []string) (btrfsOptions, bool, error) {
 	return options, userDiskQuota, nil
 }
 
+// validateCompression checks that value can be used as the compression
+// property of a subvolume: "none", or the name of an algorithm, optionally
+// followed by a colon and a level.
+func validateCompression(value string) error {
+	if value == "none" {
+		return nil
+	}
+	algorithm, level, hasLevel := value, "", false
+	if i := strings.IndexByte(value, ':'); i >= 0 {
+		algorithm, level, hasLevel = value[:i], value[i+1:], true
+	}
+	levels, ok := compressionLevels[algorithm]
+	if !ok {
+		return fmt.Errorf("btrfs: unknown compression algorithm %q", algorithm)
+	}
+	if !hasLevel {
+		return nil
+	}
+	n, err := strconv.Atoi(level)
+	if err != nil || n < levels[0] || n > levels[1] || levels[1] == 0 {
+		return fmt.Errorf("btrfs: invalid level %q for %s compression", level, algorithm)
+	}
+	return nil
+}
+
+// setCompression sets the compression property of the subvolume at dir,
+// which is inherited by the files created in it and by its snapshots.
+func setCompression(dir, value string) error {
+	if err := unix.Lsetxattr(dir, compressionXattr, []byte(value), 0); err != nil {
+		return errors.Wrapf(err, "btrfs: setting compression %q on %s", value, dir)
+	}
+	return nil
+}
+
+// getCompression returns the compression property of the subvolume at dir,
+// or "" if it is not set.
+func getCompression(dir string) (string, error) {
+	value, err := system.Lgetxattr(dir, compressionXattr)
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
 // Driver contains information about the filesystem mounted.
 type Driver struct {
 	//root of the file system
@@ -485,6 +547,16 @@ func (d *Driver) Create(id, parent string, opts *graphdriver.CreateOpts) error {
 	if err := idtools.MkdirAllAs(subvolumes, 0700, rootUID, rootGID); err != nil {
 		return err
 	}
+
+	var storageOpt map[string]string
+	if opts != nil {
+		storageOpt = opts.StorageOpt
+	}
+	driver := &Driver{}
+	if err := d.parseStorageOpt(storageOpt, driver); err != nil {
+		return err
+	}
+
 	if parent == "" {
 		if err := subvolCreate(subvolumes, id); err != nil {
 			return err
@@ -506,17 +578,19 @@ func (d *Driver) Create(id, parent string, opts *graphdriver.CreateOpts) error {
 		}
 	}
 
-	var storageOpt map[string]string
-	if opts != nil {
-		storageOpt = opts.StorageOpt
+	// a snapshot inherits the compression of its parent, unless another
+	// one is requested
+	compression := driver.options.compression
+	if compression == "" && parent == "" {
+		compression = d.options.compression
 	}
-
-	if _, ok := storageOpt["size"]; ok {
-		driver := &Driver{}
-		if err := d.parseStorageOpt(storageOpt, driver); err != nil {
+	if compression != "" {
+		if err := setCompression(path.Join(subvolumes, id), compression); err != nil {
 			return err
 		}
+	}
 
+	if _, ok := storageOpt["size"]; ok {
 		if err := d.setStorageSize(path.Join(subvolumes, id), driver); err != nil {
 			return err
 		}
@@ -556,6 +630,11 @@ func (d *Driver) parseStorageOpt(storageOpt map[string]string, driver *Driver) e
 				return err
 			}
 			driver.options.size = uint64(size)
+		case "compression":
+			if err := validateCompression(val); err != nil {
+				return err
+			}
+			driver.options.compression = val
 		default:
 			return fmt.Errorf("Unknown option %s", key)
 		}
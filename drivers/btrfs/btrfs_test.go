@@ -3,6 +3,7 @@
 package btrfs
 
 import (
+	"io/ioutil"
 	"os"
 	"path"
 	"testing"
@@ -63,6 +64,77 @@ func TestBtrfsSubvolDelete(t *testing.T) {
 	}
 }
 
+func TestBtrfsSnapshotCompression(t *testing.T) {
+	d := graphtest.GetDriver(t, "btrfs")
+	defer graphtest.PutDriver(t)
+
+	if err := d.Create("compressed", "", &graphdriver.CreateOpts{StorageOpt: map[string]string{"compression": "zstd:3"}}); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Remove("compressed")
+	dir, err := d.Get("compressed", graphdriver.MountOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Put("compressed")
+	if compression, err := getCompression(dir); err != nil || compression != "zstd:3" {
+		t.Fatalf("Compression of the layer is %q (%v), expected zstd:3", compression, err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "file"), []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// a child is a snapshot of its parent, with the same compression
+	// unless another one is requested
+	for _, c := range []struct {
+		id, compression, expected string
+	}{
+		{"snapshot", "", "zstd:3"},
+		{"snapshot-zlib", "zlib", "zlib"},
+	} {
+		var opts *graphdriver.CreateOpts
+		if c.compression != "" {
+			opts = &graphdriver.CreateOpts{StorageOpt: map[string]string{"compression": c.compression}}
+		}
+		if err := d.Create(c.id, "compressed", opts); err != nil {
+			t.Fatal(err)
+		}
+		defer d.Remove(c.id)
+		child, err := d.Get(c.id, graphdriver.MountOpts{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Put(c.id)
+		if subvolume, err := isSubvolume(child); err != nil || !subvolume {
+			t.Fatalf("Layer %q is not a subvolume (%v)", c.id, err)
+		}
+		if data, err := ioutil.ReadFile(path.Join(child, "file")); err != nil || string(data) != "contents" {
+			t.Fatalf("Contents of the parent missing from %q: %q (%v)", c.id, data, err)
+		}
+		if compression, err := getCompression(child); err != nil || compression != c.expected {
+			t.Fatalf("Compression of %q is %q (%v), expected %q", c.id, compression, err, c.expected)
+		}
+	}
+
+	if err := d.Create("invalid", "", &graphdriver.CreateOpts{StorageOpt: map[string]string{"compression": "lzo:3"}}); err == nil {
+		d.Remove("invalid")
+		t.Fatal("Invalid compression accepted")
+	}
+}
+
+func TestValidateCompression(t *testing.T) {
+	for _, value := range []string{"zstd", "zstd:1", "zstd:15", "zlib:9", "lzo", "none"} {
+		if err := validateCompression(value); err != nil {
+			t.Fatalf("%q rejected: %v", value, err)
+		}
+	}
+	for _, value := range []string{"", "gzip", "zstd:", "zstd:0", "zstd:16", "zlib:x", "lzo:1", "none:1"} {
+		if err := validateCompression(value); err == nil {
+			t.Fatalf("%q accepted", value)
+		}
+	}
+}
+
 func TestBtrfsEcho(t *testing.T) {
 	graphtest.DriverTestEcho(t, "btrfs")
 }
@@ -15,6 +15,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
@@ -72,6 +73,27 @@ func CopyRegularToFile(srcPath string, dstFile *os.File, fileinfo os.FileInfo, c
 	return legacyCopy(srcFile, dstFile)
 }
 
+// SupportsReflinks checks if files in dir can be copied using reflinks.
+func SupportsReflinks(dir string) (bool, error) {
+	src, err := ioutil.TempFile(dir, "reflink-check")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(src.Name())
+	defer src.Close()
+	if _, err := src.Write([]byte("reflink check")); err != nil {
+		return false, err
+	}
+	dst, err := ioutil.TempFile(dir, "reflink-check")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, dst.Fd(), C.FICLONE, src.Fd())
+	return errno == 0, nil
+}
+
 // CopyRegular copies the content of a file to another
 func CopyRegular(srcPath, dstPath string, fileinfo os.FileInfo, copyWithFileRange, copyWithFileClone *bool) error { // nolint: golint
 	// If the destination file already exists, we shouldn't blow it away
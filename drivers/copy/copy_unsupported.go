@@ -34,6 +34,11 @@ func CopyRegularToFile(srcPath string, dstFile *os.File, fileinfo os.FileInfo, c
 	return err
 }
 
+// SupportsReflinks checks if files in dir can be copied using reflinks.
+func SupportsReflinks(dir string) (bool, error) {
+	return false, nil
+}
+
 // CopyRegular copies the content of a file to another
 func CopyRegular(srcPath, dstPath string, fileinfo os.FileInfo, copyWithFileRange, copyWithFileClone *bool) error {
 	return chrootarchive.NewArchiver(nil).CopyWithTar(srcPath, dstPath)
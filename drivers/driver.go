@@ -58,7 +58,9 @@ type MountOpts struct {
 	Options []string
 
 	// Volatile specifies whether the container storage can be optimized
-	// at the cost of not syncing all the dirty files in memory.
+	// at the cost of not syncing all the dirty files in memory.  Drivers
+	// which can't do that ignore it.  Changes made through a volatile
+	// mount may be lost if the host crashes, even after it is unmounted.
 	Volatile bool
 
 	// DisableShifting forces the driver to not do any ID shifting at runtime.
@@ -72,6 +74,11 @@ type ApplyDiffOpts struct {
 	MountLabel        string
 	IgnoreChownErrors bool
 	ForceMask         *os.FileMode
+	// Sync, if set, is called with the directory which holds the contents
+	// of the layer once the diff is applied, to flush them to disk.  The
+	// windows driver, which imports layers with the host's API, doesn't
+	// call it.
+	Sync func(dir string) error
 }
 
 // InitFunc initializes the storage driver.
@@ -181,6 +188,9 @@ type DriverWithDifferOutput struct {
 	UncompressedDigest digest.Digest
 	Metadata           string
 	BigData            map[string][]byte
+	// TarSplit, if set, is the uncompressed tar-split metadata for the
+	// layer, which allows the original tarball to be reassembled.
+	TarSplit []byte
 }
 
 // Differ defines the interface for using a custom differ.
@@ -213,6 +223,22 @@ type Capabilities struct {
 	// for consistent tar streams, and avoid extra processing to account
 	// for potential differences (eg: the layer store's use of tar-split).
 	ReproducesExactDiffs bool
+	// NativeDiff is set if the driver computes the differences between a
+	// layer and its parent itself, instead of comparing their contents.
+	NativeDiff bool
+	// Quotas is set if the size of layers can be limited with the "size"
+	// storage option.
+	Quotas bool
+	// Reflinks is set if the driver copies the contents of layers using
+	// reflinks, which share their data until it is modified.
+	Reflinks bool
+	// IDShifting is set if layers can be used with any ID mapping without
+	// changing the ownership of their files, as reported by
+	// SupportsShifting.
+	IDShifting bool
+	// Mounts is set if the driver mounts a file system at a layer's mount
+	// point to make its contents available there.
+	Mounts bool
 }
 
 // CapabilityDriver is the interface for layered file system drivers that
@@ -261,6 +287,49 @@ type DiffGetterDriver interface {
 	DiffGetter(id string) (FileGetCloser, error)
 }
 
+// RepairDriver is the interface for layered file system drivers that can
+// detect and fix inconsistencies in the metadata they keep for layers.
+type RepairDriver interface {
+	Driver
+	// Repair checks the metadata kept for each of the layers in parents,
+	// which maps the ID of each layer to the ID of its parent, or to ""
+	// if it has none, and fixes any inconsistencies it finds.  It returns
+	// a description of each of the fixes which it made.
+	Repair(parents map[string]string) ([]string, error)
+}
+
+// UpperDirDriver is the interface for layered file system drivers which keep
+// the files written to a mounted layer in a directory of their own, such as
+// the upper directory of an overlay mount, which can be watched for changes.
+type UpperDirDriver interface {
+	Driver
+	// UpperDir returns the directory which receives the files written
+	// to the layer.  Deleted files are recorded in it with the driver's
+	// usual whiteouts.
+	UpperDir(id string) (string, error)
+}
+
+// ImageFileDriver is the interface for layered file system drivers that can
+// use a file system image as the contents of a layer.
+type ImageFileDriver interface {
+	Driver
+	// CreateFromImageFile creates a new read-only layer, like Create,
+	// whose contents are those of the file system of type fsType in the
+	// image file.  The file is stored with the layer, and it is mounted
+	// read-only while the layer, or a layer based on it, is mounted.
+	CreateFromImageFile(id, parent, image, fsType string, opts *CreateOpts) error
+}
+
+// AdditionalImageStoreDriver is the interface for layered file system drivers
+// whose additional image stores can be changed after they are initialized.
+type AdditionalImageStoreDriver interface {
+	Driver
+	// SetAdditionalImageStores replaces the list of additional image
+	// stores, which AdditionalImageStores returns, and in which the
+	// contents of read-only layers are looked up.
+	SetAdditionalImageStores(stores []string) error
+}
+
 // FileGetCloser extends the storage.FileGetter interface with a Close method
 // for cleaning up.
 type FileGetCloser interface {
@@ -184,6 +184,11 @@ func (gdw *NaiveDiffDriver) ApplyDiff(id, parent string, options ApplyDiffOpts)
 		return
 	}
 	logrus.Debugf("Untar time: %vs", time.Now().UTC().Sub(start).Seconds())
+	if options.Sync != nil {
+		if err = options.Sync(layerFs); err != nil {
+			return
+		}
+	}
 
 	return
 }
@@ -8,13 +8,13 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"syscall"
 
 	"github.com/containers/storage/pkg/archive"
 	"github.com/containers/storage/pkg/ioutils"
 	"github.com/containers/storage/pkg/mount"
 	"github.com/containers/storage/pkg/system"
-	"github.com/containers/storage/pkg/unshare"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
@@ -23,8 +23,9 @@ import (
 // doesSupportNativeDiff checks whether the filesystem has a bug
 // which copies up the opaque flag when copying up an opaque
 // directory or the kernel enable CONFIG_OVERLAY_FS_REDIRECT_DIR.
-// When these exist naive diff should be used.
-func doesSupportNativeDiff(d, mountOpts string) error {
+// When these exist naive diff should be used.  userxattr selects whether
+// overlay is mounted with the "userxattr" option.
+func doesSupportNativeDiff(d, mountOpts string, userxattr bool) error {
 	td, err := ioutil.TempDir(d, "opaque-bug-check")
 	if err != nil {
 		return err
@@ -56,12 +57,12 @@ func doesSupportNativeDiff(d, mountOpts string) error {
 	}
 
 	// Mark l2/d as opaque
-	if err := system.Lsetxattr(filepath.Join(td, "l2", "d"), archive.GetOverlayXattrName("opaque"), []byte("y"), 0); err != nil {
+	if err := system.Lsetxattr(filepath.Join(td, "l2", "d"), archive.GetOverlayXattrNameWithUserXattr("opaque", userxattr), []byte("y"), 0); err != nil {
 		return errors.Wrap(err, "failed to set opaque flag on middle layer")
 	}
 
 	mountFlags := "lowerdir=%s:%s,upperdir=%s,workdir=%s"
-	if unshare.IsRootless() {
+	if userxattr {
 		mountFlags = mountFlags + ",userxattr"
 	}
 
@@ -85,7 +86,7 @@ func doesSupportNativeDiff(d, mountOpts string) error {
 	}
 
 	// Check l3/d does not have opaque flag
-	xattrOpaque, err := system.Lgetxattr(filepath.Join(td, "l3", "d"), archive.GetOverlayXattrName("opaque"))
+	xattrOpaque, err := system.Lgetxattr(filepath.Join(td, "l3", "d"), archive.GetOverlayXattrNameWithUserXattr("opaque", userxattr))
 	if err != nil {
 		return errors.Wrap(err, "failed to read opaque flag on upper layer")
 	}
@@ -102,7 +103,7 @@ func doesSupportNativeDiff(d, mountOpts string) error {
 		return errors.Wrap(err, "failed to rename dir in merged directory")
 	}
 	// get the xattr of "d2"
-	xattrRedirect, err := system.Lgetxattr(filepath.Join(td, "l3", "d2"), archive.GetOverlayXattrName("redirect"))
+	xattrRedirect, err := system.Lgetxattr(filepath.Join(td, "l3", "d2"), archive.GetOverlayXattrNameWithUserXattr("redirect", userxattr))
 	if err != nil {
 		return errors.Wrap(err, "failed to read redirect flag on upper layer")
 	}
@@ -117,8 +118,9 @@ func doesSupportNativeDiff(d, mountOpts string) error {
 // doesMetacopy checks if the filesystem is going to optimize changes to
 // metadata by using nodes marked with an "overlay.metacopy" attribute to avoid
 // copying up a file from a lower layer unless/until its contents are being
-// modified
-func doesMetacopy(d, mountOpts string) (bool, error) {
+// modified.  userxattr selects whether overlay is mounted with the
+// "userxattr" option.
+func doesMetacopy(d, mountOpts string, userxattr bool) (bool, error) {
 	td, err := ioutil.TempDir(d, "metacopy-check")
 	if err != nil {
 		return false, err
@@ -147,7 +149,7 @@ func doesMetacopy(d, mountOpts string) (bool, error) {
 	}
 	// Mount using the mandatory options and configured options
 	opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", path.Join(td, "l1"), path.Join(td, "l2"), path.Join(td, "work"))
-	if unshare.IsRootless() {
+	if userxattr {
 		opts = fmt.Sprintf("%s,userxattr", opts)
 	}
 	flags, data := mount.ParseOptions(mountOpts)
@@ -171,7 +173,7 @@ func doesMetacopy(d, mountOpts string) (bool, error) {
 	if err := os.Chmod(filepath.Join(td, "merged", "f"), 0600); err != nil {
 		return false, errors.Wrap(err, "error changing permissions on file for metacopy check")
 	}
-	metacopy, err := system.Lgetxattr(filepath.Join(td, "l2", "f"), archive.GetOverlayXattrName("metacopy"))
+	metacopy, err := system.Lgetxattr(filepath.Join(td, "l2", "f"), archive.GetOverlayXattrNameWithUserXattr("metacopy", userxattr))
 	if err != nil {
 		if errors.Is(err, unix.ENOTSUP) {
 			logrus.Info("metacopy option not supported")
@@ -218,3 +220,55 @@ func doesVolatile(d string) (bool, error) {
 	}()
 	return true, nil
 }
+
+// doesXino checks if the kernel supports the "xino" mount option, and is
+// able to use it with the file system of d: if it isn't, the kernel accepts
+// the option but turns it off.
+func doesXino(d string) (bool, error) {
+	td, err := ioutil.TempDir(d, "xino-check")
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err := os.RemoveAll(td); err != nil {
+			logrus.Warnf("Failed to remove check directory %v: %v", td, err)
+		}
+	}()
+
+	for _, dir := range []string{"lower", "upper", "work", "merged"} {
+		if err := os.Mkdir(filepath.Join(td, dir), 0755); err != nil {
+			return false, err
+		}
+	}
+	merged := filepath.Join(td, "merged")
+	opts := fmt.Sprintf("xino=on,lowerdir=%s,upperdir=%s,workdir=%s", path.Join(td, "lower"), path.Join(td, "upper"), path.Join(td, "work"))
+	if err := unix.Mount("overlay", merged, "overlay", 0, opts); err != nil {
+		return false, errors.Wrapf(err, "failed to mount overlay for xino check")
+	}
+	defer func() {
+		if err := unix.Unmount(merged, 0); err != nil {
+			logrus.Warnf("Failed to unmount check directory %v: %v", merged, err)
+		}
+	}()
+	mounts, err := mount.GetMounts()
+	if err != nil {
+		return false, err
+	}
+	for _, m := range mounts {
+		if m.Mountpoint == merged {
+			return hasXinoOn(m.VFSOptions), nil
+		}
+	}
+	return false, errors.Errorf("overlay mounted for xino check not found at %q", merged)
+}
+
+// hasXinoOn checks if the options of an overlay mount, as listed in
+// /proc/self/mountinfo, say that xino is in use.
+func hasXinoOn(options string) bool {
+	for _, o := range strings.Split(options, ",") {
+		if o == "xino=on" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,201 @@
+// +build linux
+
+package overlay
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	graphdriver "github.com/containers/storage/drivers"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// imageFile is the name of the file system image, in the directory
+	// of a layer created with CreateFromImageFile, which is mounted on
+	// the layer's diff directory.
+	imageFile = "image"
+	// imageFSTypeFile records the type of the file system in imageFile.
+	imageFSTypeFile = "image-fstype"
+)
+
+// CreateFromImageFile creates a read-only layer whose contents are the file
+// system of type fsType, such as "ext4" or "erofs", in image.  The image is
+// hard linked, or copied, into the layer's directory, and loop-mounted
+// read-only on the layer's diff directory while a mount which uses the layer
+// exists.
+func (d *Driver) CreateFromImageFile(id, parent, image, fsType string, opts *graphdriver.CreateOpts) (retErr error) {
+	if fsType == "" || strings.ContainsAny(fsType, ",\n") {
+		return fmt.Errorf("invalid file system type %q for image %q", fsType, image)
+	}
+	st, err := os.Stat(image)
+	if err != nil {
+		return err
+	}
+	if !st.Mode().IsRegular() {
+		return fmt.Errorf("image %q is not a regular file", image)
+	}
+	if err := d.Create(id, parent, opts); err != nil {
+		return err
+	}
+	defer func() {
+		if retErr != nil {
+			if err := d.Remove(id); err != nil {
+				logrus.Errorf("Removing layer %q after failing to use image %q: %v", id, image, err)
+			}
+		}
+	}()
+
+	dir := d.dir(id)
+	if err := linkOrCopyFile(image, path.Join(dir, imageFile)); err != nil {
+		return errors.Wrapf(err, "storing image %q in layer %q", image, id)
+	}
+	return ioutil.WriteFile(path.Join(dir, imageFSTypeFile), []byte(fsType), 0600)
+}
+
+// linkOrCopyFile makes dest a hard link to src, or a copy of it if they are
+// on different file systems.
+func linkOrCopyFile(src, dest string) error {
+	if err := os.Link(src, dest); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dest)
+		return err
+	}
+	return out.Close()
+}
+
+// imageLayerDiffs returns the diff directories of the layers, among the one
+// with the specified ID and the ones it is based on, which were created with
+// CreateFromImageFile.
+func (d *Driver) imageLayerDiffs(id string) ([]string, error) {
+	lowers, err := d.getLowerDirs(id)
+	if err != nil {
+		return nil, err
+	}
+	var diffs []string
+	for _, diff := range append([]string{path.Join(d.dir(id), "diff")}, lowers...) {
+		if _, err := os.Stat(filepath.Join(filepath.Dir(diff), imageFile)); err == nil {
+			diffs = append(diffs, diff)
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return diffs, nil
+}
+
+// mountImageLayers mounts the image of each of the layers whose diff
+// directories are in diffs, unless it is already in use.
+func (d *Driver) mountImageLayers(diffs []string) (retErr error) {
+	var mounted []string
+	defer func() {
+		if retErr != nil {
+			d.unmountImageLayers(mounted)
+		}
+	}()
+	for _, diff := range diffs {
+		if d.imageCtr.Increment(diff) > 1 {
+			mounted = append(mounted, diff)
+			continue
+		}
+		if err := mountImageFile(filepath.Dir(diff), diff); err != nil {
+			d.imageCtr.Decrement(diff)
+			return err
+		}
+		mounted = append(mounted, diff)
+	}
+	return nil
+}
+
+// unmountImageLayers releases the images mounted by mountImageLayers.
+func (d *Driver) unmountImageLayers(diffs []string) {
+	for _, diff := range diffs {
+		if d.imageCtr.Decrement(diff) > 0 {
+			continue
+		}
+		if err := unix.Unmount(diff, unix.MNT_DETACH); err != nil && err != unix.EINVAL && !os.IsNotExist(err) {
+			logrus.Debugf("Failed to unmount image on %s: %v", diff, err)
+		}
+	}
+}
+
+// mountImageFile mounts the image in the layer directory dir on target,
+// read-only, using a loop device.
+func mountImageFile(dir, target string) error {
+	fsType, err := ioutil.ReadFile(path.Join(dir, imageFSTypeFile))
+	if err != nil {
+		return err
+	}
+	loop, err := attachLoopDevice(path.Join(dir, imageFile))
+	if err != nil {
+		return err
+	}
+	// The loop device is released once it is unmounted, since it is set
+	// to be cleared automatically when it is no longer used.
+	defer loop.Close()
+	if err := unix.Mount(loop.Name(), target, string(fsType), unix.MS_RDONLY, ""); err != nil {
+		return errors.Wrapf(err, "mounting %s image of %q on %q", fsType, dir, target)
+	}
+	return nil
+}
+
+// attachLoopDevice attaches image, read-only, to a free loop device, which is
+// released when it is no longer open or mounted.
+func attachLoopDevice(image string) (*os.File, error) {
+	file, err := os.Open(image)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	ctl, err := os.OpenFile("/dev/loop-control", os.O_RDWR, 0)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening the loop device control file")
+	}
+	defer ctl.Close()
+
+	for {
+		index, err := unix.IoctlRetInt(int(ctl.Fd()), unix.LOOP_CTL_GET_FREE)
+		if err != nil {
+			return nil, errors.Wrapf(err, "finding a free loop device")
+		}
+		loop, err := os.OpenFile(fmt.Sprintf("/dev/loop%d", index), os.O_RDONLY, 0)
+		if err != nil {
+			return nil, err
+		}
+		if err := unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_SET_FD, int(file.Fd())); err != nil {
+			loop.Close()
+			if err == unix.EBUSY {
+				// someone else took it first
+				continue
+			}
+			return nil, errors.Wrapf(err, "attaching %q to %s", image, loop.Name())
+		}
+		info := unix.LoopInfo64{Flags: unix.LO_FLAGS_AUTOCLEAR | unix.LO_FLAGS_READ_ONLY}
+		copy(info.File_name[:], image)
+		if _, _, errno := unix.Syscall(unix.SYS_IOCTL, loop.Fd(), unix.LOOP_SET_STATUS64, uintptr(unsafe.Pointer(&info))); errno != 0 {
+			_ = unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_CLR_FD, 0)
+			loop.Close()
+			return nil, errors.Wrapf(errno, "setting up %s for %q", loop.Name(), image)
+		}
+		return loop, nil
+	}
+}
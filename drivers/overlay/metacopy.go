@@ -0,0 +1,254 @@
+// +build linux
+
+package overlay
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/containers/storage/pkg/system"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const capabilityXattr = "security.capability"
+
+// useMetacopyDiffs tells whether the files of the diffs applied to layers
+// can be stored as metadata-only copies of the files in the lower layers.
+func (d *Driver) useMetacopyDiffs() bool {
+	return d.usingMetacopy && d.options.mountProgram == ""
+}
+
+// isMetacopy tells whether the file at path is a metadata-only copy of a file
+// in a lower layer.
+func (d *Driver) isMetacopy(path string) (bool, error) {
+	value, err := system.Lgetxattr(path, d.overlayXattrName("metacopy"))
+	if err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			return false, nil
+		}
+		return false, err
+	}
+	return value != nil, nil
+}
+
+// hasMetacopyFiles tells whether diffDir contains metadata-only copies of
+// files, which the native diff can't be used for, since their contents are
+// only in the lower layers.
+func (d *Driver) hasMetacopyFiles(diffDir string) (bool, error) {
+	found := false
+	err := filepath.Walk(diffDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if found, err = d.isMetacopy(path); err != nil {
+			return err
+		}
+		if found {
+			return io.EOF
+		}
+		return nil
+	})
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	return found, nil
+}
+
+// metacopyUnchangedFiles turns the regular files in diffDir which have the
+// same contents as the files that they replace in lowers, ordered from the
+// topmost, into metadata-only copies, so that a diff which only changes the
+// owners, permissions or times of files doesn't store their contents again.
+func (d *Driver) metacopyUnchangedFiles(diffDir string, lowers []string) error {
+	return filepath.Walk(diffDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || info.Size() == 0 {
+			return nil
+		}
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok || st.Nlink != 1 {
+			return nil
+		}
+		if metacopy, err := d.isMetacopy(path); err != nil || metacopy {
+			return err
+		}
+		rel, err := filepath.Rel(diffDir, path)
+		if err != nil {
+			return err
+		}
+		lower, err := d.findLowerData(rel, diffDir, lowers)
+		if err != nil || lower == "" {
+			return err
+		}
+		same, err := sameContents(path, lower, info.Size())
+		if err != nil || !same {
+			return err
+		}
+		if err := d.makeMetacopy(path, info, st); err != nil {
+			return errors.Wrapf(err, "storing %q as a metadata-only copy", path)
+		}
+		return nil
+	})
+}
+
+// findLowerData returns the path of the file whose contents overlay would use
+// for a metadata-only copy of rel in upper, or "" if there is none.  Lower
+// directories which are opaque, or which are redirected to other paths,
+// aren't followed.
+func (d *Driver) findLowerData(rel, upper string, lowers []string) (string, error) {
+	var parents []string
+	for dir := filepath.Dir(rel); dir != "."; dir = filepath.Dir(dir) {
+		parents = append(parents, dir)
+	}
+	for _, layer := range append([]string{upper}, lowers...) {
+		opaque := false
+		for _, parent := range parents {
+			info, err := os.Lstat(filepath.Join(layer, parent))
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return "", err
+			}
+			if !info.IsDir() {
+				return "", nil
+			}
+			dir := filepath.Join(layer, parent)
+			if redirect, err := system.Lgetxattr(dir, d.overlayXattrName("redirect")); err != nil && !errors.Is(err, unix.ENOTSUP) {
+				return "", err
+			} else if redirect != nil {
+				return "", nil
+			}
+			if value, err := system.Lgetxattr(dir, d.overlayXattrName("opaque")); err != nil && !errors.Is(err, unix.ENOTSUP) {
+				return "", err
+			} else if len(value) == 1 && value[0] == 'y' {
+				opaque = true
+			}
+		}
+		if layer != upper {
+			path := filepath.Join(layer, rel)
+			info, err := os.Lstat(path)
+			switch {
+			case err == nil:
+				if !info.Mode().IsRegular() {
+					return "", nil
+				}
+				metacopy, err := d.isMetacopy(path)
+				if err != nil {
+					return "", err
+				}
+				if !metacopy {
+					return path, nil
+				}
+			case !os.IsNotExist(err):
+				return "", err
+			}
+		}
+		if opaque {
+			return "", nil
+		}
+	}
+	return "", nil
+}
+
+// sameContents tells whether the files a and b both have size bytes of the
+// same contents.
+func sameContents(a, b string, size int64) (bool, error) {
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+	info, err := fb.Stat()
+	if err != nil || info.Size() != size {
+		return false, err
+	}
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+
+	bufA := make([]byte, 64*1024)
+	bufB := make([]byte, len(bufA))
+	for {
+		n, errA := io.ReadFull(fa, bufA)
+		m, errB := io.ReadFull(fb, bufB)
+		if n != m || !bytes.Equal(bufA[:n], bufB[:m]) {
+			return false, nil
+		}
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			return errB == io.EOF || errB == io.ErrUnexpectedEOF, nil
+		}
+		if errA != nil {
+			return false, errA
+		}
+		if errB != nil {
+			return false, errB
+		}
+	}
+}
+
+// makeMetacopy drops the contents of the file at path, which has the metadata
+// in info and st, and marks it as a metadata-only copy.
+func (d *Driver) makeMetacopy(path string, info os.FileInfo, st *syscall.Stat_t) error {
+	// Truncating the file drops its file capabilities, so they are saved
+	// to be set again.
+	capability, err := system.Lgetxattr(path, capabilityXattr)
+	if err != nil && !errors.Is(err, unix.ENOTSUP) {
+		return err
+	}
+	// The file is marked first, so that overlay reads the same contents
+	// from the lower layer if it can't be truncated.  It keeps its size,
+	// which overlay reports for metadata-only copies, but none of its
+	// blocks.
+	if err := system.Lsetxattr(path, d.overlayXattrName("metacopy"), []byte{}, 0); err != nil {
+		return err
+	}
+	if err := os.Truncate(path, 0); err != nil {
+		return err
+	}
+	if err := os.Truncate(path, info.Size()); err != nil {
+		return err
+	}
+	if capability != nil {
+		if err := system.Lsetxattr(path, capabilityXattr, capability, 0); err != nil {
+			return err
+		}
+	}
+	if err := os.Chmod(path, info.Mode()); err != nil {
+		return err
+	}
+	times := []unix.Timespec{
+		unix.NsecToTimespec(syscall.TimespecToNsec(st.Atim)),
+		unix.NsecToTimespec(syscall.TimespecToNsec(st.Mtim)),
+	}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, times, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// metacopyDiff stores the files in the diff of id whose contents are the same
+// as in its lower layers as metadata-only copies.
+func (d *Driver) metacopyDiff(id string) error {
+	if !d.useMetacopyDiffs() {
+		return nil
+	}
+	diffDir, err := d.getDiffPath(id)
+	if err != nil {
+		return err
+	}
+	lowers, err := d.getLowerDiffPaths(id)
+	if err != nil || len(lowers) == 0 {
+		return err
+	}
+	logrus.Debugf("Storing unchanged files in %s as metadata-only copies", diffDir)
+	return d.metacopyUnchangedFiles(diffDir, lowers)
+}
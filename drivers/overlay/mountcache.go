@@ -0,0 +1,110 @@
+// +build linux
+
+package overlay
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// cachedLowersDir is where, in the directory of a layer, the
+	// read-only overlay of the layer and its lowers is mounted when the
+	// mount_cache option is set, to be used as the single lower of the
+	// layers based on it.
+	cachedLowersDir = "cached-lowers"
+	// cachedLowersFile records, in the directory of a mounted layer, the
+	// ID of the parent whose cached lowers it uses.
+	cachedLowersFile = "cached-lowers-parent"
+)
+
+// cachedLowersParent returns the ID of the parent of the layer whose lowers
+// are lowers, as resolved from splitLowers, if its lowers can be replaced by
+// a cached mount of them.  It returns "" if they can't, because the option
+// isn't set, because there is nothing to gain from it, because the parent is
+// not in the driver's home directory, or because the lowers are too many to
+// be mounted without using relative paths.
+func (d *Driver) cachedLowersParent(splitLowers, lowers []string) string {
+	if !d.options.mountCache || d.options.mountProgram != "" || d.usingMetacopy {
+		return ""
+	}
+	if len(lowers) < 2 || len(splitLowers) == 0 || lowers[0] != path.Join(d.home, splitLowers[0]) {
+		return ""
+	}
+	if len("lowerdir=")+len(strings.Join(lowers, ":")) >= unix.Getpagesize() {
+		return ""
+	}
+	target, err := os.Readlink(lowers[0])
+	if err != nil {
+		return ""
+	}
+	parent := filepath.Base(filepath.Dir(target))
+	if d.dir(parent) != path.Join(d.home, parent) {
+		return ""
+	}
+	return parent
+}
+
+// mountCachedLowers mounts lowers, the lowers of a child of parent, as a
+// read-only overlay in parent's directory, unless they are already mounted
+// there, and returns where they are mounted.  The mount is kept until every
+// call is matched by a call to releaseCachedLowers.
+func (d *Driver) mountCachedLowers(parent string, lowers []string) (string, error) {
+	d.locker.Lock(parent)
+	defer d.locker.Unlock(parent)
+
+	mountpoint := path.Join(d.dir(parent), cachedLowersDir)
+	if count := d.cachedLowersCtr.Increment(mountpoint); count > 1 {
+		return mountpoint, nil
+	}
+	if err := os.MkdirAll(mountpoint, 0700); err != nil {
+		d.cachedLowersCtr.Decrement(mountpoint)
+		return "", err
+	}
+	opts := fmt.Sprintf("lowerdir=%s", strings.Join(lowers, ":"))
+	if err := unix.Mount("overlay", mountpoint, "overlay", unix.MS_RDONLY, opts); err != nil {
+		d.cachedLowersCtr.Decrement(mountpoint)
+		return "", errors.Wrapf(err, "mounting the lowers of layer %s on %q", parent, mountpoint)
+	}
+	logrus.Debugf("overlay: mounted the lowers of layer %s on %s", parent, mountpoint)
+	return mountpoint, nil
+}
+
+// releaseCachedLowers releases the mount of the lowers of a child of parent
+// made by mountCachedLowers, and unmounts them if they are no longer used.
+func (d *Driver) releaseCachedLowers(parent string) {
+	d.locker.Lock(parent)
+	defer d.locker.Unlock(parent)
+
+	mountpoint := path.Join(d.dir(parent), cachedLowersDir)
+	if count := d.cachedLowersCtr.Decrement(mountpoint); count > 0 {
+		return
+	}
+	if err := unix.Unmount(mountpoint, unix.MNT_DETACH); err != nil && err != unix.EINVAL && !os.IsNotExist(err) {
+		logrus.Debugf("Failed to unmount the lowers of layer %s: %v", parent, err)
+	}
+	if err := unix.Rmdir(mountpoint); err != nil && !os.IsNotExist(err) {
+		logrus.Debugf("Failed to remove mountpoint %s: %v", mountpoint, err)
+	}
+}
+
+// releaseCachedLowersOf releases the cached lowers used by the mount of the
+// layer in dir, if it used any.
+func (d *Driver) releaseCachedLowersOf(dir string) {
+	parent, err := ioutil.ReadFile(path.Join(dir, cachedLowersFile))
+	if err != nil {
+		return
+	}
+	if err := os.Remove(path.Join(dir, cachedLowersFile)); err != nil {
+		logrus.Debugf("Failed to remove %s: %v", path.Join(dir, cachedLowersFile), err)
+	}
+	d.releaseCachedLowers(string(parent))
+}
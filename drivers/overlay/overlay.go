@@ -12,6 +12,7 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -25,6 +26,7 @@ import (
 	"github.com/containers/storage/pkg/directory"
 	"github.com/containers/storage/pkg/fsutils"
 	"github.com/containers/storage/pkg/idtools"
+	"github.com/containers/storage/pkg/ioutils"
 	"github.com/containers/storage/pkg/locker"
 	"github.com/containers/storage/pkg/mount"
 	"github.com/containers/storage/pkg/parsers"
@@ -81,9 +83,15 @@ const (
 
 const (
 	linkDir   = "l"
+	trashDir  = "trash"
 	lowerFile = "lower"
 	maxDepth  = 128
 
+	// volatileFile is created in a layer's directory when it is mounted
+	// with the "volatile" option, and records the ID of the boot during
+	// which that happened.
+	volatileFile = "volatile"
+
 	// idLength represents the number of random characters
 	// which can be used to create the unique link identifier
 	// for every layer. If this value is too long then the
@@ -103,6 +111,10 @@ type overlayOptions struct {
 	mountOptions      string
 	ignoreChownErrors bool
 	forceMask         *os.FileMode
+	userxattr         *bool
+	xino              bool
+	mountCache        bool
+	asyncRemove       bool
 }
 
 // Driver contains information about the home directory and the list of active mounts that are created using this driver.
@@ -113,11 +125,16 @@ type Driver struct {
 	uidMaps          []idtools.IDMap
 	gidMaps          []idtools.IDMap
 	ctr              *graphdriver.RefCounter
+	imageCtr         *graphdriver.RefCounter
+	cachedLowersCtr  *graphdriver.RefCounter
+	trash            *graphdriver.Trash
 	quotaCtl         *quota.Control
 	options          overlayOptions
+	imageStoresLock  sync.RWMutex
 	naiveDiff        graphdriver.DiffDriver
 	supportsDType    bool
 	supportsVolatile *bool
+	supportsXino     *bool
 	usingMetacopy    bool
 	locker           *locker.Locker
 }
@@ -173,10 +190,76 @@ func hasVolatileOption(opts []string) bool {
 	return false
 }
 
+// conflictingMountOptions lists pairs of mount options which can not both be
+// used for the same mount.
+var conflictingMountOptions = [][2]string{
+	{"dev", "nodev"},
+	{"exec", "noexec"},
+	{"suid", "nosuid"},
+}
+
+// validateMountOptions checks that the options which were requested for a
+// mount can be used together.
+func validateMountOptions(opts []string, readWrite, volatile bool) error {
+	if !readWrite && (volatile || hasVolatileOption(opts)) {
+		return fmt.Errorf("overlay: volatile mounts must be writable")
+	}
+	requested := make(map[string]bool)
+	for _, o := range opts {
+		requested[o] = true
+	}
+	for _, pair := range conflictingMountOptions {
+		if requested[pair[0]] && requested[pair[1]] {
+			return fmt.Errorf("overlay: mount options %q and %q can not be used together", pair[0], pair[1])
+		}
+	}
+	return nil
+}
+
 func getMountProgramFlagFile(path string) string {
 	return filepath.Join(path, ".has-mount-program")
 }
 
+// currentBootID returns the kernel's identifier for the current boot of the
+// host.
+func currentBootID() (string, error) {
+	data, err := ioutil.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// recordVolatileMount notes in the layer directory dir that the layer is
+// being mounted with the "volatile" option.  Changes made through such a
+// mount aren't synced to disk, not even when it is unmounted, so they are
+// lost if the host crashes before the kernel writes them back.
+func recordVolatileMount(dir string) error {
+	bootID, err := currentBootID()
+	if err != nil {
+		return err
+	}
+	return ioutils.AtomicWriteFile(filepath.Join(dir, volatileFile), []byte(bootID), 0600)
+}
+
+// volatileMountBeforeReboot checks if the layer in directory dir was mounted
+// with the "volatile" option before the host was last restarted, in which
+// case some of the changes made to it may have been lost.
+func volatileMountBeforeReboot(dir string) (bool, error) {
+	recorded, err := ioutil.ReadFile(filepath.Join(dir, volatileFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	bootID, err := currentBootID()
+	if err != nil {
+		return false, err
+	}
+	return string(recorded) != bootID, nil
+}
+
 func checkSupportVolatile(home, runhome string) (bool, error) {
 	feature := fmt.Sprintf("volatile")
 	volatileCacheResult, _, err := cachedFeatureCheck(runhome, feature)
@@ -204,6 +287,29 @@ func checkSupportVolatile(home, runhome string) (bool, error) {
 	return usingVolatile, nil
 }
 
+func checkSupportXino(home, runhome string) (bool, error) {
+	feature := "xino"
+	xinoCacheResult, _, err := cachedFeatureCheck(runhome, feature)
+	if err == nil {
+		if xinoCacheResult {
+			logrus.Debugf("Cached value indicated that xino is supported")
+		} else {
+			logrus.Debugf("Cached value indicated that xino is not supported")
+		}
+		return xinoCacheResult, nil
+	}
+	supportsXino, err := doesXino(home)
+	if err != nil {
+		logrus.Debugf("overlay: test mount indicated that xino is not supported: %v", err)
+	} else {
+		logrus.Debugf("overlay: test mount indicated that xino is supported")
+	}
+	if err := cachedFeatureRecord(runhome, feature, supportsXino, ""); err != nil {
+		return false, errors.Wrap(err, "recording xino support status")
+	}
+	return supportsXino, nil
+}
+
 func checkAndRecordOverlaySupport(fsMagic graphdriver.FsMagic, home, runhome string) (bool, error) {
 	var supportsDType bool
 
@@ -257,6 +363,33 @@ func (d *Driver) getSupportsVolatile() (bool, error) {
 	return supportsVolatile, nil
 }
 
+func (d *Driver) getSupportsXino() (bool, error) {
+	if d.supportsXino != nil {
+		return *d.supportsXino, nil
+	}
+	supportsXino, err := checkSupportXino(d.home, d.runhome)
+	if err != nil {
+		return false, err
+	}
+	d.supportsXino = &supportsXino
+	return supportsXino, nil
+}
+
+// useXino checks if "xino=on" should be added to the options used to mount
+// a layer: only if it was requested, if it wasn't already specified in a
+// different form, and if the kernel supports it.
+func (d *Driver) useXino(opts []string) (bool, error) {
+	if !d.options.xino || d.options.mountProgram != "" {
+		return false, nil
+	}
+	for _, o := range opts {
+		if strings.HasPrefix(o, "xino=") {
+			return false, nil
+		}
+	}
+	return d.getSupportsXino()
+}
+
 // isNetworkFileSystem checks if the specified file system is supported by native overlay
 // as backing store when running in a user namespace.
 func isNetworkFileSystem(fsMagic graphdriver.FsMagic) bool {
@@ -351,7 +484,7 @@ func Init(home string, options graphdriver.Options) (graphdriver.Driver, error)
 			}
 			usingMetacopy = metacopyCacheResult
 		} else {
-			usingMetacopy, err = doesMetacopy(home, opts.mountOptions)
+			usingMetacopy, err = doesMetacopy(home, opts.mountOptions, opts.useUserXattr())
 			if err == nil {
 				if usingMetacopy {
 					logrus.Debugf("overlay: test mount indicated that metacopy is being used")
@@ -386,6 +519,8 @@ func Init(home string, options graphdriver.Options) (graphdriver.Driver, error)
 		uidMaps:          options.UIDMaps,
 		gidMaps:          options.GIDMaps,
 		ctr:              graphdriver.NewRefCounter(graphdriver.NewFsChecker(fileSystemType)),
+		imageCtr:         graphdriver.NewRefCounter(graphdriver.NewDefaultChecker()),
+		cachedLowersCtr:  graphdriver.NewRefCounter(graphdriver.NewDefaultChecker()),
 		supportsDType:    supportsDType,
 		usingMetacopy:    usingMetacopy,
 		supportsVolatile: supportsVolatile,
@@ -394,6 +529,11 @@ func Init(home string, options graphdriver.Options) (graphdriver.Driver, error)
 	}
 
 	d.naiveDiff = graphdriver.NewNaiveDiffDriver(d, graphdriver.NewNaiveLayerIDMapUpdater(d))
+	if opts.asyncRemove {
+		if d.trash, err = graphdriver.NewTrash(path.Join(home, trashDir)); err != nil {
+			return nil, err
+		}
+	}
 	if backingFs == "xfs" {
 		// Try to enable project quota support over xfs.
 		if d.quotaCtl, err = quota.NewControl(home); err == nil {
@@ -448,16 +588,9 @@ func parseOptions(options []string) (*overlayOptions, error) {
 				continue
 			}
 			for _, store := range strings.Split(val, ",") {
-				store = filepath.Clean(store)
-				if !filepath.IsAbs(store) {
-					return nil, fmt.Errorf("overlay: image path %q is not absolute.  Can not be relative", store)
-				}
-				st, err := os.Stat(store)
+				store, err := checkImageStore(store)
 				if err != nil {
-					return nil, fmt.Errorf("overlay: can't stat imageStore dir %s: %v", store, err)
-				}
-				if !st.IsDir() {
-					return nil, fmt.Errorf("overlay: image path %q must be a directory", store)
+					return nil, err
 				}
 				o.imageStores = append(o.imageStores, store)
 			}
@@ -515,6 +648,31 @@ func parseOptions(options []string) (*overlayOptions, error) {
 			if err != nil {
 				return nil, err
 			}
+		case "userxattr":
+			logrus.Debugf("overlay: userxattr=%s", val)
+			userxattr, err := strconv.ParseBool(val)
+			if err != nil {
+				return nil, err
+			}
+			o.userxattr = &userxattr
+		case "xino":
+			logrus.Debugf("overlay: xino=%s", val)
+			o.xino, err = strconv.ParseBool(val)
+			if err != nil {
+				return nil, err
+			}
+		case "mount_cache":
+			logrus.Debugf("overlay: mount_cache=%s", val)
+			o.mountCache, err = strconv.ParseBool(val)
+			if err != nil {
+				return nil, err
+			}
+		case "async_remove":
+			logrus.Debugf("overlay: async_remove=%s", val)
+			o.asyncRemove, err = strconv.ParseBool(val)
+			if err != nil {
+				return nil, err
+			}
 		case "force_mask":
 			logrus.Debugf("overlay: force_mask=%s", val)
 			var mask int64
@@ -725,7 +883,7 @@ func (d *Driver) useNaiveDiff() bool {
 			useNaiveDiffOnly = !nativeDiffCacheResult
 			return
 		}
-		if err := doesSupportNativeDiff(d.home, d.options.mountOptions); err != nil {
+		if err := doesSupportNativeDiff(d.home, d.options.mountOptions, d.useUserXattr()); err != nil {
 			nativeDiffCacheText = fmt.Sprintf("Not using native diff for overlay, this may cause degraded performance for building images: %v", err)
 			logrus.Info(nativeDiffCacheText)
 			useNaiveDiffOnly = true
@@ -779,6 +937,9 @@ func (d *Driver) Metadata(id string) (map[string]string, error) {
 // is being shutdown. For now, we just have to unmount the bind mounted
 // we had created.
 func (d *Driver) Cleanup() error {
+	if d.trash != nil {
+		d.trash.Close()
+	}
 	_ = os.RemoveAll(d.getStagingDir())
 	return mount.Unmount(d.home)
 }
@@ -1151,6 +1312,18 @@ func (d *Driver) Remove(id string) error {
 
 	d.releaseAdditionalLayerByID(id)
 
+	if _, err := os.Stat(path.Join(dir, imageFile)); err == nil {
+		if err := unix.Unmount(path.Join(dir, "diff"), unix.MNT_DETACH); err != nil && err != unix.EINVAL {
+			logrus.Debugf("Failed to unmount image of %s: %v", id, err)
+		}
+	}
+	if err := unix.Unmount(path.Join(dir, cachedLowersDir), unix.MNT_DETACH); err != nil && err != unix.EINVAL && !os.IsNotExist(err) {
+		logrus.Debugf("Failed to unmount the cached lowers of %s: %v", id, err)
+	}
+
+	if d.trash != nil {
+		return d.trash.Add(dir)
+	}
 	if err := system.EnsureRemoveAll(dir); err != nil && !os.IsNotExist(err) {
 		return err
 	}
@@ -1184,8 +1357,8 @@ func (d *Driver) recreateSymlinks() error {
 		// Check that for each layer, there's a link in "l" with the name in
 		// the layer's "link" file that points to the layer's "diff" directory.
 		for _, dir := range dirs {
-			// Skip over the linkDir and anything that is not a directory
-			if dir.Name() == linkDir || !dir.Mode().IsDir() {
+			// Skip over the linkDir, the trashDir and anything that is not a directory
+			if dir.Name() == linkDir || dir.Name() == trashDir || !dir.Mode().IsDir() {
 				continue
 			}
 			// Read the "link" file under each layer to get the name of the symlink
@@ -1252,6 +1425,177 @@ func (d *Driver) recreateSymlinks() error {
 	return nil
 }
 
+// validLinkName checks that the contents of a layer's "link" file can be
+// used as the name of its symlink in the linkDir and in a lowerdir list.
+func validLinkName(lid string) bool {
+	return lid != "" && lid != "." && lid != ".." && !strings.ContainsAny(lid, "/:,\n")
+}
+
+// Repair rebuilds the symlinks in the linkDir, and the "link" and "lower"
+// files of the layers in parents, which maps each layer's ID to its
+// parent's ID.  Only layers in the driver's home directory are modified.
+func (d *Driver) Repair(parents map[string]string) ([]string, error) {
+	var fixed []string
+	linksDir := path.Join(d.home, linkDir)
+	rootUID, rootGID, err := idtools.GetRootUIDGID(d.uidMaps, d.gidMaps)
+	if err != nil {
+		return nil, err
+	}
+	if err := idtools.MkdirAllAs(linksDir, 0700, rootUID, rootGID); err != nil {
+		return nil, err
+	}
+
+	// Drop the symlinks which don't point to a layer's "diff" directory,
+	// and index the rest by the layer they point to.
+	entries, err := ioutil.ReadDir(linksDir)
+	if err != nil {
+		return nil, err
+	}
+	linksByLayer := make(map[string][]string)
+	for _, entry := range entries {
+		linkPath := filepath.Join(linksDir, entry.Name())
+		target, err := os.Readlink(linkPath)
+		if err == nil {
+			targetComponents := strings.Split(target, string(os.PathSeparator))
+			if len(targetComponents) == 3 && targetComponents[0] == ".." && targetComponents[2] == "diff" {
+				if _, err := os.Stat(filepath.Join(d.home, targetComponents[1], "diff")); err == nil {
+					linksByLayer[targetComponents[1]] = append(linksByLayer[targetComponents[1]], entry.Name())
+					continue
+				}
+			}
+		}
+		if err := os.RemoveAll(linkPath); err != nil {
+			return fixed, err
+		}
+		fixed = append(fixed, fmt.Sprintf("removed stale link %q", entry.Name()))
+	}
+
+	ids := make([]string, 0, len(parents))
+	for id := range parents {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	// Make sure that each layer has a valid "link" file, and that the
+	// symlink it names points to the layer's "diff" directory.
+	links := make(map[string]string)
+	for _, id := range ids {
+		dir := d.dir(id)
+		data, err := ioutil.ReadFile(path.Join(dir, "link"))
+		if err != nil && !os.IsNotExist(err) {
+			return fixed, err
+		}
+		lid := strings.TrimSpace(string(data))
+		if dir != path.Join(d.home, id) {
+			// The layer is in an additional image store, which we
+			// can't modify, so just use what it has.
+			if validLinkName(lid) {
+				links[id] = lid
+			}
+			continue
+		}
+		if _, err := os.Stat(path.Join(dir, "diff")); err != nil {
+			// Not a layer that we know how to repair.
+			continue
+		}
+		if !validLinkName(lid) {
+			if len(linksByLayer[id]) > 0 {
+				lid = linksByLayer[id][0]
+			} else {
+				lid = generateID(idLength)
+			}
+			if err := ioutil.WriteFile(path.Join(dir, "link"), []byte(lid), 0644); err != nil {
+				return fixed, err
+			}
+			fixed = append(fixed, fmt.Sprintf("rewrote link file for layer %s", id))
+		}
+		links[id] = lid
+
+		linkPath := path.Join(linksDir, lid)
+		if target, err := os.Readlink(linkPath); err != nil || target != path.Join("..", id, "diff") {
+			if err := os.RemoveAll(linkPath); err != nil {
+				return fixed, err
+			}
+			if err := os.Symlink(path.Join("..", id, "diff"), linkPath); err != nil {
+				return fixed, err
+			}
+			fixed = append(fixed, fmt.Sprintf("recreated link %q for layer %s", lid, id))
+		}
+		for _, extra := range linksByLayer[id] {
+			if extra == lid {
+				continue
+			}
+			if err := os.Remove(path.Join(linksDir, extra)); err != nil && !os.IsNotExist(err) {
+				return fixed, err
+			}
+			fixed = append(fixed, fmt.Sprintf("removed extra link %q for layer %s", extra, id))
+		}
+	}
+
+	// Now rebuild the list of lower layers for each layer from the chain
+	// of its parents, the same way Create() builds it.
+	lowers := make(map[string]string)
+	var getLowers func(id string, depth int) (string, bool)
+	getLowers = func(id string, depth int) (string, bool) {
+		if l, ok := lowers[id]; ok {
+			return l, true
+		}
+		parent, ok := parents[id]
+		if !ok || depth > maxDepth {
+			return "", false
+		}
+		if parent == "" {
+			return "", true
+		}
+		parentLink, ok := links[parent]
+		if !ok {
+			return "", false
+		}
+		parentLowers, ok := getLowers(parent, depth+1)
+		if !ok {
+			return "", false
+		}
+		l := path.Join(linkDir, parentLink)
+		if parentLowers != "" {
+			l = l + ":" + parentLowers
+		}
+		lowers[id] = l
+		return l, true
+	}
+	for _, id := range ids {
+		dir := path.Join(d.home, id)
+		if d.dir(id) != dir {
+			continue
+		}
+		if _, err := os.Stat(path.Join(dir, "diff")); err != nil {
+			continue
+		}
+		expected, ok := getLowers(id, 0)
+		if !ok {
+			continue
+		}
+		data, err := ioutil.ReadFile(path.Join(dir, lowerFile))
+		if err != nil && !os.IsNotExist(err) {
+			return fixed, err
+		}
+		if err == nil && string(data) == expected {
+			continue
+		}
+		if expected == "" {
+			if err != nil {
+				continue
+			}
+			if err := os.Remove(path.Join(dir, lowerFile)); err != nil {
+				return fixed, err
+			}
+		} else if err := ioutil.WriteFile(path.Join(dir, lowerFile), []byte(expected), 0666); err != nil {
+			return fixed, err
+		}
+		fixed = append(fixed, fmt.Sprintf("rewrote lower file for layer %s", id))
+	}
+	return fixed, nil
+}
+
 // Get creates and mounts the required file system for the given id and returns the mount path.
 func (d *Driver) Get(id string, options graphdriver.MountOpts) (_ string, retErr error) {
 	return d.get(id, false, options)
@@ -1300,6 +1644,9 @@ func (d *Driver) get(id string, disableShifting bool, options graphdriver.MountO
 			break
 		}
 	}
+	if err := validateMountOptions(optsList, readWrite, options.Volatile); err != nil {
+		return "", err
+	}
 
 	lowers, err := ioutil.ReadFile(path.Join(dir, lowerFile))
 	if err != nil && !os.IsNotExist(err) {
@@ -1353,6 +1700,10 @@ func (d *Driver) get(id string, disableShifting bool, options graphdriver.MountO
 		}
 	}
 
+	// ownDiffs is the number of the layer's own additional diffN
+	// directories at the front of the lists.
+	ownDiffs := len(absLowers)
+
 	// For each lower, resolve its path, and append it and any additional diffN
 	// directories to the lowers list.
 	for _, l := range splitLowers {
@@ -1418,6 +1769,14 @@ func (d *Driver) get(id string, disableShifting bool, options graphdriver.MountO
 		return "", err
 	}
 
+	imageDiffs, err := d.imageLayerDiffs(id)
+	if err != nil {
+		return "", err
+	}
+	if len(imageDiffs) > 0 && imageDiffs[0] == diffDir && readWrite {
+		return "", fmt.Errorf("layer %s was created from a file system image and can only be mounted read-only", id)
+	}
+
 	mergedDir := path.Join(dir, "merged")
 	// Create the driver merged dir
 	if err := idtools.MkdirAs(mergedDir, 0700, rootUID, rootGID); err != nil && !os.IsExist(err) {
@@ -1436,6 +1795,38 @@ func (d *Driver) get(id string, disableShifting bool, options graphdriver.MountO
 		}
 	}()
 
+	// Layers created from file system images need them mounted on their
+	// diff directories.
+	if err := d.mountImageLayers(imageDiffs); err != nil {
+		return "", err
+	}
+	defer func() {
+		if retErr != nil {
+			d.unmountImageLayers(imageDiffs)
+		}
+	}()
+
+	// With mount_cache, the lowers inherited from the parent are replaced
+	// by a read-only mount of them, which is shared with the other layers
+	// based on the same parent.
+	if parent := d.cachedLowersParent(splitLowers, absLowers[ownDiffs:]); parent != "" {
+		cached, err := d.mountCachedLowers(parent, absLowers[ownDiffs:])
+		if err != nil {
+			return "", err
+		}
+		if err := ioutil.WriteFile(path.Join(dir, cachedLowersFile), []byte(parent), 0600); err != nil {
+			d.releaseCachedLowers(parent)
+			return "", err
+		}
+		defer func() {
+			if retErr != nil {
+				d.releaseCachedLowersOf(dir)
+			}
+		}()
+		absLowers = append(absLowers[:ownDiffs:ownDiffs], cached)
+		relLowers = append(relLowers[:ownDiffs:ownDiffs], path.Join(parent, cachedLowersDir))
+	}
+
 	workdir := path.Join(dir, "work")
 
 	var opts string
@@ -1448,18 +1839,28 @@ func (d *Driver) get(id string, disableShifting bool, options graphdriver.MountO
 		opts = fmt.Sprintf("%s,%s", strings.Join(optsList, ","), opts)
 	}
 
-	if d.options.mountProgram == "" && unshare.IsRootless() {
+	if d.options.mountProgram == "" && d.useUserXattr() {
 		opts = fmt.Sprintf("%s,userxattr", opts)
 	}
 
+	xino, err := d.useXino(strings.Split(opts, ","))
+	if err != nil {
+		return "", err
+	}
+	if xino {
+		opts = fmt.Sprintf("%s,xino=on", opts)
+	}
+
 	// If "volatile" is not supported by the file system, just ignore the request
-	if options.Volatile && !hasVolatileOption(strings.Split(opts, ",")) {
+	volatile := hasVolatileOption(strings.Split(opts, ","))
+	if options.Volatile && !volatile {
 		supported, err := d.getSupportsVolatile()
 		if err != nil {
 			return "", err
 		}
 		if supported {
 			opts = fmt.Sprintf("%s,volatile", opts)
+			volatile = true
 		}
 	}
 
@@ -1505,7 +1906,7 @@ func (d *Driver) get(id string, disableShifting bool, options graphdriver.MountO
 			diffDir := path.Join(id, "diff")
 			opts = fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(relLowers, ":"), diffDir, workdir)
 		} else {
-			opts = fmt.Sprintf("lowerdir=%s", strings.Join(absLowers, ":"))
+			opts = fmt.Sprintf("lowerdir=%s:%s", path.Join(id, "diff"), strings.Join(relLowers, ":"))
 		}
 		mountData = label.FormatMountLabel(opts, options.MountLabel)
 		if len(mountData) > pageSize {
@@ -1518,11 +1919,30 @@ func (d *Driver) get(id string, disableShifting bool, options graphdriver.MountO
 	}
 
 	// overlay has a check in place to prevent mounting the same file system twice
-	// if volatile was already specified.
+	// if volatile was already specified.  The kernel leaves the directory
+	// behind even when the host crashes, so we keep our own record of
+	// volatile mounts to warn about layers which may have lost changes.
+	lostChanges, err := volatileMountBeforeReboot(dir)
+	if err != nil {
+		return "", err
+	}
+	if lostChanges {
+		logrus.Warnf("overlay: layer %s was mounted with the volatile option before the host was restarted, some of its changes may have been lost", id)
+	}
 	err = os.RemoveAll(filepath.Join(workdir, "work/incompat/volatile"))
 	if err != nil && !os.IsNotExist(err) {
 		return "", err
 	}
+	if volatile && readWrite {
+		if err := recordVolatileMount(dir); err != nil {
+			return "", err
+		}
+	} else if lostChanges {
+		// The warning was given, don't repeat it.
+		if err := os.Remove(filepath.Join(dir, volatileFile)); err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+	}
 
 	flags, data := mount.ParseOptions(mountData)
 	logrus.Debugf("overlay: mount_data=%s", mountData)
@@ -1587,6 +2007,14 @@ func (d *Driver) Put(id string) error {
 		logrus.Debugf("Failed to remove mountpoint %s overlay: %s - %v", id, mountpoint, err)
 	}
 
+	d.releaseCachedLowersOf(dir)
+
+	imageDiffs, err := d.imageLayerDiffs(id)
+	if err != nil {
+		logrus.Debugf("Failed to find the images used by %s overlay: %v", id, err)
+	}
+	d.unmountImageLayers(imageDiffs)
+
 	return nil
 }
 
@@ -1617,6 +2045,36 @@ func (d *Driver) isParent(id, parent string) bool {
 	return ld == parentDir
 }
 
+// useUserXattr checks if overlay is mounted with the "userxattr" option, in
+// which case it uses user.overlay.* extended attributes instead of
+// trusted.overlay.* ones.  Unless it is set explicitly with the "userxattr"
+// option, it is used in rootless mode, where trusted.* extended attributes
+// can't be set.
+func (o *overlayOptions) useUserXattr() bool {
+	if o.userxattr != nil {
+		return *o.userxattr
+	}
+	return unshare.IsRootless()
+}
+
+// useUserXattr checks if the driver mounts overlay with the "userxattr"
+// option, see overlayOptions.useUserXattr.
+func (d *Driver) useUserXattr() bool {
+	return d.options.useUserXattr()
+}
+
+// overlayXattrName returns the extended attribute which overlay uses with the
+// given name, in the namespace selected by useUserXattr.
+func (d *Driver) overlayXattrName(name string) string {
+	return archive.GetOverlayXattrNameWithUserXattr(name, d.useUserXattr())
+}
+
+// overlayUserXattr returns the value for archive.TarOptions.OverlayUserXattr.
+func (d *Driver) overlayUserXattr() *bool {
+	userxattr := d.useUserXattr()
+	return &userxattr
+}
+
 func (d *Driver) getWhiteoutFormat() archive.WhiteoutFormat {
 	whiteoutFormat := archive.OverlayWhiteoutFormat
 	if d.options.mountProgram != "" {
@@ -1650,6 +2108,12 @@ func (d *Driver) DiffGetter(id string) (graphdriver.FileGetCloser, error) {
 	return fileGetNilCloser{storage.NewPathFileGetter(p)}, nil
 }
 
+// UpperDir returns the "diff" directory of the layer, which is the upper
+// directory of its mounts.
+func (d *Driver) UpperDir(id string) (string, error) {
+	return d.getDiffPath(id)
+}
+
 // CleanupStagingDirectory cleanups the staging directory.
 func (d *Driver) CleanupStagingDirectory(stagingDirectory string) error {
 	return os.RemoveAll(stagingDirectory)
@@ -1692,6 +2156,7 @@ func (d *Driver) ApplyDiffWithDiffer(id, parent string, options *graphdriver.App
 		GIDMaps:           idMappings.GIDs(),
 		IgnoreChownErrors: d.options.ignoreChownErrors,
 		WhiteoutFormat:    d.getWhiteoutFormat(),
+		OverlayUserXattr:  d.overlayUserXattr(),
 		InUserNS:          userns.RunningInUserNS(),
 	})
 	out.Target = applyDir
@@ -1711,7 +2176,16 @@ func (d *Driver) ApplyDiffFromStagingDirectory(id, parent, stagingDirectory stri
 	if err := os.RemoveAll(diff); err != nil && !os.IsNotExist(err) {
 		return err
 	}
-	return os.Rename(stagingDirectory, diff)
+	if err := os.Rename(stagingDirectory, diff); err != nil {
+		return err
+	}
+	if err := d.metacopyDiff(id); err != nil {
+		return err
+	}
+	if options != nil && options.Sync != nil {
+		return options.Sync(diff)
+	}
+	return nil
 }
 
 // DifferTarget gets the location where files are stored for the layer.
@@ -1750,10 +2224,19 @@ func (d *Driver) ApplyDiff(id, parent string, options graphdriver.ApplyDiffOpts)
 		IgnoreChownErrors: d.options.ignoreChownErrors,
 		ForceMask:         d.options.forceMask,
 		WhiteoutFormat:    d.getWhiteoutFormat(),
+		OverlayUserXattr:  d.overlayUserXattr(),
 		InUserNS:          userns.RunningInUserNS(),
 	}); err != nil {
 		return 0, err
 	}
+	if err := d.metacopyDiff(id); err != nil {
+		return 0, err
+	}
+	if options.Sync != nil {
+		if err := options.Sync(applyDir); err != nil {
+			return 0, err
+		}
+	}
 
 	return directory.Size(applyDir)
 }
@@ -1812,13 +2295,25 @@ func (d *Driver) Diff(id string, idMappings *idtools.IDMappings, parent string,
 	if err != nil {
 		return nil, err
 	}
+	// The contents of metadata-only copies are in the lower layers, so
+	// they can only be read through a mount.
+	if d.usingMetacopy {
+		metacopy, err := d.hasMetacopyFiles(diffPath)
+		if err != nil {
+			return nil, err
+		}
+		if metacopy {
+			return d.naiveDiff.Diff(id, idMappings, parent, parentMappings, mountLabel)
+		}
+	}
 	logrus.Debugf("Tar with options on %s", diffPath)
 	return archive.TarWithOptions(diffPath, &archive.TarOptions{
-		Compression:    archive.Uncompressed,
-		UIDMaps:        idMappings.UIDs(),
-		GIDMaps:        idMappings.GIDs(),
-		WhiteoutFormat: d.getWhiteoutFormat(),
-		WhiteoutData:   lowerDirs,
+		Compression:      archive.Uncompressed,
+		UIDMaps:          idMappings.UIDs(),
+		GIDMaps:          idMappings.GIDs(),
+		WhiteoutFormat:   d.getWhiteoutFormat(),
+		WhiteoutData:     lowerDirs,
+		OverlayUserXattr: d.overlayUserXattr(),
 	})
 }
 
@@ -1839,12 +2334,48 @@ func (d *Driver) Changes(id string, idMappings *idtools.IDMappings, parent strin
 		return nil, err
 	}
 
-	return archive.OverlayChanges(layers, diffPath)
+	return archive.OverlayChangesWithUserXattr(layers, diffPath, d.useUserXattr())
+}
+
+// checkImageStore checks that the path of an additional image store is an
+// absolute path to a directory, and returns it cleaned.
+func checkImageStore(store string) (string, error) {
+	store = filepath.Clean(store)
+	if !filepath.IsAbs(store) {
+		return "", fmt.Errorf("overlay: image path %q is not absolute.  Can not be relative", store)
+	}
+	st, err := os.Stat(store)
+	if err != nil {
+		return "", fmt.Errorf("overlay: can't stat imageStore dir %s: %v", store, err)
+	}
+	if !st.IsDir() {
+		return "", fmt.Errorf("overlay: image path %q must be a directory", store)
+	}
+	return store, nil
 }
 
 // AdditionalImageStores returns additional image stores supported by the driver
 func (d *Driver) AdditionalImageStores() []string {
-	return d.options.imageStores
+	d.imageStoresLock.RLock()
+	defer d.imageStoresLock.RUnlock()
+	return append([]string(nil), d.options.imageStores...)
+}
+
+// SetAdditionalImageStores replaces the additional image stores in which the
+// directories of lower layers are looked up.
+func (d *Driver) SetAdditionalImageStores(stores []string) error {
+	var checked []string
+	for _, store := range stores {
+		store, err := checkImageStore(store)
+		if err != nil {
+			return err
+		}
+		checked = append(checked, store)
+	}
+	d.imageStoresLock.Lock()
+	defer d.imageStoresLock.Unlock()
+	d.options.imageStores = checked
+	return nil
 }
 
 // UpdateLayerIDMap updates ID mappings in a from matching the ones specified
@@ -1922,6 +2453,16 @@ func (d *Driver) UpdateLayerIDMap(id string, toContainer, toHost *idtools.IDMapp
 	return nil
 }
 
+// Capabilities reports the features which the driver supports.
+func (d *Driver) Capabilities() graphdriver.Capabilities {
+	return graphdriver.Capabilities{
+		NativeDiff: !d.useNaiveDiff(),
+		Quotas:     d.quotaCtl != nil,
+		IDShifting: d.SupportsShifting(),
+		Mounts:     true,
+	}
+}
+
 // SupportsShifting tells whether the driver support shifting of the UIDs/GIDs in an userNS
 func (d *Driver) SupportsShifting() bool {
 	if os.Getenv("_TEST_FORCE_SUPPORT_SHIFTING") == "yes-please" {
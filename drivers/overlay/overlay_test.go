@@ -3,14 +3,24 @@
 package overlay
 
 import (
+	"archive/tar"
+	"bytes"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	graphdriver "github.com/containers/storage/drivers"
 	"github.com/containers/storage/drivers/graphtest"
 	"github.com/containers/storage/pkg/archive"
+	"github.com/containers/storage/pkg/mount"
 	"github.com/containers/storage/pkg/reexec"
+	"github.com/containers/storage/pkg/stringid"
+	"github.com/containers/storage/pkg/unshare"
+	"golang.org/x/sys/unix"
 )
 
 const driverName = "overlay"
@@ -31,7 +41,7 @@ func skipIfNaive(t *testing.T) {
 	}
 	defer os.RemoveAll(td)
 
-	if err := doesSupportNativeDiff(td, ""); err != nil {
+	if err := doesSupportNativeDiff(td, "", unshare.IsRootless()); err != nil {
 		t.Skipf("Cannot run test with naive diff")
 	}
 }
@@ -72,6 +82,705 @@ func TestOverlayChanges(t *testing.T) {
 	graphtest.DriverTestChanges(t, driverName)
 }
 
+func TestOverlayMountOptions(t *testing.T) {
+	driver := graphtest.GetDriver(t, driverName)
+	defer graphtest.PutDriver(t)
+
+	id := stringid.GenerateRandomID()
+	if err := driver.Create(id, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	defer driver.Remove(id)
+
+	for _, options := range []graphdriver.MountOpts{
+		{Options: []string{"ro"}, Volatile: true},
+		{Options: []string{"ro", "volatile"}},
+		{Options: []string{"nodev", "dev"}},
+		{Options: []string{"noexec", "exec"}},
+	} {
+		if _, err := driver.Get(id, options); err == nil {
+			driver.Put(id)
+			t.Fatalf("expected mounting with %v (volatile=%v) to fail", options.Options, options.Volatile)
+		}
+	}
+
+	dir, err := driver.Get(id, graphdriver.MountOpts{Options: []string{"nodev"}, Volatile: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer driver.Put(id)
+
+	mounts, err := mount.GetMounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info *mount.Info
+	for _, m := range mounts {
+		if m.Mountpoint == dir {
+			info = m
+		}
+	}
+	if info == nil {
+		t.Fatalf("%s is not mounted", dir)
+	}
+	if !strings.Contains(","+info.Options+",", ",nodev,") {
+		t.Fatalf("expected %s to be mounted nodev, got %q", dir, info.Options)
+	}
+	d := driver.(*graphtest.Driver).Driver.(*Driver)
+	supportsVolatile, err := d.getSupportsVolatile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Newer kernels report "volatile" as "fsync=volatile".
+	vfsOptions := "," + info.VFSOptions + ","
+	if supportsVolatile && d.options.mountProgram == "" && !strings.Contains(vfsOptions, ",volatile,") && !strings.Contains(vfsOptions, ",fsync=volatile,") {
+		t.Fatalf("expected %s to be mounted volatile, got %q", dir, info.VFSOptions)
+	}
+	// The volatile mount is recorded.
+	_, err = os.Stat(filepath.Join(d.dir(id), volatileFile))
+	if supportsVolatile && err != nil {
+		t.Fatalf("volatile mount of %s not recorded: %v", id, err)
+	} else if !supportsVolatile && !os.IsNotExist(err) {
+		t.Fatalf("volatile mount of %s recorded without volatile support: %v", id, err)
+	}
+}
+
+func TestOverlayRepair(t *testing.T) {
+	driver := graphtest.GetDriver(t, driverName)
+	defer graphtest.PutDriver(t)
+	d := driver.(*graphtest.Driver).Driver.(*Driver)
+
+	base := stringid.GenerateRandomID()
+	child := stringid.GenerateRandomID()
+	grandchild := stringid.GenerateRandomID()
+	parents := map[string]string{
+		base:       "",
+		child:      base,
+		grandchild: child,
+	}
+	for _, id := range []string{base, child, grandchild} {
+		if err := driver.Create(id, parents[id], nil); err != nil {
+			t.Fatal(err)
+		}
+		defer driver.Remove(id)
+	}
+	dir, err := driver.Get(base, graphdriver.MountOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("base"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.Put(base); err != nil {
+		t.Fatal(err)
+	}
+
+	readLink := func(id string) string {
+		data, err := ioutil.ReadFile(filepath.Join(d.home, id, "link"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	// Lose the base layer's symlink, garble the child's "link" file, drop
+	// the grandchild's "lower" file, and leave a dangling symlink around.
+	baseLink := readLink(base)
+	if err := os.Remove(filepath.Join(d.home, linkDir, baseLink)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(d.home, child, "link"), []byte("../garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(d.home, grandchild, lowerFile)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../nonexistent/diff", filepath.Join(d.home, linkDir, "DANGLING")); err != nil {
+		t.Fatal(err)
+	}
+
+	fixed, err := d.Repair(parents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixed) == 0 {
+		t.Fatal("Repair didn't report any fixes")
+	}
+	if _, err := os.Lstat(filepath.Join(d.home, linkDir, "DANGLING")); !os.IsNotExist(err) {
+		t.Fatalf("Dangling link was not removed: %v", err)
+	}
+	if readLink(base) != baseLink {
+		t.Fatal("Valid link file was modified")
+	}
+	for _, id := range []string{base, child, grandchild} {
+		if target, err := os.Readlink(filepath.Join(d.home, linkDir, readLink(id))); err != nil || target != filepath.Join("..", id, "diff") {
+			t.Fatalf("Invalid link for layer %s: %q, %v", id, target, err)
+		}
+	}
+	lower, err := ioutil.ReadFile(filepath.Join(d.home, grandchild, lowerFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := filepath.Join(linkDir, readLink(child)) + ":" + filepath.Join(linkDir, baseLink); string(lower) != expected {
+		t.Fatalf("Invalid lower file %q, expected %q", lower, expected)
+	}
+
+	fixed, err = d.Repair(parents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixed) != 0 {
+		t.Fatalf("Unexpected fixes on a consistent driver: %v", fixed)
+	}
+
+	dir, err = driver.Get(grandchild, graphdriver.MountOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer driver.Put(grandchild)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "base" {
+		t.Fatalf("Unexpected content %q", data)
+	}
+}
+
+func TestValidateMountOptions(t *testing.T) {
+	for _, c := range []struct {
+		opts      []string
+		readWrite bool
+		volatile  bool
+		valid     bool
+	}{
+		{nil, true, false, true},
+		{[]string{"nodev", "noexec"}, true, true, true},
+		{[]string{"ro", "nodev"}, false, false, true},
+		{[]string{"volatile"}, true, false, true},
+		{[]string{"ro", "volatile"}, false, false, false},
+		{[]string{"ro"}, false, true, false},
+		{[]string{"suid", "nosuid"}, true, false, false},
+	} {
+		err := validateMountOptions(c.opts, c.readWrite, c.volatile)
+		if c.valid && err != nil {
+			t.Errorf("expected %v (readWrite=%v, volatile=%v) to be accepted: %v", c.opts, c.readWrite, c.volatile, err)
+		} else if !c.valid && err == nil {
+			t.Errorf("expected %v (readWrite=%v, volatile=%v) to be rejected", c.opts, c.readWrite, c.volatile)
+		}
+	}
+}
+
+func TestVolatileMountBeforeReboot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overlay-volatile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if lost, err := volatileMountBeforeReboot(dir); err != nil || lost {
+		t.Fatalf("expected a layer which was never mounted volatile to be intact: %v, %v", lost, err)
+	}
+	if err := recordVolatileMount(dir); err != nil {
+		t.Fatal(err)
+	}
+	if lost, err := volatileMountBeforeReboot(dir); err != nil || lost {
+		t.Fatalf("expected a layer mounted volatile during this boot to be intact: %v, %v", lost, err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, volatileFile), []byte("some other boot"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if lost, err := volatileMountBeforeReboot(dir); err != nil || !lost {
+		t.Fatalf("expected a layer mounted volatile during another boot to be reported: %v, %v", lost, err)
+	}
+}
+
+func TestUserXattrOption(t *testing.T) {
+	for _, c := range []struct {
+		option   string
+		expected bool
+	}{
+		{"overlay.userxattr=true", true},
+		{"overlay.userxattr=false", false},
+	} {
+		opts, err := parseOptions([]string{c.option})
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := &Driver{options: *opts}
+		if d.useUserXattr() != c.expected {
+			t.Errorf("%s: expected userxattr to be %v", c.option, c.expected)
+		}
+	}
+	opts, err := parseOptions(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &Driver{options: *opts}
+	if d.useUserXattr() != unshare.IsRootless() {
+		t.Errorf("userxattr should default to being used in rootless mode only")
+	}
+	if _, err := parseOptions([]string{"overlay.userxattr=maybe"}); err == nil {
+		t.Errorf("invalid userxattr value accepted")
+	}
+}
+
+func TestXinoOption(t *testing.T) {
+	opts, err := parseOptions([]string{"overlay.xino=true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	supported := true
+	d := &Driver{options: *opts, supportsXino: &supported}
+	for _, c := range []struct {
+		mountOptions []string
+		expected     bool
+	}{
+		{nil, true},
+		{[]string{"nodev"}, true},
+		{[]string{"xino=off"}, false},
+		{[]string{"xino=auto"}, false},
+	} {
+		if xino, err := d.useXino(c.mountOptions); err != nil || xino != c.expected {
+			t.Errorf("%v: expected xino to be added: %v, got %v, %v", c.mountOptions, c.expected, xino, err)
+		}
+	}
+	supported = false
+	if xino, err := d.useXino(nil); err != nil || xino {
+		t.Errorf("xino added when not supported: %v", err)
+	}
+	supported = true
+	d.options.mountProgram = "/usr/bin/fuse-overlayfs"
+	if xino, err := d.useXino(nil); err != nil || xino {
+		t.Errorf("xino added with a mount program: %v", err)
+	}
+
+	if opts, err = parseOptions(nil); err != nil {
+		t.Fatal(err)
+	}
+	d = &Driver{options: *opts, supportsXino: &supported}
+	if xino, err := d.useXino(nil); err != nil || xino {
+		t.Errorf("xino added without being requested: %v", err)
+	}
+	if _, err := parseOptions([]string{"overlay.xino=maybe"}); err == nil {
+		t.Errorf("invalid xino value accepted")
+	}
+}
+
+func TestOverlayReadOnlyMount(t *testing.T) {
+	driver := graphtest.GetDriver(t, driverName)
+	defer graphtest.PutDriver(t)
+
+	base := stringid.GenerateRandomID()
+	if err := driver.Create(base, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	defer driver.Remove(base)
+	dir, err := driver.Get(base, graphdriver.MountOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("contents"), 0644); err != nil {
+		driver.Put(base)
+		t.Fatal(err)
+	}
+	if err := driver.Put(base); err != nil {
+		t.Fatal(err)
+	}
+	id := stringid.GenerateRandomID()
+	if err := driver.Create(id, base, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer driver.Remove(id)
+
+	dir, err = driver.Get(id, graphdriver.MountOpts{Options: []string{"ro"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer driver.Put(id)
+
+	mounts, err := mount.GetMounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info *mount.Info
+	for _, m := range mounts {
+		if m.Mountpoint == dir {
+			info = m
+		}
+	}
+	if info == nil {
+		t.Fatalf("%s is not mounted", dir)
+	}
+	if !strings.Contains(","+info.Options+",", ",ro,") {
+		t.Fatalf("expected %s to be mounted ro, got %q", dir, info.Options)
+	}
+	if strings.Contains(info.VFSOptions, "upperdir=") || strings.Contains(info.VFSOptions, "workdir=") {
+		t.Fatalf("expected %s to be mounted without an upper directory, got %q", dir, info.VFSOptions)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "file")); err != nil || string(data) != "contents" {
+		t.Fatalf("expected the lower layer's file to be visible, got %q, %v", data, err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "new-file"), nil, 0644); err == nil {
+		t.Fatalf("expected writing to %s to fail", dir)
+	}
+}
+
+func TestOverlayCapabilities(t *testing.T) {
+	driver := graphtest.GetDriver(t, driverName)
+	defer graphtest.PutDriver(t)
+	d := driver.(*graphtest.Driver).Driver.(*Driver)
+
+	expected := graphdriver.Capabilities{
+		NativeDiff: !d.useNaiveDiff(),
+		Quotas:     projectQuotaSupported,
+		IDShifting: d.SupportsShifting(),
+		Mounts:     true,
+	}
+	if caps := d.Capabilities(); caps != expected {
+		t.Fatalf("expected capabilities %+v, got %+v", expected, caps)
+	}
+}
+
+func TestOverlayMountCache(t *testing.T) {
+	driver := graphtest.GetDriver(t, driverName)
+	defer graphtest.PutDriver(t)
+	d := driver.(*graphtest.Driver).Driver.(*Driver)
+	if d.options.mountProgram != "" || d.usingMetacopy {
+		t.Skip("the mount cache is not used with a mount program or metacopy")
+	}
+	d.options.mountCache = true
+	defer func() {
+		d.options.mountCache = false
+	}()
+
+	base := stringid.GenerateRandomID()
+	top := stringid.GenerateRandomID()
+	for _, l := range []struct{ id, parent, file string }{{base, "", "base"}, {top, base, "top"}} {
+		if err := driver.Create(l.id, l.parent, nil); err != nil {
+			t.Fatal(err)
+		}
+		defer driver.Remove(l.id)
+		dir, err := driver.Get(l.id, graphdriver.MountOpts{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, l.file), []byte(l.file), 0644)
+		driver.Put(l.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cached := filepath.Join(d.dir(top), cachedLowersDir)
+	mountedOn := func(dir string) *mount.Info {
+		mounts, err := mount.GetMounts()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range mounts {
+			if m.Mountpoint == dir {
+				return m
+			}
+		}
+		return nil
+	}
+
+	var containers []string
+	for i := 0; i < 2; i++ {
+		id := stringid.GenerateRandomID()
+		if err := driver.CreateReadWrite(id, top, nil); err != nil {
+			t.Fatal(err)
+		}
+		defer driver.Remove(id)
+		dir, err := driver.Get(id, graphdriver.MountOpts{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		containers = append(containers, id)
+		info := mountedOn(dir)
+		if info == nil {
+			t.Fatalf("%s is not mounted", dir)
+		}
+		if !strings.Contains(info.VFSOptions, "lowerdir="+cached+",") {
+			t.Fatalf("expected %s to be mounted on top of %s, got %q", dir, cached, info.VFSOptions)
+		}
+		for _, file := range []string{"base", "top"} {
+			if data, err := ioutil.ReadFile(filepath.Join(dir, file)); err != nil || string(data) != file {
+				t.Fatalf("expected %q to be visible in %s, got %q, %v", file, dir, data, err)
+			}
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "container"), []byte(id), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mounts, err := mount.GetMounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, m := range mounts {
+		if m.Mountpoint == cached {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Fatalf("expected the lowers to be mounted once, found %d mounts", n)
+	}
+
+	if err := driver.Put(containers[0]); err != nil {
+		t.Fatal(err)
+	}
+	if mountedOn(cached) == nil {
+		t.Fatalf("the cached lowers were unmounted while still in use")
+	}
+	if err := driver.Put(containers[1]); err != nil {
+		t.Fatal(err)
+	}
+	if mountedOn(cached) != nil {
+		t.Fatalf("the cached lowers are still mounted")
+	}
+}
+
+func TestOverlayXino(t *testing.T) {
+	driver := graphtest.GetDriver(t, driverName)
+	defer graphtest.PutDriver(t)
+	d := driver.(*graphtest.Driver).Driver.(*Driver)
+	if d.options.mountProgram != "" {
+		t.Skip("xino is not used with a mount program")
+	}
+	supported, err := d.getSupportsXino()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.options.xino = true
+	defer func() {
+		d.options.xino = false
+	}()
+	id := stringid.GenerateRandomID()
+	if err := driver.Create(id, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	defer driver.Remove(id)
+	dir, err := driver.Get(id, graphdriver.MountOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer driver.Put(id)
+
+	mounts, err := mount.GetMounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range mounts {
+		if m.Mountpoint == dir {
+			if hasXinoOn(m.VFSOptions) != supported {
+				t.Fatalf("expected xino to be used only if supported (%v), got %q", supported, m.VFSOptions)
+			}
+			return
+		}
+	}
+	t.Fatalf("%s is not mounted", dir)
+}
+
+func TestOverlayImageFileLayer(t *testing.T) {
+	mkfs, err := exec.LookPath("mkfs.ext4")
+	if err != nil {
+		t.Skip("mkfs.ext4 is not available")
+	}
+	tmp, err := ioutil.TempDir("", "overlay-image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	src := filepath.Join(tmp, "src")
+	if err := os.Mkdir(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "from-image"), []byte("image contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	image := filepath.Join(tmp, "layer.img")
+	if out, err := exec.Command(mkfs, "-q", "-F", "-d", src, image, "4M").CombinedOutput(); err != nil {
+		t.Skipf("Can't create an ext4 image: %v: %s", err, out)
+	}
+	loop, err := attachLoopDevice(image)
+	if err != nil {
+		t.Skipf("Loop devices are not available: %v", err)
+	}
+	loop.Close()
+
+	driver := graphtest.GetDriver(t, driverName)
+	defer graphtest.PutDriver(t)
+	d := driver.(*graphtest.Driver).Driver.(*Driver)
+
+	base := stringid.GenerateRandomID()
+	if err := d.CreateFromImageFile(base, "", image, "ext4", nil); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Remove(base)
+	if _, err := d.Get(base, graphdriver.MountOpts{}); err == nil {
+		d.Put(base)
+		t.Fatal("Layer created from an image mounted read-write")
+	}
+	baseDiff := filepath.Join(d.dir(base), "diff")
+	if mounted, _ := mount.Mounted(baseDiff); mounted {
+		t.Fatal("Image left mounted after a failed mount")
+	}
+
+	id := stringid.GenerateRandomID()
+	if err := d.Create(id, base, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Remove(id)
+	dir, err := d.Get(id, graphdriver.MountOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mounted, _ := mount.Mounted(baseDiff); !mounted {
+		d.Put(id)
+		t.Fatal("Image not mounted on the layer's diff directory")
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "from-image")); err != nil || string(data) != "image contents" {
+		d.Put(id)
+		t.Fatalf("Expected the image's file in the merged mount, got %q, %v", data, err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "new-file"), nil, 0644); err != nil {
+		d.Put(id)
+		t.Fatalf("Writing to the upper layer: %v", err)
+	}
+	if err := d.Put(id); err != nil {
+		t.Fatal(err)
+	}
+	if mounted, _ := mount.Mounted(baseDiff); mounted {
+		t.Fatal("Image still mounted after the last mount which used it was removed")
+	}
+}
+
+func TestOverlayMetacopyDiff(t *testing.T) {
+	driver := graphtest.GetDriver(t, driverName)
+	defer graphtest.PutDriver(t)
+	d := driver.(*graphtest.Driver).Driver.(*Driver)
+	if d.options.mountProgram != "" {
+		t.Skip("metadata-only copies are not used with a mount program")
+	}
+	if ok, err := doesMetacopy(d.home, "metacopy=on", d.useUserXattr()); err != nil || !ok {
+		t.Skipf("metacopy is not supported: %v", err)
+	}
+	usingMetacopy, mountOptions := d.usingMetacopy, d.options.mountOptions
+	d.usingMetacopy, d.options.mountOptions = true, "metacopy=on"
+	defer func() {
+		d.usingMetacopy, d.options.mountOptions = usingMetacopy, mountOptions
+	}()
+
+	contents := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	changed := bytes.Repeat([]byte("fedcba9876543210"), 4096)
+	makeTar := func(files map[string][]byte, mode int64) *bytes.Buffer {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, name := range []string{"same", "changed"} {
+			data, ok := files[name]
+			if !ok {
+				continue
+			}
+			if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: mode, Size: int64(len(data))}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tw.Write(data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return &buf
+	}
+
+	base := stringid.GenerateRandomID()
+	if err := d.Create(base, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Remove(base)
+	if _, err := d.ApplyDiff(base, "", graphdriver.ApplyDiffOpts{Diff: makeTar(map[string][]byte{"same": contents, "changed": contents}, 0644)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The child layer only changes the permissions of "same".
+	top := stringid.GenerateRandomID()
+	if err := d.Create(top, base, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Remove(top)
+	if _, err := d.ApplyDiff(top, base, graphdriver.ApplyDiffOpts{Diff: makeTar(map[string][]byte{"same": contents, "changed": changed}, 0600)}); err != nil {
+		t.Fatal(err)
+	}
+
+	diff := filepath.Join(d.dir(top), "diff")
+	var st unix.Stat_t
+	if err := unix.Lstat(filepath.Join(diff, "same"), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Blocks != 0 || st.Size != int64(len(contents)) {
+		t.Fatalf("Expected an empty copy of %d bytes of the unchanged file, got %d bytes in %d blocks", len(contents), st.Size, st.Blocks)
+	}
+	if metacopy, err := d.isMetacopy(filepath.Join(diff, "same")); err != nil || !metacopy {
+		t.Fatalf("Expected the unchanged file to be a metadata-only copy: %v", err)
+	}
+	if metacopy, err := d.isMetacopy(filepath.Join(diff, "changed")); err != nil || metacopy {
+		t.Fatalf("Expected the changed file to be stored in full: %v", err)
+	}
+
+	dir, err := d.Get(top, graphdriver.MountOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "same"))
+	if err != nil || !bytes.Equal(data, contents) {
+		d.Put(top)
+		t.Fatalf("Expected the contents of the lower layer in the merged mount: %v", err)
+	}
+	info, err := os.Stat(filepath.Join(dir, "same"))
+	if err != nil || info.Mode().Perm() != 0600 {
+		d.Put(top)
+		t.Fatalf("Expected the mode of the upper layer in the merged mount, got %v, %v", info, err)
+	}
+	if err := d.Put(top); err != nil {
+		t.Fatal(err)
+	}
+
+	// Diffs still carry the contents of the files.
+	rc, err := d.Diff(top, nil, base, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	tr := tar.NewReader(rc)
+	found := false
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name != "same" {
+			continue
+		}
+		found = true
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, contents) || hdr.Mode&0777 != 0600 {
+			t.Fatalf("Expected the full contents of the unchanged file with mode 0600 in the diff, got %d bytes with mode %o", len(data), hdr.Mode)
+		}
+	}
+	if !found {
+		t.Fatal("The unchanged file is missing from the diff")
+	}
+}
+
 func TestOverlayTeardown(t *testing.T) {
 	graphtest.PutDriver(t)
 }
@@ -0,0 +1,116 @@
+package graphdriver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/containers/storage/pkg/stringid"
+	"github.com/containers/storage/pkg/system"
+	"github.com/sirupsen/logrus"
+)
+
+// TrashDrainInterval is how often a Trash is emptied, in addition to every
+// time something is added to it, so that whatever couldn't be removed, or
+// was added by another process, is eventually removed.
+var TrashDrainInterval = 5 * time.Minute
+
+// Trash is a directory where a driver can move the directories of the layers
+// it removes, so that it doesn't have to wait for them to be deleted, which
+// can take a long time for large layers.  Its contents are deleted in the
+// background.
+type Trash struct {
+	dir  string
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+	// mu serializes the calls to Drain.
+	mu        sync.Mutex
+	closeOnce sync.Once
+}
+
+// NewTrash creates the trash directory dir, which must be on the same file
+// system as the directories that will be added to it, and starts emptying it
+// in the background, starting with whatever was left there by a previous
+// process.
+func NewTrash(dir string) (*Trash, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	t := &Trash{
+		dir:  dir,
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go t.run()
+	return t, nil
+}
+
+func (t *Trash) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(TrashDrainInterval)
+	defer ticker.Stop()
+	for {
+		if err := t.Drain(); err != nil {
+			logrus.Debugf("Emptying %s: %v", t.dir, err)
+		}
+		select {
+		case <-t.stop:
+			return
+		case <-t.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Add moves path to the trash, from where it will be deleted in the
+// background.  If path can't be moved, it is deleted right away.  It is not
+// an error if path doesn't exist.
+func (t *Trash) Add(path string) error {
+	target := filepath.Join(t.dir, filepath.Base(path)+"-"+stringid.GenerateRandomID()[:12])
+	if err := os.Rename(path, target); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		logrus.Debugf("Moving %s to the trash: %v", path, err)
+		return system.EnsureRemoveAll(path)
+	}
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Drain deletes the contents of the trash, and returns the first error it
+// encounters.
+func (t *Trash) Drain() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entries, err := ioutil.ReadDir(t.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var firstErr error
+	for _, entry := range entries {
+		if err := system.EnsureRemoveAll(filepath.Join(t.dir, entry.Name())); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Close stops emptying the trash in the background.  Whatever is left in it
+// is removed by the next call to NewTrash for the same directory.
+func (t *Trash) Close() {
+	t.closeOnce.Do(func() {
+		close(t.stop)
+	})
+	<-t.done
+}
@@ -5,3 +5,7 @@ import "github.com/containers/storage/drivers/copy"
 func dirCopy(srcDir, dstDir string) error {
 	return copy.DirCopy(srcDir, dstDir, copy.Content, true)
 }
+
+func supportsReflinks(dir string) (bool, error) {
+	return copy.SupportsReflinks(dir)
+}
@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 
 	graphdriver "github.com/containers/storage/drivers"
 	"github.com/containers/storage/pkg/archive"
@@ -43,6 +44,7 @@ func Init(home string, options graphdriver.Options) (graphdriver.Driver, error)
 	if err := idtools.MkdirAllAndChown(home, 0700, rootIDs); err != nil {
 		return nil, err
 	}
+	asyncRemove := false
 	for _, option := range options.DriverOptions {
 
 		key, val, err := parsers.ParseKeyValueOpt(option)
@@ -63,10 +65,22 @@ func Init(home string, options graphdriver.Options) (graphdriver.Driver, error)
 			if err != nil {
 				return nil, err
 			}
+		case ".async_remove", "vfs.async_remove":
+			logrus.Debugf("vfs: async_remove=%s", val)
+			asyncRemove, err = strconv.ParseBool(val)
+			if err != nil {
+				return nil, err
+			}
 		default:
 			return nil, fmt.Errorf("vfs driver does not support %s options", key)
 		}
 	}
+	if asyncRemove {
+		var err error
+		if d.trash, err = graphdriver.NewTrash(filepath.Join(home, "trash")); err != nil {
+			return nil, err
+		}
+	}
 	d.updater = graphdriver.NewNaiveLayerIDMapUpdater(d)
 	d.naiveDiff = graphdriver.NewNaiveDiffDriver(d, d.updater)
 
@@ -79,9 +93,11 @@ func Init(home string, options graphdriver.Options) (graphdriver.Driver, error)
 // Driver must be wrapped in NaiveDiffDriver to be used as a graphdriver.Driver
 type Driver struct {
 	name              string
+	homesLock         sync.RWMutex
 	homes             []string
 	idMappings        *idtools.IDMappings
 	ignoreChownErrors bool
+	trash             *graphdriver.Trash
 	naiveDiff         graphdriver.DiffDriver
 	updater           graphdriver.LayerIDMapUpdater
 }
@@ -100,8 +116,11 @@ func (d *Driver) Metadata(id string) (map[string]string, error) {
 	return nil, nil
 }
 
-// Cleanup is used to implement graphdriver.ProtoDriver. There is no cleanup required for this driver.
+// Cleanup is used to implement graphdriver.ProtoDriver. The only cleanup required for this driver is to stop emptying the trash, if async_remove is set.
 func (d *Driver) Cleanup() error {
+	if d.trash != nil {
+		d.trash.Close()
+	}
 	return nil
 }
 
@@ -120,6 +139,12 @@ func (d *Driver) DiffGetter(id string) (graphdriver.FileGetCloser, error) {
 	return fileGetNilCloser{storage.NewPathFileGetter(p)}, nil
 }
 
+// UpperDir returns the directory of the layer, which holds all of its files
+// and is also where it is "mounted".
+func (d *Driver) UpperDir(id string) (string, error) {
+	return d.dir(id), nil
+}
+
 // CreateFromTemplate creates a layer with the same contents and parent as another layer.
 func (d *Driver) CreateFromTemplate(id, template string, templateIDMappings *idtools.IDMappings, parent string, parentIDMappings *idtools.IDMappings, opts *graphdriver.CreateOpts, readWrite bool) error {
 	if readWrite {
@@ -201,6 +226,8 @@ func (d *Driver) create(id, parent string, opts *graphdriver.CreateOpts, ro bool
 }
 
 func (d *Driver) dir(id string) string {
+	d.homesLock.RLock()
+	defer d.homesLock.RUnlock()
 	for i, home := range d.homes {
 		if i > 0 {
 			home = filepath.Join(home, d.String())
@@ -216,22 +243,22 @@ func (d *Driver) dir(id string) string {
 
 // Remove deletes the content from the directory for a given id.
 func (d *Driver) Remove(id string) error {
+	if d.trash != nil {
+		return d.trash.Add(d.dir(id))
+	}
 	return system.EnsureRemoveAll(d.dir(id))
 }
 
 // Get returns the directory for the given id.
 func (d *Driver) Get(id string, options graphdriver.MountOpts) (_ string, retErr error) {
 	dir := d.dir(id)
-	switch len(options.Options) {
-	case 0:
-	case 1:
-		if options.Options[0] == "ro" {
-			// ignore "ro" option
-			break
+	// Nothing is actually mounted, so "ro" can be ignored, and since we
+	// never sync anything, neither can a request for a volatile mount.
+	// Any other option would require an actual mount to be honored.
+	for _, opt := range options.Options {
+		if opt != "ro" {
+			return "", fmt.Errorf("vfs driver does not support mount option %q", opt)
 		}
-		fallthrough
-	default:
-		return "", fmt.Errorf("vfs driver does not support mount options")
 	}
 	if st, err := os.Stat(dir); err != nil {
 		return "", err
@@ -262,17 +289,45 @@ func (d *Driver) Exists(id string) bool {
 
 // AdditionalImageStores returns additional image stores supported by the driver
 func (d *Driver) AdditionalImageStores() []string {
+	d.homesLock.RLock()
+	defer d.homesLock.RUnlock()
 	if len(d.homes) > 1 {
-		return d.homes[1:]
+		return append([]string(nil), d.homes[1:]...)
 	}
 	return nil
 }
 
+// SetAdditionalImageStores replaces the additional image stores in which the
+// directories of layers are looked up.
+func (d *Driver) SetAdditionalImageStores(stores []string) error {
+	d.homesLock.Lock()
+	defer d.homesLock.Unlock()
+	d.homes = append([]string{d.homes[0]}, stores...)
+	return nil
+}
+
 // SupportsShifting tells whether the driver support shifting of the UIDs/GIDs in an userNS
 func (d *Driver) SupportsShifting() bool {
 	return d.updater.SupportsShifting()
 }
 
+// Capabilities reports the features which the driver supports.  Layers are
+// copies of their parents, which are made using reflinks if the file system
+// of the driver's home directory supports them.
+func (d *Driver) Capabilities() graphdriver.Capabilities {
+	d.homesLock.RLock()
+	home := d.homes[0]
+	d.homesLock.RUnlock()
+	reflinks, err := supportsReflinks(home)
+	if err != nil {
+		logrus.Debugf("vfs: checking for reflink support: %v", err)
+	}
+	return graphdriver.Capabilities{
+		Reflinks:   reflinks,
+		IDShifting: d.SupportsShifting(),
+	}
+}
+
 // UpdateLayerIDMap updates ID mappings in a from matching the ones specified
 // by toContainer to those specified by toHost.
 func (d *Driver) UpdateLayerIDMap(id string, toContainer, toHost *idtools.IDMappings, mountLabel string) error {
@@ -55,4 +55,16 @@ var (
 	ErrStoreIsReadOnly = types.ErrStoreIsReadOnly
 	// ErrNotSupported is returned when the requested functionality is not supported.
 	ErrNotSupported = types.ErrNotSupported
+	// ErrLayerCorrupted is returned when the contents of a layer don't match the digests which were recorded for it.
+	ErrLayerCorrupted = types.ErrLayerCorrupted
+	// ErrLayerMountOptionsConflict is returned when the caller attempts to mount a layer with options which differ from those of its current mount.
+	ErrLayerMountOptionsConflict = types.ErrLayerMountOptionsConflict
+	// ErrLayerHasNoTarSplit is returned when the original tarball of a layer is requested, but no tar-split metadata was recorded for it.
+	ErrLayerHasNoTarSplit = types.ErrLayerHasNoTarSplit
+	// ErrLayerNotMaterialized is returned when a layer which was registered with RegisterLazyLayer is needed, but its contents haven't been fetched and no fetcher for them is known.
+	ErrLayerNotMaterialized = types.ErrLayerNotMaterialized
+	// ErrLayerPinned is returned when the caller attempts to delete a layer which was pinned with PinLayer.
+	ErrLayerPinned = types.ErrLayerPinned
+	// ErrContainerSizeLimitExceeded is returned when the layer of a container has grown past the size limit which was set for it.
+	ErrContainerSizeLimitExceeded = types.ErrContainerSizeLimitExceeded
 )
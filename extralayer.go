@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/storage/pkg/archive"
+	"github.com/containers/storage/pkg/mount"
+	"github.com/containers/storage/pkg/system"
+	"github.com/opencontainers/selinux/go-selinux/label"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// The mounts created by MountWithExtraLayer are kept in directories under
+// extraLayerMountsDir in the run root, each holding the tmpfs with the upper
+// and work directories of the overlay, the overlay's mount point, and a file
+// recording the ID of the image's top layer, which is mounted as the lower
+// directory of the overlay.
+const (
+	extraLayerMountsDir   = "extra-layer-mounts"
+	extraLayerTmpfs       = "tmpfs"
+	extraLayerMerged      = "merged"
+	extraLayerLowerRecord = "layer"
+)
+
+// ExtraLayerOptions is used for passing options to a Store's
+// MountWithExtraLayer() method.
+type ExtraLayerOptions struct {
+	// MountLabel is the SELinux label to assign to the mount.
+	MountLabel string
+	// Size, if not zero, limits the size, in bytes, of the contents of the
+	// extra layer, including what is written to the mount.
+	Size int64
+}
+
+func (s *store) MountWithExtraLayer(imageID string, extraTar io.Reader, options *ExtraLayerOptions) (mountPoint string, err error) {
+	if options == nil {
+		options = &ExtraLayerOptions{}
+	}
+	img, err := s.Image(imageID)
+	if err != nil {
+		return "", err
+	}
+	if img.TopLayer == "" {
+		return "", errors.Wrapf(ErrLayerUnknown, "image %q has no layers to mount", img.ID)
+	}
+	layer, err := s.Layer(img.TopLayer)
+	if err != nil {
+		return "", err
+	}
+
+	mountsDir := filepath.Join(s.runRoot, extraLayerMountsDir)
+	if err := os.MkdirAll(mountsDir, 0700); err != nil {
+		return "", err
+	}
+	dir, err := ioutil.TempDir(mountsDir, "")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			if err2 := os.RemoveAll(dir); err2 != nil {
+				logrus.Errorf("Removing %q: %v", dir, err2)
+			}
+		}
+	}()
+	if err := ioutil.WriteFile(filepath.Join(dir, extraLayerLowerRecord), []byte(layer.ID), 0600); err != nil {
+		return "", err
+	}
+
+	lower, err := s.MountImage(img.ID, nil, options.MountLabel)
+	if err != nil {
+		return "", errors.Wrapf(err, "mounting image %q", img.ID)
+	}
+	defer func() {
+		if err != nil {
+			if _, err2 := s.Unmount(layer.ID, false); err2 != nil {
+				logrus.Errorf("Unmounting layer %q: %v", layer.ID, err2)
+			}
+		}
+	}()
+
+	tmpfs := filepath.Join(dir, extraLayerTmpfs)
+	if err := os.Mkdir(tmpfs, 0700); err != nil {
+		return "", err
+	}
+	tmpfsOptions := "mode=0700"
+	if options.Size != 0 {
+		tmpfsOptions += fmt.Sprintf(",size=%d", options.Size)
+	}
+	if err := mount.Mount("tmpfs", tmpfs, "tmpfs", tmpfsOptions); err != nil {
+		return "", errors.Wrapf(err, "mounting a tmpfs for the extra layer")
+	}
+	defer func() {
+		if err != nil {
+			if err2 := mount.Unmount(tmpfs); err2 != nil {
+				logrus.Errorf("Unmounting %q: %v", tmpfs, err2)
+			}
+		}
+	}()
+
+	// The upper directory is the root of the mount, so it starts with the
+	// attributes of the image's root directory.
+	upper := filepath.Join(tmpfs, "upper")
+	work := filepath.Join(tmpfs, "work")
+	if err := os.Mkdir(work, 0700); err != nil {
+		return "", err
+	}
+	root, err := system.Stat(lower)
+	if err != nil {
+		return "", err
+	}
+	if err := os.Mkdir(upper, 0700); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(upper, os.FileMode(root.Mode()).Perm()); err != nil {
+		return "", err
+	}
+	if err := os.Chown(upper, int(root.UID()), int(root.GID())); err != nil {
+		return "", err
+	}
+	if err := archive.Untar(extraTar, upper, &archive.TarOptions{
+		UIDMaps:        layer.UIDMap,
+		GIDMaps:        layer.GIDMap,
+		WhiteoutFormat: archive.OverlayWhiteoutFormat,
+	}); err != nil {
+		return "", errors.Wrapf(err, "extracting the extra layer")
+	}
+
+	merged := filepath.Join(dir, extraLayerMerged)
+	if err := os.Mkdir(merged, 0700); err != nil {
+		return "", err
+	}
+	overlayOptions := label.FormatMountLabel(fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lower, upper, work), options.MountLabel)
+	if err := mount.Mount("overlay", merged, "overlay", overlayOptions); err != nil {
+		return "", errors.Wrapf(err, "mounting the extra layer over image %q", img.ID)
+	}
+	return merged, nil
+}
+
+func (s *store) UnmountExtraLayer(mountPoint string) error {
+	dir := filepath.Dir(filepath.Clean(mountPoint))
+	if filepath.Base(mountPoint) != extraLayerMerged || filepath.Dir(dir) != filepath.Join(s.runRoot, extraLayerMountsDir) {
+		return errors.Errorf("%q was not mounted by MountWithExtraLayer", mountPoint)
+	}
+	layerID, err := ioutil.ReadFile(filepath.Join(dir, extraLayerLowerRecord))
+	if err != nil {
+		return errors.Wrapf(err, "reading the layer mounted under %q", mountPoint)
+	}
+	if err := mount.Unmount(mountPoint); err != nil {
+		return errors.Wrapf(err, "unmounting %q", mountPoint)
+	}
+	tmpfs := filepath.Join(dir, extraLayerTmpfs)
+	if err := mount.Unmount(tmpfs); err != nil {
+		return errors.Wrapf(err, "unmounting %q", tmpfs)
+	}
+	if _, err := s.Unmount(strings.TrimSpace(string(layerID)), false); err != nil && !errors.Is(err, ErrLayerUnknown) {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/containers/storage/pkg/mount"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMountWithExtraLayer(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("mounting the extra layer requires root")
+	}
+	s := newTestStore(t)
+
+	layer, _, err := s.PutLayer("", "", nil, "", false, nil, makeTestLayerTar(t, map[string]string{
+		"file":     "image contents",
+		"replaced": "image contents",
+	}))
+	require.NoError(t, err)
+	img, err := s.CreateImage("", nil, layer.ID, "", nil)
+	require.NoError(t, err)
+
+	extra := makeTestLayerTar(t, map[string]string{
+		"etc/injected": "injected contents",
+		"replaced":     "injected contents",
+	})
+	mountPoint, err := s.MountWithExtraLayer(img.ID, extra, nil)
+	if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.ENODEV) {
+		t.Skipf("overlay or tmpfs mounts are not supported: %v", err)
+	}
+	require.NoError(t, err)
+	for name, contents := range map[string]string{
+		"file":         "image contents",
+		"replaced":     "injected contents",
+		"etc/injected": "injected contents",
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(mountPoint, name))
+		require.NoError(t, err)
+		require.Equal(t, contents, string(data))
+	}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(mountPoint, "written"), []byte("written"), 0644))
+	count, err := s.Mounted(layer.ID)
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+
+	require.NoError(t, s.UnmountExtraLayer(mountPoint))
+
+	// nothing is left behind
+	mountsDir := filepath.Join(s.RunRoot(), extraLayerMountsDir)
+	kernelMounts, err := mount.GetMounts()
+	require.NoError(t, err)
+	for _, m := range kernelMounts {
+		require.False(t, strings.HasPrefix(m.Mountpoint, mountsDir), "%q is still mounted", m.Mountpoint)
+	}
+	entries, err := ioutil.ReadDir(mountsDir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+	count, err = s.Mounted(layer.ID)
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+	layers, err := s.Layers()
+	require.NoError(t, err)
+	require.Len(t, layers, 1)
+
+	imageMountPoint, err := s.MountImage(img.ID, nil, "")
+	require.NoError(t, err)
+	for _, name := range []string{"etc/injected", "written"} {
+		_, err := os.Stat(filepath.Join(imageMountPoint, name))
+		require.True(t, os.IsNotExist(err), "%q persisted after unmounting the extra layer", name)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(imageMountPoint, "replaced"))
+	require.NoError(t, err)
+	require.Equal(t, "image contents", string(data))
+	_, err = s.UnmountImage(img.ID, false)
+	require.NoError(t, err)
+
+	require.Error(t, s.UnmountExtraLayer(imageMountPoint))
+}
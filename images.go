@@ -9,13 +9,19 @@ import (
 	"time"
 
 	"github.com/containers/storage/pkg/ioutils"
+	"github.com/containers/storage/pkg/lockfile"
 	"github.com/containers/storage/pkg/stringid"
 	"github.com/containers/storage/pkg/stringutils"
 	"github.com/containers/storage/pkg/truncindex"
 	digest "github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
+// imageStagingDir is the directory of the image store where the big data
+// items of the images which are being created are written.
+const imageStagingDir = "staging"
+
 const (
 	// ImageDigestManifestBigDataNamePrefix is a prefix of big data item
 	// names which we consider to be manifests, used for computing a
@@ -92,6 +98,10 @@ type Image struct {
 	ReadOnly bool `json:"-"`
 
 	Flags map[string]interface{} `json:"flags,omitempty"`
+
+	// Binds are the directories which are bind mounted, read-only, into
+	// the image when it is mounted.
+	Binds []ReadOnlyBind `json:"binds,omitempty"`
 }
 
 // ROImageStore provides bookkeeping for information about Images.
@@ -133,11 +143,20 @@ type ImageStore interface {
 	// read-only) layer.  That layer can be referenced by multiple images.
 	Create(id string, names []string, layer, metadata string, created time.Time, searchableDigest digest.Digest) (*Image, error)
 
+	// CreateWithBigData is like Create, but the image is created with the
+	// specified big data items.  Either the image is recorded with all of
+	// them, or, if anything fails, nothing is.
+	CreateWithBigData(id string, names []string, layer, metadata string, created time.Time, searchableDigest digest.Digest, bigData []ImageBigDataOption) (*Image, error)
+
 	// SetNames replaces the list of names associated with an image with the
 	// supplied values.  The values are expected to be valid normalized
 	// named image references.
 	SetNames(id string, names []string) error
 
+	// SetBinds replaces the list of directories which are bind mounted
+	// into the image when it is mounted.
+	SetBinds(id string, binds []ReadOnlyBind) error
+
 	// Delete removes the record of the image.
 	Delete(id string) error
 
@@ -154,6 +173,9 @@ type imageStore struct {
 	byname   map[string]*Image
 	bydigest map[digest.Digest][]*Image
 	loadMut  sync.Mutex
+	// journalCrash is the journalCrashHook of the store which uses this
+	// image store.
+	journalCrash *journalCrashHook
 }
 
 func copyImage(i *Image) *Image {
@@ -172,6 +194,7 @@ func copyImage(i *Image) *Image {
 		Created:         i.Created,
 		ReadOnly:        i.ReadOnly,
 		Flags:           copyStringInterfaceMap(i.Flags),
+		Binds:           copyReadOnlyBinds(i.Binds),
 	}
 }
 
@@ -317,7 +340,7 @@ func (r *imageStore) Save() error {
 	return ioutils.AtomicWriteFile(rpath, jdata, 0600)
 }
 
-func newImageStore(dir string) (ImageStore, error) {
+func newImageStore(dir string, journalCrash *journalCrashHook) (ImageStore, error) {
 	if err := os.MkdirAll(dir, 0700); err != nil {
 		return nil, err
 	}
@@ -328,12 +351,13 @@ func newImageStore(dir string) (ImageStore, error) {
 	lockfile.Lock()
 	defer lockfile.Unlock()
 	istore := imageStore{
-		lockfile: lockfile,
-		dir:      dir,
-		images:   []*Image{},
-		byid:     make(map[string]*Image),
-		byname:   make(map[string]*Image),
-		bydigest: make(map[digest.Digest][]*Image),
+		lockfile:     lockfile,
+		dir:          dir,
+		images:       []*Image{},
+		byid:         make(map[string]*Image),
+		byname:       make(map[string]*Image),
+		bydigest:     make(map[digest.Digest][]*Image),
+		journalCrash: journalCrash,
 	}
 	if err := istore.Load(); err != nil {
 		return nil, err
@@ -346,6 +370,20 @@ func newROImageStore(dir string) (ROImageStore, error) {
 	if err != nil {
 		return nil, err
 	}
+	return newROImageStoreWithLockfile(dir, lockfile)
+}
+
+// newSharedROImageStore opens the image store in dir read-only, in a way
+// which allows it to also be opened read-write in this process.
+func newSharedROImageStore(dir string) (ROImageStore, error) {
+	lockfile, err := lockfile.GetReadOnlyView(filepath.Join(dir, "images.lock"))
+	if err != nil {
+		return nil, err
+	}
+	return newROImageStoreWithLockfile(dir, lockfile)
+}
+
+func newROImageStoreWithLockfile(dir string, lockfile Locker) (ROImageStore, error) {
 	lockfile.RLock()
 	defer lockfile.Unlock()
 	istore := imageStore{
@@ -401,7 +439,11 @@ func (r *imageStore) SetFlag(id string, flag string, value interface{}) error {
 	return r.Save()
 }
 
-func (r *imageStore) Create(id string, names []string, layer, metadata string, created time.Time, searchableDigest digest.Digest) (image *Image, err error) {
+func (r *imageStore) Create(id string, names []string, layer, metadata string, created time.Time, searchableDigest digest.Digest) (*Image, error) {
+	return r.CreateWithBigData(id, names, layer, metadata, created, searchableDigest, nil)
+}
+
+func (r *imageStore) CreateWithBigData(id string, names []string, layer, metadata string, created time.Time, searchableDigest digest.Digest, bigData []ImageBigDataOption) (*Image, error) {
 	if !r.IsReadWrite() {
 		return nil, errors.Wrapf(ErrStoreIsReadOnly, "not allowed to create new images at %q", r.imagespath())
 	}
@@ -425,38 +467,105 @@ func (r *imageStore) Create(id string, names []string, layer, metadata string, c
 	if created.IsZero() {
 		created = time.Now().UTC()
 	}
-	if err == nil {
-		image = &Image{
-			ID:             id,
-			Digest:         searchableDigest,
-			Digests:        nil,
-			Names:          names,
-			TopLayer:       layer,
-			Metadata:       metadata,
-			BigDataNames:   []string{},
-			BigDataSizes:   make(map[string]int64),
-			BigDataDigests: make(map[string]digest.Digest),
-			Created:        created,
-			Flags:          make(map[string]interface{}),
-		}
-		err := image.recomputeDigests()
-		if err != nil {
-			return nil, errors.Wrapf(err, "error validating digests for new image")
-		}
-		r.images = append(r.images, image)
-		r.idindex.Add(id)
-		r.byid[id] = image
-		for _, name := range names {
-			r.byname[name] = image
+	image := &Image{
+		ID:             id,
+		Digest:         searchableDigest,
+		Digests:        nil,
+		Names:          names,
+		TopLayer:       layer,
+		Metadata:       metadata,
+		BigDataNames:   []string{},
+		BigDataSizes:   make(map[string]int64),
+		BigDataDigests: make(map[string]digest.Digest),
+		Created:        created,
+		Flags:          make(map[string]interface{}),
+	}
+	if err := r.writeNewBigData(image, bigData); err != nil {
+		return nil, err
+	}
+	if r.journalCrash.at("image-data-written") {
+		return nil, errJournalCrash
+	}
+	// Nothing refers to the image's data directory until the image is
+	// recorded, so that is all there is to remove if that fails.
+	if err := image.recomputeDigests(); err != nil {
+		if err2 := os.RemoveAll(r.datadir(id)); err2 != nil {
+			logrus.Errorf("Removing the data of image %q: %v", id, err2)
 		}
-		for _, digest := range image.Digests {
-			list := r.bydigest[digest]
-			r.bydigest[digest] = append(list, image)
+		return nil, errors.Wrapf(err, "error validating digests for new image")
+	}
+	r.images = append(r.images, image)
+	r.idindex.Add(id)
+	r.byid[id] = image
+	for _, name := range names {
+		r.byname[name] = image
+	}
+	for _, digest := range image.Digests {
+		list := r.bydigest[digest]
+		r.bydigest[digest] = append(list, image)
+	}
+	if err := r.Save(); err != nil {
+		r.forget(image)
+		if err2 := os.RemoveAll(r.datadir(id)); err2 != nil {
+			logrus.Errorf("Removing the data of image %q: %v", id, err2)
 		}
-		err = r.Save()
-		image = copyImage(image)
+		return nil, err
 	}
-	return image, err
+	return copyImage(image), nil
+}
+
+// writeNewBigData writes the big data items of image, which is being created,
+// to a staging directory, which is then renamed to the image's data
+// directory, so that the directory either has all of them or doesn't exist.
+// The names, sizes and digests of the items are recorded in image.
+func (r *imageStore) writeNewBigData(image *Image, bigData []ImageBigDataOption) error {
+	if len(bigData) == 0 {
+		return nil
+	}
+	// The store is locked, so whatever was staged before was left by a
+	// process which didn't finish creating an image.
+	stagingRoot := filepath.Join(r.dir, imageStagingDir)
+	if err := os.RemoveAll(stagingRoot); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(stagingRoot, 0700); err != nil {
+		return err
+	}
+	staging, err := ioutil.TempDir(stagingRoot, image.ID)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := os.RemoveAll(staging); err != nil {
+			logrus.Debugf("Removing %q: %v", staging, err)
+		}
+	}()
+	for _, item := range bigData {
+		if item.Key == "" {
+			return errors.Wrapf(ErrInvalidBigDataName, "can't set empty name for image big data item")
+		}
+		itemDigest := item.Digest
+		if itemDigest == "" {
+			if bigDataNameIsManifest(item.Key) {
+				return errors.Wrapf(ErrDigestUnknown, "no digest provided for manifest %q of image %q", item.Key, image.ID)
+			}
+			itemDigest = digest.Canonical.FromBytes(item.Data)
+		}
+		if err := ioutils.AtomicWriteFile(filepath.Join(staging, makeBigDataBaseName(item.Key)), item.Data, 0600); err != nil {
+			return err
+		}
+		if _, found := image.BigDataSizes[item.Key]; !found {
+			image.BigDataNames = append(image.BigDataNames, item.Key)
+		}
+		image.BigDataSizes[item.Key] = int64(len(item.Data))
+		image.BigDataDigests[item.Key] = itemDigest
+	}
+	// An image with this ID isn't known, so a data directory for it can
+	// only be left over from a failed attempt to create it.
+	if err := os.RemoveAll(r.datadir(image.ID)); err != nil {
+		return err
+	}
+	return os.Rename(staging, r.datadir(image.ID))
 }
 
 func (r *imageStore) addMappedTopLayer(id, layer string) error {
@@ -498,6 +607,17 @@ func (r *imageStore) SetMetadata(id, metadata string) error {
 	return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
 }
 
+func (r *imageStore) SetBinds(id string, binds []ReadOnlyBind) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify image binds at %q", r.imagespath())
+	}
+	if image, ok := r.lookup(id); ok {
+		image.Binds = copyReadOnlyBinds(binds)
+		return r.Save()
+	}
+	return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+}
+
 func (r *imageStore) removeName(image *Image, name string) {
 	image.Names = stringSliceWithoutValue(image.Names, name)
 }
@@ -537,6 +657,19 @@ func (r *imageStore) Delete(id string) error {
 		return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
 	}
 	id = image.ID
+	r.forget(image)
+	if err := r.Save(); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(r.datadir(id)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// forget removes image from the list of images and from the indexes.
+func (r *imageStore) forget(image *Image) {
+	id := image.ID
 	toDeleteIndex := -1
 	for i, candidate := range r.images {
 		if candidate.ID == id {
@@ -564,13 +697,6 @@ func (r *imageStore) Delete(id string) error {
 			r.images = append(r.images[:toDeleteIndex], r.images[toDeleteIndex+1:]...)
 		}
 	}
-	if err := r.Save(); err != nil {
-		return err
-	}
-	if err := os.RemoveAll(r.datadir(id)); err != nil {
-		return err
-	}
-	return nil
 }
 
 func (r *imageStore) Get(id string) (*Image, error) {
@@ -610,6 +736,25 @@ func (r *imageStore) BigData(id, key string) ([]byte, error) {
 	return ioutil.ReadFile(r.datapath(image.ID, key))
 }
 
+// immutableBigData reads, without locking the store, the big data item of
+// the image with the specified ID whose name is d, the digest of its
+// contents, such as the image's configuration.  Since such an item is only
+// ever written atomically and can't change without its name changing, its
+// contents are valid as long as they match d and the image still exists,
+// which the caller has to check after it is read.  It returns false if the
+// item isn't there or doesn't match.
+func (r *imageStore) immutableBigData(id string, d digest.Digest) ([]byte, bool) {
+	data, err := ioutil.ReadFile(r.datapath(id, d.String()))
+	if err != nil {
+		return nil, false
+	}
+	verifier := d.Verifier()
+	if _, err := verifier.Write(data); err != nil || !verifier.Verified() {
+		return nil, false
+	}
+	return data, true
+}
+
 func (r *imageStore) BigDataSize(id, key string) (int64, error) {
 	if key == "" {
 		return -1, errors.Wrapf(ErrInvalidBigDataName, "can't retrieve size of image big data with empty name")
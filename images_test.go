@@ -2,17 +2,20 @@ package storage
 
 import (
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
 func newTestImageStore(t *testing.T) ImageStore {
 	dir, err := ioutil.TempDir("", "storage")
 	require.Nil(t, err)
-	store, err := newImageStore(dir)
+	store, err := newImageStore(dir, nil)
 	require.Nil(t, err)
 	return store
 }
@@ -92,3 +95,168 @@ func TestHistoryNames(t *testing.T) {
 	require.Equal(t, secondImage.NamesHistory[0], "3")
 	require.Equal(t, secondImage.NamesHistory[1], "2")
 }
+
+func TestCloneImage(t *testing.T) {
+	store := newTestStore(t)
+
+	base, _, err := store.PutLayer("", "", nil, "", false, nil, makeTestLayerTar(t, map[string]string{"file": "contents"}))
+	require.NoError(t, err)
+	top, _, err := store.PutLayer("", base.ID, nil, "", false, nil, makeTestLayerTar(t, map[string]string{"other": "more contents"}))
+	require.NoError(t, err)
+	image, err := store.CreateImage("", []string{"original"}, top.ID, "metadata", &ImageOptions{})
+	require.NoError(t, err)
+	manifest := []byte(`{"schemaVersion": 2}`)
+	manifestDigest := digest.FromString("manifest")
+	require.NoError(t, store.SetImageBigData(image.ID, "manifest", manifest, func([]byte) (digest.Digest, error) { return manifestDigest, nil }))
+	require.NoError(t, store.SetImageBigData(image.ID, "config", []byte("config"), nil))
+
+	countLayers := func() int {
+		layers, err := store.Layers()
+		require.NoError(t, err)
+		return len(layers)
+	}
+
+	cloneID, err := store.CloneImage("original", "clone", nil)
+	require.NoError(t, err)
+	require.NotEqual(t, image.ID, cloneID)
+	// no layers were created
+	require.Equal(t, 2, countLayers())
+
+	clone, err := store.Image("clone")
+	require.NoError(t, err)
+	require.Equal(t, cloneID, clone.ID)
+	require.Equal(t, top.ID, clone.TopLayer)
+	require.Equal(t, "metadata", clone.Metadata)
+	require.ElementsMatch(t, []string{"manifest", "config"}, clone.BigDataNames)
+	require.Equal(t, manifestDigest, clone.BigDataDigests["manifest"])
+	require.Contains(t, clone.Digests, manifestDigest)
+	data, err := store.ImageBigData(cloneID, "config")
+	require.NoError(t, err)
+	require.Equal(t, "config", string(data))
+
+	// the clone's data items are its own
+	require.NoError(t, store.SetImageBigData(cloneID, "config", []byte("changed"), nil))
+	data, err = store.ImageBigData(image.ID, "config")
+	require.NoError(t, err)
+	require.Equal(t, "config", string(data))
+
+	_, err = store.CloneImage(image.ID, "clone", nil)
+	require.True(t, errors.Is(err, ErrDuplicateName))
+	_, err = store.CloneImage("no-such-image", "another-clone", nil)
+	require.True(t, errors.Is(err, ErrImageUnknown))
+
+	unnamedID, err := store.CloneImage(image.ID, "", nil)
+	require.NoError(t, err)
+	unnamed, err := store.Image(unnamedID)
+	require.NoError(t, err)
+	require.Empty(t, unnamed.Names)
+	_, err = store.DeleteImage(unnamedID, true)
+	require.NoError(t, err)
+
+	withLayerID, err := store.CloneImage(image.ID, "with-layer", &CloneImageOptions{NewTopLayer: true})
+	require.NoError(t, err)
+	withLayer, err := store.Image(withLayerID)
+	require.NoError(t, err)
+	newTop, err := store.Layer(withLayer.TopLayer)
+	require.NoError(t, err)
+	require.Equal(t, top.ID, newTop.Parent)
+	require.Equal(t, 3, countLayers())
+
+	// removing the original keeps the layers which the clones use
+	removed, err := store.DeleteImage(image.ID, true)
+	require.NoError(t, err)
+	require.Empty(t, removed)
+	require.Equal(t, 3, countLayers())
+	data, err = store.ImageBigData(cloneID, "manifest")
+	require.NoError(t, err)
+	require.Equal(t, manifest, data)
+
+	// the layers are removed along with the last image which uses them
+	removed, err = store.DeleteImage(withLayerID, true)
+	require.NoError(t, err)
+	require.Equal(t, []string{newTop.ID}, removed)
+	removed, err = store.DeleteImage(cloneID, true)
+	require.NoError(t, err)
+	require.Equal(t, []string{top.ID, base.ID}, removed)
+	require.Equal(t, 0, countLayers())
+}
+
+func TestCreateImageWithBigData(t *testing.T) {
+	s := newTestStore(t)
+
+	manifest := []byte(`{"schemaVersion": 2}`)
+	manifestDigest := digest.FromBytes(manifest)
+	image, err := s.CreateImage("", []string{"complete"}, "", "", &ImageOptions{
+		BigData: []ImageBigDataOption{
+			{Key: "config", Data: []byte("config")},
+			{Key: "manifest", Data: manifest, Digest: manifestDigest},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"config", "manifest"}, image.BigDataNames)
+	require.Equal(t, digest.FromString("config"), image.BigDataDigests["config"])
+	require.Equal(t, int64(len(manifest)), image.BigDataSizes["manifest"])
+	require.Contains(t, image.Digests, manifestDigest)
+	data, err := s.ImageBigData(image.ID, "manifest")
+	require.NoError(t, err)
+	require.Equal(t, manifest, data)
+	images, err := s.ImagesByDigest(manifestDigest)
+	require.NoError(t, err)
+	require.Len(t, images, 1)
+
+	// The manifest can't be stored without its digest, after the
+	// configuration was.
+	_, err = s.CreateImage("partial", []string{"partial"}, "", "", &ImageOptions{
+		BigData: []ImageBigDataOption{
+			{Key: "config", Data: []byte("config")},
+			{Key: "manifest", Data: manifest},
+		},
+	})
+	require.True(t, errors.Is(err, ErrDigestUnknown))
+	require.False(t, s.Exists("partial"))
+	_, err = s.Image("partial")
+	require.True(t, errors.Is(err, ErrImageUnknown))
+
+	ristore, err := s.(*store).ImageStore()
+	require.NoError(t, err)
+	imagesDir := ristore.(*imageStore).dir
+	_, err = os.Stat(filepath.Join(imagesDir, "partial"))
+	require.True(t, os.IsNotExist(err))
+	staged, err := ioutil.ReadDir(filepath.Join(imagesDir, imageStagingDir))
+	require.NoError(t, err)
+	require.Empty(t, staged)
+}
+
+func TestCreateWithBigDataRollback(t *testing.T) {
+	store := newTestImageStore(t)
+	store.Lock()
+	dir := store.(*imageStore).dir
+
+	// Recording the image fails once its data is in place.
+	imagesPath := filepath.Join(dir, "images.json")
+	require.NoError(t, os.RemoveAll(imagesPath))
+	require.NoError(t, os.Mkdir(imagesPath, 0700))
+	_, err := store.CreateWithBigData("failed", []string{"failed"}, "", "", time.Time{}, "", []ImageBigDataOption{{Key: "config", Data: []byte("config")}})
+	require.Error(t, err)
+	require.False(t, store.Exists("failed"))
+	_, err = store.Lookup("failed")
+	require.Error(t, err)
+	_, err = os.Stat(filepath.Join(dir, "failed"))
+	require.True(t, os.IsNotExist(err))
+
+	// The same image can be created once that works again, and nothing of
+	// the failed attempt is loaded.
+	require.NoError(t, os.Remove(imagesPath))
+	_, err = store.CreateWithBigData("created", nil, "", "", time.Time{}, "", nil)
+	require.NoError(t, err)
+	image, err := store.CreateWithBigData("failed", []string{"failed"}, "", "", time.Time{}, "", []ImageBigDataOption{{Key: "config", Data: []byte("config")}})
+	require.NoError(t, err)
+	require.Equal(t, []string{"config"}, image.BigDataNames)
+	store.Unlock()
+
+	reloaded, err := newImageStore(dir, nil)
+	require.NoError(t, err)
+	images, err := reloaded.Images()
+	require.NoError(t, err)
+	require.Len(t, images, 2)
+}
@@ -0,0 +1,346 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/storage/pkg/ioutils"
+	"github.com/containers/storage/pkg/stringid"
+	"github.com/containers/storage/pkg/stringutils"
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// The operations which are recorded in the journal, because they change
+// more than one of the store's files, or the driver's data and a file.
+// Creations are undone if they were interrupted, and deletions completed.
+const (
+	journalCreateLayer     = "create-layer"
+	journalCreateImage     = "create-image"
+	journalDeleteLayers    = "delete-layers"
+	journalDeleteImage     = "delete-image"
+	journalDeleteContainer = "delete-container"
+)
+
+// journalEntry describes an operation recorded in the journal.
+type journalEntry struct {
+	Operation  string   `json:"operation"`
+	Layers     []string `json:"layers,omitempty"`
+	Images     []string `json:"images,omitempty"`
+	Containers []string `json:"containers,omitempty"`
+}
+
+// journalRecord is the file of an operation in the journal, which is removed
+// when the operation is done.
+type journalRecord struct {
+	path string
+}
+
+// journalCrashHook is checked, with the name of the step which was just done,
+// at the points of the operations recorded in the journal where a crash would
+// leave the store's files out of sync with one another.  A store shares it
+// with its read-write layer and image stores, so that tests can set its crash
+// function to simulate a crash at one of them, in which case the operation
+// fails with errJournalCrash, and its record is kept.
+type journalCrashHook struct {
+	crash func(step string) bool
+}
+
+// at returns true if a crash is to be simulated after step.
+func (h *journalCrashHook) at(step string) bool {
+	return h != nil && h.crash != nil && h.crash(step)
+}
+
+// errJournalCrash is returned by the operations interrupted by journalCrash.
+var errJournalCrash = errors.New("simulated crash")
+
+// journalDir returns the directory where the records of the operations in
+// progress are kept.
+func (s *store) journalDir() string {
+	return filepath.Join(s.metadataDir(s.graphRoot), s.graphDriverName+"-journal")
+}
+
+// beginJournal records entry in the journal.  The caller must hold the write
+// lock of the store whose files the operation changes, or of the layer store
+// if it changes the files of more than one, until it calls the record's
+// finish method.  The recovery takes the locks of all of them, so it never
+// sees the record of an operation which is still in progress.
+func (s *store) beginJournal(entry journalEntry) (*journalRecord, error) {
+	dir := s.journalDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(&entry)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, stringid.GenerateRandomID()+".json")
+	opts := &ioutils.AtomicFileWriterOptions{NoSync: s.syncPolicy == SyncPolicyNone}
+	if err := ioutils.AtomicWriteFileWithOpts(path, data, 0600, opts); err != nil {
+		return nil, errors.Wrapf(err, "recording a %s operation in the journal", entry.Operation)
+	}
+	return &journalRecord{path: path}, nil
+}
+
+// finish removes the record of an operation which returned err, unless it
+// was interrupted by a journalCrashHook.
+func (j *journalRecord) finish(err error) {
+	if merr, ok := err.(*multierror.Error); ok {
+		for _, err := range merr.Errors {
+			if errors.Cause(err) == errJournalCrash {
+				return
+			}
+		}
+	}
+	if errors.Cause(err) == errJournalCrash {
+		return
+	}
+	if err := os.Remove(j.path); err != nil && !os.IsNotExist(err) {
+		logrus.Errorf("Removing the journal record %q: %v", j.path, err)
+	}
+}
+
+// recoverJournal completes or undoes the operations recorded in the journal
+// by processes which died before they were done.  The ones which fail are
+// logged, and kept to be tried again.
+func (s *store) recoverJournal() error {
+	dir := s.journalDir()
+	if names, err := journalRecords(dir); err != nil || len(names) == 0 {
+		return err
+	}
+	rlstore, err := s.LayerStore()
+	if err != nil {
+		return err
+	}
+	ristore, err := s.ImageStore()
+	if err != nil {
+		return err
+	}
+	rcstore, err := s.ContainerStore()
+	if err != nil {
+		return err
+	}
+	rlstore.Lock()
+	defer rlstore.Unlock()
+	if err := rlstore.ReloadIfChanged(); err != nil {
+		return err
+	}
+	ristore.Lock()
+	defer ristore.Unlock()
+	if err := ristore.ReloadIfChanged(); err != nil {
+		return err
+	}
+	rcstore.Lock()
+	defer rcstore.Unlock()
+	if err := rcstore.ReloadIfChanged(); err != nil {
+		return err
+	}
+
+	// with the lock held, the ones left are those of dead processes
+	names, err := journalRecords(dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var entry journalEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			logrus.Errorf("Discarding the unreadable journal record %q: %v", path, err)
+		} else if err := s.recoverOperation(&entry, rlstore, ristore, rcstore); err != nil {
+			logrus.Errorf("Recovering from an interrupted %s operation: %v", entry.Operation, err)
+			continue
+		} else {
+			logrus.Infof("Recovered from an interrupted %s operation", entry.Operation)
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// journalRecords lists the names of the records in the journal directory.
+func journalRecords(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		// skip the temporary files of records being written
+		if strings.HasSuffix(info.Name(), ".json") && !strings.HasPrefix(info.Name(), ".") {
+			names = append(names, info.Name())
+		}
+	}
+	return names, nil
+}
+
+// recoverOperation completes or undoes an interrupted operation.
+func (s *store) recoverOperation(entry *journalEntry, rlstore LayerStore, ristore ImageStore, rcstore ContainerStore) error {
+	switch entry.Operation {
+	case journalCreateLayer:
+		for _, id := range entry.Layers {
+			if rlstore.Exists(id) {
+				// a process which was already running could have
+				// used it in the meantime
+				layers, err := rlstore.Layers()
+				if err != nil {
+					return err
+				}
+				images, err := ristore.Images()
+				if err != nil {
+					return err
+				}
+				containers, err := rcstore.Containers()
+				if err != nil {
+					return err
+				}
+				if layerInUse(id, layers, images, containers) {
+					logrus.Warnf("Keeping layer %q, whose creation was interrupted, which is in use", id)
+					continue
+				}
+				if err := rlstore.Delete(id); err != nil {
+					return err
+				}
+			} else if s.graphDriver.Exists(id) {
+				if err := s.graphDriver.Remove(id); err != nil {
+					return err
+				}
+			}
+		}
+	case journalCreateImage:
+		for _, id := range entry.Images {
+			if ristore.Exists(id) {
+				containers, err := rcstore.Containers()
+				if err != nil {
+					return err
+				}
+				inUse := false
+				for _, container := range containers {
+					inUse = inUse || container.ImageID == id
+				}
+				if inUse {
+					logrus.Warnf("Keeping image %q, whose creation was interrupted, which is in use", id)
+					continue
+				}
+				if err := ristore.Delete(id); err != nil {
+					return err
+				}
+			} else if istore, ok := ristore.(*imageStore); ok {
+				if err := os.RemoveAll(istore.datadir(id)); err != nil {
+					return err
+				}
+			}
+		}
+	case journalDeleteContainer:
+		for _, id := range entry.Containers {
+			if rcstore.Exists(id) {
+				if err := rcstore.Delete(id); err != nil {
+					return err
+				}
+			}
+			middleDir := s.graphDriverName + "-containers"
+			for _, root := range []string{s.graphRoot, s.runRoot} {
+				if err := os.RemoveAll(filepath.Join(root, middleDir, id)); err != nil {
+					return err
+				}
+			}
+		}
+		return s.recoverLayerDeletions(entry.Layers, rlstore, ristore, rcstore)
+	case journalDeleteImage:
+		for _, id := range entry.Images {
+			if ristore.Exists(id) {
+				if err := ristore.Delete(id); err != nil {
+					return err
+				}
+			}
+		}
+		return s.recoverLayerDeletions(entry.Layers, rlstore, ristore, rcstore)
+	case journalDeleteLayers:
+		return s.recoverLayerDeletions(entry.Layers, rlstore, ristore, rcstore)
+	default:
+		return errors.Errorf("unknown operation %q", entry.Operation)
+	}
+	return nil
+}
+
+// recoverLayerDeletions completes the deletion of layers, in order, except
+// for the ones which, since then, are used by other layers, by images, or by
+// containers, and removes the deleted ones from the images which list them
+// as mapped top layers.
+func (s *store) recoverLayerDeletions(ids []string, rlstore LayerStore, ristore ImageStore, rcstore ContainerStore) error {
+	for _, id := range ids {
+		if rlstore.Exists(id) {
+			layers, err := rlstore.Layers()
+			if err != nil {
+				return err
+			}
+			images, err := ristore.Images()
+			if err != nil {
+				return err
+			}
+			containers, err := rcstore.Containers()
+			if err != nil {
+				return err
+			}
+			if layerInUse(id, layers, images, containers) {
+				logrus.Warnf("Not completing the deletion of layer %q, which is in use", id)
+				continue
+			}
+			if err := rlstore.Delete(id); err != nil {
+				return err
+			}
+		} else if s.graphDriver.Exists(id) {
+			if err := s.graphDriver.Remove(id); err != nil {
+				return err
+			}
+		}
+		istore, ok := ristore.(*imageStore)
+		if !ok {
+			continue
+		}
+		images, err := istore.Images()
+		if err != nil {
+			return err
+		}
+		for _, image := range images {
+			if stringutils.InSlice(image.MappedTopLayers, id) {
+				if err := istore.removeMappedTopLayer(image.ID, id); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// layerInUse checks if the layer is the parent of one of layers, the top
+// layer of one of images, or the layer of one of containers.
+func layerInUse(id string, layers []Layer, images []Image, containers []Container) bool {
+	for _, layer := range layers {
+		if layer.Parent == id {
+			return true
+		}
+	}
+	for _, image := range images {
+		if image.TopLayer == id {
+			return true
+		}
+	}
+	for _, container := range containers {
+		if container.LayerID == id {
+			return true
+		}
+	}
+	return false
+}
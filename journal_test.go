@@ -0,0 +1,276 @@
+package storage
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// reopenTestStore replaces a store, as a process started after a crash would.
+func reopenTestStore(t *testing.T, s Store) Store {
+	_, _ = s.Shutdown(true)
+	s.Free()
+	reopened, err := GetStore(StoreOptions{
+		RunRoot:         s.RunRoot(),
+		GraphRoot:       s.GraphRoot(),
+		GraphDriverName: s.GraphDriverName(),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_, _ = reopened.Shutdown(true)
+		reopened.Free()
+	})
+	return reopened
+}
+
+// requireConsistentStore checks that a store has no problems, no leftover
+// driver data, and no operations left in its journal.
+func requireConsistentStore(t *testing.T, s Store) {
+	report, err := s.Check(nil)
+	require.NoError(t, err)
+	assert.True(t, report.Consistent(), "%+v", report)
+
+	layers, err := s.Layers()
+	require.NoError(t, err)
+	var layerIDs []string
+	for _, layer := range layers {
+		layerIDs = append(layerIDs, layer.ID)
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(s.GraphRoot(), "vfs", "dir"))
+	require.NoError(t, err)
+	var dirs []string
+	for _, entry := range entries {
+		dirs = append(dirs, entry.Name())
+	}
+	assert.ElementsMatch(t, layerIDs, dirs)
+
+	records, err := journalRecords(s.(*store).journalDir())
+	require.NoError(t, err)
+	assert.Empty(t, records)
+}
+
+func TestJournalRecovery(t *testing.T) {
+	// createImage creates an image with two layers, and returns its ID.
+	createImage := func(t *testing.T, s Store) string {
+		base, _, err := s.PutLayer("", "", nil, "", false, nil, makeTestLayerTar(t, map[string]string{"base": "base"}))
+		require.NoError(t, err)
+		top, _, err := s.PutLayer("", base.ID, nil, "", false, nil, makeTestLayerTar(t, map[string]string{"top": "top"}))
+		require.NoError(t, err)
+		image, err := s.CreateImage("", nil, top.ID, "", &ImageOptions{
+			BigData: []ImageBigDataOption{{Key: "config", Data: []byte("{}")}},
+		})
+		require.NoError(t, err)
+		return image.ID
+	}
+
+	for _, c := range []struct {
+		name  string
+		step  string
+		setup func(t *testing.T, s Store) string
+		run   func(s Store, id string) error
+		check func(t *testing.T, s Store, id string)
+	}{
+		{
+			name: "layer creation",
+			step: "layer-created",
+			run: func(s Store, id string) error {
+				_, _, err := s.PutLayer("", "", nil, "", false, nil, makeTestLayerTar(t, map[string]string{"file": "data"}))
+				return err
+			},
+			check: func(t *testing.T, s Store, id string) {
+				layers, err := s.Layers()
+				require.NoError(t, err)
+				assert.Empty(t, layers)
+			},
+		},
+		{
+			name: "layer creation",
+			step: "layer-saved",
+			run: func(s Store, id string) error {
+				_, _, err := s.PutLayer("", "", nil, "", false, nil, makeTestLayerTar(t, map[string]string{"file": "data"}))
+				return err
+			},
+			check: func(t *testing.T, s Store, id string) {
+				layers, err := s.Layers()
+				require.NoError(t, err)
+				assert.Empty(t, layers)
+			},
+		},
+		{
+			name: "image creation",
+			step: "image-data-written",
+			setup: func(t *testing.T, s Store) string {
+				layer, err := s.CreateLayer("", "", nil, "", false, nil)
+				require.NoError(t, err)
+				return layer.ID
+			},
+			run: func(s Store, id string) error {
+				_, err := s.CreateImage("", nil, id, "", &ImageOptions{
+					BigData: []ImageBigDataOption{{Key: "config", Data: []byte("{}")}},
+				})
+				return err
+			},
+			check: func(t *testing.T, s Store, id string) {
+				images, err := s.Images()
+				require.NoError(t, err)
+				assert.Empty(t, images)
+				assert.True(t, s.Exists(id))
+			},
+		},
+		{
+			name: "image creation",
+			step: "image-saved",
+			setup: func(t *testing.T, s Store) string {
+				layer, err := s.CreateLayer("", "", nil, "", false, nil)
+				require.NoError(t, err)
+				return layer.ID
+			},
+			run: func(s Store, id string) error {
+				_, err := s.CreateImage("", nil, id, "", &ImageOptions{
+					BigData: []ImageBigDataOption{{Key: "config", Data: []byte("{}")}},
+				})
+				return err
+			},
+			check: func(t *testing.T, s Store, id string) {
+				images, err := s.Images()
+				require.NoError(t, err)
+				assert.Empty(t, images)
+				assert.True(t, s.Exists(id))
+			},
+		},
+		{
+			name: "layer deletion",
+			step: "layer-removed",
+			setup: func(t *testing.T, s Store) string {
+				layer, _, err := s.PutLayer("", "", nil, "", false, nil, makeTestLayerTar(t, map[string]string{"file": "data"}))
+				require.NoError(t, err)
+				return layer.ID
+			},
+			run: func(s Store, id string) error {
+				return s.DeleteLayer(id)
+			},
+			check: func(t *testing.T, s Store, id string) {
+				assert.False(t, s.Exists(id))
+			},
+		},
+		{
+			name: "layer deletion",
+			step: "layer-deleted",
+			setup: func(t *testing.T, s Store) string {
+				layer, _, err := s.PutLayer("", "", nil, "", false, nil, makeTestLayerTar(t, map[string]string{"file": "data"}))
+				require.NoError(t, err)
+				return layer.ID
+			},
+			run: func(s Store, id string) error {
+				return s.DeleteLayer(id)
+			},
+			check: func(t *testing.T, s Store, id string) {
+				assert.False(t, s.Exists(id))
+			},
+		},
+		{
+			name:  "image deletion",
+			step:  "image-deleted",
+			setup: createImage,
+			run: func(s Store, id string) error {
+				_, err := s.DeleteImage(id, true)
+				return err
+			},
+			check: func(t *testing.T, s Store, id string) {
+				assert.False(t, s.Exists(id))
+				layers, err := s.Layers()
+				require.NoError(t, err)
+				assert.Empty(t, layers)
+			},
+		},
+		{
+			name:  "image deletion",
+			step:  "layer-removed",
+			setup: createImage,
+			run: func(s Store, id string) error {
+				_, err := s.DeleteImage(id, true)
+				return err
+			},
+			check: func(t *testing.T, s Store, id string) {
+				assert.False(t, s.Exists(id))
+				layers, err := s.Layers()
+				require.NoError(t, err)
+				assert.Empty(t, layers)
+			},
+		},
+		{
+			name: "container deletion",
+			step: "layer-removed",
+			setup: func(t *testing.T, s Store) string {
+				container, err := s.CreateContainer("", nil, createImage(t, s), "", "", nil)
+				require.NoError(t, err)
+				return container.ID
+			},
+			run: func(s Store, id string) error {
+				return s.DeleteContainer(id)
+			},
+			check: func(t *testing.T, s Store, id string) {
+				assert.False(t, s.Exists(id))
+				images, err := s.Images()
+				require.NoError(t, err)
+				require.Len(t, images, 1)
+				layers, err := s.Layers()
+				require.NoError(t, err)
+				assert.Len(t, layers, 2)
+			},
+		},
+	} {
+		t.Run(c.name+"/"+c.step, func(t *testing.T) {
+			s := newTestStore(t)
+			id := ""
+			if c.setup != nil {
+				id = c.setup(t, s)
+			}
+
+			step := c.step
+			s.(*store).journalCrash.crash = func(name string) bool {
+				if name == step {
+					// only the first time
+					step = ""
+					return true
+				}
+				return false
+			}
+			err := c.run(s, id)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), errJournalCrash.Error())
+			records, err := journalRecords(s.(*store).journalDir())
+			require.NoError(t, err)
+			assert.Len(t, records, 1)
+
+			s = reopenTestStore(t, s)
+			c.check(t, s, id)
+			requireConsistentStore(t, s)
+		})
+	}
+}
+
+func TestJournalFinishedOperations(t *testing.T) {
+	s := newTestStore(t)
+
+	layer, _, err := s.PutLayer("", "", nil, "", false, nil, makeTestLayerTar(t, map[string]string{"file": "data"}))
+	require.NoError(t, err)
+	image, err := s.CreateImage("", nil, layer.ID, "", nil)
+	require.NoError(t, err)
+	container, err := s.CreateContainer("", nil, image.ID, "", "", nil)
+	require.NoError(t, err)
+
+	// failed operations don't leave records either
+	_, err = s.CreateImage(image.ID, nil, layer.ID, "", nil)
+	require.Error(t, err)
+	err = s.DeleteLayer(layer.ID)
+	require.Error(t, err)
+
+	require.NoError(t, s.DeleteContainer(container.ID))
+	_, err = s.DeleteImage(image.ID, true)
+	require.NoError(t, err)
+	requireConsistentStore(t, s)
+}
@@ -0,0 +1,224 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/containers/storage/pkg/archive"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// The archives written by ExportLayer are uncompressed tarballs whose first
+// entry is an exportedLayer record, followed by the layer's tar-split
+// metadata if it has any, its big data items, and, last, its diff.
+const (
+	exportedLayerVersion = 1
+
+	exportedLayerRecord        = "layer.json"
+	exportedLayerTarSplit      = "tar-split.json"
+	exportedLayerBigDataPrefix = "big-data/"
+	exportedLayerDiff          = "diff.tar"
+)
+
+// exportedLayer describes a layer in an archive written by ExportLayer.
+type exportedLayer struct {
+	// Version is the version of the format of the archive.
+	Version int `json:"version"`
+	// Layer is the exported layer.  The big data items are stored, in
+	// the order of Layer.BigDataNames, as entries whose names are made of
+	// exportedLayerBigDataPrefix and their index in that list.
+	Layer Layer `json:"layer"`
+}
+
+func (s *store) ExportLayer(id string, w io.Writer) error {
+	layer, err := s.Layer(id)
+	if err != nil {
+		return err
+	}
+
+	// The size of the diff must be known before it can be written to the
+	// archive, so it is spooled to a temporary file.
+	uncompressed := archive.Uncompressed
+	diff, err := s.Diff("", layer.ID, &DiffOptions{Compression: &uncompressed})
+	if err != nil {
+		return errors.Wrapf(err, "reading the diff of layer %q", layer.ID)
+	}
+	defer diff.Close()
+	spool, err := ioutil.TempFile("", "layer-export")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		spool.Close()
+		if err := os.Remove(spool.Name()); err != nil {
+			logrus.Debugf("Removing %q: %v", spool.Name(), err)
+		}
+	}()
+	diffSize, err := io.Copy(spool, diff)
+	if err != nil {
+		return errors.Wrapf(err, "reading the diff of layer %q", layer.ID)
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	var tarSplit []byte
+	tsdata, err := s.TarSplitStream(layer.ID)
+	if err == nil {
+		tarSplit, err = ioutil.ReadAll(tsdata)
+		tsdata.Close()
+	}
+	if err != nil && !errors.Is(err, ErrLayerHasNoTarSplit) {
+		return errors.Wrapf(err, "reading the tar-split metadata of layer %q", layer.ID)
+	}
+
+	tw := tar.NewWriter(w)
+	writeEntry := func(name string, size int64, contents io.Reader) error {
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0600,
+			Size:     size,
+		}); err != nil {
+			return err
+		}
+		_, err := io.Copy(tw, contents)
+		return err
+	}
+	record, err := json.Marshal(&exportedLayer{
+		Version: exportedLayerVersion,
+		Layer:   *layer,
+	})
+	if err != nil {
+		return err
+	}
+	if err := writeEntry(exportedLayerRecord, int64(len(record)), bytes.NewReader(record)); err != nil {
+		return err
+	}
+	if tarSplit != nil {
+		if err := writeEntry(exportedLayerTarSplit, int64(len(tarSplit)), bytes.NewReader(tarSplit)); err != nil {
+			return err
+		}
+	}
+	for i, key := range layer.BigDataNames {
+		rc, err := s.LayerBigData(layer.ID, key)
+		if err != nil {
+			return errors.Wrapf(err, "reading big data item %q of layer %q", key, layer.ID)
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return errors.Wrapf(err, "reading big data item %q of layer %q", key, layer.ID)
+		}
+		if err := writeEntry(exportedLayerBigDataPrefix+strconv.Itoa(i), int64(len(data)), bytes.NewReader(data)); err != nil {
+			return err
+		}
+	}
+	if err := writeEntry(exportedLayerDiff, diffSize, spool); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func (s *store) ImportLayer(r io.Reader) (*Layer, error) {
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading the exported layer")
+	}
+	if hdr.Name != exportedLayerRecord {
+		return nil, errors.Errorf("expected %q at the start of the exported layer, found %q", exportedLayerRecord, hdr.Name)
+	}
+	var record exportedLayer
+	if err := json.NewDecoder(tr).Decode(&record); err != nil {
+		return nil, errors.Wrapf(err, "decoding the exported layer")
+	}
+	if record.Version != exportedLayerVersion {
+		return nil, errors.Errorf("unsupported version %d of the exported layer format", record.Version)
+	}
+	exported := &record.Layer
+
+	var tarSplit []byte
+	bigData := make([][]byte, len(exported.BigDataNames))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, errors.Errorf("no diff found in the exported layer %q", exported.ID)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading the exported layer %q", exported.ID)
+		}
+		if hdr.Name == exportedLayerDiff {
+			break
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading %q from the exported layer %q", hdr.Name, exported.ID)
+		}
+		switch {
+		case hdr.Name == exportedLayerTarSplit:
+			tarSplit = data
+		case strings.HasPrefix(hdr.Name, exportedLayerBigDataPrefix):
+			i, err := strconv.Atoi(strings.TrimPrefix(hdr.Name, exportedLayerBigDataPrefix))
+			if err != nil || i < 0 || i >= len(bigData) {
+				return nil, errors.Errorf("unexpected big data item %q in the exported layer %q", hdr.Name, exported.ID)
+			}
+			bigData[i] = data
+		default:
+			return nil, errors.Errorf("unexpected entry %q in the exported layer %q", hdr.Name, exported.ID)
+		}
+	}
+
+	// The diff is passed uncompressed, so the digest of the blob it came
+	// from has to be supplied, while the digest of the diff is computed
+	// again so that it can be checked.
+	options := &LayerOptions{OriginalDigest: exported.CompressedDigest}
+	layer, _, err := s.putLayer(exported.ID, exported.Parent, exported.Names, exported.MountLabel, false, options, exported.Flags, tr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "creating layer %q", exported.ID)
+	}
+	if err := s.importLayerMetadata(layer, exported, tarSplit, bigData); err != nil {
+		if err2 := s.DeleteLayer(layer.ID); err2 != nil {
+			logrus.Errorf("Removing partially imported layer %q: %v", layer.ID, err2)
+		}
+		return nil, err
+	}
+	return s.Layer(layer.ID)
+}
+
+// importLayerMetadata checks that the diff of layer, which was just created
+// by ImportLayer, matches the exported layer, and copies to it the exported
+// layer's tar-split metadata and big data items, and the rest of the
+// information which couldn't be derived from its diff.
+func (s *store) importLayerMetadata(layer, exported *Layer, tarSplit []byte, bigData [][]byte) error {
+	if exported.UncompressedDigest != "" && layer.UncompressedDigest != exported.UncompressedDigest {
+		return errors.Wrapf(ErrLayerCorrupted, "the diff of the exported layer %q has digest %s, expected %s", exported.ID, layer.UncompressedDigest, exported.UncompressedDigest)
+	}
+	rlstore, err := s.LayerStore()
+	if err != nil {
+		return err
+	}
+	rlstore.Lock()
+	defer rlstore.Unlock()
+	if err := rlstore.ReloadIfChanged(); err != nil {
+		return err
+	}
+	if err := rlstore.SetImportedMetadata(layer.ID, exported, tarSplit); err != nil {
+		return errors.Wrapf(err, "recording the metadata of layer %q", layer.ID)
+	}
+	for i, key := range exported.BigDataNames {
+		if bigData[i] == nil {
+			return errors.Errorf("big data item %q of the exported layer %q is missing", key, exported.ID)
+		}
+		if err := rlstore.SetBigData(layer.ID, key, bytes.NewReader(bigData[i])); err != nil {
+			return errors.Wrapf(err, "recording big data item %q of layer %q", key, layer.ID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLayerHooks(t *testing.T) {
+	var calls []string
+	var createErr, mountErr, unmountErr error
+	hooks := &LayerHooks{
+		OnLayerCreate: func(id, parent string) error {
+			calls = append(calls, "create "+id+" "+parent)
+			return createErr
+		},
+		OnMount: func(id, mountPoint string) error {
+			calls = append(calls, "mount "+id+" "+mountPoint)
+			return mountErr
+		},
+		OnUnmount: func(id, mountPoint string) error {
+			calls = append(calls, "unmount "+id+" "+mountPoint)
+			return unmountErr
+		},
+	}
+	wd, err := ioutil.TempDir("", "testStorageLayerHooks")
+	require.NoError(t, err)
+	defer os.RemoveAll(wd)
+	s, err := GetStore(StoreOptions{
+		RunRoot:         filepath.Join(wd, "run"),
+		GraphRoot:       filepath.Join(wd, "root"),
+		GraphDriverName: "vfs",
+		LayerHooks:      hooks,
+	})
+	require.NoError(t, err)
+	defer func() {
+		_, _ = s.Shutdown(true)
+		s.Free()
+	}()
+
+	base, _, err := s.PutLayer("", "", nil, "", false, nil, makeTestLayerTar(t, map[string]string{"file": "base"}))
+	require.NoError(t, err)
+	layer, err := s.CreateLayer("", base.ID, nil, "", true, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"create " + base.ID + " ", "create " + layer.ID + " " + base.ID}, calls)
+
+	// only the first mount and the last unmount call the hooks
+	calls = nil
+	mountPoint, err := s.Mount(layer.ID, "")
+	require.NoError(t, err)
+	_, err = s.Mount(layer.ID, "")
+	require.NoError(t, err)
+	_, err = s.Unmount(layer.ID, false)
+	require.NoError(t, err)
+	_, err = s.Unmount(layer.ID, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"mount " + layer.ID + " " + mountPoint, "unmount " + layer.ID + " " + mountPoint}, calls)
+
+	// a failing hook aborts the operation
+	createErr = errors.New("create failed")
+	_, _, err = s.PutLayer("aborted", base.ID, nil, "", false, nil, makeTestLayerTar(t, map[string]string{"file": "aborted"}))
+	assert.True(t, errors.Is(err, createErr), "%v", err)
+	_, err = s.Layer("aborted")
+	assert.True(t, errors.Is(err, ErrLayerUnknown), "%v", err)
+	createErr = nil
+
+	mountErr = errors.New("mount failed")
+	_, err = s.Mount(layer.ID, "")
+	assert.True(t, errors.Is(err, mountErr), "%v", err)
+	mounted, err := s.Mounted(layer.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 0, mounted)
+	mountErr = nil
+
+	_, err = s.Mount(layer.ID, "")
+	require.NoError(t, err)
+	unmountErr = errors.New("unmount failed")
+	_, err = s.Unmount(layer.ID, false)
+	assert.True(t, errors.Is(err, unmountErr), "%v", err)
+	mounted, err = s.Mounted(layer.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, mounted)
+	unmountErr = nil
+	_, err = s.Unmount(layer.ID, false)
+	require.NoError(t, err)
+}
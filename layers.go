@@ -3,12 +3,14 @@ package storage
 import (
 	"bytes"
 	"fmt"
+	"hash/crc64"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
 	"reflect"
+	"runtime"
 	"sort"
 	"strings"
 	"sync"
@@ -16,13 +18,16 @@ import (
 
 	drivers "github.com/containers/storage/drivers"
 	"github.com/containers/storage/pkg/archive"
+	"github.com/containers/storage/pkg/chunked/compressor"
 	"github.com/containers/storage/pkg/idtools"
 	"github.com/containers/storage/pkg/ioutils"
+	"github.com/containers/storage/pkg/lockfile"
 	"github.com/containers/storage/pkg/mount"
 	"github.com/containers/storage/pkg/stringid"
 	"github.com/containers/storage/pkg/system"
 	"github.com/containers/storage/pkg/tarlog"
 	"github.com/containers/storage/pkg/truncindex"
+	"github.com/containers/storage/types"
 	multierror "github.com/hashicorp/go-multierror"
 	"github.com/klauspost/pgzip"
 	digest "github.com/opencontainers/go-digest"
@@ -37,6 +42,21 @@ import (
 const (
 	tarSplitSuffix = ".tar-split.gz"
 	incompleteFlag = "incomplete"
+	// lazyFlag is set on layers which were registered with
+	// RegisterLazyLayer until their contents are populated.
+	lazyFlag = "lazy"
+	// pinnedFlag is set on layers which were pinned with PinLayer.
+	pinnedFlag = "pinned"
+	// expiresFlag records, on layers which were created with a TTL, the
+	// time after which ExpireStale can remove them.
+	expiresFlag = "expires"
+	// sizeLimitFlag records, on the layers of containers which were given
+	// a size limit, the number of bytes they may grow to.
+	sizeLimitFlag = "size-limit"
+
+	// chunkedManifestBigDataKey is the name of the big data item in which
+	// pkg/chunked stores the manifest of layers that were partially pulled.
+	chunkedManifestBigDataKey = "zstd-chunked-manifest"
 )
 
 // A Layer is a record of a copy-on-write layer that's stored by the lower
@@ -72,6 +92,10 @@ type Layer struct {
 	// mounted at the mount point.
 	MountCount int `json:"-"`
 
+	// MountOptions are the per-mount options, if any, which were requested
+	// when the layer was mounted at MountPoint.
+	MountOptions []string `json:"-"`
+
 	// Created is the datestamp for when this layer was created.  Older
 	// versions of the library did not track this information, so callers
 	// will likely want to use the IsZero() method to verify that a value
@@ -127,9 +151,10 @@ type Layer struct {
 }
 
 type layerMountPoint struct {
-	ID         string `json:"id"`
-	MountPoint string `json:"path"`
-	MountCount int    `json:"count"`
+	ID         string   `json:"id"`
+	MountPoint string   `json:"path"`
+	MountCount int      `json:"count"`
+	Options    []string `json:"options,omitempty"`
 }
 
 // DiffOptions override the default behavior of Diff() methods.
@@ -173,6 +198,16 @@ type ROLayerStore interface {
 	// produced by Diff.
 	DiffSize(from, to string) (int64, error)
 
+	// TarSplit returns the tar-split metadata which was recorded when the
+	// layer's diff was applied, as a stream of uncompressed JSON records.
+	TarSplit(id string) (io.ReadCloser, error)
+
+	// AssembleTar reassembles the uncompressed tarball which was used to
+	// populate the layer, byte for byte, using its tar-split metadata.
+	// Unlike Diff, it fails instead of generating a new tarball if no
+	// tar-split metadata was recorded for the layer.
+	AssembleTar(id string) (io.ReadCloser, error)
+
 	// Size produces a cached value for the uncompressed size of the layer,
 	// if one is known, or -1 if it is not known.  If the layer can not be
 	// found, it returns an error.
@@ -192,6 +227,13 @@ type ROLayerStore interface {
 
 	// Layers returns a slice of the known layers.
 	Layers() ([]Layer, error)
+
+	// Verify recomputes the checksums of the files in a layer, and of the
+	// layer's diff, and compares them to the values which were recorded
+	// when the layer was populated.  If they don't match, the returned
+	// error wraps ErrLayerCorrupted and lists the offending paths.  If stop
+	// is closed, the verification ends early with an error.
+	Verify(id string, stop <-chan struct{}) error
 }
 
 // LayerStore wraps a graph driver, adding the ability to refer to layers by
@@ -262,6 +304,13 @@ type LayerStore interface {
 	// DifferTarget gets the location where files are stored for the layer.
 	DifferTarget(id string) (string, error)
 
+	// SetImportedMetadata records, for a layer which was populated with
+	// the diff of an exported layer, the information about the exported
+	// layer which can't be derived from its diff: its compressed size and
+	// compression type, its metadata, and its tar-split metadata, which is
+	// replaced if tarSplit is not nil.
+	SetImportedMetadata(id string, exported *Layer, tarSplit []byte) error
+
 	// LoadLocked wraps Load in a locked state. This means it loads the store
 	// and cleans-up invalid layers if needed.
 	LoadLocked() error
@@ -289,6 +338,12 @@ type layerStore struct {
 	gidMap             []idtools.IDMap
 	loadMut            sync.Mutex
 	layerspathModified time.Time
+	hooks              *types.LayerHooks
+	syncPolicy         string
+	journalCrash       *journalCrashHook
+	// deleteCheck, if set, is called before a layer is deleted, and the
+	// layer is kept if it returns an error.
+	deleteCheck func(id string) error
 }
 
 func copyLayer(l *Layer) *Layer {
@@ -300,6 +355,7 @@ func copyLayer(l *Layer) *Layer {
 		MountLabel:         l.MountLabel,
 		MountPoint:         l.MountPoint,
 		MountCount:         l.MountCount,
+		MountOptions:       copyStringSlice(l.MountOptions),
 		Created:            l.Created,
 		CompressedDigest:   l.CompressedDigest,
 		CompressedSize:     l.CompressedSize,
@@ -443,6 +499,7 @@ func (r *layerStore) loadMounts() error {
 		for _, layer := range r.layers {
 			layer.MountPoint = ""
 			layer.MountCount = 0
+			layer.MountOptions = nil
 		}
 		// All of the non-zero count values will have been encoded, so
 		// we reset the still-mounted ones based on the contents.
@@ -452,6 +509,7 @@ func (r *layerStore) loadMounts() error {
 					mounts[mount.MountPoint] = layer
 					layer.MountPoint = mount.MountPoint
 					layer.MountCount = mount.MountCount
+					layer.MountOptions = mount.Options
 				}
 			}
 		}
@@ -487,7 +545,7 @@ func (r *layerStore) saveLayers() error {
 		return err
 	}
 	defer r.Touch()
-	return ioutils.AtomicWriteFile(rpath, jldata, 0600)
+	return r.atomicWriteFile(rpath, jldata)
 }
 
 func (r *layerStore) saveMounts() error {
@@ -508,6 +566,7 @@ func (r *layerStore) saveMounts() error {
 				ID:         layer.ID,
 				MountPoint: layer.MountPoint,
 				MountCount: layer.MountCount,
+				Options:    layer.MountOptions,
 			})
 		}
 	}
@@ -515,7 +574,7 @@ func (r *layerStore) saveMounts() error {
 	if err != nil {
 		return err
 	}
-	if err = ioutils.AtomicWriteFile(mpath, jmdata, 0600); err != nil {
+	if err = r.atomicWriteFile(mpath, jmdata); err != nil {
 		return err
 	}
 	return r.loadMounts()
@@ -547,6 +606,13 @@ func (s *store) newLayerStore(rundir string, layerdir string, driver drivers.Dri
 		byname:         make(map[string]*Layer),
 		uidMap:         copyIDMap(s.uidMap),
 		gidMap:         copyIDMap(s.gidMap),
+		hooks:          s.layerHooks,
+		syncPolicy:     s.syncPolicy,
+		journalCrash:   s.journalCrash,
+	}
+	if s.namespace == "" {
+		// the layers can be shared base layers of namespaced stores
+		rlstore.deleteCheck = s.checkNamespaceUsers
 	}
 	if err := rlstore.Load(); err != nil {
 		return nil, err
@@ -559,6 +625,20 @@ func newROLayerStore(rundir string, layerdir string, driver drivers.Driver) (ROL
 	if err != nil {
 		return nil, err
 	}
+	return newROLayerStoreWithLockfile(rundir, layerdir, driver, lockfile)
+}
+
+// newSharedROLayerStore opens the layer store in layerdir read-only, in a way
+// which allows it to also be opened read-write in this process.
+func newSharedROLayerStore(rundir string, layerdir string, driver drivers.Driver) (ROLayerStore, error) {
+	lockfile, err := lockfile.GetReadOnlyView(filepath.Join(layerdir, "layers.lock"))
+	if err != nil {
+		return nil, err
+	}
+	return newROLayerStoreWithLockfile(rundir, layerdir, driver, lockfile)
+}
+
+func newROLayerStoreWithLockfile(rundir string, layerdir string, driver drivers.Driver, lockfile Locker) (ROLayerStore, error) {
 	rlstore := layerStore{
 		lockfile:       lockfile,
 		mountsLockfile: nil,
@@ -774,6 +854,9 @@ func (r *layerStore) Put(id string, parentLayer *Layer, names []string, mountLab
 			return nil, -1, err
 		}
 	}
+	if r.journalCrash.at("layer-created") {
+		return nil, -1, errJournalCrash
+	}
 	if err == nil {
 		layer = &Layer{
 			ID:           id,
@@ -815,6 +898,14 @@ func (r *layerStore) Put(id string, parentLayer *Layer, names []string, mountLab
 			}
 			delete(layer.Flags, incompleteFlag)
 		}
+		if r.hooks != nil && r.hooks.OnLayerCreate != nil {
+			if err := r.hooks.OnLayerCreate(id, parent); err != nil {
+				if err2 := r.Delete(layer.ID); err2 != nil {
+					logrus.Errorf("Deleting layer %q after its creation hook failed: %v", layer.ID, err2)
+				}
+				return nil, -1, errors.Wrapf(err, "running the creation hook of layer %q", id)
+			}
+		}
 		err = r.Save()
 		if err != nil {
 			// We don't have a record of this layer, but at least
@@ -854,6 +945,44 @@ func (r *layerStore) Mounted(id string) (int, error) {
 	return layer.MountCount, nil
 }
 
+// normalizeMountOptions returns a sorted, deduplicated list of the options
+// in a MountOpts, including "volatile" if it was requested, so that the
+// options used for two mounts can be compared.
+func normalizeMountOptions(options drivers.MountOpts) []string {
+	var opts []string
+	seen := make(map[string]struct{})
+	add := func(opt string) {
+		if _, ok := seen[opt]; ok || opt == "" {
+			return
+		}
+		seen[opt] = struct{}{}
+		opts = append(opts, opt)
+	}
+	for _, opt := range options.Options {
+		add(opt)
+	}
+	if options.Volatile {
+		add("volatile")
+	}
+	sort.Strings(opts)
+	return opts
+}
+
+// checkMountOptions returns an error which wraps ErrLayerMountOptionsConflict
+// if the current mount of the layer can't be handed out to a caller who asked
+// for it to be mounted with the specified normalized options.  The layer only
+// has one mount point, so it can't be mounted differently for each caller.  A
+// caller who didn't ask for any options gets the current mount, whatever its
+// options are, and so does every caller if the options of the current mount
+// weren't recorded, as is the case for the mounts which were made by older
+// versions of the library.
+func checkMountOptions(layer *Layer, mountOptions []string) error {
+	if len(mountOptions) == 0 || len(layer.MountOptions) == 0 || reflect.DeepEqual(mountOptions, layer.MountOptions) {
+		return nil
+	}
+	return errors.Wrapf(ErrLayerMountOptionsConflict, "layer %q is mounted at %q with options %v, not %v", layer.ID, layer.MountPoint, layer.MountOptions, mountOptions)
+}
+
 func (r *layerStore) Mount(id string, options drivers.MountOpts) (string, error) {
 
 	// check whether options include ro option
@@ -883,6 +1012,7 @@ func (r *layerStore) Mount(id string, options drivers.MountOpts) (string, error)
 	if !ok {
 		return "", ErrLayerUnknown
 	}
+	mountOptions := normalizeMountOptions(options)
 	if layer.MountCount > 0 {
 		mounted, err := mount.Mounted(layer.MountPoint)
 		if err != nil {
@@ -892,6 +1022,9 @@ func (r *layerStore) Mount(id string, options drivers.MountOpts) (string, error)
 		// where the kernel umounted the mount point. This means
 		// that the mount count never got decremented.
 		if mounted {
+			if err := checkMountOptions(layer, mountOptions); err != nil {
+				return "", err
+			}
 			layer.MountCount++
 			return layer.MountPoint, r.saveMounts()
 		}
@@ -906,12 +1039,21 @@ func (r *layerStore) Mount(id string, options drivers.MountOpts) (string, error)
 		}
 	}
 	mountpoint, err := r.driver.Get(id, options)
+	if mountpoint != "" && err == nil && layer.MountCount == 0 && r.hooks != nil && r.hooks.OnMount != nil {
+		if err := r.hooks.OnMount(id, filepath.Clean(mountpoint)); err != nil {
+			if err2 := r.driver.Put(id); err2 != nil {
+				logrus.Errorf("Unmounting layer %q after its mount hook failed: %v", id, err2)
+			}
+			return "", errors.Wrapf(err, "running the mount hook of layer %q", id)
+		}
+	}
 	if mountpoint != "" && err == nil {
 		if layer.MountPoint != "" {
 			delete(r.bymount, layer.MountPoint)
 		}
 		layer.MountPoint = filepath.Clean(mountpoint)
 		layer.MountCount++
+		layer.MountOptions = mountOptions
 		r.bymount[layer.MountPoint] = layer
 		err = r.saveMounts()
 	}
@@ -945,6 +1087,11 @@ func (r *layerStore) Unmount(id string, force bool) (bool, error) {
 		layer.MountCount--
 		return true, r.saveMounts()
 	}
+	if r.hooks != nil && r.hooks.OnUnmount != nil && layer.MountPoint != "" {
+		if err := r.hooks.OnUnmount(layer.ID, layer.MountPoint); err != nil {
+			return true, errors.Wrapf(err, "running the unmount hook of layer %q", layer.ID)
+		}
+	}
 	err := r.driver.Put(id)
 	if err == nil || os.IsNotExist(err) {
 		if layer.MountPoint != "" {
@@ -952,6 +1099,7 @@ func (r *layerStore) Unmount(id string, force bool) (bool, error) {
 		}
 		layer.MountCount--
 		layer.MountPoint = ""
+		layer.MountOptions = nil
 		return false, r.saveMounts()
 	}
 	return true, err
@@ -1091,7 +1239,7 @@ func (r *layerStore) SetBigData(id, key string, data io.Reader) error {
 	// NewAtomicFileWriter doesn't overwrite/truncate the existing inode.
 	// BigData() relies on this behaviour when opening the file for read
 	// so that it is either accessing the old data or the new one.
-	writer, err := ioutils.NewAtomicFileWriter(r.datapath(layer.ID, key), 0600)
+	writer, err := ioutils.NewAtomicFileWriterWithOpts(r.datapath(layer.ID, key), 0600, r.writerOptions())
 	if err != nil {
 		return errors.Wrapf(err, "error opening bigdata file")
 	}
@@ -1162,6 +1310,9 @@ func (r *layerStore) deleteInternal(id string) error {
 	if err != nil {
 		return err
 	}
+	if r.journalCrash.at("layer-removed") {
+		return errJournalCrash
+	}
 
 	os.Remove(r.tspath(id))
 	os.RemoveAll(r.datadir(id))
@@ -1233,6 +1384,11 @@ func (r *layerStore) Delete(id string) error {
 		return ErrLayerUnknown
 	}
 	id = layer.ID
+	if r.deleteCheck != nil {
+		if err := r.deleteCheck(id); err != nil {
+			return err
+		}
+	}
 	// The layer may already have been explicitly unmounted, but if not, we
 	// should try to clean that up before we start deleting anything at the
 	// driver level.
@@ -1360,8 +1516,6 @@ func (r *layerStore) newFileGetter(id string) (drivers.FileGetCloser, error) {
 }
 
 func (r *layerStore) Diff(from, to string, options *DiffOptions) (io.ReadCloser, error) {
-	var metadata storage.Unpacker
-
 	from, to, fromLayer, toLayer, err := r.findParentAndLayer(from, to)
 	if err != nil {
 		return nil, ErrLayerUnknown
@@ -1453,7 +1607,7 @@ func (r *layerStore) Diff(from, to string, options *DiffOptions) (io.ReadCloser,
 		}
 	}
 
-	tsfile, err := os.Open(r.tspath(to))
+	tsdata, err := r.openTarSplit(toLayer)
 	if err != nil {
 		if !os.IsNotExist(err) {
 			return nil, err
@@ -1465,6 +1619,50 @@ func (r *layerStore) Diff(from, to string, options *DiffOptions) (io.ReadCloser,
 		return maybeCompressReadCloser(diff)
 	}
 
+	rc, err := r.assembleTar(to, tsdata)
+	if err != nil {
+		return nil, err
+	}
+	return maybeCompressReadCloser(rc)
+}
+
+// writeTarSplit saves the compressed tar-split metadata for the layer.
+func (r *layerStore) writeTarSplit(layer *Layer, tsdata []byte) error {
+	if err := os.MkdirAll(filepath.Dir(r.tspath(layer.ID)), 0700); err != nil {
+		return err
+	}
+	return r.atomicWriteFile(r.tspath(layer.ID), tsdata)
+}
+
+// writerOptions returns the options for writing the store's records of the
+// layers, which are not flushed to disk with SyncPolicyNone.
+func (r *layerStore) writerOptions() *ioutils.AtomicFileWriterOptions {
+	return &ioutils.AtomicFileWriterOptions{NoSync: r.syncPolicy == SyncPolicyNone}
+}
+
+// atomicWriteFile writes data to the file at path with the options returned
+// by writerOptions.
+func (r *layerStore) atomicWriteFile(path string, data []byte) error {
+	return ioutils.AtomicWriteFileWithOpts(path, data, 0600, r.writerOptions())
+}
+
+// syncContents returns the function which the driver calls to flush the
+// contents of a layer to disk once they are applied, or nil if the sync
+// policy doesn't require it.
+func (r *layerStore) syncContents() func(dir string) error {
+	if r.syncPolicy != SyncPolicyAlways {
+		return nil
+	}
+	return syncFilesystem
+}
+
+// openTarSplit opens the tar-split metadata recorded for the layer, and
+// returns it decompressed.
+func (r *layerStore) openTarSplit(layer *Layer) (io.ReadCloser, error) {
+	tsfile, err := os.Open(r.tspath(layer.ID))
+	if err != nil {
+		return nil, err
+	}
 	decompressor, err := pgzip.NewReader(tsfile)
 	if err != nil {
 		if e := tsfile.Close(); e != nil {
@@ -1472,29 +1670,35 @@ func (r *layerStore) Diff(from, to string, options *DiffOptions) (io.ReadCloser,
 		}
 		return nil, err
 	}
-
-	metadata = storage.NewJSONUnpacker(decompressor)
-
-	fgetter, err := r.newFileGetter(to)
-	if err != nil {
-		errs := multierror.Append(nil, errors.Wrapf(err, "creating file-getter"))
+	return ioutils.NewReadCloserWrapper(decompressor, func() error {
+		var errs *multierror.Error
 		if err := decompressor.Close(); err != nil {
 			errs = multierror.Append(errs, errors.Wrapf(err, "closing decompressor"))
 		}
 		if err := tsfile.Close(); err != nil {
 			errs = multierror.Append(errs, errors.Wrapf(err, "closing tarstream headers"))
 		}
+		return errs.ErrorOrNil()
+	}), nil
+}
+
+// assembleTar reassembles the layer's diff from the tar-split metadata in
+// tsdata, which is closed along with the returned stream.
+func (r *layerStore) assembleTar(id string, tsdata io.ReadCloser) (io.ReadCloser, error) {
+	fgetter, err := r.newFileGetter(id)
+	if err != nil {
+		errs := multierror.Append(nil, errors.Wrapf(err, "creating file-getter"))
+		if err := tsdata.Close(); err != nil {
+			errs = multierror.Append(errs, err)
+		}
 		return nil, errs.ErrorOrNil()
 	}
 
-	tarstream := asm.NewOutputTarStream(fgetter, metadata)
-	rc := ioutils.NewReadCloserWrapper(tarstream, func() error {
+	tarstream := asm.NewOutputTarStream(fgetter, storage.NewJSONUnpacker(tsdata))
+	return ioutils.NewReadCloserWrapper(tarstream, func() error {
 		var errs *multierror.Error
-		if err := decompressor.Close(); err != nil {
-			errs = multierror.Append(errs, errors.Wrapf(err, "closing decompressor"))
-		}
-		if err := tsfile.Close(); err != nil {
-			errs = multierror.Append(errs, errors.Wrapf(err, "closing tarstream headers"))
+		if err := tsdata.Close(); err != nil {
+			errs = multierror.Append(errs, err)
 		}
 		if err := tarstream.Close(); err != nil {
 			errs = multierror.Append(errs, errors.Wrapf(err, "closing reconstructed tarstream"))
@@ -1502,12 +1706,32 @@ func (r *layerStore) Diff(from, to string, options *DiffOptions) (io.ReadCloser,
 		if err := fgetter.Close(); err != nil {
 			errs = multierror.Append(errs, errors.Wrapf(err, "closing file-getter"))
 		}
-		if errs != nil {
-			return errs.ErrorOrNil()
+		return errs.ErrorOrNil()
+	}), nil
+}
+
+func (r *layerStore) TarSplit(id string) (io.ReadCloser, error) {
+	layer, ok := r.lookup(id)
+	if !ok {
+		return nil, ErrLayerUnknown
+	}
+	tsdata, err := r.openTarSplit(layer)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.Wrapf(ErrLayerHasNoTarSplit, "layer %q", layer.ID)
 		}
-		return nil
-	})
-	return maybeCompressReadCloser(rc)
+		return nil, err
+	}
+	return tsdata, nil
+}
+
+func (r *layerStore) AssembleTar(id string) (io.ReadCloser, error) {
+	tsdata, err := r.TarSplit(id)
+	if err != nil {
+		return nil, err
+	}
+	layer, _ := r.lookup(id)
+	return r.assembleTar(layer.ID, tsdata)
 }
 
 func (r *layerStore) DiffSize(from, to string) (size int64, err error) {
@@ -1605,6 +1829,7 @@ func (r *layerStore) applyDiffWithOptions(to string, layerOptions *LayerOptions,
 		Diff:       payload,
 		Mappings:   r.layerMappings(layer),
 		MountLabel: layer.MountLabel,
+		Sync:       r.syncContents(),
 	}
 	size, err = r.driver.ApplyDiff(layer.ID, layer.Parent, options)
 	if err != nil {
@@ -1612,10 +1837,7 @@ func (r *layerStore) applyDiffWithOptions(to string, layerOptions *LayerOptions,
 	}
 	compressor.Close()
 	if err == nil {
-		if err := os.MkdirAll(filepath.Dir(r.tspath(layer.ID)), 0700); err != nil {
-			return -1, err
-		}
-		if err := ioutils.AtomicWriteFile(r.tspath(layer.ID), tsdata.Bytes(), 0600); err != nil {
+		if err := r.writeTarSplit(layer, tsdata.Bytes()); err != nil {
 			return -1, err
 		}
 	}
@@ -1698,10 +1920,32 @@ func (r *layerStore) ApplyDiffFromStagingDirectory(id, stagingDirectory string,
 			MountLabel: layer.MountLabel,
 		}
 	}
+	if options.Sync == nil {
+		opts := *options
+		opts.Sync = r.syncContents()
+		options = &opts
+	}
 	err := ddriver.ApplyDiffFromStagingDirectory(layer.ID, layer.Parent, stagingDirectory, diffOutput, options)
 	if err != nil {
 		return err
 	}
+	if diffOutput.TarSplit != nil {
+		tsdata := bytes.Buffer{}
+		compressor, err := pgzip.NewWriterLevel(&tsdata, pgzip.BestSpeed)
+		if err != nil {
+			compressor = pgzip.NewWriter(&tsdata)
+		}
+		if _, err := compressor.Write(diffOutput.TarSplit); err != nil {
+			compressor.Close()
+			return err
+		}
+		if err := compressor.Close(); err != nil {
+			return err
+		}
+		if err := r.writeTarSplit(layer, tsdata.Bytes()); err != nil {
+			return err
+		}
+	}
 	layer.UIDs = diffOutput.UIDs
 	layer.GIDs = diffOutput.GIDs
 	layer.UncompressedDigest = diffOutput.UncompressedDigest
@@ -1719,6 +1963,39 @@ func (r *layerStore) ApplyDiffFromStagingDirectory(id, stagingDirectory string,
 	return err
 }
 
+func (r *layerStore) SetImportedMetadata(id string, exported *Layer, tarSplit []byte) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify layer metadata at %q", r.layerspath())
+	}
+	layer, ok := r.lookup(id)
+	if !ok {
+		return ErrLayerUnknown
+	}
+	if tarSplit != nil {
+		tsdata := bytes.Buffer{}
+		compressor, err := pgzip.NewWriterLevel(&tsdata, pgzip.BestSpeed)
+		if err != nil {
+			compressor = pgzip.NewWriter(&tsdata)
+		}
+		if _, err := compressor.Write(tarSplit); err != nil {
+			compressor.Close()
+			return err
+		}
+		if err := compressor.Close(); err != nil {
+			return err
+		}
+		if err := r.writeTarSplit(layer, tsdata.Bytes()); err != nil {
+			return err
+		}
+	}
+	if exported.CompressedDigest != "" && exported.CompressedDigest == layer.CompressedDigest {
+		layer.CompressedSize = exported.CompressedSize
+		layer.CompressionType = exported.CompressionType
+	}
+	layer.Metadata = exported.Metadata
+	return r.Save()
+}
+
 func (r *layerStore) ApplyDiffWithDiffer(to string, options *drivers.ApplyDiffOpts, differ drivers.Differ) (*drivers.DriverWithDifferOutput, error) {
 	ddriver, ok := r.driver.(drivers.DriverWithDiffer)
 	if !ok {
@@ -1758,6 +2035,239 @@ func (r *layerStore) CleanupStagingDirectory(stagingDirectory string) error {
 	return ddriver.CleanupStagingDirectory(stagingDirectory)
 }
 
+// errVerificationStopped is returned by Verify when it is asked to stop.
+var errVerificationStopped = errors.New("layer verification stopped")
+
+// stoppableFileGetter is a FileGetCloser whose files can't be read once stop
+// is closed, so that a layer's verification ends soon after it is asked to.
+type stoppableFileGetter struct {
+	drivers.FileGetCloser
+	stop <-chan struct{}
+}
+
+func (g *stoppableFileGetter) stopped() bool {
+	select {
+	case <-g.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (g *stoppableFileGetter) Get(path string) (io.ReadCloser, error) {
+	if g.stopped() {
+		return nil, errVerificationStopped
+	}
+	rc, err := g.FileGetCloser.Get(path)
+	if err != nil {
+		return nil, err
+	}
+	return &stoppableReadCloser{ReadCloser: rc, getter: g}, nil
+}
+
+type stoppableReadCloser struct {
+	io.ReadCloser
+	getter *stoppableFileGetter
+}
+
+func (r *stoppableReadCloser) Read(p []byte) (int, error) {
+	if r.getter.stopped() {
+		return 0, errVerificationStopped
+	}
+	return r.ReadCloser.Read(p)
+}
+
+// verifyFiles runs check on each of the specified paths using a pool of
+// workers, and returns the sorted list of paths for which check failed.
+func verifyFiles(paths []string, check func(path string) (bool, error)) ([]string, error) {
+	var (
+		mismatched []string
+		firstErr   error
+		mu         sync.Mutex
+		wg         sync.WaitGroup
+	)
+	workers := runtime.NumCPU()
+	if workers > len(paths) {
+		workers = len(paths)
+	}
+	queue := make(chan string)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range queue {
+				ok, err := check(p)
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				if err == nil && !ok {
+					mismatched = append(mismatched, p)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, p := range paths {
+		queue <- p
+	}
+	close(queue)
+	wg.Wait()
+	sort.Strings(mismatched)
+	return mismatched, firstErr
+}
+
+// verifyTarSplit checks the files in the layer against the checksums which
+// were recorded in the layer's tar-split data, and then reassembles the
+// layer's diff to check it against the layer's uncompressed digest.
+func (r *layerStore) verifyTarSplit(layer *Layer, fgetter drivers.FileGetCloser) error {
+	readEntries := func(f func(storage.Unpacker) error) error {
+		tsdata, err := r.openTarSplit(layer)
+		if err != nil {
+			return err
+		}
+		defer tsdata.Close()
+		return f(storage.NewJSONUnpacker(tsdata))
+	}
+
+	checksums := make(map[string][]byte)
+	sizes := make(map[string]int64)
+	var paths []string
+	if err := readEntries(func(metadata storage.Unpacker) error {
+		for {
+			entry, err := metadata.Next()
+			if err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+			if entry.Type != storage.FileType || entry.Size == 0 {
+				continue
+			}
+			name := entry.GetName()
+			checksums[name] = entry.Payload
+			sizes[name] = entry.Size
+			paths = append(paths, name)
+		}
+	}); err != nil {
+		return errors.Wrapf(err, "error reading tar-split data for layer %q", layer.ID)
+	}
+
+	mismatched, err := verifyFiles(paths, func(name string) (bool, error) {
+		f, err := fgetter.Get(name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return false, nil
+			}
+			return false, err
+		}
+		defer f.Close()
+		crc := crc64.New(storage.CRCTable)
+		n, err := io.Copy(crc, f)
+		if err != nil {
+			return false, err
+		}
+		return n == sizes[name] && bytes.Equal(crc.Sum(nil), checksums[name]), nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(mismatched) > 0 {
+		return errors.Wrapf(ErrLayerCorrupted, "layer %q: %s", layer.ID, strings.Join(mismatched, ", "))
+	}
+
+	if layer.UncompressedDigest == "" || !layer.UncompressedDigest.Algorithm().Available() {
+		return nil
+	}
+	digester := layer.UncompressedDigest.Algorithm().Digester()
+	if err := readEntries(func(metadata storage.Unpacker) error {
+		return asm.WriteOutputTarStream(fgetter, metadata, digester.Hash())
+	}); err != nil {
+		return errors.Wrapf(err, "error reassembling diff for layer %q", layer.ID)
+	}
+	if digester.Digest() != layer.UncompressedDigest {
+		return errors.Wrapf(ErrLayerCorrupted, "layer %q: diff digest is %s, expected %s", layer.ID, digester.Digest(), layer.UncompressedDigest)
+	}
+	return nil
+}
+
+// verifyChunkedManifest checks the files in the layer against the digests
+// which were recorded in the manifest of a partially pulled layer.
+func (r *layerStore) verifyChunkedManifest(layer *Layer, fgetter drivers.FileGetCloser) error {
+	data, err := ioutil.ReadFile(r.datapath(layer.ID, chunkedManifestBigDataKey))
+	if err != nil {
+		return err
+	}
+	files, err := compressor.ParseManifestFiles(data)
+	if err != nil {
+		return errors.Wrapf(err, "error parsing chunked manifest for layer %q", layer.ID)
+	}
+
+	// The digests can be computed with hashers which the digest package
+	// doesn't know about, registered with compressor.RegisterChunkHasher.
+	digests := make(map[string]string)
+	var paths []string
+	for _, file := range files {
+		name := filepath.Clean(file.Name)
+		digests[name] = file.Digest
+		paths = append(paths, name)
+	}
+
+	mismatched, err := verifyFiles(paths, func(name string) (bool, error) {
+		f, err := fgetter.Get(name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return false, nil
+			}
+			return false, err
+		}
+		defer f.Close()
+		d, err := compressor.DigestLike(digests[name], f)
+		if err != nil {
+			return false, errors.Wrapf(err, "digest for %q in chunked manifest for layer %q", name, layer.ID)
+		}
+		return d == digests[name], nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(mismatched) > 0 {
+		return errors.Wrapf(ErrLayerCorrupted, "layer %q: %s", layer.ID, strings.Join(mismatched, ", "))
+	}
+	return nil
+}
+
+func (r *layerStore) Verify(id string, stop <-chan struct{}) error {
+	layer, ok := r.lookup(id)
+	if !ok {
+		return ErrLayerUnknown
+	}
+	_, tsErr := os.Stat(r.tspath(layer.ID))
+	if tsErr != nil && !os.IsNotExist(tsErr) {
+		return tsErr
+	}
+	_, manifestErr := os.Stat(r.datapath(layer.ID, chunkedManifestBigDataKey))
+	if manifestErr != nil && !os.IsNotExist(manifestErr) {
+		return manifestErr
+	}
+	if tsErr != nil && manifestErr != nil {
+		return errors.Wrapf(ErrNotSupported, "no checksums were recorded for layer %q", layer.ID)
+	}
+
+	getter, err := r.newFileGetter(layer.ID)
+	if err != nil {
+		return errors.Wrapf(err, "creating file-getter")
+	}
+	defer getter.Close()
+	fgetter := &stoppableFileGetter{FileGetCloser: getter, stop: stop}
+
+	if tsErr == nil {
+		return r.verifyTarSplit(layer, fgetter)
+	}
+	return r.verifyChunkedManifest(layer, fgetter)
+}
+
 func (r *layerStore) layersByDigestMap(m map[digest.Digest][]string, d digest.Digest) ([]Layer, error) {
 	var layers []Layer
 	for _, layerID := range m[d] {
@@ -0,0 +1,485 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	drivers "github.com/containers/storage/drivers"
+	"github.com/containers/storage/pkg/reexec"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func init() {
+	reexec.Init()
+}
+
+// newTestStore creates a Store using the vfs driver in a temporary directory
+// which is removed when the test completes, after letting each of modifiers
+// adjust the options it is created with.
+func newTestStore(t testing.TB, modifiers ...func(*StoreOptions)) Store {
+	wd, err := ioutil.TempDir("", "testStorageLayers")
+	require.NoError(t, err)
+	options := StoreOptions{
+		RunRoot:         filepath.Join(wd, "run"),
+		GraphRoot:       filepath.Join(wd, "root"),
+		GraphDriverName: "vfs",
+	}
+	for _, modifier := range modifiers {
+		modifier(&options)
+	}
+	store, err := GetStore(options)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_, _ = store.Shutdown(true)
+		store.Free()
+		os.RemoveAll(wd)
+	})
+	return store
+}
+
+// makeTestLayerTar returns a tarball containing the specified files.
+func makeTestLayerTar(t testing.TB, files map[string]string) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, contents := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(contents)),
+		}))
+		_, err := tw.Write([]byte(contents))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return &buf
+}
+
+func TestVerifyLayer(t *testing.T) {
+	store := newTestStore(t)
+
+	diff := makeTestLayerTar(t, map[string]string{
+		"file1": "hello",
+		"file2": "world",
+	})
+	layer, _, err := store.PutLayer("", "", nil, "", false, nil, diff)
+	require.NoError(t, err)
+
+	require.NoError(t, store.VerifyLayer(layer.ID))
+
+	mountPoint, err := store.Mount(layer.ID, "")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(mountPoint, "file2"), []byte("w0rld"), 0644))
+	_, err = store.Unmount(layer.ID, true)
+	require.NoError(t, err)
+
+	err = store.VerifyLayer(layer.ID)
+	require.Error(t, err)
+	require.True(t, errors.Is(err, ErrLayerCorrupted))
+	require.Contains(t, err.Error(), "file2")
+	require.NotContains(t, err.Error(), "file1")
+
+	require.True(t, errors.Is(store.VerifyLayer("nonexistent"), ErrLayerUnknown))
+}
+
+func TestVerifyLayerChunkedManifest(t *testing.T) {
+	store := newTestStore(t)
+
+	layer, _, err := store.PutLayer("", "", nil, "", false, nil, makeTestLayerTar(t, map[string]string{
+		"file1": "hello",
+		"file2": "world",
+	}))
+	require.NoError(t, err)
+	// a layer which was pulled partially has a manifest instead of
+	// tar-split metadata, whose digests can use any registered hasher
+	require.NoError(t, os.Remove(filepath.Join(store.GraphRoot(), "vfs-layers", layer.ID+tarSplitSuffix)))
+	sum := func(data string) string {
+		h := sha512.New512_256()
+		h.Write([]byte(data))
+		return "sha512-256:" + hex.EncodeToString(h.Sum(nil))
+	}
+	manifest := `{"version":1,"entries":[` +
+		`{"type":"reg","name":"file1","digest":"` + sum("hello") + `"},` +
+		`{"type":"reg","name":"file2","digest":"` + sum("world") + `"}]}`
+	require.NoError(t, store.SetLayerBigData(layer.ID, chunkedManifestBigDataKey, strings.NewReader(manifest)))
+	require.NoError(t, store.VerifyLayer(layer.ID))
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(store.GraphRoot(), "vfs", "dir", layer.ID, "file1"), []byte("h3llo"), 0644))
+	err = store.VerifyLayer(layer.ID)
+	require.True(t, errors.Is(err, ErrLayerCorrupted), "%v", err)
+	require.Contains(t, err.Error(), "file1")
+	require.NotContains(t, err.Error(), "file2")
+}
+
+func TestVerifyLayerEncodedChunkedManifest(t *testing.T) {
+	store := newTestStore(t)
+
+	layer, _, err := store.PutLayer("", "", nil, "", false, nil, makeTestLayerTar(t, map[string]string{
+		"file1": "hello",
+		"file2": "world",
+	}))
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(filepath.Join(store.GraphRoot(), "vfs-layers", layer.ID+tarSplitSuffix)))
+	sum := func(data string) string {
+		s := sha256.Sum256([]byte(data))
+		return base64.RawStdEncoding.EncodeToString(s[:])
+	}
+	// the digests are expanded by the manifest's decoder before they are
+	// compared with the files
+	manifest := `{"version":2,"digestEncoding":"base64","entries":[` +
+		`{"type":"reg","name":"file1","digest":"` + sum("hello") + `"},` +
+		`{"type":"reg","name":"file2","digest":"` + sum("world") + `"}]}`
+	require.NoError(t, store.SetLayerBigData(layer.ID, chunkedManifestBigDataKey, strings.NewReader(manifest)))
+	require.NoError(t, store.VerifyLayer(layer.ID))
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(store.GraphRoot(), "vfs", "dir", layer.ID, "file2"), []byte("w0rld"), 0644))
+	err = store.VerifyLayer(layer.ID)
+	require.True(t, errors.Is(err, ErrLayerCorrupted), "%v", err)
+	require.Contains(t, err.Error(), "file2")
+	require.NotContains(t, err.Error(), "file1")
+
+	// encoded digests aren't accepted in a version 1 manifest
+	manifest = strings.Replace(manifest, `"version":2`, `"version":1`, 1)
+	require.NoError(t, store.SetLayerBigData(layer.ID, chunkedManifestBigDataKey, strings.NewReader(manifest)))
+	err = store.VerifyLayer(layer.ID)
+	require.Error(t, err)
+	require.False(t, errors.Is(err, ErrLayerCorrupted), "%v", err)
+}
+
+func TestMountWithOptions(t *testing.T) {
+	store := newTestStore(t)
+
+	layer, _, err := store.PutLayer("", "", nil, "", true, nil, makeTestLayerTar(t, map[string]string{"file": "contents"}))
+	require.NoError(t, err)
+
+	// vfs doesn't actually mount anything, so it can't honor "nodev",
+	// but it has nothing to sync, so a volatile mount is fine.
+	_, err = store.MountWithOptions(layer.ID, "", []string{"nodev"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "nodev")
+
+	mountPoint, err := store.MountWithOptions(layer.ID, "", []string{"volatile"})
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(mountPoint, "file"))
+	require.NoError(t, err)
+	_, err = store.Unmount(layer.ID, true)
+	require.NoError(t, err)
+}
+
+func TestNormalizeMountOptions(t *testing.T) {
+	require.Nil(t, normalizeMountOptions(drivers.MountOpts{}))
+	require.Equal(t, []string{"nodev", "noexec", "volatile"}, normalizeMountOptions(drivers.MountOpts{
+		Options:  []string{"noexec", "nodev", "noexec"},
+		Volatile: true,
+	}))
+}
+
+func TestCheckMountOptions(t *testing.T) {
+	layer := &Layer{ID: "layer", MountPoint: "/mnt", MountOptions: []string{"nodev"}}
+	require.NoError(t, checkMountOptions(layer, []string{"nodev"}))
+	require.NoError(t, checkMountOptions(layer, nil))
+	err := checkMountOptions(layer, []string{"noexec"})
+	require.True(t, errors.Is(err, ErrLayerMountOptionsConflict), "%v", err)
+
+	// a caller who didn't ask for any options shares the current mount,
+	// even if it is volatile
+	layer.MountOptions = []string{"nodev", "volatile"}
+	require.NoError(t, checkMountOptions(layer, []string{"nodev", "volatile"}))
+	require.NoError(t, checkMountOptions(layer, nil))
+
+	// the options of the mounts recorded by older versions are unknown
+	layer.MountOptions = nil
+	require.NoError(t, checkMountOptions(layer, []string{"noexec"}))
+}
+
+func TestRepairLayersNotSupported(t *testing.T) {
+	store := newTestStore(t)
+
+	_, err := store.RepairLayers()
+	require.Error(t, err)
+	require.True(t, errors.Is(err, ErrNotSupported))
+}
+
+func TestAssembleTar(t *testing.T) {
+	store := newTestStore(t)
+
+	// Use headers which wouldn't be reproduced by generating a new
+	// tarball, and trailing padding after the end-of-archive marker.
+	var diff bytes.Buffer
+	tw := tar.NewWriter(&diff)
+	for _, f := range []struct{ name, contents string }{{"b-file", "hello"}, {"a-file", "world"}} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     f.name,
+			Mode:     0600,
+			Size:     int64(len(f.contents)),
+			Uname:    "someone",
+			Format:   tar.FormatGNU,
+		}))
+		_, err := tw.Write([]byte(f.contents))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	diff.Write(make([]byte, 4096))
+	original := append([]byte{}, diff.Bytes()...)
+
+	layer, _, err := store.PutLayer("", "", nil, "", false, nil, &diff)
+	require.NoError(t, err)
+
+	rc, err := store.AssembleTar(layer.ID)
+	require.NoError(t, err)
+	assembled, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.Equal(t, original, assembled)
+
+	rc, err = store.TarSplitStream(layer.ID)
+	require.NoError(t, err)
+	tsdata, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.Contains(t, string(tsdata), "b-file")
+
+	// A layer which wasn't populated from a tarball has no tar-split data.
+	empty, err := store.CreateLayer("", "", nil, "", false, nil)
+	require.NoError(t, err)
+	_, err = store.AssembleTar(empty.ID)
+	require.True(t, errors.Is(err, ErrLayerHasNoTarSplit), "unexpected error %v", err)
+	_, err = store.TarSplitStream("no-such-layer")
+	require.True(t, errors.Is(err, ErrLayerUnknown), "unexpected error %v", err)
+}
+
+func TestLayersByIDs(t *testing.T) {
+	store := newTestStore(t)
+
+	base, err := store.CreateLayer("", "", []string{"base"}, "", false, nil)
+	require.NoError(t, err)
+	top, err := store.CreateLayer("", base.ID, nil, "", false, nil)
+	require.NoError(t, err)
+
+	layers, err := store.LayersByIDs([]string{top.ID, "no-such-layer", "base"})
+	require.NoError(t, err)
+	require.Len(t, layers, 3)
+	require.NotNil(t, layers[0])
+	require.Equal(t, top.ID, layers[0].ID)
+	require.Nil(t, layers[1])
+	require.NotNil(t, layers[2])
+	require.Equal(t, base.ID, layers[2].ID)
+}
+
+func BenchmarkLayerLookup(b *testing.B) {
+	store := newTestStore(b)
+	var ids []string
+	parent := ""
+	for i := 0; i < 50; i++ {
+		layer, err := store.CreateLayer("", parent, nil, "", false, nil)
+		require.NoError(b, err)
+		ids = append(ids, layer.ID)
+		parent = layer.ID
+	}
+
+	b.Run("Layer", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, id := range ids {
+				if _, err := store.Layer(id); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("LayersByIDs", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := store.LayersByIDs(ids); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestMountReadOnly(t *testing.T) {
+	store := newTestStore(t)
+
+	base, _, err := store.PutLayer("", "", nil, "", false, nil, makeTestLayerTar(t, map[string]string{"file": "contents"}))
+	require.NoError(t, err)
+	top, err := store.CreateLayer("", base.ID, nil, "", false, nil)
+	require.NoError(t, err)
+
+	mountpoint, err := store.MountReadOnly(top.ID)
+	require.NoError(t, err)
+	require.NotEmpty(t, mountpoint)
+	count, err := store.Mounted(top.ID)
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+	layer, err := store.Layer(top.ID)
+	require.NoError(t, err)
+	require.Equal(t, []string{"ro"}, layer.MountOptions)
+
+	// no layer was created for the mount
+	layers, err := store.Layers()
+	require.NoError(t, err)
+	require.Len(t, layers, 2)
+
+	_, err = store.Unmount(top.ID, false)
+	require.NoError(t, err)
+	_, err = store.MountReadOnly("no-such-layer")
+	require.True(t, errors.Is(err, ErrLayerUnknown), "unexpected error %v", err)
+}
+
+func TestPutLayerReuseExisting(t *testing.T) {
+	store := newTestStore(t)
+
+	diff := makeTestLayerTar(t, map[string]string{"file": "contents"}).Bytes()
+	options := &LayerOptions{UncompressedDigest: digest.FromBytes(diff), ReuseExisting: true}
+
+	const creators = 8
+	var wg sync.WaitGroup
+	ids := make([]string, creators)
+	errs := make([]error, creators)
+	for i := 0; i < creators; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			layer, _, err := store.PutLayer("", "", []string{fmt.Sprintf("name-%d", i)}, "", false, options, bytes.NewReader(diff))
+			if err == nil {
+				ids[i] = layer.ID
+			}
+			errs[i] = err
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < creators; i++ {
+		require.NoError(t, errs[i])
+		require.Equal(t, ids[0], ids[i])
+	}
+	layers, err := store.Layers()
+	require.NoError(t, err)
+	require.Len(t, layers, 1)
+	require.Len(t, layers[0].Names, creators)
+
+	// a layer with the same diff on top of another parent is created
+	child, _, err := store.PutLayer("", ids[0], nil, "", false, options, bytes.NewReader(diff))
+	require.NoError(t, err)
+	require.NotEqual(t, ids[0], child.ID)
+	reused, _, err := store.PutLayer("", ids[0], nil, "", false, options, bytes.NewReader(diff))
+	require.NoError(t, err)
+	require.Equal(t, child.ID, reused.ID)
+
+	// layers are only reused if asked to
+	other, _, err := store.PutLayer("", "", nil, "", false, &LayerOptions{UncompressedDigest: options.UncompressedDigest}, bytes.NewReader(diff))
+	require.NoError(t, err)
+	require.NotEqual(t, ids[0], other.ID)
+}
+
+// withSyncPolicy returns a newTestStore modifier which sets the sync policy.
+func withSyncPolicy(policy string) func(*StoreOptions) {
+	return func(options *StoreOptions) {
+		options.SyncPolicy = policy
+	}
+}
+
+func TestLayerSyncPolicy(t *testing.T) {
+	var synced []string
+	defer func(f func(string) error) {
+		syncFilesystem = f
+	}(syncFilesystem)
+	syncFilesystem = func(dir string) error {
+		synced = append(synced, dir)
+		return nil
+	}
+
+	for _, policy := range []string{"", SyncPolicyAlways, SyncPolicyMetadataOnly, SyncPolicyNone} {
+		synced = nil
+		store := newTestStore(t, withSyncPolicy(policy))
+		layer, _, err := store.PutLayer("", "", nil, "", false, nil, makeTestLayerTar(t, map[string]string{"file": "contents"}))
+		require.NoError(t, err, policy)
+		if policy == SyncPolicyAlways {
+			driver, err := store.GraphDriver()
+			require.NoError(t, err)
+			dir, err := driver.(drivers.UpperDirDriver).UpperDir(layer.ID)
+			require.NoError(t, err)
+			require.Equal(t, []string{dir}, synced)
+		} else {
+			require.Empty(t, synced, policy)
+		}
+		// the records are written regardless
+		reloaded, err := store.Layer(layer.ID)
+		require.NoError(t, err, policy)
+		require.Equal(t, layer.ID, reloaded.ID)
+	}
+
+	syncFilesystem = func(dir string) error {
+		return errors.New("flushing failed")
+	}
+	store := newTestStore(t, withSyncPolicy(SyncPolicyAlways))
+	_, _, err := store.PutLayer("", "", nil, "", false, nil, makeTestLayerTar(t, map[string]string{"file": "contents"}))
+	require.Error(t, err)
+	layers, err := store.Layers()
+	require.NoError(t, err)
+	require.Empty(t, layers)
+
+	wd, err := ioutil.TempDir("", "testStorageSync")
+	require.NoError(t, err)
+	defer os.RemoveAll(wd)
+	_, err = GetStore(StoreOptions{
+		RunRoot:         filepath.Join(wd, "run"),
+		GraphRoot:       filepath.Join(wd, "root"),
+		GraphDriverName: "vfs",
+		SyncPolicy:      "sometimes",
+	})
+	require.Error(t, err)
+}
+
+func BenchmarkLayerSyncPolicy(b *testing.B) {
+	files := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		files[fmt.Sprintf("file-%d", i)] = fmt.Sprintf("contents of file %d", i)
+	}
+	diff := makeTestLayerTar(b, files).Bytes()
+	for _, policy := range []string{SyncPolicyAlways, SyncPolicyMetadataOnly, SyncPolicyNone} {
+		b.Run(policy, func(b *testing.B) {
+			store := newTestStore(b, withSyncPolicy(policy))
+			b.SetBytes(int64(len(diff)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := store.PutLayer("", "", nil, "", false, nil, bytes.NewReader(diff)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestMissingLayers(t *testing.T) {
+	store := newTestStore(t)
+
+	base, _, err := store.PutLayer("", "", nil, "", false, nil, makeTestLayerTar(t, map[string]string{"base": "base"}))
+	require.NoError(t, err)
+	top, _, err := store.PutLayer("", "", nil, base.ID, false, nil, makeTestLayerTar(t, map[string]string{"top": "top"}))
+	require.NoError(t, err)
+	absent := digest.FromString("absent")
+	other := digest.FromString("other")
+
+	missing, err := store.MissingLayers([]digest.Digest{base.UncompressedDigest, absent, top.UncompressedDigest, other, absent})
+	require.NoError(t, err)
+	require.Equal(t, []digest.Digest{absent, other}, missing)
+
+	missing, err = store.MissingLayers([]digest.Digest{top.UncompressedDigest, base.UncompressedDigest})
+	require.NoError(t, err)
+	require.Empty(t, missing)
+
+	_, err = store.MissingLayers([]digest.Digest{"not-a-digest"})
+	require.Error(t, err)
+}
@@ -0,0 +1,245 @@
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/containers/storage/pkg/ioutils"
+	"github.com/pkg/errors"
+)
+
+// metadataExportVersion is the version of the format written by
+// ExportMetadata.  It is increased whenever the format changes in a way that
+// older versions of ImportMetadata can't read.
+const metadataExportVersion = 1
+
+// metadataExport is what ExportMetadata writes.
+type metadataExport struct {
+	Version    int                 `json:"version"`
+	Driver     string              `json:"driver"`
+	Layers     []metadataLayer     `json:"layers,omitempty"`
+	Images     []metadataImage     `json:"images,omitempty"`
+	Containers []metadataContainer `json:"containers,omitempty"`
+}
+
+// metadataLayer is the record of a layer, with its big data items, such as
+// its chunked manifest.
+type metadataLayer struct {
+	Layer   *Layer            `json:"layer"`
+	BigData map[string][]byte `json:"big-data,omitempty"`
+}
+
+// metadataImage is the record of an image, with its big data items, such as
+// its manifests and its configuration.
+type metadataImage struct {
+	Image   *Image            `json:"image"`
+	BigData map[string][]byte `json:"big-data,omitempty"`
+}
+
+// metadataContainer is the record of a container, with its big data items.
+type metadataContainer struct {
+	Container *Container        `json:"container"`
+	BigData   map[string][]byte `json:"big-data,omitempty"`
+}
+
+func (s *store) ExportMetadata(w io.Writer) error {
+	export := metadataExport{
+		Version: metadataExportVersion,
+		Driver:  s.graphDriverName,
+	}
+
+	layers, err := s.Layers()
+	if err != nil {
+		return err
+	}
+	for i := range layers {
+		layer := &layers[i]
+		exported := metadataLayer{Layer: layer}
+		keys, err := s.ListLayerBigData(layer.ID)
+		if err != nil {
+			return errors.Wrapf(err, "listing the big data of layer %q", layer.ID)
+		}
+		for _, key := range keys {
+			rc, err := s.LayerBigData(layer.ID, key)
+			if err != nil {
+				return errors.Wrapf(err, "reading big data %q of layer %q", key, layer.ID)
+			}
+			data, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return errors.Wrapf(err, "reading big data %q of layer %q", key, layer.ID)
+			}
+			if exported.BigData == nil {
+				exported.BigData = make(map[string][]byte)
+			}
+			exported.BigData[key] = data
+		}
+		export.Layers = append(export.Layers, exported)
+	}
+
+	images, err := s.Images()
+	if err != nil {
+		return err
+	}
+	for i := range images {
+		image := &images[i]
+		exported := metadataImage{Image: image}
+		for _, key := range image.BigDataNames {
+			data, err := s.ImageBigData(image.ID, key)
+			if err != nil {
+				return errors.Wrapf(err, "reading big data %q of image %q", key, image.ID)
+			}
+			if exported.BigData == nil {
+				exported.BigData = make(map[string][]byte)
+			}
+			exported.BigData[key] = data
+		}
+		export.Images = append(export.Images, exported)
+	}
+
+	containers, err := s.Containers()
+	if err != nil {
+		return err
+	}
+	for i := range containers {
+		container := &containers[i]
+		exported := metadataContainer{Container: container}
+		for _, key := range container.BigDataNames {
+			data, err := s.ContainerBigData(container.ID, key)
+			if err != nil {
+				return errors.Wrapf(err, "reading big data %q of container %q", key, container.ID)
+			}
+			if exported.BigData == nil {
+				exported.BigData = make(map[string][]byte)
+			}
+			exported.BigData[key] = data
+		}
+		export.Containers = append(export.Containers, exported)
+	}
+
+	return json.NewEncoder(w).Encode(&export)
+}
+
+// ImportMetadata reads metadata written by a Store's ExportMetadata() method
+// from r, writes it to the empty store described by options, and returns
+// the store.  The contents of the layers were not exported, so the layers
+// of the new store can't be mounted or read, but their records, and the
+// ones of the images and containers, can be examined as in the original
+// store.  If options.GraphDriverName is not set, the records are written
+// for the vfs driver, which can be used anywhere.  An error is returned if
+// the store already has layers, images or containers.
+func ImportMetadata(r io.Reader, options StoreOptions) (Store, error) {
+	var export metadataExport
+	if err := json.NewDecoder(r).Decode(&export); err != nil {
+		return nil, errors.Wrapf(err, "decoding the exported metadata")
+	}
+	if export.Version != metadataExportVersion {
+		return nil, errors.Errorf("unsupported metadata export version %d", export.Version)
+	}
+	if options.GraphRoot == "" || options.RunRoot == "" {
+		return nil, errors.Wrap(ErrIncompleteOptions, "no storage root specified")
+	}
+	if options.GraphDriverName == "" {
+		options.GraphDriverName = "vfs"
+	}
+
+	root := options.GraphRoot
+	if options.Namespace != "" {
+		root = filepath.Join(root, "namespaces", options.Namespace)
+	}
+	prefix := options.GraphDriverName + "-"
+	layerDir := filepath.Join(root, prefix+"layers")
+	imageDir := filepath.Join(root, prefix+"images")
+	containerDir := filepath.Join(root, prefix+"containers")
+	for _, path := range []string{
+		filepath.Join(layerDir, "layers.json"),
+		filepath.Join(imageDir, "images.json"),
+		filepath.Join(containerDir, "containers.json"),
+	} {
+		if _, err := os.Stat(path); err == nil {
+			return nil, errors.Errorf("can't import metadata into %q, which already has records in %q", options.GraphRoot, path)
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	layers := []*Layer{}
+	for _, exported := range export.Layers {
+		if exported.Layer == nil {
+			return nil, errors.New("exported layer without a record")
+		}
+		layers = append(layers, exported.Layer)
+		if err := writeImportedBigData(layerDir, exported.Layer.ID, exported.BigData); err != nil {
+			return nil, err
+		}
+	}
+	images := []*Image{}
+	for _, exported := range export.Images {
+		if exported.Image == nil {
+			return nil, errors.New("exported image without a record")
+		}
+		images = append(images, exported.Image)
+		if err := writeImportedBigData(imageDir, exported.Image.ID, exported.BigData); err != nil {
+			return nil, err
+		}
+	}
+	containers := []*Container{}
+	for _, exported := range export.Containers {
+		if exported.Container == nil {
+			return nil, errors.New("exported container without a record")
+		}
+		containers = append(containers, exported.Container)
+		if err := writeImportedBigData(containerDir, exported.Container.ID, exported.BigData); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, records := range []struct {
+		path    string
+		records interface{}
+	}{
+		{filepath.Join(layerDir, "layers.json"), layers},
+		{filepath.Join(imageDir, "images.json"), images},
+		{filepath.Join(containerDir, "containers.json"), containers},
+	} {
+		data, err := json.Marshal(records.records)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(records.path), 0700); err != nil {
+			return nil, err
+		}
+		if err := ioutils.AtomicWriteFile(records.path, data, 0600); err != nil {
+			return nil, err
+		}
+	}
+
+	return GetStore(options)
+}
+
+// writeImportedBigData writes the big data items in bigData to the directory
+// under parent where a store keeps the ones of the layer, image, or container
+// with the specified ID.
+func writeImportedBigData(parent, id string, bigData map[string][]byte) error {
+	if id == "" || id == "." || id == ".." || filepath.Base(id) != id {
+		return errors.Errorf("invalid ID %q in the exported metadata", id)
+	}
+	if len(bigData) == 0 {
+		return nil
+	}
+	dir := filepath.Join(parent, id)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	for key, data := range bigData {
+		if key == "" {
+			return errors.Wrapf(ErrInvalidBigDataName, "importing big data into %q", dir)
+		}
+		if err := ioutils.AtomicWriteFile(filepath.Join(dir, makeBigDataBaseName(key)), data, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
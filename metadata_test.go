@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportImportMetadata(t *testing.T) {
+	store := newTestStore(t)
+
+	parent, _, err := store.PutLayer("", "", nil, "", false, nil, makeTestLayerTar(t, map[string]string{"base": "base"}))
+	require.NoError(t, err)
+	layer, _, err := store.PutLayer("", "", []string{"top"}, parent.ID, false, nil, makeTestLayerTar(t, map[string]string{"file": "contents"}))
+	require.NoError(t, err)
+	require.NoError(t, store.SetLayerBigData(layer.ID, chunkedManifestBigDataKey, strings.NewReader(`{"version":1}`)))
+	image, err := store.CreateImage("", []string{"example.com/image:latest"}, layer.ID, "image metadata", nil)
+	require.NoError(t, err)
+	require.NoError(t, store.SetImageBigData(image.ID, "notes", []byte(`{"schemaVersion":2}`), nil))
+	require.NoError(t, store.SetImageBigData(image.ID, "config", []byte(`{"os":"linux"}`), nil))
+	container, err := store.CreateContainer("", []string{"ctr"}, image.ID, "", "container metadata", nil)
+	require.NoError(t, err)
+	require.NoError(t, store.SetContainerBigData(container.ID, "state", []byte("running")))
+
+	var exported bytes.Buffer
+	require.NoError(t, store.ExportMetadata(&exported))
+	assert.NotContains(t, exported.String(), "contents")
+
+	wd, err := ioutil.TempDir("", "testStorageImport")
+	require.NoError(t, err)
+	defer os.RemoveAll(wd)
+	options := StoreOptions{
+		RunRoot:   filepath.Join(wd, "run"),
+		GraphRoot: filepath.Join(wd, "root"),
+	}
+	imported, err := ImportMetadata(bytes.NewReader(exported.Bytes()), options)
+	require.NoError(t, err)
+	defer func() {
+		_, _ = imported.Shutdown(true)
+		imported.Free()
+	}()
+
+	originalLayers, err := store.Layers()
+	require.NoError(t, err)
+	importedLayers, err := imported.Layers()
+	require.NoError(t, err)
+	assert.Equal(t, originalLayers, importedLayers)
+	manifest, err := imported.LayerBigData(layer.ID, chunkedManifestBigDataKey)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(manifest)
+	manifest.Close()
+	require.NoError(t, err)
+	assert.Equal(t, `{"version":1}`, string(data))
+
+	originalImages, err := store.Images()
+	require.NoError(t, err)
+	importedImages, err := imported.Images()
+	require.NoError(t, err)
+	assert.Equal(t, originalImages, importedImages)
+	for _, key := range []string{"notes", "config"} {
+		original, err := store.ImageBigData(image.ID, key)
+		require.NoError(t, err)
+		data, err := imported.ImageBigData(image.ID, key)
+		require.NoError(t, err)
+		assert.Equal(t, original, data)
+	}
+	byName, err := imported.Image("example.com/image:latest")
+	require.NoError(t, err)
+	assert.Equal(t, image.ID, byName.ID)
+
+	originalContainers, err := store.Containers()
+	require.NoError(t, err)
+	importedContainers, err := imported.Containers()
+	require.NoError(t, err)
+	assert.Equal(t, originalContainers, importedContainers)
+	data, err = imported.ContainerBigData(container.ID, "state")
+	require.NoError(t, err)
+	assert.Equal(t, "running", string(data))
+
+	// the contents of the layers were not exported
+	assert.True(t, errors.Is(imported.VerifyLayer(parent.ID), ErrNotSupported))
+
+	// a store which has records is not overwritten
+	_, err = ImportMetadata(bytes.NewReader(exported.Bytes()), options)
+	assert.Error(t, err)
+
+	// nor is an unknown version read
+	options.GraphRoot = filepath.Join(wd, "other")
+	_, err = ImportMetadata(strings.NewReader(`{"version":1000}`), options)
+	assert.Error(t, err)
+	_, err = ImportMetadata(strings.NewReader(`{"version":1,"layers":[{"layer":{"id":"../escape"}}]}`), options)
+	assert.Error(t, err)
+}
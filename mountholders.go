@@ -0,0 +1,39 @@
+package storage
+
+// ProcessRef describes a process which keeps a layer mounted, as found by a
+// Store's MountHolders() method.
+type ProcessRef struct {
+	// PID is the ID of the process, in the PID namespace of /proc.
+	PID int
+	// Command is the name of the process's command.
+	Command string
+	// Mounted is set if the layer's mount point is mounted in the mount
+	// namespace of the process, which isn't the store's one.
+	Mounted bool
+	// OpenFiles lists the files under the layer's mount point which the
+	// process has open, or uses as its working or root directory.
+	OpenFiles []string
+}
+
+func (s *store) MountHolders(id string) ([]ProcessRef, error) {
+	if layerID, err := s.ContainerLayerID(id); err == nil {
+		id = layerID
+	}
+	rlstore, err := s.LayerStore()
+	if err != nil {
+		return nil, err
+	}
+	rlstore.RLock()
+	defer rlstore.Unlock()
+	if err := rlstore.ReloadIfChanged(); err != nil {
+		return nil, err
+	}
+	layer, err := rlstore.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if layer.MountPoint == "" {
+		return nil, nil
+	}
+	return mountHolders(procRoot, layer.MountPoint)
+}
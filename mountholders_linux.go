@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/containers/storage/pkg/mount"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// procRoot is where the proc filesystem is mounted.  It can be replaced by
+// tests.
+var procRoot = "/proc"
+
+// mountHolders returns the processes which keep mountPoint mounted, as seen
+// in the proc filesystem mounted at root.  The processes whose details can't
+// be read are skipped.
+func mountHolders(root, mountPoint string) ([]ProcessRef, error) {
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing the processes in %q", root)
+	}
+	// every process in our mount namespace has the mount point, since we
+	// mounted it there
+	ownNamespace, err := os.Readlink(filepath.Join(root, "self", "ns", "mnt"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading our mount namespace")
+	}
+	var holders []ProcessRef
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || pid <= 0 {
+			continue
+		}
+		holder, err := mountHolder(filepath.Join(root, entry.Name()), mountPoint, ownNamespace)
+		if err != nil {
+			// the process may have exited, or belong to another user
+			logrus.Debugf("Looking for %q in process %d: %v", mountPoint, pid, err)
+			continue
+		}
+		if holder.Mounted || len(holder.OpenFiles) > 0 {
+			holder.PID = pid
+			holders = append(holders, holder)
+		}
+	}
+	sort.Slice(holders, func(i, j int) bool {
+		return holders[i].PID < holders[j].PID
+	})
+	return holders, nil
+}
+
+// mountHolder checks if the process whose proc directory is dir keeps
+// mountPoint mounted.  ownNamespace is our mount namespace.  The details
+// which we aren't allowed to read are skipped.
+func mountHolder(dir, mountPoint, ownNamespace string) (ProcessRef, error) {
+	holder := ProcessRef{}
+	comm, err := ioutil.ReadFile(filepath.Join(dir, "comm"))
+	if err != nil {
+		return holder, err
+	}
+	holder.Command = strings.TrimSuffix(string(comm), "\n")
+
+	namespace, err := os.Readlink(filepath.Join(dir, "ns", "mnt"))
+	if err != nil && !os.IsPermission(err) {
+		return holder, err
+	}
+	if err == nil && namespace != ownNamespace {
+		f, err := os.Open(filepath.Join(dir, "mountinfo"))
+		if err != nil {
+			return holder, err
+		}
+		mounts, err := mount.GetMountsFromReader(f, nil)
+		f.Close()
+		if err != nil {
+			return holder, err
+		}
+		for _, m := range mounts {
+			if m.Mountpoint == mountPoint {
+				holder.Mounted = true
+				break
+			}
+		}
+	}
+
+	under := func(path string) bool {
+		return path == mountPoint || strings.HasPrefix(path, mountPoint+"/")
+	}
+	for _, link := range []string{"cwd", "root"} {
+		if target, err := os.Readlink(filepath.Join(dir, link)); err == nil && under(target) {
+			holder.OpenFiles = append(holder.OpenFiles, target)
+		}
+	}
+	fds, err := ioutil.ReadDir(filepath.Join(dir, "fd"))
+	if err != nil {
+		if os.IsPermission(err) {
+			err = nil
+		}
+		return holder, err
+	}
+	for _, fd := range fds {
+		// the descriptor may have been closed in the meantime
+		if target, err := os.Readlink(filepath.Join(dir, "fd", fd.Name())); err == nil && under(target) {
+			holder.OpenFiles = append(holder.OpenFiles, target)
+		}
+	}
+	return holder, nil
+}
@@ -0,0 +1,123 @@
+// +build linux
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeProcess describes a process in a fake proc filesystem.
+type fakeProcess struct {
+	command   string
+	namespace string
+	mounts    []string
+	links     map[string]string
+}
+
+// makeFakeProc creates a fake proc filesystem with the specified processes,
+// in which self is the process with PID 1.
+func makeFakeProc(t *testing.T, processes map[int]fakeProcess) string {
+	root, err := ioutil.TempDir("", "fake-proc")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		os.RemoveAll(root)
+	})
+	for pid, p := range processes {
+		dir := filepath.Join(root, strconv.Itoa(pid))
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "ns"), 0755))
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "fd"), 0755))
+		if p.command != "" {
+			require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "comm"), []byte(p.command+"\n"), 0644))
+		}
+		require.NoError(t, os.Symlink(p.namespace, filepath.Join(dir, "ns", "mnt")))
+		mountinfo := "22 1 0:21 / / rw,relatime - ext4 /dev/root rw\n"
+		for i, m := range p.mounts {
+			mountinfo += strconv.Itoa(23+i) + " 22 0:42 / " + m + " rw,relatime - overlay overlay rw\n"
+		}
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "mountinfo"), []byte(mountinfo), 0644))
+		for name, target := range p.links {
+			require.NoError(t, os.Symlink(target, filepath.Join(dir, name)))
+		}
+	}
+	require.NoError(t, os.Symlink("1", filepath.Join(root, "self")))
+	return root
+}
+
+func TestMountHolders(t *testing.T) {
+	store := newTestStore(t)
+
+	layer, _, err := store.PutLayer("", "", nil, "", false, nil, makeTestLayerTar(t, map[string]string{"file": "data"}))
+	require.NoError(t, err)
+	image, err := store.CreateImage("", nil, layer.ID, "", nil)
+	require.NoError(t, err)
+	container, err := store.CreateContainer("", nil, image.ID, "", "", nil)
+	require.NoError(t, err)
+	mountPoint, err := store.Mount(container.ID, "")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_, _ = store.Unmount(container.ID, true)
+	})
+
+	defer func(root string) {
+		procRoot = root
+	}(procRoot)
+	procRoot = makeFakeProc(t, map[int]fakeProcess{
+		1: {command: "podman", namespace: "mnt:[1]", mounts: []string{mountPoint}, links: map[string]string{"fd/3": "/dev/null", "cwd": "/"}},
+		// a process in another namespace which still has the mount
+		10: {command: "sleep", namespace: "mnt:[2]", mounts: []string{mountPoint}},
+		// a process with files open under it
+		11: {command: "bash", namespace: "mnt:[1]", mounts: []string{mountPoint}, links: map[string]string{
+			"cwd":  mountPoint + "/usr",
+			"fd/4": mountPoint + "/file",
+			"fd/5": "/other",
+		}},
+		// processes which don't hold it
+		12: {command: "other", namespace: "mnt:[2]", links: map[string]string{"fd/3": mountPoint + "x"}},
+		13: {namespace: "mnt:[2]", mounts: []string{mountPoint}},
+	})
+
+	expected := []ProcessRef{
+		{PID: 10, Command: "sleep", Mounted: true},
+		{PID: 11, Command: "bash", OpenFiles: []string{mountPoint + "/usr", mountPoint + "/file"}},
+	}
+	holders, err := store.MountHolders(container.ID)
+	require.NoError(t, err)
+	assert.Equal(t, expected, holders)
+	holders, err = store.MountHolders(container.LayerID)
+	require.NoError(t, err)
+	assert.Equal(t, expected, holders)
+
+	// layers which aren't mounted have no holders
+	holders, err = store.MountHolders(layer.ID)
+	require.NoError(t, err)
+	assert.Empty(t, holders)
+	_, err = store.MountHolders("no-such-layer")
+	assert.Error(t, err)
+}
+
+func TestMountHoldersProc(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mount-holders")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	f, err := os.Create(filepath.Join(dir, "file"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	holders, err := mountHolders("/proc", dir)
+	require.NoError(t, err)
+	found := false
+	for _, holder := range holders {
+		if holder.PID == os.Getpid() {
+			found = true
+			assert.Contains(t, holder.OpenFiles, f.Name())
+		}
+	}
+	assert.True(t, found, "%+v", holders)
+}
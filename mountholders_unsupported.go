@@ -0,0 +1,17 @@
+// +build !linux
+
+package storage
+
+import (
+	"github.com/pkg/errors"
+)
+
+// procRoot is where the proc filesystem is mounted.  It can be replaced by
+// tests.
+var procRoot = "/proc"
+
+// mountHolders returns the processes which keep mountPoint mounted, as seen
+// in the proc filesystem mounted at root.
+func mountHolders(root, mountPoint string) ([]ProcessRef, error) {
+	return nil, errors.Wrapf(ErrNotSupported, "finding the processes which keep %q mounted", mountPoint)
+}
@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/containers/storage/pkg/mount"
+)
+
+// MountProblem describes a disagreement between a Store's records of which
+// layers are mounted and the mounts which the kernel reports.
+type MountProblem string
+
+const (
+	// MountNotMounted is reported for a layer which the Store considers
+	// to be mounted, with a graph driver which mounts layers, but which
+	// has nothing mounted at its mount point, usually because it was
+	// unmounted without the Store knowing about it.
+	MountNotMounted MountProblem = "not-mounted"
+	// MountUntracked is reported for a file system mounted under the
+	// graph driver's directory which is not the mount point of any layer
+	// which the Store considers to be mounted, usually because it was
+	// leaked by a process which failed to unmount it.  Graph drivers may
+	// also mount file systems of their own there.
+	MountUntracked MountProblem = "untracked"
+)
+
+// MountInfo describes a mount returned by Store.ListMounts.
+type MountInfo struct {
+	// LayerID is the ID of the mounted layer.  It is empty for an
+	// untracked mount whose path doesn't name any layer.
+	LayerID string `json:"layer,omitempty"`
+	// MountPoint is where the layer is mounted.
+	MountPoint string `json:"path"`
+	// MountCount is the number of times the layer has been mounted and
+	// not unmounted, according to the Store.
+	MountCount int `json:"count"`
+	// MountOptions are the options which were requested when the layer
+	// was mounted.
+	MountOptions []string `json:"options,omitempty"`
+	// Mounted is set if the kernel reports a file system mounted at
+	// MountPoint.
+	Mounted bool `json:"mounted"`
+	// Problem is set if the Store's records and the kernel's disagree
+	// about this mount.
+	Problem MountProblem `json:"problem,omitempty"`
+}
+
+// getMounts returns the mounts which the kernel reports.  Tests replace it to
+// simulate mounts.
+var getMounts = mount.GetMounts
+
+func (s *store) ListMounts() ([]MountInfo, error) {
+	caps, err := s.DriverCapabilities()
+	if err != nil {
+		return nil, err
+	}
+	rlstore, err := s.LayerStore()
+	if err != nil {
+		return nil, err
+	}
+	rlstore.RLock()
+	defer rlstore.Unlock()
+	if err := rlstore.ReloadIfChanged(); err != nil {
+		return nil, err
+	}
+	layers, err := rlstore.Layers()
+	if err != nil {
+		return nil, err
+	}
+	kernelMounts, err := getMounts()
+	if err != nil {
+		return nil, err
+	}
+	return checkMounts(layers, kernelMounts, filepath.Join(s.graphRoot, s.graphDriverName), caps.Mounts), nil
+}
+
+// checkMounts compares the mounts of layers with kernelMounts, which are
+// expected to include one for every mounted layer if driverMounts is set,
+// and to include none under home, the graph driver's directory, other than
+// those.  The result is sorted by mount point.
+func checkMounts(layers []Layer, kernelMounts []*mount.Info, home string, driverMounts bool) []MountInfo {
+	mounted := make(map[string]bool)
+	for _, m := range kernelMounts {
+		mounted[filepath.Clean(m.Mountpoint)] = true
+	}
+	known := make(map[string]bool)
+	tracked := make(map[string]bool)
+	var mounts []MountInfo
+	for _, layer := range layers {
+		known[layer.ID] = true
+		if layer.MountCount == 0 || layer.MountPoint == "" {
+			continue
+		}
+		mountPoint := filepath.Clean(layer.MountPoint)
+		tracked[mountPoint] = true
+		info := MountInfo{
+			LayerID:      layer.ID,
+			MountPoint:   mountPoint,
+			MountCount:   layer.MountCount,
+			MountOptions: copyStringSlice(layer.MountOptions),
+			Mounted:      mounted[mountPoint],
+		}
+		if driverMounts && !info.Mounted {
+			info.Problem = MountNotMounted
+		}
+		mounts = append(mounts, info)
+	}
+
+	home = filepath.Clean(home)
+	for _, m := range kernelMounts {
+		mountPoint := filepath.Clean(m.Mountpoint)
+		if tracked[mountPoint] || !strings.HasPrefix(mountPoint, home+string(os.PathSeparator)) {
+			continue
+		}
+		// Don't report a mount twice if it is stacked on another one.
+		tracked[mountPoint] = true
+		info := MountInfo{
+			MountPoint: mountPoint,
+			Mounted:    true,
+			Problem:    MountUntracked,
+		}
+		for _, component := range strings.Split(strings.TrimPrefix(mountPoint, home), string(os.PathSeparator)) {
+			if known[component] {
+				info.LayerID = component
+				break
+			}
+		}
+		mounts = append(mounts, info)
+	}
+
+	sort.Slice(mounts, func(i, j int) bool {
+		return mounts[i].MountPoint < mounts[j].MountPoint
+	})
+	return mounts
+}
@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/storage/pkg/mount"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListMounts(t *testing.T) {
+	s := newTestStore(t)
+
+	mounted, err := s.CreateLayer("", "", nil, "", true, nil)
+	require.NoError(t, err)
+	leaked, err := s.CreateLayer("", "", nil, "", true, nil)
+	require.NoError(t, err)
+	mountPoint, err := s.Mount(mounted.ID, "")
+	require.NoError(t, err)
+
+	home := filepath.Join(s.GraphRoot(), s.GraphDriverName())
+	leakedMountPoint := filepath.Join(home, "dir", leaked.ID)
+	kernelMounts := []*mount.Info{
+		{Mountpoint: "/"},
+		{Mountpoint: home},
+		{Mountpoint: mountPoint},
+		{Mountpoint: leakedMountPoint},
+	}
+	defer func(saved func() ([]*mount.Info, error)) {
+		getMounts = saved
+	}(getMounts)
+	getMounts = func() ([]*mount.Info, error) {
+		return kernelMounts, nil
+	}
+
+	mounts, err := s.ListMounts()
+	require.NoError(t, err)
+	expected := []MountInfo{
+		{LayerID: mounted.ID, MountPoint: mountPoint, MountCount: 1, Mounted: true},
+		{LayerID: leaked.ID, MountPoint: leakedMountPoint, Mounted: true, Problem: MountUntracked},
+	}
+	if mountPoint > leakedMountPoint {
+		expected[0], expected[1] = expected[1], expected[0]
+	}
+	assert.Equal(t, expected, mounts)
+
+	// The vfs driver doesn't mount anything, so the kernel not reporting
+	// a mounted layer isn't a problem.
+	kernelMounts = nil
+	mounts, err = s.ListMounts()
+	require.NoError(t, err)
+	assert.Equal(t, []MountInfo{{LayerID: mounted.ID, MountPoint: mountPoint, MountCount: 1}}, mounts)
+
+	_, err = s.Unmount(mounted.ID, false)
+	require.NoError(t, err)
+	mounts, err = s.ListMounts()
+	require.NoError(t, err)
+	assert.Empty(t, mounts)
+}
+
+func TestCheckMounts(t *testing.T) {
+	home := "/var/lib/containers/storage/overlay"
+	layers := []Layer{
+		{ID: "a", MountPoint: filepath.Join(home, "a", "merged"), MountCount: 2, MountOptions: []string{"ro"}},
+		{ID: "b", MountPoint: filepath.Join(home, "b", "merged"), MountCount: 1},
+		{ID: "c"},
+	}
+	kernelMounts := []*mount.Info{
+		{Mountpoint: filepath.Join(home, "a", "merged")},
+		{Mountpoint: filepath.Join(home, "c", "merged")},
+		{Mountpoint: filepath.Join(home, "c", "merged")},
+		{Mountpoint: filepath.Join(home, "unknown")},
+		{Mountpoint: "/var/lib/containers/storage/overlay-containers"},
+	}
+
+	assert.Equal(t, []MountInfo{
+		{LayerID: "a", MountPoint: filepath.Join(home, "a", "merged"), MountCount: 2, MountOptions: []string{"ro"}, Mounted: true},
+		{LayerID: "b", MountPoint: filepath.Join(home, "b", "merged"), MountCount: 1, Problem: MountNotMounted},
+		{LayerID: "c", MountPoint: filepath.Join(home, "c", "merged"), Mounted: true, Problem: MountUntracked},
+		{MountPoint: filepath.Join(home, "unknown"), Mounted: true, Problem: MountUntracked},
+	}, checkMounts(layers, kernelMounts, home, true))
+
+	// Without a driver which mounts layers, only untracked mounts are
+	// problems.
+	mounts := checkMounts(layers, kernelMounts, home, false)
+	require.Len(t, mounts, 4)
+	assert.Empty(t, mounts[1].Problem)
+}
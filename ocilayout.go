@@ -0,0 +1,310 @@
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// The media types of the manifests and indexes which ImportOCILayout reads.
+const (
+	ociImageIndexMediaType        = "application/vnd.oci.image.index.v1+json"
+	ociImageManifestMediaType     = "application/vnd.oci.image.manifest.v1+json"
+	dockerManifestListMediaType   = "application/vnd.docker.distribution.manifest.list.v2+json"
+	dockerImageManifestMediaType  = "application/vnd.docker.distribution.manifest.v2+json"
+	ociLayoutVersion              = "1.0.0"
+	ociLayoutFile                 = "oci-layout"
+	ociLayoutIndexFile            = "index.json"
+	maxOCILayoutIndexNestingLevel = 8
+)
+
+// ociDescriptor is the part of an OCI content descriptor which
+// ImportOCILayout uses.
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType,omitempty"`
+	Digest      digest.Digest     `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ociIndex is the part of an OCI image index, or of a Docker manifest list,
+// which ImportOCILayout uses.
+type ociIndex struct {
+	MediaType string          `json:"mediaType,omitempty"`
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+// ociManifest is the part of an OCI image manifest, or of a Docker schema 2
+// manifest, which ImportOCILayout uses.
+type ociManifest struct {
+	MediaType string          `json:"mediaType,omitempty"`
+	Config    ociDescriptor   `json:"config"`
+	Layers    []ociDescriptor `json:"layers"`
+}
+
+// ociImageConfig is the part of an image's configuration which
+// ImportOCILayout uses.
+type ociImageConfig struct {
+	RootFS struct {
+		DiffIDs []digest.Digest `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+// LayerBlobDecoder returns a reader of the tarball held by a layer blob of
+// the specified size, which can be read from blob, if it recognizes its
+// format from the media type and the annotations of its descriptor, or nil
+// if it doesn't.  diffID is the digest which the tarball must have.
+type LayerBlobDecoder func(blob io.ReaderAt, size int64, mediaType string, annotations map[string]string, diffID digest.Digest) (io.ReadCloser, error)
+
+var (
+	layerBlobDecodersLock sync.Mutex
+	layerBlobDecoders     []LayerBlobDecoder
+)
+
+// RegisterLayerBlobDecoder adds a decoder which ImportOCILayout tries, before
+// handing a layer blob to PutLayer, which only decompresses gzip and zstd
+// streams.  pkg/chunked registers one for zstd:chunked blobs.
+func RegisterLayerBlobDecoder(decoder LayerBlobDecoder) {
+	layerBlobDecodersLock.Lock()
+	defer layerBlobDecodersLock.Unlock()
+	layerBlobDecoders = append(layerBlobDecoders, decoder)
+}
+
+// ociLayoutImporter holds the state of an ImportOCILayout call.
+type ociLayoutImporter struct {
+	store   *store
+	dir     string
+	created []string
+	// visited lists the manifests and indexes already imported.
+	visited map[digest.Digest]bool
+}
+
+func (s *store) ImportOCILayout(dir string) ([]string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, ociLayoutFile))
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading the OCI layout at %q", dir)
+	}
+	var layout struct {
+		Version string `json:"imageLayoutVersion"`
+	}
+	if err := json.Unmarshal(data, &layout); err != nil {
+		return nil, errors.Wrapf(err, "parsing %q", filepath.Join(dir, ociLayoutFile))
+	}
+	if layout.Version != ociLayoutVersion {
+		return nil, errors.Errorf("unsupported OCI layout version %q in %q", layout.Version, dir)
+	}
+	data, err = ioutil.ReadFile(filepath.Join(dir, ociLayoutIndexFile))
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading the index of the OCI layout at %q", dir)
+	}
+	var index ociIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, errors.Wrapf(err, "parsing %q", filepath.Join(dir, ociLayoutIndexFile))
+	}
+
+	importer := &ociLayoutImporter{
+		store:   s,
+		dir:     dir,
+		visited: make(map[digest.Digest]bool),
+	}
+	for _, desc := range index.Manifests {
+		if err := importer.importDescriptor(desc, 0); err != nil {
+			return importer.created, err
+		}
+	}
+	return importer.created, nil
+}
+
+// readBlob reads the blob described by desc, and checks its size and digest.
+func (i *ociLayoutImporter) readBlob(desc ociDescriptor) ([]byte, error) {
+	path, err := i.blobPath(desc)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	// read one more byte than expected, to catch bigger blobs
+	data, err := ioutil.ReadAll(io.LimitReader(f, desc.Size+1))
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading blob %q", desc.Digest)
+	}
+	if int64(len(data)) != desc.Size {
+		return nil, errors.Errorf("blob %q is not %d bytes long", desc.Digest, desc.Size)
+	}
+	if desc.Digest.Algorithm().FromBytes(data) != desc.Digest {
+		return nil, errors.Errorf("blob %q doesn't match its digest", desc.Digest)
+	}
+	return data, nil
+}
+
+// blobPath returns the path of the blob described by desc.
+func (i *ociLayoutImporter) blobPath(desc ociDescriptor) (string, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return "", errors.Wrapf(err, "invalid blob digest %q", desc.Digest)
+	}
+	if desc.Size < 0 {
+		return "", errors.Errorf("invalid size %d for blob %q", desc.Size, desc.Digest)
+	}
+	return filepath.Join(i.dir, "blobs", desc.Digest.Algorithm().String(), desc.Digest.Encoded()), nil
+}
+
+// importDescriptor imports the image whose manifest is described by desc,
+// or all of the images of the index which desc describes.
+func (i *ociLayoutImporter) importDescriptor(desc ociDescriptor, level int) error {
+	if i.visited[desc.Digest] {
+		return nil
+	}
+	i.visited[desc.Digest] = true
+	data, err := i.readBlob(desc)
+	if err != nil {
+		return err
+	}
+
+	mediaType := desc.MediaType
+	if mediaType == "" {
+		// the index or the manifest may say what it is
+		var probe struct {
+			MediaType string          `json:"mediaType"`
+			Manifests []ociDescriptor `json:"manifests"`
+		}
+		if err := json.Unmarshal(data, &probe); err != nil {
+			return errors.Wrapf(err, "parsing %q", desc.Digest)
+		}
+		switch {
+		case probe.MediaType != "":
+			mediaType = probe.MediaType
+		case probe.Manifests != nil:
+			mediaType = ociImageIndexMediaType
+		default:
+			mediaType = ociImageManifestMediaType
+		}
+	}
+
+	switch mediaType {
+	case ociImageIndexMediaType, dockerManifestListMediaType:
+		if level >= maxOCILayoutIndexNestingLevel {
+			return errors.Errorf("index %q is nested too deeply", desc.Digest)
+		}
+		var index ociIndex
+		if err := json.Unmarshal(data, &index); err != nil {
+			return errors.Wrapf(err, "parsing index %q", desc.Digest)
+		}
+		for _, m := range index.Manifests {
+			if err := i.importDescriptor(m, level+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	case ociImageManifestMediaType, dockerImageManifestMediaType:
+		var manifest ociManifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return errors.Wrapf(err, "parsing manifest %q", desc.Digest)
+		}
+		return i.importImage(desc.Digest, &manifest)
+	default:
+		return errors.Errorf("unsupported media type %q for %q", mediaType, desc.Digest)
+	}
+}
+
+// importImage creates the layers of the image whose manifest is manifest,
+// reusing the ones which are already in the store.
+func (i *ociLayoutImporter) importImage(manifestDigest digest.Digest, manifest *ociManifest) error {
+	data, err := i.readBlob(manifest.Config)
+	if err != nil {
+		return errors.Wrapf(err, "reading the configuration of image %q", manifestDigest)
+	}
+	var config ociImageConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return errors.Wrapf(err, "parsing the configuration of image %q", manifestDigest)
+	}
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return errors.Errorf("image %q has %d layers, and %d diffIDs", manifestDigest, len(manifest.Layers), len(config.RootFS.DiffIDs))
+	}
+
+	parent := ""
+	for n, desc := range manifest.Layers {
+		diffID := config.RootFS.DiffIDs[n]
+		if err := diffID.Validate(); err != nil {
+			return errors.Wrapf(err, "invalid diffID %q in image %q", diffID, manifestDigest)
+		}
+		id, err := i.importLayer(desc, diffID, parent)
+		if err != nil {
+			return errors.Wrapf(err, "importing layer %q of image %q", desc.Digest, manifestDigest)
+		}
+		parent = id
+	}
+	return nil
+}
+
+// importLayer returns the ID of the layer with the specified diffID on top of
+// parent, after creating it from the blob described by desc if there is
+// none.
+func (i *ociLayoutImporter) importLayer(desc ociDescriptor, diffID digest.Digest, parent string) (string, error) {
+	existing, err := i.store.LayersByUncompressedDigest(diffID)
+	if err != nil && errors.Cause(err) != ErrLayerUnknown {
+		return "", err
+	}
+	for _, layer := range existing {
+		if layer.Parent == parent {
+			return layer.ID, nil
+		}
+	}
+
+	path, err := i.blobPath(desc)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	verifier := desc.Digest.Verifier()
+	size, err := io.Copy(verifier, f)
+	if err != nil {
+		return "", err
+	}
+	if size != desc.Size || !verifier.Verified() {
+		return "", errors.Errorf("blob %q doesn't match its descriptor", desc.Digest)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	var diff io.Reader = f
+	layerBlobDecodersLock.Lock()
+	decoders := layerBlobDecoders
+	layerBlobDecodersLock.Unlock()
+	for _, decoder := range decoders {
+		decoded, err := decoder(f, size, desc.MediaType, desc.Annotations, diffID)
+		if err != nil {
+			return "", err
+		}
+		if decoded != nil {
+			defer decoded.Close()
+			diff = decoded
+			break
+		}
+	}
+
+	layer, _, err := i.store.PutLayer("", parent, nil, "", false, nil, diff)
+	if err != nil {
+		return "", err
+	}
+	if layer.UncompressedDigest != diffID {
+		if err2 := i.store.DeleteLayer(layer.ID); err2 != nil {
+			return "", errors.Wrapf(err2, "deleting layer %q, whose diffID %q is not %q", layer.ID, layer.UncompressedDigest, diffID)
+		}
+		return "", errors.Errorf("the diffID of the layer is %q, not %q", layer.UncompressedDigest, diffID)
+	}
+	i.created = append(i.created, layer.ID)
+	return layer.ID, nil
+}
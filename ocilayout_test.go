@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+// testOCILayout writes an OCI image layout to a temporary directory.
+type testOCILayout struct {
+	t   *testing.T
+	dir string
+}
+
+// testTempDir creates a temporary directory which is removed when the test
+// completes.
+func testTempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "testOCILayout")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	return dir
+}
+
+func newTestOCILayout(t *testing.T) *testOCILayout {
+	dir := testTempDir(t)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, ociLayoutFile), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0755))
+	return &testOCILayout{t: t, dir: dir}
+}
+
+// blob writes a blob, and returns its descriptor.
+func (l *testOCILayout) blob(mediaType string, data []byte) ociDescriptor {
+	d := digest.FromBytes(data)
+	require.NoError(l.t, ioutil.WriteFile(filepath.Join(l.dir, "blobs", "sha256", d.Encoded()), data, 0644))
+	return ociDescriptor{MediaType: mediaType, Digest: d, Size: int64(len(data))}
+}
+
+func (l *testOCILayout) jsonBlob(mediaType string, v interface{}) ociDescriptor {
+	data, err := json.Marshal(v)
+	require.NoError(l.t, err)
+	return l.blob(mediaType, data)
+}
+
+// layer writes a layer blob holding files, compressed with compression,
+// which is one of "", "gzip", and "zstd", and returns its descriptor and its
+// diffID.
+func (l *testOCILayout) layer(files map[string]string, compression string) (ociDescriptor, digest.Digest) {
+	tarball := makeTestLayerTar(l.t, files).Bytes()
+	var blob bytes.Buffer
+	mediaType := "application/vnd.oci.image.layer.v1.tar"
+	switch compression {
+	case "gzip":
+		mediaType += "+gzip"
+		w := gzip.NewWriter(&blob)
+		_, err := w.Write(tarball)
+		require.NoError(l.t, err)
+		require.NoError(l.t, w.Close())
+	case "zstd":
+		mediaType += "+zstd"
+		w, err := zstd.NewWriter(&blob)
+		require.NoError(l.t, err)
+		_, err = w.Write(tarball)
+		require.NoError(l.t, err)
+		require.NoError(l.t, w.Close())
+	default:
+		blob.Write(tarball)
+	}
+	return l.blob(mediaType, blob.Bytes()), digest.FromBytes(tarball)
+}
+
+// image writes the configuration and the manifest of an image, and returns
+// the manifest's descriptor.
+func (l *testOCILayout) image(layers []ociDescriptor, diffIDs []digest.Digest) ociDescriptor {
+	var config ociImageConfig
+	config.RootFS.DiffIDs = diffIDs
+	return l.jsonBlob(ociImageManifestMediaType, ociManifest{
+		MediaType: ociImageManifestMediaType,
+		Config:    l.jsonBlob("application/vnd.oci.image.config.v1+json", config),
+		Layers:    layers,
+	})
+}
+
+func (l *testOCILayout) index(manifests ...ociDescriptor) {
+	data, err := json.Marshal(ociIndex{MediaType: ociImageIndexMediaType, Manifests: manifests})
+	require.NoError(l.t, err)
+	require.NoError(l.t, ioutil.WriteFile(filepath.Join(l.dir, ociLayoutIndexFile), data, 0644))
+}
+
+func TestImportOCILayout(t *testing.T) {
+	store := newTestStore(t)
+	layout := newTestOCILayout(t)
+
+	base, baseDiffID := layout.layer(map[string]string{"base": "base"}, "gzip")
+	amd64, amd64DiffID := layout.layer(map[string]string{"arch": "amd64"}, "zstd")
+	arm64, arm64DiffID := layout.layer(map[string]string{"arch": "arm64"}, "")
+	amd64Image := layout.image([]ociDescriptor{base, amd64}, []digest.Digest{baseDiffID, amd64DiffID})
+	arm64Image := layout.image([]ociDescriptor{base, arm64}, []digest.Digest{baseDiffID, arm64DiffID})
+	// a nested index, with no media type in its descriptor
+	nested := layout.jsonBlob("", ociIndex{Manifests: []ociDescriptor{arm64Image, amd64Image}})
+	layout.index(amd64Image, nested)
+
+	created, err := store.ImportOCILayout(layout.dir)
+	require.NoError(t, err)
+	require.Len(t, created, 3)
+
+	// the base layer is shared by both images
+	for i, diffID := range []digest.Digest{baseDiffID, amd64DiffID, arm64DiffID} {
+		layer, err := store.Layer(created[i])
+		require.NoError(t, err)
+		require.Equal(t, diffID, layer.UncompressedDigest)
+		if i == 0 {
+			require.Empty(t, layer.Parent)
+		} else {
+			require.Equal(t, created[0], layer.Parent)
+		}
+	}
+	layer, err := store.Layer(created[1])
+	require.NoError(t, err)
+	require.Equal(t, amd64.Digest, layer.CompressedDigest)
+
+	// nothing is created twice
+	created, err = store.ImportOCILayout(layout.dir)
+	require.NoError(t, err)
+	require.Empty(t, created)
+	layers, err := store.Layers()
+	require.NoError(t, err)
+	require.Len(t, layers, 3)
+}
+
+func TestImportOCILayoutErrors(t *testing.T) {
+	store := newTestStore(t)
+
+	_, err := store.ImportOCILayout(testTempDir(t))
+	require.Error(t, err, "not a layout")
+
+	// a diffID which doesn't match the layer
+	layout := newTestOCILayout(t)
+	layer, _ := layout.layer(map[string]string{"file": "contents"}, "gzip")
+	layout.index(layout.image([]ociDescriptor{layer}, []digest.Digest{digest.FromString("wrong")}))
+	_, err = store.ImportOCILayout(layout.dir)
+	require.Error(t, err)
+	layers, err := store.Layers()
+	require.NoError(t, err)
+	require.Empty(t, layers)
+
+	// a blob which doesn't match its digest
+	layout = newTestOCILayout(t)
+	layer, diffID := layout.layer(map[string]string{"file": "contents"}, "")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(layout.dir, "blobs", "sha256", layer.Digest.Encoded()), makeTestLayerTar(t, map[string]string{"file": "other"}).Bytes(), 0644))
+	layout.index(layout.image([]ociDescriptor{layer}, []digest.Digest{diffID}))
+	_, err = store.ImportOCILayout(layout.dir)
+	require.Error(t, err)
+
+	// a blob path which escapes the layout
+	layout = newTestOCILayout(t)
+	layout.index(ociDescriptor{MediaType: ociImageManifestMediaType, Digest: "sha256:../../index.json", Size: 1})
+	_, err = store.ImportOCILayout(layout.dir)
+	require.Error(t, err)
+}
@@ -67,6 +67,12 @@ type (
 		CopyPass bool
 		// ForceMask, if set, indicates the permission mask used for created files.
 		ForceMask *os.FileMode
+		// OverlayUserXattr, if set, selects whether the overlay whiteout
+		// format uses user.overlay.* extended attributes, as the kernel
+		// does when overlay is mounted with "userxattr", or
+		// trusted.overlay.* ones.  By default, user.overlay.* extended
+		// attributes are used in rootless mode.
+		OverlayUserXattr *bool
 	}
 )
 
@@ -806,7 +812,7 @@ func TarWithOptions(srcPath string, options *TarOptions) (io.ReadCloser, error)
 			compressWriter,
 			options.ChownOpts,
 		)
-		ta.WhiteoutConverter = GetWhiteoutConverter(options.WhiteoutFormat, options.WhiteoutData)
+		ta.WhiteoutConverter = GetWhiteoutConverterForOptions(options)
 		ta.CopyPass = options.CopyPass
 
 		defer func() {
@@ -966,7 +972,7 @@ func Unpack(decompressedArchive io.Reader, dest string, options *TarOptions) err
 	var dirs []*tar.Header
 	idMappings := idtools.NewIDMappingsFromMaps(options.UIDMaps, options.GIDMaps)
 	rootIDs := idMappings.RootPair()
-	whiteoutConverter := GetWhiteoutConverter(options.WhiteoutFormat, options.WhiteoutData)
+	whiteoutConverter := GetWhiteoutConverterForOptions(options)
 	buffer := make([]byte, 1<<20)
 
 	if options.ForceMask != nil {
@@ -1506,7 +1512,20 @@ func TarPath(uidmap []idtools.IDMap, gidmap []idtools.IDMap) func(path string) (
 // It uses the trusted.overlay prefix when running as root, and user.overlay
 // in rootless mode.
 func GetOverlayXattrName(name string) string {
-	if unshare.IsRootless() {
+	return overlayXattrName(name, unshare.IsRootless())
+}
+
+// GetOverlayXattrNameWithUserXattr is like GetOverlayXattrName, but it lets
+// the caller select whether the user.overlay prefix is used instead of the
+// trusted.overlay one.
+func GetOverlayXattrNameWithUserXattr(name string, userxattr bool) string {
+	return overlayXattrName(name, userxattr)
+}
+
+// overlayXattrName returns the xattr used by the overlay driver with the
+// given name, in the user.overlay namespace if userxattr is set.
+func overlayXattrName(name string, userxattr bool) string {
+	if userxattr {
 		return fmt.Sprintf("user.overlay.%s", name)
 	}
 	return fmt.Sprintf("trusted.overlay.%s", name)
@@ -9,6 +9,7 @@ import (
 
 	"github.com/containers/storage/pkg/idtools"
 	"github.com/containers/storage/pkg/system"
+	"github.com/containers/storage/pkg/unshare"
 	"golang.org/x/sys/unix"
 )
 
@@ -19,15 +20,31 @@ func getOverlayOpaqueXattrName() string {
 func GetWhiteoutConverter(format WhiteoutFormat, data interface{}) TarWhiteoutConverter {
 	if format == OverlayWhiteoutFormat {
 		if rolayers, ok := data.([]string); ok && len(rolayers) > 0 {
-			return overlayWhiteoutConverter{rolayers: rolayers}
+			return overlayWhiteoutConverter{rolayers: rolayers, userxattr: unshare.IsRootless()}
 		}
-		return overlayWhiteoutConverter{rolayers: nil}
+		return overlayWhiteoutConverter{rolayers: nil, userxattr: unshare.IsRootless()}
 	}
 	return nil
 }
 
+// GetWhiteoutConverterForOptions is like GetWhiteoutConverter, but it also
+// honors options.OverlayUserXattr.
+func GetWhiteoutConverterForOptions(options *TarOptions) TarWhiteoutConverter {
+	converter := GetWhiteoutConverter(options.WhiteoutFormat, options.WhiteoutData)
+	if o, ok := converter.(overlayWhiteoutConverter); ok && options.OverlayUserXattr != nil {
+		o.userxattr = *options.OverlayUserXattr
+		return o
+	}
+	return converter
+}
+
 type overlayWhiteoutConverter struct {
-	rolayers []string
+	rolayers  []string
+	userxattr bool
+}
+
+func (o overlayWhiteoutConverter) opaqueXattrName() string {
+	return overlayXattrName("opaque", o.userxattr)
 }
 
 func (o overlayWhiteoutConverter) ConvertWrite(hdr *tar.Header, path string, fi os.FileInfo) (wo *tar.Header, err error) {
@@ -43,13 +60,13 @@ func (o overlayWhiteoutConverter) ConvertWrite(hdr *tar.Header, path string, fi
 
 	if fi.Mode()&os.ModeDir != 0 {
 		// convert opaque dirs to AUFS format by writing an empty file with the whiteout prefix
-		opaque, err := system.Lgetxattr(path, getOverlayOpaqueXattrName())
+		opaque, err := system.Lgetxattr(path, o.opaqueXattrName())
 		if err != nil {
 			return nil, err
 		}
 		if len(opaque) == 1 && opaque[0] == 'y' {
 			if hdr.Xattrs != nil {
-				delete(hdr.Xattrs, getOverlayOpaqueXattrName())
+				delete(hdr.Xattrs, o.opaqueXattrName())
 			}
 			// If there are no lower layers, then it can't have been deleted in this layer.
 			if len(o.rolayers) == 0 {
@@ -112,13 +129,13 @@ func (o overlayWhiteoutConverter) ConvertWrite(hdr *tar.Header, path string, fi
 	return
 }
 
-func (overlayWhiteoutConverter) ConvertReadWithHandler(hdr *tar.Header, path string, handler TarWhiteoutHandler) (bool, error) {
+func (o overlayWhiteoutConverter) ConvertReadWithHandler(hdr *tar.Header, path string, handler TarWhiteoutHandler) (bool, error) {
 	base := filepath.Base(path)
 	dir := filepath.Dir(path)
 
 	// if a directory is marked as opaque by the AUFS special file, we need to translate that to overlay
 	if base == WhiteoutOpaqueDir {
-		err := handler.Setxattr(dir, getOverlayOpaqueXattrName(), []byte{'y'})
+		err := handler.Setxattr(dir, o.opaqueXattrName(), []byte{'y'})
 		// don't write the file itself
 		return false, err
 	}
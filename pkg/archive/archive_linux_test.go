@@ -216,3 +216,72 @@ func TestNestedOverlayWhiteouts(t *testing.T) {
 	require.NoError(t, err)
 	checkFileMode(t, filepath.Join(dst, "foo"), os.ModeDevice|os.ModeCharDevice)
 }
+
+type recordingWhiteoutHandler struct {
+	xattrs map[string]string
+}
+
+func (h *recordingWhiteoutHandler) Setxattr(path, name string, value []byte) error {
+	h.xattrs[path] = name
+	return nil
+}
+
+func (h *recordingWhiteoutHandler) Mknod(path string, mode uint32, dev int) error {
+	return nil
+}
+
+func (h *recordingWhiteoutHandler) Chown(path string, uid, gid int) error {
+	return nil
+}
+
+func TestOverlayWhiteoutXattrNamespace(t *testing.T) {
+	for _, userxattr := range []bool{false, true} {
+		userxattr := userxattr
+		expected, other := "trusted.overlay.opaque", "user.overlay.opaque"
+		if userxattr {
+			expected, other = other, expected
+		}
+		options := &TarOptions{
+			WhiteoutFormat:   OverlayWhiteoutFormat,
+			OverlayUserXattr: &userxattr,
+		}
+
+		// Reading an opaque directory marker sets the xattr in the
+		// selected namespace.
+		handler := &recordingWhiteoutHandler{xattrs: make(map[string]string)}
+		name := filepath.Join("d", WhiteoutOpaqueDir)
+		writeFile, err := GetWhiteoutConverterForOptions(options).ConvertReadWithHandler(&tar.Header{Name: name}, name, handler)
+		require.NoError(t, err)
+		require.False(t, writeFile)
+		require.Equal(t, expected, handler.xattrs["d"])
+
+		// Writing only recognizes opaque directories which are marked
+		// in the selected namespace.
+		lower, err := ioutil.TempDir("", "storage-overlay-lower")
+		require.NoError(t, err)
+		defer os.RemoveAll(lower)
+		src, err := ioutil.TempDir("", "storage-overlay-src")
+		require.NoError(t, err)
+		defer os.RemoveAll(src)
+		require.NoError(t, os.Mkdir(filepath.Join(lower, "d"), 0700))
+		require.NoError(t, os.Mkdir(filepath.Join(src, "d"), 0700))
+		if err := system.Lsetxattr(filepath.Join(src, "d"), other, []byte("y"), 0); err != nil {
+			t.Skipf("Unable to set %s: %v", other, err)
+		}
+		options.WhiteoutData = []string{lower}
+		converter := GetWhiteoutConverterForOptions(options)
+		fi, err := os.Lstat(filepath.Join(src, "d"))
+		require.NoError(t, err)
+		wo, err := converter.ConvertWrite(&tar.Header{Name: "d", Typeflag: tar.TypeDir, Mode: 0700}, filepath.Join(src, "d"), fi)
+		require.NoError(t, err)
+		require.Nil(t, wo, "opaque directory marked with %s recognized", other)
+
+		if err := system.Lsetxattr(filepath.Join(src, "d"), expected, []byte("y"), 0); err != nil {
+			t.Skipf("Unable to set %s: %v", expected, err)
+		}
+		wo, err = converter.ConvertWrite(&tar.Header{Name: "d", Typeflag: tar.TypeDir, Mode: 0700}, filepath.Join(src, "d"), fi)
+		require.NoError(t, err)
+		require.NotNil(t, wo, "opaque directory marked with %s not recognized", expected)
+		require.Equal(t, filepath.Join("d", WhiteoutOpaqueDir), wo.Name)
+	}
+}
@@ -6,6 +6,10 @@ func GetWhiteoutConverter(format WhiteoutFormat, data interface{}) TarWhiteoutCo
 	return nil
 }
 
+func GetWhiteoutConverterForOptions(options *TarOptions) TarWhiteoutConverter {
+	return GetWhiteoutConverter(options.WhiteoutFormat, options.WhiteoutData)
+}
+
 func GetFileOwner(path string) (uint32, uint32, uint32, error) {
 	return 0, 0, 0, nil
 }
@@ -13,6 +13,7 @@ import (
 
 	"github.com/containers/storage/pkg/idtools"
 	"github.com/containers/storage/pkg/system"
+	"github.com/containers/storage/pkg/unshare"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
 )
@@ -315,8 +316,15 @@ func parseDirent(buf []byte, names []nameIno) (consumed int, newnames []nameIno)
 // OverlayChanges walks the path rw and determines changes for the files in the path,
 // with respect to the parent layers
 func OverlayChanges(layers []string, rw string) ([]Change, error) {
+	return OverlayChangesWithUserXattr(layers, rw, unshare.IsRootless())
+}
+
+// OverlayChangesWithUserXattr is like OverlayChanges, but it lets the caller
+// select whether opaque directories are marked with user.overlay.* extended
+// attributes or with trusted.overlay.* ones.
+func OverlayChangesWithUserXattr(layers []string, rw string, userxattr bool) ([]Change, error) {
 	dc := func(root, path string, fi os.FileInfo) (string, error) {
-		return overlayDeletedFile(layers, root, path, fi)
+		return overlayDeletedFile(layers, root, path, fi, userxattr)
 	}
 	return changes(layers, rw, dc, nil, overlayLowerContainsWhiteout)
 }
@@ -337,7 +345,7 @@ func overlayLowerContainsWhiteout(root, path string) (bool, error) {
 	return false, nil
 }
 
-func overlayDeletedFile(layers []string, root, path string, fi os.FileInfo) (string, error) {
+func overlayDeletedFile(layers []string, root, path string, fi os.FileInfo, userxattr bool) (string, error) {
 	// If it's a whiteout item, then a file or directory with that name is removed by this layer.
 	if fi.Mode()&os.ModeCharDevice != 0 {
 		if isWhiteOut(fi) {
@@ -349,7 +357,7 @@ func overlayDeletedFile(layers []string, root, path string, fi os.FileInfo) (str
 		return "", nil
 	}
 	// If the directory isn't marked as opaque, then it's just a normal directory.
-	opaque, err := system.Lgetxattr(filepath.Join(root, path), getOverlayOpaqueXattrName())
+	opaque, err := system.Lgetxattr(filepath.Join(root, path), overlayXattrName("opaque", userxattr))
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,223 @@
+package archive
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containers/storage/pkg/idtools"
+)
+
+// NormalizeTarOptions controls how NormalizeTar rewrites an archive.
+type NormalizeTarOptions struct {
+	// ClampTime, if not zero, is the latest modification time which is
+	// kept.  Later modification times are replaced with it.
+	ClampTime time.Time
+	// Owner, if set, is the owner of every entry in the normalized
+	// archive.  If nil, every entry is owned by 0:0.
+	Owner *idtools.IDPair
+}
+
+// volatileXattrPrefixes lists the extended attributes which describe the host
+// the archive was created on, or how it was stored there, rather than the
+// files themselves.
+var volatileXattrPrefixes = []string{
+	"security.selinux",
+	"security.ima",
+	"security.evm",
+	"trusted.overlay.",
+	"user.overlay.",
+	containersOverrideXattr,
+}
+
+func isVolatileXattr(name string) bool {
+	for _, prefix := range volatileXattrPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeTarName cleans name, removing any leading "/" or "./", and adds a
+// trailing "/" to the names of directories.
+func normalizeTarName(name string, isDir bool) string {
+	name = strings.TrimLeft(path.Clean("/"+name), "/")
+	if name == "" {
+		name = "."
+	}
+	if isDir {
+		name += "/"
+	}
+	return name
+}
+
+// normalizeTarHeader returns a copy of hdr which only retains the fields
+// which describe the entry itself.
+func normalizeTarHeader(hdr *tar.Header, options *NormalizeTarOptions) *tar.Header {
+	uid, gid := 0, 0
+	if options.Owner != nil {
+		uid, gid = options.Owner.UID, options.Owner.GID
+	}
+	modTime := hdr.ModTime.Truncate(time.Second)
+	if !options.ClampTime.IsZero() && modTime.After(options.ClampTime) {
+		modTime = options.ClampTime.Truncate(time.Second)
+	}
+	normalized := &tar.Header{
+		Typeflag: hdr.Typeflag,
+		Name:     normalizeTarName(hdr.Name, hdr.Typeflag == tar.TypeDir),
+		Mode:     hdr.Mode & 07777,
+		Uid:      uid,
+		Gid:      gid,
+		Size:     hdr.Size,
+		ModTime:  modTime.UTC(),
+		Format:   tar.FormatPAX,
+	}
+	switch hdr.Typeflag {
+	case tar.TypeLink:
+		normalized.Linkname = normalizeTarName(hdr.Linkname, false)
+	case tar.TypeSymlink:
+		normalized.Linkname = hdr.Linkname
+	case tar.TypeChar, tar.TypeBlock:
+		normalized.Devmajor = hdr.Devmajor
+		normalized.Devminor = hdr.Devminor
+	case tar.TypeReg, tar.TypeRegA:
+		normalized.Typeflag = tar.TypeReg
+	}
+	if normalized.Typeflag != tar.TypeReg {
+		normalized.Size = 0
+	}
+	for key, value := range hdr.PAXRecords {
+		if !strings.HasPrefix(key, "SCHILY.xattr.") || isVolatileXattr(strings.TrimPrefix(key, "SCHILY.xattr.")) {
+			continue
+		}
+		if normalized.PAXRecords == nil {
+			normalized.PAXRecords = make(map[string]string)
+		}
+		normalized.PAXRecords[key] = value
+	}
+	return normalized
+}
+
+// NormalizeTar reads the tar archive from in and returns a stream with an
+// equivalent archive which doesn't depend on the order the entries were
+// added in or on the host it was created on, so that the same contents
+// always produce the same archive:
+//   - entries are sorted by name, with hard links after all other entries,
+//     and after the hard links they point to, and only the last entry with a
+//     given name is kept;
+//   - user and group names, access and change times, and device numbers of
+//     anything other than device nodes are dropped;
+//   - modification times are truncated to seconds, and clamped to
+//     options.ClampTime;
+//   - every entry is owned by options.Owner, or by 0:0;
+//   - extended attributes which are specific to the host, such as SELinux
+//     labels, are dropped.
+//
+// The whole archive is read before the result is written.  The headers are
+// kept in memory, and the contents of the files in a temporary file.
+func NormalizeTar(in io.Reader, options *NormalizeTarOptions) io.ReadCloser {
+	if options == nil {
+		options = &NormalizeTarOptions{}
+	}
+	pipeReader, pipeWriter := io.Pipe()
+
+	go func() {
+		pipeWriter.CloseWithError(normalizeTar(in, pipeWriter, options))
+	}()
+	return pipeReader
+}
+
+// normalizeTarEntry is an entry of an archive read by NormalizeTar, whose
+// contents are at offset in the spool file.
+type normalizeTarEntry struct {
+	hdr    *tar.Header
+	offset int64
+}
+
+func normalizeTar(in io.Reader, out io.Writer, options *NormalizeTarOptions) error {
+	spool, err := ioutil.TempFile("", "normalize-tar")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}()
+
+	entries := make(map[string]normalizeTarEntry)
+	var spooled int64
+	tarReader := tar.NewReader(in)
+	for {
+		hdr, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		normalized := normalizeTarHeader(hdr, options)
+		offset := spooled
+		if normalized.Typeflag == tar.TypeReg {
+			n, err := io.Copy(spool, tarReader)
+			if err != nil {
+				return err
+			}
+			spooled += n
+		}
+		// Later entries replace earlier ones when extracted, and a
+		// directory and a file with the same name are one entry.
+		name := strings.TrimSuffix(normalized.Name, "/")
+		entries[name] = normalizeTarEntry{hdr: normalized, offset: offset}
+	}
+
+	var names, links []string
+	for name, e := range entries {
+		if e.hdr.Typeflag == tar.TypeLink {
+			links = append(links, name)
+		} else {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	sort.Strings(links)
+	// Hard links are written after everything else, so that their
+	// targets are always extracted first, and a hard link which points
+	// to another one is written after it.  A cycle of hard links is
+	// broken wherever it is entered.
+	added := make(map[string]bool, len(links))
+	var addLink func(name string)
+	addLink = func(name string) {
+		if added[name] {
+			return
+		}
+		added[name] = true
+		linkname := entries[name].hdr.Linkname
+		if target, ok := entries[linkname]; ok && target.hdr.Typeflag == tar.TypeLink {
+			addLink(linkname)
+		}
+		names = append(names, name)
+	}
+	for _, name := range links {
+		addLink(name)
+	}
+
+	tarWriter := tar.NewWriter(out)
+	for _, name := range names {
+		e := entries[name]
+		if err := tarWriter.WriteHeader(e.hdr); err != nil {
+			return err
+		}
+		if e.hdr.Size > 0 {
+			if _, err := io.Copy(tarWriter, io.NewSectionReader(spool, e.offset, e.hdr.Size)); err != nil {
+				return err
+			}
+		}
+	}
+	return tarWriter.Close()
+}
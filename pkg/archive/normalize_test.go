@@ -0,0 +1,138 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containers/storage/pkg/idtools"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type normalizeTestEntry struct {
+	hdr     tar.Header
+	content string
+}
+
+func makeNormalizeTestTar(t *testing.T, entries []normalizeTestEntry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := e.hdr
+		hdr.Size = int64(len(e.content))
+		require.NoError(t, tw.WriteHeader(&hdr))
+		_, err := tw.Write([]byte(e.content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func normalizeTestTar(t *testing.T, tarball []byte, options *NormalizeTarOptions) []byte {
+	rc := NormalizeTar(bytes.NewReader(tarball), options)
+	defer rc.Close()
+	normalized, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	return normalized
+}
+
+func TestNormalizeTarEquivalentArchives(t *testing.T) {
+	now := time.Now()
+	epoch := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	first := makeNormalizeTestTar(t, []normalizeTestEntry{
+		{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "dir/", Mode: 0755, ModTime: epoch}},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "dir/file", Mode: 0644, ModTime: now, Uid: 1000, Gid: 1000, Uname: "user", Gname: "user",
+			PAXRecords: map[string]string{"SCHILY.xattr.security.selinux": "system_u:object_r:container_file_t:s0", "SCHILY.xattr.user.keep": "yes"}}, content: "hello"},
+		{hdr: tar.Header{Typeflag: tar.TypeLink, Name: "a-link", Linkname: "dir/file", ModTime: epoch}},
+		{hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: "symlink", Linkname: "dir/file", ModTime: epoch, AccessTime: now, ChangeTime: now}},
+	})
+	second := makeNormalizeTestTar(t, []normalizeTestEntry{
+		{hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: "./symlink", Linkname: "dir/file", ModTime: epoch}},
+		{hdr: tar.Header{Typeflag: tar.TypeLink, Name: "/a-link", Linkname: "./dir/file", ModTime: epoch.Add(100 * time.Millisecond)}},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "dir/file", Mode: 0644, ModTime: now.Add(time.Hour), Uid: 0, Gid: 0,
+			PAXRecords: map[string]string{"SCHILY.xattr.user.keep": "yes"}}, content: "hello"},
+		{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "./dir", Mode: 0755, ModTime: epoch}},
+	})
+
+	options := &NormalizeTarOptions{ClampTime: epoch}
+	assert.Equal(t, normalizeTestTar(t, first, options), normalizeTestTar(t, second, options))
+
+	tr := tar.NewReader(bytes.NewReader(normalizeTestTar(t, first, options)))
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, hdr.Name)
+		assert.Equal(t, 0, hdr.Uid)
+		assert.Equal(t, "", hdr.Uname)
+		assert.True(t, hdr.ModTime.Equal(epoch), "%s has modification time %v", hdr.Name, hdr.ModTime)
+		assert.True(t, hdr.AccessTime.IsZero())
+		if hdr.Name == "dir/file" {
+			assert.Equal(t, map[string]string{"user.keep": "yes"}, hdr.Xattrs)
+		}
+	}
+	// hard links come last
+	assert.Equal(t, []string{"dir/", "dir/file", "symlink", "a-link"}, names)
+}
+
+func TestNormalizeTarOwner(t *testing.T) {
+	tarball := makeNormalizeTestTar(t, []normalizeTestEntry{
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "file", Mode: 0600, Uid: 1000, Gid: 100}, content: "data"},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "file", Mode: 0644, Uid: 1000, Gid: 100}, content: "replaced"},
+	})
+	normalized := normalizeTestTar(t, tarball, &NormalizeTarOptions{Owner: &idtools.IDPair{UID: 42, GID: 43}})
+
+	tr := tar.NewReader(bytes.NewReader(normalized))
+	hdr, err := tr.Next()
+	require.NoError(t, err)
+	assert.Equal(t, 42, hdr.Uid)
+	assert.Equal(t, 43, hdr.Gid)
+	assert.Equal(t, int64(0644), hdr.Mode)
+	content, err := ioutil.ReadAll(tr)
+	require.NoError(t, err)
+	assert.Equal(t, "replaced", string(content))
+	_, err = tr.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestNormalizeTarLinkOrder(t *testing.T) {
+	tarball := makeNormalizeTestTar(t, []normalizeTestEntry{
+		{hdr: tar.Header{Typeflag: tar.TypeLink, Name: "a-link", Linkname: "z-link"}},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "file", Mode: 0644}, content: strings.Repeat("contents", 1000)},
+		{hdr: tar.Header{Typeflag: tar.TypeLink, Name: "z-link", Linkname: "file"}},
+		{hdr: tar.Header{Typeflag: tar.TypeLink, Name: "b-link", Linkname: "file"}},
+	})
+
+	tr := tar.NewReader(bytes.NewReader(normalizeTestTar(t, tarball, nil)))
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, hdr.Name)
+		if hdr.Name == "file" {
+			content, err := ioutil.ReadAll(tr)
+			require.NoError(t, err)
+			assert.Equal(t, strings.Repeat("contents", 1000), string(content))
+		}
+	}
+	// a hard link comes after the hard link it points to
+	assert.Equal(t, []string{"file", "z-link", "a-link", "b-link"}, names)
+}
+
+func TestNormalizeTarInvalidInput(t *testing.T) {
+	rc := NormalizeTar(bytes.NewReader([]byte("not a tarball, but long enough to look like a broken header")), nil)
+	defer rc.Close()
+	_, err := ioutil.ReadAll(rc)
+	assert.Error(t, err)
+}
@@ -0,0 +1,153 @@
+package chunked
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+
+	"github.com/containers/storage/pkg/chunked/compressor"
+)
+
+// ChunkParams controls how the contents of regular files are split into
+// chunks when a zstd:chunked blob is created.
+type ChunkParams = compressor.ChunkParams
+
+// ChunkStats describes the chunks which a set of ChunkParams produces for a
+// sample tarball.
+type ChunkStats struct {
+	// Params are the parameters which were measured.
+	Params ChunkParams
+	// Chunks is the number of chunks, and DistinctChunks is the number of
+	// chunks with different contents.
+	Chunks         int
+	DistinctChunks int
+	// MinChunkSize, MaxChunkSize, and MeanChunkSize describe the sizes of
+	// the chunks before they are compressed.
+	MinChunkSize  int64
+	MaxChunkSize  int64
+	MeanChunkSize int64
+	// CompressedSize is the total size of the compressed chunks, and
+	// DistinctCompressedSize is the same, counting the chunks with the
+	// same contents only once.
+	CompressedSize         int64
+	DistinctCompressedSize int64
+	// BlobSize is the size of the whole blob, including the tar headers
+	// and the manifest.
+	BlobSize int64
+}
+
+// chunkRequestOverhead is an estimate, in bytes, of what retrieving one more
+// chunk costs: its entry in the manifest, and its share of a range request.
+const chunkRequestOverhead = 512
+
+// autoTuneCandidates are the parameters which AutoTune compares, from the
+// largest chunks to the smallest.
+var autoTuneCandidates = func() []ChunkParams {
+	var candidates []ChunkParams
+	for bits := uint32(18); bits >= 12; bits -= 2 {
+		candidates = append(candidates, ChunkParams{
+			RollsumBits: bits,
+			MinSize:     1 << (bits - 2),
+			MaxSize:     1 << (bits + 2),
+		})
+	}
+	return candidates
+}()
+
+// MeasureChunkParams creates a zstd:chunked blob from sampleTar, with its
+// files split into chunks according to params, and returns statistics about
+// the chunks.
+func MeasureChunkParams(sampleTar io.Reader, params ChunkParams) (*ChunkStats, error) {
+	var blob bytes.Buffer
+	w, err := compressor.ZstdCompressorWithOptions(&blob, make(map[string]string), &compressor.Options{Chunking: &params})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(w, sampleTar); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	toc, _, err := readZstdChunkedTOC(bytes.NewReader(blob.Bytes()), int64(blob.Len()))
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &ChunkStats{Params: params, BlobSize: int64(blob.Len())}
+	seen := make(map[string]bool)
+	var totalSize int64
+	var file *FileMetadata
+	for i := range toc.Entries {
+		e := &toc.Entries[i]
+		switch e.Type {
+		case TypeReg:
+			file = e
+		case TypeChunk:
+			if file == nil {
+				continue
+			}
+		default:
+			file = nil
+			continue
+		}
+		if file.Digest == "" {
+			// no payload
+			continue
+		}
+		// ChunkSize is 0 for the last chunk
+		size := e.ChunkSize
+		if size == 0 {
+			size = file.Size - e.ChunkOffset
+		}
+		compressedSize := e.EndOffset - e.Offset
+
+		if stats.Chunks == 0 || size < stats.MinChunkSize {
+			stats.MinChunkSize = size
+		}
+		if size > stats.MaxChunkSize {
+			stats.MaxChunkSize = size
+		}
+		stats.Chunks++
+		totalSize += size
+		stats.CompressedSize += compressedSize
+		if !seen[e.ChunkDigest] {
+			seen[e.ChunkDigest] = true
+			stats.DistinctChunks++
+			stats.DistinctCompressedSize += compressedSize
+		}
+	}
+	if stats.Chunks > 0 {
+		stats.MeanChunkSize = totalSize / int64(stats.Chunks)
+	}
+	return stats, nil
+}
+
+// AutoTune compresses the sample tarball read from sampleTar with a few sets
+// of chunk parameters, and returns the one for which retrieving the distinct
+// chunks is expected to cost the least, counting both their compressed size
+// and an estimate of the overhead of each chunk.  Smaller chunks find more
+// contents which are repeated, but each of them costs more.  The whole
+// sample is kept in memory, so it should be representative rather than
+// large.  This is meant for analysis, not for use while compressing layers.
+func AutoTune(sampleTar io.Reader) (ChunkParams, error) {
+	sample, err := ioutil.ReadAll(sampleTar)
+	if err != nil {
+		return ChunkParams{}, err
+	}
+	var best ChunkParams
+	var bestCost int64 = -1
+	for _, candidate := range autoTuneCandidates {
+		stats, err := MeasureChunkParams(bytes.NewReader(sample), candidate)
+		if err != nil {
+			return ChunkParams{}, err
+		}
+		cost := stats.DistinctCompressedSize + int64(stats.DistinctChunks)*chunkRequestOverhead
+		// on ties, prefer larger chunks
+		if bestCost < 0 || cost < bestCost {
+			best, bestCost = candidate, cost
+		}
+	}
+	return best, nil
+}
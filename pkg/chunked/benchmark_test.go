@@ -0,0 +1,261 @@
+package chunked
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/containers/storage/pkg/chunked/compressor"
+	"github.com/containers/storage/pkg/chunked/internal"
+	"github.com/klauspost/compress/zstd"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// benchLayer is a synthetic layer used by the benchmarks, generated from a
+// fixed seed so that the results can be compared between runs.
+type benchLayer struct {
+	name     string
+	generate func(r *rand.Rand, tw *tar.Writer) error
+}
+
+var benchLayers = []benchLayer{
+	{
+		// a typical distribution layer, made of many small text files
+		name: "many-small-files",
+		generate: func(r *rand.Rand, tw *tar.Writer) error {
+			words := []string{"lorem", "ipsum", "dolor", "sit", "amet", "func", "return", "if", "else", "for", "\n", "\t", "{", "}"}
+			for i := 0; i < 2000; i++ {
+				var contents bytes.Buffer
+				for size := 512 + r.Intn(4096); contents.Len() < size; {
+					contents.WriteString(words[r.Intn(len(words))])
+					contents.WriteByte(' ')
+				}
+				if err := writeBenchFile(tw, fmt.Sprintf("usr/share/doc/pkg%d/file%d", i/20, i), contents.Bytes()); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		// a few big binaries, which compress moderately well
+		name: "few-large-files",
+		generate: func(r *rand.Rand, tw *tar.Writer) error {
+			for i := 0; i < 4; i++ {
+				contents := make([]byte, 4<<20)
+				for j := 0; j < len(contents); j += 64 {
+					if r.Intn(2) == 0 {
+						r.Read(contents[j : j+64])
+					} else {
+						copy(contents[j:j+64], contents[r.Intn(j+1)&^63:])
+					}
+				}
+				if err := writeBenchFile(tw, fmt.Sprintf("usr/lib/lib%d.so", i), contents); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		// a disk image which is mostly zeros
+		name: "sparse-vm-image",
+		generate: func(r *rand.Rand, tw *tar.Writer) error {
+			contents := make([]byte, 16<<20)
+			for i := 0; i < 64; i++ {
+				offset := r.Intn(len(contents) - 16<<10)
+				r.Read(contents[offset : offset+16<<10])
+			}
+			return writeBenchFile(tw, "var/lib/images/disk.img", contents)
+		},
+	},
+	{
+		// media files, which are already compressed
+		name: "compressed-media",
+		generate: func(r *rand.Rand, tw *tar.Writer) error {
+			for i := 0; i < 8; i++ {
+				contents := make([]byte, 512<<10)
+				r.Read(contents)
+				if err := writeBenchFile(tw, fmt.Sprintf("srv/media/video%d.mp4", i), contents); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+}
+
+func writeBenchFile(tw *tar.Writer, name string, contents []byte) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(contents)),
+	}); err != nil {
+		return err
+	}
+	_, err := tw.Write(contents)
+	return err
+}
+
+// benchInput is a benchLayer's tarball, and the blobs created from it.
+type benchInput struct {
+	tarball     []byte
+	chunked     []byte
+	annotations map[string]string
+	plain       []byte
+}
+
+var (
+	benchInputsLock sync.Mutex
+	benchInputs     = make(map[string]*benchInput)
+)
+
+// getBenchInput returns the input generated for layer, generating it the
+// first time.
+func getBenchInput(b *testing.B, layer benchLayer) *benchInput {
+	benchInputsLock.Lock()
+	defer benchInputsLock.Unlock()
+	if input, found := benchInputs[layer.name]; found {
+		return input
+	}
+	var tarball bytes.Buffer
+	tw := tar.NewWriter(&tarball)
+	if err := layer.generate(rand.New(rand.NewSource(1)), tw); err != nil {
+		b.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		b.Fatal(err)
+	}
+	input := &benchInput{tarball: tarball.Bytes()}
+	var err error
+	if input.chunked, input.annotations, err = compressChunked(input.tarball); err != nil {
+		b.Fatal(err)
+	}
+	if input.plain, err = compressPlain(input.tarball); err != nil {
+		b.Fatal(err)
+	}
+	benchInputs[layer.name] = input
+	return input
+}
+
+func compressChunked(tarball []byte) ([]byte, map[string]string, error) {
+	var blob bytes.Buffer
+	annotations := make(map[string]string)
+	w, err := compressor.ZstdCompressorWithOptions(&blob, annotations, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := w.Write(tarball); err != nil {
+		w.Close()
+		return nil, nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, nil, err
+	}
+	return blob.Bytes(), annotations, nil
+}
+
+// compressPlain compresses tarball as a single zstd stream, with the same
+// level as the chunked compressor's default.
+func compressPlain(tarball []byte) ([]byte, error) {
+	var blob bytes.Buffer
+	w, err := internal.ZstdWriterWithLevel(&blob, 3)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(tarball); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return blob.Bytes(), nil
+}
+
+// reportSizes reports the size of blob, and of the manifest described by
+// annotations if there is one, relative to the size of the tarball.
+func reportSizes(b *testing.B, input *benchInput, blob []byte, annotations map[string]string) {
+	b.ReportMetric(float64(len(blob)), "blob-bytes")
+	b.ReportMetric(float64(len(blob))/float64(len(input.tarball)), "ratio")
+	if position := annotations[internal.ManifestInfoKey]; position != "" {
+		var offset, length, lengthUncompressed, manifestType uint64
+		if _, err := fmt.Sscanf(position, "%d:%d:%d:%d", &offset, &length, &lengthUncompressed, &manifestType); err != nil {
+			b.Fatal(err)
+		}
+		b.ReportMetric(float64(length), "manifest-bytes")
+	}
+}
+
+// BenchmarkCompression measures the time needed to create zstd:chunked and
+// plain zstd blobs from the synthetic layers, and the size of the results.
+func BenchmarkCompression(b *testing.B) {
+	for _, layer := range benchLayers {
+		layer := layer
+		b.Run(layer.name+"/chunked", func(b *testing.B) {
+			input := getBenchInput(b, layer)
+			b.SetBytes(int64(len(input.tarball)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := compressChunked(input.tarball); err != nil {
+					b.Fatal(err)
+				}
+			}
+			reportSizes(b, input, input.chunked, input.annotations)
+		})
+		b.Run(layer.name+"/zstd", func(b *testing.B) {
+			input := getBenchInput(b, layer)
+			b.SetBytes(int64(len(input.tarball)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := compressPlain(input.tarball); err != nil {
+					b.Fatal(err)
+				}
+			}
+			reportSizes(b, input, input.plain, nil)
+		})
+	}
+}
+
+// BenchmarkReconstruction measures the time needed to get the tarball back
+// from zstd:chunked blobs, verifying the digests in the manifest, and from
+// plain zstd blobs.
+func BenchmarkReconstruction(b *testing.B) {
+	for _, layer := range benchLayers {
+		layer := layer
+		b.Run(layer.name+"/chunked", func(b *testing.B) {
+			input := getBenchInput(b, layer)
+			diffID := digest.FromBytes(input.tarball)
+			b.SetBytes(int64(len(input.tarball)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := ReconstructTar(bytes.NewReader(input.chunked), int64(len(input.chunked)), diffID, ioutil.Discard); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(layer.name+"/zstd", func(b *testing.B) {
+			input := getBenchInput(b, layer)
+			b.SetBytes(int64(len(input.tarball)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				decoder, err := zstd.NewReader(bytes.NewReader(input.plain))
+				if err != nil {
+					b.Fatal(err)
+				}
+				digester := digest.Canonical.Digester()
+				_, err = io.Copy(digester.Hash(), decoder)
+				decoder.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
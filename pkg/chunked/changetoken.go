@@ -0,0 +1,38 @@
+package chunked
+
+import (
+	"github.com/containers/storage/pkg/chunked/internal"
+)
+
+// ChangeToken returns the token which the compressor's ChangeTokens option
+// records in the ChangeToken field of the manifest entry of a file, computed
+// from the other fields of entry.  It can be computed for the files of a
+// source tree to compare them with the entries of a manifest.
+func ChangeToken(entry *FileMetadata) string {
+	return internal.ChangeToken(entry)
+}
+
+// ChangedFiles compares the change tokens of the entries of two manifests,
+// and returns the names of the entries of newer which may differ from the
+// ones of older, in the order in which they are in newer: the entries with no
+// entry of the same name in older, the ones whose change token differs from
+// its, and the ones which don't have a change token in either manifest.  The
+// entries of the chunks of files are skipped.
+func ChangedFiles(older, newer []FileMetadata) []string {
+	tokens := make(map[string]string, len(older))
+	for _, e := range older {
+		if e.Type != TypeChunk {
+			tokens[e.Name] = e.ChangeToken
+		}
+	}
+	var changed []string
+	for _, e := range newer {
+		if e.Type == TypeChunk {
+			continue
+		}
+		if token, found := tokens[e.Name]; !found || token == "" || token != e.ChangeToken {
+			changed = append(changed, e.Name)
+		}
+	}
+	return changed
+}
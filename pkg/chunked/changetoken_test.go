@@ -0,0 +1,80 @@
+// +build linux
+
+package chunked
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/containers/storage/pkg/chunked/compressor"
+)
+
+func TestChangeTokens(t *testing.T) {
+	modTime := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	params := &compressor.ChunkParams{RollsumBits: 12, MinSize: 1024, MaxSize: 16384}
+	options := &compressor.Options{Chunking: params, ChangeTokens: true}
+	scan := func(files []testFile, options *compressor.Options) []FileMetadata {
+		entries, err := ScanTarMetadata(bytes.NewReader(makeTestTar(t, files)), options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return entries
+	}
+
+	files := []testFile{
+		{name: "a", contents: "a", modTime: modTime},
+		{name: "b", contents: "bbb", modTime: modTime},
+		{name: "chunked", contents: randomContents(1, 100000), modTime: modTime},
+	}
+	older := scan(files, options)
+	chunks := 0
+	for _, e := range older {
+		if e.Type == TypeChunk {
+			chunks++
+			if e.ChangeToken != "" {
+				t.Fatalf("Change token recorded for a chunk of %q", e.Name)
+			}
+			continue
+		}
+		if e.ChangeToken == "" || e.ChangeToken != ChangeToken(&e) {
+			t.Fatalf("Wrong change token %q for %q", e.ChangeToken, e.Name)
+		}
+	}
+	if chunks == 0 {
+		t.Fatal("No chunks in the manifest")
+	}
+	if changed := ChangedFiles(older, older); len(changed) != 0 {
+		t.Fatalf("Unchanged files reported as changed: %v", changed)
+	}
+
+	// the contents aren't looked at, only the size and the times are
+	newer := scan([]testFile{
+		{name: "a", contents: "A", modTime: modTime},
+		{name: "b", contents: "bbbb", modTime: modTime},
+		{name: "chunked", contents: randomContents(1, 100000), modTime: modTime.Add(time.Second)},
+		{name: "new", contents: "new", modTime: modTime},
+	}, options)
+	if changed := ChangedFiles(older, newer); !reflect.DeepEqual(changed, []string{"b", "chunked", "new"}) {
+		t.Fatalf("Wrong changed files %v", changed)
+	}
+
+	// files without tokens are always changed
+	withoutTokens := scan(files, &compressor.Options{Chunking: params})
+	if changed := ChangedFiles(withoutTokens, withoutTokens); !reflect.DeepEqual(changed, []string{"a", "b", "chunked"}) {
+		t.Fatalf("Wrong changed files without tokens %v", changed)
+	}
+
+	// the tokens survive the manifest, and can be computed from it again
+	blob, annotations := makeZstdChunkedBlob(t, files, options)
+	toc := readTestTOC(t, blob, annotations)
+	if changed := ChangedFiles(older, toc.Entries); len(changed) != 0 {
+		t.Fatalf("Files reported as changed after reading the manifest: %v", changed)
+	}
+	for _, e := range toc.Entries {
+		if e.Type != TypeChunk && e.ChangeToken != ChangeToken(&e) {
+			t.Fatalf("Change token of %q not computed from the manifest", e.Name)
+		}
+	}
+}
@@ -4,8 +4,10 @@ import (
 	archivetar "archive/tar"
 	"bytes"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"strconv"
 
 	"github.com/containerd/stargz-snapshotter/estargz"
@@ -29,6 +31,21 @@ const (
 	TypeSymlink = internal.TypeSymlink
 )
 
+// The classes of contents recorded in FileMetadata.ContentClass when the
+// compressor's ContentClasses option is set.
+const (
+	ContentClassText       = internal.ContentClassText
+	ContentClassBinary     = internal.ContentClassBinary
+	ContentClassCompressed = internal.ContentClassCompressed
+	ContentClassImage      = internal.ContentClassImage
+)
+
+// MaxManifestSize is the limit for the size of the manifests which are read,
+// both compressed and uncompressed, as declared in the blob and once
+// decompressed.  Programs which need to read bigger manifests can raise it,
+// but manifests bigger than its default value are never written.
+var MaxManifestSize uint64 = internal.DefaultMaxManifestSize
+
 var typesToTar = map[string]byte{
 	TypeReg:     tar.TypeReg,
 	TypeLink:    tar.TypeLink,
@@ -48,10 +65,16 @@ func typeToTarType(t string) (byte, error) {
 }
 
 func isZstdChunkedFrameMagic(data []byte) bool {
-	if len(data) < 8 {
-		return false
-	}
-	return bytes.Equal(internal.ZstdChunkedFrameMagic, data[:8])
+	return internal.IsFrameMagic(data)
+}
+
+// RegisterFrameMagic makes blobs which use magic, an 8 bytes value, as the
+// magic number in their footer be recognized as zstd:chunked blobs.  It is
+// meant to be used by variants of the format which set
+// compressor.Options.FrameMagic, and panics if magic is not valid or is
+// already known.
+func RegisterFrameMagic(magic []byte) {
+	internal.RegisterFrameMagic(magic)
 }
 
 func readEstargzChunkedManifest(blobStream ImageSourceSeekable, blobSize int64, annotations map[string]string) ([]byte, int64, error) {
@@ -97,7 +120,7 @@ func readEstargzChunkedManifest(blobStream ImageSourceSeekable, blobSize int64,
 
 	size := int64(blobSize - footerSize - tocOffset)
 	// set a reasonable limit
-	if size > (1<<20)*50 {
+	if size > int64(MaxManifestSize) {
 		return nil, 0, errors.New("manifest too big")
 	}
 
@@ -132,7 +155,7 @@ func readEstargzChunkedManifest(blobStream ImageSourceSeekable, blobSize int64,
 		return nil, 0, err
 	}
 	// set a reasonable limit
-	if header.Size > (1<<20)*50 {
+	if header.Size > int64(MaxManifestSize) {
 		return nil, 0, errors.New("manifest too big")
 	}
 
@@ -174,6 +197,12 @@ func readZstdChunkedManifest(blobStream ImageSourceSeekable, blobSize int64, ann
 
 	var offset, length, lengthUncompressed, manifestType uint64
 
+	if magic := annotations[internal.ManifestFrameMagicKey]; magic != "" {
+		if m, err := hex.DecodeString(magic); err != nil || !isZstdChunkedFrameMagic(m) {
+			return nil, 0, fmt.Errorf("unknown frame magic %q", magic)
+		}
+	}
+
 	if offsetMetadata := annotations[internal.ManifestInfoKey]; offsetMetadata != "" {
 		if _, err := fmt.Sscanf(offsetMetadata, "%d:%d:%d:%d", &offset, &length, &lengthUncompressed, &manifestType); err != nil {
 			return nil, 0, err
@@ -208,15 +237,12 @@ func readZstdChunkedManifest(blobStream ImageSourceSeekable, blobSize int64, ann
 		}
 	}
 
-	if manifestType != internal.ManifestTypeCRFS {
+	if !internal.IsManifestType(manifestType) {
 		return nil, 0, errors.New("invalid manifest type")
 	}
 
 	// set a reasonable limit
-	if length > (1<<20)*50 {
-		return nil, 0, errors.New("manifest too big")
-	}
-	if lengthUncompressed > (1<<20)*50 {
+	if length > MaxManifestSize {
 		return nil, 0, errors.New("manifest too big")
 	}
 
@@ -256,18 +282,166 @@ func readZstdChunkedManifest(blobStream ImageSourceSeekable, blobSize int64, ann
 		return nil, 0, errors.New("invalid manifest checksum")
 	}
 
-	decoder, err := zstd.NewReader(nil)
+	decoded, err := internal.DecompressManifest(manifest, lengthUncompressed, MaxManifestSize, manifestType)
 	if err != nil {
 		return nil, 0, err
 	}
+	return decoded, int64(offset), nil
+}
+
+// readTarSplit retrieves from blobStream the tar-split metadata which toc
+// points to, checks it against its digest and returns it decompressed, or
+// nil if the blob has none.
+func readTarSplit(blobStream ImageSourceSeekable, toc *internal.TOC) ([]byte, error) {
+	if toc.TarSplitLength == 0 {
+		return nil, nil
+	}
+	if toc.TarSplitOffset <= 0 || toc.TarSplitLength < 0 || toc.TarSplitUncompressedSize < 0 {
+		return nil, errors.New("invalid position of the tar-split metadata")
+	}
+	expected, err := digest.Parse(toc.TarSplitDigest)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid digest of the tar-split metadata")
+	}
+
+	chunk := ImageSourceChunk{
+		Offset: uint64(toc.TarSplitOffset),
+		Length: uint64(toc.TarSplitLength),
+	}
+	parts, errs, err := blobStream.GetBlobAt([]ImageSourceChunk{chunk})
+	if err != nil {
+		return nil, err
+	}
+	var reader io.ReadCloser
+	select {
+	case r := <-parts:
+		reader = r
+	case err := <-errs:
+		return nil, err
+	}
+	defer reader.Close()
+
+	compressed := make([]byte, toc.TarSplitLength)
+	if _, err := io.ReadFull(reader, compressed); err != nil {
+		return nil, err
+	}
+	if digest.FromBytes(compressed) != expected {
+		return nil, errors.New("invalid tar-split metadata checksum")
+	}
+
+	decoder, err := zstd.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
 	defer decoder.Close()
+	tarSplit, err := ioutil.ReadAll(io.LimitReader(decoder, toc.TarSplitUncompressedSize+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "decompressing the tar-split metadata")
+	}
+	if int64(len(tarSplit)) != toc.TarSplitUncompressedSize {
+		return nil, errors.Errorf("the tar-split metadata is not %d bytes long", toc.TarSplitUncompressedSize)
+	}
+	return tarSplit, nil
+}
+
+// ErrManifestNotFirst is returned by ReadManifestFirst for blobs which don't
+// start with their manifest.
+var ErrManifestNotFirst = errors.New("the blob doesn't start with its manifest")
+
+// ReadManifestFirst reads the manifest from the start of a zstd:chunked blob
+// which was written with the compressor's ManifestFirst option, and returns
+// its entries, leaving r at the end of the manifest, where the tarball
+// starts.  If annotations has the checksum of the manifest, it is verified.
+// It returns ErrManifestNotFirst if the blob doesn't start with its
+// manifest.
+func ReadManifestFirst(r io.Reader, annotations map[string]string) ([]FileMetadata, error) {
+	header := make([]byte, 8+internal.FooterSizeSupported)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrManifestNotFirst
+		}
+		return nil, err
+	}
+	if !internal.IsSkippableFrameMagic(header) || binary.LittleEndian.Uint32(header[4:8]) != internal.FooterSizeSupported ||
+		!bytes.Equal(header[8+32:], internal.ZstdChunkedManifestFirstMagic) {
+		return nil, ErrManifestNotFirst
+	}
+	offset := binary.LittleEndian.Uint64(header[8:16])
+	length := binary.LittleEndian.Uint64(header[16:24])
+	lengthUncompressed := binary.LittleEndian.Uint64(header[24:32])
+	manifestType := binary.LittleEndian.Uint64(header[32:40])
+	if !internal.IsManifestType(manifestType) {
+		return nil, errors.New("invalid manifest type")
+	}
+	if offset != uint64(len(header))+8 {
+		return nil, fmt.Errorf("the manifest is at offset %d instead of right after the header", offset)
+	}
+	// set a reasonable limit
+	if length > MaxManifestSize {
+		return nil, errors.New("manifest too big")
+	}
 
-	b := make([]byte, 0, lengthUncompressed)
-	if decoded, err := decoder.DecodeAll(manifest, b); err == nil {
-		return decoded, int64(offset), nil
+	frameHeader := make([]byte, 8)
+	if _, err := io.ReadFull(r, frameHeader); err != nil {
+		return nil, err
+	}
+	frameSize := uint64(binary.LittleEndian.Uint32(frameHeader[4:]))
+	if !internal.IsSkippableFrameMagic(frameHeader) || frameSize < length {
+		return nil, errors.New("invalid manifest frame")
+	}
+	manifest := make([]byte, length)
+	if _, err := io.ReadFull(r, manifest); err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(ioutil.Discard, r, int64(frameSize-length)); err != nil {
+		return nil, err
 	}
 
-	return manifest, int64(offset), nil
+	if checksum := annotations[internal.ManifestChecksumKey]; checksum != "" {
+		d, err := digest.Parse(checksum)
+		if err != nil {
+			return nil, err
+		}
+		if digest.Canonical.FromBytes(manifest) != d {
+			return nil, errors.New("invalid manifest checksum")
+		}
+	}
+
+	decoded, err := internal.DecompressManifest(manifest, lengthUncompressed, MaxManifestSize, manifestType)
+	if err != nil {
+		return nil, err
+	}
+	toc, err := internal.ParseTOC(decoded)
+	if err != nil {
+		return nil, err
+	}
+	return toc.Entries, nil
+}
+
+// Summary describes the contents of a zstd:chunked layer.
+type Summary struct {
+	// Entries is the number of entries in the layer's tarball.
+	Entries int64
+	// Size is the total size of the files in the layer.
+	Size int64
+}
+
+// ReadSummary returns the summary which was recorded in the annotations of
+// a zstd:chunked layer when it was created with the compressor's
+// RecordSummary option, or nil if there is none.
+func ReadSummary(annotations map[string]string) (*Summary, error) {
+	value, found := annotations[internal.ManifestSummaryKey]
+	if !found {
+		return nil, nil
+	}
+	var summary Summary
+	if _, err := fmt.Sscanf(value, "%d:%d", &summary.Entries, &summary.Size); err != nil {
+		return nil, errors.Wrapf(err, "invalid summary %q", value)
+	}
+	if summary.Entries < 0 || summary.Size < 0 {
+		return nil, fmt.Errorf("invalid summary %q", value)
+	}
+	return &summary, nil
 }
 
 // ZstdCompressor is a CompressorFunc for the zstd compression algorithm.
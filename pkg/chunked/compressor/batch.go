@@ -0,0 +1,129 @@
+package compressor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/containers/storage/pkg/chunked/internal"
+	"github.com/containers/storage/pkg/ioutils"
+)
+
+// sharedFrame is the position in the blob of a frame which holds a chunk.
+type sharedFrame struct {
+	offset, endOffset int64
+	compressedDigest  string
+}
+
+// ZstdCompressBatch compresses the tarballs read from readers, one after the
+// other, into a single zstd:chunked blob written to dest, where the chunks
+// which are in more than one file, in the same tarball or in different ones,
+// are stored only once.  The blob holds a manifest for each tarball, with the
+// internal.LayoutShared layout, and the returned annotations, one map for
+// each tarball, point to them.  The footer at the end of the blob points to
+// the manifest of the last tarball.  SortChunksByDigest and ManifestFirst,
+// which change the layout of the blob, can't be used.
+func ZstdCompressBatch(dest io.Writer, readers []io.Reader, options *Options) ([]map[string]string, error) {
+	opts, err := completeOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	if opts.SortChunksByDigest || opts.ManifestFirst {
+		return nil, errors.New("a batch of tarballs can't be compressed with SortChunksByDigest or ManifestFirst")
+	}
+
+	// Whether a chunk was already stored is only known once it is
+	// compressed, so each tarball is written to a temporary file first.
+	tmpFile, err := ioutil.TempFile("", "zstd-chunked")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+	}()
+
+	// total written so far.  Used to retrieve partial offsets in the file
+	out := ioutils.NewWriteCounter(dest)
+
+	frames := make(map[string]sharedFrame)
+	annotations := make([]map[string]string, 0, len(readers))
+	for i, reader := range readers {
+		if err := tmpFile.Truncate(0); err != nil {
+			return nil, err
+		}
+		if _, err := tmpFile.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		tmp := ioutils.NewWriteCounter(tmpFile)
+		metadata, tarSplit, err := writeZstdChunkedBody(tmp, reader, &opts)
+		if err != nil {
+			return nil, fmt.Errorf("compressing tarball %d: %w", i, err)
+		}
+		if err := copySharedFrames(out, tmpFile, tmp.Count, metadata, frames); err != nil {
+			return nil, err
+		}
+
+		toc := newTOC(metadata, &opts)
+		toc.Layout = internal.LayoutShared
+		if tarSplit != nil {
+			if err := internal.WriteTarSplit(out, uint64(out.Count), toc, tarSplit, *opts.Level); err != nil {
+				return nil, err
+			}
+		}
+		outMetadata := make(map[string]string)
+		recordSummary(outMetadata, metadata, &opts)
+		if err := internal.WriteZstdChunkedManifest(out, outMetadata, uint64(out.Count), toc, *opts.Level, opts.FrameMagic, opts.manifestType()); err != nil {
+			return nil, err
+		}
+		annotations = append(annotations, outMetadata)
+	}
+	return annotations, nil
+}
+
+// copySharedFrames copies to dest the body of a blob, size bytes long, which
+// is read from body and described by metadata, except for the frames of the
+// chunks which are already in frames, and updates the offsets in metadata to
+// refer to the frames in dest.  The frames which are copied are added to
+// frames.
+func copySharedFrames(dest *ioutils.WriteCounter, body io.ReaderAt, size int64, metadata []internal.FileMetadata, frames map[string]sharedFrame) error {
+	var pos int64
+	for i := range metadata {
+		e := &metadata[i]
+		if e.EndOffset == 0 {
+			continue
+		}
+		if e.Offset < pos {
+			return fmt.Errorf("the payload of %q at offset %d precedes the previous one", e.Name, e.Offset)
+		}
+		// the tar headers before the chunk
+		if _, err := io.Copy(dest, io.NewSectionReader(body, pos, e.Offset-pos)); err != nil {
+			return err
+		}
+		pos = e.EndOffset
+
+		// ChunkDigest is only set for the files split in several
+		// chunks, otherwise the chunk is the whole file.
+		key := e.ChunkDigest
+		if key == "" && e.Type == internal.TypeReg {
+			key = e.Digest
+		}
+		if frame, found := frames[key]; found && key != "" {
+			e.Offset, e.EndOffset, e.CompressedDigest = frame.offset, frame.endOffset, frame.compressedDigest
+			continue
+		}
+		offset := dest.Count
+		if _, err := io.Copy(dest, io.NewSectionReader(body, e.Offset, e.EndOffset-e.Offset)); err != nil {
+			return err
+		}
+		e.Offset, e.EndOffset = offset, dest.Count
+		if key != "" {
+			frames[key] = sharedFrame{offset: e.Offset, endOffset: e.EndOffset, compressedDigest: e.CompressedDigest}
+		}
+	}
+	// the end of the archive
+	_, err := io.Copy(dest, io.NewSectionReader(body, pos, size-pos))
+	return err
+}
@@ -0,0 +1,118 @@
+package compressor
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/vbatts/tar-split/archive/tar"
+)
+
+// ErrInputChecksumMismatch is returned, when Options.VerifyInputChecksums is
+// set, if the payload of an entry of the tarball doesn't match a checksum
+// recorded for it in the entry's PAX records.
+var ErrInputChecksumMismatch = errors.New("payload does not match the checksum recorded in the tarball")
+
+// inputChecksumAlgorithms lists the algorithms of the checksums which are
+// recognized in PAX records, by the suffix of the records' names.
+var inputChecksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// inputChecksum is a checksum of a payload which was found in a PAX record.
+type inputChecksum struct {
+	record   string
+	expected []byte
+	hash     hash.Hash
+}
+
+// inputChecksumVerifier computes the checksums which were recorded for the
+// payload of a tar entry as the payload is written to it.
+type inputChecksumVerifier struct {
+	name      string
+	checksums []inputChecksum
+}
+
+// newInputChecksumVerifier returns a verifier for the checksums recorded in
+// the PAX records of hdr.  Records are recognized if their name is made of a
+// vendor prefix and the name of an algorithm, such as "SCHILY.sha256", and
+// their value is the hex-encoded checksum, optionally preceded by the name of
+// the algorithm and a colon.  Extended attributes are never considered.  It
+// returns nil if hdr is not a regular file or has no such records.
+func newInputChecksumVerifier(hdr *tar.Header) (*inputChecksumVerifier, error) {
+	if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+		return nil, nil
+	}
+	var checksums []inputChecksum
+	for record, value := range hdr.PAXRecords {
+		if strings.HasPrefix(record, "SCHILY.xattr.") || strings.HasPrefix(record, "LIBARCHIVE.xattr.") {
+			continue
+		}
+		i := strings.LastIndex(record, ".")
+		if i <= 0 {
+			continue
+		}
+		algorithm := strings.ToLower(record[i+1:])
+		newHash, ok := inputChecksumAlgorithms[algorithm]
+		if !ok {
+			continue
+		}
+		value = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(value)), algorithm+":")
+		expected, err := hex.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid checksum in PAX record %q of %q: %w", record, hdr.Name, err)
+		}
+		checksums = append(checksums, inputChecksum{record: record, expected: expected, hash: newHash()})
+	}
+	if len(checksums) == 0 {
+		return nil, nil
+	}
+	sort.Slice(checksums, func(i, j int) bool {
+		return checksums[i].record < checksums[j].record
+	})
+	return &inputChecksumVerifier{name: hdr.Name, checksums: checksums}, nil
+}
+
+// Write implements io.Writer.
+func (v *inputChecksumVerifier) Write(p []byte) (int, error) {
+	for _, c := range v.checksums {
+		c.hash.Write(p)
+	}
+	return len(p), nil
+}
+
+// verify checks the checksums of what was written against the expected ones.
+func (v *inputChecksumVerifier) verify() error {
+	for _, c := range v.checksums {
+		if sum := c.hash.Sum(nil); !bytes.Equal(sum, c.expected) {
+			return fmt.Errorf("%q, PAX record %q: expected %x, got %x: %w", v.name, c.record, c.expected, sum, ErrInputChecksumMismatch)
+		}
+	}
+	return nil
+}
+
+// withInputChecksums returns a writer which writes to dest and, if options
+// requests it and hdr has checksums recorded for its payload, to a verifier
+// for them, which is returned too.
+func withInputChecksums(dest io.Writer, hdr *tar.Header, options *Options) (io.Writer, *inputChecksumVerifier, error) {
+	if !options.VerifyInputChecksums {
+		return dest, nil, nil
+	}
+	verifier, err := newInputChecksumVerifier(hdr)
+	if err != nil || verifier == nil {
+		return dest, nil, err
+	}
+	return io.MultiWriter(dest, verifier), verifier, nil
+}
@@ -5,157 +5,1456 @@ package compressor
 // larger software like the graph drivers.
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"time"
 
 	"github.com/containers/storage/pkg/chunked/internal"
 	"github.com/containers/storage/pkg/ioutils"
-	"github.com/opencontainers/go-digest"
+	"github.com/klauspost/compress/zstd"
+	digest "github.com/opencontainers/go-digest"
 	"github.com/vbatts/tar-split/archive/tar"
 )
 
-func writeZstdChunkedStream(destFile io.Writer, outMetadata map[string]string, reader io.Reader, level int) error {
-	// total written so far.  Used to retrieve partial offsets in the file
-	dest := ioutils.NewWriteCounter(destFile)
+// Options contains the settings used when creating a zstd:chunked blob.
+type Options struct {
+	// Level is the zstd compression level.  If nil, level 3 is used.
+	Level *int
+
+	// PrefetchOrder lists the names of the files which should be retrieved
+	// first when the layer is pulled lazily, in the order they are needed.
+	// It is recorded in the manifest.
+	PrefetchOrder []string
+
+	// ChunkHasher is the name of the hasher used for the digests of the
+	// files and chunks, either a built-in one ("sha256", "sha512" or
+	// "sha512-256") or one added with RegisterChunkHasher.  If empty,
+	// "sha256" is used.  It is recorded in the manifest.
+	ChunkHasher string
+
+	// FrameMagic, if set, is the 8 bytes magic number written in the
+	// footer of the blob instead of the upstream one, so that blobs using
+	// an experimental variant of the format are not mistaken for regular
+	// zstd:chunked blobs.  Readers must register it with
+	// chunked.RegisterFrameMagic to accept such blobs.
+	FrameMagic []byte
+
+	// Deadline, if set, is the time by which the blob must have been
+	// written.  Once it is exceeded, the compression is aborted and
+	// ErrDeadlineExceeded is returned.
+	Deadline time.Time
+
+	// SortChunksByDigest, if set, causes the blob to be written with a
+	// layout meant for storing each chunk as a separate object keyed by
+	// its digest: every distinct chunk is stored only once, and the
+	// chunks are sorted by digest.  The result is not a zstd compressed
+	// tarball, so it can be used only by readers which use its manifest.
+	SortChunksByDigest bool
+
+	// RecordSummary, if set, causes the number of entries in the tarball
+	// and the total size of its files to be recorded in the annotations
+	// of the blob, so that they can be retrieved with chunked.ReadSummary
+	// without reading the manifest.
+	RecordSummary bool
+
+	// Chunking, if set, causes the contents of regular files to be split
+	// into chunks at boundaries which depend on their contents, so that
+	// the parts which are the same in different files, or in different
+	// versions of a file, can be found and retrieved separately.  If nil,
+	// each file is stored as a single chunk.  It can't be used together
+	// with SortChunksByDigest.
+	Chunking *ChunkParams
+
+	// ChunkThreshold, if set along with Chunking, is the size below which
+	// regular files are not split, and are stored as a single chunk with
+	// only the digest of the whole file, since small files rarely share
+	// chunks with other files, while their chunks make the manifest
+	// bigger.  It doesn't apply to the files listed in ExplicitBoundaries.
+	ChunkThreshold int64
+
+	// OnSplit, if set, is called each time a chunk of a regular file
+	// ends, with the reason why it ended, so that the decisions of the
+	// chunker can be analyzed.  It is called from the goroutine which
+	// writes the blob.
+	OnSplit func(ChunkSplit)
+
+	// ExplicitBoundaries, if set, maps the names of regular files, as
+	// they appear in the tarball, to the offsets in them at which their
+	// chunks must end, in increasing order, so that different producers
+	// which agree on the boundaries create the same chunks.  The files
+	// which are listed are split only at those offsets, regardless of
+	// the rolling checksum and of the sizes in Chunking, which must be
+	// set, and their chunks which contain only zeros are not merged.
+	// The offsets past the end of a file are ignored.
+	ExplicitBoundaries map[string][]int64
+
+	// VerifyInputChecksums, if set, causes the payload of each regular
+	// file to be checked against the checksums recorded for it in the PAX
+	// records of its entry in the tarball, if there are any, such as
+	// "SCHILY.sha256".  ErrInputChecksumMismatch is returned if they
+	// don't match.
+	VerifyInputChecksums bool
+
+	// DigestEncoding, if set, causes the digests in the manifest to be
+	// recorded without the name of the hasher, which is recorded only
+	// once, so that the manifest is smaller.  It is either "hex" or
+	// "base64".  Readers restore the complete digests.
+	DigestEncoding string
+
+	// OffsetEncoding, if set to "delta", causes the offsets of the entries
+	// in the manifest to be recorded as differences from the preceding
+	// entries, which are smaller than the absolute offsets.  Readers
+	// restore the absolute offsets.
+	OffsetEncoding string
+
+	// ManifestCompression is the compression of the manifest, either
+	// "zstd", the default, or "gzip", for the tools which can only read
+	// the manifest with a gzip decompressor.  It is recorded as the
+	// MANIFEST_TYPE of the footer.  The rest of the blob is compressed
+	// with zstd either way.
+	ManifestCompression string
+
+	// MaxXattrSize, if not zero, is the maximum size of the value of an
+	// extended attribute of an entry, and MaxXattrsSize, if not zero, is
+	// the maximum total size of the names and values of the extended
+	// attributes of an entry.  ErrXattrTooBig is returned if they are
+	// exceeded, unless DropOversizedXattrs is set.
+	MaxXattrSize  int
+	MaxXattrsSize int
+
+	// NewTarReader, if set, is used instead of tar.NewReader to create the
+	// reader of the tarball, so that variants of the tar format which need
+	// special handling can be read.  The headers and the padding which
+	// the reader returns with RawBytes are copied to the blob as they
+	// are, so a reader built on a tar.Reader must set its RawAccounting.
+	NewTarReader func(r io.Reader) TarReader
+
+	// DropOversizedXattrs, if set, causes the extended attributes which
+	// exceed MaxXattrSize or MaxXattrsSize to be left out of the manifest
+	// instead of failing.  The entries which lost some of their extended
+	// attributes are marked with the XattrsDropped field.
+	DropOversizedXattrs bool
+
+	// CompressedDigests, if set, causes the digest of the compressed bytes
+	// of each chunk, from its Offset to its EndOffset in the blob, to be
+	// recorded in the CompressedDigest field of its manifest entry, so
+	// that a range fetched from the blob can be verified before it is
+	// decompressed.  It is computed with ChunkHasher.
+	CompressedDigests bool
+
+	// CompressedSizes, if set, causes the number of bytes of the blob
+	// taken by the compressed payload of each regular file, from the
+	// Offset to the EndOffset of each of its chunks, to be recorded in
+	// the CompressedSize field of its manifest entry.  The frames of the
+	// tar headers are not attributed to any file.  With
+	// SortChunksByDigest, a payload which is shared by several files is
+	// counted for each of them.
+	CompressedSizes bool
+
+	// ContentClasses, if set, causes a coarse class of the contents of
+	// each regular file, text, binary, already compressed or image, to be
+	// recorded in the ContentClass field of its manifest entry.  It is
+	// guessed from the magic number at the start of the file, or from
+	// its extension, or by looking for text in the first bytes of the
+	// file.
+	ContentClasses bool
+
+	// ManifestFirst, if set, causes the manifest to be written at the
+	// start of the blob, after a header which tells where it is, so that
+	// readers which can't seek can read it before the files.  The blob
+	// still ends with the usual footer, so it can be read like any other
+	// zstd:chunked blob.  Since the whole blob has to be known before it
+	// is written, it is written to a temporary file first.  It can't be
+	// used together with SortChunksByDigest.
+	ManifestFirst bool
+
+	// MarkEmptyDirs, if set, causes the directories which have no entries
+	// under them in the tarball to be marked with the EmptyDir field of
+	// their manifest entries, so that they can be told apart from the
+	// directories which are only created to hold their contents.  Such
+	// directories are often placeholders for mount points.
+	MarkEmptyDirs bool
+
+	// ChangeTokens, if set, causes a token computed from the type, link
+	// target, size, mode, owner, modification time and change time of
+	// each entry, as read from its tar header, to be recorded in the
+	// ChangeToken field of its manifest entry, so that incremental
+	// rebuilds can skip hashing the files which didn't change.
+	ChangeTokens bool
+
+	// ZeroRanges, if set, causes the ranges of each regular file which
+	// contain only zeros, in blocks of internal.ZeroRangeBlockSize bytes,
+	// to be recorded in the ZeroRanges field of its manifest entry, so
+	// that they can be left as holes when it is extracted.
+	ZeroRanges bool
+
+	// SourceDir, if set, is the directory which the tarball was created
+	// from.  The ranges of each regular file which are not allocated in
+	// the file with the same name under it, and which the tarball has as
+	// zeros, are recorded in the UnallocatedRanges field of its manifest
+	// entry, so that they can be left as holes when it is extracted.  The
+	// files which are missing, or whose size doesn't match their entry,
+	// are skipped.  It requires ZeroRanges.  Finding the ranges is only
+	// supported on Linux.
+	SourceDir string
+
+	// TarSplit, if set, causes the tar-split metadata of the tarball,
+	// which describes it as the files it contains and the bytes around
+	// them, to be stored in the blob and pointed to by the manifest, so
+	// that the layers pulled partially from the blob can be exported as
+	// the same tarball.  It is left out if the tarball has more than one
+	// entry with the same name, which tar-split can't describe.
+	TarSplit bool
+}
+
+// TarReader is what the compressor needs from the reader of a tarball.  It
+// is implemented by tar.Reader.
+type TarReader interface {
+	// Next advances to the next entry of the tarball.
+	Next() (*tar.Header, error)
+	// Read reads from the payload of the current entry.
+	Read(b []byte) (int, error)
+	// RawBytes returns the raw bytes of the tarball which were consumed
+	// since the previous call, other than the payloads.
+	RawBytes() []byte
+}
 
-	tr := tar.NewReader(reader)
+// newTarReader returns the reader of the tarball in r, as configured in
+// options.
+func newTarReader(r io.Reader, options *Options) TarReader {
+	if options.NewTarReader != nil {
+		return options.NewTarReader(r)
+	}
+	tr := tar.NewReader(r)
 	tr.RawAccounting = true
+	return tr
+}
 
-	buf := make([]byte, 4096)
+// SplitReason tells why a chunk of a file ended.
+type SplitReason int
+
+const (
+	// SplitRollsum means that the rolling checksum of the data matched
+	// ChunkParams.RollsumBits.
+	SplitRollsum SplitReason = iota
+	// SplitMaxSize means that the chunk reached ChunkParams.MaxSize.
+	SplitMaxSize
+	// SplitEndOfFile means that the chunk is the last one of the file.
+	SplitEndOfFile
+	// SplitExplicit means that the chunk ended at one of the offsets in
+	// Options.ExplicitBoundaries.
+	SplitExplicit
+)
+
+func (r SplitReason) String() string {
+	switch r {
+	case SplitRollsum:
+		return "rollsum"
+	case SplitMaxSize:
+		return "max-size"
+	case SplitEndOfFile:
+		return "end-of-file"
+	case SplitExplicit:
+		return "explicit"
+	}
+	return fmt.Sprintf("SplitReason(%d)", int(r))
+}
+
+// ChunkSplit describes a chunk of a file, for Options.OnSplit.
+type ChunkSplit struct {
+	// Name is the name of the file.
+	Name string
+	// Offset and Size are the position and the size of the chunk in the
+	// file.
+	Offset int64
+	Size   int64
+	// Reason is why the chunk ended.
+	Reason SplitReason
+}
+
+// ChunkParams controls how the contents of regular files are split into
+// chunks.
+type ChunkParams struct {
+	// RollsumBits is the number of low bits of the rolling checksum of the
+	// data which must all be set for a chunk to end there, so that chunks
+	// are 2^RollsumBits bytes long on average.
+	RollsumBits uint32
+	// MinSize is the minimum size of a chunk, except for the last chunk
+	// of a file.
+	MinSize int64
+	// MaxSize, if positive, is the maximum size of a chunk.  Consecutive
+	// chunks which contain only zeros are merged in the manifest, so they
+	// can be bigger.
+	MaxSize int64
+}
+
+// Validate checks that the parameters can be used.
+func (p *ChunkParams) Validate() error {
+	if p.RollsumBits == 0 || p.RollsumBits > 31 {
+		return fmt.Errorf("invalid number of rolling checksum bits %d", p.RollsumBits)
+	}
+	if p.MinSize < 0 {
+		return fmt.Errorf("invalid minimum chunk size %d", p.MinSize)
+	}
+	if p.MaxSize < 0 || (p.MaxSize > 0 && p.MaxSize < p.MinSize) {
+		return fmt.Errorf("invalid maximum chunk size %d", p.MaxSize)
+	}
+	return nil
+}
+
+// validateExplicitBoundaries checks that the boundaries in
+// options.ExplicitBoundaries can be used.
+func validateExplicitBoundaries(options *Options) error {
+	if len(options.ExplicitBoundaries) == 0 {
+		return nil
+	}
+	if options.Chunking == nil {
+		return errors.New("explicit chunk boundaries can't be used without Chunking")
+	}
+	for name, boundaries := range options.ExplicitBoundaries {
+		var last int64
+		for _, boundary := range boundaries {
+			if boundary <= last {
+				return fmt.Errorf("the chunk boundaries of %q are not positive and increasing", name)
+			}
+			last = boundary
+		}
+	}
+	return nil
+}
+
+// ErrDeadlineExceeded is returned when a blob could not be written before
+// the deadline set in Options.
+var ErrDeadlineExceeded = errors.New("zstd:chunked compression deadline exceeded")
 
-	zstdWriter, err := internal.ZstdWriterWithLevel(dest, level)
+// ErrXattrTooBig is returned when the extended attributes of an entry exceed
+// the limits set in Options.
+var ErrXattrTooBig = errors.New("extended attributes too big")
+
+// deadlineCheckInterval is how much of a file's payload is compressed
+// between checks of the deadline.
+const deadlineCheckInterval = 1 << 20
+
+// RegisterChunkHasher makes a hash implementation available under name, so
+// that it can be selected with Options.ChunkHasher and so that layers which
+// use it can be verified when they are pulled.  It is meant to be called
+// from an init function, and panics if name is invalid or already in use.
+func RegisterChunkHasher(name string, factory func() hash.Hash) {
+	internal.RegisterChunkHasher(name, factory)
+}
+
+// DigestLike computes the digest of the data read from r with the hasher
+// which was used to compute d, which can be one registered with
+// RegisterChunkHasher, so that the two can be compared.
+func DigestLike(d string, r io.Reader) (string, error) {
+	digester, err := internal.NewChunkDigesterForDigest(d)
 	if err != nil {
-		return err
+		return "", err
 	}
-	defer func() {
-		if zstdWriter != nil {
-			zstdWriter.Close()
-			zstdWriter.Flush()
+	if _, err := io.Copy(digester.Hash(), r); err != nil {
+		return "", err
+	}
+	return digester.Digest(), nil
+}
+
+// ManifestFile is a regular file listed in a zstd:chunked manifest.
+type ManifestFile struct {
+	// Name is the path of the file in the layer.
+	Name string
+	// Digest is the complete digest of the file's contents, which can be
+	// checked with DigestLike.
+	Digest string
+}
+
+// ParseManifestFiles decodes a zstd:chunked manifest with the decoder for
+// the version it declares, expanding its encoded digests, and returns the
+// regular files which it lists with a digest.
+func ParseManifestFiles(data []byte) ([]ManifestFile, error) {
+	toc, err := internal.ParseTOC(data)
+	if err != nil {
+		return nil, err
+	}
+	var files []ManifestFile
+	for _, e := range toc.Entries {
+		if e.Type != internal.TypeReg || e.Digest == "" {
+			continue
 		}
-	}()
+		files = append(files, ManifestFile{Name: e.Name, Digest: e.Digest})
+	}
+	return files, nil
+}
 
-	restartCompression := func() (int64, error) {
-		var offset int64
-		if zstdWriter != nil {
-			if err := zstdWriter.Close(); err != nil {
-				return 0, err
+var (
+	// minManifestTime and maxManifestTime are the earliest and the latest
+	// times which can be encoded in the manifest, since the JSON encoding
+	// of a time.Time is limited to four-digit years.
+	minManifestTime = time.Date(0, time.January, 1, 0, 0, 0, 0, time.UTC)
+	maxManifestTime = time.Date(9999, time.December, 31, 23, 59, 59, 999999999, time.UTC)
+)
+
+// normalizeTime converts t to UTC, so that the manifest doesn't depend on
+// the local time zone, and clamps it to the range of times which can be
+// encoded in the manifest.  The zero time.Time, which is used when a time
+// is not set, is preserved.
+func normalizeTime(t time.Time) time.Time {
+	if t.IsZero() {
+		return t
+	}
+	t = t.UTC()
+	if t.Before(minManifestTime) {
+		return minManifestTime
+	}
+	if t.After(maxManifestTime) {
+		return maxManifestTime
+	}
+	return t
+}
+
+// zeroRangesWriter records the blocks of the data written to it which
+// contain only zeros, merging adjacent ones.
+type zeroRangesWriter struct {
+	offset      int64
+	blockIsZero bool
+	ranges      []internal.ZeroRange
+}
+
+func (z *zeroRangesWriter) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		inBlock := z.offset % internal.ZeroRangeBlockSize
+		if inBlock == 0 {
+			z.blockIsZero = true
+		}
+		n := int64(len(p))
+		if n > internal.ZeroRangeBlockSize-inBlock {
+			n = internal.ZeroRangeBlockSize - inBlock
+		}
+		if z.blockIsZero && !internal.IsZero(p[:n]) {
+			z.blockIsZero = false
+		}
+		z.offset += n
+		p = p[n:]
+		if z.offset%internal.ZeroRangeBlockSize == 0 && z.blockIsZero {
+			start := z.offset - internal.ZeroRangeBlockSize
+			if l := len(z.ranges); l > 0 && z.ranges[l-1].Offset+z.ranges[l-1].Length == start {
+				z.ranges[l-1].Length += internal.ZeroRangeBlockSize
+			} else {
+				z.ranges = append(z.ranges, internal.ZeroRange{Offset: start, Length: internal.ZeroRangeBlockSize})
+			}
+		}
+	}
+	return written, nil
+}
+
+// scannedChunk is a chunk of the payload of a file, as written by a scanSink.
+type scannedChunk struct {
+	offset, endOffset, fileOffset, size int64
+	digest                              string
+	// zeros is set if the chunk contains only zeros.
+	zeros bool
+	// compressedDigest is the digest of the bytes of the blob between
+	// offset and endOffset, if compressed digests are recorded, and
+	// frame are those bytes, if the sink kept them.
+	compressedDigest string
+	frame            []byte
+}
+
+// coalesceZeroChunks merges the consecutive chunks of a file which contain
+// only zeros, such as the ones of a hole bigger than the maximum chunk size,
+// so that they are listed in a single entry of the manifest.  The frames of
+// the merged chunks are adjacent in the blob, and are read as one.
+func coalesceZeroChunks(chunks []scannedChunk, hasher string) ([]scannedChunk, error) {
+	result := chunks[:1]
+	for _, c := range chunks[1:] {
+		last := &result[len(result)-1]
+		if !c.zeros || !last.zeros || last.endOffset != c.offset {
+			result = append(result, c)
+			continue
+		}
+		last.endOffset = c.endOffset
+		last.size += c.size
+		last.digest = ""
+		if last.compressedDigest != "" {
+			last.compressedDigest = ""
+			if last.frame != nil && c.frame != nil {
+				last.frame = append(last.frame, c.frame...)
+				digester, err := internal.NewChunkDigester(hasher)
+				if err != nil {
+					return nil, err
+				}
+				if _, err := digester.Hash().Write(last.frame); err != nil {
+					return nil, err
+				}
+				last.compressedDigest = digester.Digest()
+			} else {
+				last.frame = nil
 			}
-			if err := zstdWriter.Flush(); err != nil {
-				return 0, err
+		}
+	}
+	var zeros []byte
+	for i := range result {
+		if result[i].digest != "" {
+			continue
+		}
+		if zeros == nil {
+			zeros = make([]byte, internal.ZeroRangeBlockSize)
+		}
+		digester, err := internal.NewChunkDigester(hasher)
+		if err != nil {
+			return nil, err
+		}
+		for left := result[i].size; left > 0; {
+			n := left
+			if n > int64(len(zeros)) {
+				n = int64(len(zeros))
 			}
-			offset = dest.Count
-			zstdWriter.Reset(dest)
+			digester.Hash().Write(zeros[:n])
+			left -= n
 		}
+		result[i].digest = digester.Digest()
+	}
+	return result, nil
+}
+
+// rollingChecksumReader reads the payload of a file, and tells where its
+// chunks end according to params, or at the offsets in boundaries if it is
+// not nil.  If params is nil, the payload is a single chunk.
+type rollingChecksumReader struct {
+	reader    *bufio.Reader
+	params    *ChunkParams
+	rollsum   *rollSum
+	chunkSize int64
+	// reason is why the last chunk which Read reported as ended did so.
+	reason SplitReason
+	// boundaries are the offsets at which the remaining chunks end, if
+	// they were given, and offset is the offset of the data read so far.
+	boundaries []int64
+	offset     int64
+}
+
+func newRollingChecksumReader(r io.Reader, params *ChunkParams, boundaries []int64) *rollingChecksumReader {
+	rc := &rollingChecksumReader{params: params}
+	if params != nil {
+		rc.reader = bufio.NewReader(r)
+		rc.rollsum = newRollSum()
+		rc.boundaries = boundaries
+	} else {
+		rc.reader = bufio.NewReaderSize(r, 4096)
+	}
+	return rc
+}
+
+// Read reads up to len(b) bytes of the current chunk.  The returned bool is
+// true if the chunk ends with the data which was read.
+func (rc *rollingChecksumReader) Read(b []byte) (bool, int, error) {
+	if rc.params == nil {
+		n, err := rc.reader.Read(b)
+		return false, n, err
+	}
+	if rc.boundaries != nil {
+		return rc.readToBoundary(b)
+	}
+	for i := range b {
+		c, err := rc.reader.ReadByte()
+		if err != nil {
+			return false, i, err
+		}
+		b[i] = c
+		rc.rollsum.roll(c)
+		rc.chunkSize++
+		if rc.params.MaxSize > 0 && rc.chunkSize >= rc.params.MaxSize {
+			rc.reason = SplitMaxSize
+		} else if rc.chunkSize >= rc.params.MinSize && rc.rollsum.onSplitWithBits(rc.params.RollsumBits) {
+			rc.reason = SplitRollsum
+		} else {
+			continue
+		}
+		rc.chunkSize = 0
+		return true, i + 1, nil
+	}
+	return false, len(b), nil
+}
+
+// readToBoundary is Read when the boundaries of the chunks were given.
+func (rc *rollingChecksumReader) readToBoundary(b []byte) (bool, int, error) {
+	if len(rc.boundaries) > 0 && int64(len(b)) > rc.boundaries[0]-rc.offset {
+		b = b[:rc.boundaries[0]-rc.offset]
+	}
+	n, err := rc.reader.Read(b)
+	rc.offset += int64(n)
+	if len(rc.boundaries) > 0 && rc.offset == rc.boundaries[0] {
+		rc.boundaries = rc.boundaries[1:]
+		rc.reason = SplitExplicit
+		return true, n, err
+	}
+	return false, n, err
+}
+
+// checkDeadline returns ErrDeadlineExceeded if deadline is set and it has
+// passed.
+func checkDeadline(deadline time.Time) error {
+	if !deadline.IsZero() && time.Now().After(deadline) {
+		return ErrDeadlineExceeded
+	}
+	return nil
+}
+
+// encodeXattrs returns the extended attributes of hdr encoded for the
+// manifest, enforcing the limits set in options.  The attributes are
+// considered in the order of their names, so that the same ones are dropped
+// every time.
+func encodeXattrs(hdr *tar.Header, options *Options) (map[string]string, bool, error) {
+	names := make([]string, 0, len(hdr.Xattrs))
+	for k := range hdr.Xattrs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	xattrs := make(map[string]string)
+	dropped := false
+	total := 0
+	for _, k := range names {
+		v := hdr.Xattrs[k]
+		tooBig := options.MaxXattrSize > 0 && len(v) > options.MaxXattrSize
+		if !tooBig && options.MaxXattrsSize > 0 && total+len(k)+len(v) > options.MaxXattrsSize {
+			tooBig = true
+		}
+		if tooBig {
+			if !options.DropOversizedXattrs {
+				return nil, false, fmt.Errorf("%q, extended attribute %q of %d bytes: %w", hdr.Name, k, len(v), ErrXattrTooBig)
+			}
+			dropped = true
+			continue
+		}
+		total += len(k) + len(v)
+		xattrs[k] = base64.StdEncoding.EncodeToString([]byte(v))
+	}
+	return xattrs, dropped, nil
+}
+
+// newFileMetadata creates the manifest entry for the tar entry hdr, whose
+// payload has the specified digest and zero ranges.
+func newFileMetadata(hdr *tar.Header, checksum string, zeroRanges []internal.ZeroRange, options *Options) (internal.FileMetadata, error) {
+	typ, err := internal.GetType(hdr.Typeflag)
+	if err != nil {
+		return internal.FileMetadata{}, err
+	}
+	xattrs, dropped, err := encodeXattrs(hdr, options)
+	if err != nil {
+		return internal.FileMetadata{}, err
+	}
+	m := internal.FileMetadata{
+		Type:       typ,
+		Name:       hdr.Name,
+		Linkname:   hdr.Linkname,
+		Mode:       hdr.Mode,
+		Size:       hdr.Size,
+		UID:        hdr.Uid,
+		GID:        hdr.Gid,
+		ModTime:    normalizeTime(hdr.ModTime),
+		AccessTime: normalizeTime(hdr.AccessTime),
+		ChangeTime: normalizeTime(hdr.ChangeTime),
+		Devmajor:   hdr.Devmajor,
+		Devminor:   hdr.Devminor,
+		Xattrs:     xattrs,
+		Digest:     checksum,
+
+		// ChunkSize is 0 for the last chunk
+		ChunkSize:   0,
+		ChunkOffset: 0,
+		ChunkDigest: checksum,
+
+		ZeroRanges: zeroRanges,
+
+		XattrsDropped: dropped,
+	}
+	if options.ChangeTokens {
+		m.ChangeToken = internal.ChangeToken(&m)
+	}
+	return m, nil
+}
+
+// recordSummary adds the summary of the entries to outMetadata, if
+// options.RecordSummary is set.
+func recordSummary(outMetadata map[string]string, entries []internal.FileMetadata, options *Options) {
+	if !options.RecordSummary {
+		return
+	}
+	var count, size int64
+	for _, e := range entries {
+		if e.Type == internal.TypeChunk {
+			continue
+		}
+		count++
+		size += e.Size
+	}
+	outMetadata[internal.ManifestSummaryKey] = fmt.Sprintf("%d:%d", count, size)
+}
+
+// markEmptyDirs sets the EmptyDir field of the entries of the directories
+// which have no other entries under them, if options.MarkEmptyDirs is set.
+func markEmptyDirs(entries []internal.FileMetadata, options *Options) {
+	if !options.MarkEmptyDirs {
+		return
+	}
+	parents := make(map[string]bool)
+	for _, e := range entries {
+		for dir := path.Dir(cleanEntryName(e.Name)); !parents[dir]; dir = path.Dir(dir) {
+			parents[dir] = true
+			if dir == "/" {
+				break
+			}
+		}
+	}
+	for i := range entries {
+		if entries[i].Type == internal.TypeDir && !parents[cleanEntryName(entries[i].Name)] {
+			entries[i].EmptyDir = true
+		}
+	}
+}
+
+// cleanEntryName returns the name of an entry of the tarball as an absolute
+// path without trailing slashes, so that the different spellings of a name
+// can be compared.
+func cleanEntryName(name string) string {
+	return path.Clean("/" + name)
+}
+
+// scanSink receives the contents of a tarball as scanTar reads it.
+type scanSink interface {
+	// writeRaw writes the parts of the tarball which are not the
+	// payload of a file: the headers of its entries and any padding.
+	writeRaw(p []byte) error
+	// startChunk is called before the first byte of each chunk of a
+	// file's payload is written, and returns the offset in the blob
+	// where the chunk starts.
+	startChunk() (int64, error)
+	// writePayload writes part of the payload of a file.
+	writePayload(p []byte) error
+	// endChunk is called after the last byte of each chunk is written,
+	// and returns the offset in the blob where the chunk ends.
+	endChunk() (int64, error)
+	// lastFrame returns the digest of the bytes written to the blob for
+	// the chunk which ended last, or "" if compressed digests are not
+	// recorded, and those bytes if they are short enough to be kept.
+	lastFrame() (string, []byte)
+}
+
+// discardSink is a scanSink which writes nothing, so that all the offsets
+// in the blob are 0.
+type discardSink struct{}
+
+func (discardSink) writeRaw(p []byte) error     { return nil }
+func (discardSink) startChunk() (int64, error)  { return 0, nil }
+func (discardSink) writePayload(p []byte) error { return nil }
+func (discardSink) endChunk() (int64, error)    { return 0, nil }
+func (discardSink) lastFrame() (string, []byte) { return "", nil }
+
+// maxKeptFrameSize is the size of the largest frame which zstdChunkedSink
+// keeps, so that the compressed digest of the frames of the chunks merged by
+// coalesceZeroChunks, which compress very well, can be computed.
+const maxKeptFrameSize = 64 * 1024
+
+// zstdChunkedSink is the scanSink used by writeZstdChunkedStream, which
+// compresses each chunk in its own zstd frame.
+type zstdChunkedSink struct {
+	// total written so far.  Used to retrieve partial offsets in the file
+	dest       *ioutils.WriteCounter
+	zstdWriter *zstd.Encoder
+
+	// If recordFrames is set, the bytes of the current frame are written
+	// to frame, which computes their digest with hasher, and lastDigest
+	// and lastData describe the frame which ended last.
+	recordFrames bool
+	hasher       string
+	frame        *frameRecorder
+	lastDigest   string
+	lastData     []byte
+}
+
+// frameRecorder computes the digest of the bytes written to it, and keeps
+// them as long as they are no more than maxKeptFrameSize.
+type frameRecorder struct {
+	digester *internal.ChunkDigester
+	data     []byte
+	overflow bool
+}
+
+func (f *frameRecorder) Write(p []byte) (int, error) {
+	if !f.overflow {
+		if len(f.data)+len(p) > maxKeptFrameSize {
+			f.overflow = true
+			f.data = nil
+		} else {
+			f.data = append(f.data, p...)
+		}
+	}
+	return f.digester.Hash().Write(p)
+}
+
+func (z *zstdChunkedSink) writeRaw(p []byte) error {
+	_, err := z.zstdWriter.Write(p)
+	return err
+}
+
+func (z *zstdChunkedSink) writePayload(p []byte) error {
+	_, err := z.zstdWriter.Write(p)
+	return err
+}
+
+func (z *zstdChunkedSink) restartCompression() (int64, error) {
+	if err := z.zstdWriter.Close(); err != nil {
+		return 0, err
+	}
+	if err := z.zstdWriter.Flush(); err != nil {
+		return 0, err
+	}
+	offset := z.dest.Count
+	if !z.recordFrames {
+		z.zstdWriter.Reset(z.dest)
 		return offset, nil
 	}
+	// The frame which was just closed ends here, so its digest is
+	// complete, and the next one is recorded from the start.
+	if z.frame != nil {
+		z.lastDigest = z.frame.digester.Digest()
+		z.lastData = z.frame.data
+	}
+	digester, err := internal.NewChunkDigester(z.hasher)
+	if err != nil {
+		return 0, err
+	}
+	z.frame = &frameRecorder{digester: digester}
+	z.zstdWriter.Reset(io.MultiWriter(z.dest, z.frame))
+	return offset, nil
+}
+
+func (z *zstdChunkedSink) startChunk() (int64, error) {
+	return z.restartCompression()
+}
+
+func (z *zstdChunkedSink) endChunk() (int64, error) {
+	return z.restartCompression()
+}
+
+func (z *zstdChunkedSink) lastFrame() (string, []byte) {
+	return z.lastDigest, z.lastData
+}
+
+// scanTar reads the tarball from reader, writes it to sink, and returns the
+// manifest entries which describe it.  Its tar-split metadata is recorded
+// with tarSplit.
+func scanTar(reader io.Reader, options *Options, sink scanSink, tarSplit *tarSplitRecorder) ([]internal.FileMetadata, error) {
+	tr := newTarReader(reader, options)
+
+	buf := make([]byte, 4096)
 
 	var metadata []internal.FileMetadata
 	for {
+		if err := checkDeadline(options.Deadline); err != nil {
+			return nil, err
+		}
 		hdr, err := tr.Next()
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			return err
+			return nil, err
 		}
 
-		rawBytes := tr.RawBytes()
-		if _, err := zstdWriter.Write(rawBytes); err != nil {
-			return err
+		raw := tr.RawBytes()
+		if err := sink.writeRaw(raw); err != nil {
+			return nil, err
+		}
+		if err := tarSplit.segment(raw); err != nil {
+			return nil, err
+		}
+		payloadDigester, err := internal.NewChunkDigester(options.ChunkHasher)
+		if err != nil {
+			return nil, err
 		}
-		payloadDigester := digest.Canonical.Digester()
 		payloadChecksum := payloadDigester.Hash()
 
-		payloadDest := io.MultiWriter(payloadChecksum, zstdWriter)
+		zeroRanges := &zeroRangesWriter{}
+		sniffer := newContentSniffer(options)
+		payloadWriters := []io.Writer{payloadChecksum, sniffer}
+		if options.ZeroRanges {
+			payloadWriters = append(payloadWriters, zeroRanges)
+		}
+		if tarSplit != nil {
+			payloadWriters = append(payloadWriters, tarSplit)
+		}
+		payloadDest, inputChecksums, err := withInputChecksums(io.MultiWriter(payloadWriters...), hdr, options)
+		if err != nil {
+			return nil, err
+		}
+
+		boundaries := options.ExplicitBoundaries[hdr.Name]
+		chunking := options.Chunking
+		if boundaries == nil && hdr.Size < options.ChunkThreshold {
+			chunking = nil
+		}
+
+		// The sink is told where each chunk starts and ends, so that it
+		// can compress it in its own frame.  When the file is split,
+		// the digest of each chunk is computed too.
+		var chunks []scannedChunk
+		var current *scannedChunk
+		var chunkDigester *internal.ChunkDigester
+		var written int64
+		startChunk := func() error {
+			offset, err := sink.startChunk()
+			if err != nil {
+				return err
+			}
+			current = &scannedChunk{offset: offset, fileOffset: written, zeros: true}
+			if chunking != nil {
+				if chunkDigester, err = internal.NewChunkDigester(options.ChunkHasher); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		endChunk := func(reason SplitReason) error {
+			endOffset, err := sink.endChunk()
+			if err != nil {
+				return err
+			}
+			current.endOffset = endOffset
+			current.size = written - current.fileOffset
+			current.compressedDigest, current.frame = sink.lastFrame()
+			if chunkDigester != nil {
+				current.digest = chunkDigester.Digest()
+			}
+			chunks = append(chunks, *current)
+			if options.OnSplit != nil {
+				options.OnSplit(ChunkSplit{Name: hdr.Name, Offset: current.fileOffset, Size: current.size, Reason: reason})
+			}
+			current = nil
+			return nil
+		}
 
 		// Now handle the payload, if any
-		var startOffset, endOffset int64
+		payload := newRollingChecksumReader(tr, chunking, boundaries)
+		var sinceLastCheck int
 		checksum := ""
 		for {
-			read, errRead := tr.Read(buf)
+			split, read, errRead := payload.Read(buf)
 			if errRead != nil && errRead != io.EOF {
-				return err
+				return nil, errRead
+			}
+			sinceLastCheck += read
+			if sinceLastCheck >= deadlineCheckInterval {
+				if err := checkDeadline(options.Deadline); err != nil {
+					return nil, err
+				}
+				sinceLastCheck = 0
 			}
 
 			// restart the compression only if there is
 			// a payload.
 			if read > 0 {
-				if startOffset == 0 {
-					startOffset, err = restartCompression()
-					if err != nil {
-						return err
+				if current == nil {
+					if err := startChunk(); err != nil {
+						return nil, err
 					}
 				}
-				_, err := payloadDest.Write(buf[:read])
-				if err != nil {
-					return err
+				if _, err := payloadDest.Write(buf[:read]); err != nil {
+					return nil, err
+				}
+				if err := sink.writePayload(buf[:read]); err != nil {
+					return nil, err
+				}
+				if chunkDigester != nil {
+					if _, err := chunkDigester.Hash().Write(buf[:read]); err != nil {
+						return nil, err
+					}
+				}
+				if current.zeros && !internal.IsZero(buf[:read]) {
+					current.zeros = false
+				}
+				written += int64(read)
+			}
+			if current != nil && (split || errRead == io.EOF) {
+				reason := SplitEndOfFile
+				if split {
+					reason = payload.reason
+				}
+				if err := endChunk(reason); err != nil {
+					return nil, err
 				}
 			}
 			if errRead == io.EOF {
-				if startOffset > 0 {
-					endOffset, err = restartCompression()
-					if err != nil {
-						return err
-					}
-					checksum = payloadDigester.Digest().String()
+				if len(chunks) > 0 {
+					checksum = payloadDigester.Digest()
 				}
 				break
 			}
 		}
+		if inputChecksums != nil {
+			if err := inputChecksums.verify(); err != nil {
+				return nil, err
+			}
+		}
+		if err := tarSplit.file(hdr); err != nil {
+			return nil, err
+		}
 
-		typ, err := internal.GetType(hdr.Typeflag)
-		if err != nil {
-			return err
+		if len(chunks) > 1 && boundaries == nil {
+			if chunks, err = coalesceZeroChunks(chunks, options.ChunkHasher); err != nil {
+				return nil, err
+			}
 		}
-		xattrs := make(map[string]string)
-		for k, v := range hdr.Xattrs {
-			xattrs[k] = base64.StdEncoding.EncodeToString([]byte(v))
-		}
-		m := internal.FileMetadata{
-			Type:       typ,
-			Name:       hdr.Name,
-			Linkname:   hdr.Linkname,
-			Mode:       hdr.Mode,
-			Size:       hdr.Size,
-			UID:        hdr.Uid,
-			GID:        hdr.Gid,
-			ModTime:    hdr.ModTime,
-			AccessTime: hdr.AccessTime,
-			ChangeTime: hdr.ChangeTime,
-			Devmajor:   hdr.Devmajor,
-			Devminor:   hdr.Devminor,
-			Xattrs:     xattrs,
-			Digest:     checksum,
-			Offset:     startOffset,
-			EndOffset:  endOffset,
 
-			// ChunkSize is 0 for the last chunk
-			ChunkSize:   0,
-			ChunkOffset: 0,
-			ChunkDigest: checksum,
+		m, err := newFileMetadata(hdr, checksum, zeroRanges.ranges, options)
+		if err != nil {
+			return nil, err
+		}
+		m.ContentClass = sniffer.class(hdr.Name)
+		if m.UnallocatedRanges, err = unallocatedRanges(hdr, m.ZeroRanges, options); err != nil {
+			return nil, err
+		}
+		if len(chunks) > 0 {
+			m.Offset = chunks[0].offset
+			m.EndOffset = chunks[0].endOffset
+			m.CompressedDigest = chunks[0].compressedDigest
+		}
+		if len(chunks) > 1 {
+			m.ChunkSize = chunks[0].size
+			m.ChunkDigest = chunks[0].digest
+		}
+		if options.CompressedSizes {
+			for _, c := range chunks {
+				m.CompressedSize += c.endOffset - c.offset
+			}
 		}
 		metadata = append(metadata, m)
+		for i := 1; i < len(chunks); i++ {
+			c := internal.FileMetadata{
+				Type:             internal.TypeChunk,
+				Name:             hdr.Name,
+				Offset:           chunks[i].offset,
+				EndOffset:        chunks[i].endOffset,
+				ChunkOffset:      chunks[i].fileOffset,
+				ChunkDigest:      chunks[i].digest,
+				CompressedDigest: chunks[i].compressedDigest,
+			}
+			// ChunkSize is 0 for the last chunk
+			if i < len(chunks)-1 {
+				c.ChunkSize = chunks[i].size
+			}
+			metadata = append(metadata, c)
+		}
+	}
+
+	raw := tr.RawBytes()
+	if err := sink.writeRaw(raw); err != nil {
+		return nil, err
+	}
+	if err := tarSplit.segment(raw); err != nil {
+		return nil, err
+	}
+	markEmptyDirs(metadata, options)
+	return metadata, nil
+}
+
+// ScanTarMetadata reads the tarball from r and returns the manifest entries
+// which a zstd:chunked blob created from it with the same options would
+// have, including the digests of the files and, if options.Chunking is set,
+// of their chunks, without compressing anything.  Since there is no blob,
+// the Offset and EndOffset fields of the entries are 0.  The options which
+// only affect the blob, such as Level, are ignored.  The entries have the
+// type chunked.FileMetadata.
+func ScanTarMetadata(r io.Reader, options *Options) ([]internal.FileMetadata, error) {
+	opts := Options{}
+	if options != nil {
+		opts = *options
+	}
+	if _, err := internal.NewChunkDigester(opts.ChunkHasher); err != nil {
+		return nil, err
+	}
+	if opts.Chunking != nil {
+		if err := opts.Chunking.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if opts.ChunkThreshold < 0 {
+		return nil, fmt.Errorf("invalid chunk threshold %d", opts.ChunkThreshold)
+	}
+	if opts.SourceDir != "" && !opts.ZeroRanges {
+		return nil, errors.New("SourceDir requires ZeroRanges")
+	}
+	if err := validateExplicitBoundaries(&opts); err != nil {
+		return nil, err
+	}
+	return scanTar(r, &opts, discardSink{}, nil)
+}
+
+func writeZstdChunkedStream(destFile io.Writer, outMetadata map[string]string, reader io.Reader, options *Options) error {
+	// total written so far.  Used to retrieve partial offsets in the file
+	dest := ioutils.NewWriteCounter(destFile)
+
+	metadata, tarSplit, err := writeZstdChunkedBody(dest, reader, options)
+	if err != nil {
+		return err
+	}
+	toc := newTOC(metadata, options)
+	if tarSplit != nil {
+		if err := internal.WriteTarSplit(dest, uint64(dest.Count), toc, tarSplit, *options.Level); err != nil {
+			return err
+		}
+	}
+	recordSummary(outMetadata, metadata, options)
+	return internal.WriteZstdChunkedManifest(dest, outMetadata, uint64(dest.Count), toc, *options.Level, options.FrameMagic, options.manifestType())
+}
+
+// writeZstdChunkedManifestFirstStream is like writeZstdChunkedStream, but it
+// writes the manifest at the start of the blob, as described for
+// internal.ZstdChunkedManifestFirstMagic.  Since the offsets recorded in the
+// manifest depend on its size, the rest of the blob is written to a
+// temporary file first.
+func writeZstdChunkedManifestFirstStream(destFile io.Writer, outMetadata map[string]string, reader io.Reader, options *Options) error {
+	tmpFile, err := ioutil.TempFile("", "zstd-chunked")
+	if err != nil {
+		return err
 	}
+	defer func() {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+	}()
+	tmp := ioutils.NewWriteCounter(tmpFile)
 
-	rawBytes := tr.RawBytes()
-	if _, err := zstdWriter.Write(rawBytes); err != nil {
+	metadata, tarSplit, err := writeZstdChunkedBody(tmp, reader, options)
+	if err != nil {
+		return err
+	}
+	toc := newTOC(metadata, options)
+	if tarSplit != nil {
+		if err := internal.WriteTarSplit(tmp, uint64(tmp.Count), toc, tarSplit, *options.Level); err != nil {
+			return err
+		}
+	}
+	if _, err := tmpFile.Seek(0, io.SeekStart); err != nil {
 		return err
 	}
+	recordSummary(outMetadata, metadata, options)
+	return internal.WriteZstdChunkedManifestFirst(destFile, outMetadata, toc, tmpFile, tmp.Count, *options.Level, options.FrameMagic, options.manifestType())
+}
+
+// writeZstdChunkedBody writes to dest the tarball read from reader, with the
+// payloads of the files compressed in their own frames, and returns the
+// manifest entries which describe it, and its tar-split metadata if options
+// ask for it to be recorded.
+func writeZstdChunkedBody(dest *ioutils.WriteCounter, reader io.Reader, options *Options) ([]internal.FileMetadata, []byte, error) {
+	zstdWriter, err := internal.ZstdWriterWithLevel(dest, *options.Level)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if zstdWriter != nil {
+			zstdWriter.Close()
+			zstdWriter.Flush()
+		}
+	}()
+
+	sink := &zstdChunkedSink{
+		dest:         dest,
+		zstdWriter:   zstdWriter,
+		hasher:       options.ChunkHasher,
+		recordFrames: options.CompressedDigests,
+	}
+	tarSplit := newTarSplitRecorder(options)
+	metadata, err := scanTar(reader, options, sink, tarSplit)
+	if err != nil {
+		return nil, nil, err
+	}
 	if err := zstdWriter.Flush(); err != nil {
+		return nil, nil, err
+	}
+	if err := zstdWriter.Close(); err != nil {
+		return nil, nil, err
+	}
+	zstdWriter = nil
+	return metadata, tarSplit.data(), nil
+}
+
+// newTOC returns the manifest of a blob with the sequential layout whose
+// entries are metadata.
+func newTOC(metadata []internal.FileMetadata, options *Options) *internal.TOC {
+	return &internal.TOC{
+		Entries:        metadata,
+		Prefetch:       options.PrefetchOrder,
+		ChunkHasher:    options.ChunkHasher,
+		DigestEncoding: options.DigestEncoding,
+		OffsetEncoding: options.OffsetEncoding,
+	}
+}
+
+// copyPayload copies the payload of the current entry of tr to dest, and
+// returns its size.
+func copyPayload(dest io.Writer, tr TarReader, deadline time.Time) (int64, error) {
+	buf := make([]byte, 4096)
+	var written int64
+	var sinceLastCheck int
+	for {
+		read, errRead := tr.Read(buf)
+		if errRead != nil && errRead != io.EOF {
+			return written, errRead
+		}
+		if read > 0 {
+			if _, err := dest.Write(buf[:read]); err != nil {
+				return written, err
+			}
+			written += int64(read)
+		}
+		if errRead == io.EOF {
+			return written, nil
+		}
+		sinceLastCheck += read
+		if sinceLastCheck >= deadlineCheckInterval {
+			if err := checkDeadline(deadline); err != nil {
+				return written, err
+			}
+			sinceLastCheck = 0
+		}
+	}
+}
+
+// writeZstdChunkedSortedStream is like writeZstdChunkedStream, but it writes
+// the blob with the internal.LayoutDigestSorted layout.  Since the payloads
+// can be written only once all of them are known, they are compressed to a
+// temporary file first.
+func writeZstdChunkedSortedStream(destFile io.Writer, outMetadata map[string]string, reader io.Reader, options *Options) error {
+	level := *options.Level
+
+	tmpFile, err := ioutil.TempFile("", "zstd-chunked")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+	}()
+	tmp := ioutils.NewWriteCounter(tmpFile)
+
+	zstdWriter, err := internal.ZstdWriterWithLevel(tmp, level)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// Closing the encoder again can write the end of the last frame
+		// a second time, so make sure it doesn't end up after the
+		// manifest.
+		zstdWriter.Reset(ioutil.Discard)
+		zstdWriter.Close()
+	}()
+
+	// the position in tmpFile of the compressed payloads, by digest
+	type storedPayload struct {
+		offset, length int64
+	}
+	payloads := make(map[string]storedPayload)
+
+	// the tarball without the payloads, as described for
+	// internal.LayoutDigestSorted
+	var headers bytes.Buffer
+	appendRecord := func(data []byte) {
+		var length [binary.MaxVarintLen64]byte
+		headers.Write(length[:binary.PutUvarint(length[:], uint64(len(data)))])
+		headers.Write(data)
+	}
+
+	tr := newTarReader(reader, options)
+	tarSplit := newTarSplitRecorder(options)
+
+	var metadata []internal.FileMetadata
+	for {
+		if err := checkDeadline(options.Deadline); err != nil {
+			return err
+		}
+		hdr, err := tr.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		raw := tr.RawBytes()
+		appendRecord(raw)
+		if err := tarSplit.segment(raw); err != nil {
+			return err
+		}
+
+		payloadDigester, err := internal.NewChunkDigester(options.ChunkHasher)
+		if err != nil {
+			return err
+		}
+		zeroRanges := &zeroRangesWriter{}
+		sniffer := newContentSniffer(options)
+		start := tmp.Count
+		zstdWriter.Reset(tmp)
+		payloadWriters := []io.Writer{payloadDigester.Hash(), sniffer, zstdWriter}
+		if options.ZeroRanges {
+			payloadWriters = append(payloadWriters, zeroRanges)
+		}
+		if tarSplit != nil {
+			payloadWriters = append(payloadWriters, tarSplit)
+		}
+		payloadDest, inputChecksums, err := withInputChecksums(io.MultiWriter(payloadWriters...), hdr, options)
+		if err != nil {
+			return err
+		}
+		size, err := copyPayload(payloadDest, tr, options.Deadline)
+		if err != nil {
+			return err
+		}
+		if inputChecksums != nil {
+			if err := inputChecksums.verify(); err != nil {
+				return err
+			}
+		}
+		if err := zstdWriter.Close(); err != nil {
+			return err
+		}
+		if err := tarSplit.file(hdr); err != nil {
+			return err
+		}
+
+		checksum := ""
+		if size > 0 {
+			checksum = payloadDigester.Digest()
+			if options.OnSplit != nil {
+				options.OnSplit(ChunkSplit{Name: hdr.Name, Size: size, Reason: SplitEndOfFile})
+			}
+		}
+		if _, found := payloads[checksum]; found || checksum == "" {
+			// drop what was just written, it is not needed
+			if err := tmpFile.Truncate(start); err != nil {
+				return err
+			}
+			if _, err := tmpFile.Seek(start, io.SeekStart); err != nil {
+				return err
+			}
+			tmp.Count = start
+		} else {
+			payloads[checksum] = storedPayload{offset: start, length: tmp.Count - start}
+		}
+
+		m, err := newFileMetadata(hdr, checksum, zeroRanges.ranges, options)
+		if err != nil {
+			return err
+		}
+		m.ContentClass = sniffer.class(hdr.Name)
+		if m.UnallocatedRanges, err = unallocatedRanges(hdr, m.ZeroRanges, options); err != nil {
+			return err
+		}
+		metadata = append(metadata, m)
+	}
+	raw := tr.RawBytes()
+	appendRecord(raw)
+	if err := tarSplit.segment(raw); err != nil {
+		return err
+	}
+	markEmptyDirs(metadata, options)
+
+	// total written so far.  Used to retrieve partial offsets in the file
+	dest := ioutils.NewWriteCounter(destFile)
+
+	// The headers come first, so that no payload is at offset 0, which
+	// means that a file has no payload.
+	zstdWriter.Reset(dest)
+	if _, err := zstdWriter.Write(headers.Bytes()); err != nil {
 		return err
 	}
 	if err := zstdWriter.Close(); err != nil {
 		return err
 	}
-	zstdWriter = nil
+	headersEndOffset := dest.Count
+
+	digests := make([]string, 0, len(payloads))
+	for d := range payloads {
+		digests = append(digests, d)
+	}
+	sort.Strings(digests)
+	offsets := make(map[string]int64)
+	compressedDigests := make(map[string]string)
+	for _, d := range digests {
+		if err := checkDeadline(options.Deadline); err != nil {
+			return err
+		}
+		p := payloads[d]
+		offsets[d] = dest.Count
+		var frameDest io.Writer = dest
+		var frameDigester *internal.ChunkDigester
+		if options.CompressedDigests {
+			if frameDigester, err = internal.NewChunkDigester(options.ChunkHasher); err != nil {
+				return err
+			}
+			frameDest = io.MultiWriter(dest, frameDigester.Hash())
+		}
+		if _, err := io.Copy(frameDest, io.NewSectionReader(tmpFile, p.offset, p.length)); err != nil {
+			return err
+		}
+		if frameDigester != nil {
+			compressedDigests[d] = frameDigester.Digest()
+		}
+	}
+	for i := range metadata {
+		if d := metadata[i].Digest; d != "" {
+			metadata[i].Offset = offsets[d]
+			metadata[i].EndOffset = offsets[d] + payloads[d].length
+			metadata[i].CompressedDigest = compressedDigests[d]
+			if options.CompressedSizes {
+				metadata[i].CompressedSize = payloads[d].length
+			}
+		}
+	}
+
+	toc := internal.TOC{
+		Entries:             metadata,
+		Prefetch:            options.PrefetchOrder,
+		ChunkHasher:         options.ChunkHasher,
+		Layout:              internal.LayoutDigestSorted,
+		TarHeadersEndOffset: headersEndOffset,
+		DigestEncoding:      options.DigestEncoding,
+		OffsetEncoding:      options.OffsetEncoding,
+	}
+	if data := tarSplit.data(); data != nil {
+		if err := internal.WriteTarSplit(dest, uint64(dest.Count), &toc, data, level); err != nil {
+			return err
+		}
+	}
+	recordSummary(outMetadata, metadata, options)
+	return internal.WriteZstdChunkedManifest(dest, outMetadata, uint64(dest.Count), &toc, level, options.FrameMagic, options.manifestType())
+}
 
-	return internal.WriteZstdChunkedManifest(dest, outMetadata, uint64(dest.Count), metadata, level)
+// DigestedWriteCloser is implemented by the writers returned by ZstdCompressor
+// and ZstdCompressorWithOptions, which compute the digest of the blob, with
+// digest.Canonical, as they write it, so that it can be used to identify the
+// blob without reading it again.
+type DigestedWriteCloser interface {
+	io.WriteCloser
+	// Digest returns the digest of the whole blob, including the
+	// manifest and the footer, once Close returned without an error, or
+	// "" otherwise.
+	Digest() digest.Digest
 }
 
 type zstdChunkedWriter struct {
 	tarSplitOut *io.PipeWriter
 	tarSplitErr chan error
+	// blobDigest is set by the goroutine writing the blob, before it
+	// sends its result to tarSplitErr.
+	blobDigest *digest.Digest
 }
 
 func (w zstdChunkedWriter) Close() error {
@@ -167,6 +1466,10 @@ func (w zstdChunkedWriter) Close() error {
 	return w.tarSplitOut.Close()
 }
 
+func (w zstdChunkedWriter) Digest() digest.Digest {
+	return *w.blobDigest
+}
+
 func (w zstdChunkedWriter) Write(p []byte) (int, error) {
 	select {
 	case err := <-w.tarSplitErr:
@@ -177,7 +1480,7 @@ func (w zstdChunkedWriter) Write(p []byte) (int, error) {
 	}
 }
 
-// zstdChunkedWriterWithLevel writes a zstd compressed tarball where each file is
+// zstdChunkedWriterWithOptions writes a zstd compressed tarball where each file is
 // compressed separately so it can be addressed separately.  Idea based on CRFS:
 // https://github.com/google/crfs
 // The difference with CRFS is that the zstd compression is used instead of gzip.
@@ -192,12 +1495,37 @@ func (w zstdChunkedWriter) Write(p []byte) (int, error) {
 // [SKIPPABLE FRAME 1]: [ZSTD SKIPPABLE FRAME, SIZE=MANIFEST LENGTH][MANIFEST]
 // [SKIPPABLE FRAME 2]: [ZSTD SKIPPABLE FRAME, SIZE=16][MANIFEST_OFFSET][MANIFEST_LENGTH][MANIFEST_LENGTH_UNCOMPRESSED][MANIFEST_TYPE][CHUNKED_ZSTD_MAGIC_NUMBER]
 // MANIFEST_OFFSET, MANIFEST_LENGTH, MANIFEST_LENGTH_UNCOMPRESSED and CHUNKED_ZSTD_MAGIC_NUMBER are 64 bits unsigned in little endian format.
-func zstdChunkedWriterWithLevel(out io.Writer, metadata map[string]string, level int) (io.WriteCloser, error) {
+func zstdChunkedWriterWithOptions(out io.Writer, metadata map[string]string, options *Options) (io.WriteCloser, error) {
 	ch := make(chan error, 1)
 	r, w := io.Pipe()
+	blobDigest := new(digest.Digest)
+	digester := digest.Canonical.Digester()
 
 	go func() {
-		ch <- writeZstdChunkedStream(out, metadata, r, level)
+		if !options.Deadline.IsZero() {
+			// Unblock the goroutine if it is waiting for more data
+			// when the deadline expires.  Writes to the pipe fail
+			// from then on as well.
+			timer := time.AfterFunc(time.Until(options.Deadline), func() {
+				r.CloseWithError(ErrDeadlineExceeded)
+			})
+			defer timer.Stop()
+		}
+		writeStream := writeZstdChunkedStream
+		if options.SortChunksByDigest {
+			writeStream = writeZstdChunkedSortedStream
+		} else if options.ManifestFirst {
+			writeStream = writeZstdChunkedManifestFirstStream
+		}
+		err := writeStream(io.MultiWriter(out, digester.Hash()), metadata, r, options)
+		if err != nil && !options.Deadline.IsZero() && !time.Now().Before(options.Deadline) {
+			// the pipe was closed by the timer
+			err = ErrDeadlineExceeded
+		}
+		if err == nil {
+			*blobDigest = digester.Digest()
+		}
+		ch <- err
 		io.Copy(ioutil.Discard, r)
 		r.Close()
 		close(ch)
@@ -206,15 +1534,80 @@ func zstdChunkedWriterWithLevel(out io.Writer, metadata map[string]string, level
 	return zstdChunkedWriter{
 		tarSplitOut: w,
 		tarSplitErr: ch,
+		blobDigest:  blobDigest,
 	}, nil
 }
 
 // ZstdCompressor is a CompressorFunc for the zstd compression algorithm.
 func ZstdCompressor(r io.Writer, metadata map[string]string, level *int) (io.WriteCloser, error) {
-	if level == nil {
-		l := 3
-		level = &l
+	return ZstdCompressorWithOptions(r, metadata, &Options{Level: level})
+}
+
+// ZstdCompressorWithOptions is like ZstdCompressor, but it allows to
+// customize how the zstd:chunked blob is created.  The returned writer is a
+// DigestedWriteCloser.
+func ZstdCompressorWithOptions(r io.Writer, metadata map[string]string, options *Options) (io.WriteCloser, error) {
+	opts, err := completeOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	if opts.ManifestFirst && opts.SortChunksByDigest {
+		return nil, errors.New("the manifest can't be written first with SortChunksByDigest")
 	}
 
-	return zstdChunkedWriterWithLevel(r, metadata, *level)
+	return zstdChunkedWriterWithOptions(r, metadata, &opts)
+}
+
+// manifestType returns the MANIFEST_TYPE which matches the
+// ManifestCompression of options, which completeOptions validated.
+func (options *Options) manifestType() uint64 {
+	manifestType, _ := internal.ManifestTypeForCompression(options.ManifestCompression)
+	return manifestType
+}
+
+// completeOptions returns a copy of options with the defaults filled in, or
+// an error if they are not valid.
+func completeOptions(options *Options) (Options, error) {
+	opts := Options{}
+	if options != nil {
+		opts = *options
+	}
+	if opts.Level == nil {
+		l := 3
+		opts.Level = &l
+	}
+	// Fail early rather than from the goroutine writing the blob.
+	if _, err := internal.NewChunkDigester(opts.ChunkHasher); err != nil {
+		return opts, err
+	}
+	if err := internal.ValidateDigestEncoding(opts.DigestEncoding); err != nil {
+		return opts, err
+	}
+	if err := internal.ValidateOffsetEncoding(opts.OffsetEncoding); err != nil {
+		return opts, err
+	}
+	if _, err := internal.ManifestTypeForCompression(opts.ManifestCompression); err != nil {
+		return opts, err
+	}
+	if opts.FrameMagic != nil && len(opts.FrameMagic) != len(internal.ZstdChunkedFrameMagic) {
+		return opts, fmt.Errorf("frame magic %x is not %d bytes long", opts.FrameMagic, len(internal.ZstdChunkedFrameMagic))
+	}
+	if opts.Chunking != nil {
+		if err := opts.Chunking.Validate(); err != nil {
+			return opts, err
+		}
+		if opts.SortChunksByDigest {
+			return opts, errors.New("files can't be split into chunks with SortChunksByDigest")
+		}
+	}
+	if opts.ChunkThreshold < 0 {
+		return opts, fmt.Errorf("invalid chunk threshold %d", opts.ChunkThreshold)
+	}
+	if opts.SourceDir != "" && !opts.ZeroRanges {
+		return opts, errors.New("SourceDir requires ZeroRanges")
+	}
+	if err := validateExplicitBoundaries(&opts); err != nil {
+		return opts, err
+	}
+	return opts, nil
 }
@@ -0,0 +1,117 @@
+package compressor
+
+import (
+	"bytes"
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/containers/storage/pkg/chunked/internal"
+)
+
+// contentSampleSize is how many bytes from the start of a file are used to
+// find its content class.
+const contentSampleSize = 512
+
+// contentMagics lists the magic numbers of the compressed and image formats.
+var contentMagics = []struct {
+	magic []byte
+	class string
+}{
+	{[]byte{0x1f, 0x8b}, internal.ContentClassCompressed},                             // gzip
+	{[]byte{0x28, 0xb5, 0x2f, 0xfd}, internal.ContentClassCompressed},                 // zstd
+	{[]byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, internal.ContentClassCompressed},         // xz
+	{[]byte("BZh"), internal.ContentClassCompressed},                                  // bzip2
+	{[]byte{0x04, 0x22, 0x4d, 0x18}, internal.ContentClassCompressed},                 // lz4
+	{[]byte("PK\x03\x04"), internal.ContentClassCompressed},                           // zip, jar
+	{[]byte{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}, internal.ContentClassCompressed},       // 7z
+	{[]byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n'}, internal.ContentClassImage}, // png
+	{[]byte{0xff, 0xd8, 0xff}, internal.ContentClassImage},                            // jpeg
+	{[]byte("GIF87a"), internal.ContentClassImage},                                    // gif
+	{[]byte("GIF89a"), internal.ContentClassImage},                                    // gif
+}
+
+// contentExtensions lists the classes of the formats which have no magic
+// number, or which are text, by file name extension.
+var contentExtensions = map[string]string{
+	".br":   internal.ContentClassCompressed,
+	".lzma": internal.ContentClassCompressed,
+	".svg":  internal.ContentClassImage,
+}
+
+// contentSniffer keeps the start of the payload written to it, to find its
+// content class.
+type contentSniffer struct {
+	sample []byte
+	limit  int
+}
+
+// newContentSniffer returns a contentSniffer which keeps nothing unless
+// options.ContentClasses is set.
+func newContentSniffer(options *Options) *contentSniffer {
+	s := &contentSniffer{}
+	if options.ContentClasses {
+		s.limit = contentSampleSize
+	}
+	return s
+}
+
+func (s *contentSniffer) Write(p []byte) (int, error) {
+	if n := s.limit - len(s.sample); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		s.sample = append(s.sample, p[:n]...)
+	}
+	return len(p), nil
+}
+
+// class returns the content class of the file called name, or "" if nothing
+// was kept.
+func (s *contentSniffer) class(name string) string {
+	if len(s.sample) == 0 {
+		return ""
+	}
+	return contentClass(name, s.sample, len(s.sample) == s.limit)
+}
+
+// contentClass returns the content class of the file called name which
+// starts with sample, which is truncated if the file is longer.
+func contentClass(name string, sample []byte, truncated bool) string {
+	for _, m := range contentMagics {
+		if bytes.HasPrefix(sample, m.magic) {
+			return m.class
+		}
+	}
+	// webp images are RIFF files
+	if len(sample) >= 12 && bytes.Equal(sample[:4], []byte("RIFF")) && bytes.Equal(sample[8:12], []byte("WEBP")) {
+		return internal.ContentClassImage
+	}
+	if class, ok := contentExtensions[strings.ToLower(path.Ext(name))]; ok {
+		return class
+	}
+	if isText(sample, truncated) {
+		return internal.ContentClassText
+	}
+	return internal.ContentClassBinary
+}
+
+// isText tells whether sample is UTF-8 text without control characters other
+// than whitespace and escapes.  If it is truncated, it can end with an
+// incomplete character.
+func isText(sample []byte, truncated bool) bool {
+	for len(sample) > 0 {
+		r, size := utf8.DecodeRune(sample)
+		if r == utf8.RuneError && size <= 1 {
+			return truncated && !utf8.FullRune(sample)
+		}
+		if r < 0x20 && r != '\t' && r != '\n' && r != '\r' && r != '\f' && r != '\b' && r != 0x1b {
+			return false
+		}
+		if r == 0x7f {
+			return false
+		}
+		sample = sample[size:]
+	}
+	return true
+}
@@ -0,0 +1,44 @@
+package compressor
+
+// rollSum is the rolling checksum used by bup to find content-defined chunk
+// boundaries: the checksum of the last windowSize bytes can be updated in
+// constant time as each byte is added, so that a boundary can be placed
+// wherever its low bits match, independently of what came before.
+type rollSum struct {
+	s1, s2 uint32
+	window [windowSize]uint8
+	wofs   int
+}
+
+const (
+	windowSize = 64 // must be a power of 2
+	charOffset = 31
+)
+
+func newRollSum() *rollSum {
+	return &rollSum{
+		s1: windowSize * charOffset,
+		s2: windowSize * (windowSize - 1) * charOffset,
+	}
+}
+
+func (rs *rollSum) add(drop, add uint32) {
+	s1 := rs.s1 + add - drop
+	rs.s1 = s1
+	rs.s2 += s1 - uint32(windowSize)*(drop+charOffset)
+}
+
+// roll adds ch to the window, dropping the oldest byte.
+func (rs *rollSum) roll(ch byte) {
+	wp := &rs.window[rs.wofs]
+	rs.add(uint32(*wp), uint32(ch))
+	*wp = ch
+	rs.wofs = (rs.wofs + 1) & (windowSize - 1)
+}
+
+// onSplitWithBits checks if the n low bits of the checksum are all set,
+// which happens every 2^n bytes on average.
+func (rs *rollSum) onSplitWithBits(n uint32) bool {
+	mask := (uint32(1) << n) - 1
+	return rs.s2&mask == mask
+}
@@ -0,0 +1,92 @@
+package compressor
+
+import (
+	"bytes"
+	"errors"
+	"hash"
+	"hash/crc64"
+
+	"github.com/vbatts/tar-split/archive/tar"
+	"github.com/vbatts/tar-split/tar/storage"
+)
+
+// tarSplitRecorder records the tar-split metadata of a tarball as it is
+// read, in the format written by asm.NewInputTarStream, so that the tarball
+// can be reassembled from the files it contains with asm.NewOutputTarStream.
+// Its methods do nothing if it is nil.
+type tarSplitRecorder struct {
+	buf    bytes.Buffer
+	packer storage.Packer
+	crc    hash.Hash64
+
+	// failed is set if the tarball has more than one entry with the
+	// same name, which tar-split can't describe.
+	failed bool
+}
+
+// newTarSplitRecorder returns a tarSplitRecorder if options ask for the
+// tar-split metadata to be recorded, and nil otherwise.
+func newTarSplitRecorder(options *Options) *tarSplitRecorder {
+	if !options.TarSplit {
+		return nil
+	}
+	t := &tarSplitRecorder{
+		crc: crc64.New(storage.CRCTable),
+	}
+	t.packer = storage.NewJSONPacker(&t.buf)
+	return t
+}
+
+// segment records the raw bytes of the tarball which are not the payload of
+// a file: the headers of its entries and any padding.
+func (t *tarSplitRecorder) segment(p []byte) error {
+	if t == nil || t.failed || len(p) == 0 {
+		return nil
+	}
+	_, err := t.packer.AddEntry(storage.Entry{
+		Type:    storage.SegmentType,
+		Payload: p,
+	})
+	return err
+}
+
+// Write adds p to the checksum of the payload of the current entry.
+func (t *tarSplitRecorder) Write(p []byte) (int, error) {
+	return t.crc.Write(p)
+}
+
+// file records the entry for hdr, whose payload was written with Write.
+func (t *tarSplitRecorder) file(hdr *tar.Header) error {
+	if t == nil {
+		return nil
+	}
+	defer t.crc.Reset()
+	if t.failed {
+		return nil
+	}
+	entry := storage.Entry{
+		Type: storage.FileType,
+		Size: hdr.Size,
+	}
+	entry.SetName(hdr.Name)
+	if hdr.Size > 0 {
+		entry.Payload = t.crc.Sum(nil)
+	}
+	if _, err := t.packer.AddEntry(entry); err != nil {
+		if errors.Is(err, storage.ErrDuplicatePath) {
+			t.failed = true
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// data returns the tar-split metadata which was recorded, or nil if there is
+// none.
+func (t *tarSplitRecorder) data() []byte {
+	if t == nil || t.failed {
+		return nil
+	}
+	return t.buf.Bytes()
+}
@@ -0,0 +1,63 @@
+package compressor
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/containers/storage/pkg/chunked/internal"
+	"github.com/vbatts/tar-split/archive/tar"
+)
+
+// unallocatedRanges returns the ranges of the regular file hdr which are not
+// allocated in its copy under options.SourceDir, and which are within its
+// zero ranges, since the other ones have data in the tarball whatever the
+// source file says.
+func unallocatedRanges(hdr *tar.Header, zeroRanges []internal.ZeroRange, options *Options) ([]internal.ZeroRange, error) {
+	if options.SourceDir == "" || hdr.Typeflag != tar.TypeReg || len(zeroRanges) == 0 {
+		return nil, nil
+	}
+	path := filepath.Join(options.SourceDir, filepath.Clean("/"+hdr.Name))
+	info, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if !info.Mode().IsRegular() || info.Size() != hdr.Size {
+		return nil, nil
+	}
+	holes, err := fileHoles(path, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	return intersectRanges(holes, zeroRanges), nil
+}
+
+// intersectRanges returns the ranges which are covered by both a and b, which
+// are sorted by offset and don't overlap.
+func intersectRanges(a, b []internal.ZeroRange) []internal.ZeroRange {
+	var result []internal.ZeroRange
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		start, end := a[i].Offset, a[i].Offset+a[i].Length
+		if b[j].Offset > start {
+			start = b[j].Offset
+		}
+		if e := b[j].Offset + b[j].Length; e < end {
+			end = e
+		}
+		if start < end {
+			if n := len(result); n > 0 && result[n-1].Offset+result[n-1].Length == start {
+				result[n-1].Length += end - start
+			} else {
+				result = append(result, internal.ZeroRange{Offset: start, Length: end - start})
+			}
+		}
+		if a[i].Offset+a[i].Length < b[j].Offset+b[j].Length {
+			i++
+		} else {
+			j++
+		}
+	}
+	return result
+}
@@ -0,0 +1,48 @@
+package compressor
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/containers/storage/pkg/chunked/internal"
+	"golang.org/x/sys/unix"
+)
+
+// fileHoles returns the ranges of the file at path, which is size bytes long,
+// which are not allocated, as reported by SEEK_DATA and SEEK_HOLE.
+func fileHoles(path string, size int64) ([]internal.ZeroRange, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fd := int(f.Fd())
+
+	var holes []internal.ZeroRange
+	for offset := int64(0); offset < size; {
+		hole, err := unix.Seek(fd, offset, unix.SEEK_HOLE)
+		if err != nil {
+			if err == unix.ENXIO {
+				break
+			}
+			return nil, fmt.Errorf("looking for holes in %q: %w", path, err)
+		}
+		if hole >= size {
+			break
+		}
+		data, err := unix.Seek(fd, hole, unix.SEEK_DATA)
+		if err != nil {
+			if err != unix.ENXIO {
+				return nil, fmt.Errorf("looking for data in %q: %w", path, err)
+			}
+			// the rest of the file is a hole
+			data = size
+		}
+		if data > size {
+			data = size
+		}
+		holes = append(holes, internal.ZeroRange{Offset: hole, Length: data - hole})
+		offset = data
+	}
+	return holes, nil
+}
@@ -0,0 +1,13 @@
+// +build !linux
+
+package compressor
+
+import (
+	"errors"
+
+	"github.com/containers/storage/pkg/chunked/internal"
+)
+
+func fileHoles(path string, size int64) ([]internal.ZeroRange, error) {
+	return nil, errors.New("finding the unallocated ranges of files is not supported on this platform")
+}
@@ -0,0 +1,221 @@
+package chunked
+
+import (
+	"sort"
+
+	"github.com/containers/storage/pkg/chunked/internal"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// FileMetadata is an entry in the manifest of a zstd:chunked layer.
+type FileMetadata = internal.FileMetadata
+
+// chunkKey identifies the contents of a chunk.  Chunks which contain only
+// zeros are identified by their length, so that they match regardless of the
+// hasher which was used for their digest.
+type chunkKey struct {
+	digest     string
+	zeroLength int64
+}
+
+// inZeroRange checks if the specified range of a file is entirely covered by
+// one of the file's zero ranges.
+func inZeroRange(ranges []internal.ZeroRange, offset, length int64) bool {
+	for _, r := range ranges {
+		if r.Offset <= offset && offset+length <= r.Offset+r.Length {
+			return true
+		}
+	}
+	return false
+}
+
+// forEachChunk calls fn for each chunk of the regular files described by the
+// manifest entries, with the entry of the file it belongs to.
+func forEachChunk(entries []FileMetadata, fn func(file *FileMetadata, key chunkKey, size int64)) {
+	var file *FileMetadata
+	for i := range entries {
+		e := &entries[i]
+		switch e.Type {
+		case TypeReg:
+			file = e
+		case TypeChunk:
+			if file == nil {
+				continue
+			}
+		default:
+			file = nil
+			continue
+		}
+		// ChunkSize is 0 for the last chunk
+		size := e.ChunkSize
+		if size == 0 {
+			size = file.Size - e.ChunkOffset
+		}
+		if size <= 0 {
+			continue
+		}
+		var key chunkKey
+		switch {
+		case inZeroRange(file.ZeroRanges, e.ChunkOffset, size):
+			key.zeroLength = size
+		case e.ChunkDigest != "":
+			key.digest = e.ChunkDigest
+		case e.Type == TypeReg && e.Digest != "" && e.ChunkSize == 0:
+			// a file stored as a single chunk
+			key.digest = e.Digest
+		default:
+			continue
+		}
+		fn(file, key, size)
+	}
+}
+
+// layerChunks returns the size of each distinct chunk of the regular files
+// described by the manifest entries.
+func layerChunks(entries []FileMetadata) map[chunkKey]int64 {
+	chunks := make(map[chunkKey]int64)
+	forEachChunk(entries, func(_ *FileMetadata, key chunkKey, size int64) {
+		chunks[key] = size
+	})
+	return chunks
+}
+
+// EstimateDedup computes how much data the regular files of two layers, as
+// described by the entries of their manifests, have in common when they are
+// deduplicated at the chunk level.  sharedBytes is the size of the chunks
+// which are in both layers, uniqueABytes and uniqueBBytes are the sizes of
+// the chunks which are only in a or only in b.  Chunks are compared by
+// digest, except for the ones containing only zeros, which are compared by
+// length.  Each distinct chunk is counted once, even if it is repeated in a
+// layer.
+func EstimateDedup(a, b []FileMetadata) (sharedBytes, uniqueABytes, uniqueBBytes int64) {
+	chunksA := layerChunks(a)
+	chunksB := layerChunks(b)
+	for key, size := range chunksA {
+		if _, found := chunksB[key]; found {
+			sharedBytes += size
+		} else {
+			uniqueABytes += size
+		}
+	}
+	for key, size := range chunksB {
+		if _, found := chunksA[key]; !found {
+			uniqueBBytes += size
+		}
+	}
+	return sharedBytes, uniqueABytes, uniqueBBytes
+}
+
+// FilesByDigest returns the entries of the regular files described by the
+// manifest whose contents have the digest d, in the order in which they are
+// in the manifest.  Empty files, which have no digest, are never returned,
+// nor are hard links, whose entries don't record the digest of their target.
+func FilesByDigest(manifest []FileMetadata, d digest.Digest) []FileMetadata {
+	if d == "" {
+		return nil
+	}
+	var files []FileMetadata
+	for _, e := range manifest {
+		if e.Type == TypeReg && e.Digest == d.String() {
+			files = append(files, e)
+		}
+	}
+	return files
+}
+
+// SimilarityThreshold is the Jaccard similarity above which SimilarFiles
+// reports two files.
+const SimilarityThreshold = 0.5
+
+// FileRef identifies a file in one of the manifests passed to SimilarFiles.
+type FileRef struct {
+	// Manifest is the index of the manifest in the arguments.
+	Manifest int
+	// Name is the name of the file in the manifest.
+	Name string
+}
+
+// SimilarPair is a pair of files reported by SimilarFiles.
+type SimilarPair struct {
+	A, B FileRef
+	// Similarity is the Jaccard similarity of the sets of chunks of the
+	// files: the number of distinct chunks which they share, divided by
+	// the number of distinct chunks which are in either of them.
+	Similarity float64
+}
+
+// SimilarFiles finds the pairs of regular files, in the same manifest or in
+// different ones, whose sets of chunks have a Jaccard similarity above
+// SimilarityThreshold, which makes them candidates for delta encoding.
+// Chunks are compared as they are by EstimateDedup, but the ones containing
+// only zeros are ignored, since they say nothing about the contents of the
+// files.  Files with the same chunks are reported with a similarity of 1.
+// The pairs are sorted by decreasing similarity.
+func SimilarFiles(manifests ...[]FileMetadata) []SimilarPair {
+	type fileChunks struct {
+		ref    FileRef
+		chunks map[chunkKey]struct{}
+	}
+	var files []*fileChunks
+	// filesWithChunk lists the indexes in files of the files which have
+	// each chunk.
+	filesWithChunk := make(map[chunkKey][]int)
+	for m, entries := range manifests {
+		var current *fileChunks
+		var currentEntry *FileMetadata
+		forEachChunk(entries, func(file *FileMetadata, key chunkKey, size int64) {
+			if key.zeroLength != 0 {
+				return
+			}
+			if file != currentEntry {
+				currentEntry = file
+				current = &fileChunks{
+					ref:    FileRef{Manifest: m, Name: file.Name},
+					chunks: make(map[chunkKey]struct{}),
+				}
+				files = append(files, current)
+			}
+			if _, found := current.chunks[key]; !found {
+				current.chunks[key] = struct{}{}
+				filesWithChunk[key] = append(filesWithChunk[key], len(files)-1)
+			}
+		})
+	}
+
+	var pairs []SimilarPair
+	for i, file := range files {
+		// shared counts the chunks which the file shares with each of
+		// the files after it.
+		shared := make(map[int]int)
+		for key := range file.chunks {
+			for _, j := range filesWithChunk[key] {
+				if j > i {
+					shared[j]++
+				}
+			}
+		}
+		for j, n := range shared {
+			similarity := float64(n) / float64(len(file.chunks)+len(files[j].chunks)-n)
+			if similarity > SimilarityThreshold {
+				pairs = append(pairs, SimilarPair{A: file.ref, B: files[j].ref, Similarity: similarity})
+			}
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].Similarity != pairs[j].Similarity {
+			return pairs[i].Similarity > pairs[j].Similarity
+		}
+		if pairs[i].A != pairs[j].A {
+			return fileRefLess(pairs[i].A, pairs[j].A)
+		}
+		return fileRefLess(pairs[i].B, pairs[j].B)
+	})
+	return pairs
+}
+
+func fileRefLess(a, b FileRef) bool {
+	if a.Manifest != b.Manifest {
+		return a.Manifest < b.Manifest
+	}
+	return a.Name < b.Name
+}
@@ -0,0 +1,118 @@
+package chunked
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/containers/storage/pkg/chunked/internal"
+)
+
+func TestEstimateDedup(t *testing.T) {
+	a := []FileMetadata{
+		{Type: TypeDir, Name: "dir"},
+		// a file split in two chunks, the second one shared with b
+		{Type: TypeReg, Name: "dir/big", Size: 300, Digest: "sha256:big", ChunkSize: 100, ChunkDigest: "sha256:big-0"},
+		{Type: TypeChunk, Name: "dir/big", ChunkOffset: 100, ChunkDigest: "sha256:big-1"},
+		// a single-chunk file which is also in b under another name
+		{Type: TypeReg, Name: "same", Size: 50, Digest: "sha256:same", ChunkDigest: "sha256:same"},
+		// a repeated file is only counted once
+		{Type: TypeReg, Name: "same-again", Size: 50, Digest: "sha256:same", ChunkDigest: "sha256:same"},
+		// zeros are matched by length, even with a different hasher
+		{Type: TypeReg, Name: "zeros", Size: 4096, Digest: "sha256:zeros", ChunkDigest: "sha256:zeros",
+			ZeroRanges: []internal.ZeroRange{{Offset: 0, Length: 4096}}},
+		{Type: TypeLink, Name: "link", Linkname: "same"},
+		{Type: TypeReg, Name: "empty"},
+	}
+	b := []FileMetadata{
+		{Type: TypeReg, Name: "other", Size: 250, Digest: "sha256:other", ChunkSize: 50, ChunkDigest: "sha256:other-0"},
+		{Type: TypeChunk, Name: "other", ChunkOffset: 50, ChunkDigest: "sha256:big-1"},
+		{Type: TypeReg, Name: "renamed", Size: 50, Digest: "sha256:same", ChunkDigest: "sha256:same"},
+		{Type: TypeReg, Name: "zeros", Size: 4096, Digest: "sha512:zeros", ChunkDigest: "sha512:zeros",
+			ZeroRanges: []internal.ZeroRange{{Offset: 0, Length: 8192}}},
+		// same length as a zero chunk, but not zeros
+		{Type: TypeReg, Name: "data", Size: 4096, Digest: "sha256:data", ChunkDigest: "sha256:data"},
+	}
+
+	shared, uniqueA, uniqueB := EstimateDedup(a, b)
+	if shared != 200+50+4096 {
+		t.Errorf("Wrong shared size %d", shared)
+	}
+	if uniqueA != 100 {
+		t.Errorf("Wrong size %d for the chunks only in a", uniqueA)
+	}
+	if uniqueB != 50+4096 {
+		t.Errorf("Wrong size %d for the chunks only in b", uniqueB)
+	}
+
+	shared, uniqueA, uniqueB = EstimateDedup(a, nil)
+	if shared != 0 || uniqueA != 100+200+50+4096 || uniqueB != 0 {
+		t.Errorf("Wrong sizes %d, %d, %d for a layer compared with an empty one", shared, uniqueA, uniqueB)
+	}
+}
+
+func TestSimilarFiles(t *testing.T) {
+	chunked := func(name string, digests ...string) []FileMetadata {
+		entries := []FileMetadata{{Type: TypeReg, Name: name, Size: int64(100 * len(digests)), Digest: "sha256:" + name, ChunkSize: 100, ChunkDigest: digests[0]}}
+		for i, d := range digests[1:] {
+			entries = append(entries, FileMetadata{Type: TypeChunk, Name: name, ChunkOffset: int64(100 * (i + 1)), ChunkSize: 100, ChunkDigest: d})
+		}
+		return entries
+	}
+	var a, b []FileMetadata
+	a = append(a, chunked("v1", "sha256:1", "sha256:2", "sha256:3", "sha256:4")...)
+	// shares 3 of the 5 distinct chunks of both files with v1
+	a = append(a, chunked("v2", "sha256:1", "sha256:2", "sha256:3", "sha256:5")...)
+	// shares only 1 of 4 chunks with v1
+	a = append(a, chunked("unrelated", "sha256:1", "sha256:6", "sha256:7", "sha256:8")...)
+	a = append(a, FileMetadata{Type: TypeReg, Name: "zeros", Size: 4096, Digest: "sha256:zeros", ChunkDigest: "sha256:zeros",
+		ZeroRanges: []internal.ZeroRange{{Offset: 0, Length: 4096}}})
+	b = append(b, chunked("v3", "sha256:1", "sha256:2", "sha256:3", "sha256:4", "sha256:5")...)
+	// files with only zeros in common aren't similar
+	b = append(b, FileMetadata{Type: TypeReg, Name: "zeros", Size: 4096, Digest: "sha256:zeros", ChunkDigest: "sha256:zeros",
+		ZeroRanges: []internal.ZeroRange{{Offset: 0, Length: 4096}}})
+	b = append(b, FileMetadata{Type: TypeLink, Name: "link", Linkname: "v3"})
+
+	pairs := SimilarFiles(a, b)
+	expected := []SimilarPair{
+		{A: FileRef{0, "v1"}, B: FileRef{1, "v3"}, Similarity: 0.8},
+		{A: FileRef{0, "v2"}, B: FileRef{1, "v3"}, Similarity: 0.8},
+		{A: FileRef{0, "v1"}, B: FileRef{0, "v2"}, Similarity: 0.6},
+	}
+	if !reflect.DeepEqual(pairs, expected) {
+		t.Fatalf("Wrong similar files %+v, expected %+v", pairs, expected)
+	}
+
+	if pairs := SimilarFiles(a[:4]); len(pairs) != 0 {
+		t.Errorf("Unexpected similar files %+v", pairs)
+	}
+}
+
+func TestFilesByDigest(t *testing.T) {
+	manifest := []FileMetadata{
+		{Type: TypeDir, Name: "dir"},
+		{Type: TypeReg, Name: "dir/a", Size: 300, Digest: "sha256:same", ChunkSize: 100, ChunkDigest: "sha256:same-0"},
+		{Type: TypeChunk, Name: "dir/a", ChunkOffset: 100, ChunkDigest: "sha256:same-1"},
+		{Type: TypeReg, Name: "other", Size: 5, Digest: "sha256:other"},
+		{Type: TypeReg, Name: "b", Size: 300, Digest: "sha256:same"},
+		{Type: TypeLink, Name: "link", Linkname: "b"},
+		{Type: TypeReg, Name: "empty"},
+	}
+
+	files := FilesByDigest(manifest, "sha256:same")
+	if len(files) != 2 || files[0].Name != "dir/a" || files[1].Name != "b" {
+		t.Fatalf("Unexpected files %+v", files)
+	}
+	if files := FilesByDigest(manifest, "sha256:other"); len(files) != 1 || files[0].Name != "other" {
+		t.Fatalf("Unexpected files %+v", files)
+	}
+	// chunk digests are not file digests
+	if files := FilesByDigest(manifest, "sha256:same-1"); len(files) != 0 {
+		t.Fatalf("Unexpected files %+v", files)
+	}
+	if files := FilesByDigest(manifest, "sha256:missing"); len(files) != 0 {
+		t.Fatalf("Unexpected files %+v", files)
+	}
+	if files := FilesByDigest(manifest, ""); len(files) != 0 {
+		t.Fatalf("Unexpected files %+v", files)
+	}
+}
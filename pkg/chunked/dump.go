@@ -0,0 +1,198 @@
+package chunked
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// dumpNode is a file or a directory in the tree rendered by DumpManifest.
+type dumpNode struct {
+	name  string
+	entry *FileMetadata
+	// chunks lists the TypeChunk entries which follow the entry of a
+	// regular file split in several chunks.
+	chunks   []*FileMetadata
+	children []*dumpNode
+	byName   map[string]*dumpNode
+}
+
+// child returns the child of the node with the specified name, which is
+// added if it isn't there yet.
+func (n *dumpNode) child(name string) *dumpNode {
+	if c, ok := n.byName[name]; ok {
+		return c
+	}
+	if n.byName == nil {
+		n.byName = make(map[string]*dumpNode)
+	}
+	c := &dumpNode{name: name}
+	n.byName[name] = c
+	n.children = append(n.children, c)
+	return c
+}
+
+// DumpManifest writes a tree of the entries of a zstd:chunked manifest to
+// w, one line per file, with its type, mode, size, number of chunks, and a
+// shortened digest.  The chunks which follow the entry of a file in the
+// manifest are counted with it, and the directories which are only implied
+// by the names of the entries are listed without any details.  Entries are
+// listed in the order in which they first appear in the manifest.
+func DumpManifest(manifest []FileMetadata, w io.Writer) error {
+	return dumpManifest(manifest, w, false)
+}
+
+// DumpManifestVerbose is like DumpManifest, but it also writes the owners,
+// the modification times, and the whole digests, and lists the chunks of
+// each file, with their offsets in the file and in the blob.
+func DumpManifestVerbose(manifest []FileMetadata, w io.Writer) error {
+	return dumpManifest(manifest, w, true)
+}
+
+func dumpManifest(manifest []FileMetadata, w io.Writer, verbose bool) error {
+	root := &dumpNode{name: "/"}
+	var file *dumpNode
+	for i := range manifest {
+		e := &manifest[i]
+		if e.Type == TypeChunk && file != nil {
+			file.chunks = append(file.chunks, e)
+			continue
+		}
+		node := root
+		if name := strings.TrimPrefix(path.Clean("/"+e.Name), "/"); name != "" {
+			for _, component := range strings.Split(name, "/") {
+				node = node.child(component)
+			}
+		}
+		node.entry = e
+		file = nil
+		if e.Type == TypeReg {
+			file = node
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	d := &manifestDumper{w: bw, verbose: verbose}
+	d.dump(root, "", "")
+	// the first write error, if any, is kept by bw
+	return bw.Flush()
+}
+
+// manifestDumper writes the tree of a manifest.
+type manifestDumper struct {
+	w       io.Writer
+	verbose bool
+}
+
+// dump writes the line of node, after prefix, and then the lines of its
+// chunks and of its children, after childPrefix.
+func (d *manifestDumper) dump(node *dumpNode, prefix, childPrefix string) {
+	fmt.Fprintf(d.w, "%s%s\n", prefix, d.describe(node))
+	var lines []string
+	if d.verbose {
+		for i, chunk := range d.fileChunks(node) {
+			lines = append(lines, d.describeChunk(node.entry, i, chunk))
+		}
+	}
+	for i, line := range lines {
+		if i == len(lines)-1 && len(node.children) == 0 {
+			fmt.Fprintf(d.w, "%s└── %s\n", childPrefix, line)
+		} else {
+			fmt.Fprintf(d.w, "%s├── %s\n", childPrefix, line)
+		}
+	}
+	for i, child := range node.children {
+		if i == len(node.children)-1 {
+			d.dump(child, childPrefix+"└── ", childPrefix+"    ")
+		} else {
+			d.dump(child, childPrefix+"├── ", childPrefix+"│   ")
+		}
+	}
+}
+
+// fileChunks returns the entries describing the chunks of the regular file
+// at node, starting with the file's own, or nil if it isn't split.
+func (d *manifestDumper) fileChunks(node *dumpNode) []*FileMetadata {
+	e := node.entry
+	if e == nil || e.Type != TypeReg || (e.ChunkSize == 0 && len(node.chunks) == 0) {
+		return nil
+	}
+	return append([]*FileMetadata{e}, node.chunks...)
+}
+
+// describe returns the line of a node.
+func (d *manifestDumper) describe(node *dumpNode) string {
+	e := node.entry
+	name := node.name
+	if e == nil || e.Type == TypeDir {
+		if name != "/" {
+			name += "/"
+		}
+		if e == nil {
+			return name
+		}
+	}
+	details := []string{fmt.Sprintf("%s %04o", e.Type, e.Mode&07777)}
+	switch e.Type {
+	case TypeReg:
+		chunks := 0
+		if e.Size > 0 {
+			chunks = 1 + len(node.chunks)
+		}
+		plural := "s"
+		if chunks == 1 {
+			plural = ""
+		}
+		details = append(details, fmt.Sprintf("%d bytes", e.Size), fmt.Sprintf("%d chunk%s", chunks, plural))
+		if e.Digest != "" {
+			details = append(details, d.digest(e.Digest))
+		}
+	case TypeChar, TypeBlock:
+		details = append(details, fmt.Sprintf("device %d:%d", e.Devmajor, e.Devminor))
+	case TypeSymlink:
+		name += " -> " + e.Linkname
+	case TypeLink:
+		name += " => " + e.Linkname
+	}
+	if d.verbose {
+		details = append(details, fmt.Sprintf("uid %d", e.UID), fmt.Sprintf("gid %d", e.GID))
+		if !e.ModTime.IsZero() {
+			details = append(details, "modified "+e.ModTime.UTC().Format(time.RFC3339))
+		}
+		if len(e.Xattrs) > 0 {
+			details = append(details, fmt.Sprintf("%d xattrs", len(e.Xattrs)))
+		}
+	}
+	return fmt.Sprintf("%s (%s)", name, strings.Join(details, ", "))
+}
+
+// describeChunk returns the line of the i-th chunk of file.
+func (d *manifestDumper) describeChunk(file *FileMetadata, i int, chunk *FileMetadata) string {
+	// ChunkSize is 0 for the last chunk
+	size := chunk.ChunkSize
+	if size == 0 {
+		size = file.Size - chunk.ChunkOffset
+	}
+	line := fmt.Sprintf("chunk %d: %d bytes at %d", i, size, chunk.ChunkOffset)
+	if chunk.ChunkDigest != "" {
+		line += ", " + d.digest(chunk.ChunkDigest)
+	}
+	if chunk.EndOffset != 0 {
+		line += fmt.Sprintf(", blob %d-%d", chunk.Offset, chunk.EndOffset)
+	}
+	return line
+}
+
+// digest returns a digest, shortened unless the dump is verbose.
+func (d *manifestDumper) digest(digest string) string {
+	if d.verbose {
+		return digest
+	}
+	if i := strings.IndexByte(digest, ':'); i >= 0 && len(digest) > i+13 {
+		return digest[:i+13]
+	}
+	return digest
+}
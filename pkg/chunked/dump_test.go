@@ -0,0 +1,59 @@
+package chunked
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestDumpManifest(t *testing.T) {
+	modTime := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	manifest := []FileMetadata{
+		{Type: TypeDir, Name: "./", Mode: 0755},
+		{Type: TypeDir, Name: "usr/", Mode: 0755, ModTime: modTime},
+		// a file split in three chunks
+		{Type: TypeReg, Name: "usr/big", Mode: 0644, Size: 300, Digest: "sha256:0123456789abcdef", ModTime: modTime,
+			ChunkSize: 100, ChunkDigest: "sha256:aaaaaaaaaaaaaaaa", Offset: 10, EndOffset: 50},
+		{Type: TypeChunk, Name: "usr/big", ChunkOffset: 100, ChunkSize: 150, ChunkDigest: "sha256:bbbbbbbbbbbbbbbb", Offset: 50, EndOffset: 90},
+		{Type: TypeChunk, Name: "usr/big", ChunkOffset: 250, ChunkDigest: "sha256:cccccccccccccccc", Offset: 90, EndOffset: 100},
+		{Type: TypeSymlink, Name: "usr/link", Mode: 0777, Linkname: "big"},
+		// a directory which isn't in the manifest
+		{Type: TypeReg, Name: "etc/empty", Mode: 0600, UID: 1, GID: 2},
+		{Type: TypeReg, Name: "small", Mode: 04755, Size: 5, Digest: "sha256:fedcba9876543210", Offset: 100, EndOffset: 120},
+	}
+
+	var compact bytes.Buffer
+	if err := DumpManifest(manifest, &compact); err != nil {
+		t.Fatal(err)
+	}
+	expected := `/ (dir 0755)
+├── usr/ (dir 0755)
+│   ├── big (reg 0644, 300 bytes, 3 chunks, sha256:0123456789ab)
+│   └── link -> big (symlink 0777)
+├── etc/
+│   └── empty (reg 0600, 0 bytes, 0 chunks)
+└── small (reg 4755, 5 bytes, 1 chunk, sha256:fedcba987654)
+`
+	if compact.String() != expected {
+		t.Fatalf("Unexpected compact dump:\n%s\nexpected:\n%s", compact.String(), expected)
+	}
+
+	var verbose bytes.Buffer
+	if err := DumpManifestVerbose(manifest, &verbose); err != nil {
+		t.Fatal(err)
+	}
+	expected = `/ (dir 0755, uid 0, gid 0)
+├── usr/ (dir 0755, uid 0, gid 0, modified 2021-06-01T12:00:00Z)
+│   ├── big (reg 0644, 300 bytes, 3 chunks, sha256:0123456789abcdef, uid 0, gid 0, modified 2021-06-01T12:00:00Z)
+│   │   ├── chunk 0: 100 bytes at 0, sha256:aaaaaaaaaaaaaaaa, blob 10-50
+│   │   ├── chunk 1: 150 bytes at 100, sha256:bbbbbbbbbbbbbbbb, blob 50-90
+│   │   └── chunk 2: 50 bytes at 250, sha256:cccccccccccccccc, blob 90-100
+│   └── link -> big (symlink 0777, uid 0, gid 0)
+├── etc/
+│   └── empty (reg 0600, 0 bytes, 0 chunks, uid 1, gid 2)
+└── small (reg 4755, 5 bytes, 1 chunk, sha256:fedcba9876543210, uid 0, gid 0)
+`
+	if verbose.String() != expected {
+		t.Fatalf("Unexpected verbose dump:\n%s\nexpected:\n%s", verbose.String(), expected)
+	}
+}
@@ -0,0 +1,113 @@
+package chunked
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/containers/storage/pkg/chunked/internal"
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// FileSink returns the writer which receives the contents of the regular
+// file described by meta, or nil if the file must be skipped.  The writer is
+// closed once the contents were written, or when the extraction fails.
+type FileSink func(meta FileMetadata) (io.WriteCloser, error)
+
+// ExtractFiles reads the regular files of the zstd:chunked blob of the given
+// size which can be read from ra, and writes the contents of each of them,
+// in the order of the manifest, to the writer that sink returns for it.  The
+// contents of each file, and of each of its chunks, are checked against the
+// digests in the blob's manifest as they are written, and an error is
+// returned on the first mismatch, in which case the writer for that file
+// may have received only part of it.  Entries which are not regular files
+// are not passed to sink.
+func ExtractFiles(ra io.ReaderAt, size int64, sink FileSink) error {
+	toc, _, err := readZstdChunkedTOC(ra, size)
+	if err != nil {
+		return err
+	}
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return err
+	}
+	defer decoder.Close()
+
+	for i := range toc.Entries {
+		entry := &toc.Entries[i]
+		if entry.Type != internal.TypeReg {
+			continue
+		}
+		chunks := []*internal.FileMetadata{entry}
+		for j := i + 1; j < len(toc.Entries) && toc.Entries[j].Type == internal.TypeChunk; j++ {
+			chunks = append(chunks, &toc.Entries[j])
+		}
+		if err := extractFile(ra, decoder, entry, chunks, sink); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractFile writes the contents of the regular file described by entry,
+// whose chunks are listed in chunks, to the writer returned by sink.
+func extractFile(ra io.ReaderAt, decoder *zstd.Decoder, entry *internal.FileMetadata, chunks []*internal.FileMetadata, sink FileSink) error {
+	w, err := sink(*entry)
+	if err != nil {
+		return errors.Wrapf(err, "creating the output for %q", entry.Name)
+	}
+	if w == nil {
+		return nil
+	}
+	if entry.Size > 0 {
+		end := chunks[len(chunks)-1].EndOffset
+		if entry.Digest == "" || entry.Offset <= 0 || end < entry.Offset {
+			w.Close()
+			return errors.Errorf("invalid position for the payload of %q", entry.Name)
+		}
+		if err := decoder.Reset(io.NewSectionReader(ra, entry.Offset, end-entry.Offset)); err != nil {
+			w.Close()
+			return err
+		}
+		if err := verifyFileChunks(io.TeeReader(decoder, w), entry, chunks); err != nil {
+			w.Close()
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return errors.Wrapf(err, "writing %q", entry.Name)
+	}
+	return nil
+}
+
+// TreeSink returns a FileSink which recreates the regular files under dest,
+// at the paths recorded in the manifest, with the permissions recorded in it.
+// Paths are resolved within dest, so that they can't point outside of it.
+// The missing parent directories are created, with mode 0755.  The
+// unallocated ranges of the files are left as holes.
+func TreeSink(dest string) FileSink {
+	return func(meta FileMetadata) (io.WriteCloser, error) {
+		path, err := securejoin.SecureJoin(dest, meta.Name)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(meta.Mode)&os.ModePerm)
+		if err != nil {
+			return nil, err
+		}
+		if len(meta.UnallocatedRanges) == 0 {
+			return f, nil
+		}
+		sparse, err := newSparseFileWriter(f, meta.UnallocatedRanges)
+		if err != nil {
+			f.Close()
+			return nil, errors.Wrapf(err, "unallocated ranges of %q", meta.Name)
+		}
+		return sparseFileCloser{sparse}, nil
+	}
+}
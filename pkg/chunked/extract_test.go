@@ -0,0 +1,125 @@
+// +build linux
+
+package chunked
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/containers/storage/pkg/chunked/compressor"
+)
+
+// digestStore is a FileSink which stores the contents of the files by
+// digest, and skips the contents it already has.
+type digestStore struct {
+	files    map[string]string
+	requests int
+}
+
+type digestStoreWriter struct {
+	bytes.Buffer
+	store  *digestStore
+	digest string
+}
+
+func (w *digestStoreWriter) Close() error {
+	w.store.files[w.digest] = w.String()
+	return nil
+}
+
+func (s *digestStore) sink(meta FileMetadata) (io.WriteCloser, error) {
+	s.requests++
+	if _, found := s.files[meta.Digest]; found {
+		return nil, nil
+	}
+	return &digestStoreWriter{store: s, digest: meta.Digest}, nil
+}
+
+func TestExtractFilesByDigest(t *testing.T) {
+	big := randomContents(1, 1<<20)
+	files := []testFile{
+		{name: "a", contents: "hello"},
+		{name: "dir/b", contents: "hello"},
+		{name: "big", contents: big},
+		{name: "empty"},
+	}
+	params := &compressor.ChunkParams{RollsumBits: 12, MinSize: 1024, MaxSize: 16384}
+	for _, options := range []*compressor.Options{
+		nil,
+		{Chunking: params},
+		{SortChunksByDigest: true},
+	} {
+		blob, annotations := makeZstdChunkedBlob(t, files, options)
+		toc := readTestTOC(t, blob, annotations)
+		expected := make(map[string]string)
+		for _, entry := range toc.Entries {
+			if entry.Type == TypeReg {
+				expected[entry.Digest] = map[string]string{"a": "hello", "dir/b": "hello", "big": big, "empty": ""}[entry.Name]
+			}
+		}
+
+		store := &digestStore{files: make(map[string]string)}
+		if err := ExtractFiles(bytes.NewReader(blob), int64(len(blob)), store.sink); err != nil {
+			t.Fatal(err)
+		}
+		if store.requests != len(files) {
+			t.Fatalf("Sink called %d times, expected %d", store.requests, len(files))
+		}
+		if !reflect.DeepEqual(store.files, expected) {
+			t.Fatalf("Unexpected files extracted: %d of them, expected %d", len(store.files), len(expected))
+		}
+	}
+}
+
+func TestExtractFilesTree(t *testing.T) {
+	files := []testFile{
+		{name: "a", contents: "first"},
+		{name: "dir/sub/b", contents: randomContents(2, 100000)},
+		{name: "../escape", contents: "contained"},
+	}
+	blob, _ := makeZstdChunkedBlob(t, files, nil)
+
+	dest, err := ioutil.TempDir("", "chunked-extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+	if err := ExtractFiles(bytes.NewReader(blob), int64(len(blob)), TreeSink(dest)); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []testFile{files[0], files[1], {name: "escape", contents: "contained"}} {
+		path := filepath.Join(dest, f.name)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != f.contents {
+			t.Fatalf("Unexpected contents for %q", f.name)
+		}
+		st, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Mode().Perm() != 0644 {
+			t.Fatalf("Unexpected mode %v for %q", st.Mode(), f.name)
+		}
+	}
+
+	// a damaged payload is detected
+	corrupted := []byte(string(blob))
+	i := bytes.Index(blob, []byte("first"))
+	if i < 0 {
+		t.Fatal("payload not found in the blob")
+	}
+	corrupted[i] = 'F'
+	err = ExtractFiles(bytes.NewReader(corrupted), int64(len(corrupted)), TreeSink(dest))
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("Unexpected error %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+package chunked
+
+import (
+	"sort"
+)
+
+// DefaultFetchGap is the gap tolerance used by PlanFetch: fetching up to that
+// many unneeded bytes between two ranges costs less than making another
+// request for the second one.
+const DefaultFetchGap = 4096
+
+// ByteRange is a range of a blob.
+type ByteRange struct {
+	Offset int64
+	Length int64
+}
+
+// PlanFetch returns the ranges of a zstd:chunked blob which have to be
+// retrieved to get the contents of the regular files with the specified
+// names, as described by the entries of its manifest, sorted by offset.  The
+// ranges which overlap, or which are separated by no more than
+// DefaultFetchGap bytes, are merged.
+func PlanFetch(manifest []FileMetadata, names []string) []ByteRange {
+	return PlanFetchWithGap(manifest, names, DefaultFetchGap)
+}
+
+// PlanFetchWithGap is like PlanFetch, but it merges the ranges which are
+// separated by no more than maxGap bytes.  With a maxGap of 0, only the
+// ranges which overlap or are adjacent are merged.  Names which don't refer
+// to regular files with contents in the blob, or to hard links to them, are
+// ignored.
+func PlanFetchWithGap(manifest []FileMetadata, names []string, maxGap int64) []ByteRange {
+	index := BuildFlatIndex(manifest)
+	var ranges []ByteRange
+	for _, name := range names {
+		for _, c := range index[name].Chunks {
+			if c.FrameLength > 0 {
+				ranges = append(ranges, ByteRange{Offset: c.BlobOffset, Length: c.FrameLength})
+			}
+		}
+	}
+	if len(ranges) == 0 {
+		return nil
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].Offset < ranges[j].Offset
+	})
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		end := last.Offset + last.Length
+		if r.Offset-end > maxGap {
+			merged = append(merged, r)
+			continue
+		}
+		if rEnd := r.Offset + r.Length; rEnd > end {
+			last.Length = rEnd - last.Offset
+		}
+	}
+	return merged
+}
@@ -0,0 +1,54 @@
+package chunked
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlanFetch(t *testing.T) {
+	manifest := []FileMetadata{
+		{Type: TypeDir, Name: "dir"},
+		{Type: TypeReg, Name: "dir/a", Size: 10, Offset: 100, EndOffset: 120},
+		{Type: TypeReg, Name: "dir/b", Size: 10, Offset: 120, EndOffset: 140},
+		{Type: TypeReg, Name: "dir/c", Size: 10, Offset: 140, EndOffset: 160},
+		{Type: TypeReg, Name: "empty"},
+		{Type: TypeReg, Name: "multi", Size: 250, Offset: 1000, EndOffset: 1030, ChunkSize: 100},
+		{Type: TypeChunk, Name: "multi", Offset: 1030, EndOffset: 1050, ChunkOffset: 100, ChunkSize: 100},
+		{Type: TypeChunk, Name: "multi", Offset: 1050, EndOffset: 1060, ChunkOffset: 200},
+		{Type: TypeReg, Name: "far", Size: 10, Offset: 10000, EndOffset: 10020},
+		{Type: TypeReg, Name: "near-far", Size: 10, Offset: 10100, EndOffset: 10120},
+		// stores the same contents as dir/b, as with LayoutDigestSorted
+		{Type: TypeReg, Name: "same-as-b", Size: 10, Offset: 120, EndOffset: 140},
+		{Type: TypeLink, Name: "link", Linkname: "far"},
+		{Type: TypeSymlink, Name: "symlink", Linkname: "far"},
+	}
+	for _, c := range []struct {
+		names    []string
+		maxGap   int64
+		expected []ByteRange
+	}{
+		// clustered files are fetched with a single range
+		{[]string{"dir/a", "dir/b", "dir/c"}, 0, []ByteRange{{100, 60}}},
+		{[]string{"dir/c", "dir/a"}, 0, []ByteRange{{100, 20}, {140, 20}}},
+		{[]string{"dir/c", "dir/a"}, 20, []ByteRange{{100, 60}}},
+		// scattered files are fetched separately, in order
+		{[]string{"far", "multi", "dir/a"}, 0, []ByteRange{{100, 20}, {1000, 60}, {10000, 20}}},
+		{[]string{"far", "near-far"}, 79, []ByteRange{{10000, 20}, {10100, 20}}},
+		{[]string{"far", "near-far"}, 80, []ByteRange{{10000, 120}}},
+		{[]string{"multi", "dir/a"}, DefaultFetchGap, []ByteRange{{100, 960}}},
+		// shared frames and links are fetched once
+		{[]string{"dir/b", "same-as-b", "link", "far"}, 0, []ByteRange{{120, 20}, {10000, 20}}},
+		{[]string{"multi", "multi"}, 0, []ByteRange{{1000, 60}}},
+		// names without contents in the blob are ignored
+		{[]string{"dir", "empty", "symlink", "missing"}, 0, nil},
+		{nil, 0, nil},
+	} {
+		if ranges := PlanFetchWithGap(manifest, c.names, c.maxGap); !reflect.DeepEqual(ranges, c.expected) {
+			t.Fatalf("Ranges for %v with gap %d are %v, expected %v", c.names, c.maxGap, ranges, c.expected)
+		}
+	}
+
+	if ranges := PlanFetch(manifest, []string{"dir/a", "multi", "far"}); !reflect.DeepEqual(ranges, []ByteRange{{100, 960}, {10000, 20}}) {
+		t.Fatalf("Wrong ranges %v with the default gap", ranges)
+	}
+}
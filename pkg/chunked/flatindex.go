@@ -0,0 +1,96 @@
+package chunked
+
+import (
+	"sort"
+)
+
+// ChunkLocation is the position of one of the chunks of a file in a
+// zstd:chunked blob.
+type ChunkLocation struct {
+	// FileOffset is the offset of the chunk in the file.
+	FileOffset int64
+	// BlobOffset and FrameLength are the position and the length of the
+	// zstd frame in the blob which holds the chunk.
+	BlobOffset  int64
+	FrameLength int64
+	// UncompressedSize is the length of the chunk after the frame is
+	// decompressed.
+	UncompressedSize int64
+}
+
+// FileLocation lists where the contents of a regular file are stored in a
+// zstd:chunked blob.
+type FileLocation struct {
+	// Size is the size of the file.
+	Size int64
+	// Chunks are the file's chunks, sorted by FileOffset.  It is empty
+	// for empty files.
+	Chunks []ChunkLocation
+}
+
+// BuildFlatIndex returns the location of the contents of every regular file
+// described by the entries of a zstd:chunked manifest, by name, so that
+// reads from a file can be mapped to ranges of the blob without the rest of
+// the manifest.  Hard links to regular files are listed with the location
+// of their targets.  If a name appears more than once, the last entry wins,
+// as it would when the layer is extracted.
+func BuildFlatIndex(manifest []FileMetadata) map[string]FileLocation {
+	index := make(map[string]FileLocation)
+	var file *FileMetadata
+	var location *FileLocation
+	addChunk := func(e *FileMetadata) {
+		// ChunkSize is 0 for the last chunk
+		size := e.ChunkSize
+		if size == 0 {
+			size = file.Size - e.ChunkOffset
+		}
+		if size <= 0 {
+			return
+		}
+		location.Chunks = append(location.Chunks, ChunkLocation{
+			FileOffset:       e.ChunkOffset,
+			BlobOffset:       e.Offset,
+			FrameLength:      e.EndOffset - e.Offset,
+			UncompressedSize: size,
+		})
+	}
+	flush := func() {
+		if file != nil {
+			sort.Slice(location.Chunks, func(i, j int) bool {
+				return location.Chunks[i].FileOffset < location.Chunks[j].FileOffset
+			})
+			index[file.Name] = *location
+		}
+		file, location = nil, nil
+	}
+	var links []*FileMetadata
+	for i := range manifest {
+		e := &manifest[i]
+		switch e.Type {
+		case TypeReg:
+			flush()
+			file = e
+			location = &FileLocation{Size: e.Size}
+			addChunk(e)
+		case TypeChunk:
+			if file != nil {
+				addChunk(e)
+			}
+		default:
+			flush()
+			if e.Type == TypeLink {
+				links = append(links, e)
+			} else {
+				// anything else replaces a regular file with the same name
+				delete(index, e.Name)
+			}
+		}
+	}
+	flush()
+	for _, link := range links {
+		if target, ok := index[link.Linkname]; ok {
+			index[link.Name] = target
+		}
+	}
+	return index
+}
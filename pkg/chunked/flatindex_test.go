@@ -0,0 +1,44 @@
+package chunked
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBuildFlatIndex(t *testing.T) {
+	manifest := []FileMetadata{
+		{Type: TypeDir, Name: "dir"},
+		{Type: TypeReg, Name: "dir/single", Size: 10, Digest: "sha256:single", Offset: 100, EndOffset: 120},
+		{Type: TypeReg, Name: "dir/multi", Size: 250, Digest: "sha256:multi", Offset: 120, EndOffset: 150, ChunkSize: 100},
+		{Type: TypeChunk, Name: "dir/multi", Offset: 150, EndOffset: 170, ChunkOffset: 100, ChunkSize: 100},
+		{Type: TypeChunk, Name: "dir/multi", Offset: 170, EndOffset: 180, ChunkOffset: 200},
+		{Type: TypeReg, Name: "empty"},
+		{Type: TypeLink, Name: "link", Linkname: "dir/multi"},
+		{Type: TypeSymlink, Name: "symlink", Linkname: "dir/single"},
+		// replaced by a later entry
+		{Type: TypeReg, Name: "replaced", Size: 5, Offset: 180, EndOffset: 190},
+		{Type: TypeReg, Name: "replaced", Size: 6, Offset: 190, EndOffset: 200},
+		{Type: TypeReg, Name: "now-a-dir", Size: 5, Offset: 200, EndOffset: 210},
+		{Type: TypeDir, Name: "now-a-dir"},
+	}
+	multi := FileLocation{
+		Size: 250,
+		Chunks: []ChunkLocation{
+			{FileOffset: 0, BlobOffset: 120, FrameLength: 30, UncompressedSize: 100},
+			{FileOffset: 100, BlobOffset: 150, FrameLength: 20, UncompressedSize: 100},
+			{FileOffset: 200, BlobOffset: 170, FrameLength: 10, UncompressedSize: 50},
+		},
+	}
+	expected := map[string]FileLocation{
+		"dir/single": {Size: 10, Chunks: []ChunkLocation{{FileOffset: 0, BlobOffset: 100, FrameLength: 20, UncompressedSize: 10}}},
+		"dir/multi":  multi,
+		"empty":      {},
+		"link":       multi,
+		"replaced":   {Size: 6, Chunks: []ChunkLocation{{FileOffset: 0, BlobOffset: 190, FrameLength: 10, UncompressedSize: 6}}},
+	}
+
+	index := BuildFlatIndex(manifest)
+	if !reflect.DeepEqual(index, expected) {
+		t.Fatalf("Wrong index %+v", index)
+	}
+}
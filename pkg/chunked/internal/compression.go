@@ -7,10 +7,15 @@ package internal
 import (
 	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"io/ioutil"
+	"sync"
 	"time"
 
 	"github.com/klauspost/compress/zstd"
@@ -20,8 +25,81 @@ import (
 type TOC struct {
 	Version int            `json:"version"`
 	Entries []FileMetadata `json:"entries"`
+
+	// Prefetch lists the names of the files which should be retrieved
+	// first when the layer is pulled lazily, in the order they are needed.
+	Prefetch []string `json:"prefetch,omitempty"`
+
+	// ChunkHasher is the name of the hasher used for the file and chunk
+	// digests.  If empty, DefaultChunkHasher was used.
+	ChunkHasher string `json:"chunkHasher,omitempty"`
+
+	// Layout is how the payloads of the files are stored in the blob,
+	// either LayoutSequential, LayoutDigestSorted or LayoutShared.
+	Layout string `json:"layout,omitempty"`
+
+	// TarHeadersEndOffset is, with LayoutDigestSorted, the end of the
+	// frame at the start of the blob which holds the tar headers.
+	TarHeadersEndOffset int64 `json:"tarHeadersEndOffset,omitempty"`
+
+	// DigestEncoding, if set, is how the digests of the entries are
+	// encoded in the manifest, without the name of the hasher, either
+	// DigestEncodingHex or DigestEncodingBase64.  The digests are
+	// converted when the TOC is encoded and decoded, so they are always
+	// complete in memory.
+	DigestEncoding string `json:"digestEncoding,omitempty"`
+
+	// OffsetEncoding, if set, is how the offsets of the entries are
+	// encoded in the manifest, either absolute, if empty, or
+	// OffsetEncodingDelta.  Like the digests, they are converted when the
+	// TOC is encoded and decoded.
+	OffsetEncoding string `json:"offsetEncoding,omitempty"`
+
+	// TarSplitOffset and TarSplitLength are, if TarSplitLength is not 0,
+	// the position in the blob of the tar-split metadata of the tarball,
+	// compressed with zstd in a skippable frame, which allows the tarball
+	// to be reassembled from the files it contains.  TarSplitDigest is
+	// the digest of the compressed bytes, and TarSplitUncompressedSize
+	// their size once decompressed.
+	TarSplitOffset           int64  `json:"tarSplitOffset,omitempty"`
+	TarSplitLength           int64  `json:"tarSplitLength,omitempty"`
+	TarSplitUncompressedSize int64  `json:"tarSplitUncompressedSize,omitempty"`
+	TarSplitDigest           string `json:"tarSplitDigest,omitempty"`
 }
 
+const (
+	// LayoutSequential stores the payload of each file right after its
+	// tar header, so that the whole blob is a zstd compressed tarball.
+	LayoutSequential = ""
+
+	// LayoutDigestSorted stores each distinct payload only once, in its
+	// own frame, with the frames sorted by the digest of their contents,
+	// so that they can be stored as separate objects keyed by digest.
+	// The manifest entries of the files with the same contents refer to
+	// the same frame.  The rest of the tarball is stored in a single frame
+	// at the start of the blob, as a sequence of records made of a uvarint
+	// length followed by that many bytes of the tarball: one for the data
+	// preceding the payload of each entry, and a last one for the end of
+	// the archive.
+	LayoutDigestSorted = "digest-sorted"
+
+	// LayoutShared stores the payloads like LayoutSequential, except that
+	// each chunk is stored only once in a blob which holds several
+	// tarballs, each with its own manifest, so the manifest entries may
+	// refer to frames which precede the tarball, or to the same frame as
+	// other entries.  The tarball can't be rebuilt by decompressing the
+	// blob.
+	LayoutShared = "shared"
+)
+
+// FileMetadata describes an entry in the manifest.
+//
+// ModTime, AccessTime and ChangeTime are encoded as RFC 3339 strings in UTC,
+// so times before the epoch are stored as they are, e.g. as
+// "1900-01-01T00:00:00Z", and the epoch itself as "1970-01-01T00:00:00Z".
+// Times outside of the years 0 to 9999, which can't be encoded that way, are
+// clamped to that range.  The zero time.Time, "0001-01-01T00:00:00Z", means
+// that the time is not known, and it is not applied to extracted files.
 type FileMetadata struct {
 	Type       string            `json:"type"`
 	Name       string            `json:"name"`
@@ -44,6 +122,103 @@ type FileMetadata struct {
 	ChunkSize   int64  `json:"chunkSize,omitempty"`
 	ChunkOffset int64  `json:"chunkOffset,omitempty"`
 	ChunkDigest string `json:"chunkDigest,omitempty"`
+
+	// ZeroRanges lists the ranges of a regular file which contain only
+	// zeros, sorted by offset, so that they can be left as holes when the
+	// file is extracted.
+	ZeroRanges []ZeroRange `json:"zeroRanges,omitempty"`
+
+	// UnallocatedRanges lists the ranges of a regular file which were not
+	// allocated in the file which the tarball was created from, as
+	// opposed to allocated and filled with zeros, sorted by offset.  They
+	// are within ZeroRanges, and they are left as holes when the file is
+	// extracted, even when the other zero ranges are written out.
+	UnallocatedRanges []ZeroRange `json:"unallocatedRanges,omitempty"`
+
+	// XattrsDropped is set if some of the extended attributes of the
+	// entry were left out of Xattrs because they were too big.
+	XattrsDropped bool `json:"xattrsDropped,omitempty"`
+
+	// CompressedDigest, if set, is the digest of the bytes of the blob
+	// from Offset to EndOffset, which is the compressed chunk.
+	CompressedDigest string `json:"compressedDigest,omitempty"`
+
+	// CompressedSize, if set on the entry of a regular file, is the number
+	// of bytes of the blob taken by the frames of all of its chunks, so
+	// that the cost of storing and transferring the file can be told.
+	CompressedSize int64 `json:"compressedSize,omitempty"`
+
+	// ContentClass, if set, is a coarse guess of the kind of contents of
+	// a regular file, one of the ContentClass constants, made from the
+	// start of its contents or from its name, to help choosing how to
+	// compress or transfer it.
+	ContentClass string `json:"contentClass,omitempty"`
+
+	// EmptyDir is set on the entries of directories which had no entries
+	// under them in the tarball, when the blob was created with the
+	// compressor's MarkEmptyDirs option, so that their emptiness can be
+	// preserved when the layer is applied.
+	EmptyDir bool `json:"emptyDir,omitempty"`
+
+	// ChangeToken, if set, is computed by ChangeToken from the other
+	// fields of the entry which were read from its tar header, so that a
+	// tool rebuilding the layer from a source tree can tell the files
+	// which may have changed without hashing their contents.
+	ChangeToken string `json:"changeToken,omitempty"`
+}
+
+// ChangeToken returns a token which changes when the type, link target,
+// size, mode, owner, modification time or change time of the entry do.  It
+// is cheap to compute, and it doesn't depend on the contents of the file.
+func ChangeToken(e *FileMetadata) string {
+	unixNano := func(t time.Time) int64 {
+		if t.IsZero() {
+			return 0
+		}
+		return t.UnixNano()
+	}
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s\x00%s\x00%d:%o:%d:%d:%d:%d", e.Type, e.Linkname, e.Size, e.Mode, e.UID, e.GID, unixNano(e.ModTime), unixNano(e.ChangeTime))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+const (
+	// ContentClassText is for files made of UTF-8 text.
+	ContentClassText = "text"
+	// ContentClassBinary is for files which are none of the others.
+	ContentClassBinary = "binary"
+	// ContentClassCompressed is for files which are already compressed,
+	// such as gzip, zstd or zip files.
+	ContentClassCompressed = "compressed"
+	// ContentClassImage is for image files, such as PNG or JPEG files.
+	ContentClassImage = "image"
+)
+
+// ZeroRange is a range of a file which contains only zeros.
+type ZeroRange struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// ZeroRangeBlockSize is the granularity of the ranges recorded in
+// FileMetadata.ZeroRanges.
+const ZeroRangeBlockSize = 4096
+
+var zeroBlock [ZeroRangeBlockSize]byte
+
+// IsZero checks if data contains only zeros.
+func IsZero(data []byte) bool {
+	for len(data) > 0 {
+		n := len(data)
+		if n > len(zeroBlock) {
+			n = len(zeroBlock)
+		}
+		if !bytes.Equal(data[:n], zeroBlock[:n]) {
+			return false
+		}
+		data = data[n:]
+	}
+	return true
 }
 
 const (
@@ -80,9 +255,23 @@ const (
 	ManifestChecksumKey = "io.containers.zstd-chunked.manifest-checksum"
 	ManifestInfoKey     = "io.containers.zstd-chunked.manifest-position"
 
+	// ManifestFrameMagicKey records, in hex, the magic number used in the
+	// footer when it is not ZstdChunkedFrameMagic.
+	ManifestFrameMagicKey = "io.containers.zstd-chunked.frame-magic"
+
+	// ManifestSummaryKey records the number of entries in the tarball
+	// and the total size of its files, as "ENTRIES:SIZE".
+	ManifestSummaryKey = "io.containers.zstd-chunked.summary"
+
 	// ManifestTypeCRFS is a manifest file compatible with the CRFS TOC file.
 	ManifestTypeCRFS = 1
 
+	// ManifestTypeCRFSGzip is a manifest file compatible with the CRFS TOC
+	// file, compressed with gzip instead of zstd, for the tools which can
+	// only read it with a gzip decompressor.  The rest of the blob is
+	// still compressed with zstd.
+	ManifestTypeCRFSGzip = 2
+
 	// FooterSizeSupported is the footer size supported by this implementation.
 	// Newer versions of the image format might increase this value, so reject
 	// any version that is not supported.
@@ -96,8 +285,59 @@ var (
 	skippableFrameMagic = []byte{0x50, 0x2a, 0x4d, 0x18}
 
 	ZstdChunkedFrameMagic = []byte{0x47, 0x6e, 0x55, 0x6c, 0x49, 0x6e, 0x55, 0x78}
+
+	// ZstdChunkedManifestFirstMagic is the magic number of the header of
+	// the blobs which have their manifest at the start, so that it can be
+	// read without seeking to the end of the blob.  The header is a zstd
+	// skippable frame at the start of the blob, laid out like the footer,
+	// which is followed by a skippable frame holding the compressed
+	// manifest, padded with zeros, and then by the rest of the blob, which
+	// ends with the usual footer.
+	ZstdChunkedManifestFirstMagic = []byte{0x47, 0x6e, 0x55, 0x6c, 0x48, 0x64, 0x52, 0x78}
+
+	frameMagicsLock sync.RWMutex
+	frameMagics     = [][]byte{ZstdChunkedFrameMagic}
 )
 
+// RegisterFrameMagic adds magic to the magic numbers which are accepted in
+// the footer of a blob, in addition to ZstdChunkedFrameMagic.  It panics if
+// magic is not 8 bytes long, or if it is already known.
+func RegisterFrameMagic(magic []byte) {
+	if len(magic) != len(ZstdChunkedFrameMagic) {
+		panic(fmt.Sprintf("frame magic %x is not %d bytes long", magic, len(ZstdChunkedFrameMagic)))
+	}
+	frameMagicsLock.Lock()
+	defer frameMagicsLock.Unlock()
+	for _, m := range frameMagics {
+		if bytes.Equal(m, magic) {
+			panic(fmt.Sprintf("frame magic %x registered twice", magic))
+		}
+	}
+	frameMagics = append(frameMagics, append([]byte{}, magic...))
+}
+
+// IsFrameMagic checks if data starts with ZstdChunkedFrameMagic or with one
+// of the magic numbers added with RegisterFrameMagic.
+func IsFrameMagic(data []byte) bool {
+	if len(data) < len(ZstdChunkedFrameMagic) {
+		return false
+	}
+	frameMagicsLock.RLock()
+	defer frameMagicsLock.RUnlock()
+	for _, m := range frameMagics {
+		if bytes.Equal(m, data[:len(m)]) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsSkippableFrameMagic checks if data starts with the magic number of the
+// zstd skippable frames written by appendZstdSkippableFrame.
+func IsSkippableFrameMagic(data []byte) bool {
+	return bytes.HasPrefix(data, skippableFrameMagic)
+}
+
 func appendZstdSkippableFrame(dest io.Writer, data []byte) error {
 	if _, err := dest.Write(skippableFrameMagic); err != nil {
 		return err
@@ -114,35 +354,254 @@ func appendZstdSkippableFrame(dest io.Writer, data []byte) error {
 	return nil
 }
 
-func WriteZstdChunkedManifest(dest io.Writer, outMetadata map[string]string, offset uint64, metadata []FileMetadata, level int) error {
+// IsManifestType checks if manifestType is a type of manifest which this
+// implementation can read.
+func IsManifestType(manifestType uint64) bool {
+	return manifestType == ManifestTypeCRFS || manifestType == ManifestTypeCRFSGzip
+}
+
+// ManifestTypeForCompression returns the type of the manifests compressed
+// with compression, either "zstd" or "gzip".  An empty compression stands for
+// "zstd".
+func ManifestTypeForCompression(compression string) (uint64, error) {
+	switch compression {
+	case "", "zstd":
+		return ManifestTypeCRFS, nil
+	case "gzip":
+		return ManifestTypeCRFSGzip, nil
+	default:
+		return 0, fmt.Errorf("unknown manifest compression %q", compression)
+	}
+}
+
+// WriteZstdChunkedManifest appends the manifest and the footer to dest,
+// using magic as the magic number in the footer, or ZstdChunkedFrameMagic if
+// it is nil.  The manifest is compressed as manifestType requires, or as for
+// ManifestTypeCRFS if it is 0.
+func WriteZstdChunkedManifest(dest io.Writer, outMetadata map[string]string, offset uint64, toc *TOC, level int, magic []byte, manifestType uint64) error {
+	if magic == nil {
+		magic = ZstdChunkedFrameMagic
+	}
+	if len(magic) != len(ZstdChunkedFrameMagic) {
+		return fmt.Errorf("frame magic %x is not %d bytes long", magic, len(ZstdChunkedFrameMagic))
+	}
+	if manifestType == 0 {
+		manifestType = ManifestTypeCRFS
+	}
+
 	// 8 is the size of the zstd skippable frame header + the frame size
 	manifestOffset := offset + 8
 
-	toc := TOC{
-		Version: 1,
-		Entries: metadata,
+	// the caller's TOC is left alone
+	tocCopy := *toc
+	toc = &tocCopy
+	if toc.Version == 0 {
+		toc.Version = toc.MinimumVersion()
 	}
 
-	// Generate the manifest
-	manifest, err := json.Marshal(toc)
+	manifest, compressedManifest, err := compressManifest(toc, level, manifestType)
 	if err != nil {
 		return err
 	}
+	if err := recordManifest(outMetadata, manifestOffset, manifest, compressedManifest, magic, manifestType); err != nil {
+		return err
+	}
+	if err := appendZstdSkippableFrame(dest, compressedManifest); err != nil {
+		return err
+	}
 
-	var compressedBuffer bytes.Buffer
-	zstdWriter, err := ZstdWriterWithLevel(&compressedBuffer, level)
+	return WriteZstdChunkedFooter(dest, manifestOffset, uint64(len(compressedManifest)), uint64(len(manifest)), magic, manifestType)
+}
+
+// WriteTarSplit appends to dest, which is at offset in the blob, a skippable
+// frame holding tarSplit, the tar-split metadata of the tarball, compressed
+// with zstd at level, and records its position in toc.
+func WriteTarSplit(dest io.Writer, offset uint64, toc *TOC, tarSplit []byte, level int) error {
+	var compressed bytes.Buffer
+	encoder, err := ZstdWriterWithLevel(&compressed, level)
 	if err != nil {
 		return err
 	}
-	if _, err := zstdWriter.Write(manifest); err != nil {
-		zstdWriter.Close()
+	if _, err := encoder.Write(tarSplit); err != nil {
+		encoder.Close()
+		return err
+	}
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+	if err := appendZstdSkippableFrame(dest, compressed.Bytes()); err != nil {
+		return err
+	}
+	// 8 is the size of the zstd skippable frame header + the frame size
+	toc.TarSplitOffset = int64(offset) + 8
+	toc.TarSplitLength = int64(compressed.Len())
+	toc.TarSplitUncompressedSize = int64(len(tarSplit))
+	toc.TarSplitDigest = digest.FromBytes(compressed.Bytes()).String()
+	return nil
+}
+
+// WriteZstdChunkedManifestFirst writes to dest a blob made of the body of a
+// zstd:chunked blob, which is bodySize bytes long and whose payloads are at
+// the offsets recorded in toc relative to the start of body, preceded by the
+// header and the manifest, as described for ZstdChunkedManifestFirstMagic, and
+// followed by the footer, which uses magic as the magic number, or
+// ZstdChunkedFrameMagic if it is nil.  The offsets in the manifest are
+// adjusted for the position of body in the blob.  The manifest is compressed
+// as manifestType requires, or as for ManifestTypeCRFS if it is 0.
+func WriteZstdChunkedManifestFirst(dest io.Writer, outMetadata map[string]string, toc *TOC, body io.Reader, bodySize int64, level int, magic []byte, manifestType uint64) error {
+	if magic == nil {
+		magic = ZstdChunkedFrameMagic
+	}
+	if len(magic) != len(ZstdChunkedFrameMagic) {
+		return fmt.Errorf("frame magic %x is not %d bytes long", magic, len(ZstdChunkedFrameMagic))
+	}
+	if manifestType == 0 {
+		manifestType = ManifestTypeCRFS
+	}
+	if toc.Layout != LayoutSequential {
+		return fmt.Errorf("the manifest can't be written first with layout %q", toc.Layout)
+	}
+	// the caller's TOC is left alone
+	tocCopy := *toc
+	toc = &tocCopy
+	if toc.Version == 0 {
+		toc.Version = toc.MinimumVersion()
+	}
+
+	// The offsets in the manifest depend on the size of the manifest,
+	// which depends on them, so room is reserved for it and grown until
+	// it fits.
+	const headerSize = 8 + FooterSizeSupported
+	manifestOffset := uint64(headerSize + 8)
+	entries := toc.Entries
+	tarSplitOffset := toc.TarSplitOffset
+	var manifest, compressedManifest []byte
+	reserved := 0
+	for {
+		bodyOffset := int64(manifestOffset) + int64(reserved)
+		if toc.TarSplitLength != 0 {
+			toc.TarSplitOffset = tarSplitOffset + bodyOffset
+		}
+		shifted := make([]FileMetadata, len(entries))
+		copy(shifted, entries)
+		for i := range shifted {
+			if shifted[i].EndOffset != 0 {
+				shifted[i].Offset += bodyOffset
+				shifted[i].EndOffset += bodyOffset
+			}
+		}
+		toc.Entries = shifted
+		var err error
+		if manifest, compressedManifest, err = compressManifest(toc, level, manifestType); err != nil {
+			return err
+		}
+		if len(compressedManifest) <= reserved {
+			break
+		}
+		reserved = len(compressedManifest) + len(compressedManifest)/64 + 64
+	}
+
+	if err := recordManifest(outMetadata, manifestOffset, manifest, compressedManifest, magic, manifestType); err != nil {
+		return err
+	}
+	if err := WriteZstdChunkedFooter(dest, manifestOffset, uint64(len(compressedManifest)), uint64(len(manifest)), ZstdChunkedManifestFirstMagic, manifestType); err != nil {
+		return err
+	}
+	// the reserved room which the manifest doesn't use is left as zeros
+	padded := make([]byte, reserved)
+	copy(padded, compressedManifest)
+	if err := appendZstdSkippableFrame(dest, padded); err != nil {
 		return err
 	}
-	if err := zstdWriter.Close(); err != nil {
+	if _, err := io.CopyN(dest, body, bodySize); err != nil {
 		return err
 	}
-	compressedManifest := compressedBuffer.Bytes()
+	return WriteZstdChunkedFooter(dest, manifestOffset, uint64(len(compressedManifest)), uint64(len(manifest)), magic, manifestType)
+}
+
+// DefaultMaxManifestSize is the default limit for the size of a manifest,
+// both compressed and uncompressed.  Readers reject bigger manifests, so
+// they are never written.
+const DefaultMaxManifestSize = 50 << 20
+
+// DecompressManifest decompresses the manifest in compressed, which is of
+// type manifestType and is declared to be lengthUncompressed bytes long once
+// decompressed.  It fails if the declared length is more than limit, or if
+// the manifest turns out to be longer than declared, in which case the
+// decompression stops as soon as the declared length is exceeded.
+func DecompressManifest(compressed []byte, lengthUncompressed, limit, manifestType uint64) ([]byte, error) {
+	if lengthUncompressed > limit {
+		return nil, fmt.Errorf("manifest too big: %d bytes declared, the limit is %d", lengthUncompressed, limit)
+	}
+	var decoder io.Reader
+	switch manifestType {
+	case ManifestTypeCRFS:
+		zstdDecoder, err := zstd.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, err
+		}
+		defer zstdDecoder.Close()
+		decoder = zstdDecoder
+	case ManifestTypeCRFSGzip:
+		gzipDecoder, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, fmt.Errorf("decompressing the manifest: %w", err)
+		}
+		defer gzipDecoder.Close()
+		decoder = gzipDecoder
+	default:
+		return nil, fmt.Errorf("unknown manifest type %d", manifestType)
+	}
+	manifest, err := ioutil.ReadAll(io.LimitReader(decoder, int64(lengthUncompressed)+1))
+	if err != nil {
+		return nil, fmt.Errorf("decompressing the manifest: %w", err)
+	}
+	if uint64(len(manifest)) > lengthUncompressed {
+		return nil, fmt.Errorf("the manifest is longer than its declared length of %d bytes", lengthUncompressed)
+	}
+	return manifest, nil
+}
+
+// compressManifest encodes toc, and returns it along with its version
+// compressed as manifestType requires.  level is the zstd compression level;
+// gzip always uses its default level.
+func compressManifest(toc *TOC, level int, manifestType uint64) ([]byte, []byte, error) {
+	manifest, err := json.Marshal(toc)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(manifest) > DefaultMaxManifestSize {
+		return nil, nil, fmt.Errorf("the manifest is %d bytes long, more than the limit of %d", len(manifest), DefaultMaxManifestSize)
+	}
+
+	var compressedBuffer bytes.Buffer
+	var writer io.WriteCloser
+	switch manifestType {
+	case ManifestTypeCRFS:
+		if writer, err = ZstdWriterWithLevel(&compressedBuffer, level); err != nil {
+			return nil, nil, err
+		}
+	case ManifestTypeCRFSGzip:
+		writer = gzip.NewWriter(&compressedBuffer)
+	default:
+		return nil, nil, fmt.Errorf("unknown manifest type %d", manifestType)
+	}
+	if _, err := writer.Write(manifest); err != nil {
+		writer.Close()
+		return nil, nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, nil, err
+	}
+	if compressedBuffer.Len() > DefaultMaxManifestSize {
+		return nil, nil, fmt.Errorf("the compressed manifest is %d bytes long, more than the limit of %d", compressedBuffer.Len(), DefaultMaxManifestSize)
+	}
+	return manifest, compressedBuffer.Bytes(), nil
+}
 
+// recordManifest adds to outMetadata the annotations which describe the
+// manifest stored at manifestOffset in the blob.
+func recordManifest(outMetadata map[string]string, manifestOffset uint64, manifest, compressedManifest, magic []byte, manifestType uint64) error {
 	manifestDigester := digest.Canonical.Digester()
 	manifestChecksum := manifestDigester.Hash()
 	if _, err := manifestChecksum.Write(compressedManifest); err != nil {
@@ -150,18 +609,24 @@ func WriteZstdChunkedManifest(dest io.Writer, outMetadata map[string]string, off
 	}
 
 	outMetadata[ManifestChecksumKey] = manifestDigester.Digest().String()
-	outMetadata[ManifestInfoKey] = fmt.Sprintf("%d:%d:%d:%d", manifestOffset, len(compressedManifest), len(manifest), ManifestTypeCRFS)
-	if err := appendZstdSkippableFrame(dest, compressedManifest); err != nil {
-		return err
+	outMetadata[ManifestInfoKey] = fmt.Sprintf("%d:%d:%d:%d", manifestOffset, len(compressedManifest), len(manifest), manifestType)
+	if !bytes.Equal(magic, ZstdChunkedFrameMagic) {
+		outMetadata[ManifestFrameMagicKey] = hex.EncodeToString(magic)
 	}
+	return nil
+}
 
+// WriteZstdChunkedFooter appends to dest the footer of a blob whose manifest,
+// of the specified compressed and uncompressed lengths and of type
+// manifestType, starts at offset, using magic as the magic number.
+func WriteZstdChunkedFooter(dest io.Writer, offset, length, lengthUncompressed uint64, magic []byte, manifestType uint64) error {
 	// Store the offset to the manifest and its size in LE order
 	var manifestDataLE []byte = make([]byte, FooterSizeSupported)
-	binary.LittleEndian.PutUint64(manifestDataLE, manifestOffset)
-	binary.LittleEndian.PutUint64(manifestDataLE[8:], uint64(len(compressedManifest)))
-	binary.LittleEndian.PutUint64(manifestDataLE[16:], uint64(len(manifest)))
-	binary.LittleEndian.PutUint64(manifestDataLE[24:], uint64(ManifestTypeCRFS))
-	copy(manifestDataLE[32:], ZstdChunkedFrameMagic)
+	binary.LittleEndian.PutUint64(manifestDataLE, offset)
+	binary.LittleEndian.PutUint64(manifestDataLE[8:], length)
+	binary.LittleEndian.PutUint64(manifestDataLE[16:], lengthUncompressed)
+	binary.LittleEndian.PutUint64(manifestDataLE[24:], manifestType)
+	copy(manifestDataLE[32:], magic)
 
 	return appendZstdSkippableFrame(dest, manifestDataLE)
 }
@@ -0,0 +1,148 @@
+package internal
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	// DigestEncodingHex records the digests of the entries of the
+	// manifest as the hex encoding of the hash, without the name of the
+	// hasher, which is the TOC's ChunkHasher.
+	DigestEncodingHex = "hex"
+
+	// DigestEncodingBase64 is like DigestEncodingHex, but the hash is
+	// encoded with unpadded standard base64, which is shorter.
+	DigestEncodingBase64 = "base64"
+)
+
+// ValidateDigestEncoding checks that encoding is a known digest encoding, or
+// empty for complete digests.
+func ValidateDigestEncoding(encoding string) error {
+	switch encoding {
+	case "", DigestEncodingHex, DigestEncodingBase64:
+		return nil
+	}
+	return fmt.Errorf("unknown digest encoding %q", encoding)
+}
+
+// tocJSON has the same fields as TOC, without its methods.
+type tocJSON TOC
+
+// MarshalJSON encodes the TOC, with its digests encoded as specified by
+// DigestEncoding, and its offsets as specified by OffsetEncoding.
+func (t TOC) MarshalJSON() ([]byte, error) {
+	if t.DigestEncoding == "" && t.OffsetEncoding == "" {
+		return json.Marshal(tocJSON(t))
+	}
+	entries := make([]FileMetadata, len(t.Entries))
+	copy(entries, t.Entries)
+	if t.DigestEncoding != "" {
+		prefix := t.digestPrefix()
+		for i := range entries {
+			e := &entries[i]
+			var err error
+			if e.Digest, err = compactDigest(e.Digest, prefix, t.DigestEncoding); err != nil {
+				return nil, err
+			}
+			if e.ChunkDigest, err = compactDigest(e.ChunkDigest, prefix, t.DigestEncoding); err != nil {
+				return nil, err
+			}
+			if e.CompressedDigest, err = compactDigest(e.CompressedDigest, prefix, t.DigestEncoding); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if t.OffsetEncoding != "" {
+		if err := encodeOffsets(entries, t.OffsetEncoding); err != nil {
+			return nil, err
+		}
+	}
+	t.Entries = entries
+	return json.Marshal(tocJSON(t))
+}
+
+// UnmarshalJSON decodes a TOC, restoring its digests and its offsets if they
+// were encoded as specified by DigestEncoding and OffsetEncoding.
+func (t *TOC) UnmarshalJSON(data []byte) error {
+	var decoded tocJSON
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	*t = TOC(decoded)
+	if t.OffsetEncoding != "" {
+		if err := decodeOffsets(t.Entries, t.OffsetEncoding); err != nil {
+			return err
+		}
+	}
+	if t.DigestEncoding == "" {
+		return nil
+	}
+	prefix := t.digestPrefix()
+	for i := range t.Entries {
+		e := &t.Entries[i]
+		var err error
+		if e.Digest, err = expandDigest(e.Digest, prefix, t.DigestEncoding); err != nil {
+			return err
+		}
+		if e.ChunkDigest, err = expandDigest(e.ChunkDigest, prefix, t.DigestEncoding); err != nil {
+			return err
+		}
+		if e.CompressedDigest, err = expandDigest(e.CompressedDigest, prefix, t.DigestEncoding); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// digestPrefix returns the prefix which all the digests in the TOC have.
+func (t *TOC) digestPrefix() string {
+	if t.ChunkHasher == "" {
+		return DefaultChunkHasher + ":"
+	}
+	return t.ChunkHasher + ":"
+}
+
+func compactDigest(d, prefix, encoding string) (string, error) {
+	if d == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(d, prefix) {
+		return "", fmt.Errorf("digest %q doesn't start with %q", d, prefix)
+	}
+	d = d[len(prefix):]
+	switch encoding {
+	case DigestEncodingHex:
+		return d, nil
+	case DigestEncodingBase64:
+		sum, err := hex.DecodeString(d)
+		if err != nil {
+			return "", fmt.Errorf("invalid digest %q: %w", prefix+d, err)
+		}
+		return base64.RawStdEncoding.EncodeToString(sum), nil
+	}
+	return "", fmt.Errorf("unknown digest encoding %q", encoding)
+}
+
+func expandDigest(d, prefix, encoding string) (string, error) {
+	if d == "" {
+		return "", nil
+	}
+	switch encoding {
+	case DigestEncodingHex:
+		if _, err := hex.DecodeString(d); err != nil {
+			return "", fmt.Errorf("invalid hex digest %q: %w", d, err)
+		}
+		return prefix + d, nil
+	case DigestEncodingBase64:
+		sum, err := base64.RawStdEncoding.DecodeString(d)
+		if err != nil {
+			return "", fmt.Errorf("invalid base64 digest %q: %w", d, err)
+		}
+		return prefix + hex.EncodeToString(sum), nil
+	}
+	return "", fmt.Errorf("unknown digest encoding %q", encoding)
+}
@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+	"sync"
+)
+
+// DefaultChunkHasher is the name of the hasher used for the digests of
+// files and chunks when none is requested.
+const DefaultChunkHasher = "sha256"
+
+var (
+	chunkHashersLock sync.RWMutex
+	chunkHashers     = map[string]func() hash.Hash{
+		"sha256":     sha256.New,
+		"sha512":     sha512.New,
+		"sha512-256": sha512.New512_256,
+	}
+)
+
+// validChunkHasherName checks that name can be used as the algorithm part
+// of a digest.
+func validChunkHasherName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') && !strings.ContainsRune("+._-", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// RegisterChunkHasher makes a hash implementation available under name, so
+// that it can be used for the digests of files and chunks.  It panics if
+// the name is not valid as a digest algorithm, or if it is already in use.
+func RegisterChunkHasher(name string, factory func() hash.Hash) {
+	if !validChunkHasherName(name) {
+		panic(fmt.Sprintf("invalid chunk hasher name %q", name))
+	}
+	if factory == nil {
+		panic(fmt.Sprintf("nil factory for chunk hasher %q", name))
+	}
+	chunkHashersLock.Lock()
+	defer chunkHashersLock.Unlock()
+	if _, found := chunkHashers[name]; found {
+		panic(fmt.Sprintf("chunk hasher %q registered twice", name))
+	}
+	chunkHashers[name] = factory
+}
+
+// ChunkDigester computes digests in the "<hasher name>:<hex>" format used
+// in the manifest.
+type ChunkDigester struct {
+	name string
+	hash hash.Hash
+}
+
+// NewChunkDigester returns a ChunkDigester which uses the hasher registered
+// as name, or DefaultChunkHasher if name is empty.
+func NewChunkDigester(name string) (*ChunkDigester, error) {
+	if name == "" {
+		name = DefaultChunkHasher
+	}
+	chunkHashersLock.RLock()
+	factory, found := chunkHashers[name]
+	chunkHashersLock.RUnlock()
+	if !found {
+		return nil, fmt.Errorf("unknown chunk hasher %q", name)
+	}
+	return &ChunkDigester{
+		name: name,
+		hash: factory(),
+	}, nil
+}
+
+// NewChunkDigesterForDigest returns a ChunkDigester which uses the same
+// hasher which was used to compute d.
+func NewChunkDigesterForDigest(d string) (*ChunkDigester, error) {
+	i := strings.IndexByte(d, ':')
+	if i <= 0 || i == len(d)-1 {
+		return nil, fmt.Errorf("invalid digest %q", d)
+	}
+	return NewChunkDigester(d[:i])
+}
+
+// Hash returns the hash which the data to be digested should be written to.
+func (c *ChunkDigester) Hash() hash.Hash {
+	return c.hash
+}
+
+// Digest returns the digest of the data written so far.
+func (c *ChunkDigester) Digest() string {
+	return c.name + ":" + hex.EncodeToString(c.hash.Sum(nil))
+}
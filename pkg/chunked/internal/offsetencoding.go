@@ -0,0 +1,74 @@
+package internal
+
+import "fmt"
+
+// OffsetEncodingDelta records the offsets of the entries of the manifest as
+// differences from the preceding entries, which are small numbers that take
+// less room than the absolute offsets:
+//
+//   - for an entry with a payload, Offset is relative to the EndOffset of
+//     the last preceding entry with a payload, and EndOffset is the size of
+//     the payload;
+//   - for a TypeChunk entry, ChunkOffset is relative to the end of the
+//     preceding entry's chunk, its ChunkOffset plus its ChunkSize, so it is
+//     usually 0 and left out.
+const OffsetEncodingDelta = "delta"
+
+// ValidateOffsetEncoding checks that encoding is a known offset encoding, or
+// empty for absolute offsets.
+func ValidateOffsetEncoding(encoding string) error {
+	switch encoding {
+	case "", OffsetEncodingDelta:
+		return nil
+	}
+	return fmt.Errorf("unknown offset encoding %q", encoding)
+}
+
+// encodeOffsets converts the offsets of entries, in place, as specified by
+// encoding.
+func encodeOffsets(entries []FileMetadata, encoding string) error {
+	if encoding != OffsetEncodingDelta {
+		return fmt.Errorf("unknown offset encoding %q", encoding)
+	}
+	var payloadEnd, chunkEnd int64
+	for i := range entries {
+		e := &entries[i]
+		offset, endOffset, chunkOffset := e.Offset, e.EndOffset, e.ChunkOffset
+		// An entry whose payload is empty keeps its Offset, and is
+		// recognized by its EndOffset being 0.
+		if endOffset != offset {
+			e.Offset = offset - payloadEnd
+			payloadEnd = endOffset
+		}
+		e.EndOffset = endOffset - offset
+		if e.Type == TypeChunk {
+			e.ChunkOffset = chunkOffset - chunkEnd
+		}
+		chunkEnd = chunkOffset + e.ChunkSize
+	}
+	return nil
+}
+
+// decodeOffsets restores, in place, the absolute offsets of entries which
+// were converted by encodeOffsets.
+func decodeOffsets(entries []FileMetadata, encoding string) error {
+	if encoding != OffsetEncodingDelta {
+		return fmt.Errorf("unknown offset encoding %q", encoding)
+	}
+	var payloadEnd, chunkEnd int64
+	for i := range entries {
+		e := &entries[i]
+		if e.EndOffset != 0 {
+			e.Offset += payloadEnd
+			e.EndOffset += e.Offset
+			payloadEnd = e.EndOffset
+		} else {
+			e.EndOffset = e.Offset
+		}
+		if e.Type == TypeChunk {
+			e.ChunkOffset += chunkEnd
+		}
+		chunkEnd = e.ChunkOffset + e.ChunkSize
+	}
+	return nil
+}
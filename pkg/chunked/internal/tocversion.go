@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	// TOCVersion1 is the original layout of the manifest, which is also
+	// the layout of the CRFS and estargz TOCs: the entries have complete
+	// digests and absolute offsets, and the payloads of the files are
+	// stored sequentially.  The fields which were added later, such as
+	// ChunkHasher, Prefetch or ZeroRanges, only add information, so they
+	// can be ignored by the readers of this version, and their zero values
+	// are their defaults.  The CRFS and estargz TOCs don't record
+	// EndOffset, which is filled in from the offset of the next payload.
+	TOCVersion1 = 1
+
+	// TOCVersion2 is used for the manifests which can't be read correctly
+	// by a reader of TOCVersion1, because their digests or offsets are
+	// encoded as specified by DigestEncoding and OffsetEncoding, or
+	// because their payloads are stored with LayoutDigestSorted or
+	// LayoutShared.
+	TOCVersion2 = 2
+
+	// CurrentTOCVersion is the newest version of the manifest.  Manifests
+	// are written with the oldest version which can describe them, see
+	// TOC.MinimumVersion.
+	CurrentTOCVersion = TOCVersion2
+)
+
+// tocDecoders has the decoders for each supported version of the manifest.
+var tocDecoders = map[int]func(data []byte) (*TOC, error){
+	TOCVersion1: decodeTOCVersion1,
+	TOCVersion2: decodeTOCVersion2,
+}
+
+// ParseTOC decodes the manifest in data with the decoder for the version it
+// declares, and returns an error if that version is not supported.
+func ParseTOC(data []byte) (*TOC, error) {
+	var header struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, fmt.Errorf("parsing the manifest: %w", err)
+	}
+	decode, found := tocDecoders[header.Version]
+	if !found {
+		return nil, fmt.Errorf("unsupported manifest version %d", header.Version)
+	}
+	toc, err := decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("parsing the version %d manifest: %w", header.Version, err)
+	}
+	return toc, nil
+}
+
+// MinimumVersion returns the oldest version of the manifest which can
+// describe t.
+func (t *TOC) MinimumVersion() int {
+	if t.DigestEncoding != "" || t.OffsetEncoding != "" || t.Layout != LayoutSequential {
+		return TOCVersion2
+	}
+	return TOCVersion1
+}
+
+func decodeTOCVersion1(data []byte) (*TOC, error) {
+	var toc TOC
+	if err := json.Unmarshal(data, &toc); err != nil {
+		return nil, err
+	}
+	if toc.DigestEncoding != "" {
+		return nil, fmt.Errorf("digest encoding %q requires version %d", toc.DigestEncoding, TOCVersion2)
+	}
+	if toc.OffsetEncoding != "" {
+		return nil, fmt.Errorf("offset encoding %q requires version %d", toc.OffsetEncoding, TOCVersion2)
+	}
+	if toc.Layout != LayoutSequential {
+		return nil, fmt.Errorf("layout %q requires version %d", toc.Layout, TOCVersion2)
+	}
+	FillEndOffsets(toc.Entries)
+	return &toc, nil
+}
+
+// FillEndOffsets sets the EndOffset of the entries with a payload which
+// don't have one to the Offset of the next entry with a payload.  The last
+// payload ends where the manifest starts, which is not known here, so its
+// EndOffset is left for the caller to compute.
+func FillEndOffsets(entries []FileMetadata) {
+	var next int64
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := &entries[i]
+		if e.Offset == 0 {
+			continue
+		}
+		if e.EndOffset == 0 {
+			e.EndOffset = next
+		}
+		next = e.Offset
+	}
+}
+
+func decodeTOCVersion2(data []byte) (*TOC, error) {
+	var toc TOC
+	if err := json.Unmarshal(data, &toc); err != nil {
+		return nil, err
+	}
+	if err := ValidateDigestEncoding(toc.DigestEncoding); err != nil {
+		return nil, err
+	}
+	if err := ValidateOffsetEncoding(toc.OffsetEncoding); err != nil {
+		return nil, err
+	}
+	if toc.Layout != LayoutSequential && toc.Layout != LayoutDigestSorted && toc.Layout != LayoutShared {
+		return nil, fmt.Errorf("unknown layout %q", toc.Layout)
+	}
+	return &toc, nil
+}
@@ -0,0 +1,29 @@
+package chunked
+
+import (
+	"io"
+
+	storage "github.com/containers/storage"
+	"github.com/containers/storage/pkg/chunked/internal"
+	digest "github.com/opencontainers/go-digest"
+)
+
+func init() {
+	storage.RegisterLayerBlobDecoder(decodeZstdChunkedBlob)
+}
+
+// decodeZstdChunkedBlob is the storage.LayerBlobDecoder for zstd:chunked
+// blobs, which are recognized by their manifest checksum annotation.  The
+// tarball is rebuilt with ReconstructTar, since the frames of blobs with the
+// digest-sorted layout are not in the order of the tarball, and a failure to
+// rebuild it, including a diffID mismatch, is returned by the reader.
+func decodeZstdChunkedBlob(blob io.ReaderAt, size int64, mediaType string, annotations map[string]string, diffID digest.Digest) (io.ReadCloser, error) {
+	if _, ok := annotations[internal.ManifestChecksumKey]; !ok {
+		return nil, nil
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(ReconstructTar(blob, size, diffID, pw))
+	}()
+	return pr, nil
+}
@@ -0,0 +1,134 @@
+package chunked
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containers/storage/pkg/chunked/internal"
+	"github.com/pkg/errors"
+)
+
+// ociTOCVersion is the version of the TOC written by ToOCITOC.
+const ociTOCVersion = 1
+
+// ociTOCTypes lists the entry types which can be stored in the TOC.  They
+// have the same names in both formats.
+var ociTOCTypes = map[string]bool{
+	TypeReg:     true,
+	TypeChunk:   true,
+	TypeLink:    true,
+	TypeChar:    true,
+	TypeBlock:   true,
+	TypeDir:     true,
+	TypeFifo:    true,
+	TypeSymlink: true,
+}
+
+// ToOCITOC encodes the entries of a zstd:chunked manifest as a TOC in the
+// JSON format used by estargz, so that they can be read by other partial
+// pull implementations.  The chunks of a file are represented the same way
+// in both formats: the entry of the file describes its first chunk, and
+// each following chunk has an entry of type TypeChunk, whose ChunkSize is 0
+// if it extends to the end of the file.  The fields which the TOC has no
+// room for, such as EndOffset, AccessTime, ChangeTime, ZeroRanges or
+// CompressedDigest, are left out.
+func ToOCITOC(manifest []FileMetadata) ([]byte, error) {
+	toc := estargz.JTOC{
+		Version: ociTOCVersion,
+		Entries: make([]*estargz.TOCEntry, 0, len(manifest)),
+	}
+	for _, m := range manifest {
+		if !ociTOCTypes[m.Type] {
+			return nil, errors.Errorf("unknown type %q for %q", m.Type, m.Name)
+		}
+		e := &estargz.TOCEntry{
+			Name:        m.Name,
+			Type:        m.Type,
+			Size:        m.Size,
+			LinkName:    m.Linkname,
+			Mode:        m.Mode,
+			UID:         m.UID,
+			GID:         m.GID,
+			Offset:      m.Offset,
+			DevMajor:    int(m.Devmajor),
+			DevMinor:    int(m.Devminor),
+			Digest:      m.Digest,
+			ChunkOffset: m.ChunkOffset,
+			ChunkSize:   m.ChunkSize,
+			ChunkDigest: m.ChunkDigest,
+		}
+		if !m.ModTime.IsZero() {
+			e.ModTime3339 = m.ModTime.UTC().Format(time.RFC3339)
+		}
+		if len(m.Xattrs) > 0 {
+			e.Xattrs = make(map[string][]byte, len(m.Xattrs))
+			for k, v := range m.Xattrs {
+				value, err := base64.StdEncoding.DecodeString(v)
+				if err != nil {
+					return nil, errors.Wrapf(err, "decoding extended attribute %q of %q", k, m.Name)
+				}
+				e.Xattrs[k] = value
+			}
+		}
+		toc.Entries = append(toc.Entries, e)
+	}
+	return json.Marshal(toc)
+}
+
+// FromOCITOC decodes a TOC in the JSON format used by estargz, and returns
+// its entries as the entries of a zstd:chunked manifest.  The TOC doesn't
+// record where the payloads end, so the EndOffset of each entry is set to
+// the Offset of the next payload, and it is left to zero for the last one,
+// as for the manifests of estargz blobs.
+func FromOCITOC(data []byte) ([]FileMetadata, error) {
+	var toc estargz.JTOC
+	if err := json.Unmarshal(data, &toc); err != nil {
+		return nil, errors.Wrapf(err, "parsing the TOC")
+	}
+	if toc.Version != ociTOCVersion {
+		return nil, errors.Errorf("unsupported TOC version %d", toc.Version)
+	}
+	manifest := make([]FileMetadata, 0, len(toc.Entries))
+	for _, e := range toc.Entries {
+		if e == nil {
+			return nil, errors.New("null entry in the TOC")
+		}
+		if !ociTOCTypes[e.Type] {
+			return nil, errors.Errorf("unknown type %q for %q", e.Type, e.Name)
+		}
+		m := FileMetadata{
+			Type:        e.Type,
+			Name:        e.Name,
+			Linkname:    e.LinkName,
+			Mode:        e.Mode,
+			Size:        e.Size,
+			UID:         e.UID,
+			GID:         e.GID,
+			Devmajor:    int64(e.DevMajor),
+			Devminor:    int64(e.DevMinor),
+			Digest:      e.Digest,
+			Offset:      e.Offset,
+			ChunkSize:   e.ChunkSize,
+			ChunkOffset: e.ChunkOffset,
+			ChunkDigest: e.ChunkDigest,
+		}
+		if e.ModTime3339 != "" {
+			modTime, err := time.Parse(time.RFC3339, e.ModTime3339)
+			if err != nil {
+				return nil, errors.Wrapf(err, "parsing the modification time of %q", e.Name)
+			}
+			m.ModTime = modTime.UTC()
+		}
+		if len(e.Xattrs) > 0 {
+			m.Xattrs = make(map[string]string, len(e.Xattrs))
+			for k, v := range e.Xattrs {
+				m.Xattrs[k] = base64.StdEncoding.EncodeToString(v)
+			}
+		}
+		manifest = append(manifest, m)
+	}
+	internal.FillEndOffsets(manifest)
+	return manifest, nil
+}
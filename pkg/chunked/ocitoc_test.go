@@ -0,0 +1,125 @@
+package chunked
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOCITOCRoundTrip(t *testing.T) {
+	modTime := time.Date(2021, 6, 1, 12, 30, 0, 0, time.UTC)
+	manifest := []FileMetadata{
+		{Type: TypeDir, Name: "etc/", Mode: 0755, ModTime: modTime},
+		{Type: TypeReg, Name: "etc/passwd", Mode: 0644, Size: 10, UID: 1, GID: 2, ModTime: modTime,
+			Digest: "sha256:aaaa", Offset: 100, EndOffset: 150, ChunkDigest: "sha256:aaaa",
+			Xattrs: map[string]string{"user.a": base64.StdEncoding.EncodeToString([]byte("value"))}},
+		{Type: TypeReg, Name: "big", Mode: 0644, Size: 250, ModTime: modTime, Digest: "sha256:bbbb",
+			Offset: 150, EndOffset: 200, ChunkSize: 100, ChunkDigest: "sha256:cccc"},
+		{Type: TypeChunk, Name: "big", Offset: 200, EndOffset: 260, ChunkOffset: 100, ChunkSize: 100, ChunkDigest: "sha256:dddd"},
+		{Type: TypeChunk, Name: "big", Offset: 260, EndOffset: 300, ChunkOffset: 200, ChunkDigest: "sha256:eeee"},
+		{Type: TypeReg, Name: "empty", Mode: 0600},
+		{Type: TypeLink, Name: "link", Linkname: "etc/passwd"},
+		{Type: TypeSymlink, Name: "symlink", Linkname: "big", Mode: 0777},
+		{Type: TypeChar, Name: "dev/null", Mode: 0666, Devmajor: 1, Devminor: 3},
+		{Type: TypeBlock, Name: "dev/sda", Mode: 0660, Devmajor: 8},
+		{Type: TypeFifo, Name: "fifo", Mode: 0600},
+		{Type: TypeReg, Name: "last", Size: 1, Digest: "sha256:ffff", Offset: 300, EndOffset: 320, ChunkDigest: "sha256:ffff"},
+	}
+	data, err := ToOCITOC(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the fields have the names used by estargz
+	var toc struct {
+		Version int                      `json:"version"`
+		Entries []map[string]interface{} `json:"entries"`
+	}
+	if err := json.Unmarshal(data, &toc); err != nil {
+		t.Fatal(err)
+	}
+	if toc.Version != 1 || len(toc.Entries) != len(manifest) {
+		t.Fatalf("Unexpected TOC %s", data)
+	}
+	passwd := toc.Entries[1]
+	if passwd["modtime"] != "2021-06-01T12:30:00Z" || passwd["xattrs"].(map[string]interface{})["user.a"] != base64.StdEncoding.EncodeToString([]byte("value")) {
+		t.Fatalf("Unexpected entry %v", passwd)
+	}
+	if _, found := passwd["endOffset"]; found {
+		t.Fatalf("EndOffset stored in the TOC: %v", passwd)
+	}
+	if toc.Entries[6]["linkName"] != "etc/passwd" {
+		t.Fatalf("Unexpected entry %v", toc.Entries[6])
+	}
+
+	// everything but the end of the last payload comes back
+	decoded, err := FromOCITOC(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := append([]FileMetadata(nil), manifest...)
+	expected[len(expected)-1].EndOffset = 0
+	if !reflect.DeepEqual(decoded, expected) {
+		t.Fatalf("Manifest decoded as %+v, expected %+v", decoded, expected)
+	}
+	again, err := ToOCITOC(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(again) != string(data) {
+		t.Fatalf("TOC encoded again as %s, expected %s", again, data)
+	}
+
+	// the fields the TOC has no room for are dropped
+	data, err = ToOCITOC([]FileMetadata{{Type: TypeReg, Name: "f", AccessTime: modTime, ContentClass: ContentClassText, CompressedDigest: "sha256:aaaa"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err = FromOCITOC(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, []FileMetadata{{Type: TypeReg, Name: "f"}}) {
+		t.Fatalf("Unexpected entries %+v", decoded)
+	}
+
+	if _, err := ToOCITOC([]FileMetadata{{Type: "socket", Name: "s"}}); err == nil {
+		t.Fatal("Unknown type accepted")
+	}
+	for _, toc := range []string{
+		`{"version":2,"entries":[]}`,
+		`{"version":1,"entries":[{"name":"s","type":"socket"}]}`,
+		`{"version":1,"entries":[{"name":"f","type":"reg","modtime":"yesterday"}]}`,
+		`{"version":1,"entries":[null]}`,
+	} {
+		if _, err := FromOCITOC([]byte(toc)); err == nil {
+			t.Fatalf("Invalid TOC %s accepted", toc)
+		}
+	}
+}
+
+func TestFromOCITOC(t *testing.T) {
+	// a TOC as written by estargz
+	data := `{"version":1,"entries":[` +
+		`{"name":"bin/","type":"dir","modtime":"2021-06-01T12:30:00Z","mode":493,"NumLink":0},` +
+		`{"name":"bin/sh","type":"reg","size":5,"modtime":"2021-06-01T12:30:00Z","mode":493,"uid":10,"gid":20,"userName":"user","groupName":"group","offset":70,"NumLink":0,"xattrs":{"security.capability":"AQID"},"digest":"sha256:aaaa","chunkDigest":"sha256:aaaa"},` +
+		`{"name":"bin/true","type":"reg","size":3,"offset":140,"NumLink":0,"digest":"sha256:bbbb","chunkDigest":"sha256:bbbb"},` +
+		`{"name":".prefetch.landmark","type":"reg","size":1,"offset":200,"NumLink":0,"digest":"sha256:cccc","chunkDigest":"sha256:cccc"}]}`
+	manifest, err := FromOCITOC([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2021, 6, 1, 12, 30, 0, 0, time.UTC)
+	expected := []FileMetadata{
+		{Type: TypeDir, Name: "bin/", Mode: 0755, ModTime: modTime},
+		{Type: TypeReg, Name: "bin/sh", Size: 5, Mode: 0755, UID: 10, GID: 20, ModTime: modTime, Offset: 70, EndOffset: 140,
+			Xattrs: map[string]string{"security.capability": "AQID"}, Digest: "sha256:aaaa", ChunkDigest: "sha256:aaaa"},
+		{Type: TypeReg, Name: "bin/true", Size: 3, Offset: 140, EndOffset: 200, Digest: "sha256:bbbb", ChunkDigest: "sha256:bbbb"},
+		{Type: TypeReg, Name: ".prefetch.landmark", Size: 1, Offset: 200, Digest: "sha256:cccc", ChunkDigest: "sha256:cccc"},
+	}
+	if !reflect.DeepEqual(manifest, expected) {
+		t.Fatalf("TOC decoded as %+v, expected %+v", manifest, expected)
+	}
+}
@@ -0,0 +1,278 @@
+package chunked
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/containers/storage/pkg/chunked/internal"
+	"github.com/klauspost/compress/zstd"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/vbatts/tar-split/archive/tar"
+)
+
+// readZstdChunkedTOC reads the manifest of the zstd:chunked blob in ra using
+// the position recorded in the blob's footer, and returns it together with
+// the offset where the frames holding the tarball end: where the manifest's
+// skippable frame starts, or where the footer starts if the blob has its
+// manifest first.
+func readZstdChunkedTOC(ra io.ReaderAt, size int64) (*internal.TOC, int64, error) {
+	footerSize := int64(internal.FooterSizeSupported)
+	if size <= footerSize {
+		return nil, 0, errors.New("blob too small")
+	}
+	footer := make([]byte, footerSize)
+	if _, err := ra.ReadAt(footer, size-footerSize); err != nil {
+		return nil, 0, err
+	}
+	offset := binary.LittleEndian.Uint64(footer[0:8])
+	length := binary.LittleEndian.Uint64(footer[8:16])
+	lengthUncompressed := binary.LittleEndian.Uint64(footer[16:24])
+	manifestType := binary.LittleEndian.Uint64(footer[24:32])
+	if !isZstdChunkedFrameMagic(footer[32:40]) {
+		return nil, 0, errors.New("invalid magic number")
+	}
+	if !internal.IsManifestType(manifestType) {
+		return nil, 0, errors.New("invalid manifest type")
+	}
+	// set a reasonable limit
+	if length > MaxManifestSize {
+		return nil, 0, errors.New("manifest too big")
+	}
+	// the manifest is preceded by the 8 bytes of its skippable frame header
+	if offset < 8 || offset+length > uint64(size-footerSize) {
+		return nil, 0, errors.New("invalid manifest position")
+	}
+
+	manifest := make([]byte, length)
+	if _, err := ra.ReadAt(manifest, int64(offset)); err != nil {
+		return nil, 0, err
+	}
+	decoded, err := internal.DecompressManifest(manifest, lengthUncompressed, MaxManifestSize, manifestType)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	toc, err := internal.ParseTOC(decoded)
+	if err != nil {
+		return nil, 0, err
+	}
+	manifestFirst, err := hasManifestFirstHeader(ra, int64(offset))
+	if err != nil {
+		return nil, 0, err
+	}
+	if manifestFirst {
+		return toc, size - (8 + footerSize), nil
+	}
+	return toc, int64(offset) - 8, nil
+}
+
+// hasManifestFirstHeader tells whether the blob in ra, whose manifest is at
+// manifestOffset, starts with the header of the blobs which have their
+// manifest first.
+func hasManifestFirstHeader(ra io.ReaderAt, manifestOffset int64) (bool, error) {
+	const headerSize = 8 + internal.FooterSizeSupported
+	if manifestOffset != headerSize+8 {
+		return false, nil
+	}
+	header := make([]byte, headerSize)
+	if _, err := ra.ReadAt(header, 0); err != nil {
+		return false, err
+	}
+	return bytes.Equal(header[headerSize-8:], internal.ZstdChunkedManifestFirstMagic), nil
+}
+
+// verifyFileChunks copies the contents of the file described by entry from
+// r to the hashers for its chunks, listed in chunks, and for the whole file,
+// and checks the results against the digests in the manifest.
+func verifyFileChunks(r io.Reader, entry *internal.FileMetadata, chunks []*internal.FileMetadata) error {
+	fileDigester, err := internal.NewChunkDigesterForDigest(entry.Digest)
+	if err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		// ChunkSize is 0 for the last chunk
+		size := chunk.ChunkSize
+		if size == 0 {
+			size = entry.Size - chunk.ChunkOffset
+		}
+		dest := io.Writer(fileDigester.Hash())
+		var chunkDigester *internal.ChunkDigester
+		if chunk.ChunkDigest != "" {
+			chunkDigester, err = internal.NewChunkDigesterForDigest(chunk.ChunkDigest)
+			if err != nil {
+				return err
+			}
+			dest = io.MultiWriter(dest, chunkDigester.Hash())
+		}
+		if _, err := io.CopyN(dest, r, size); err != nil {
+			return errors.Wrapf(err, "reading chunk at offset %d of %q", chunk.ChunkOffset, entry.Name)
+		}
+		if chunkDigester != nil && chunkDigester.Digest() != chunk.ChunkDigest {
+			return fmt.Errorf("checksum mismatch for chunk at offset %d of %q", chunk.ChunkOffset, entry.Name)
+		}
+	}
+	if fileDigester.Digest() != entry.Digest {
+		return fmt.Errorf("checksum mismatch for %q", entry.Name)
+	}
+	return nil
+}
+
+// ReconstructTar rebuilds the original tarball from the zstd:chunked blob
+// of the given size which can be read from ra, and writes it to w.  The
+// contents of each file, and of each of its chunks, are checked against the
+// digests in the blob's manifest as they are written, and the digest of the
+// whole tarball is checked against expectedDiffID at the end.  An error is
+// returned on the first mismatch, in which case only part of the tarball
+// may have been written.
+func ReconstructTar(ra io.ReaderAt, size int64, expectedDiffID digest.Digest, w io.Writer) error {
+	if err := expectedDiffID.Validate(); err != nil {
+		return errors.Wrapf(err, "invalid diffID %q", expectedDiffID)
+	}
+	toc, manifestStart, err := readZstdChunkedTOC(ra, size)
+	if err != nil {
+		return err
+	}
+	switch toc.Layout {
+	case internal.LayoutSequential:
+	case internal.LayoutDigestSorted:
+		return reconstructSortedTar(ra, toc, expectedDiffID, w)
+	case internal.LayoutShared:
+		return fmt.Errorf("tarballs can't be rebuilt from blobs with the %q layout", toc.Layout)
+	default:
+		return fmt.Errorf("unknown layout %q", toc.Layout)
+	}
+
+	decoder, err := zstd.NewReader(io.NewSectionReader(ra, 0, manifestStart))
+	if err != nil {
+		return err
+	}
+	defer decoder.Close()
+
+	diffIDDigester := expectedDiffID.Algorithm().Digester()
+	stream := io.TeeReader(decoder, io.MultiWriter(w, diffIDDigester.Hash()))
+
+	entries := toc.Entries
+	tr := tar.NewReader(stream)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrapf(err, "reading the reconstructed tarball")
+		}
+
+		// skip over the entries for chunks of files we have already seen
+		for len(entries) > 0 && entries[0].Type == internal.TypeChunk {
+			entries = entries[1:]
+		}
+		if len(entries) == 0 {
+			return fmt.Errorf("%q is not in the manifest", hdr.Name)
+		}
+		entry := &entries[0]
+		entries = entries[1:]
+		if entry.Name != hdr.Name || entry.Size != hdr.Size {
+			return fmt.Errorf("%q does not match the manifest entry for %q", hdr.Name, entry.Name)
+		}
+		if entry.Type != internal.TypeReg || entry.Digest == "" {
+			continue
+		}
+		chunks := []*internal.FileMetadata{entry}
+		for i := 0; i < len(entries) && entries[i].Type == internal.TypeChunk; i++ {
+			chunks = append(chunks, &entries[i])
+		}
+		if err := verifyFileChunks(tr, entry, chunks); err != nil {
+			return err
+		}
+	}
+	for _, entry := range entries {
+		if entry.Type != internal.TypeChunk {
+			return fmt.Errorf("%q is missing from the reconstructed tarball", entry.Name)
+		}
+	}
+
+	// copy whatever follows the last entry, i.e. the end-of-archive marker
+	if _, err := io.Copy(ioutil.Discard, stream); err != nil {
+		return err
+	}
+	if diffIDDigester.Digest() != expectedDiffID {
+		return fmt.Errorf("diffID mismatch: expected %s, got %s", expectedDiffID, diffIDDigester.Digest())
+	}
+	return nil
+}
+
+// reconstructSortedTar is like ReconstructTar, for blobs which use the
+// internal.LayoutDigestSorted layout.
+func reconstructSortedTar(ra io.ReaderAt, toc *internal.TOC, expectedDiffID digest.Digest, w io.Writer) error {
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return err
+	}
+	defer decoder.Close()
+
+	headersFrame := make([]byte, toc.TarHeadersEndOffset)
+	if _, err := ra.ReadAt(headersFrame, 0); err != nil {
+		return errors.Wrapf(err, "reading the tar headers")
+	}
+	headers, err := decoder.DecodeAll(headersFrame, nil)
+	if err != nil {
+		return errors.Wrapf(err, "decompressing the tar headers")
+	}
+	headersReader := bytes.NewReader(headers)
+
+	diffIDDigester := expectedDiffID.Algorithm().Digester()
+	dest := io.MultiWriter(w, diffIDDigester.Hash())
+	copyRecord := func() error {
+		length, err := binary.ReadUvarint(headersReader)
+		if err != nil {
+			return errors.Wrapf(err, "reading the tar headers")
+		}
+		if length > uint64(headersReader.Len()) {
+			return errors.New("invalid tar headers record")
+		}
+		_, err = io.CopyN(dest, headersReader, int64(length))
+		return err
+	}
+
+	for i := range toc.Entries {
+		entry := &toc.Entries[i]
+		if entry.Type == internal.TypeChunk {
+			continue
+		}
+		if err := copyRecord(); err != nil {
+			return err
+		}
+		if entry.Type != internal.TypeReg || entry.Digest == "" {
+			continue
+		}
+		if entry.Offset < toc.TarHeadersEndOffset || entry.EndOffset < entry.Offset {
+			return fmt.Errorf("invalid position for the payload of %q", entry.Name)
+		}
+		if err := decoder.Reset(io.NewSectionReader(ra, entry.Offset, entry.EndOffset-entry.Offset)); err != nil {
+			return err
+		}
+		chunks := []*internal.FileMetadata{entry}
+		for j := i + 1; j < len(toc.Entries) && toc.Entries[j].Type == internal.TypeChunk; j++ {
+			chunks = append(chunks, &toc.Entries[j])
+		}
+		if err := verifyFileChunks(io.TeeReader(decoder, dest), entry, chunks); err != nil {
+			return err
+		}
+	}
+	// the end-of-archive marker
+	if err := copyRecord(); err != nil {
+		return err
+	}
+	if headersReader.Len() != 0 {
+		return errors.New("unexpected data after the end of the tar headers")
+	}
+
+	if diffIDDigester.Digest() != expectedDiffID {
+		return fmt.Errorf("diffID mismatch: expected %s, got %s", expectedDiffID, diffIDDigester.Digest())
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package chunked
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/containers/storage/pkg/chunked/internal"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// readSeekerAt reads from an io.ReadSeeker at a given offset.
+type readSeekerAt struct {
+	rs io.ReadSeeker
+}
+
+func (r readSeekerAt) ReadAt(p []byte, off int64) (int, error) {
+	if _, err := r.rs.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(r.rs, p)
+}
+
+// RebuildTrailer repairs a zstd:chunked blob whose footer, the skippable
+// frame which follows the manifest and records its position, is missing or
+// damaged, for example because the blob was truncated, while the skippable
+// frame holding the manifest is intact.  The blob is scanned backwards for
+// the frame holding the manifest, and a footer describing it is written right
+// after it, using ZstdChunkedFrameMagic as the magic number and the type of
+// the manifest which was found.  Blobs with a valid footer are left
+// untouched.  An error is returned if no manifest is found near the end of
+// the blob.
+func RebuildTrailer(blob io.ReadWriteSeeker) error {
+	size, err := blob.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	ra := readSeekerAt{rs: blob}
+	if _, _, err := readZstdChunkedTOC(ra, size); err == nil {
+		return nil
+	}
+
+	// The manifest frame ends at most a whole footer frame before the
+	// end of the blob, so it must start in the window read here.
+	const footerFrameSize = 8 + internal.FooterSizeSupported
+	windowStart := size - (8 + int64(MaxManifestSize) + footerFrameSize)
+	if windowStart < 0 {
+		windowStart = 0
+	}
+	window := make([]byte, size-windowStart)
+	if _, err := ra.ReadAt(window, windowStart); err != nil {
+		return err
+	}
+
+	for p := len(window) - 8; p >= 0; p-- {
+		if !internal.IsSkippableFrameMagic(window[p:]) {
+			continue
+		}
+		length := int64(binary.LittleEndian.Uint32(window[p+4 : p+8]))
+		end := int64(p) + 8 + length
+		if end > int64(len(window)) || int64(len(window))-end > footerFrameSize {
+			continue
+		}
+		decoded, manifestType := decompressAnyManifest(window[p+8 : end])
+		if decoded == nil {
+			continue
+		}
+
+		offset := windowStart + int64(p) + 8
+		if _, err := blob.Seek(windowStart+end, io.SeekStart); err != nil {
+			return err
+		}
+		if err := internal.WriteZstdChunkedFooter(blob, uint64(offset), uint64(length), uint64(len(decoded)), internal.ZstdChunkedFrameMagic, manifestType); err != nil {
+			return errors.Wrapf(err, "writing the footer")
+		}
+		return nil
+	}
+	return errors.New("no manifest found at the end of the blob")
+}
+
+// decompressAnyManifest returns the decompressed manifest in compressed, and
+// its type, trying each of the known types, or nil if it isn't a manifest.
+func decompressAnyManifest(compressed []byte) ([]byte, uint64) {
+	for _, manifestType := range []uint64{internal.ManifestTypeCRFS, internal.ManifestTypeCRFSGzip} {
+		decoded, err := internal.DecompressManifest(compressed, MaxManifestSize, MaxManifestSize, manifestType)
+		if err != nil {
+			continue
+		}
+		if _, err := internal.ParseTOC(decoded); err != nil {
+			continue
+		}
+		return decoded, manifestType
+	}
+	return nil, 0
+}
+
+// TrailingGarbage returns the number of bytes which follow the footer of
+// the zstd:chunked blob which can be read from ra, whose size including them
+// is size, for blobs to which a transfer added padding or other bytes.  The
+// footer is searched backwards from the end, among the last window bytes
+// which can follow it, and the last frame which has the layout of a footer,
+// with a known magic number and pointing to the skippable frame of a
+// manifest, is taken as the footer.  The blob without the trailing bytes,
+// whose size is size minus the returned count, can then be read as any other
+// zstd:chunked blob.  0 is returned for blobs which end with their footer.
+func TrailingGarbage(ra io.ReaderAt, size, window int64) (int64, error) {
+	const footerFrameSize = 8 + internal.FooterSizeSupported
+	if window < 0 {
+		return 0, errors.Errorf("invalid window size %d", window)
+	}
+	if window > size-footerFrameSize {
+		window = size - footerFrameSize
+	}
+	if window < 0 {
+		return 0, errors.New("blob too small")
+	}
+	data := make([]byte, window+footerFrameSize)
+	if _, err := ra.ReadAt(data, size-int64(len(data))); err != nil {
+		return 0, err
+	}
+	for trailing := int64(0); trailing <= window; trailing++ {
+		frame := data[window-trailing : window-trailing+footerFrameSize]
+		if !internal.IsSkippableFrameMagic(frame) || binary.LittleEndian.Uint32(frame[4:8]) != internal.FooterSizeSupported {
+			continue
+		}
+		footer := frame[8:]
+		offset := binary.LittleEndian.Uint64(footer[0:8])
+		length := binary.LittleEndian.Uint64(footer[8:16])
+		manifestType := binary.LittleEndian.Uint64(footer[24:32])
+		if !isZstdChunkedFrameMagic(footer[32:40]) || !internal.IsManifestType(manifestType) {
+			continue
+		}
+		footerStart := uint64(size - trailing - footerFrameSize)
+		if offset < 8 || length > MaxManifestSize || offset+length > footerStart {
+			continue
+		}
+		header := make([]byte, 8)
+		if _, err := ra.ReadAt(header, int64(offset)-8); err != nil {
+			return 0, err
+		}
+		// the frame of a manifest written first can be padded
+		if internal.IsSkippableFrameMagic(header) && uint64(binary.LittleEndian.Uint32(header[4:8])) >= length {
+			return trailing, nil
+		}
+	}
+	return 0, errors.Errorf("no zstd:chunked footer found in the last %d bytes of the blob", window+footerFrameSize)
+}
+
+// BackfillChunkDigests returns a copy of manifest, the entries of the
+// zstd:chunked blob of the given size which can be read from ra, where the
+// chunks of the regular files have their ChunkDigest, ChunkOffset and
+// ChunkSize set, so that blobs created without them can be deduplicated by
+// chunk.  The chunks of the files which have more than one are read from
+// their frames in the blob, at the offsets recorded in the manifest, and
+// hashed with the hasher of the digest of their file; the digest of the
+// only chunk of the other files is the digest of the file.  The digests which are already set are
+// checked, and so is the digest of each whole file, so that an error is
+// returned, and nothing is filled in, if the offsets don't match the
+// contents.
+func BackfillChunkDigests(ra io.ReaderAt, size int64, manifest []FileMetadata) ([]FileMetadata, error) {
+	result := append([]FileMetadata{}, manifest...)
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer decoder.Close()
+
+	for i := range result {
+		if result[i].Type != internal.TypeReg {
+			continue
+		}
+		end := i + 1
+		for end < len(result) && result[end].Type == internal.TypeChunk {
+			end++
+		}
+		if end-i > 1 {
+			if err := backfillFileChunks(ra, size, decoder, result[i:end]); err != nil {
+				return nil, err
+			}
+		} else if result[i].ChunkDigest == "" {
+			// the only chunk is the whole file
+			result[i].ChunkDigest = result[i].Digest
+		}
+	}
+	return result, nil
+}
+
+// backfillFileChunks fills in the chunk fields of chunks, the entry of a
+// regular file followed by the entries of its other chunks.
+func backfillFileChunks(ra io.ReaderAt, size int64, decoder *zstd.Decoder, chunks []FileMetadata) error {
+	entry := &chunks[0]
+	fileDigester, err := internal.NewChunkDigesterForDigest(entry.Digest)
+	if err != nil {
+		return errors.Wrapf(err, "file %q", entry.Name)
+	}
+	var fileOffset int64
+	for i := range chunks {
+		chunk := &chunks[i]
+		if chunk.Offset <= 0 || chunk.EndOffset < chunk.Offset || chunk.EndOffset > size {
+			return errors.Errorf("invalid position for chunk %d of %q", i, entry.Name)
+		}
+		if i > 0 && chunk.ChunkOffset != 0 && chunk.ChunkOffset != fileOffset {
+			return errors.Errorf("chunk %d of %q is at offset %d, expected %d", i, entry.Name, chunk.ChunkOffset, fileOffset)
+		}
+		if err := decoder.Reset(io.NewSectionReader(ra, chunk.Offset, chunk.EndOffset-chunk.Offset)); err != nil {
+			return err
+		}
+		chunkDigester, err := internal.NewChunkDigesterForDigest(entry.Digest)
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(io.MultiWriter(fileDigester.Hash(), chunkDigester.Hash()), io.LimitReader(decoder, entry.Size-fileOffset+1))
+		if err != nil {
+			return errors.Wrapf(err, "reading chunk %d of %q", i, entry.Name)
+		}
+		if fileOffset+n > entry.Size {
+			return errors.Errorf("the chunks of %q hold more than %d bytes", entry.Name, entry.Size)
+		}
+		chunkDigest := chunkDigester.Digest()
+		if chunk.ChunkDigest != "" && chunk.ChunkDigest != chunkDigest {
+			return errors.Errorf("checksum mismatch for chunk %d of %q", i, entry.Name)
+		}
+		chunk.ChunkDigest = chunkDigest
+		chunk.ChunkOffset = fileOffset
+		// ChunkSize is 0 for the last chunk
+		if i < len(chunks)-1 {
+			chunk.ChunkSize = n
+		} else {
+			chunk.ChunkSize = 0
+		}
+		fileOffset += n
+	}
+	if fileOffset != entry.Size {
+		return errors.Errorf("the chunks of %q hold %d bytes, expected %d", entry.Name, fileOffset, entry.Size)
+	}
+	if fileDigester.Digest() != entry.Digest {
+		return errors.Errorf("checksum mismatch for %q", entry.Name)
+	}
+	return nil
+}
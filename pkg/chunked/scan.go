@@ -0,0 +1,16 @@
+package chunked
+
+import (
+	"io"
+
+	"github.com/containers/storage/pkg/chunked/compressor"
+)
+
+// ScanTarMetadata reads the uncompressed tarball from r and returns the
+// manifest entries which describe it, as they would be recorded in a
+// zstd:chunked blob created from it with the same options, but without
+// compressing it.  The Offset and EndOffset fields of the entries, which
+// refer to positions in the blob, are 0.
+func ScanTarMetadata(r io.Reader, options *compressor.Options) ([]FileMetadata, error) {
+	return compressor.ScanTarMetadata(r, options)
+}
@@ -0,0 +1,85 @@
+package chunked
+
+import (
+	"io"
+	"os"
+
+	"github.com/containers/storage/pkg/chunked/internal"
+	"github.com/pkg/errors"
+)
+
+// sparseFileWriter writes to a file, seeking over the ranges which are
+// known to contain only zeros instead of writing them, so that they are
+// left as holes.
+type sparseFileWriter struct {
+	file   *os.File
+	holes  []internal.ZeroRange
+	offset int64
+}
+
+func newSparseFileWriter(file *os.File, holes []internal.ZeroRange) (*sparseFileWriter, error) {
+	var end int64
+	for _, h := range holes {
+		if h.Offset < end || h.Length <= 0 {
+			return nil, errors.New("invalid zero ranges")
+		}
+		end = h.Offset + h.Length
+	}
+	return &sparseFileWriter{
+		file:  file,
+		holes: holes,
+	}, nil
+}
+
+func (s *sparseFileWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		for len(s.holes) > 0 && s.holes[0].Offset+s.holes[0].Length <= s.offset {
+			s.holes = s.holes[1:]
+		}
+		n := int64(len(p))
+		if len(s.holes) > 0 && s.offset >= s.holes[0].Offset {
+			if end := s.holes[0].Offset + s.holes[0].Length; n > end-s.offset {
+				n = end - s.offset
+			}
+			// The data is checked against the file's digest, so
+			// make sure that what is skipped is what was hashed.
+			if !internal.IsZero(p[:n]) {
+				return written, errors.New("non-zero data in a range recorded as zeros")
+			}
+			if _, err := s.file.Seek(n, io.SeekCurrent); err != nil {
+				return written, err
+			}
+		} else {
+			if len(s.holes) > 0 && n > s.holes[0].Offset-s.offset {
+				n = s.holes[0].Offset - s.offset
+			}
+			if _, err := s.file.Write(p[:n]); err != nil {
+				return written, err
+			}
+		}
+		s.offset += n
+		written += int(n)
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// finish sets the size of the file, which is needed if it ends with a hole.
+func (s *sparseFileWriter) finish() error {
+	return s.file.Truncate(s.offset)
+}
+
+// sparseFileCloser is a sparseFileWriter which sets the size of the file and
+// closes it when it is closed.
+type sparseFileCloser struct {
+	*sparseFileWriter
+}
+
+func (s sparseFileCloser) Close() error {
+	err := s.finish()
+	if err2 := s.file.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
@@ -0,0 +1,184 @@
+package chunked
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+
+	"github.com/containers/storage/pkg/chunked/internal"
+	"github.com/pkg/errors"
+)
+
+// splitTrailerOverhead is a bound for the size of the parts of the trailer of
+// a blob which don't depend on the manifest entries: the frame headers, the
+// footer, and the other fields of the manifest.
+const splitTrailerOverhead = 1024
+
+// BlobPart is one of the blobs which a zstd:chunked blob is split into by
+// SplitChunkedBlob.  A part is itself a zstd:chunked blob, made of a range of
+// the frames of the original blob, followed by a new manifest which lists the
+// files whose contents are in that range.
+type BlobPart struct {
+	// Offset and Length are the position, in the original blob, of the
+	// frames which make up the part.
+	Offset int64
+	Length int64
+	// Trailer holds the manifest and the footer of the part, which
+	// follow its frames.
+	Trailer []byte
+	// Annotations are the annotations of the part, which describe the
+	// position of its manifest.
+	Annotations map[string]string
+	// Entries are the entries of the part's manifest, with offsets
+	// relative to the start of the part.
+	Entries []FileMetadata
+}
+
+// Size returns the size of the part.
+func (p *BlobPart) Size() int64 {
+	return p.Length + int64(len(p.Trailer))
+}
+
+// Reader returns the contents of the part, given the original blob.
+func (p *BlobPart) Reader(src io.ReaderAt) io.Reader {
+	return io.MultiReader(io.NewSectionReader(src, p.Offset, p.Length), bytes.NewReader(p.Trailer))
+}
+
+// SplitChunkedBlob splits the zstd:chunked blob of the given size, which can
+// be read from src, into parts which are no bigger than maxBlobSize, so that
+// they can be stored separately.  The blob is only split between the frames
+// of different files, so that every part is a valid zstd:chunked blob, whose
+// manifest lists the files it holds.  The frames of the parts, in order, are
+// the frames of the original blob.  An error is returned if the frames of a
+// single file, together with a manifest, don't fit in maxBlobSize.  Blobs
+// which don't use the internal.LayoutSequential layout, or which have their
+// manifest first, can't be split.
+func SplitChunkedBlob(src io.ReaderAt, size, maxBlobSize int64) ([]BlobPart, error) {
+	toc, manifestStart, err := readZstdChunkedTOC(src, size)
+	if err != nil {
+		return nil, err
+	}
+	if toc.Layout != internal.LayoutSequential {
+		return nil, errors.Errorf("blobs with the %q layout can't be split", toc.Layout)
+	}
+	if manifestStart == size-(8+internal.FooterSizeSupported) {
+		return nil, errors.New("blobs with the manifest first can't be split")
+	}
+	footer := make([]byte, internal.FooterSizeSupported)
+	if _, err := src.ReadAt(footer, size-int64(len(footer))); err != nil {
+		return nil, err
+	}
+	manifestType := binary.LittleEndian.Uint64(footer[24:32])
+	magic := footer[32:40]
+
+	// A group is a run of entries which must stay in the same part: a
+	// regular file with a payload, its chunks, and any entries without a
+	// payload which precede it.  The blob can be cut where a group ends.
+	type group struct {
+		entries []internal.FileMetadata
+		// end is where the frames of the group's payload end.
+		end int64
+		// manifestSize is the size of the group's entries in the
+		// manifest.
+		manifestSize int64
+	}
+	var groups []group
+	var current group
+	for i, e := range toc.Entries {
+		encoded, err := json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		current.entries = append(current.entries, e)
+		current.manifestSize += int64(len(encoded)) + 1
+		if e.EndOffset > current.end {
+			current.end = e.EndOffset
+		}
+		if (e.Type == internal.TypeReg || e.Type == internal.TypeChunk) && e.EndOffset > 0 &&
+			(i+1 == len(toc.Entries) || toc.Entries[i+1].Type != internal.TypeChunk) {
+			groups = append(groups, current)
+			current = group{}
+		}
+	}
+	if len(current.entries) > 0 || len(groups) == 0 {
+		groups = append(groups, current)
+	}
+	// The last part also holds whatever follows the last payload, such as
+	// the end-of-archive marker.
+	groups[len(groups)-1].end = manifestStart
+
+	// makePart creates the part holding the frames from start to end, and
+	// the specified entries.
+	makePart := func(start, end int64, entries []internal.FileMetadata) (BlobPart, error) {
+		part := BlobPart{
+			Offset:      start,
+			Length:      end - start,
+			Annotations: make(map[string]string),
+			Entries:     make([]FileMetadata, len(entries)),
+		}
+		names := make(map[string]bool)
+		for i, e := range entries {
+			if e.EndOffset > 0 {
+				e.Offset -= start
+				e.EndOffset -= start
+			}
+			part.Entries[i] = e
+			names[e.Name] = true
+		}
+		partTOC := internal.TOC{
+			Entries:        part.Entries,
+			ChunkHasher:    toc.ChunkHasher,
+			DigestEncoding: toc.DigestEncoding,
+			OffsetEncoding: toc.OffsetEncoding,
+		}
+		for _, name := range toc.Prefetch {
+			if names[name] {
+				partTOC.Prefetch = append(partTOC.Prefetch, name)
+			}
+		}
+		var trailer bytes.Buffer
+		if err := internal.WriteZstdChunkedManifest(&trailer, part.Annotations, uint64(part.Length), &partTOC, 3, magic, manifestType); err != nil {
+			return part, err
+		}
+		part.Trailer = trailer.Bytes()
+		return part, nil
+	}
+
+	var parts []BlobPart
+	start := int64(0)
+	for len(groups) > 0 {
+		// Take as many groups as the estimated size of the part allows,
+		// then make sure that the part really fits.
+		n := 0
+		manifestSize := int64(splitTrailerOverhead)
+		for n < len(groups) && groups[n].end-start+manifestSize+groups[n].manifestSize <= maxBlobSize {
+			manifestSize += groups[n].manifestSize
+			n++
+		}
+		for ; n > 0; n-- {
+			var entries []internal.FileMetadata
+			for _, g := range groups[:n] {
+				entries = append(entries, g.entries...)
+			}
+			part, err := makePart(start, groups[n-1].end, entries)
+			if err != nil {
+				return nil, err
+			}
+			if part.Size() <= maxBlobSize {
+				parts = append(parts, part)
+				break
+			}
+		}
+		if n == 0 {
+			name := ""
+			if len(groups[0].entries) > 0 {
+				name = groups[0].entries[len(groups[0].entries)-1].Name
+			}
+			return nil, errors.Errorf("the frames of %q don't fit in a blob of %d bytes", name, maxBlobSize)
+		}
+		start = groups[n-1].end
+		groups = groups[n:]
+	}
+	return parts, nil
+}
@@ -4,7 +4,6 @@ import (
 	archivetar "archive/tar"
 	"context"
 	"encoding/base64"
-	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -56,6 +55,10 @@ type chunkedDiffer struct {
 	tocOffset      int64
 	fileType       compressedFileType
 
+	// restoreSparseFiles leaves the ranges of files which the manifest
+	// records as zeros as holes, instead of writing the zeros.
+	restoreSparseFiles bool
+
 	gzipReader *pgzip.Reader
 }
 
@@ -70,7 +73,9 @@ func timeToTimespec(time time.Time) (ts unix.Timespec) {
 		ts.Nsec = ((1 << 30) - 2)
 		return
 	}
-	return unix.NsecToTimespec(time.UnixNano())
+	// Don't use UnixNano(), which overflows for times before 1678 or
+	// after 2262.
+	return unix.Timespec{Sec: time.Unix(), Nsec: int64(time.Nanosecond())}
 }
 
 func doHardLink(srcFd int, destDirFd int, destBase string) error {
@@ -161,8 +166,8 @@ func getLayersCache(store storage.Store) (map[string][]internal.FileMetadata, ma
 		if err != nil {
 			return nil, nil, fmt.Errorf("open manifest file for layer %q: %w", r.ID, err)
 		}
-		var toc internal.TOC
-		if err := json.Unmarshal(manifest, &toc); err != nil {
+		toc, err := internal.ParseTOC(manifest)
+		if err != nil {
 			continue
 		}
 		layersMetadata[r.ID] = toc.Entries
@@ -344,8 +349,13 @@ func findFileInOtherLayers(file *internal.FileMetadata, dirfd int, layersMetadat
 	return false, nil, 0, nil
 }
 
-func getFileDigest(f *os.File) (digest.Digest, error) {
-	digester := digest.Canonical.Digester()
+// getFileDigest computes the digest of the content of f, using the same hasher
+// which was used for expected.
+func getFileDigest(f *os.File, expected string) (string, error) {
+	digester, err := internal.NewChunkDigesterForDigest(expected)
+	if err != nil {
+		return "", err
+	}
 	if _, err := io.Copy(digester.Hash(), f); err != nil {
 		return "", err
 	}
@@ -432,17 +442,12 @@ func findFileOnTheHost(file *internal.FileMetadata, dirfd int, useHardLinks bool
 	f := os.NewFile(uintptr(fd), "fd")
 	defer f.Close()
 
-	manifestChecksum, err := digest.Parse(file.Digest)
-	if err != nil {
-		return false, nil, 0, err
-	}
-
-	checksum, err := getFileDigest(f)
+	checksum, err := getFileDigest(f, file.Digest)
 	if err != nil {
 		return false, nil, 0, err
 	}
 
-	if checksum != manifestChecksum {
+	if checksum != file.Digest {
 		return false, nil, 0, nil
 	}
 
@@ -459,12 +464,12 @@ func findFileOnTheHost(file *internal.FileMetadata, dirfd int, useHardLinks bool
 		dstFile.Close()
 		return false, nil, 0, err
 	}
-	checksum, err = getFileDigest(f)
+	checksum, err = getFileDigest(f, file.Digest)
 	if err != nil {
 		dstFile.Close()
 		return false, nil, 0, err
 	}
-	if checksum != manifestChecksum {
+	if checksum != file.Digest {
 		dstFile.Close()
 		return false, nil, 0, nil
 	}
@@ -543,14 +548,25 @@ func setFileAttrs(dirfd int, file *os.File, mode os.FileMode, metadata *internal
 		baseName = filepath.Base(metadata.Name)
 	}
 
+	// Special files can't be opened without side effects, so they are
+	// opened with O_PATH, which the f* syscalls reject with EBADF, and
+	// are then changed through their /proc/self/fd path instead.
+	isSpecial := t == tar.TypeChar || t == tar.TypeBlock || t == tar.TypeFifo
+
 	doChown := func() error {
 		if usePath {
 			return unix.Fchownat(dirfd, baseName, metadata.UID, metadata.GID, unix.AT_SYMLINK_NOFOLLOW)
 		}
+		if isSpecial {
+			return unix.Fchownat(fd, "", metadata.UID, metadata.GID, unix.AT_EMPTY_PATH)
+		}
 		return unix.Fchown(fd, metadata.UID, metadata.GID)
 	}
 
 	doSetXattr := func(k string, v []byte) error {
+		if isSpecial {
+			return unix.Setxattr(fmt.Sprintf("/proc/self/fd/%d", fd), k, v, 0)
+		}
 		return unix.Fsetxattr(fd, k, v, 0)
 	}
 
@@ -566,6 +582,9 @@ func setFileAttrs(dirfd int, file *os.File, mode os.FileMode, metadata *internal
 		if usePath {
 			return unix.Fchmodat(dirfd, baseName, uint32(mode), unix.AT_SYMLINK_NOFOLLOW)
 		}
+		if isSpecial {
+			return unix.Chmod(fmt.Sprintf("/proc/self/fd/%d", fd), uint32(mode))
+		}
 		return unix.Fchmod(fd, uint32(mode))
 	}
 
@@ -579,14 +598,14 @@ func setFileAttrs(dirfd int, file *os.File, mode os.FileMode, metadata *internal
 		return err == nil || errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.ENOTSUP)
 	}
 
-	for k, v := range metadata.Xattrs {
+	xattrs, err := DecodeXattrs(metadata.Xattrs)
+	if err != nil {
+		return fmt.Errorf("xattrs for %q: %w", metadata.Name, err)
+	}
+	for k, data := range xattrs {
 		if _, found := xattrsToIgnore[k]; found {
 			continue
 		}
-		data, err := base64.StdEncoding.DecodeString(v)
-		if err != nil {
-			return fmt.Errorf("decode xattr %q: %w", v, err)
-		}
 		if err := doSetXattr(k, data); !canIgnore(err) {
 			return fmt.Errorf("set xattr %s=%q for %q: %w", k, data, metadata.Name, err)
 		}
@@ -767,9 +786,27 @@ func (c *chunkedDiffer) createFileFromCompressedStream(dest string, dirfd int, r
 		}
 	}()
 
-	digester := digest.Canonical.Digester()
+	digester, err := internal.NewChunkDigesterForDigest(metadata.Digest)
+	if err != nil {
+		return err
+	}
 	checksum := digester.Hash()
-	to := io.MultiWriter(file, checksum)
+	var fileDest io.Writer = file
+	var sparse *sparseFileWriter
+	// the unallocated ranges are left as holes even when the other
+	// zero ranges are written out
+	holes := metadata.UnallocatedRanges
+	if c.restoreSparseFiles {
+		holes = metadata.ZeroRanges
+	}
+	if len(holes) > 0 {
+		sparse, err = newSparseFileWriter(file, holes)
+		if err != nil {
+			return fmt.Errorf("%q: %w", metadata.Name, err)
+		}
+		fileDest = sparse
+	}
+	to := io.MultiWriter(fileDest, checksum)
 
 	switch c.fileType {
 	case fileTypeZstdChunked:
@@ -809,13 +846,14 @@ func (c *chunkedDiffer) createFileFromCompressedStream(dest string, dirfd int, r
 		return fmt.Errorf("unknown file type %q", c.fileType)
 	}
 
-	manifestChecksum, err := digest.Parse(metadata.Digest)
-	if err != nil {
-		return err
-	}
-	if digester.Digest() != manifestChecksum {
+	if digester.Digest() != metadata.Digest {
 		return fmt.Errorf("checksum mismatch for %q", dest)
 	}
+	if sparse != nil {
+		if err := sparse.finish(); err != nil {
+			return err
+		}
+	}
 	return setFileAttrs(dirfd, file, mode, metadata, options, false)
 }
 
@@ -867,6 +905,14 @@ func mergeMissingChunks(missingChunks []missingChunk, target int) []missingChunk
 		return missingChunks
 	}
 
+	// the gaps are computed between consecutive chunks in the blob, but
+	// the chunks are not necessarily in that order, e.g. with
+	// LayoutDigestSorted, LayoutShared or after prioritizeMissingChunks.
+	missingChunks = append([]missingChunk{}, missingChunks...)
+	sort.SliceStable(missingChunks, func(i, j int) bool {
+		return missingChunks[i].RawChunk.Offset < missingChunks[j].RawChunk.Offset
+	})
+
 	getGap := func(missingChunks []missingChunk, i int) int {
 		prev := missingChunks[i-1].RawChunk.Offset + missingChunks[i-1].RawChunk.Length
 		return int(missingChunks[i].RawChunk.Offset - prev)
@@ -904,6 +950,37 @@ func mergeMissingChunks(missingChunks []missingChunk, target int) []missingChunk
 	return newMissingChunks
 }
 
+// prioritizeMissingChunks splits missingChunks, where each chunk refers to a
+// single file, in two lists: the chunks for the files listed in prefetch,
+// sorted in the same order as prefetch, and all the other ones.
+func prioritizeMissingChunks(missingChunks []missingChunk, prefetch []string) ([]missingChunk, []missingChunk) {
+	if len(prefetch) == 0 {
+		return nil, missingChunks
+	}
+	priorities := make(map[string]int)
+	for i, name := range prefetch {
+		name = filepath.Clean("/" + name)
+		if _, found := priorities[name]; !found {
+			priorities[name] = i
+		}
+	}
+
+	var prioritized, others []missingChunk
+	for _, mc := range missingChunks {
+		if len(mc.Files) == 1 && mc.Files[0].File != nil {
+			if _, found := priorities[filepath.Clean("/"+mc.Files[0].File.Name)]; found {
+				prioritized = append(prioritized, mc)
+				continue
+			}
+		}
+		others = append(others, mc)
+	}
+	sort.SliceStable(prioritized, func(i, j int) bool {
+		return priorities[filepath.Clean("/"+prioritized[i].Files[0].File.Name)] < priorities[filepath.Clean("/"+prioritized[j].Files[0].File.Name)]
+	})
+	return prioritized, others
+}
+
 func (c *chunkedDiffer) retrieveMissingFiles(dest string, dirfd int, missingChunks []missingChunk, options *archive.TarOptions) error {
 	var chunksToRequest []ImageSourceChunk
 	for _, c := range missingChunks {
@@ -1029,6 +1106,49 @@ func safeSymlink(dirfd int, mode os.FileMode, metadata *internal.FileMetadata, o
 	return nil
 }
 
+// safeMknod creates the FIFO or device described by metadata.
+func safeMknod(dirfd int, mode os.FileMode, metadata *internal.FileMetadata, options *archive.TarOptions) error {
+	t, err := typeToTarType(metadata.Type)
+	if err != nil {
+		return err
+	}
+	kind := uint32(unix.S_IFIFO)
+	switch t {
+	case tar.TypeChar:
+		kind = unix.S_IFCHR
+	case tar.TypeBlock:
+		kind = unix.S_IFBLK
+	}
+	if kind != unix.S_IFIFO && options.InUserNS {
+		logrus.Debugf("Can't create device %q while running in user namespace", metadata.Name)
+		return nil
+	}
+
+	destDir, destBase := filepath.Dir(metadata.Name), filepath.Base(metadata.Name)
+	destDirFd := dirfd
+	if destDir != "." {
+		f, err := openOrCreateDirUnderRoot(destDir, dirfd, 0)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		destDirFd = int(f.Fd())
+	}
+
+	dev := unix.Mkdev(uint32(metadata.Devmajor), uint32(metadata.Devminor))
+	if err := unix.Mknodat(destDirFd, destBase, kind|uint32(mode)&07777, int(dev)); err != nil {
+		return fmt.Errorf("mknod %q: %w", metadata.Name, err)
+	}
+
+	file, err := openFileUnderRoot(metadata.Name, dirfd, unix.O_PATH|unix.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return setFileAttrs(dirfd, file, mode, metadata, options, false)
+}
+
 type whiteoutHandler struct {
 	Dirfd int
 	Root  string
@@ -1095,6 +1215,33 @@ func (d whiteoutHandler) Chown(path string, uid, gid int) error {
 	return nil
 }
 
+// sameContentFile is a file whose payload is the same as the one of source,
+// which is retrieved instead.
+type sameContentFile struct {
+	source *internal.FileMetadata
+	file   *internal.FileMetadata
+}
+
+// createSameContentFile creates f.file from f.source, once it was retrieved.
+func createSameContentFile(dirfd int, f sameContentFile, options *archive.TarOptions, useHardLinks bool) error {
+	srcFile, err := openFileUnderRoot(f.source.Name, dirfd, unix.O_RDONLY, 0)
+	if err != nil {
+		return fmt.Errorf("open source file %q: %w", f.source.Name, err)
+	}
+	defer srcFile.Close()
+
+	useHardLinks = useHardLinks && canDedupMetadataWithHardLink(f.file, f.source)
+	dstFile, _, err := copyFileContent(int(srcFile.Fd()), f.file.Name, dirfd, 0, useHardLinks)
+	if err != nil {
+		return err
+	}
+	if dstFile == nil {
+		return nil
+	}
+	defer dstFile.Close()
+	return setFileAttrs(dirfd, dstFile, os.FileMode(f.file.Mode), f.file, options, false)
+}
+
 type hardLinkToCreate struct {
 	dest     string
 	dirfd    int
@@ -1133,16 +1280,27 @@ func (c *chunkedDiffer) ApplyDiff(dest string, options *archive.TarOptions) (gra
 	// modifies the source file as well.
 	useHardLinks := parseBooleanPullOption(&storeOpts, "use_hard_links", false)
 
+	c.restoreSparseFiles = parseBooleanPullOption(&storeOpts, "restore_sparse_files", false)
+
 	// List of OSTree repositories to use for deduplication
 	ostreeRepos := strings.Split(storeOpts.PullOptions["ostree_repos"], ":")
 
 	// Generate the manifest
-	var toc internal.TOC
-	if err := json.Unmarshal(c.manifest, &toc); err != nil {
+	toc, err := internal.ParseTOC(c.manifest)
+	if err != nil {
+		return output, err
+	}
+	if toc.Layout != internal.LayoutSequential && toc.Layout != internal.LayoutDigestSorted && toc.Layout != internal.LayoutShared {
+		return output, fmt.Errorf("unknown layout %q", toc.Layout)
+	}
+
+	// The tarball is reassembled from the files and the tar-split
+	// metadata when the layer is exported.
+	if output.TarSplit, err = readTarSplit(c.stream, toc); err != nil {
 		return output, err
 	}
 
-	whiteoutConverter := archive.GetWhiteoutConverter(options.WhiteoutFormat, options.WhiteoutData)
+	whiteoutConverter := archive.GetWhiteoutConverterForOptions(options)
 
 	var missingChunks []missingChunk
 
@@ -1176,6 +1334,11 @@ func (c *chunkedDiffer) ApplyDiff(dest string, options *archive.TarOptions) (gra
 	// are retrieved
 	var hardLinks []hardLinkToCreate
 
+	// files are retrieved only once for each payload, the other files
+	// with the same payload are copied once it is retrieved.
+	retrievedPayloads := make(map[ImageSourceChunk]*internal.FileMetadata)
+	var sameContentFiles []sameContentFile
+
 	missingChunksSize, totalChunksSize := int64(0), int64(0)
 	for i, r := range mergedEntries {
 		if options.ForceMask != nil {
@@ -1262,10 +1425,12 @@ func (c *chunkedDiffer) ApplyDiff(dest string, options *archive.TarOptions) (gra
 			}
 			continue
 
-		case tar.TypeChar:
-		case tar.TypeBlock:
-		case tar.TypeFifo:
-			/* Ignore.  */
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			if err := safeMknod(dirfd, mode, &r, options); err != nil {
+				return output, err
+			}
+			continue
+
 		default:
 			return output, fmt.Errorf("invalid type %q", t)
 		}
@@ -1317,12 +1482,21 @@ func (c *chunkedDiffer) ApplyDiff(dest string, options *archive.TarOptions) (gra
 			}
 		}
 
+		rawChunk := ImageSourceChunk{
+			Offset: uint64(r.Offset),
+			Length: uint64(r.EndOffset - r.Offset),
+		}
+		if source, found := retrievedPayloads[rawChunk]; found && t == tar.TypeReg {
+			sameContentFiles = append(sameContentFiles, sameContentFile{
+				source: source,
+				file:   &mergedEntries[i],
+			})
+			continue
+		}
+
 		missingChunksSize += r.Size
 		if t == tar.TypeReg {
-			rawChunk := ImageSourceChunk{
-				Offset: uint64(r.Offset),
-				Length: uint64(r.EndOffset - r.Offset),
-			}
+			retrievedPayloads[rawChunk] = &mergedEntries[i]
 
 			file := missingFile{
 				File: &mergedEntries[i],
@@ -1336,6 +1510,15 @@ func (c *chunkedDiffer) ApplyDiff(dest string, options *archive.TarOptions) (gra
 			})
 		}
 	}
+	// Retrieve first the files that the manifest asks to prefetch, in the
+	// requested order, so that they are available as soon as possible.
+	prefetchChunks, missingChunks := prioritizeMissingChunks(missingChunks, toc.Prefetch)
+	if len(prefetchChunks) > 0 {
+		if err := c.retrieveMissingFiles(dest, dirfd, prefetchChunks, options); err != nil {
+			return output, err
+		}
+	}
+
 	// There are some missing files.  Prepare a multirange request for the missing chunks.
 	if len(missingChunks) > 0 {
 		missingChunks = mergeMissingChunks(missingChunks, maxNumberMissingChunks)
@@ -1344,6 +1527,12 @@ func (c *chunkedDiffer) ApplyDiff(dest string, options *archive.TarOptions) (gra
 		}
 	}
 
+	for _, f := range sameContentFiles {
+		if err := createSameContentFile(dirfd, f, options, useHardLinks); err != nil {
+			return output, err
+		}
+	}
+
 	for _, m := range hardLinks {
 		if err := safeLink(m.dirfd, m.mode, m.metadata, options); err != nil {
 			return output, err
@@ -0,0 +1,86 @@
+package chunked
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/pkg/archive"
+	"github.com/containers/storage/pkg/chunked/compressor"
+	"github.com/containers/storage/types"
+)
+
+func TestApplyDiffWithDifferTarSplit(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("the overlay driver needs to be run as root")
+	}
+	dir, err := ioutil.TempDir("", "chunked-differ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	// the differ reads the pull options from the configuration file
+	conf := filepath.Join(dir, "storage.conf")
+	if err := ioutil.WriteFile(conf, []byte("[storage]\ndriver = \"overlay\"\n[storage.options]\npull_options = {enable_partial_images = \"true\"}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("CONTAINERS_STORAGE_CONF", conf)
+	defer os.Unsetenv("CONTAINERS_STORAGE_CONF")
+
+	store, err := storage.GetStore(types.StoreOptions{
+		RunRoot:         filepath.Join(dir, "run"),
+		GraphRoot:       filepath.Join(dir, "root"),
+		GraphDriverName: "overlay",
+	})
+	if err != nil {
+		t.Skipf("the overlay driver can't be used: %v", err)
+	}
+	defer store.Shutdown(true)
+
+	files := []testFile{
+		{name: "etc/config", contents: "config"},
+		{name: "usr/bin/tool", contents: randomContents(3, 100000)},
+		{name: "empty", contents: ""},
+	}
+	tarball := makeTestTar(t, files)
+	blob, annotations := makeZstdChunkedBlob(t, files, &compressor.Options{TarSplit: true})
+
+	differ, err := GetDiffer(context.Background(), store, int64(len(blob)), annotations, bytesSeekable(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer, err := store.CreateLayer("", "", nil, "", true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := store.ApplyDiffWithDiffer("", nil, differ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output.TarSplit == nil {
+		t.Fatal("The differ didn't return the tar-split metadata")
+	}
+	if err := store.ApplyDiffFromStagingDirectory(layer.ID, output.Target, output, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the layer is exported as the tarball it was pulled from
+	uncompressed := archive.Uncompressed
+	rc, err := store.Diff("", layer.ID, &storage.DiffOptions{Compression: &uncompressed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	diff, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(diff, tarball) {
+		t.Fatal("The layer was not exported as the original tarball")
+	}
+}
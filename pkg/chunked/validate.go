@@ -0,0 +1,145 @@
+package chunked
+
+import (
+	"bytes"
+	"io"
+	"sort"
+
+	"github.com/containers/storage/pkg/chunked/internal"
+	"github.com/klauspost/compress/zstd"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// The kinds of chunks which VerifyChunkBytes can check.
+const (
+	// ChunkTypeData is a chunk stored in the blob as zstd frames, the
+	// way every chunk of a zstd:chunked blob is.
+	ChunkTypeData = "data"
+	// ChunkTypeZeros is a chunk stored like ChunkTypeData, which is in
+	// one of the zero ranges of its file, so it must only hold zeros.
+	ChunkTypeZeros = "zeros"
+	// ChunkTypeRaw is a chunk stored uncompressed, as it is in an
+	// uncompressed tarball.
+	ChunkTypeRaw = "raw"
+	// ChunkTypeUnallocated is a chunk stored like ChunkTypeZeros, which
+	// is in one of the unallocated ranges of its file, so it must only
+	// hold zeros, and is left as a hole when the file is extracted.
+	ChunkTypeUnallocated = "unallocated"
+)
+
+// ValidateManifestBounds checks, without reading the blob, that the ranges
+// of the blob referred to by the entries of a zstd:chunked manifest are
+// within a blob of size blobSize, and that they don't partially overlap one
+// another.  Entries can refer to the same range, as they do when a blob
+// stores identical chunks only once.  Entries without a payload, whose
+// Offset and EndOffset are both 0, are ignored.  It returns an error
+// describing the first entry found to be invalid, in the order of the
+// manifest.
+func ValidateManifestBounds(manifest []FileMetadata, blobSize int64) error {
+	type blobRange struct {
+		index             int
+		offset, endOffset int64
+	}
+	var ranges []blobRange
+	for i, e := range manifest {
+		if e.Offset == 0 && e.EndOffset == 0 {
+			continue
+		}
+		if e.Offset < 0 || e.EndOffset <= e.Offset || e.EndOffset > blobSize {
+			return errors.Errorf("entry %d (%q) refers to range [%d, %d), out of a blob of %d bytes", i, e.Name, e.Offset, e.EndOffset, blobSize)
+		}
+		ranges = append(ranges, blobRange{index: i, offset: e.Offset, endOffset: e.EndOffset})
+	}
+	sort.SliceStable(ranges, func(i, j int) bool {
+		if ranges[i].offset != ranges[j].offset {
+			return ranges[i].offset < ranges[j].offset
+		}
+		return ranges[i].endOffset < ranges[j].endOffset
+	})
+	if len(ranges) == 0 {
+		return nil
+	}
+	// reach is the range seen so far which ends last.  Of two overlapping
+	// entries, the one which comes later in the manifest is reported.
+	reach := ranges[0]
+	bad := -1
+	for i := 1; i < len(ranges); i++ {
+		cur := ranges[i]
+		if cur.offset < reach.endOffset && (cur.offset != reach.offset || cur.endOffset != reach.endOffset) {
+			index := reach.index
+			if cur.index > index {
+				index = cur.index
+			}
+			if bad == -1 || index < bad {
+				bad = index
+			}
+		}
+		if cur.endOffset > reach.endOffset {
+			reach = cur
+		}
+	}
+	if bad != -1 {
+		e := manifest[bad]
+		return errors.Errorf("entry %d (%q) refers to range [%d, %d), which overlaps another entry", bad, e.Name, e.Offset, e.EndOffset)
+	}
+	return nil
+}
+
+// errNotZeros is returned by zeroChecker.
+var errNotZeros = errors.New("the chunk of a zero range holds other bytes than zeros")
+
+// zeroChecker fails writes of anything else than zeros.
+type zeroChecker struct{}
+
+func (zeroChecker) Write(p []byte) (int, error) {
+	for i, b := range p {
+		if b != 0 {
+			return i, errNotZeros
+		}
+	}
+	return len(p), nil
+}
+
+// VerifyChunkBytes checks a single chunk fetched from a blob, whose bytes,
+// compressed unless chunkType is ChunkTypeRaw, are in compressed, against
+// the digest of its uncompressed contents recorded in the manifest, without
+// any other part of the blob or of the manifest.  chunkType is one of
+// ChunkTypeData, ChunkTypeZeros, ChunkTypeUnallocated, and ChunkTypeRaw.  The digest can be
+// computed with any of the chunk hashers, including the ones registered
+// with compressor.RegisterChunkHasher.  The chunk is decompressed as it is
+// hashed, so it is never held uncompressed in memory.
+func VerifyChunkBytes(compressed []byte, expectedUncompressedDigest digest.Digest, chunkType string) error {
+	digester, err := internal.NewChunkDigesterForDigest(expectedUncompressedDigest.String())
+	if err != nil {
+		return err
+	}
+	dest := io.Writer(digester.Hash())
+	var contents io.Reader
+	switch chunkType {
+	case ChunkTypeRaw:
+		contents = bytes.NewReader(compressed)
+	case ChunkTypeData, ChunkTypeZeros, ChunkTypeUnallocated:
+		decoder, err := zstd.NewReader(bytes.NewReader(compressed), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		defer decoder.Close()
+		contents = decoder
+		if chunkType == ChunkTypeZeros || chunkType == ChunkTypeUnallocated {
+			dest = io.MultiWriter(zeroChecker{}, dest)
+		}
+	default:
+		return errors.Errorf("unknown chunk type %q", chunkType)
+	}
+	if _, err := io.Copy(dest, contents); err != nil {
+		if err == errNotZeros {
+			return err
+		}
+		return errors.Wrapf(err, "decompressing the chunk")
+	}
+	if digester.Digest() != expectedUncompressedDigest.String() {
+		return errors.Errorf("checksum mismatch for the chunk: expected %s, got %s", expectedUncompressedDigest, digester.Digest())
+	}
+	return nil
+}
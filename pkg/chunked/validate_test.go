@@ -0,0 +1,141 @@
+package chunked
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestValidateManifestBounds(t *testing.T) {
+	valid := []FileMetadata{
+		{Type: TypeDir, Name: "dir"},
+		{Type: TypeReg, Name: "dir/single", Offset: 100, EndOffset: 120},
+		{Type: TypeReg, Name: "dir/multi", Offset: 120, EndOffset: 150, ChunkSize: 100},
+		{Type: TypeChunk, Name: "dir/multi", Offset: 150, EndOffset: 170, ChunkOffset: 100},
+		{Type: TypeReg, Name: "empty"},
+		{Type: TypeLink, Name: "link", Linkname: "dir/multi"},
+		// the same chunk stored only once
+		{Type: TypeReg, Name: "copy", Offset: 100, EndOffset: 120},
+	}
+	if err := ValidateManifestBounds(valid, 200); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateManifestBounds(nil, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name     string
+		entries  []FileMetadata
+		blobSize int64
+		bad      string
+	}{
+		{"past the end", valid, 160, "entry 3 "},
+		{"negative offset", []FileMetadata{{Name: "a", Offset: -10, EndOffset: 10}}, 100, "entry 0 "},
+		{"reversed", []FileMetadata{{Name: "a", Offset: 10, EndOffset: 20}, {Name: "b", Offset: 30, EndOffset: 25}}, 100, "entry 1 "},
+		{"no end", []FileMetadata{{Name: "a", Offset: 10}}, 100, "entry 0 "},
+		{"overlapping", []FileMetadata{
+			{Name: "a", Offset: 10, EndOffset: 20},
+			{Name: "b", Offset: 20, EndOffset: 40},
+			{Name: "c", Offset: 60, EndOffset: 70},
+			{Name: "d", Offset: 30, EndOffset: 50},
+			{Name: "e", Offset: 15, EndOffset: 25},
+		}, 100, "entry 3 "},
+		{"contained", []FileMetadata{
+			{Name: "a", Offset: 10, EndOffset: 100},
+			{Name: "b", Offset: 20, EndOffset: 30},
+			{Name: "c", Offset: 50, EndOffset: 60},
+		}, 100, "entry 1 "},
+	} {
+		err := ValidateManifestBounds(c.entries, c.blobSize)
+		if err == nil {
+			t.Fatalf("%s: invalid manifest accepted", c.name)
+		}
+		if !strings.HasPrefix(err.Error(), c.bad) {
+			t.Fatalf("%s: expected an error about %q, got %v", c.name, c.bad, err)
+		}
+	}
+}
+
+// compressChunk compresses contents in a zstd frame, as a chunk is.
+func compressChunk(t *testing.T, contents []byte) []byte {
+	var buf bytes.Buffer
+	w, err := zstd.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestVerifyChunkBytes(t *testing.T) {
+	data := []byte(strings.Repeat("chunk data ", 1000))
+	zeros := make([]byte, 8192)
+	compressedData := compressChunk(t, data)
+	compressedZeros := compressChunk(t, zeros)
+
+	if err := VerifyChunkBytes(compressedData, digest.FromBytes(data), ChunkTypeData); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyChunkBytes(compressedZeros, digest.FromBytes(zeros), ChunkTypeZeros); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyChunkBytes(data, digest.FromBytes(data), ChunkTypeRaw); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyChunkBytes(compressedZeros, digest.FromBytes(zeros), ChunkTypeUnallocated); err != nil {
+		t.Fatal(err)
+	}
+	// the digest may come from another chunk hasher
+	sum := sha512.Sum512(data)
+	if err := VerifyChunkBytes(compressedData, digest.Digest("sha512:"+hex.EncodeToString(sum[:])), ChunkTypeData); err != nil {
+		t.Fatal(err)
+	}
+
+	// a range which was corrupted in transit
+	corrupted := append([]byte(nil), compressedData...)
+	corrupted[len(corrupted)/2] ^= 0xff
+	if err := VerifyChunkBytes(corrupted, digest.FromBytes(data), ChunkTypeData); err == nil {
+		t.Fatal("Corrupted chunk not detected")
+	}
+	// a truncated range
+	if err := VerifyChunkBytes(compressedData[:len(compressedData)-4], digest.FromBytes(data), ChunkTypeData); err == nil {
+		t.Fatal("Truncated chunk not detected")
+	}
+	rawCorrupted := append([]byte(nil), data...)
+	rawCorrupted[0] = 'C'
+	if err := VerifyChunkBytes(rawCorrupted, digest.FromBytes(data), ChunkTypeRaw); err == nil {
+		t.Fatal("Corrupted raw chunk not detected")
+	}
+	if err := VerifyChunkBytes(compressedData, digest.FromBytes(zeros), ChunkTypeData); err == nil {
+		t.Fatal("Wrong chunk not detected")
+	}
+	// a zero chunk must only hold zeros, whatever its digest
+	if err := VerifyChunkBytes(compressedData, digest.FromBytes(data), ChunkTypeZeros); err != errNotZeros {
+		t.Fatalf("Unexpected error for a zero chunk which holds data: %v", err)
+	}
+	if err := VerifyChunkBytes(compressedData, digest.FromBytes(data), ChunkTypeUnallocated); err != errNotZeros {
+		t.Fatalf("Unexpected error for an unallocated chunk which holds data: %v", err)
+	}
+	// compressed data isn't a raw chunk
+	if err := VerifyChunkBytes(compressedData, digest.FromBytes(data), ChunkTypeRaw); err == nil {
+		t.Fatal("Compressed data accepted as a raw chunk")
+	}
+
+	if err := VerifyChunkBytes(compressedData, digest.FromBytes(data), "unknown"); err == nil {
+		t.Fatal("Unknown chunk type accepted")
+	}
+	if err := VerifyChunkBytes(compressedData, "invalid", ChunkTypeData); err == nil {
+		t.Fatal("Invalid digest accepted")
+	}
+}
@@ -0,0 +1,32 @@
+package chunked
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+)
+
+// DecodeXattrs decodes the values of the extended attributes of a manifest
+// entry, which are stored base64 encoded.  An error identifying the
+// attribute is returned if a value is not valid base64.
+func DecodeXattrs(xattrs map[string]string) (map[string][]byte, error) {
+	if len(xattrs) == 0 {
+		return nil, nil
+	}
+	// sort the names, so that the same error is reported every time
+	names := make([]string, 0, len(xattrs))
+	for name := range xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	decoded := make(map[string][]byte, len(xattrs))
+	for _, name := range names {
+		data, err := base64.StdEncoding.DecodeString(xattrs[name])
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 value for xattr %q: %w", name, err)
+		}
+		decoded[name] = data
+	}
+	return decoded, nil
+}
@@ -0,0 +1,44 @@
+package chunked
+
+import (
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeXattrs(t *testing.T) {
+	xattrs := map[string]string{
+		"user.valid":  base64.StdEncoding.EncodeToString([]byte("value\x00with\xffbytes")),
+		"user.empty":  "",
+		"user.binary": base64.StdEncoding.EncodeToString([]byte{0, 1, 2}),
+	}
+	decoded, err := DecodeXattrs(xattrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]byte{
+		"user.valid":  []byte("value\x00with\xffbytes"),
+		"user.empty":  {},
+		"user.binary": {0, 1, 2},
+	}
+	if !reflect.DeepEqual(decoded, expected) {
+		t.Fatalf("Wrong decoded xattrs %v", decoded)
+	}
+
+	decoded, err = DecodeXattrs(nil)
+	if err != nil || len(decoded) != 0 {
+		t.Fatalf("Unexpected result %v, %v for no xattrs", decoded, err)
+	}
+
+	for _, corrupt := range []string{"not base64!", "YWJj=", "YQ"} {
+		xattrs["user.corrupt"] = corrupt
+		_, err := DecodeXattrs(xattrs)
+		if err == nil {
+			t.Fatalf("Invalid value %q not detected", corrupt)
+		}
+		if !strings.Contains(err.Error(), `"user.corrupt"`) {
+			t.Fatalf("The error doesn't identify the invalid xattr: %v", err)
+		}
+	}
+}
@@ -3,15 +3,42 @@
 package chunked
 
 import (
+	"archive/tar"
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
+	"hash/fnv"
 	"io"
 	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/containers/storage/pkg/archive"
+	"github.com/containers/storage/pkg/chunked/compressor"
 	"github.com/containers/storage/pkg/chunked/internal"
+	"github.com/containers/storage/pkg/ioutils"
+	"github.com/klauspost/compress/zstd"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/runc/libcontainer/userns"
+	tarsplit "github.com/vbatts/tar-split/archive/tar"
+	"github.com/vbatts/tar-split/tar/asm"
+	"github.com/vbatts/tar-split/tar/storage"
+	"golang.org/x/sys/unix"
 )
 
 func TestIsZstdChunkedFrameMagic(t *testing.T) {
@@ -95,9 +122,13 @@ func TestGenerateAndParseManifest(t *testing.T) {
 
 	var b bytes.Buffer
 	writer := bufio.NewWriter(&b)
-	if err := internal.WriteZstdChunkedManifest(writer, annotations, offsetManifest, someFiles[:], 9); err != nil {
+	written := &internal.TOC{Entries: someFiles[:]}
+	if err := internal.WriteZstdChunkedManifest(writer, annotations, offsetManifest, written, 9, nil, internal.ManifestTypeCRFS); err != nil {
 		t.Error(err)
 	}
+	if written.Version != 0 {
+		t.Fatalf("The caller's TOC was modified: version %d", written.Version)
+	}
 	if err := writer.Flush(); err != nil {
 		t.Error(err)
 	}
@@ -174,3 +205,2871 @@ func TestGetTarType(t *testing.T) {
 		t.Fatal("Invalid GetType conversion")
 	}
 }
+
+// bytesSeekable is an ImageSourceSeekable which serves any range of an
+// in-memory blob.
+type bytesSeekable []byte
+
+func (b bytesSeekable) GetBlobAt(req []ImageSourceChunk) (chan io.ReadCloser, chan error, error) {
+	m := make(chan io.ReadCloser)
+	e := make(chan error)
+
+	go func() {
+		for _, chunk := range req {
+			m <- ioutil.NopCloser(bytes.NewReader(b[chunk.Offset : chunk.Offset+chunk.Length]))
+		}
+		close(m)
+		close(e)
+	}()
+
+	return m, e, nil
+}
+
+type testFile struct {
+	name     string
+	contents string
+	modTime  time.Time
+}
+
+// makeTestTar creates a tarball containing the specified files.
+func makeTestTar(t *testing.T, files []testFile) []byte {
+	var tarBuffer bytes.Buffer
+	tw := tar.NewWriter(&tarBuffer)
+	for _, f := range files {
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     f.name,
+			Mode:     0644,
+			Size:     int64(len(f.contents)),
+			ModTime:  f.modTime,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(f.contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return tarBuffer.Bytes()
+}
+
+// makeZstdChunkedBlob creates a zstd:chunked blob containing the specified
+// files, and returns it together with its annotations.
+func makeZstdChunkedBlob(t *testing.T, files []testFile, options *compressor.Options) ([]byte, map[string]string) {
+	var blob bytes.Buffer
+	annotations := make(map[string]string)
+	w, err := compressor.ZstdCompressorWithOptions(&blob, annotations, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(makeTestTar(t, files)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return blob.Bytes(), annotations
+}
+
+// readTestTOC reads the manifest of a blob created by makeZstdChunkedBlob.
+func readTestTOC(t *testing.T, blob []byte, annotations map[string]string) internal.TOC {
+	manifest, _, err := readZstdChunkedManifest(bytesSeekable(blob), int64(len(blob)), annotations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toc, err := internal.ParseTOC(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *toc
+}
+
+func TestPrefetchOrderRoundTrip(t *testing.T) {
+	files := []testFile{
+		{name: "usr/lib/libfoo.so", contents: "foo"},
+		{name: "usr/bin/entrypoint", contents: "entrypoint"},
+		{name: "etc/config", contents: "config"},
+	}
+	prefetch := []string{"usr/bin/entrypoint", "usr/lib/libfoo.so"}
+	blob, annotations := makeZstdChunkedBlob(t, files, &compressor.Options{PrefetchOrder: prefetch})
+
+	toc := readTestTOC(t, blob, annotations)
+	if len(toc.Prefetch) != len(prefetch) {
+		t.Fatalf("Invalid prefetch list %v", toc.Prefetch)
+	}
+	for i := range prefetch {
+		if toc.Prefetch[i] != prefetch[i] {
+			t.Fatalf("Invalid prefetch list %v", toc.Prefetch)
+		}
+	}
+}
+
+func TestPrioritizeMissingChunks(t *testing.T) {
+	var missingChunks []missingChunk
+	for i, name := range []string{"/a", "/b", "/c", "/d"} {
+		missingChunks = append(missingChunks, missingChunk{
+			RawChunk: ImageSourceChunk{Offset: uint64(i * 100), Length: 10},
+			Files: []missingFile{
+				{File: &internal.FileMetadata{Name: name}},
+			},
+		})
+	}
+
+	prioritized, others := prioritizeMissingChunks(missingChunks, []string{"d", "./b", "/missing"})
+	if len(prioritized) != 2 || prioritized[0].Files[0].File.Name != "/d" || prioritized[1].Files[0].File.Name != "/b" {
+		t.Fatalf("Invalid prioritized chunks %v", prioritized)
+	}
+	if len(others) != 2 || others[0].Files[0].File.Name != "/a" || others[1].Files[0].File.Name != "/c" {
+		t.Fatalf("Invalid remaining chunks %v", others)
+	}
+
+	prioritized, others = prioritizeMissingChunks(missingChunks, nil)
+	if len(prioritized) != 0 || len(others) != len(missingChunks) {
+		t.Fatal("Chunks prioritized without a prefetch list")
+	}
+}
+
+const testChunkHasher = "test-fnv128a"
+
+var (
+	// testFrameMagic is recognized by the reader, unknownFrameMagic isn't.
+	testFrameMagic    = []byte("testMagc")
+	unknownFrameMagic = []byte("unknown!")
+)
+
+func init() {
+	compressor.RegisterChunkHasher(testChunkHasher, func() hash.Hash {
+		return fnv.New128a()
+	})
+	RegisterFrameMagic(testFrameMagic)
+}
+
+func TestCustomChunkHasher(t *testing.T) {
+	files := []testFile{
+		{name: "file1", contents: "hello"},
+		{name: "file2", contents: "world"},
+	}
+	blob, annotations := makeZstdChunkedBlob(t, files, &compressor.Options{ChunkHasher: testChunkHasher})
+
+	toc := readTestTOC(t, blob, annotations)
+	if toc.ChunkHasher != testChunkHasher {
+		t.Fatalf("Invalid chunk hasher %q recorded in the manifest", toc.ChunkHasher)
+	}
+	if len(toc.Entries) != len(files) {
+		t.Fatalf("Invalid number of entries %d", len(toc.Entries))
+	}
+
+	dest, err := ioutil.TempDir("", "chunk-hasher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+	dirfd, err := unix.Open(dest, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(dirfd)
+
+	c := &chunkedDiffer{fileType: fileTypeZstdChunked}
+	for i, e := range toc.Entries {
+		h := fnv.New128a()
+		h.Write([]byte(files[i].contents))
+		expected := testChunkHasher + ":" + hex.EncodeToString(h.Sum(nil))
+		if e.Digest != expected || e.ChunkDigest != expected {
+			t.Fatalf("Invalid digest %q for %q, expected %q", e.Digest, e.Name, expected)
+		}
+
+		// The digest must be verified with the same hasher when the
+		// file is extracted.
+		reader := bytes.NewReader(blob[e.Offset:e.EndOffset])
+		if err := c.createFileFromCompressedStream(dest, dirfd, reader, 0644, &e, &archive.TarOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		e.Name += ".bad"
+		e.Digest = testChunkHasher + ":" + strings.Repeat("0", 32)
+		reader = bytes.NewReader(blob[e.Offset:e.EndOffset])
+		if err := c.createFileFromCompressedStream(dest, dirfd, reader, 0644, &e, &archive.TarOptions{}); err == nil {
+			t.Fatalf("Checksum mismatch not detected for %q", e.Name)
+		}
+	}
+}
+
+func TestBuiltinChunkHashers(t *testing.T) {
+	files := []testFile{{name: "file", contents: "hello"}}
+	sum := sha512.Sum512_256([]byte("hello"))
+	blob, annotations := makeZstdChunkedBlob(t, files, &compressor.Options{ChunkHasher: "sha512-256"})
+	toc := readTestTOC(t, blob, annotations)
+	if expected := "sha512-256:" + hex.EncodeToString(sum[:]); toc.Entries[0].Digest != expected {
+		t.Fatalf("Invalid digest %q, expected %q", toc.Entries[0].Digest, expected)
+	}
+
+	// The default is still sha256.
+	blob, annotations = makeZstdChunkedBlob(t, files, nil)
+	toc = readTestTOC(t, blob, annotations)
+	if toc.ChunkHasher != "" || !strings.HasPrefix(toc.Entries[0].Digest, "sha256:") {
+		t.Fatalf("Invalid default digest %q", toc.Entries[0].Digest)
+	}
+
+	if _, err := compressor.ZstdCompressorWithOptions(ioutil.Discard, map[string]string{}, &compressor.Options{ChunkHasher: "unknown"}); err == nil {
+		t.Fatal("Unknown chunk hasher accepted")
+	}
+}
+
+func TestReconstructTar(t *testing.T) {
+	files := []testFile{
+		{name: "file1", contents: "hello"},
+		{name: "empty", contents: ""},
+		{name: "file2", contents: strings.Repeat("world", 1000)},
+	}
+	tarball := makeTestTar(t, files)
+	diffID := digest.FromBytes(tarball)
+	blob, _ := makeZstdChunkedBlob(t, files, nil)
+
+	var out bytes.Buffer
+	if err := ReconstructTar(bytes.NewReader(blob), int64(len(blob)), diffID, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), tarball) {
+		t.Fatal("Reconstructed tarball differs from the original")
+	}
+
+	if err := ReconstructTar(bytes.NewReader(blob), int64(len(blob)), digest.FromString("something else"), ioutil.Discard); err == nil {
+		t.Fatal("diffID mismatch not detected")
+	}
+}
+
+func TestReconstructTarFileMismatch(t *testing.T) {
+	files := []testFile{
+		{name: "file1", contents: "hello"},
+		{name: "file2", contents: "world"},
+	}
+	tarball := makeTestTar(t, files)
+	blob, _ := makeZstdChunkedBlob(t, files, nil)
+
+	// Rewrite the manifest with a wrong digest for file1.
+	toc, manifestStart, err := readZstdChunkedTOC(bytes.NewReader(blob), int64(len(blob)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	toc.Entries[0].Digest = digest.FromString("something else").String()
+	toc.Entries[0].ChunkDigest = toc.Entries[0].Digest
+	var badBlob bytes.Buffer
+	badBlob.Write(blob[:manifestStart])
+	if err := internal.WriteZstdChunkedManifest(&badBlob, map[string]string{}, uint64(manifestStart), toc, 3, nil, internal.ManifestTypeCRFS); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	err = ReconstructTar(bytes.NewReader(badBlob.Bytes()), int64(badBlob.Len()), digest.FromBytes(tarball), &out)
+	if err == nil || !strings.Contains(err.Error(), "file1") {
+		t.Fatalf("Checksum mismatch for file1 not detected: %v", err)
+	}
+	// It should fail before reaching the second file.
+	if bytes.Contains(out.Bytes(), []byte("world")) {
+		t.Fatal("Reconstruction continued after a checksum mismatch")
+	}
+}
+
+func TestDecodeZstdChunkedBlob(t *testing.T) {
+	files := []testFile{
+		{name: "file1", contents: "hello"},
+		{name: "file2", contents: strings.Repeat("world", 1000)},
+	}
+	tarball := makeTestTar(t, files)
+	diffID := digest.FromBytes(tarball)
+	blob, annotations := makeZstdChunkedBlob(t, files, &compressor.Options{SortChunksByDigest: true})
+
+	r, err := decodeZstdChunkedBlob(bytes.NewReader(blob), int64(len(blob)), "", annotations, diffID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, tarball) {
+		t.Fatal("Decoded tarball differs from the original")
+	}
+
+	r, err = decodeZstdChunkedBlob(bytes.NewReader(blob), int64(len(blob)), "", annotations, digest.FromString("something else"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(r)
+	r.Close()
+	if err == nil {
+		t.Fatal("diffID mismatch not detected")
+	}
+
+	// blobs without the annotations are left to the store
+	if r, err := decodeZstdChunkedBlob(bytes.NewReader(tarball), int64(len(tarball)), "", nil, diffID); r != nil || err != nil {
+		t.Fatalf("Unexpected result for a tarball: %v, %v", r, err)
+	}
+}
+
+func TestManifestModTimes(t *testing.T) {
+	files := []testFile{
+		{name: "epoch", modTime: time.Unix(0, 0)},
+		{name: "before-epoch", modTime: time.Date(1900, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "far-past", modTime: time.Date(-5000, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "after-2262", modTime: time.Date(2500, time.June, 1, 12, 0, 0, 0, time.UTC)},
+		{name: "far-future", modTime: time.Date(20000, time.January, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	expected := map[string]string{
+		"epoch":        "1970-01-01T00:00:00Z",
+		"before-epoch": "1900-01-01T00:00:00Z",
+		"far-past":     "0000-01-01T00:00:00Z",
+		"after-2262":   "2500-06-01T12:00:00Z",
+		"far-future":   "9999-12-31T23:59:59.999999999Z",
+	}
+	blob, annotations := makeZstdChunkedBlob(t, files, nil)
+	toc := readTestTOC(t, blob, annotations)
+	if len(toc.Entries) != len(files) {
+		t.Fatalf("Expected %d entries, got %d", len(files), len(toc.Entries))
+	}
+	for _, e := range toc.Entries {
+		if got := e.ModTime.Format(time.RFC3339Nano); got != expected[e.Name] {
+			t.Errorf("Wrong modification time for %q: expected %s, got %s", e.Name, expected[e.Name], got)
+		}
+	}
+}
+
+func TestTimeToTimespec(t *testing.T) {
+	if ts := timeToTimespec(time.Time{}); ts.Nsec != unix.UTIME_OMIT {
+		t.Errorf("The zero time should not be applied, got %v", ts)
+	}
+	for _, tm := range []time.Time{
+		time.Unix(0, 0),
+		time.Unix(-1, 500),
+		time.Date(1600, time.January, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2500, time.June, 1, 12, 0, 0, 42, time.UTC),
+		time.Date(9999, time.December, 31, 23, 59, 59, 999999999, time.UTC),
+	} {
+		ts := timeToTimespec(tm)
+		if got := time.Unix(ts.Unix()); !got.Equal(tm) {
+			t.Errorf("Wrong timespec for %v: got %v", tm, got)
+		}
+	}
+}
+
+// slowReader returns a few bytes of an endless tarball at a time, waiting
+// before each read.
+type slowReader struct {
+	r     io.Reader
+	delay time.Duration
+}
+
+func (s slowReader) Read(p []byte) (int, error) {
+	time.Sleep(s.delay)
+	if len(p) > 512 {
+		p = p[:512]
+	}
+	return s.r.Read(p)
+}
+
+func TestCompressionDeadline(t *testing.T) {
+	// A tar header for a huge file, followed by its never-ending contents.
+	var header bytes.Buffer
+	tw := tar.NewWriter(&header)
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     "huge",
+		Mode:     0644,
+		Size:     1 << 40,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	input := slowReader{
+		r:     io.MultiReader(&header, zeroReader{}),
+		delay: 10 * time.Millisecond,
+	}
+
+	var blob bytes.Buffer
+	w, err := compressor.ZstdCompressorWithOptions(&blob, map[string]string{}, &compressor.Options{
+		Deadline: time.Now().Add(200 * time.Millisecond),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, err = io.Copy(w, input)
+	if err != compressor.ErrDeadlineExceeded {
+		t.Fatalf("Expected ErrDeadlineExceeded from Write, got %v", err)
+	}
+	// The error was already reported by Write, but Close must not hang.
+	w.Close()
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Compression was aborted only after %v", elapsed)
+	}
+}
+
+func TestCompressionDeadlineNotExceeded(t *testing.T) {
+	files := []testFile{{name: "file", contents: "hello"}}
+	blob, annotations := makeZstdChunkedBlob(t, files, &compressor.Options{
+		Deadline: time.Now().Add(time.Hour),
+	})
+	toc := readTestTOC(t, blob, annotations)
+	if len(toc.Entries) != 1 {
+		t.Fatalf("Expected 1 entry, got %d", len(toc.Entries))
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestCustomFrameMagic(t *testing.T) {
+	files := []testFile{{name: "file", contents: "hello"}}
+
+	blob, annotations := makeZstdChunkedBlob(t, files, &compressor.Options{FrameMagic: unknownFrameMagic})
+	if !bytes.Equal(blob[len(blob)-8:], unknownFrameMagic) {
+		t.Fatal("Custom frame magic not written to the footer")
+	}
+	if _, _, err := readZstdChunkedManifest(bytesSeekable(blob), int64(len(blob)), annotations); err == nil {
+		t.Fatal("Blob with an unknown frame magic accepted")
+	}
+	// Without the annotations, the footer is checked.
+	delete(annotations, internal.ManifestInfoKey)
+	delete(annotations, internal.ManifestFrameMagicKey)
+	if _, _, err := readZstdChunkedManifest(bytesSeekable(blob), int64(len(blob)), annotations); err == nil || !strings.Contains(err.Error(), "magic") {
+		t.Fatalf("Blob with an unknown frame magic in the footer accepted: %v", err)
+	}
+
+	blob, annotations = makeZstdChunkedBlob(t, files, &compressor.Options{FrameMagic: testFrameMagic})
+	toc := readTestTOC(t, blob, annotations)
+	if len(toc.Entries) != 1 {
+		t.Fatalf("Expected 1 entry, got %d", len(toc.Entries))
+	}
+	delete(annotations, internal.ManifestInfoKey)
+	readTestTOC(t, blob, annotations)
+
+	// Blobs using the upstream magic number don't record it.
+	_, annotations = makeZstdChunkedBlob(t, files, nil)
+	if _, found := annotations[internal.ManifestFrameMagicKey]; found {
+		t.Fatal("Default frame magic recorded in the annotations")
+	}
+
+	if _, err := compressor.ZstdCompressorWithOptions(ioutil.Discard, map[string]string{}, &compressor.Options{FrameMagic: []byte("short")}); err == nil {
+		t.Fatal("Invalid frame magic accepted")
+	}
+}
+
+func TestZeroRanges(t *testing.T) {
+	const block = internal.ZeroRangeBlockSize
+	contents := "data" + strings.Repeat("\x00", 100*block) + "more data" + strings.Repeat("\x00", 3*block)
+	files := []testFile{
+		{name: "sparse", contents: contents},
+		{name: "dense", contents: strings.Repeat("x", 2*block)},
+	}
+	blob, annotations := makeZstdChunkedBlob(t, files, nil)
+	if r := readTestTOC(t, blob, annotations).Entries[0].ZeroRanges; len(r) != 0 {
+		t.Fatalf("Zero ranges recorded without the ZeroRanges option: %v", r)
+	}
+	blob, annotations = makeZstdChunkedBlob(t, files, &compressor.Options{ZeroRanges: true})
+	toc := readTestTOC(t, blob, annotations)
+
+	// Blocks which are only partially zero, like the one with "more data"
+	// and the incomplete one at the end, are not recorded.
+	expected := []internal.ZeroRange{
+		{Offset: block, Length: 99 * block},
+		{Offset: 101 * block, Length: 2 * block},
+	}
+	sparse := toc.Entries[0]
+	if !reflect.DeepEqual(sparse.ZeroRanges, expected) {
+		t.Fatalf("Wrong zero ranges: expected %v, got %v", expected, sparse.ZeroRanges)
+	}
+	if len(toc.Entries[1].ZeroRanges) != 0 {
+		t.Fatalf("Zero ranges recorded for a file without zeros: %v", toc.Entries[1].ZeroRanges)
+	}
+
+	dest, err := ioutil.TempDir("", "zero-ranges")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+	dirfd, err := unix.Open(dest, unix.O_RDONLY|unix.O_PATH, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(dirfd)
+
+	c := &chunkedDiffer{
+		fileType:           fileTypeZstdChunked,
+		restoreSparseFiles: true,
+	}
+	stream := bytes.NewReader(blob[sparse.Offset:sparse.EndOffset])
+	if err := c.createFileFromCompressedStream(dest, dirfd, stream, 0644, &sparse, &archive.TarOptions{IgnoreChownErrors: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dest, "sparse")
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != contents {
+		t.Fatal("Wrong contents for the extracted file")
+	}
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Blocks*512 >= int64(len(contents)) {
+		t.Skipf("The file system at %q doesn't seem to support sparse files", dest)
+	}
+	if st.Blocks*512 > 8*block {
+		t.Fatalf("The extracted file uses %d bytes, it is not sparse", st.Blocks*512)
+	}
+
+	// Data where the manifest records zeros must be detected.
+	sparse.Name = "bad"
+	sparse.ZeroRanges = []internal.ZeroRange{{Offset: 0, Length: block}}
+	stream = bytes.NewReader(blob[sparse.Offset:sparse.EndOffset])
+	if err := c.createFileFromCompressedStream(dest, dirfd, stream, 0644, &sparse, &archive.TarOptions{IgnoreChownErrors: true}); err == nil {
+		t.Fatal("Non-zero data in a zero range not detected")
+	}
+}
+
+// isHole tells if the range of the file at path is not allocated.
+func isHole(t *testing.T, path string, r internal.ZeroRange) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := unix.Seek(int(f.Fd()), r.Offset, unix.SEEK_DATA)
+	if err == unix.ENXIO {
+		return true
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data >= r.Offset+r.Length
+}
+
+// isAllocated tells if the range of the file at path is all allocated.
+func isAllocated(t *testing.T, path string, r internal.ZeroRange) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	hole, err := unix.Seek(int(f.Fd()), r.Offset, unix.SEEK_HOLE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hole >= r.Offset+r.Length
+}
+
+func TestUnallocatedRanges(t *testing.T) {
+	const block = internal.ZeroRangeBlockSize
+	source, err := ioutil.TempDir("", "unallocated-source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(source)
+
+	// Blocks 1 and 2 are written with zeros, blocks 3 to 9 and 11 are
+	// holes.
+	path := filepath.Join(source, "sparse")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(append([]byte("data"), make([]byte, 3*block-4)...), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("more data"), 10*block); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(12 * block); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	zeroed := internal.ZeroRange{Offset: block, Length: 2 * block}
+	holes := []internal.ZeroRange{
+		{Offset: 3 * block, Length: 7 * block},
+		{Offset: 11 * block, Length: block},
+	}
+	if !isHole(t, path, holes[0]) || !isHole(t, path, holes[1]) {
+		t.Skipf("The file system at %q doesn't seem to support sparse files", source)
+	}
+	if !isAllocated(t, path, zeroed) {
+		t.Fatal("The zeroed blocks are not allocated")
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := []testFile{
+		{name: "sparse", contents: string(contents)},
+		// a file which isn't in the source directory
+		{name: "missing", contents: strings.Repeat("\x00", 4*block)},
+	}
+	blob, annotations := makeZstdChunkedBlob(t, files, &compressor.Options{ZeroRanges: true, SourceDir: source})
+	toc := readTestTOC(t, blob, annotations)
+
+	sparse := toc.Entries[0]
+	expectedZeros := []internal.ZeroRange{
+		{Offset: block, Length: 9 * block},
+		{Offset: 11 * block, Length: block},
+	}
+	if !reflect.DeepEqual(sparse.ZeroRanges, expectedZeros) {
+		t.Fatalf("Wrong zero ranges: expected %v, got %v", expectedZeros, sparse.ZeroRanges)
+	}
+	if !reflect.DeepEqual(sparse.UnallocatedRanges, holes) {
+		t.Fatalf("Wrong unallocated ranges: expected %v, got %v", holes, sparse.UnallocatedRanges)
+	}
+	if len(toc.Entries[1].UnallocatedRanges) != 0 {
+		t.Fatalf("Unallocated ranges recorded for a file which is not in the source directory: %v", toc.Entries[1].UnallocatedRanges)
+	}
+	// without a source directory, nothing is known about the allocation
+	blob, annotations = makeZstdChunkedBlob(t, files, &compressor.Options{ZeroRanges: true})
+	if r := readTestTOC(t, blob, annotations).Entries[0].UnallocatedRanges; len(r) != 0 {
+		t.Fatalf("Unallocated ranges recorded without a source directory: %v", r)
+	}
+	blob, _ = makeZstdChunkedBlob(t, files, &compressor.Options{ZeroRanges: true, SourceDir: source})
+
+	check := func(path string) {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, contents) {
+			t.Fatalf("Wrong contents for %q", path)
+		}
+		for _, h := range holes {
+			if !isHole(t, path, h) {
+				t.Fatalf("The unallocated range %v of %q is allocated", h, path)
+			}
+		}
+		if !isAllocated(t, path, zeroed) {
+			t.Fatalf("The zeroed range %v of %q is not allocated", zeroed, path)
+		}
+	}
+
+	dest, err := ioutil.TempDir("", "unallocated-dest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+	if err := ExtractFiles(bytes.NewReader(blob), int64(len(blob)), TreeSink(dest)); err != nil {
+		t.Fatal(err)
+	}
+	check(filepath.Join(dest, "sparse"))
+
+	// The differ leaves them as holes even when it doesn't restore the
+	// other zero ranges as holes.
+	layer := filepath.Join(dest, "layer")
+	if err := os.Mkdir(layer, 0755); err != nil {
+		t.Fatal(err)
+	}
+	dirfd, err := unix.Open(layer, unix.O_RDONLY|unix.O_PATH, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(dirfd)
+	c := &chunkedDiffer{fileType: fileTypeZstdChunked}
+	stream := bytes.NewReader(blob[sparse.Offset:sparse.EndOffset])
+	if err := c.createFileFromCompressedStream(layer, dirfd, stream, 0644, &sparse, &archive.TarOptions{IgnoreChownErrors: true}); err != nil {
+		t.Fatal(err)
+	}
+	check(filepath.Join(layer, "sparse"))
+}
+
+func TestSortChunksByDigest(t *testing.T) {
+	files := []testFile{
+		{name: "a", contents: "repeated contents"},
+		{name: "b", contents: strings.Repeat("other", 100)},
+		{name: "empty", contents: ""},
+		{name: "c", contents: "repeated contents"},
+		{name: "d", contents: "repeated contents"},
+		{name: "e", contents: "z"},
+	}
+	tarball := makeTestTar(t, files)
+	blob, annotations := makeZstdChunkedBlob(t, files, &compressor.Options{SortChunksByDigest: true})
+	toc := readTestTOC(t, blob, annotations)
+	if toc.Layout != internal.LayoutDigestSorted {
+		t.Fatalf("Wrong layout %q", toc.Layout)
+	}
+
+	// each distinct payload is stored once, sorted by digest
+	var digests []string
+	offsets := make(map[string]int64)
+	for _, e := range toc.Entries {
+		if e.Digest == "" {
+			if e.Offset != 0 || e.EndOffset != 0 {
+				t.Fatalf("Payload stored for the empty file %q", e.Name)
+			}
+			continue
+		}
+		if offset, found := offsets[e.Digest]; found {
+			if offset != e.Offset {
+				t.Fatalf("Payload of %q stored twice", e.Name)
+			}
+			continue
+		}
+		if e.Offset < toc.TarHeadersEndOffset {
+			t.Fatalf("Payload of %q overlaps with the tar headers", e.Name)
+		}
+		offsets[e.Digest] = e.Offset
+		digests = append(digests, e.Digest)
+	}
+	if len(digests) != 3 {
+		t.Fatalf("Expected 3 distinct payloads, got %d", len(digests))
+	}
+	for i := 1; i < len(digests); i++ {
+		if (digests[i-1] < digests[i]) != (offsets[digests[i-1]] < offsets[digests[i]]) {
+			t.Fatal("Payloads are not sorted by digest")
+		}
+	}
+
+	var out bytes.Buffer
+	if err := ReconstructTar(bytes.NewReader(blob), int64(len(blob)), digest.FromBytes(tarball), &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), tarball) {
+		t.Fatal("Reconstructed tarball differs from the original")
+	}
+
+	// a file with the same contents as a retrieved one is copied from it
+	dest, err := ioutil.TempDir("", "sorted-chunks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+	dirfd, err := unix.Open(dest, unix.O_RDONLY|unix.O_PATH, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(dirfd)
+	options := &archive.TarOptions{IgnoreChownErrors: true}
+	c := &chunkedDiffer{fileType: fileTypeZstdChunked}
+	source, file := &toc.Entries[0], &toc.Entries[3]
+	stream := bytes.NewReader(blob[source.Offset:source.EndOffset])
+	if err := c.createFileFromCompressedStream(dest, dirfd, stream, 0644, source, options); err != nil {
+		t.Fatal(err)
+	}
+	if err := createSameContentFile(dirfd, sameContentFile{source: source, file: file}, options, false); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dest, file.Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "repeated contents" {
+		t.Fatalf("Wrong contents %q for the copied file", data)
+	}
+}
+
+func TestMergeMissingChunksUnsorted(t *testing.T) {
+	chunk := func(offset, length uint64) missingChunk {
+		file := &internal.FileMetadata{Offset: int64(offset), EndOffset: int64(offset + length)}
+		return missingChunk{
+			RawChunk: ImageSourceChunk{Offset: offset, Length: length},
+			Files:    []missingFile{{File: file}},
+		}
+	}
+	missingChunks := []missingChunk{chunk(300, 10), chunk(100, 10), chunk(200, 10), chunk(115, 5)}
+	merged := mergeMissingChunks(missingChunks, 3)
+	if len(merged) != 3 {
+		t.Fatalf("Expected 3 chunks, got %d", len(merged))
+	}
+	expected := []ImageSourceChunk{{Offset: 100, Length: 20}, {Offset: 200, Length: 10}, {Offset: 300, Length: 10}}
+	for i, mc := range merged {
+		if mc.RawChunk != expected[i] {
+			t.Fatalf("Wrong chunk %d: expected %v, got %v", i, expected[i], mc.RawChunk)
+		}
+	}
+}
+
+func TestRecordSummary(t *testing.T) {
+	files := []testFile{
+		{name: "file1", contents: "hello"},
+		{name: "empty", contents: ""},
+		{name: "file2", contents: strings.Repeat("world", 1000)},
+	}
+	for _, sorted := range []bool{false, true} {
+		blob, annotations := makeZstdChunkedBlob(t, files, &compressor.Options{RecordSummary: true, SortChunksByDigest: sorted})
+		summary, err := ReadSummary(annotations)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if summary == nil {
+			t.Fatal("No summary recorded")
+		}
+
+		// the tallies match what is in the manifest
+		var entries, size int64
+		for _, e := range readTestTOC(t, blob, annotations).Entries {
+			entries++
+			size += e.Size
+		}
+		if summary.Entries != 3 || summary.Entries != entries {
+			t.Errorf("Wrong number of entries %d, the manifest has %d", summary.Entries, entries)
+		}
+		if summary.Size != 5005 || summary.Size != size {
+			t.Errorf("Wrong size %d, the manifest has %d", summary.Size, size)
+		}
+	}
+
+	_, annotations := makeZstdChunkedBlob(t, files, nil)
+	if summary, err := ReadSummary(annotations); summary != nil || err != nil {
+		t.Fatalf("Unexpected summary %v, %v", summary, err)
+	}
+	for _, invalid := range []string{"", "1", "a:b", "-1:5"} {
+		if _, err := ReadSummary(map[string]string{internal.ManifestSummaryKey: invalid}); err == nil {
+			t.Errorf("Invalid summary %q accepted", invalid)
+		}
+	}
+}
+
+func TestBuildFlatIndexRoundTrip(t *testing.T) {
+	files := []testFile{
+		{name: "a", contents: "some contents"},
+		{name: "b", contents: strings.Repeat("more contents", 1000)},
+		{name: "empty", contents: ""},
+	}
+	blob, annotations := makeZstdChunkedBlob(t, files, nil)
+	toc := readTestTOC(t, blob, annotations)
+	index := BuildFlatIndex(toc.Entries)
+	if len(index) != len(files) {
+		t.Fatalf("Wrong number of files in the index: %d", len(index))
+	}
+
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoder.Close()
+	for _, f := range files {
+		location, found := index[f.name]
+		if !found {
+			t.Fatalf("%q is not in the index", f.name)
+		}
+		if location.Size != int64(len(f.contents)) {
+			t.Fatalf("Wrong size %d for %q", location.Size, f.name)
+		}
+		var contents []byte
+		for _, chunk := range location.Chunks {
+			frame := blob[chunk.BlobOffset : chunk.BlobOffset+chunk.FrameLength]
+			data, err := decoder.DecodeAll(frame, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if int64(len(data)) != chunk.UncompressedSize || chunk.FileOffset != int64(len(contents)) {
+				t.Fatalf("Wrong chunk %+v for %q", chunk, f.name)
+			}
+			contents = append(contents, data...)
+		}
+		if string(contents) != f.contents {
+			t.Fatalf("Wrong contents for %q", f.name)
+		}
+	}
+}
+
+// randomContents returns size bytes of pseudo-random data.
+func randomContents(seed int64, size int) string {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return string(data)
+}
+
+func TestChunking(t *testing.T) {
+	params := &compressor.ChunkParams{RollsumBits: 12, MinSize: 1024, MaxSize: 16384}
+	data := randomContents(1, 1<<20)
+	files := []testFile{
+		{name: "big", contents: data},
+		{name: "shifted", contents: "a prefix" + data},
+		{name: "small", contents: "hello"},
+	}
+	tarball := makeTestTar(t, files)
+	blob, annotations := makeZstdChunkedBlob(t, files, &compressor.Options{Chunking: params})
+	toc := readTestTOC(t, blob, annotations)
+
+	var out bytes.Buffer
+	if err := ReconstructTar(bytes.NewReader(blob), int64(len(blob)), digest.FromBytes(tarball), &out); err != nil {
+		t.Fatal(err)
+	}
+
+	chunkDigests := make(map[string]map[string]bool)
+	index := BuildFlatIndex(toc.Entries)
+	for _, f := range files {
+		location := index[f.name]
+		digests := make(map[string]bool)
+		chunkDigests[f.name] = digests
+		for i, chunk := range location.Chunks {
+			last := i == len(location.Chunks)-1
+			if chunk.UncompressedSize > params.MaxSize || (!last && chunk.UncompressedSize < params.MinSize) {
+				t.Fatalf("Chunk %+v of %q has the wrong size", chunk, f.name)
+			}
+			if i > 0 && chunk.BlobOffset != location.Chunks[i-1].BlobOffset+location.Chunks[i-1].FrameLength {
+				t.Fatalf("Chunk %+v of %q doesn't follow the previous one", chunk, f.name)
+			}
+		}
+		if f.name == "small" && len(location.Chunks) != 1 {
+			t.Fatalf("%q was split in %d chunks", f.name, len(location.Chunks))
+		}
+	}
+	for _, e := range toc.Entries {
+		if e.ChunkDigest != "" {
+			chunkDigests[e.Name][e.ChunkDigest] = true
+		}
+	}
+	if n := len(chunkDigests["big"]); n < 32 {
+		t.Fatalf("%d chunks for 1MiB", n)
+	}
+	// the boundaries depend on the contents, so most chunks are found in
+	// both versions
+	shared := 0
+	for d := range chunkDigests["big"] {
+		if chunkDigests["shifted"][d] {
+			shared++
+		}
+	}
+	if shared < len(chunkDigests["big"])-2 {
+		t.Fatalf("Only %d chunks out of %d are shared", shared, len(chunkDigests["big"]))
+	}
+
+	var blobBuffer bytes.Buffer
+	if _, err := compressor.ZstdCompressorWithOptions(&blobBuffer, nil, &compressor.Options{Chunking: params, SortChunksByDigest: true}); err == nil {
+		t.Fatal("Chunking accepted with SortChunksByDigest")
+	}
+	if _, err := compressor.ZstdCompressorWithOptions(&blobBuffer, nil, &compressor.Options{Chunking: &compressor.ChunkParams{RollsumBits: 12, MinSize: 100, MaxSize: 10}}); err == nil {
+		t.Fatal("Maximum chunk size smaller than the minimum accepted")
+	}
+}
+
+func TestAutoTune(t *testing.T) {
+	// Nothing is repeated, so the largest chunks are the cheapest.
+	var files []testFile
+	for i := 0; i < 4; i++ {
+		files = append(files, testFile{name: fmt.Sprintf("unique%d", i), contents: randomContents(int64(i), 256<<10)})
+	}
+	params, err := AutoTune(bytes.NewReader(makeTestTar(t, files)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params != autoTuneCandidates[0] {
+		t.Fatalf("Wrong parameters %+v for unique data", params)
+	}
+
+	// The same block is found in every file at a different offset, so
+	// smaller chunks are better.
+	shared := randomContents(100, 512<<10)
+	files = nil
+	for i := 0; i < 8; i++ {
+		prefix := randomContents(int64(200+i), 1000*(i+1))
+		suffix := randomContents(int64(300+i), 3000)
+		files = append(files, testFile{name: fmt.Sprintf("shared%d", i), contents: prefix + shared + suffix})
+	}
+	sample := makeTestTar(t, files)
+	params, err = AutoTune(bytes.NewReader(sample))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.RollsumBits > 16 {
+		t.Fatalf("Wrong parameters %+v for repeated data", params)
+	}
+	stats, err := MeasureChunkParams(bytes.NewReader(sample), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.DistinctChunks >= stats.Chunks || stats.DistinctCompressedSize*4 > stats.CompressedSize {
+		t.Fatalf("Repeated chunks not found: %+v", stats)
+	}
+	if stats.MinChunkSize > stats.MeanChunkSize || stats.MeanChunkSize > stats.MaxChunkSize || stats.MaxChunkSize > params.MaxSize {
+		t.Fatalf("Inconsistent chunk sizes: %+v", stats)
+	}
+}
+
+func TestChunkSplitReasons(t *testing.T) {
+	files := []testFile{
+		// the rolling checksum never matches on zeros
+		{name: "zeros", contents: string(make([]byte, 10000))},
+		{name: "random", contents: randomContents(2, 64<<10)},
+		{name: "small", contents: "hi"},
+		{name: "empty", contents: ""},
+	}
+	var splits []compressor.ChunkSplit
+	options := &compressor.Options{
+		Chunking: &compressor.ChunkParams{RollsumBits: 10, MinSize: 1024, MaxSize: 4096},
+		OnSplit: func(split compressor.ChunkSplit) {
+			splits = append(splits, split)
+		},
+	}
+	makeZstdChunkedBlob(t, files, options)
+
+	bySize := make(map[string]int64)
+	reasons := make(map[string][]compressor.SplitReason)
+	for _, split := range splits {
+		if split.Offset != bySize[split.Name] {
+			t.Fatalf("Chunk %+v doesn't follow the previous one", split)
+		}
+		bySize[split.Name] += split.Size
+		reasons[split.Name] = append(reasons[split.Name], split.Reason)
+	}
+	for _, f := range files {
+		if bySize[f.name] != int64(len(f.contents)) {
+			t.Fatalf("The chunks of %q add up to %d bytes", f.name, bySize[f.name])
+		}
+	}
+	expected := []compressor.SplitReason{compressor.SplitMaxSize, compressor.SplitMaxSize, compressor.SplitEndOfFile}
+	if !reflect.DeepEqual(reasons["zeros"], expected) {
+		t.Fatalf("Wrong split reasons %v for zeros", reasons["zeros"])
+	}
+	if !reflect.DeepEqual(reasons["small"], []compressor.SplitReason{compressor.SplitEndOfFile}) {
+		t.Fatalf("Wrong split reasons %v for a small file", reasons["small"])
+	}
+	rollsum := 0
+	for _, reason := range reasons["random"] {
+		if reason == compressor.SplitRollsum {
+			rollsum++
+		}
+	}
+	if rollsum < 8 {
+		t.Fatalf("Only %d chunks of random data ended because of the rolling checksum: %v", rollsum, reasons["random"])
+	}
+	if _, found := reasons["empty"]; found {
+		t.Fatal("Split reported for an empty file")
+	}
+}
+
+func TestExplicitBoundaries(t *testing.T) {
+	aligned := randomContents(1, 50000)
+	files := []testFile{
+		{name: "aligned", contents: aligned},
+		{name: "zeros", contents: string(make([]byte, 20000))},
+		{name: "other", contents: randomContents(2, 50000)},
+	}
+	boundaries := map[string][]int64{
+		"aligned": {1000, 1001, 30000, 60000},
+		"zeros":   {5000, 10000},
+	}
+	var splits []compressor.ChunkSplit
+	options := &compressor.Options{
+		Chunking:           &compressor.ChunkParams{RollsumBits: 10, MinSize: 1024, MaxSize: 4096},
+		ExplicitBoundaries: boundaries,
+		OnSplit: func(split compressor.ChunkSplit) {
+			splits = append(splits, split)
+		},
+	}
+	blob, annotations := makeZstdChunkedBlob(t, files, options)
+
+	var alignedSplits []compressor.ChunkSplit
+	otherSplits := 0
+	for _, split := range splits {
+		switch split.Name {
+		case "aligned":
+			alignedSplits = append(alignedSplits, split)
+		case "other":
+			if split.Reason == compressor.SplitExplicit {
+				t.Fatalf("Explicit split %+v of a file without boundaries", split)
+			}
+			otherSplits++
+		}
+	}
+	expectedSplits := []compressor.ChunkSplit{
+		{Name: "aligned", Offset: 0, Size: 1000, Reason: compressor.SplitExplicit},
+		{Name: "aligned", Offset: 1000, Size: 1, Reason: compressor.SplitExplicit},
+		{Name: "aligned", Offset: 1001, Size: 28999, Reason: compressor.SplitExplicit},
+		{Name: "aligned", Offset: 30000, Size: 20000, Reason: compressor.SplitEndOfFile},
+	}
+	if !reflect.DeepEqual(alignedSplits, expectedSplits) {
+		t.Fatalf("Unexpected splits %+v", alignedSplits)
+	}
+	if otherSplits < 10 {
+		t.Fatalf("Only %d chunks for a file without boundaries", otherSplits)
+	}
+
+	// the manifest lists the same chunks, with their digests, and the
+	// chunks of zeros are not merged
+	toc := readTestTOC(t, blob, annotations)
+	chunks := make(map[string][]int64)
+	for _, entry := range toc.Entries {
+		if entry.Type != internal.TypeReg && entry.Type != internal.TypeChunk {
+			continue
+		}
+		chunks[entry.Name] = append(chunks[entry.Name], entry.ChunkOffset)
+		if entry.Name == "aligned" {
+			end := int64(len(aligned))
+			if entry.ChunkSize != 0 {
+				end = entry.ChunkOffset + entry.ChunkSize
+			}
+			if entry.ChunkDigest != digest.FromString(aligned[entry.ChunkOffset:end]).String() {
+				t.Fatalf("Wrong digest for the chunk at offset %d", entry.ChunkOffset)
+			}
+		}
+	}
+	if !reflect.DeepEqual(chunks["aligned"], []int64{0, 1000, 1001, 30000}) {
+		t.Fatalf("Unexpected chunks %v", chunks["aligned"])
+	}
+	if !reflect.DeepEqual(chunks["zeros"], []int64{0, 5000, 10000}) {
+		t.Fatalf("Unexpected chunks of zeros %v", chunks["zeros"])
+	}
+	if err := ExtractFiles(bytes.NewReader(blob), int64(len(blob)), func(FileMetadata) (io.WriteCloser, error) {
+		return ioutils.NopWriteCloser(ioutil.Discard), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, options := range []*compressor.Options{
+		{ExplicitBoundaries: boundaries},
+		{Chunking: options.Chunking, ExplicitBoundaries: map[string][]int64{"aligned": {1000, 1000}}},
+		{Chunking: options.Chunking, ExplicitBoundaries: map[string][]int64{"aligned": {0, 1000}}},
+	} {
+		if _, err := compressor.ZstdCompressorWithOptions(ioutil.Discard, map[string]string{}, options); err == nil {
+			t.Fatalf("Invalid boundaries %v accepted", options.ExplicitBoundaries)
+		}
+	}
+}
+
+func TestVerifyInputChecksums(t *testing.T) {
+	makeTar := func(recorded string) []byte {
+		var tarBuffer bytes.Buffer
+		tw := tar.NewWriter(&tarBuffer)
+		for _, f := range []struct{ name, contents, sha256 string }{
+			{"good", "some data", fmt.Sprintf("%x", sha256.Sum256([]byte("some data")))},
+			{"checked", "other data", recorded},
+		} {
+			if err := tw.WriteHeader(&tar.Header{
+				Typeflag:   tar.TypeReg,
+				Name:       f.name,
+				Mode:       0644,
+				Size:       int64(len(f.contents)),
+				PAXRecords: map[string]string{"SCHILY.sha256": f.sha256},
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tw.Write([]byte(f.contents)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return tarBuffer.Bytes()
+	}
+	compress := func(tarball []byte, options *compressor.Options) error {
+		w, err := compressor.ZstdCompressorWithOptions(ioutil.Discard, make(map[string]string), options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = w.Write(tarball)
+		if errClose := w.Close(); err == nil {
+			err = errClose
+		}
+		return err
+	}
+
+	good := makeTar("sha256:" + fmt.Sprintf("%x", sha256.Sum256([]byte("other data"))))
+	bad := makeTar(fmt.Sprintf("%x", sha256.Sum256([]byte("corrupted"))))
+	for _, sorted := range []bool{false, true} {
+		if err := compress(good, &compressor.Options{VerifyInputChecksums: true, SortChunksByDigest: sorted}); err != nil {
+			t.Fatalf("Matching checksums rejected: %v", err)
+		}
+		if err := compress(bad, &compressor.Options{SortChunksByDigest: sorted}); err != nil {
+			t.Fatalf("Checksums verified without VerifyInputChecksums: %v", err)
+		}
+		err := compress(bad, &compressor.Options{VerifyInputChecksums: true, SortChunksByDigest: sorted})
+		if !errors.Is(err, compressor.ErrInputChecksumMismatch) {
+			t.Fatalf("Unexpected error %v for a wrong checksum", err)
+		}
+		if !strings.Contains(err.Error(), "checked") {
+			t.Fatalf("Error %q doesn't name the file", err)
+		}
+	}
+}
+
+func TestScanTarMetadata(t *testing.T) {
+	files := []testFile{
+		{name: "small", contents: "hello", modTime: time.Unix(1600000000, 0)},
+		{name: "random", contents: randomContents(3, 64<<10)},
+		{name: "zeros", contents: string(make([]byte, 3*internal.ZeroRangeBlockSize))},
+		{name: "empty", contents: ""},
+	}
+	for _, options := range []*compressor.Options{
+		nil,
+		{ChunkHasher: "sha512", ZeroRanges: true},
+		{Chunking: &compressor.ChunkParams{RollsumBits: 12, MinSize: 1024, MaxSize: 16 << 10}},
+	} {
+		blob, annotations := makeZstdChunkedBlob(t, files, options)
+		toc := readTestTOC(t, blob, annotations)
+
+		scanned, err := ScanTarMetadata(bytes.NewReader(makeTestTar(t, files)), options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := toc.Entries
+		for i := range expected {
+			if expected[i].Type == internal.TypeReg && expected[i].Size > 0 && expected[i].EndOffset <= expected[i].Offset {
+				t.Fatalf("No position in the blob for %q", expected[i].Name)
+			}
+			expected[i].Offset = 0
+			expected[i].EndOffset = 0
+		}
+		if options != nil && options.Chunking != nil && len(expected) <= len(files) {
+			t.Fatal("The files were not split into chunks")
+		}
+		// compare them as they are encoded in the manifest
+		scannedJSON, err := json.Marshal(scanned)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedJSON, err := json.Marshal(expected)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(scannedJSON, expectedJSON) {
+			t.Fatalf("Scanned metadata %s doesn't match the manifest %s", scannedJSON, expectedJSON)
+		}
+	}
+
+	_, err := ScanTarMetadata(bytes.NewReader(makeTestTar(t, files)), &compressor.Options{ChunkHasher: "unknown"})
+	if err == nil {
+		t.Fatal("Unknown hasher accepted")
+	}
+}
+
+func TestDigestEncoding(t *testing.T) {
+	var files []testFile
+	for i := 0; i < 1000; i++ {
+		files = append(files, testFile{name: fmt.Sprintf("dir/file-%d", i), contents: fmt.Sprintf("contents of file %d", i)})
+	}
+	files = append(files, testFile{name: "split", contents: randomContents(4, 64<<10)})
+	chunking := &compressor.ChunkParams{RollsumBits: 12, MinSize: 1024, MaxSize: 16 << 10}
+
+	manifestSize := func(blob []byte, annotations map[string]string) int {
+		manifest, _, err := readZstdChunkedManifest(bytesSeekable(blob), int64(len(blob)), annotations)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(manifest)
+	}
+
+	blob, annotations := makeZstdChunkedBlob(t, files, &compressor.Options{Chunking: chunking})
+	expected := readTestTOC(t, blob, annotations).Entries
+	fullSize := manifestSize(blob, annotations)
+	previousSize := fullSize
+	for _, encoding := range []string{"hex", "base64"} {
+		blob, annotations := makeZstdChunkedBlob(t, files, &compressor.Options{Chunking: chunking, DigestEncoding: encoding})
+		toc := readTestTOC(t, blob, annotations)
+		if toc.DigestEncoding != encoding {
+			t.Fatalf("Digest encoding %q recorded instead of %q", toc.DigestEncoding, encoding)
+		}
+		if !reflect.DeepEqual(toc.Entries, expected) {
+			t.Fatalf("The entries of the manifest with %s digests don't match the ones with complete digests", encoding)
+		}
+		size := manifestSize(blob, annotations)
+		t.Logf("Manifest with %s digests: %d bytes, %.1f%% smaller", encoding, size, 100-100*float64(size)/float64(fullSize))
+		if size >= previousSize {
+			t.Fatalf("Manifest with %s digests is %d bytes, not smaller than %d", encoding, size, previousSize)
+		}
+		previousSize = size
+	}
+	if previousSize > fullSize*9/10 {
+		t.Fatalf("Manifest with base64 digests is only %d bytes smaller than %d", fullSize-previousSize, fullSize)
+	}
+
+	// invalid digests are rejected when decoding
+	var toc internal.TOC
+	err := json.Unmarshal([]byte(`{"version":1,"digestEncoding":"base64","entries":[{"type":"reg","name":"f","digest":"!!"}]}`), &toc)
+	if err == nil {
+		t.Fatal("Invalid digest accepted")
+	}
+
+	w, err := compressor.ZstdCompressorWithOptions(ioutil.Discard, make(map[string]string), &compressor.Options{DigestEncoding: "base32"})
+	if err == nil {
+		w.Close()
+		t.Fatal("Unknown digest encoding accepted")
+	}
+}
+
+func TestOffsetEncoding(t *testing.T) {
+	var files []testFile
+	for i := 0; i < 500; i++ {
+		files = append(files, testFile{name: fmt.Sprintf("dir/file-%d", i), contents: fmt.Sprintf("contents of file %d", i)})
+	}
+	files = append(files, testFile{name: "split", contents: randomContents(5, 256<<10)})
+	chunking := &compressor.ChunkParams{RollsumBits: 12, MinSize: 1024, MaxSize: 16 << 10}
+
+	manifestSize := func(blob []byte, annotations map[string]string) int {
+		manifest, _, err := readZstdChunkedManifest(bytesSeekable(blob), int64(len(blob)), annotations)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(manifest)
+	}
+
+	for _, options := range []compressor.Options{
+		{Chunking: chunking},
+		{Chunking: chunking, DigestEncoding: "base64"},
+		{SortChunksByDigest: true},
+	} {
+		blob, annotations := makeZstdChunkedBlob(t, files, &options)
+		expected := readTestTOC(t, blob, annotations).Entries
+		fullSize := manifestSize(blob, annotations)
+
+		options.OffsetEncoding = "delta"
+		blob, annotations = makeZstdChunkedBlob(t, files, &options)
+		toc := readTestTOC(t, blob, annotations)
+		if toc.OffsetEncoding != "delta" {
+			t.Fatalf("Offset encoding %q recorded instead of delta", toc.OffsetEncoding)
+		}
+		if !reflect.DeepEqual(toc.Entries, expected) {
+			t.Fatalf("The entries of the manifest with delta offsets don't match the ones with absolute offsets (sorted: %v)", options.SortChunksByDigest)
+		}
+		size := manifestSize(blob, annotations)
+		t.Logf("Manifest with delta offsets (sorted: %v): %d bytes, %.1f%% smaller", options.SortChunksByDigest, size, 100-100*float64(size)/float64(fullSize))
+		if size >= fullSize {
+			t.Fatalf("Manifest with delta offsets is %d bytes, not smaller than %d", size, fullSize)
+		}
+		var buf bytes.Buffer
+		if err := ReconstructTar(bytes.NewReader(blob), int64(len(blob)), digest.FromBytes(makeTestTar(t, files)), &buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// entries whose payload is empty, or without a payload, round trip
+	toc := internal.TOC{
+		OffsetEncoding: internal.OffsetEncodingDelta,
+		Entries: []internal.FileMetadata{
+			{Type: TypeDir, Name: "dir"},
+			{Type: TypeReg, Name: "a", Offset: 100, EndOffset: 200, ChunkSize: 50},
+			{Type: TypeChunk, Name: "a", Offset: 200, EndOffset: 250, ChunkOffset: 50},
+			{Type: TypeReg, Name: "empty", Offset: 300, EndOffset: 300},
+			{Type: TypeReg, Name: "b", Offset: 150, EndOffset: 180},
+		},
+	}
+	encoded, err := json.Marshal(toc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded internal.TOC
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded.Entries, toc.Entries) {
+		t.Fatalf("Entries %+v decoded as %+v", toc.Entries, decoded.Entries)
+	}
+
+	w, err := compressor.ZstdCompressorWithOptions(ioutil.Discard, make(map[string]string), &compressor.Options{OffsetEncoding: "varint"})
+	if err == nil {
+		w.Close()
+		t.Fatal("Unknown offset encoding accepted")
+	}
+}
+
+func TestSplitChunkedBlob(t *testing.T) {
+	var files []testFile
+	for i := 0; i < 8; i++ {
+		files = append(files, testFile{name: fmt.Sprintf("file%d", i), contents: randomContents(int64(i), 48*1024)})
+	}
+	// a file made of several chunks, which can't be split across parts
+	files = append(files, testFile{name: "chunked", contents: randomContents(100, 96*1024)}, testFile{name: "small", contents: "hello"})
+	params := &compressor.ChunkParams{RollsumBits: 12, MinSize: 1024, MaxSize: 16384}
+	blob, annotations := makeZstdChunkedBlob(t, files, &compressor.Options{Chunking: params})
+	toc := readTestTOC(t, blob, annotations)
+	_, manifestStart, err := readZstdChunkedTOC(bytes.NewReader(blob), int64(len(blob)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const maxBlobSize = 128 * 1024
+	parts, err := SplitChunkedBlob(bytes.NewReader(blob), int64(len(blob)), maxBlobSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) < 3 {
+		t.Fatalf("%d-byte blob split in %d parts", len(blob), len(parts))
+	}
+
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoder.Close()
+	var frames bytes.Buffer
+	var entries []FileMetadata
+	found := make(map[string]string)
+	for _, part := range parts {
+		data, err := ioutil.ReadAll(part.Reader(bytes.NewReader(blob)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(data)) != part.Size() || part.Size() > maxBlobSize {
+			t.Fatalf("Part of %d bytes, expected %d, at most %d", len(data), part.Size(), maxBlobSize)
+		}
+		partTOC, partManifestStart, err := readZstdChunkedTOC(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if partManifestStart != part.Length {
+			t.Fatalf("Manifest of the part at %d, expected %d", partManifestStart, part.Length)
+		}
+		if !reflect.DeepEqual(partTOC.Entries, part.Entries) {
+			t.Fatal("The manifest of the part doesn't match its entries")
+		}
+		if err := ValidateManifestBounds(part.Entries, part.Length); err != nil {
+			t.Fatal(err)
+		}
+		for name, location := range BuildFlatIndex(partTOC.Entries) {
+			var contents []byte
+			for _, chunk := range location.Chunks {
+				frame := data[chunk.BlobOffset : chunk.BlobOffset+chunk.FrameLength]
+				if contents, err = decoder.DecodeAll(frame, contents); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, ok := found[name]; ok {
+				t.Fatalf("%q found in more than one part", name)
+			}
+			found[name] = string(contents)
+		}
+		frames.Write(data[:part.Length])
+
+		for _, e := range part.Entries {
+			if e.EndOffset > 0 {
+				e.Offset += part.Offset
+				e.EndOffset += part.Offset
+			}
+			entries = append(entries, e)
+		}
+	}
+	for _, f := range files {
+		if found[f.name] != f.contents {
+			t.Fatalf("Wrong contents for %q", f.name)
+		}
+	}
+	if !bytes.Equal(frames.Bytes(), blob[:manifestStart]) {
+		t.Fatal("The parts don't add up to the original blob")
+	}
+	if !reflect.DeepEqual(entries, toc.Entries) {
+		t.Fatal("The entries of the parts don't add up to the original manifest")
+	}
+
+	if _, err := SplitChunkedBlob(bytes.NewReader(blob), int64(len(blob)), 64*1024); err == nil {
+		t.Fatal("Blob split in parts too small for one of its files")
+	}
+}
+
+func TestXattrLimits(t *testing.T) {
+	var tarBuffer bytes.Buffer
+	tw := tar.NewWriter(&tarBuffer)
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     "file",
+		Mode:     0644,
+		Format:   tar.FormatPAX,
+		PAXRecords: map[string]string{
+			"SCHILY.xattr.user.big":   strings.Repeat("x", 512*1024),
+			"SCHILY.xattr.user.small": "small",
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	compress := func(options *compressor.Options) ([]byte, map[string]string, error) {
+		var blob bytes.Buffer
+		annotations := make(map[string]string)
+		w, err := compressor.ZstdCompressorWithOptions(&blob, annotations, options)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, err := w.Write(tarBuffer.Bytes()); err != nil {
+			w.Close()
+			return nil, nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, nil, err
+		}
+		return blob.Bytes(), annotations, nil
+	}
+
+	if _, _, err := compress(&compressor.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, options := range []*compressor.Options{
+		{MaxXattrSize: 64 * 1024},
+		{MaxXattrsSize: 64 * 1024},
+	} {
+		if _, _, err := compress(options); !errors.Is(err, compressor.ErrXattrTooBig) {
+			t.Fatalf("Unexpected error %v with %+v", err, options)
+		}
+	}
+
+	blob, annotations, err := compress(&compressor.Options{MaxXattrSize: 64 * 1024, DropOversizedXattrs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	toc := readTestTOC(t, blob, annotations)
+	e := toc.Entries[0]
+	if !e.XattrsDropped || len(e.Xattrs) != 1 || e.Xattrs["user.small"] != base64.StdEncoding.EncodeToString([]byte("small")) {
+		t.Fatalf("Unexpected xattrs %v, dropped: %v", e.Xattrs, e.XattrsDropped)
+	}
+}
+
+func TestCoalesceZeroChunks(t *testing.T) {
+	params := &compressor.ChunkParams{RollsumBits: 12, MinSize: 1024, MaxSize: 16384}
+	const holeSize = 16 * 16384
+	contents := randomContents(1, 20000) + string(make([]byte, holeSize)) + randomContents(2, 20000)
+	files := []testFile{{name: "sparse", contents: contents}}
+	tarball := makeTestTar(t, files)
+	blob, annotations := makeZstdChunkedBlob(t, files, &compressor.Options{Chunking: params})
+	toc := readTestTOC(t, blob, annotations)
+
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoder.Close()
+	var data []byte
+	zeroChunks := 0
+	for _, e := range toc.Entries {
+		decoded, err := decoder.DecodeAll(blob[e.Offset:e.EndOffset], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.ChunkSize != 0 && int64(len(decoded)) != e.ChunkSize {
+			t.Fatalf("Chunk at %d has %d bytes, expected %d", e.ChunkOffset, len(decoded), e.ChunkSize)
+		}
+		if d := digest.FromBytes(decoded).String(); d != e.ChunkDigest {
+			t.Fatalf("Chunk at %d has digest %s, expected %s", e.ChunkOffset, d, e.ChunkDigest)
+		}
+		if internal.IsZero(decoded) {
+			zeroChunks++
+		}
+		data = append(data, decoded...)
+	}
+	if string(data) != contents {
+		t.Fatal("The chunks don't add up to the file")
+	}
+	// the hole is in at most three chunks: the end of the chunk with the
+	// data before it, a single one with only zeros, and the start of the
+	// chunk with the data after it
+	if zeroChunks != 1 || len(toc.Entries) > 2*20000/int(params.MinSize)+3 {
+		t.Fatalf("Hole of %d bytes in %d chunks", holeSize, zeroChunks)
+	}
+
+	var out bytes.Buffer
+	if err := ReconstructTar(bytes.NewReader(blob), int64(len(blob)), digest.FromBytes(tarball), &out); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// prefixStrippingTarReader reads tarballs whose entries' names all start
+// with a prefix which must be removed.
+type prefixStrippingTarReader struct {
+	*tarsplit.Reader
+	prefix  string
+	entries int
+}
+
+func (r *prefixStrippingTarReader) Next() (*tarsplit.Header, error) {
+	hdr, err := r.Reader.Next()
+	if err != nil {
+		return nil, err
+	}
+	r.entries++
+	hdr.Name = strings.TrimPrefix(hdr.Name, r.prefix)
+	return hdr, nil
+}
+
+func TestCustomTarReader(t *testing.T) {
+	files := []testFile{
+		{name: "rootfs/a", contents: "a"},
+		{name: "rootfs/b", contents: randomContents(1, 10000)},
+	}
+	tarball := makeTestTar(t, files)
+	var readers []*prefixStrippingTarReader
+	options := &compressor.Options{
+		NewTarReader: func(r io.Reader) compressor.TarReader {
+			tr := tarsplit.NewReader(r)
+			tr.RawAccounting = true
+			reader := &prefixStrippingTarReader{Reader: tr, prefix: "rootfs/"}
+			readers = append(readers, reader)
+			return reader
+		},
+	}
+	blob, annotations := makeZstdChunkedBlob(t, files, options)
+	if len(readers) != 1 || readers[0].entries != len(files) {
+		t.Fatalf("The custom reader wasn't used to read the %d entries", len(files))
+	}
+	toc := readTestTOC(t, blob, annotations)
+	index := BuildFlatIndex(toc.Entries)
+	for _, name := range []string{"a", "b"} {
+		if _, ok := index[name]; !ok {
+			t.Fatalf("%q not found in the manifest", name)
+		}
+	}
+
+	// the blob still holds the original tarball
+	decoder, err := zstd.NewReader(bytes.NewReader(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoder.Close()
+	decompressed, err := ioutil.ReadAll(decoder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decompressed, tarball) {
+		t.Fatal("The blob doesn't decompress to the original tarball")
+	}
+}
+
+func TestRebuildTrailer(t *testing.T) {
+	files := []testFile{
+		{name: "a", contents: randomContents(1, 100000)},
+		{name: "b", contents: "b"},
+	}
+	blob, _ := makeZstdChunkedBlob(t, files, nil)
+	footerFrameSize := 8 + internal.FooterSizeSupported
+
+	f, err := ioutil.TempFile("", "rebuild-trailer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	repair := func(data []byte) []byte {
+		if err := f.Truncate(0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteAt(data, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := RebuildTrailer(f); err != nil {
+			t.Fatalf("repairing %d bytes: %v", len(data), err)
+		}
+		repaired, err := ioutil.ReadFile(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return repaired
+	}
+
+	for _, cut := range []int{0, 1, 20, footerFrameSize - 8, footerFrameSize} {
+		repaired := repair(blob[:len(blob)-cut])
+		if !bytes.Equal(repaired, blob) {
+			t.Fatalf("blob truncated by %d bytes not repaired", cut)
+		}
+	}
+
+	// a damaged footer is replaced
+	damaged := append([]byte{}, blob...)
+	for i := len(damaged) - internal.FooterSizeSupported; i < len(damaged); i++ {
+		damaged[i] = 0xff
+	}
+	if repaired := repair(damaged); !bytes.Equal(repaired, blob) {
+		t.Fatal("damaged footer not repaired")
+	}
+
+	// but a damaged manifest can't be recovered
+	if err := f.Truncate(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(blob[:len(blob)-footerFrameSize-1], 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := RebuildTrailer(f); err == nil {
+		t.Fatal("blob with a truncated manifest repaired")
+	}
+}
+
+func TestTrailingGarbage(t *testing.T) {
+	files := []testFile{
+		{name: "a", contents: randomContents(1, 100000)},
+		{name: "b", contents: "b"},
+	}
+	for _, options := range []*compressor.Options{nil, {ManifestFirst: true}} {
+		blob, _ := makeZstdChunkedBlob(t, files, options)
+		footerFrame := blob[len(blob)-8-internal.FooterSizeSupported:]
+		for _, garbage := range [][]byte{
+			nil,
+			{0},
+			make([]byte, 7),
+			[]byte(randomContents(2, 100)),
+			make([]byte, 4096),
+			// a truncated copy of the footer is not taken for one
+			footerFrame[:len(footerFrame)-1],
+		} {
+			data := append(append([]byte{}, blob...), garbage...)
+			trailing, err := TrailingGarbage(bytes.NewReader(data), int64(len(data)), 4096)
+			if err != nil {
+				t.Fatalf("%d bytes of garbage: %v", len(garbage), err)
+			}
+			if trailing != int64(len(garbage)) {
+				t.Fatalf("%d bytes of garbage reported, expected %d", trailing, len(garbage))
+			}
+			size := int64(len(data)) - trailing
+			if _, _, err := readZstdChunkedTOC(bytes.NewReader(data), size); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(garbage) > 0 {
+				if _, _, err := readZstdChunkedTOC(bytes.NewReader(data), int64(len(data))); err == nil {
+					t.Fatalf("blob with %d bytes of garbage read without trimming them", len(garbage))
+				}
+				if _, err := TrailingGarbage(bytes.NewReader(data), int64(len(data)), int64(len(garbage)-1)); err == nil {
+					t.Fatalf("%d bytes of garbage found in a smaller window", len(garbage))
+				}
+			}
+		}
+	}
+
+	if _, err := TrailingGarbage(bytes.NewReader(make([]byte, 10000)), 10000, 1000); err == nil {
+		t.Fatal("footer found in a blob of zeros")
+	}
+	if _, err := TrailingGarbage(bytes.NewReader(make([]byte, 10)), 10, 1000); err == nil {
+		t.Fatal("footer found in a tiny blob")
+	}
+}
+
+func TestBackfillChunkDigests(t *testing.T) {
+	files := []testFile{
+		{name: "big", contents: randomContents(1, 1<<20)},
+		{name: "sparse", contents: randomContents(2, 20000) + strings.Repeat("\x00", 100000) + randomContents(3, 20000)},
+		{name: "small", contents: "hello"},
+	}
+	params := &compressor.ChunkParams{RollsumBits: 12, MinSize: 1024, MaxSize: 16384}
+	for _, hasher := range []string{"", "sha512"} {
+		blob, annotations := makeZstdChunkedBlob(t, files, &compressor.Options{Chunking: params, ChunkHasher: hasher})
+		toc := readTestTOC(t, blob, annotations)
+
+		stripped := append([]FileMetadata{}, toc.Entries...)
+		chunks := 0
+		for i := range stripped {
+			if stripped[i].Type == internal.TypeChunk {
+				chunks++
+			}
+			if stripped[i].ChunkDigest != "" {
+				stripped[i].ChunkDigest = ""
+				stripped[i].ChunkSize = 0
+				stripped[i].ChunkOffset = 0
+			}
+		}
+		if chunks == 0 {
+			t.Fatal("no chunks in the blob")
+		}
+
+		ra := bytes.NewReader(blob)
+		backfilled, err := BackfillChunkDigests(ra, int64(len(blob)), stripped)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(backfilled, toc.Entries) {
+			t.Fatalf("the backfilled manifest doesn't match the original one")
+		}
+		if stripped[0].ChunkDigest != "" {
+			t.Fatal("the input manifest was modified")
+		}
+
+		// complete manifests are left as they are
+		again, err := BackfillChunkDigests(ra, int64(len(blob)), toc.Entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(again, toc.Entries) {
+			t.Fatalf("a complete manifest was modified")
+		}
+
+		// wrong offsets are detected
+		for i := range stripped {
+			if stripped[i].Type == internal.TypeChunk {
+				damaged := append([]FileMetadata{}, stripped...)
+				damaged[i].Offset, damaged[i-1].Offset = damaged[i-1].Offset, damaged[i].Offset
+				damaged[i].EndOffset, damaged[i-1].EndOffset = damaged[i-1].EndOffset, damaged[i].EndOffset
+				if _, err := BackfillChunkDigests(ra, int64(len(blob)), damaged); err == nil {
+					t.Fatal("chunks with swapped offsets not detected")
+				}
+				break
+			}
+		}
+	}
+}
+
+func TestSpecialFiles(t *testing.T) {
+	specials := []tar.Header{
+		{Typeflag: tar.TypeFifo, Name: "fifo", Mode: 0640},
+		{Typeflag: tar.TypeChar, Name: "dev/null", Mode: 0666, Devmajor: 1, Devminor: 3},
+		{Typeflag: tar.TypeChar, Name: "dev/big", Mode: 0600, Devmajor: 511, Devminor: 1048575},
+		{Typeflag: tar.TypeBlock, Name: "dev/loop0", Mode: 0660, Devmajor: 7, Devminor: 0},
+	}
+	var tarBuffer bytes.Buffer
+	tw := tar.NewWriter(&tarBuffer)
+	for _, hdr := range []tar.Header{
+		{Typeflag: tar.TypeReg, Name: "before", Mode: 0644, Size: 6},
+		{Typeflag: tar.TypeDir, Name: "dev", Mode: 0755},
+	} {
+		hdr := hdr
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte("before")[:hdr.Size]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, hdr := range specials {
+		hdr := hdr
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "after", Mode: 0644, Size: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tarball := tarBuffer.Bytes()
+
+	for _, options := range []*compressor.Options{{}, {SortChunksByDigest: true}} {
+		var blob bytes.Buffer
+		annotations := make(map[string]string)
+		w, err := compressor.ZstdCompressorWithOptions(&blob, annotations, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(tarball); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		toc := readTestTOC(t, blob.Bytes(), annotations)
+
+		entries := make(map[string]internal.FileMetadata)
+		for _, e := range toc.Entries {
+			if e.Type == internal.TypeChunk {
+				if _, found := entries[e.Name]; !found || entries[e.Name].Type != internal.TypeReg {
+					t.Fatalf("Chunk entry for %q, which is not a regular file", e.Name)
+				}
+				continue
+			}
+			entries[e.Name] = e
+		}
+		for _, hdr := range specials {
+			e, found := entries[hdr.Name]
+			if !found {
+				t.Fatalf("%q is not in the manifest", hdr.Name)
+			}
+			typ, err := internal.GetType(hdr.Typeflag)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.Type != typ || e.Mode != hdr.Mode || e.Devmajor != hdr.Devmajor || e.Devminor != hdr.Devminor {
+				t.Fatalf("Wrong manifest entry for %q: %+v", hdr.Name, e)
+			}
+			if e.Size != 0 || e.Offset != 0 || e.EndOffset != 0 || e.Digest != "" || e.ChunkDigest != "" {
+				t.Fatalf("Payload recorded for %q: %+v", hdr.Name, e)
+			}
+		}
+
+		var out bytes.Buffer
+		if err := ReconstructTar(bytes.NewReader(blob.Bytes()), int64(blob.Len()), digest.FromBytes(tarball), &out); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), tarball) {
+			t.Fatal("Reconstructed tarball differs from the original")
+		}
+	}
+
+	// The entries are recreated as they are described in the manifest.
+	// Sockets can't be stored in tarballs, so there is nothing to
+	// recreate for them.
+	dest, err := ioutil.TempDir("", "chunked-special")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+	dirfd, err := unix.Open(dest, unix.O_RDONLY|unix.O_PATH, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(dirfd)
+	options := &archive.TarOptions{InUserNS: userns.RunningInUserNS() || unix.Geteuid() != 0}
+	for _, hdr := range specials {
+		typ, err := internal.GetType(hdr.Typeflag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		metadata := internal.FileMetadata{
+			Type:     typ,
+			Name:     hdr.Name,
+			Mode:     hdr.Mode,
+			UID:      os.Getuid(),
+			GID:      os.Getgid(),
+			Devmajor: hdr.Devmajor,
+			Devminor: hdr.Devminor,
+		}
+		if err := safeMknod(dirfd, os.FileMode(hdr.Mode), &metadata, options); err != nil {
+			t.Fatal(err)
+		}
+		var st unix.Stat_t
+		err = unix.Lstat(filepath.Join(dest, hdr.Name), &st)
+		if hdr.Typeflag != tar.TypeFifo && options.InUserNS {
+			if !os.IsNotExist(err) {
+				t.Fatalf("Device %q created in a user namespace", hdr.Name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		kind := map[byte]uint32{tar.TypeFifo: unix.S_IFIFO, tar.TypeChar: unix.S_IFCHR, tar.TypeBlock: unix.S_IFBLK}[hdr.Typeflag]
+		if st.Mode&unix.S_IFMT != kind || int64(st.Mode&07777) != hdr.Mode {
+			t.Fatalf("%q created with mode %o", hdr.Name, st.Mode)
+		}
+		if hdr.Typeflag != tar.TypeFifo && (int64(unix.Major(st.Rdev)) != hdr.Devmajor || int64(unix.Minor(st.Rdev)) != hdr.Devminor) {
+			t.Fatalf("%q created as device %d:%d", hdr.Name, unix.Major(st.Rdev), unix.Minor(st.Rdev))
+		}
+	}
+}
+
+func TestCompressedDigests(t *testing.T) {
+	params := &compressor.ChunkParams{RollsumBits: 12, MinSize: 1024, MaxSize: 16384}
+	files := []testFile{
+		{name: "chunked", contents: randomContents(1, 100000)},
+		{name: "sparse", contents: randomContents(2, 20000) + string(make([]byte, 16*16384)) + randomContents(3, 20000)},
+		{name: "small", contents: "hello"},
+		{name: "copy", contents: "hello"},
+		{name: "empty", contents: ""},
+	}
+	for _, options := range []*compressor.Options{
+		{CompressedDigests: true, Chunking: params},
+		{CompressedDigests: true, Chunking: params, ChunkHasher: "sha512", DigestEncoding: internal.DigestEncodingBase64},
+		{CompressedDigests: true, SortChunksByDigest: true},
+	} {
+		blob, annotations := makeZstdChunkedBlob(t, files, options)
+		toc := readTestTOC(t, blob, annotations)
+		for _, e := range toc.Entries {
+			if e.EndOffset == 0 {
+				if e.CompressedDigest != "" {
+					t.Fatalf("Compressed digest recorded for %q, which has no payload", e.Name)
+				}
+				continue
+			}
+			digester, err := internal.NewChunkDigesterForDigest(e.ChunkDigest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := digester.Hash().Write(blob[e.Offset:e.EndOffset]); err != nil {
+				t.Fatal(err)
+			}
+			if d := digester.Digest(); d != e.CompressedDigest {
+				t.Fatalf("Compressed digest of the chunk of %q at %d is %q, expected %q", e.Name, e.ChunkOffset, e.CompressedDigest, d)
+			}
+		}
+	}
+
+	blob, annotations := makeZstdChunkedBlob(t, files, &compressor.Options{Chunking: params})
+	for _, e := range readTestTOC(t, blob, annotations).Entries {
+		if e.CompressedDigest != "" {
+			t.Fatalf("Compressed digest recorded for %q without CompressedDigests", e.Name)
+		}
+	}
+}
+
+func TestCompressedSizes(t *testing.T) {
+	params := &compressor.ChunkParams{RollsumBits: 12, MinSize: 1024, MaxSize: 16384}
+	files := []testFile{
+		{name: "chunked", contents: randomContents(1, 100000)},
+		{name: "sparse", contents: randomContents(2, 20000) + string(make([]byte, 16*16384)) + randomContents(3, 20000)},
+		{name: "small", contents: "hello"},
+		{name: "empty", contents: ""},
+	}
+	tarSize := int64(len(makeTestTar(t, files)))
+	var contents int64
+	for _, f := range files {
+		contents += int64(len(f.contents))
+	}
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoder.Close()
+	for _, options := range []*compressor.Options{
+		{CompressedSizes: true},
+		{CompressedSizes: true, Chunking: params},
+	} {
+		blob, annotations := makeZstdChunkedBlob(t, files, options)
+		var manifestOffset int64
+		if _, err := fmt.Sscanf(annotations[internal.ManifestInfoKey], "%d:", &manifestOffset); err != nil {
+			t.Fatal(err)
+		}
+		// the manifest is in a skippable frame, after its 8 bytes header
+		payloadSize := manifestOffset - 8
+		toc := readTestTOC(t, blob, annotations)
+
+		// each file is charged for the frames of its chunks
+		sizes := make(map[string]int64)
+		var total int64
+		var ranges [][2]int64
+		for _, e := range toc.Entries {
+			if e.EndOffset != 0 {
+				sizes[e.Name] += e.EndOffset - e.Offset
+				ranges = append(ranges, [2]int64{e.Offset, e.EndOffset})
+			}
+			if e.Type == internal.TypeChunk {
+				if e.CompressedSize != 0 {
+					t.Fatalf("Compressed size recorded for a chunk of %q", e.Name)
+				}
+				continue
+			}
+			total += e.CompressedSize
+		}
+		for _, e := range toc.Entries {
+			if e.Type == internal.TypeReg && e.CompressedSize != sizes[e.Name] {
+				t.Fatalf("Compressed size of %q is %d, expected %d", e.Name, e.CompressedSize, sizes[e.Name])
+			}
+		}
+
+		// and the rest of the payload is made of the frames of the tar
+		// headers and padding
+		sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+		ranges = append(ranges, [2]int64{payloadSize, payloadSize})
+		var headers, rawHeaders, end int64
+		for _, r := range ranges {
+			if r[0] < end {
+				t.Fatalf("Overlapping payloads at %d", r[0])
+			}
+			if r[0] > end {
+				decompressed, err := decoder.DecodeAll(blob[end:r[0]], nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				rawHeaders += int64(len(decompressed))
+				headers += r[0] - end
+			}
+			end = r[1]
+		}
+		if rawHeaders+contents != tarSize {
+			t.Fatalf("%d bytes of tar headers and padding, expected %d", rawHeaders, tarSize-contents)
+		}
+		if total+headers != payloadSize {
+			t.Fatalf("Compressed sizes add up to %d, and the headers to %d, expected %d in all", total, headers, payloadSize)
+		}
+	}
+
+	blob, annotations := makeZstdChunkedBlob(t, files, &compressor.Options{Chunking: params})
+	for _, e := range readTestTOC(t, blob, annotations).Entries {
+		if e.CompressedSize != 0 {
+			t.Fatalf("Compressed size recorded for %q without CompressedSizes", e.Name)
+		}
+	}
+}
+
+func TestBlobDigest(t *testing.T) {
+	files := []testFile{
+		{name: "a", contents: randomContents(1, 100000)},
+		{name: "b", contents: "hello"},
+	}
+	for _, options := range []*compressor.Options{
+		nil,
+		{Chunking: &compressor.ChunkParams{RollsumBits: 12, MinSize: 1024, MaxSize: 16384}},
+		{SortChunksByDigest: true},
+		{ManifestFirst: true},
+	} {
+		var blob bytes.Buffer
+		w, err := compressor.ZstdCompressorWithOptions(&blob, make(map[string]string), options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dw, ok := w.(compressor.DigestedWriteCloser)
+		if !ok {
+			t.Fatalf("The writer of the blob doesn't compute its digest")
+		}
+		if _, err := w.Write(makeTestTar(t, files)); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if d, expected := dw.Digest(), digest.FromBytes(blob.Bytes()); d != expected {
+			t.Fatalf("Digest of the blob is %q, expected %q", d, expected)
+		}
+	}
+
+	// no digest for a blob which wasn't completely written
+	w, err := compressor.ZstdCompressor(ioutil.Discard, make(map[string]string), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a whole block, which the tar reader rejects without waiting for more
+	if _, err := w.Write(bytes.Repeat([]byte("x"), 512)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err == nil {
+		t.Fatal("Compressing an invalid tarball succeeded")
+	}
+	if d := w.(compressor.DigestedWriteCloser).Digest(); d != "" {
+		t.Fatalf("Digest %q returned for a blob which was not written", d)
+	}
+}
+
+// makeManifestBlob creates a blob made only of manifest, which is stored as
+// it is, and of the footer, so that manifests written by older versions can
+// be read back.
+func makeManifestBlob(t *testing.T, manifest string) ([]byte, map[string]string) {
+	var compressed bytes.Buffer
+	w, err := internal.ZstdWriterWithLevel(&compressed, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(manifest)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var blob bytes.Buffer
+	blob.Write([]byte{0x50, 0x2a, 0x4d, 0x18})
+	size := make([]byte, 4)
+	binary.LittleEndian.PutUint32(size, uint32(compressed.Len()))
+	blob.Write(size)
+	blob.Write(compressed.Bytes())
+	if err := internal.WriteZstdChunkedFooter(&blob, 8, uint64(compressed.Len()), uint64(len(manifest)), internal.ZstdChunkedFrameMagic, internal.ManifestTypeCRFS); err != nil {
+		t.Fatal(err)
+	}
+	annotations := map[string]string{
+		internal.ManifestChecksumKey: digest.FromBytes(compressed.Bytes()).String(),
+	}
+	return blob.Bytes(), annotations
+}
+
+func TestParseTOCVersions(t *testing.T) {
+	const (
+		helloDigest  = "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+		passwdDigest = "sha256:c50bfc1d6fb06f2cf8de7f2b632bfdd3d163268dfffca683122db73b7b592ca0"
+	)
+	type entry struct {
+		name              string
+		digest            string
+		offset, endOffset int64
+	}
+	for _, c := range []struct {
+		name     string
+		manifest string
+		version  int
+		layout   string
+		entries  []entry
+	}{
+		{
+			// the first zstd:chunked manifests, which recorded neither
+			// the access and change times nor the chunk hasher
+			name:     "zstd:chunked version 1",
+			manifest: `{"version":1,"entries":[{"type":"dir","name":"etc/","mode":493,"size":0,"uid":0,"gid":0,"modtime":"2021-06-01T00:00:00Z","devMajor":0,"devMinor":0},{"type":"reg","name":"etc/hosts","mode":420,"size":5,"uid":0,"gid":0,"modtime":"2021-06-01T00:00:00Z","devMajor":0,"devMinor":0,"digest":"` + helloDigest + `","offset":100,"endOffset":130,"chunkSize":5,"chunkDigest":"` + helloDigest + `"}]}`,
+			version:  internal.TOCVersion1,
+			entries:  []entry{{"etc/", "", 0, 0}, {"etc/hosts", helloDigest, 100, 130}},
+		},
+		{
+			// estargz TOCs have no endOffset, and have fields which
+			// zstd:chunked doesn't use
+			name:     "estargz",
+			manifest: `{"version":1,"entries":[{"name":"etc/","type":"dir","modtime":"2021-06-01T00:00:00Z","mode":493,"NumLink":0},{"name":"etc/hosts","type":"reg","size":5,"modtime":"2021-06-01T00:00:00Z","mode":420,"userName":"root","groupName":"root","NumLink":0,"digest":"` + helloDigest + `","offset":100,"chunkDigest":"` + helloDigest + `"},{"name":"etc/passwd","type":"reg","size":7,"modtime":"2021-06-01T00:00:00Z","mode":420,"NumLink":0,"digest":"` + passwdDigest + `","offset":160,"chunkDigest":"` + passwdDigest + `"}]}`,
+			version:  internal.TOCVersion1,
+			entries:  []entry{{"etc/", "", 0, 0}, {"etc/hosts", helloDigest, 100, 160}, {"etc/passwd", passwdDigest, 160, 0}},
+		},
+		{
+			name:     "version 2 with encoded digests and offsets",
+			manifest: `{"version":2,"digestEncoding":"base64","offsetEncoding":"delta","entries":[{"type":"dir","name":"etc/","size":0,"uid":0,"gid":0,"modtime":"2021-06-01T00:00:00Z","devMajor":0,"devMinor":0},{"type":"reg","name":"etc/hosts","size":5,"uid":0,"gid":0,"modtime":"2021-06-01T00:00:00Z","devMajor":0,"devMinor":0,"digest":"LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ","offset":100,"endOffset":30},{"type":"reg","name":"etc/passwd","size":7,"uid":0,"gid":0,"modtime":"2021-06-01T00:00:00Z","devMajor":0,"devMinor":0,"digest":"xQv8HW+wbyz43n8rYyv909FjJo3//KaDEi23O3tZLKA","endOffset":20}]}`,
+			version:  internal.TOCVersion2,
+			entries:  []entry{{"etc/", "", 0, 0}, {"etc/hosts", helloDigest, 100, 130}, {"etc/passwd", passwdDigest, 130, 150}},
+		},
+		{
+			name:     "version 2 with sorted payloads",
+			manifest: `{"version":2,"layout":"digest-sorted","tarHeadersEndOffset":90,"entries":[{"type":"reg","name":"a","size":5,"uid":0,"gid":0,"modtime":"2021-06-01T00:00:00Z","devMajor":0,"devMinor":0,"digest":"` + helloDigest + `","offset":90,"endOffset":120},{"type":"reg","name":"b","size":5,"uid":0,"gid":0,"modtime":"2021-06-01T00:00:00Z","devMajor":0,"devMinor":0,"digest":"` + helloDigest + `","offset":90,"endOffset":120}]}`,
+			version:  internal.TOCVersion2,
+			layout:   internal.LayoutDigestSorted,
+			entries:  []entry{{"a", helloDigest, 90, 120}, {"b", helloDigest, 90, 120}},
+		},
+	} {
+		blob, annotations := makeManifestBlob(t, c.manifest)
+		toc := readTestTOC(t, blob, annotations)
+		if toc.Version != c.version || toc.Layout != c.layout {
+			t.Fatalf("%s: read version %d with layout %q, expected version %d with layout %q", c.name, toc.Version, toc.Layout, c.version, c.layout)
+		}
+		if len(toc.Entries) != len(c.entries) {
+			t.Fatalf("%s: read %d entries, expected %d", c.name, len(toc.Entries), len(c.entries))
+		}
+		for i, e := range toc.Entries {
+			if got := (entry{e.Name, e.Digest, e.Offset, e.EndOffset}); got != c.entries[i] {
+				t.Fatalf("%s: read entry %d as %+v, expected %+v", c.name, i, got, c.entries[i])
+			}
+		}
+	}
+
+	for _, manifest := range []string{
+		`{"entries":[]}`,
+		`{"version":3,"entries":[]}`,
+		`{"version":2,"layout":"unknown","entries":[]}`,
+		`{"version":2,"offsetEncoding":"unknown","entries":[]}`,
+		`{"version":1,"digestEncoding":"hex","entries":[]}`,
+		`{"version":1,"offsetEncoding":"delta","entries":[]}`,
+		`{"version":1,"layout":"digest-sorted","entries":[]}`,
+		`[]`,
+	} {
+		if _, err := internal.ParseTOC([]byte(manifest)); err == nil {
+			t.Fatalf("Invalid manifest %s accepted", manifest)
+		}
+	}
+
+	// manifests are written with the oldest version which can describe them
+	files := []testFile{{name: "file", contents: "hello"}}
+	for _, c := range []struct {
+		options *compressor.Options
+		version int
+	}{
+		{nil, internal.TOCVersion1},
+		{&compressor.Options{ChunkHasher: "sha512", PrefetchOrder: []string{"file"}}, internal.TOCVersion1},
+		{&compressor.Options{DigestEncoding: internal.DigestEncodingHex}, internal.TOCVersion2},
+		{&compressor.Options{OffsetEncoding: internal.OffsetEncodingDelta}, internal.TOCVersion2},
+		{&compressor.Options{SortChunksByDigest: true}, internal.TOCVersion2},
+	} {
+		blob, annotations := makeZstdChunkedBlob(t, files, c.options)
+		if toc := readTestTOC(t, blob, annotations); toc.Version != c.version {
+			t.Fatalf("Manifest written with version %d with options %+v, expected %d", toc.Version, c.options, c.version)
+		}
+	}
+}
+
+func TestContentClasses(t *testing.T) {
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	if _, err := gw.Write([]byte("some compressed text")); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// a multibyte character is split at the end of the sample
+	longText := strings.Repeat("a", 511) + "é" + strings.Repeat("b", 100)
+
+	files := []testFile{
+		{name: "script.sh", contents: "#!/bin/sh\necho \"hello world\"\n"},
+		{name: "utf8.txt", contents: "Grüße, 世界\n"},
+		{name: "long.txt", contents: longText},
+		{name: "program", contents: "\x7fELF\x02\x01\x01\x00" + randomContents(1, 1000)},
+		{name: "nul.txt", contents: "text\x00with a NUL"},
+		{name: "layer.tar.gz", contents: gzipped.String()},
+		{name: "data.zst", contents: "\x28\xb5\x2f\xfd" + randomContents(2, 100)},
+		{name: "lib.jar", contents: "PK\x03\x04" + randomContents(3, 100)},
+		{name: "image.png", contents: "\x89PNG\r\n\x1a\n" + randomContents(4, 100)},
+		{name: "photo", contents: "\xff\xd8\xff\xe0" + randomContents(5, 100)},
+		{name: "image.webp", contents: "RIFF\x10\x00\x00\x00WEBPVP8 " + randomContents(6, 100)},
+		{name: "icon.svg", contents: "<svg xmlns=\"http://www.w3.org/2000/svg\"/>\n"},
+		{name: "asset.br", contents: "\x1b\x03\x00\xf8" + randomContents(7, 100)},
+		{name: "empty", contents: ""},
+	}
+	expected := map[string]string{
+		"script.sh":    ContentClassText,
+		"utf8.txt":     ContentClassText,
+		"long.txt":     ContentClassText,
+		"program":      ContentClassBinary,
+		"nul.txt":      ContentClassBinary,
+		"layer.tar.gz": ContentClassCompressed,
+		"data.zst":     ContentClassCompressed,
+		"lib.jar":      ContentClassCompressed,
+		"image.png":    ContentClassImage,
+		"photo":        ContentClassImage,
+		"image.webp":   ContentClassImage,
+		"icon.svg":     ContentClassImage,
+		"asset.br":     ContentClassCompressed,
+		"empty":        "",
+	}
+	check := func(what string, entries []FileMetadata) {
+		for _, e := range entries {
+			if e.Type != TypeReg {
+				continue
+			}
+			if e.ContentClass != expected[e.Name] {
+				t.Fatalf("%s: %q classified as %q, expected %q", what, e.Name, e.ContentClass, expected[e.Name])
+			}
+		}
+	}
+	chunking := &compressor.ChunkParams{RollsumBits: 12, MinSize: 1024, MaxSize: 16 << 10}
+	for _, options := range []*compressor.Options{
+		{ContentClasses: true},
+		{ContentClasses: true, Chunking: chunking},
+		{ContentClasses: true, SortChunksByDigest: true},
+	} {
+		blob, annotations := makeZstdChunkedBlob(t, files, options)
+		check(fmt.Sprintf("%+v", *options), readTestTOC(t, blob, annotations).Entries)
+	}
+	entries, err := ScanTarMetadata(bytes.NewReader(makeTestTar(t, files)), &compressor.Options{ContentClasses: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("ScanTarMetadata", entries)
+
+	// nothing is recorded unless asked to
+	blob, annotations := makeZstdChunkedBlob(t, files, nil)
+	for _, e := range readTestTOC(t, blob, annotations).Entries {
+		if e.ContentClass != "" {
+			t.Fatalf("Content class recorded for %q without ContentClasses", e.Name)
+		}
+	}
+}
+
+func TestManifestFirst(t *testing.T) {
+	params := &compressor.ChunkParams{RollsumBits: 12, MinSize: 1024, MaxSize: 16384}
+	files := []testFile{
+		{name: "a", contents: "contents of a"},
+		{name: "chunked", contents: randomContents(1, 100000)},
+		{name: "empty", contents: ""},
+		{name: "b", contents: strings.Repeat("b", 1000)},
+	}
+	contents := make(map[string]string)
+	for _, f := range files {
+		contents[f.name] = f.contents
+	}
+	tarball := makeTestTar(t, files)
+
+	for _, options := range []compressor.Options{
+		{},
+		{Chunking: params, OffsetEncoding: internal.OffsetEncodingDelta, CompressedDigests: true},
+	} {
+		blob, annotations := makeZstdChunkedBlob(t, files, &options)
+		expected := readTestTOC(t, blob, annotations).Entries
+		options.ManifestFirst = true
+		blob, annotations = makeZstdChunkedBlob(t, files, &options)
+		toc := readTestTOC(t, blob, annotations)
+		if len(toc.Entries) != len(expected) {
+			t.Fatalf("%d entries in the manifest, expected %d", len(toc.Entries), len(expected))
+		}
+
+		// the payloads are where the manifest says, and the manifest
+		// can be found from the footer too
+		delete(annotations, internal.ManifestInfoKey)
+		if fromFooter := readTestTOC(t, blob, annotations); !reflect.DeepEqual(fromFooter.Entries, toc.Entries) {
+			t.Fatal("The manifest found from the footer differs from the one in the annotations")
+		}
+		decoder, err := zstd.NewReader(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer decoder.Close()
+		for i, e := range toc.Entries {
+			if e.EndOffset == 0 {
+				continue
+			}
+			if e.Offset-expected[i].Offset != toc.Entries[0].Offset-expected[0].Offset {
+				t.Fatalf("Payload of %q moved by a different amount than the others", e.Name)
+			}
+			payload, err := decoder.DecodeAll(blob[e.Offset:e.EndOffset], nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.Type == TypeReg && e.ChunkSize == 0 && string(payload) != contents[e.Name] {
+				t.Fatalf("Wrong payload for %q", e.Name)
+			}
+			if e.CompressedDigest != "" {
+				digester, err := internal.NewChunkDigesterForDigest(e.ChunkDigest)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := digester.Hash().Write(blob[e.Offset:e.EndOffset]); err != nil {
+					t.Fatal(err)
+				}
+				if digester.Digest() != e.CompressedDigest {
+					t.Fatalf("Wrong compressed digest for %q", e.Name)
+				}
+			}
+		}
+
+		// the blob is still a zstd stream of the tarball
+		decoded, err := decoder.DecodeAll(blob, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decoded, tarball) {
+			t.Fatal("The blob doesn't decompress to the tarball")
+		}
+		var out bytes.Buffer
+		if err := ReconstructTar(bytes.NewReader(blob), int64(len(blob)), digest.FromBytes(tarball), &out); err != nil {
+			t.Fatal(err)
+		}
+
+		// the manifest is read from the start of the stream, which is
+		// left where the tarball starts
+		r := bytes.NewReader(blob)
+		entries, err := ReadManifestFirst(r, annotations)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(entries, toc.Entries) {
+			t.Fatal("The manifest read from the start differs from the one read from the end")
+		}
+		rest, err := decoder.DecodeAll(blob[len(blob)-r.Len():], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(rest, tarball) {
+			t.Fatal("The rest of the blob doesn't decompress to the tarball")
+		}
+		if pos := int64(len(blob) - r.Len()); pos > toc.Entries[0].Offset {
+			t.Fatalf("Reader left at %d, after the first payload at %d", pos, toc.Entries[0].Offset)
+		}
+
+		if _, err := SplitChunkedBlob(bytes.NewReader(blob), int64(len(blob)), int64(len(blob))); err == nil {
+			t.Fatal("A blob with the manifest first was split")
+		}
+	}
+
+	blob, annotations := makeZstdChunkedBlob(t, files, nil)
+	if _, err := ReadManifestFirst(bytes.NewReader(blob), annotations); !errors.Is(err, ErrManifestNotFirst) {
+		t.Fatalf("Expected ErrManifestNotFirst for a blob with the manifest at the end, got %v", err)
+	}
+	w, err := compressor.ZstdCompressorWithOptions(ioutil.Discard, make(map[string]string), &compressor.Options{ManifestFirst: true, SortChunksByDigest: true})
+	if err == nil {
+		w.Close()
+		t.Fatal("ManifestFirst accepted with SortChunksByDigest")
+	}
+}
+
+func TestMarkEmptyDirs(t *testing.T) {
+	var tarBuffer bytes.Buffer
+	tw := tar.NewWriter(&tarBuffer)
+	for _, hdr := range []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: "./", Mode: 0755},
+		{Typeflag: tar.TypeDir, Name: "./empty/", Mode: 0755},
+		{Typeflag: tar.TypeDir, Name: "./populated/", Mode: 0755},
+		{Typeflag: tar.TypeReg, Name: "./populated/file", Mode: 0644, Size: 4},
+		{Typeflag: tar.TypeDir, Name: "nested", Mode: 0755},
+		{Typeflag: tar.TypeDir, Name: "nested/mnt/", Mode: 0755},
+		{Typeflag: tar.TypeReg, Name: "late/file", Mode: 0644, Size: 4},
+		{Typeflag: tar.TypeDir, Name: "late/", Mode: 0755},
+		{Typeflag: tar.TypeSymlink, Name: "link/", Linkname: "empty"},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			if _, err := tw.Write([]byte("data")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tarball := tarBuffer.Bytes()
+
+	check := func(what string, entries []FileMetadata, expected map[string]bool) {
+		for _, e := range entries {
+			if e.EmptyDir != expected[e.Name] {
+				t.Fatalf("%s: EmptyDir of %q is %v", what, e.Name, e.EmptyDir)
+			}
+		}
+	}
+	emptyDirs := map[string]bool{"./empty/": true, "nested/mnt/": true}
+	for _, options := range []*compressor.Options{
+		{MarkEmptyDirs: true},
+		{MarkEmptyDirs: true, SortChunksByDigest: true},
+		{},
+	} {
+		var blob bytes.Buffer
+		annotations := make(map[string]string)
+		w, err := compressor.ZstdCompressorWithOptions(&blob, annotations, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(tarball); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		expected := emptyDirs
+		if !options.MarkEmptyDirs {
+			expected = nil
+		}
+		check(fmt.Sprintf("%+v", *options), readTestTOC(t, blob.Bytes(), annotations).Entries, expected)
+	}
+	entries, err := ScanTarMetadata(bytes.NewReader(tarball), &compressor.Options{MarkEmptyDirs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("ScanTarMetadata", entries, emptyDirs)
+}
+
+func TestManifestUncompressedLength(t *testing.T) {
+	files := []testFile{
+		{name: "a", contents: randomContents(1, 1000)},
+		{name: "b", contents: "b"},
+	}
+	blob, annotations := makeZstdChunkedBlob(t, files, nil)
+	var offset, length, lengthUncompressed, manifestType uint64
+	if _, err := fmt.Sscanf(annotations[internal.ManifestInfoKey], "%d:%d:%d:%d", &offset, &length, &lengthUncompressed, &manifestType); err != nil {
+		t.Fatal(err)
+	}
+
+	// withLength returns the blob and its annotations, with the
+	// uncompressed length of the manifest replaced by value.
+	withLength := func(value uint64) ([]byte, map[string]string) {
+		lying := append([]byte{}, blob...)
+		binary.LittleEndian.PutUint64(lying[len(lying)-internal.FooterSizeSupported+16:], value)
+		lyingAnnotations := make(map[string]string)
+		for k, v := range annotations {
+			lyingAnnotations[k] = v
+		}
+		lyingAnnotations[internal.ManifestInfoKey] = fmt.Sprintf("%d:%d:%d:%d", offset, length, value, manifestType)
+		return lying, lyingAnnotations
+	}
+	check := func(value uint64, expected string) {
+		lying, lyingAnnotations := withLength(value)
+		_, _, err := readZstdChunkedTOC(bytes.NewReader(lying), int64(len(lying)))
+		if expected == "" && err != nil || expected != "" && (err == nil || !strings.Contains(err.Error(), expected)) {
+			t.Fatalf("Reading the footer with an uncompressed length of %d: unexpected error %v", value, err)
+		}
+		_, _, err = readZstdChunkedManifest(bytesSeekable(lying), int64(len(lying)), lyingAnnotations)
+		if expected == "" && err != nil || expected != "" && (err == nil || !strings.Contains(err.Error(), expected)) {
+			t.Fatalf("Reading the annotations with an uncompressed length of %d: unexpected error %v", value, err)
+		}
+	}
+
+	check(lengthUncompressed, "")
+	check(lengthUncompressed+100, "")
+	check(lengthUncompressed-1, "longer than its declared length")
+	check(1<<62, "manifest too big")
+
+	// the limit can be changed
+	defer func(limit uint64) {
+		MaxManifestSize = limit
+	}(MaxManifestSize)
+	MaxManifestSize = lengthUncompressed - 1
+	check(lengthUncompressed, "manifest too big")
+	MaxManifestSize = lengthUncompressed
+	check(lengthUncompressed, "")
+}
+
+func TestZstdCompressBatch(t *testing.T) {
+	data := randomContents(5, 256<<10)
+	batch := [][]testFile{
+		{
+			{name: "big", contents: data},
+			{name: "small", contents: "hello"},
+		},
+		{
+			{name: "copy", contents: data},
+			{name: "shifted", contents: "a prefix" + data},
+			{name: "other", contents: "hello"},
+			{name: "empty", contents: ""},
+		},
+	}
+	options := &compressor.Options{Chunking: &compressor.ChunkParams{RollsumBits: 12, MinSize: 1024, MaxSize: 16 << 10}}
+
+	var readers []io.Reader
+	separateSize := 0
+	for _, files := range batch {
+		readers = append(readers, bytes.NewReader(makeTestTar(t, files)))
+		separate, _ := makeZstdChunkedBlob(t, files, options)
+		separateSize += len(separate)
+	}
+	var blobBuffer bytes.Buffer
+	annotations, err := compressor.ZstdCompressBatch(&blobBuffer, readers, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := blobBuffer.Bytes()
+	if len(annotations) != len(batch) {
+		t.Fatalf("%d manifests for %d tarballs", len(annotations), len(batch))
+	}
+	// the data is random, so the size shows that it was stored once
+	if len(blob) > separateSize/2 {
+		t.Fatalf("The blob is %d bytes long, the separate blobs are %d bytes long", len(blob), separateSize)
+	}
+
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoder.Close()
+	offsets := make(map[string]int64)
+	digests := make(map[int64]string)
+	for i, files := range batch {
+		toc := readTestTOC(t, blob, annotations[i])
+		if toc.Layout != internal.LayoutShared {
+			t.Fatalf("Unexpected layout %q", toc.Layout)
+		}
+		for _, e := range toc.Entries {
+			if e.EndOffset == 0 {
+				continue
+			}
+			d := e.ChunkDigest
+			if d == "" {
+				d = e.Digest
+			}
+			if offset, found := offsets[d]; found && offset != e.Offset {
+				t.Fatalf("The chunk %s of %q is stored at %d and %d", d, e.Name, offset, e.Offset)
+			}
+			if other, found := digests[e.Offset]; found && other != d {
+				t.Fatalf("The chunks %s and %s are both stored at %d", d, other, e.Offset)
+			}
+			offsets[d] = e.Offset
+			digests[e.Offset] = d
+		}
+
+		index := BuildFlatIndex(toc.Entries)
+		for _, f := range files {
+			var contents []byte
+			for _, chunk := range index[f.name].Chunks {
+				decompressed, err := decoder.DecodeAll(blob[chunk.BlobOffset:chunk.BlobOffset+chunk.FrameLength], nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				contents = append(contents, decompressed...)
+			}
+			if string(contents) != f.contents {
+				t.Fatalf("Wrong contents for %q in tarball %d", f.name, i)
+			}
+		}
+
+		tarball := makeTestTar(t, files)
+		if err := ReconstructTar(bytes.NewReader(blob), int64(len(blob)), digest.FromBytes(tarball), ioutil.Discard); err == nil {
+			t.Fatal("A tarball was rebuilt from a blob with shared chunks")
+		}
+	}
+
+	if _, err := compressor.ZstdCompressBatch(ioutil.Discard, readers, &compressor.Options{SortChunksByDigest: true}); err == nil {
+		t.Fatal("SortChunksByDigest accepted")
+	}
+}
+
+func TestChunkThreshold(t *testing.T) {
+	files := []testFile{
+		{name: "small", contents: randomContents(6, 32<<10)},
+		{name: "big", contents: randomContents(7, 256<<10)},
+		{name: "listed", contents: randomContents(8, 32<<10)},
+	}
+	options := &compressor.Options{
+		Chunking:           &compressor.ChunkParams{RollsumBits: 10, MinSize: 1024, MaxSize: 4096},
+		ChunkThreshold:     64 << 10,
+		ExplicitBoundaries: map[string][]int64{"listed": {1000}},
+	}
+	blob, annotations := makeZstdChunkedBlob(t, files, options)
+	toc := readTestTOC(t, blob, annotations)
+
+	chunks := make(map[string]int)
+	for _, e := range toc.Entries {
+		if e.Type == internal.TypeChunk {
+			chunks[e.Name]++
+		}
+		// a single chunk has the digest of the file
+		if e.Name == "small" && (e.ChunkDigest != e.Digest || e.ChunkSize != 0) {
+			t.Fatalf("Chunk metadata recorded for %+v", e)
+		}
+	}
+	if chunks["small"] != 0 {
+		t.Fatalf("The small file was split in %d chunks", chunks["small"]+1)
+	}
+	if chunks["big"] < 32 {
+		t.Fatalf("The big file was split in %d chunks", chunks["big"]+1)
+	}
+	if chunks["listed"] != 1 {
+		t.Fatalf("The file with explicit boundaries was split in %d chunks", chunks["listed"]+1)
+	}
+
+	var out bytes.Buffer
+	tarball := makeTestTar(t, files)
+	if err := ReconstructTar(bytes.NewReader(blob), int64(len(blob)), digest.FromBytes(tarball), &out); err != nil {
+		t.Fatal(err)
+	}
+	scanned, err := ScanTarMetadata(bytes.NewReader(tarball), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scanned) != len(toc.Entries) {
+		t.Fatalf("%d entries scanned, %d in the manifest", len(scanned), len(toc.Entries))
+	}
+
+	if _, err := compressor.ZstdCompressorWithOptions(ioutil.Discard, map[string]string{}, &compressor.Options{ChunkThreshold: -1}); err == nil {
+		t.Fatal("Negative threshold accepted")
+	}
+}
+
+func TestGzipManifest(t *testing.T) {
+	files := []testFile{
+		{name: "a", contents: "contents of a"},
+		{name: "b", contents: randomContents(1, 100000)},
+	}
+	tarball := makeTestTar(t, files)
+
+	if _, err := compressor.ZstdCompressorWithOptions(ioutil.Discard, map[string]string{}, &compressor.Options{ManifestCompression: "lz4"}); err == nil {
+		t.Fatal("Unknown manifest compression accepted")
+	}
+
+	for _, manifestFirst := range []bool{false, true} {
+		blob, annotations := makeZstdChunkedBlob(t, files, &compressor.Options{ManifestFirst: manifestFirst})
+		expected := readTestTOC(t, blob, annotations).Entries
+		blob, annotations = makeZstdChunkedBlob(t, files, &compressor.Options{ManifestFirst: manifestFirst, ManifestCompression: "gzip"})
+
+		var offset, length, lengthUncompressed, manifestType uint64
+		if _, err := fmt.Sscanf(annotations[internal.ManifestInfoKey], "%d:%d:%d:%d", &offset, &length, &lengthUncompressed, &manifestType); err != nil {
+			t.Fatal(err)
+		}
+		if manifestType != internal.ManifestTypeCRFSGzip {
+			t.Fatalf("Manifest type %d in the annotations", manifestType)
+		}
+		footer := blob[len(blob)-internal.FooterSizeSupported:]
+		if footerType := binary.LittleEndian.Uint64(footer[24:32]); footerType != internal.ManifestTypeCRFSGzip {
+			t.Fatalf("Manifest type %d in the footer", footerType)
+		}
+
+		// the manifest can be read with a plain gzip decompressor
+		gz, err := gzip.NewReader(bytes.NewReader(blob[offset : offset+length]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifest, err := ioutil.ReadAll(gz)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uint64(len(manifest)) != lengthUncompressed {
+			t.Fatalf("The manifest is %d bytes long, %d declared", len(manifest), lengthUncompressed)
+		}
+		fromGzip, err := internal.ParseTOC(manifest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// and by the readers, from the annotations or from the footer
+		toc := readTestTOC(t, blob, annotations)
+		if !reflect.DeepEqual(toc.Entries, fromGzip.Entries) {
+			t.Fatal("The manifest read from the annotations differs from the gzip one")
+		}
+		delete(annotations, internal.ManifestInfoKey)
+		if fromFooter := readTestTOC(t, blob, annotations); !reflect.DeepEqual(fromFooter.Entries, toc.Entries) {
+			t.Fatal("The manifest read from the footer differs from the gzip one")
+		}
+		if manifestFirst {
+			entries, err := ReadManifestFirst(bytes.NewReader(blob), annotations)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(entries, toc.Entries) {
+				t.Fatal("The manifest read first differs from the gzip one")
+			}
+		} else if !reflect.DeepEqual(toc.Entries, expected) {
+			t.Fatal("The manifest differs from the zstd one")
+		}
+
+		// the rest of the blob is still zstd
+		decoder, err := zstd.NewReader(bytes.NewReader(blob))
+		if err != nil {
+			t.Fatal(err)
+		}
+		decompressed, err := ioutil.ReadAll(decoder)
+		decoder.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decompressed, tarball) {
+			t.Fatal("The blob doesn't decompress to the tarball")
+		}
+
+		// a lost footer is rebuilt with the type of the manifest
+		if !manifestFirst {
+			f, err := ioutil.TempFile("", "gzip-manifest")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(f.Name())
+			defer f.Close()
+			if _, err := f.Write(blob[:len(blob)-8-internal.FooterSizeSupported]); err != nil {
+				t.Fatal(err)
+			}
+			if err := RebuildTrailer(f); err != nil {
+				t.Fatal(err)
+			}
+			repaired, err := ioutil.ReadFile(f.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(repaired, blob) {
+				t.Fatal("The footer of the blob with a gzip manifest wasn't rebuilt")
+			}
+		}
+	}
+}
+
+// mapFileGetter is a storage.FileGetter which serves files from a map.
+type mapFileGetter map[string]string
+
+func (m mapFileGetter) Get(name string) (io.ReadCloser, error) {
+	contents, found := m[name]
+	if !found {
+		return nil, fmt.Errorf("no file %q", name)
+	}
+	return ioutil.NopCloser(strings.NewReader(contents)), nil
+}
+
+func TestTarSplit(t *testing.T) {
+	params := &compressor.ChunkParams{RollsumBits: 12, MinSize: 1024, MaxSize: 16384}
+	files := []testFile{
+		{name: "a", contents: "contents of a"},
+		{name: "chunked", contents: randomContents(2, 100000)},
+		{name: "empty", contents: ""},
+		{name: "b", contents: strings.Repeat("b", 1000)},
+	}
+	contents := make(mapFileGetter)
+	for _, f := range files {
+		contents[f.name] = f.contents
+	}
+	tarball := makeTestTar(t, files)
+
+	blob, annotations := makeZstdChunkedBlob(t, files, nil)
+	toc := readTestTOC(t, blob, annotations)
+	if tarSplit, err := readTarSplit(bytesSeekable(blob), &toc); err != nil || tarSplit != nil {
+		t.Fatalf("Unexpected tar-split metadata without the TarSplit option: %v", err)
+	}
+
+	for _, options := range []compressor.Options{
+		{TarSplit: true},
+		{TarSplit: true, Chunking: params},
+		{TarSplit: true, ManifestFirst: true},
+		{TarSplit: true, SortChunksByDigest: true},
+	} {
+		blob, annotations := makeZstdChunkedBlob(t, files, &options)
+		toc := readTestTOC(t, blob, annotations)
+		if toc.Layout == internal.LayoutSequential && toc.Version != internal.TOCVersion1 {
+			t.Fatalf("Unexpected manifest version %d", toc.Version)
+		}
+		tarSplit, err := readTarSplit(bytesSeekable(blob), &toc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var reassembled bytes.Buffer
+		rc := asm.NewOutputTarStream(contents, storage.NewJSONUnpacker(bytes.NewReader(tarSplit)))
+		if _, err := io.Copy(&reassembled, rc); err != nil {
+			t.Fatal(err)
+		}
+		rc.Close()
+		if !bytes.Equal(reassembled.Bytes(), tarball) {
+			t.Fatalf("The tarball reassembled with %+v differs from the original", options)
+		}
+
+		// the metadata is verified before it is used
+		corrupted := append([]byte{}, blob...)
+		corrupted[toc.TarSplitOffset] ^= 0xff
+		if _, err := readTarSplit(bytesSeekable(corrupted), &toc); err == nil {
+			t.Fatal("Corrupted tar-split metadata was accepted")
+		}
+	}
+}
@@ -81,6 +81,9 @@ type BtrfsOptionsConfig struct {
 	MinSpace string `toml:"min_space"`
 	// Size
 	Size string `toml:"size"`
+	// Compression is the compression property set on the subvolumes of
+	// new layers, such as "zstd:3"
+	Compression string `toml:"compression"`
 }
 
 type OverlayOptionsConfig struct {
@@ -100,12 +103,24 @@ type OverlayOptionsConfig struct {
 	// ForceMask indicates the permissions mask (e.g. "0755") to use for new
 	// files and directories
 	ForceMask string `toml:"force_mask"`
+	// Xino indicates whether the "xino" feature of overlay should be used,
+	// if the kernel supports it, to keep inode numbers unique
+	Xino string `toml:"xino"`
+	// MountCache indicates whether the lowers of layers should be mounted
+	// once, and shared by the layers based on the same parent
+	MountCache string `toml:"mount_cache"`
+	// AsyncRemove indicates whether the directories of removed layers
+	// should be moved aside and deleted in the background
+	AsyncRemove string `toml:"async_remove"`
 }
 
 type VfsOptionsConfig struct {
 	// IgnoreChownErrors is a flag for whether chown errors should be
 	// ignored when building an image.
 	IgnoreChownErrors string `toml:"ignore_chown_errors"`
+	// AsyncRemove indicates whether the directories of removed layers
+	// should be moved aside and deleted in the background
+	AsyncRemove string `toml:"async_remove"`
 }
 
 type ZfsOptionsConfig struct {
@@ -198,6 +213,18 @@ type OptionsConfig struct {
 
 	// DisableVolatile doesn't allow volatile mounts when it is set.
 	DisableVolatile bool `toml:"disable-volatile"`
+
+	// PrefetchOnMount reads ahead the files of layers when they are
+	// first mounted.
+	PrefetchOnMount bool `toml:"prefetch-on-mount"`
+
+	// BindRoots are the directories under which the sources of the
+	// read-only binds of images and containers must be.
+	BindRoots []string `toml:"bind-roots"`
+
+	// SyncPolicy is how the layers are made durable: "always",
+	// "metadata-only" or "none".
+	SyncPolicy string `toml:"sync-policy"`
 }
 
 // GetGraphDriverOptions returns the driver specific options
@@ -212,6 +239,9 @@ func GetGraphDriverOptions(driverName string, options OptionsConfig) []string {
 		}
 
 	case "btrfs":
+		if options.Btrfs.Compression != "" {
+			doptions = append(doptions, fmt.Sprintf("%s.compression=%s", driverName, options.Btrfs.Compression))
+		}
 		if options.Btrfs.MinSpace != "" {
 			return append(doptions, fmt.Sprintf("%s.min_space=%s", driverName, options.Btrfs.MinSpace))
 		}
@@ -311,12 +341,24 @@ func GetGraphDriverOptions(driverName string, options OptionsConfig) []string {
 		} else if options.ForceMask != 0 {
 			doptions = append(doptions, fmt.Sprintf("%s.force_mask=%s", driverName, options.ForceMask))
 		}
+		if options.Overlay.Xino != "" {
+			doptions = append(doptions, fmt.Sprintf("%s.xino=%s", driverName, options.Overlay.Xino))
+		}
+		if options.Overlay.MountCache != "" {
+			doptions = append(doptions, fmt.Sprintf("%s.mount_cache=%s", driverName, options.Overlay.MountCache))
+		}
+		if options.Overlay.AsyncRemove != "" {
+			doptions = append(doptions, fmt.Sprintf("%s.async_remove=%s", driverName, options.Overlay.AsyncRemove))
+		}
 	case "vfs":
 		if options.Vfs.IgnoreChownErrors != "" {
 			doptions = append(doptions, fmt.Sprintf("%s.ignore_chown_errors=%s", driverName, options.Vfs.IgnoreChownErrors))
 		} else if options.IgnoreChownErrors != "" {
 			doptions = append(doptions, fmt.Sprintf("%s.ignore_chown_errors=%s", driverName, options.IgnoreChownErrors))
 		}
+		if options.Vfs.AsyncRemove != "" {
+			doptions = append(doptions, fmt.Sprintf("%s.async_remove=%s", driverName, options.Vfs.AsyncRemove))
+		}
 
 	case "zfs":
 		if options.Zfs.Name != "" {
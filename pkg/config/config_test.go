@@ -164,6 +164,14 @@ func TestBtrfsOptions(t *testing.T) {
 	if !searchOptions(doptions, s100) {
 		t.Fatalf("Expected to find size %q, got %v", s100, doptions)
 	}
+	// Make sure compression is passed along with min_space
+	options = OptionsConfig{}
+	options.Btrfs.Compression = "zstd:3"
+	options.Btrfs.MinSpace = s100
+	doptions = GetGraphDriverOptions("btrfs", options)
+	if !searchOptions(doptions, "btrfs.compression=zstd:3") || !searchOptions(doptions, s100) {
+		t.Fatalf("Expected to find compression and min_space options, got %v", doptions)
+	}
 
 }
 
@@ -252,6 +260,21 @@ func TestOverlayOptions(t *testing.T) {
 	if !searchOptions(doptions, "skip_mount_home") {
 		t.Fatalf("Expected to find 'skip_mount_home' options, got %v", doptions)
 	}
+	options.Overlay.Xino = "true"
+	doptions = GetGraphDriverOptions("overlay", options)
+	if !searchOptions(doptions, "xino=true") {
+		t.Fatalf("Expected to find 'xino' options, got %v", doptions)
+	}
+	options.Overlay.MountCache = "true"
+	doptions = GetGraphDriverOptions("overlay", options)
+	if !searchOptions(doptions, "mount_cache=true") {
+		t.Fatalf("Expected to find 'mount_cache' options, got %v", doptions)
+	}
+	options.Overlay.AsyncRemove = "true"
+	doptions = GetGraphDriverOptions("overlay", options)
+	if !searchOptions(doptions, "async_remove=true") {
+		t.Fatalf("Expected to find 'async_remove' options, got %v", doptions)
+	}
 
 	// Make sure legacy mountopt still works
 	options = OptionsConfig{}
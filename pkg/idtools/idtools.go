@@ -287,6 +287,103 @@ func parseSubidFile(path, username string) (ranges, error) {
 	return rangeList, nil
 }
 
+// IDRange is a range of subordinate IDs which are assigned to a user.
+type IDRange struct {
+	Start  int
+	Length int
+}
+
+// SubIDSource provides the subordinate ID ranges assigned to users.
+type SubIDSource interface {
+	// SubUIDRanges returns the subordinate UID ranges assigned to username.
+	SubUIDRanges(username string) ([]IDRange, error)
+	// SubGIDRanges returns the subordinate GID ranges assigned to username.
+	SubGIDRanges(username string) ([]IDRange, error)
+}
+
+type hostSubIDSource struct{}
+
+func toIDRanges(r ranges, err error) ([]IDRange, error) {
+	if err != nil {
+		return nil, err
+	}
+	idRanges := make([]IDRange, 0, len(r))
+	for _, subidRange := range r {
+		idRanges = append(idRanges, IDRange(subidRange))
+	}
+	return idRanges, nil
+}
+
+func (hostSubIDSource) SubUIDRanges(username string) ([]IDRange, error) {
+	return toIDRanges(readSubuid(username))
+}
+
+func (hostSubIDSource) SubGIDRanges(username string) ([]IDRange, error) {
+	return toIDRanges(readSubgid(username))
+}
+
+// HostSubIDSource reads the subordinate ID ranges from /etc/subuid and
+// /etc/subgid, or through libsubid if it is enabled.
+var HostSubIDSource SubIDSource = hostSubIDSource{}
+
+// CurrentUserRanges returns the subordinate UID and GID ranges which are
+// assigned to the user running the current process, sorted by their first ID.
+func CurrentUserRanges() (subuid, subgid []IDRange, err error) {
+	return CurrentUserRangesFromSource(HostSubIDSource)
+}
+
+// CurrentUserRangesFromSource is like CurrentUserRanges, but it looks up the
+// ranges using the specified source.
+func CurrentUserRangesFromSource(source SubIDSource) (subuid, subgid []IDRange, err error) {
+	u, err := user.LookupId(strconv.Itoa(os.Getuid()))
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "error looking up the current user")
+	}
+	return UserRangesFromSource(source, u.Username)
+}
+
+// UserRangesFromSource returns the subordinate UID and GID ranges which are
+// assigned to username by source, sorted by their first ID.
+func UserRangesFromSource(source SubIDSource, username string) (subuid, subgid []IDRange, err error) {
+	subuid, err = source.SubUIDRanges(username)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, errors.Wrapf(err, "error reading subordinate UIDs for user %q", username)
+	}
+	subgid, err = source.SubGIDRanges(username)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, errors.Wrapf(err, "error reading subordinate GIDs for user %q", username)
+	}
+	sort.Slice(subuid, func(i, j int) bool { return subuid[i].Start < subuid[j].Start })
+	sort.Slice(subgid, func(i, j int) bool { return subgid[i].Start < subgid[j].Start })
+	return subuid, subgid, nil
+}
+
+// RangesCapacity returns the number of distinct IDs which are available in
+// the specified ranges.  Overlapping ranges are counted only once.
+func RangesCapacity(idRanges []IDRange) int {
+	sorted := make([]IDRange, len(idRanges))
+	copy(sorted, idRanges)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start < sorted[j].Start })
+
+	total, end := 0, -1
+	for _, r := range sorted {
+		if r.Length <= 0 {
+			continue
+		}
+		start := r.Start
+		if start < end {
+			start = end
+		}
+		if r.Start+r.Length > start {
+			total += r.Start + r.Length - start
+		}
+		if r.Start+r.Length > end {
+			end = r.Start + r.Length
+		}
+	}
+	return total
+}
+
 func checkChownErr(err error, name string, uid, gid int) error {
 	if e, ok := err.(*os.PathError); ok && e.Err == syscall.EINVAL {
 		return errors.Wrapf(err, "potentially insufficient UIDs or GIDs available in user namespace (requested %d:%d for %s): Check /etc/subuid and /etc/subgid if configured locally", uid, gid, name)
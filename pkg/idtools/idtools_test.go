@@ -231,3 +231,67 @@ func TestIsContiguous(t *testing.T) {
 		t.Errorf("mappings %v expected to be contiguous", mappings)
 	}
 }
+
+type fakeSubIDSource struct {
+	subuid map[string][]IDRange
+	subgid map[string][]IDRange
+}
+
+func (f fakeSubIDSource) SubUIDRanges(username string) ([]IDRange, error) {
+	return f.subuid[username], nil
+}
+
+func (f fakeSubIDSource) SubGIDRanges(username string) ([]IDRange, error) {
+	return f.subgid[username], nil
+}
+
+func TestUserRangesFromSource(t *testing.T) {
+	source := fakeSubIDSource{
+		subuid: map[string][]IDRange{
+			"alice": {{Start: 200000, Length: 1000}, {Start: 100000, Length: 65536}},
+			"bob":   {{Start: 300000, Length: 65536}},
+		},
+		subgid: map[string][]IDRange{
+			"alice": {{Start: 100000, Length: 65536}},
+		},
+	}
+
+	subuid, subgid, err := UserRangesFromSource(source, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subuid) != 2 || subuid[0].Start != 100000 || subuid[1].Start != 200000 {
+		t.Errorf("unexpected subuid ranges %v", subuid)
+	}
+	if len(subgid) != 1 || subgid[0].Start != 100000 {
+		t.Errorf("unexpected subgid ranges %v", subgid)
+	}
+	if n := RangesCapacity(subuid); n != 66536 {
+		t.Errorf("expected a capacity of 66536 UIDs, got %d", n)
+	}
+
+	subuid, subgid, err = UserRangesFromSource(source, "carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subuid) != 0 || len(subgid) != 0 {
+		t.Errorf("unexpected ranges for a user without any: %v %v", subuid, subgid)
+	}
+}
+
+func TestRangesCapacity(t *testing.T) {
+	for _, c := range []struct {
+		ranges   []IDRange
+		capacity int
+	}{
+		{nil, 0},
+		{[]IDRange{{Start: 0, Length: 10}}, 10},
+		{[]IDRange{{Start: 0, Length: 10}, {Start: 5, Length: 10}}, 15},
+		{[]IDRange{{Start: 20, Length: 5}, {Start: 0, Length: 30}}, 30},
+		{[]IDRange{{Start: 0, Length: 10}, {Start: 100, Length: 10}, {Start: 50, Length: -1}}, 20},
+	} {
+		if n := RangesCapacity(c.ranges); n != c.capacity {
+			t.Errorf("capacity of %v: expected %d, got %d", c.ranges, c.capacity, n)
+		}
+	}
+}
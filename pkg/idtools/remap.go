@@ -0,0 +1,48 @@
+package idtools
+
+// RemapTreeOptions controls how RemapTreeWithOptions changes the ownership of
+// the files in a tree.
+type RemapTreeOptions struct {
+	// OldGIDMap and NewGIDMap, if either of them is set, are used to map
+	// GIDs, instead of the maps which are used to map UIDs.
+	OldGIDMap []IDMap
+	NewGIDMap []IDMap
+	// SkipUnmapped, if set, causes files whose owners can't be mapped to
+	// be left alone.  Otherwise, each of them is reported as an error.
+	SkipUnmapped bool
+	// Workers is the maximum number of files whose ownership is changed
+	// at the same time.  If it is not positive, the number of CPUs is
+	// used.
+	Workers int
+}
+
+// RemapTree changes the ownership of every file in the tree rooted at root,
+// including root itself, from the host IDs which oldMap maps container IDs
+// to, to the host IDs which newMap maps the same container IDs to.  The
+// same maps are used for UIDs and GIDs.  Files whose owners can't be mapped
+// are reported as errors.
+func RemapTree(root string, oldMap, newMap []IDMap) error {
+	return RemapTreeWithOptions(root, oldMap, newMap, nil)
+}
+
+// remapIDs maps an on-disk UID and GID from the host IDs of the old maps to
+// the host IDs of the new maps.
+func remapIDs(uid, gid int, oldUIDMap, newUIDMap, oldGIDMap, newGIDMap []IDMap) (int, int, error) {
+	contUID, err := toContainer(uid, oldUIDMap)
+	if err != nil {
+		return -1, -1, err
+	}
+	contGID, err := toContainer(gid, oldGIDMap)
+	if err != nil {
+		return -1, -1, err
+	}
+	newUID, err := toHost(contUID, newUIDMap)
+	if err != nil {
+		return -1, -1, err
+	}
+	newGID, err := toHost(contGID, newGIDMap)
+	if err != nil {
+		return -1, -1, err
+	}
+	return newUID, newGID, nil
+}
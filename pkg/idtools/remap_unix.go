@@ -0,0 +1,115 @@
+// +build !windows
+
+package idtools
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"syscall"
+
+	"github.com/containers/storage/pkg/system"
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+)
+
+// RemapTreeWithOptions is like RemapTree, with options controlling how
+// files whose owners can't be mapped are handled, how GIDs are mapped, and
+// how many files are changed at the same time.  Symbolic links are changed
+// themselves, and not followed.  Set-user-ID and set-group-ID bits, and
+// file capabilities, which are cleared when a file's owner changes, are
+// restored.  Every file is processed even if some of them fail, and the
+// returned error lists all of the failures.
+func RemapTreeWithOptions(root string, oldMap, newMap []IDMap, options *RemapTreeOptions) error {
+	if options == nil {
+		options = &RemapTreeOptions{}
+	}
+	oldGIDMap, newGIDMap := oldMap, newMap
+	if options.OldGIDMap != nil || options.NewGIDMap != nil {
+		oldGIDMap, newGIDMap = options.OldGIDMap, options.NewGIDMap
+	}
+	workers := options.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	type file struct {
+		path string
+		info os.FileInfo
+	}
+	files := make(chan file, workers)
+	var errs *multierror.Error
+	var errsLock sync.Mutex
+	addError := func(err error) {
+		errsLock.Lock()
+		errs = multierror.Append(errs, err)
+		errsLock.Unlock()
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range files {
+				if err := remapFile(f.path, f.info, oldMap, newMap, oldGIDMap, newGIDMap, options.SkipUnmapped); err != nil {
+					addError(err)
+				}
+			}
+		}()
+	}
+
+	walkErr := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			addError(err)
+			return nil
+		}
+		files <- file{path: path, info: info}
+		return nil
+	})
+	close(files)
+	wg.Wait()
+	if walkErr != nil {
+		addError(walkErr)
+	}
+	return errs.ErrorOrNil()
+}
+
+// remapFile changes the ownership of a single file for RemapTreeWithOptions.
+func remapFile(path string, info os.FileInfo, oldUIDMap, newUIDMap, oldGIDMap, newGIDMap []IDMap, skipUnmapped bool) error {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	uid, gid, err := remapIDs(int(st.Uid), int(st.Gid), oldUIDMap, newUIDMap, oldGIDMap, newGIDMap)
+	if err != nil {
+		if skipUnmapped {
+			return nil
+		}
+		return errors.Wrapf(err, "remapping the owner %d:%d of %q", st.Uid, st.Gid, path)
+	}
+	if uid == int(st.Uid) && gid == int(st.Gid) {
+		return nil
+	}
+
+	capability, err := system.Lgetxattr(path, "security.capability")
+	if err != nil && !errors.Is(err, system.EOPNOTSUPP) && err != system.ErrNotSupportedPlatform {
+		return errors.Wrapf(err, "reading the capabilities of %q", path)
+	}
+	if err := os.Lchown(path, uid, gid); err != nil {
+		return checkChownErr(err, path, uid, gid)
+	}
+	// Restore the set-user-ID and set-group-ID bits, which chown clears.
+	if info.Mode()&os.ModeSymlink == 0 && info.Mode()&(os.ModeSetuid|os.ModeSetgid) != 0 {
+		if err := os.Chmod(path, info.Mode()); err != nil {
+			return err
+		}
+	}
+	if capability != nil {
+		if err := system.Lsetxattr(path, "security.capability", capability, 0); err != nil {
+			return errors.Wrapf(err, "restoring the capabilities of %q", path)
+		}
+	}
+	return nil
+}
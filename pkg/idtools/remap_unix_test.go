@@ -0,0 +1,104 @@
+//go:build !windows
+// +build !windows
+
+package idtools
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func ownerOf(t *testing.T, info os.FileInfo) (int, int) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	require.True(t, ok)
+	return int(st.Uid), int(st.Gid)
+}
+
+func TestRemapTree(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("root required")
+	}
+	root, err := ioutil.TempDir("", "remaptree")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	oldMap := []IDMap{
+		{ContainerID: 0, HostID: 100000, Size: 1000},
+		{ContainerID: 1000, HostID: 200000, Size: 1000},
+	}
+	newMap := []IDMap{
+		{ContainerID: 0, HostID: 300000, Size: 10},
+		{ContainerID: 10, HostID: 400000, Size: 1990},
+	}
+
+	// owner in the container, expected owner after the remapping
+	tree := map[string]struct {
+		uid, gid, newUID, newGID int
+	}{
+		"dir":         {100000, 100000, 300000, 300000},
+		"dir/file":    {100005, 101000 - 1, 300005, 400000 + 989},
+		"dir/other":   {200000, 200010, 400000 + 990, 400000 + 1000},
+		"dir/symlink": {100010, 100011, 400000, 400001},
+		"setuid":      {100000, 100000, 300000, 300000},
+	}
+	require.NoError(t, os.Mkdir(filepath.Join(root, "dir"), 0755))
+	for _, name := range []string{"dir/file", "dir/other"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(root, name), nil, 0644))
+	}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "setuid"), nil, 0755))
+	require.NoError(t, os.Symlink("file", filepath.Join(root, "dir/symlink")))
+	require.NoError(t, os.Lchown(root, 100000, 100000))
+	for name, ids := range tree {
+		require.NoError(t, os.Lchown(filepath.Join(root, name), ids.uid, ids.gid))
+	}
+	require.NoError(t, os.Chmod(filepath.Join(root, "setuid"), 0755|os.ModeSetuid))
+
+	require.NoError(t, RemapTreeWithOptions(root, oldMap, newMap, &RemapTreeOptions{Workers: 2}))
+	for name, ids := range tree {
+		st, err := os.Lstat(filepath.Join(root, name))
+		require.NoError(t, err)
+		uid, gid := ownerOf(t, st)
+		assert.Equal(t, ids.newUID, uid, "UID of %s", name)
+		assert.Equal(t, ids.newGID, gid, "GID of %s", name)
+	}
+	st, err := os.Lstat(filepath.Join(root, "setuid"))
+	require.NoError(t, err)
+	assert.NotZero(t, st.Mode()&os.ModeSetuid, "the set-user-ID bit was not restored")
+
+	// A file which isn't in the old mapping is reported, unless it is
+	// skipped, and doesn't keep the others from being changed.
+	unmapped := filepath.Join(root, "unmapped")
+	require.NoError(t, ioutil.WriteFile(unmapped, nil, 0644))
+	require.NoError(t, os.Lchown(unmapped, 50, 50))
+	err = RemapTree(root, newMap, oldMap)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), unmapped)
+	st, err = os.Lstat(filepath.Join(root, "dir"))
+	require.NoError(t, err)
+	uid, gid := ownerOf(t, st)
+	assert.Equal(t, 100000, uid)
+	assert.Equal(t, 100000, gid)
+
+	require.NoError(t, RemapTreeWithOptions(root, oldMap, newMap, &RemapTreeOptions{SkipUnmapped: true}))
+	st, err = os.Lstat(unmapped)
+	require.NoError(t, err)
+	uid, gid = ownerOf(t, st)
+	assert.Equal(t, 50, uid)
+	assert.Equal(t, 50, gid)
+
+	// Separate maps for GIDs.
+	gidMap := []IDMap{{ContainerID: 0, HostID: 500000, Size: 2000}}
+	require.NoError(t, os.Lchown(unmapped, 300000, 500000))
+	require.NoError(t, RemapTreeWithOptions(unmapped, newMap, oldMap, &RemapTreeOptions{OldGIDMap: gidMap, NewGIDMap: oldMap}))
+	st, err = os.Lstat(unmapped)
+	require.NoError(t, err)
+	uid, gid = ownerOf(t, st)
+	assert.Equal(t, 100000, uid)
+	assert.Equal(t, 100000, gid)
+}
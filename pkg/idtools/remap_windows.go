@@ -0,0 +1,9 @@
+// +build windows
+
+package idtools
+
+// RemapTreeWithOptions is like RemapTree, with options.  Platforms such as
+// Windows do not support the UID/GID concept, so it does nothing.
+func RemapTreeWithOptions(root string, oldMap, newMap []IDMap, options *RemapTreeOptions) error {
+	return nil
+}
@@ -56,7 +56,13 @@ func NewAtomicFileWriter(filename string, perm os.FileMode) (io.WriteCloser, err
 
 // AtomicWriteFile atomically writes data to a file named by filename.
 func AtomicWriteFile(filename string, data []byte, perm os.FileMode) error {
-	f, err := NewAtomicFileWriter(filename, perm)
+	return AtomicWriteFileWithOpts(filename, data, perm, nil)
+}
+
+// AtomicWriteFileWithOpts atomically writes data to a file named by filename,
+// with the specified options.
+func AtomicWriteFileWithOpts(filename string, data []byte, perm os.FileMode, opts *AtomicFileWriterOptions) error {
+	f, err := NewAtomicFileWriterWithOpts(filename, perm, opts)
 	if err != nil {
 		return err
 	}
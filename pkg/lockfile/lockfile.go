@@ -68,6 +68,20 @@ func GetROLockfile(path string) (Locker, error) {
 	return getLockfile(path, true)
 }
 
+// GetReadOnlyView opens a read-write lock file, creating it if necessary, and
+// returns a Locker for it which can only be locked for reading.  Unlike one
+// returned by GetROLockfile, it can be used alongside the read-write Locker
+// for the same path in the current process, and it keeps its own record of
+// the last writer, so that its Modified() reports changes which were made
+// using that Locker.
+func GetReadOnlyView(path string) (Locker, error) {
+	locker, err := GetLockfile(path)
+	if err != nil {
+		return nil, err
+	}
+	return newReadOnlyView(locker), nil
+}
+
 // getLockfile returns a Locker object, possibly (depending on the platform)
 // working inter-process, and associated with the specified path.
 //
@@ -338,6 +338,50 @@ func TestLockfileTouch(t *testing.T) {
 	assert.True(t, m, "lock file failed to notice that someone else modified it")
 }
 
+func TestReadOnlyViewTouch(t *testing.T) {
+	l, err := getTempLockfile()
+	require.Nil(t, err, "error getting temporary lock file")
+	defer os.Remove(l.name)
+
+	v, err := GetReadOnlyView(l.name)
+	require.Nil(t, err, "error getting read-only view of lock file")
+	assert.False(t, v.IsReadWrite(), "read-only view claims to be read-write")
+
+	// Like the lock file itself, the view sees a new lock file as modified.
+	v.RLock()
+	m, err := v.Modified()
+	require.Nil(t, err, "got an error from Modified()")
+	assert.True(t, m, "new lock file does not appear to have changed")
+	assert.NotNil(t, v.Touch(), "read-only view allowed Touch()")
+	v.Unlock()
+
+	l.Lock()
+	require.Nil(t, l.Touch(), "got an error from Touch()")
+	l.Unlock()
+
+	// A change made through the read-write locker is seen by the view...
+	v.RLock()
+	m, err = v.Modified()
+	require.Nil(t, err, "got an error from Modified()")
+	assert.True(t, m, "read-only view failed to notice a change made in this process")
+	m, err = v.Modified()
+	require.Nil(t, err, "got an error from Modified()")
+	assert.False(t, m, "read-only view mistakenly reported a change twice")
+	v.Unlock()
+
+	// ...without hiding it from the read-write locker, or vice versa.
+	l.Lock()
+	m, err = l.Modified()
+	l.Unlock()
+	require.Nil(t, err, "got an error from Modified()")
+	assert.False(t, m, "lock file mistakenly indicated that someone else has modified it")
+
+	defer func() {
+		assert.NotNil(t, recover(), "Should have panicked trying to take a write lock using a read-only view")
+	}()
+	v.Lock()
+}
+
 func TestLockfileWriteConcurrent(t *testing.T) {
 	l, err := getTempLockfile()
 	require.Nil(t, err, "error getting temporary lock file")
@@ -260,3 +260,65 @@ func (l *lockfile) TouchedSince(when time.Time) bool {
 	touched := time.Unix(mtim.Unix())
 	return when.Before(touched)
 }
+
+// readOnlyView is a Locker which shares the locking of a read-write lockfile,
+// but which can only be locked for reading, and which tracks the last writer
+// separately.
+type readOnlyView struct {
+	*lockfile
+	lw string
+}
+
+func newReadOnlyView(locker Locker) Locker {
+	l, ok := locker.(*lockfile)
+	if !ok {
+		panic(fmt.Sprintf("unexpected locker type %T", locker))
+	}
+	l.stateMutex.Lock()
+	defer l.stateMutex.Unlock()
+	return &readOnlyView{lockfile: l, lw: l.lw}
+}
+
+// Lock panics, since the view is read-only.
+func (v *readOnlyView) Lock() {
+	panic("can't take write lock on read-only lock file")
+}
+
+// RecursiveLock locks the lockfile as a reader, as it does for other
+// read-only lock files.
+func (v *readOnlyView) RecursiveLock() {
+	v.lockfile.RLock()
+}
+
+// Touch returns an error, since the view is read-only.
+func (v *readOnlyView) Touch() error {
+	return errors.Errorf("can't update read-only lock file %q", v.file)
+}
+
+// Modified indicates if the lockfile has been updated since the last time it
+// was loaded using the view.
+func (v *readOnlyView) Modified() (bool, error) {
+	l := v.lockfile
+	l.stateMutex.Lock()
+	defer l.stateMutex.Unlock()
+	if !l.locked {
+		panic("attempted to check last-writer in lockfile without locking it first")
+	}
+	id := []byte(v.lw)
+	n, err := unix.Pread(int(l.fd), id, 0)
+	if err != nil {
+		return true, err
+	}
+	if n != len(id) {
+		return true, nil
+	}
+	lw := v.lw
+	v.lw = string(id)
+	return v.lw != lw, nil
+}
+
+// IsReadWrite indicates if the lock file is a read-write lock, which the
+// view never is.
+func (v *readOnlyView) IsReadWrite() bool {
+	return false
+}
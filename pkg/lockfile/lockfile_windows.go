@@ -73,3 +73,9 @@ func (l *lockfile) TouchedSince(when time.Time) bool {
 	}
 	return when.Before(stat.ModTime())
 }
+
+// newReadOnlyView returns the locker itself, since lock files are never
+// read-write here.
+func newReadOnlyView(locker Locker) Locker {
+	return locker
+}
@@ -3,3 +3,5 @@ package mount
 import "github.com/moby/sys/mountinfo"
 
 var PidMountInfo = mountinfo.PidMountInfo
+
+var GetMountsFromReader = mountinfo.GetMountsFromReader
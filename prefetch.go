@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// errPrefetchLimit stops the walk of a mounted layer when the limit of the
+// data to read ahead is reached, or when the read ahead is stopped.
+var errPrefetchLimit = errors.New("prefetch limit reached")
+
+// mountPrefetchLimit is the number of bytes which are read ahead at most
+// when a layer is mounted with the PrefetchOnMount option, so that mounting
+// a big image doesn't flood the disk with reads which may not be needed.
+var mountPrefetchLimit int64 = 64 << 20
+
+// prefetchFile asks for the first length bytes of f to be read into the
+// page cache.  It can be replaced by tests.
+var prefetchFile = readAhead
+
+// layerPrefetch is a read ahead of the files of a mounted layer which is
+// running in the background.
+type layerPrefetch struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// prefetchMountedLayer starts reading ahead, in the background, the files of
+// the layer with the specified ID, which was just mounted at mountPoint, if
+// it is its first mount.  The files listed in the prefetch lists of the
+// chunked manifests of the layer and of its parents are read first, and only
+// them if there are any; otherwise all of the files are read, in the order
+// in which they are found.  The read ahead is stopped by stopPrefetch.  The
+// caller must hold the layer store's lock.
+func (s *store) prefetchMountedLayer(rlstore LayerStore, id, mountPoint string) {
+	if mounted, err := rlstore.Mounted(id); err != nil || mounted != 1 {
+		return
+	}
+	names := layerPrefetchList(rlstore, id)
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &layerPrefetch{cancel: cancel, done: make(chan struct{})}
+
+	s.prefetchLock.Lock()
+	if s.prefetches == nil {
+		s.prefetches = make(map[string]*layerPrefetch)
+	}
+	if old, ok := s.prefetches[id]; ok {
+		// the layer was unmounted by someone else
+		old.cancel()
+	}
+	s.prefetches[id] = p
+	s.prefetchLock.Unlock()
+
+	go func() {
+		defer close(p.done)
+		prefetchMount(ctx, mountPoint, names, mountPrefetchLimit)
+		s.prefetchLock.Lock()
+		if s.prefetches[id] == p {
+			delete(s.prefetches, id)
+		}
+		s.prefetchLock.Unlock()
+		cancel()
+	}()
+}
+
+// stopPrefetch stops the read ahead of the files of the layer with the
+// specified ID, if one is running, and waits for it to finish, so that it
+// doesn't keep files open under the layer's mount point while it is being
+// unmounted.
+func (s *store) stopPrefetch(id string) {
+	s.prefetchLock.Lock()
+	p, ok := s.prefetches[id]
+	delete(s.prefetches, id)
+	s.prefetchLock.Unlock()
+	if ok {
+		p.cancel()
+		<-p.done
+	}
+}
+
+// stopAllPrefetches stops all of the read aheads which are running, and
+// waits for them to finish.
+func (s *store) stopAllPrefetches() {
+	s.prefetchLock.Lock()
+	prefetches := s.prefetches
+	s.prefetches = nil
+	s.prefetchLock.Unlock()
+	for _, p := range prefetches {
+		p.cancel()
+	}
+	for _, p := range prefetches {
+		<-p.done
+	}
+}
+
+// layerPrefetchList returns the names listed in the prefetch lists of the
+// chunked manifests of the layer with the specified ID and of its parents,
+// without duplicates.
+func layerPrefetchList(rlstore LayerStore, id string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for id != "" {
+		layer, err := rlstore.Get(id)
+		if err != nil {
+			break
+		}
+		id = layer.Parent
+		rc, err := rlstore.BigData(layer.ID, chunkedManifestBigDataKey)
+		if err != nil {
+			continue
+		}
+		var toc struct {
+			Prefetch []string `json:"prefetch,omitempty"`
+		}
+		err = json.NewDecoder(rc).Decode(&toc)
+		rc.Close()
+		if err != nil {
+			logrus.Debugf("Parsing the chunked manifest of layer %q: %v", layer.ID, err)
+			continue
+		}
+		for _, name := range toc.Prefetch {
+			name = filepath.Clean("/" + name)
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// prefetchMount reads ahead the files with the specified names under
+// mountPoint, or all of its files if names is empty, until limit bytes
+// were requested or ctx is cancelled.  Errors are only logged, since the
+// files are read again when they are used.
+func prefetchMount(ctx context.Context, mountPoint string, names []string, limit int64) {
+	prefetch := func(path string, size int64) bool {
+		if ctx.Err() != nil {
+			return false
+		}
+		if size > limit {
+			size = limit
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			logrus.Debugf("Prefetching %q: %v", path, err)
+			return true
+		}
+		defer f.Close()
+		if err := prefetchFile(f, size); err != nil {
+			logrus.Debugf("Prefetching %q: %v", path, err)
+		}
+		limit -= size
+		return limit > 0
+	}
+
+	if len(names) > 0 {
+		for _, name := range names {
+			path := filepath.Join(mountPoint, name)
+			st, err := os.Lstat(path)
+			if err != nil || !st.Mode().IsRegular() || st.Size() == 0 {
+				continue
+			}
+			if !prefetch(path, st.Size()) {
+				return
+			}
+		}
+		return
+	}
+
+	err := filepath.Walk(mountPoint, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || info.Size() == 0 {
+			return nil
+		}
+		if !prefetch(path, info.Size()) {
+			return errPrefetchLimit
+		}
+		return nil
+	})
+	if err != nil && err != errPrefetchLimit {
+		logrus.Debugf("Prefetching the files under %q: %v", mountPoint, err)
+	}
+}
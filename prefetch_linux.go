@@ -0,0 +1,13 @@
+package storage
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// readAhead asks the kernel to start reading the first length bytes of f
+// into the page cache, without waiting for them.
+func readAhead(f *os.File, length int64) error {
+	return unix.Fadvise(int(f.Fd()), 0, length, unix.FADV_WILLNEED)
+}
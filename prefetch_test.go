@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// prefetchRecorder replaces prefetchFile, and records the files which are
+// read ahead, relative to the mount point, with the number of bytes asked.
+type prefetchRecorder struct {
+	lock  sync.Mutex
+	files map[string]int64
+}
+
+func newPrefetchRecorder(t *testing.T, limit int64) *prefetchRecorder {
+	r := &prefetchRecorder{files: make(map[string]int64)}
+	oldPrefetchFile, oldLimit := prefetchFile, mountPrefetchLimit
+	t.Cleanup(func() {
+		prefetchFile, mountPrefetchLimit = oldPrefetchFile, oldLimit
+	})
+	prefetchFile = func(f *os.File, length int64) error {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		r.files[filepath.Base(f.Name())] = length
+		return nil
+	}
+	mountPrefetchLimit = limit
+	return r
+}
+
+// wait returns the files read ahead once there are n of them.
+func (r *prefetchRecorder) wait(t *testing.T, n int) map[string]int64 {
+	var files map[string]int64
+	require.Eventually(t, func() bool {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		files = make(map[string]int64)
+		for name, length := range r.files {
+			files[name] = length
+		}
+		return len(files) >= n
+	}, 5*time.Second, 10*time.Millisecond)
+	return files
+}
+
+// withPrefetchOnMount is a newTestStore modifier which turns on PrefetchOnMount.
+func withPrefetchOnMount(options *StoreOptions) {
+	options.PrefetchOnMount = true
+}
+
+func TestPrefetchOnMount(t *testing.T) {
+	recorder := newPrefetchRecorder(t, 25)
+	s := newTestStore(t, withPrefetchOnMount)
+
+	layer, _, err := s.PutLayer("", "", nil, "", false, nil, makeTestLayerTar(t, map[string]string{
+		"a":     strings.Repeat("a", 10),
+		"b":     strings.Repeat("b", 10),
+		"c":     strings.Repeat("c", 10),
+		"empty": "",
+	}))
+	require.NoError(t, err)
+	_, err = s.Mount(layer.ID, "")
+	require.NoError(t, err)
+	defer s.Unmount(layer.ID, true)
+
+	// the files are read ahead until the limit is reached
+	files := recorder.wait(t, 3)
+	assert.Equal(t, map[string]int64{"a": 10, "b": 10, "c": 5}, files)
+
+	// only the first mount triggers a read ahead
+	recorder.lock.Lock()
+	recorder.files = make(map[string]int64)
+	recorder.lock.Unlock()
+	_, err = s.Mount(layer.ID, "")
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, recorder.wait(t, 0))
+}
+
+func TestPrefetchOnMountManifest(t *testing.T) {
+	recorder := newPrefetchRecorder(t, mountPrefetchLimit)
+	s := newTestStore(t, withPrefetchOnMount)
+
+	base, _, err := s.PutLayer("", "", nil, "", false, nil, makeTestLayerTar(t, map[string]string{
+		"base-listed": "listed",
+		"base-other":  "other",
+	}))
+	require.NoError(t, err)
+	require.NoError(t, s.SetLayerBigData(base.ID, chunkedManifestBigDataKey, strings.NewReader(`{"version":1,"entries":[],"prefetch":["base-listed"]}`)))
+	top, _, err := s.PutLayer("", base.ID, nil, "", false, nil, makeTestLayerTar(t, map[string]string{
+		"top-listed": "listed",
+		"top-other":  "other",
+	}))
+	require.NoError(t, err)
+	require.NoError(t, s.SetLayerBigData(top.ID, chunkedManifestBigDataKey, strings.NewReader(`{"version":1,"entries":[],"prefetch":["./top-listed","missing"]}`)))
+
+	// only the files in the prefetch lists are read ahead
+	_, err = s.Mount(top.ID, "")
+	require.NoError(t, err)
+	defer s.Unmount(top.ID, true)
+	files := recorder.wait(t, 2)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, map[string]int64{"top-listed": 6, "base-listed": 6}, recorder.wait(t, len(files)))
+}
+
+func TestPrefetchOnMountDisabled(t *testing.T) {
+	recorder := newPrefetchRecorder(t, mountPrefetchLimit)
+	s := newTestStore(t)
+
+	layer, _, err := s.PutLayer("", "", nil, "", false, nil, makeTestLayerTar(t, map[string]string{"a": "a"}))
+	require.NoError(t, err)
+	_, err = s.Mount(layer.ID, "")
+	require.NoError(t, err)
+	defer s.Unmount(layer.ID, true)
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, recorder.wait(t, 0))
+}
+
+func TestPrefetchStoppedByUnmount(t *testing.T) {
+	newPrefetchRecorder(t, mountPrefetchLimit)
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	var lock sync.Mutex
+	var prefetched []string
+	prefetchFile = func(f *os.File, length int64) error {
+		lock.Lock()
+		prefetched = append(prefetched, filepath.Base(f.Name()))
+		lock.Unlock()
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		return nil
+	}
+	s := newTestStore(t, withPrefetchOnMount)
+
+	layer, _, err := s.PutLayer("", "", nil, "", false, nil, makeTestLayerTar(t, map[string]string{
+		"a": "a",
+		"b": "b",
+		"c": "c",
+	}))
+	require.NoError(t, err)
+	_, err = s.Mount(layer.ID, "")
+	require.NoError(t, err)
+	<-started
+
+	// the read ahead is waited for, and doesn't go on after the unmount
+	unmounted := make(chan error)
+	go func() {
+		_, err := s.Unmount(layer.ID, false)
+		unmounted <- err
+	}()
+	select {
+	case err := <-unmounted:
+		t.Fatalf("Unmount didn't wait for the read ahead: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	require.NoError(t, <-unmounted)
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Len(t, prefetched, 1)
+}
@@ -0,0 +1,19 @@
+// +build !linux
+
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// readAhead reads the first length bytes of f, so that they are in the page
+// cache when they are read again.
+func readAhead(f *os.File, length int64) error {
+	_, err := io.CopyN(ioutil.Discard, f, length)
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
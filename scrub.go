@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultScrubInterval is the time between the starts of the passes of a
+// Scrubber when ScrubOptions.Interval is not set.
+const DefaultScrubInterval = 24 * time.Hour
+
+// ScrubOptions is used for passing options to a Store's StartScrub() method.
+type ScrubOptions struct {
+	PassOptions
+	// Coverage is the fraction, between 0 and 1, of the layers which are
+	// verified in each pass, the ones which were verified the least
+	// recently first, so that all of them are verified every 1/Coverage
+	// passes.  At least one layer is verified in each pass.  If not set,
+	// all of the layers are verified in each pass.
+	Coverage float64
+	// BytesPerSecond, if set, limits the rate at which the contents of
+	// layers are read: after verifying a layer, the scrubber waits until
+	// the time it would have taken to read the layer's contents at that
+	// rate has passed.
+	BytesPerSecond int64
+	// OnCorruption, if set, is called with the ID of each layer whose
+	// contents don't match its recorded checksums, and with the error,
+	// which wraps ErrLayerCorrupted, returned by VerifyLayer.  If not set,
+	// the error is logged.
+	OnCorruption func(id string, err error)
+}
+
+// Scrubber verifies the contents of a store's layers in the background.  It
+// is started by a Store's StartScrub() method.
+type Scrubber struct {
+	store        *store
+	options      ScrubOptions
+	lastVerified map[string]time.Time
+	passes       *backgroundPasses
+}
+
+// StartScrub starts verifying the contents of the layers in the read-write
+// layer store in the background, with VerifyLayer, a share of them in each
+// pass.  The layer store is only locked while a layer is verified, so that
+// other operations can proceed between layers.  Layers for which no
+// checksums were recorded are skipped.
+func (s *store) StartScrub(options ScrubOptions) (*Scrubber, error) {
+	if options.Coverage < 0 || options.Coverage > 1 {
+		return nil, errors.Errorf("scrub coverage %v is not between 0 and 1", options.Coverage)
+	}
+	if options.BytesPerSecond < 0 {
+		return nil, errors.Errorf("invalid scrub rate %d", options.BytesPerSecond)
+	}
+	if err := options.setDefaults(DefaultScrubInterval); err != nil {
+		return nil, errors.Wrap(err, "scrub")
+	}
+	if options.Coverage == 0 {
+		options.Coverage = 1
+	}
+	if _, err := s.LayerStore(); err != nil {
+		return nil, err
+	}
+	sc := &Scrubber{
+		store:        s,
+		options:      options,
+		lastVerified: make(map[string]time.Time),
+		passes:       newBackgroundPasses(),
+	}
+	go sc.passes.run(options.PassOptions, "Scrubbing layers", sc.pass)
+	return sc, nil
+}
+
+// Stop stops the scrubber, along with the verification of the layer which is
+// being verified, if there is one, and waits for them to end.
+func (sc *Scrubber) Stop() {
+	sc.passes.Stop()
+}
+
+// pass verifies the share of the layers which were verified the least
+// recently, and returns the IDs of the ones it verified.
+func (sc *Scrubber) pass() ([]string, error) {
+	layers, err := sc.layers()
+	if err != nil {
+		return nil, err
+	}
+	count := int(math.Ceil(sc.options.Coverage * float64(len(layers))))
+	if count > len(layers) {
+		count = len(layers)
+	}
+
+	var verified []string
+	for _, layer := range layers[:count] {
+		if !sc.passes.wait(0) {
+			break
+		}
+		start := time.Now()
+		err := sc.store.verifyLayer(layer.ID, sc.passes.stop)
+		if errors.Is(err, errVerificationStopped) {
+			break
+		}
+		sc.lastVerified[layer.ID] = time.Now()
+		switch {
+		case err == nil:
+			verified = append(verified, layer.ID)
+		case errors.Is(err, ErrLayerCorrupted):
+			verified = append(verified, layer.ID)
+			if sc.options.OnCorruption != nil {
+				sc.options.OnCorruption(layer.ID, err)
+			} else {
+				logrus.Errorf("Scrubbing layer %q: %v", layer.ID, err)
+			}
+		case errors.Is(err, ErrNotSupported), errors.Is(err, ErrLayerUnknown):
+			logrus.Debugf("Not scrubbing layer %q: %v", layer.ID, err)
+			continue
+		default:
+			logrus.Warnf("Scrubbing layer %q: %v", layer.ID, err)
+			continue
+		}
+		if sc.options.BytesPerSecond > 0 && layer.UncompressedSize > 0 {
+			readTime := time.Duration(float64(layer.UncompressedSize) / float64(sc.options.BytesPerSecond) * float64(time.Second))
+			if !sc.passes.wait(readTime - time.Since(start)) {
+				break
+			}
+		}
+	}
+	return verified, nil
+}
+
+// layers returns the layers of the read-write layer store, sorted by the
+// time of their last verification, the ones which were never verified
+// first, and forgets the times of the layers which no longer exist.
+func (sc *Scrubber) layers() ([]Layer, error) {
+	rlstore, err := sc.store.LayerStore()
+	if err != nil {
+		return nil, err
+	}
+	rlstore.RLock()
+	defer rlstore.Unlock()
+	if err := rlstore.ReloadIfChanged(); err != nil {
+		return nil, err
+	}
+	layers, err := rlstore.Layers()
+	if err != nil {
+		return nil, err
+	}
+
+	exists := make(map[string]bool, len(layers))
+	for _, layer := range layers {
+		exists[layer.ID] = true
+	}
+	for id := range sc.lastVerified {
+		if !exists[id] {
+			delete(sc.lastVerified, id)
+		}
+	}
+	sort.SliceStable(layers, func(i, j int) bool {
+		return sc.lastVerified[layers[i].ID].Before(sc.lastVerified[layers[j].ID])
+	})
+	return layers, nil
+}
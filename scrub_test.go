@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// scrubRecorder collects what a Scrubber reports.
+type scrubRecorder struct {
+	lock      sync.Mutex
+	passes    [][]string
+	corrupted map[string]int
+	passDone  chan struct{}
+}
+
+func newScrubRecorder() *scrubRecorder {
+	return &scrubRecorder{
+		corrupted: make(map[string]int),
+		passDone:  make(chan struct{}, 100),
+	}
+}
+
+func (r *scrubRecorder) options(coverage float64) ScrubOptions {
+	return ScrubOptions{
+		PassOptions: PassOptions{
+			Interval: time.Millisecond,
+			OnPassDone: func(verified []string) {
+				r.lock.Lock()
+				r.passes = append(r.passes, verified)
+				r.lock.Unlock()
+				r.passDone <- struct{}{}
+			},
+		},
+		Coverage: coverage,
+		OnCorruption: func(id string, err error) {
+			r.lock.Lock()
+			defer r.lock.Unlock()
+			if errors.Is(err, ErrLayerCorrupted) {
+				r.corrupted[id] = len(r.passes) + 1
+			}
+		},
+	}
+}
+
+func (r *scrubRecorder) waitPasses(t *testing.T, n int) {
+	for i := 0; i < n; i++ {
+		select {
+		case <-r.passDone:
+		case <-time.After(time.Minute):
+			t.Fatal("timed out waiting for a scrubbing pass")
+		}
+	}
+}
+
+func TestScrub(t *testing.T) {
+	s := newTestStore(t)
+
+	var layers []string
+	for i := 0; i < 4; i++ {
+		layer, _, err := s.PutLayer("", "", nil, "", false, nil, makeTestLayerTar(t, map[string]string{
+			"file": fmt.Sprintf("contents %d", i),
+		}))
+		require.NoError(t, err)
+		layers = append(layers, layer.ID)
+	}
+
+	// a layer without checksums is skipped
+	empty, err := s.CreateLayer("", "", nil, "", true, nil)
+	require.NoError(t, err)
+
+	corrupt := layers[2]
+	mountPoint, err := s.Mount(corrupt, "")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(mountPoint, "file"), []byte("damaged"), 0644))
+	_, err = s.Unmount(corrupt, true)
+	require.NoError(t, err)
+
+	_, err = s.StartScrub(ScrubOptions{Coverage: 2})
+	assert.Error(t, err)
+
+	// with full coverage, the first pass finds it
+	recorder := newScrubRecorder()
+	scrubber, err := s.StartScrub(recorder.options(0))
+	require.NoError(t, err)
+	recorder.waitPasses(t, 1)
+	scrubber.Stop()
+	recorder.lock.Lock()
+	assert.Equal(t, map[string]int{corrupt: 1}, recorder.corrupted)
+	assert.ElementsMatch(t, layers, recorder.passes[0])
+	assert.NotContains(t, recorder.passes[0], empty.ID)
+	recorder.lock.Unlock()
+
+	// with one of the five layers in each pass, it is found within the
+	// first five passes, in which each layer is picked once
+	recorder = newScrubRecorder()
+	scrubber, err = s.StartScrub(recorder.options(0.2))
+	require.NoError(t, err)
+	recorder.waitPasses(t, 5)
+	scrubber.Stop()
+	recorder.lock.Lock()
+	require.Contains(t, recorder.corrupted, corrupt)
+	assert.LessOrEqual(t, recorder.corrupted[corrupt], 5)
+	var verified []string
+	for _, pass := range recorder.passes[:5] {
+		assert.LessOrEqual(t, len(pass), 1)
+		verified = append(verified, pass...)
+	}
+	assert.ElementsMatch(t, layers, verified)
+	recorder.lock.Unlock()
+
+	// the store can be used while a scrubber waits
+	recorder = newScrubRecorder()
+	options := recorder.options(0)
+	options.BytesPerSecond = 1
+	scrubber, err = s.StartScrub(options)
+	require.NoError(t, err)
+	_, _, err = s.PutLayer("", "", nil, "", false, nil, makeTestLayerTar(t, map[string]string{"file": "more"}))
+	require.NoError(t, err)
+	stopped := make(chan struct{})
+	go func() {
+		scrubber.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Minute):
+		t.Fatal("the scrubber didn't stop")
+	}
+
+	// the verification of a layer ends when the scrubber is stopped
+	stop := make(chan struct{})
+	close(stop)
+	err = s.(*store).verifyLayer(layers[0], stop)
+	assert.True(t, errors.Is(err, errVerificationStopped), "unexpected error %v", err)
+	err = s.(*store).verifyLayer(corrupt, stop)
+	assert.True(t, errors.Is(err, errVerificationStopped), "unexpected error %v", err)
+}
@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultSizeMonitorInterval is the time between the starts of the passes of
+// a SizeMonitor when SizeMonitorOptions.Interval is not set.
+const DefaultSizeMonitorInterval = 10 * time.Second
+
+// SizeMonitorOptions is used for passing options to a Store's
+// StartSizeMonitor() method.
+type SizeMonitorOptions struct {
+	PassOptions
+	// OnExceeded, if set, is called with the ID of each container whose
+	// layer was found to be bigger than its limit, with the layer's size,
+	// and with the limit.  It isn't called again for the same container
+	// until its layer was found to be within its limit again.  If not
+	// set, the containers are logged.
+	OnExceeded func(id string, size, limit int64)
+}
+
+// SizeMonitor measures the layers of a store's containers in the background.
+// It is started by a Store's StartSizeMonitor() method.
+type SizeMonitor struct {
+	store    *store
+	options  SizeMonitorOptions
+	exceeded map[string]bool
+	passes   *backgroundPasses
+}
+
+// withSizeLimit returns a copy of flags which records that a container's
+// layer may grow to limit bytes.
+func withSizeLimit(flags map[string]interface{}, limit int64) map[string]interface{} {
+	result := make(map[string]interface{}, len(flags)+1)
+	for k, v := range flags {
+		result[k] = v
+	}
+	// as a string, since numbers are read back as float64
+	result[sizeLimitFlag] = strconv.FormatInt(limit, 10)
+	return result
+}
+
+// layerSizeLimit returns the size limit of a container's layer, or 0 if it
+// has none.
+func layerSizeLimit(layer *Layer) int64 {
+	value, ok := layer.Flags[sizeLimitFlag].(string)
+	if !ok {
+		return 0
+	}
+	limit, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return limit
+}
+
+// checkSizeLimit returns an error which wraps ErrContainerSizeLimitExceeded
+// if the layer has grown past its size limit.  The caller must hold a lock
+// on the layer store.
+func checkSizeLimit(rlstore LayerStore, id string) error {
+	layer, err := rlstore.Get(id)
+	if err != nil {
+		return err
+	}
+	limit := layerSizeLimit(layer)
+	if limit == 0 {
+		return nil
+	}
+	size, err := rlstore.DiffSize("", layer.ID)
+	if err != nil {
+		return errors.Wrapf(err, "error determining size of layer with ID %q", layer.ID)
+	}
+	if size > limit {
+		return errors.Wrapf(ErrContainerSizeLimitExceeded, "layer %q is %d bytes long, more than its limit of %d", layer.ID, size, limit)
+	}
+	return nil
+}
+
+func (s *store) SetContainerSizeLimit(id string, limit int64) error {
+	if limit < 0 {
+		return errors.Errorf("invalid container size limit %d", limit)
+	}
+	rlstore, err := s.LayerStore()
+	if err != nil {
+		return err
+	}
+	rcstore, err := s.ContainerStore()
+	if err != nil {
+		return err
+	}
+	rlstore.Lock()
+	defer rlstore.Unlock()
+	if err := rlstore.ReloadIfChanged(); err != nil {
+		return err
+	}
+	rcstore.RLock()
+	defer rcstore.Unlock()
+	if err := rcstore.ReloadIfChanged(); err != nil {
+		return err
+	}
+	container, err := rcstore.Get(id)
+	if err != nil {
+		return err
+	}
+	if limit == 0 {
+		return rlstore.ClearFlag(container.LayerID, sizeLimitFlag)
+	}
+	return rlstore.SetFlag(container.LayerID, sizeLimitFlag, strconv.FormatInt(limit, 10))
+}
+
+// StartSizeMonitor starts measuring the layers of the containers which have
+// size limits in the background, all of them in each pass.  The layer store
+// is only locked while a layer is measured, so that other operations can
+// proceed between layers.
+func (s *store) StartSizeMonitor(options SizeMonitorOptions) (*SizeMonitor, error) {
+	if err := options.setDefaults(DefaultSizeMonitorInterval); err != nil {
+		return nil, errors.Wrap(err, "size monitor")
+	}
+	if _, err := s.LayerStore(); err != nil {
+		return nil, err
+	}
+	if _, err := s.ContainerStore(); err != nil {
+		return nil, err
+	}
+	m := &SizeMonitor{
+		store:    s,
+		options:  options,
+		exceeded: make(map[string]bool),
+		passes:   newBackgroundPasses(),
+	}
+	go m.passes.run(options.PassOptions, "Monitoring the sizes of containers", m.pass)
+	return m, nil
+}
+
+// Stop stops the monitor, and waits for the measurement of the layer which
+// is being measured, if there is one, to end.
+func (m *SizeMonitor) Stop() {
+	m.passes.Stop()
+}
+
+// pass measures the layers of the containers which have size limits, and
+// returns the IDs of the containers whose layers it measured.
+func (m *SizeMonitor) pass() ([]string, error) {
+	containers, err := m.store.Containers()
+	if err != nil {
+		return nil, err
+	}
+	exists := make(map[string]bool, len(containers))
+	var measured []string
+	for _, container := range containers {
+		exists[container.ID] = true
+		if !m.passes.wait(0) {
+			break
+		}
+		size, limit, err := m.measure(container.LayerID)
+		if err != nil {
+			if errors.Is(err, ErrLayerUnknown) {
+				logrus.Debugf("Not measuring the layer of container %q: %v", container.ID, err)
+			} else {
+				logrus.Warnf("Measuring the layer of container %q: %v", container.ID, err)
+			}
+			continue
+		}
+		if limit == 0 {
+			delete(m.exceeded, container.ID)
+			continue
+		}
+		measured = append(measured, container.ID)
+		if size <= limit {
+			delete(m.exceeded, container.ID)
+			continue
+		}
+		if m.exceeded[container.ID] {
+			continue
+		}
+		m.exceeded[container.ID] = true
+		if m.options.OnExceeded != nil {
+			m.options.OnExceeded(container.ID, size, limit)
+		} else {
+			logrus.Warnf("The layer of container %q is %d bytes long, more than its limit of %d", container.ID, size, limit)
+		}
+	}
+	for id := range m.exceeded {
+		if !exists[id] {
+			delete(m.exceeded, id)
+		}
+	}
+	return measured, nil
+}
+
+// measure returns the size of a container's layer and its limit, or a limit
+// of 0 if it has none, in which case it isn't measured.
+func (m *SizeMonitor) measure(id string) (int64, int64, error) {
+	rlstore, err := m.store.LayerStore()
+	if err != nil {
+		return -1, -1, err
+	}
+	rlstore.RLock()
+	defer rlstore.Unlock()
+	if err := rlstore.ReloadIfChanged(); err != nil {
+		return -1, -1, err
+	}
+	layer, err := rlstore.Get(id)
+	if err != nil {
+		return -1, -1, err
+	}
+	limit := layerSizeLimit(layer)
+	if limit == 0 {
+		return -1, 0, nil
+	}
+	size, err := rlstore.DiffSize("", layer.ID)
+	if err != nil {
+		return -1, -1, err
+	}
+	return size, limit, nil
+}
@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContainerSizeLimit(t *testing.T) {
+	store := newTestStore(t)
+
+	layer, _, err := store.PutLayer("", "", nil, "", false, nil, makeTestLayerTar(t, map[string]string{"base": "base"}))
+	require.NoError(t, err)
+	image, err := store.CreateImage("", nil, layer.ID, "", nil)
+	require.NoError(t, err)
+	_, err = store.CreateContainer("", nil, image.ID, "", "", &ContainerOptions{SizeLimit: -1})
+	require.Error(t, err)
+	container, err := store.CreateContainer("", nil, image.ID, "", "", &ContainerOptions{SizeLimit: 1000})
+	require.NoError(t, err)
+
+	// writes within the limit succeed
+	_, err = store.ApplyDiff(container.LayerID, makeTestLayerTar(t, map[string]string{"small": strings.Repeat("a", 100)}))
+	require.NoError(t, err)
+
+	// the write which goes past it is reported
+	_, err = store.ApplyDiff(container.LayerID, makeTestLayerTar(t, map[string]string{"big": strings.Repeat("b", 2000)}))
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrContainerSizeLimitExceeded), "%v", err)
+
+	// and so are the next ones, until the limit is raised or removed
+	_, err = store.ApplyDiff(container.LayerID, makeTestLayerTar(t, map[string]string{"other": "c"}))
+	assert.True(t, errors.Is(err, ErrContainerSizeLimitExceeded), "%v", err)
+	require.NoError(t, store.SetContainerSizeLimit(container.ID, 10000))
+	_, err = store.ApplyDiff(container.LayerID, makeTestLayerTar(t, map[string]string{"other": "c"}))
+	require.NoError(t, err)
+	require.NoError(t, store.SetContainerSizeLimit(container.ID, 0))
+	_, err = store.ApplyDiff(container.LayerID, makeTestLayerTar(t, map[string]string{"huge": strings.Repeat("d", 20000)}))
+	require.NoError(t, err)
+
+	require.Error(t, store.SetContainerSizeLimit(container.ID, -1))
+	require.Error(t, store.SetContainerSizeLimit("no-such-container", 1000))
+}
+
+// sizeMonitorRecorder collects what a SizeMonitor reports.
+type sizeMonitorRecorder struct {
+	lock     sync.Mutex
+	passes   [][]string
+	exceeded map[string][]int64
+	passDone chan struct{}
+}
+
+func newSizeMonitorRecorder() *sizeMonitorRecorder {
+	return &sizeMonitorRecorder{
+		exceeded: make(map[string][]int64),
+		passDone: make(chan struct{}, 100),
+	}
+}
+
+func (r *sizeMonitorRecorder) options() SizeMonitorOptions {
+	return SizeMonitorOptions{
+		PassOptions: PassOptions{
+			Interval: time.Millisecond,
+			OnPassDone: func(measured []string) {
+				r.lock.Lock()
+				r.passes = append(r.passes, measured)
+				r.lock.Unlock()
+				select {
+				case r.passDone <- struct{}{}:
+				default:
+				}
+			},
+		},
+		OnExceeded: func(id string, size, limit int64) {
+			r.lock.Lock()
+			defer r.lock.Unlock()
+			if size > limit {
+				r.exceeded[id] = append(r.exceeded[id], size)
+			}
+		},
+	}
+}
+
+// waitPasses waits for n passes to end after the one in progress, if there
+// is one, so that the last one started after the call.
+func (r *sizeMonitorRecorder) waitPasses(t *testing.T, n int) {
+	for len(r.passDone) > 0 {
+		<-r.passDone
+	}
+	for i := 0; i < n+1; i++ {
+		select {
+		case <-r.passDone:
+		case <-time.After(time.Minute):
+			t.Fatal("timed out waiting for a size monitoring pass")
+		}
+	}
+}
+
+func (r *sizeMonitorRecorder) exceededSizes(id string) []int64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]int64(nil), r.exceeded[id]...)
+}
+
+func TestSizeMonitor(t *testing.T) {
+	store := newTestStore(t)
+
+	layer, _, err := store.PutLayer("", "", nil, "", false, nil, makeTestLayerTar(t, map[string]string{"base": "base"}))
+	require.NoError(t, err)
+	image, err := store.CreateImage("", nil, layer.ID, "", nil)
+	require.NoError(t, err)
+	limited, err := store.CreateContainer("", nil, image.ID, "", "", &ContainerOptions{SizeLimit: 1000})
+	require.NoError(t, err)
+	unlimited, err := store.CreateContainer("", nil, image.ID, "", "", nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_, _ = store.Unmount(limited.ID, true)
+		_, _ = store.Unmount(unlimited.ID, true)
+	})
+
+	_, err = store.StartSizeMonitor(SizeMonitorOptions{PassOptions: PassOptions{Interval: -time.Second}})
+	require.Error(t, err)
+
+	recorder := newSizeMonitorRecorder()
+	monitor, err := store.StartSizeMonitor(recorder.options())
+	require.NoError(t, err)
+	defer monitor.Stop()
+
+	recorder.waitPasses(t, 1)
+	recorder.lock.Lock()
+	assert.Equal(t, []string{limited.ID}, recorder.passes[len(recorder.passes)-1])
+	recorder.lock.Unlock()
+	assert.Empty(t, recorder.exceededSizes(limited.ID))
+
+	// writing to the layers directly, as a running container would
+	write := func(id, name string, size int) {
+		mountPoint, err := store.Mount(id, "")
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(mountPoint, name), []byte(strings.Repeat("x", size)), 0644))
+	}
+	write(limited.ID, "small", 100)
+	write(unlimited.ID, "big", 4096)
+	recorder.waitPasses(t, 1)
+	assert.Empty(t, recorder.exceededSizes(limited.ID))
+	assert.Empty(t, recorder.exceededSizes(unlimited.ID))
+
+	// the container which goes past its limit is reported once
+	write(limited.ID, "big", 4096)
+	recorder.waitPasses(t, 2)
+	sizes := recorder.exceededSizes(limited.ID)
+	require.Len(t, sizes, 1)
+	assert.True(t, sizes[0] >= 4096, "size %d", sizes[0])
+
+	// and again after it went back within it
+	mountPoint, err := store.Mount(limited.ID, "")
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(filepath.Join(mountPoint, "big")))
+	recorder.waitPasses(t, 1)
+	assert.Len(t, recorder.exceededSizes(limited.ID), 1)
+	write(limited.ID, "big", 8192)
+	recorder.waitPasses(t, 1)
+	sizes = recorder.exceededSizes(limited.ID)
+	require.Len(t, sizes, 2)
+	assert.True(t, sizes[1] >= 8192, "size %d", sizes[1])
+
+	monitor.Stop()
+	// stopping it twice is harmless
+	monitor.Stop()
+}
@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"github.com/containers/storage/pkg/archive"
+	"github.com/containers/storage/types"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+func (s *store) SquashImage(id string) (string, error) {
+	img, err := s.Image(id)
+	if err != nil {
+		return "", err
+	}
+	if img.TopLayer == "" {
+		return "", errors.Wrapf(ErrLayerUnknown, "image %q has no layers to squash", img.ID)
+	}
+	layer, err := s.Layer(img.TopLayer)
+	if err != nil {
+		return "", err
+	}
+
+	// The merged view of the layers has whiteouts and opaque directories
+	// already resolved, so its contents are exactly what the new layer
+	// needs to hold.
+	mountPoint, err := s.MountImage(img.ID, nil, "")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if _, err := s.UnmountImage(img.ID, false); err != nil {
+			logrus.Warnf("Unmounting image %q after squashing it: %v", img.ID, err)
+		}
+	}()
+	tarball, err := archive.TarWithOptions(mountPoint, &archive.TarOptions{
+		Compression: archive.Uncompressed,
+		UIDMaps:     layer.UIDMap,
+		GIDMaps:     layer.GIDMap,
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "reading the contents of image %q", img.ID)
+	}
+	defer tarball.Close()
+
+	options := &LayerOptions{
+		IDMappingOptions: types.IDMappingOptions{
+			HostUIDMapping: len(layer.UIDMap) == 0,
+			HostGIDMapping: len(layer.GIDMap) == 0,
+			UIDMap:         copyIDMap(layer.UIDMap),
+			GIDMap:         copyIDMap(layer.GIDMap),
+		},
+	}
+	squashed, _, err := s.PutLayer("", "", nil, "", false, options, tarball)
+	if err != nil {
+		return "", errors.Wrapf(err, "creating the squashed layer for image %q", img.ID)
+	}
+	if _, err := s.CreateImage("", nil, squashed.ID, "", &ImageOptions{}); err != nil {
+		if err2 := s.DeleteLayer(squashed.ID); err2 != nil {
+			logrus.Errorf("Removing squashed layer %q: %v", squashed.ID, err2)
+		}
+		return "", err
+	}
+	return squashed.ID, nil
+}
@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// treeContents returns the contents of the files under root, by path, with
+// an empty string for directories.
+func treeContents(t *testing.T, root string) map[string]string {
+	contents := make(map[string]string)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == root {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			contents[rel] = ""
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		contents[rel] = string(data)
+		return nil
+	})
+	require.NoError(t, err)
+	return contents
+}
+
+func TestSquashImage(t *testing.T) {
+	s := newTestStore(t)
+
+	parent := ""
+	for _, files := range []map[string]string{
+		{"removed": "1", "dir/changed": "1", "dir/removed-later": "1", "opaque/hidden": "1"},
+		// a whiteout, an opaque directory, and a modified file
+		{".wh.removed": "", "dir/changed": "2", "opaque/.wh..wh..opq": "", "opaque/new": "2"},
+		{"dir/.wh.removed-later": "", "added": "3"},
+	} {
+		layer, _, err := s.PutLayer("", parent, nil, "", false, nil, makeTestLayerTar(t, files))
+		require.NoError(t, err)
+		parent = layer.ID
+	}
+	img, err := s.CreateImage("", []string{"layered"}, parent, "", &ImageOptions{})
+	require.NoError(t, err)
+
+	squashedID, err := s.SquashImage("layered")
+	require.NoError(t, err)
+	squashed, err := s.Layer(squashedID)
+	require.NoError(t, err)
+	assert.Equal(t, "", squashed.Parent)
+	images, err := s.ImagesByTopLayer(squashedID)
+	require.NoError(t, err)
+	require.Len(t, images, 1)
+	assert.NotEqual(t, img.ID, images[0].ID)
+
+	mountPoint, err := s.MountImage(img.ID, nil, "")
+	require.NoError(t, err)
+	expected := treeContents(t, mountPoint)
+	_, err = s.UnmountImage(img.ID, false)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"dir":         "",
+		"dir/changed": "2",
+		"opaque":      "",
+		"opaque/new":  "2",
+		"added":       "3",
+	}, expected)
+
+	mountPoint, err = s.Mount(squashedID, "")
+	require.NoError(t, err)
+	assert.Equal(t, expected, treeContents(t, mountPoint))
+	_, err = s.Unmount(squashedID, false)
+	require.NoError(t, err)
+
+	// the original image isn't left mounted
+	mounted, err := s.Mounted(img.TopLayer)
+	require.NoError(t, err)
+	assert.Equal(t, 0, mounted)
+
+	_, err = s.CreateImage("", []string{"empty"}, "", "", &ImageOptions{})
+	require.NoError(t, err)
+	_, err = s.SquashImage("empty")
+	assert.Error(t, err)
+}
@@ -29,6 +29,7 @@ import (
 	digest "github.com/opencontainers/go-digest"
 	"github.com/opencontainers/selinux/go-selinux/label"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
 var (
@@ -156,6 +157,19 @@ type FlaggableStore interface {
 
 type StoreOptions = types.StoreOptions
 
+// LayerHooks is the type of the StoreOptions' LayerHooks.
+type LayerHooks = types.LayerHooks
+
+// DriverCaps lists the features which a Store's graph driver supports.
+type DriverCaps = drivers.Capabilities
+
+// The values of the StoreOptions' SyncPolicy.
+const (
+	SyncPolicyAlways       = types.SyncPolicyAlways
+	SyncPolicyMetadataOnly = types.SyncPolicyMetadataOnly
+	SyncPolicyNone         = types.SyncPolicyNone
+)
+
 // Store wraps up the various types of file-based stores that we use into a
 // singleton object that initializes and manages them all together.
 type Store interface {
@@ -172,6 +186,31 @@ type Store interface {
 	// by the Store.
 	GraphDriver() (drivers.Driver, error)
 
+	// AdditionalStores returns the locations of the additional, read-only
+	// image stores which the Store uses, including the ones added or
+	// removed since it was created.
+	AdditionalStores() ([]string, error)
+
+	// AddAdditionalStore starts using the read-only image store at path,
+	// which is an absolute path, after the ones which are already used.
+	// The change only affects this Store object, and lasts until it is
+	// freed, but it is kept if the graph driver is reinitialized.  It is
+	// only supported by graph drivers which implement
+	// drivers.AdditionalImageStoreDriver.
+	AddAdditionalStore(path string) error
+
+	// RemoveAdditionalStore stops using the read-only image store at
+	// path, with the same limitations as AddAdditionalStore.  It fails if
+	// a layer in the writeable layer store is based on a layer which is
+	// only in that store.
+	RemoveAdditionalStore(path string) error
+
+	// DriverCapabilities returns the features which the graph driver used
+	// by the Store supports.  Drivers which don't report them are assumed
+	// to support none of them, except for shifting IDs, which all drivers
+	// report.
+	DriverCapabilities() (DriverCaps, error)
+
 	// CreateLayer creates a new layer in the underlying storage driver,
 	// optionally having the specified ID (one will be assigned if none is
 	// specified), with the specified layer (or no layer) as its parent,
@@ -191,14 +230,58 @@ type Store interface {
 	//   }
 	PutLayer(id, parent string, names []string, mountLabel string, writeable bool, options *LayerOptions, diff io.Reader) (*Layer, int64, error)
 
+	// ImportOCILayout creates the layers of the images listed in the index
+	// of the OCI image layout in the directory dir, including the ones
+	// listed in nested indexes, and returns the IDs of the layers which it
+	// created, in the order in which they were created.  Layers which are
+	// already in the store, with the same uncompressed digest and parent,
+	// are reused, and not listed.  Blobs compressed with gzip or zstd are
+	// decompressed, and zstd:chunked blobs are only recognized if
+	// pkg/chunked, which registers a LayerBlobDecoder for them, is
+	// imported.  No image records are created.  PutLayer's note about
+	// pkg/reexec applies here too.
+	ImportOCILayout(dir string) ([]string, error)
+
+	// RegisterLazyLayer creates a new read-only layer, like CreateLayer,
+	// whose contents are not populated until the layer, or a layer or
+	// container which is based on it, is first mounted.  At that point,
+	// fetch is called once to obtain the layer's diff, which is applied
+	// to the layer.  If fetch fails, the error is returned from the
+	// mount, and fetch is called again the next time.  The fetcher is
+	// only known to this Store object; mounting the layer through another
+	// one before its contents are fetched fails with
+	// ErrLayerNotMaterialized.
+	//
+	// Parent layers are populated before their children, so a lazy layer
+	// should only be based on another lazy layer if the storage driver
+	// doesn't copy the contents of the parent when creating a layer.
+	RegisterLazyLayer(id, parent string, names []string, options *LayerOptions, fetch LazyLayerFetcher) (*Layer, error)
+
 	// CreateImage creates a new image, optionally with the specified ID
 	// (one will be assigned if none is specified), with optional names,
 	// referring to a specified image, and with optional metadata.  An
 	// image is a record which associates the ID of a layer with a
 	// additional bookkeeping information which the library stores for the
-	// convenience of its caller.
+	// convenience of its caller.  The image is recorded together with the
+	// big data items listed in options, if any, only once all of them
+	// have been stored, so a failure doesn't leave a partial image behind.
 	CreateImage(id string, names []string, layer, metadata string, options *ImageOptions) (*Image, error)
 
+	// SquashImage creates a new layer, with no parent, whose contents are
+	// those of the specified image's top layer together with all of the
+	// layers it is based on, and a new image, with no names, which uses
+	// it as its top layer.  Files which were removed or hidden by the
+	// image's layers are not included.  It returns the ID of the new
+	// layer.
+	SquashImage(id string) (string, error)
+
+	// CloneImage creates a new image, with a new ID and the specified
+	// name, or no name if it is "", which refers to the same layers as the specified image, along
+	// with copies of its metadata and data items, and returns the new
+	// image's ID.  No layer data is copied.  Either image can be deleted
+	// without affecting the other one.
+	CloneImage(id, newName string, options *CloneImageOptions) (string, error)
+
 	// CreateContainer creates a new container, optionally with the
 	// specified ID (one will be assigned if none is specified), with
 	// optional names, using the specified image's top layer as the basis
@@ -239,6 +322,26 @@ type Store interface {
 	// an error.
 	DeleteLayer(id string) error
 
+	// DeleteLayerWithOptions is like DeleteLayer, but it also removes
+	// the layer if it is pinned, if options.Force is set.
+	DeleteLayerWithOptions(id string, options *DeleteLayerOptions) error
+
+	// PinLayer marks a layer as pinned, so that it is not removed along
+	// with the images which use it, or while repairing the store, and so
+	// that it can only be removed explicitly with DeleteLayerWithOptions
+	// and the Force option.  Removing a container whose layer is pinned
+	// fails.
+	PinLayer(id string) error
+
+	// UnpinLayer reverses the effect of PinLayer.
+	UnpinLayer(id string) error
+
+	// ExpireStale removes the layers which were created with a TTL which
+	// has passed, along with the containers which use them, unless they
+	// are mounted, pinned, or used by other layers or by images.  It
+	// returns the IDs of the layers which it removed.
+	ExpireStale() (removed []string, err error)
+
 	// DeleteImage removes the specified image if it is not referred to by
 	// any containers.  If its top layer is then no longer referred to by
 	// any other images and is not the parent of any other layers, its top
@@ -264,10 +367,31 @@ type Store interface {
 	// be mounted read/only
 	MountImage(id string, mountOptions []string, mountLabel string) (string, error)
 
+	// MountReadOnly mounts a layer, along with the layers it is based
+	// on, read-only, and returns the mount point.  No writable layer is
+	// created for the mount, and, with drivers which mount layers, no
+	// upper directory is used, so it is a cheap way to look at a layer's
+	// contents.  The layer must be unmounted with Unmount().
+	MountReadOnly(id string) (string, error)
+
 	// Unmount attempts to unmount an image, given an ID.
 	// Returns whether or not the layer is still mounted.
 	UnmountImage(id string, force bool) (bool, error)
 
+	// MountWithExtraLayer mounts an image with an extra layer on top of
+	// it, holding the contents of the extraTar tarball, and returns the
+	// mount point.  The extra layer is kept on a tmpfs, which also holds
+	// whatever is written to the mount, and no layer is created for it,
+	// so its contents are discarded when the mount is removed with
+	// UnmountExtraLayer().  It requires the privileges needed to mount
+	// file systems.
+	MountWithExtraLayer(imageID string, extraTar io.Reader, options *ExtraLayerOptions) (string, error)
+
+	// UnmountExtraLayer removes a mount created by MountWithExtraLayer(),
+	// discarding the contents of its extra layer, and unmounts the image
+	// which it was based on.
+	UnmountExtraLayer(mountPoint string) error
+
 	// Mount attempts to mount a layer, image, or container for access, and
 	// returns the pathname if it succeeds.
 	// Note if the mountLabel == "", the default label for the container
@@ -282,6 +406,17 @@ type Store interface {
 	//   }
 	Mount(id, mountLabel string) (string, error)
 
+	// MountWithOptions is a variant of Mount which also accepts a list of
+	// per-mount options, such as "nodev", "noexec", or "volatile", which
+	// are applied in addition to any which would otherwise be used.  The
+	// driver returns an error if it does not support one of the options,
+	// and an error is also returned if the layer is already mounted with
+	// a different set of options, since a layer only has one mount point.
+	// Mount, which doesn't ask for any options, returns the current mount
+	// point of a layer which is already mounted, even if it was mounted
+	// with "volatile".
+	MountWithOptions(id, mountLabel string, mountOpts []string) (string, error)
+
 	// Unmount attempts to unmount a layer, image, or container, given an ID, a
 	// name, or a mount path. Returns whether or not the layer is still mounted.
 	Unmount(id string, force bool) (bool, error)
@@ -289,6 +424,21 @@ type Store interface {
 	// Mounted returns number of times the layer has been mounted.
 	Mounted(id string) (int, error)
 
+	// MountHolders returns the processes which keep a layer or a
+	// container's layer mounted, for finding out why it can't be
+	// unmounted: the ones which have the layer's mount point in another
+	// mount namespace, and the ones which have files under it open or use
+	// it as their working or root directory.  The processes are found by
+	// scanning /proc, and the ones whose details can't be read, for lack
+	// of permissions or because they exited, are skipped.
+	MountHolders(id string) ([]ProcessRef, error)
+
+	// ListMounts returns the layers which the Store considers to be
+	// mounted, along with the file systems mounted under the graph
+	// driver's directory which it doesn't know about, flagging those
+	// for which its records and the kernel's disagree.
+	ListMounts() ([]MountInfo, error)
+
 	// Changes returns a summary of the changes which would need to be made
 	// to one layer to make its contents the same as a second layer.  If
 	// the first layer is not specified, the second layer's parent is
@@ -301,11 +451,47 @@ type Store interface {
 	// specify the changes returned by Changes.
 	DiffSize(from, to string) (int64, error)
 
+	// TarSplitStream returns the tar-split metadata which was recorded
+	// for a layer when its contents were applied, as a stream of
+	// uncompressed JSON records.  ErrLayerHasNoTarSplit is returned if
+	// none was recorded.
+	TarSplitStream(id string) (io.ReadCloser, error)
+
+	// AssembleTar returns the uncompressed tarball which was used to
+	// populate a layer, reassembled byte for byte from the layer's
+	// tar-split metadata and its contents, so that it can be pushed again
+	// with the same digest.  ErrLayerHasNoTarSplit is returned if no
+	// tar-split metadata was recorded for the layer.
+	AssembleTar(id string) (io.ReadCloser, error)
+
+	// ExportLayer writes to w an archive holding everything which is
+	// needed to recreate a layer in another store with ImportLayer: the
+	// layer's diff, and the information about it which can't be derived
+	// from its diff, such as its tar-split metadata and its big data
+	// items, including the manifest of a partially pulled layer.
+	ExportLayer(id string, w io.Writer) error
+
+	// ImportLayer recreates a layer from an archive written by
+	// ExportLayer, with the same ID, names and parent, which must already
+	// be present.  The layer is always read-only.  If the diff doesn't
+	// match the digest which was recorded for the exported layer, the
+	// returned error wraps ErrLayerCorrupted.
+	ImportLayer(r io.Reader) (*Layer, error)
+
 	// Diff returns the tarstream which would specify the changes returned
 	// by Changes.  If options are passed in, they can override default
 	// behaviors.
 	Diff(from, to string, options *DiffOptions) (io.ReadCloser, error)
 
+	// DiffWithCache is like Diff, but also returns the digest and the size
+	// of the tarstream, and keeps a copy of the tarstream on disk so that
+	// it can be returned again without being regenerated, as long as the
+	// layer's contents aren't replaced.  Only diffs between layers whose
+	// contents were recorded when they were applied and their parents are
+	// kept.  Cached diffs which are older or larger than the limits in
+	// options allow are removed.
+	DiffWithCache(from, to string, options *DiffCacheOptions) (io.ReadCloser, digest.Digest, int64, error)
+
 	// ApplyDiff applies a tarstream to a layer.  Information about the
 	// tarstream is cached with the layer.  Typically, a layer which is
 	// populated using a tarstream will be expected to not be modified in
@@ -342,6 +528,14 @@ type Store interface {
 	// specified uncompressed digest value recorded for them.
 	LayersByUncompressedDigest(d digest.Digest) ([]Layer, error)
 
+	// MissingLayers returns the uncompressed digests, among diffIDs, for
+	// which there is no layer in the store or in its read-only layer
+	// stores, in the order in which they are listed, each only once.
+	// These are the layers which a pull of an image with those diffIDs
+	// has to fetch, since the others can be copied from the layers which
+	// have them, even if those have different parents.
+	MissingLayers(diffIDs []digest.Digest) ([]digest.Digest, error)
+
 	// LayerSize returns a cached approximation of the layer's size, or -1
 	// if we don't have a value on hand.
 	LayerSize(id string) (int64, error)
@@ -351,12 +545,92 @@ type Store interface {
 	// any are defined) don't contain corresponding IDs.
 	LayerParentOwners(id string) ([]int, []int, error)
 
+	// VerifyLayer recomputes the checksums of the layer's contents and of
+	// its diff, and compares them to the values which were recorded when
+	// the layer was populated.  If they don't match, the returned error
+	// wraps ErrLayerCorrupted and lists the offending paths.
+	VerifyLayer(id string) error
+
+	// RepairLayers asks the storage driver to check the metadata it keeps
+	// for all known layers, such as the overlay driver's short-name links
+	// to layers, and to fix any inconsistencies it finds, returning a
+	// description of each fix.  If the driver doesn't support this, the
+	// returned error wraps ErrNotSupported.
+	RepairLayers() ([]string, error)
+
+	// StartScrub starts verifying the contents of layers in the
+	// background, as VerifyLayer does, periodically and at a limited
+	// pace, as described by options.  Corrupted layers are reported to
+	// options.OnCorruption, or logged.  The returned Scrubber's Stop()
+	// method stops it.
+	StartScrub(options ScrubOptions) (*Scrubber, error)
+
+	// SetContainerSizeLimit sets the number of bytes which the container's
+	// layer may grow to, as measured by comparing it with its parent, or
+	// removes the limit if it is 0.  The limit is not enforced by the
+	// filesystem: ApplyDiff fails when it leaves a container's layer
+	// bigger than its limit, and the layers which grow past their limits
+	// in other ways are found by StartSizeMonitor.
+	SetContainerSizeLimit(id string, limit int64) error
+
+	// StartSizeMonitor starts measuring the layers of the containers which
+	// have size limits in the background, at the interval described by
+	// options, and reports the ones which exceed their limits to
+	// options.OnExceeded.  The returned SizeMonitor's Stop() method stops
+	// it.
+	StartSizeMonitor(options SizeMonitorOptions) (*SizeMonitor, error)
+
+	// DedupLayers replaces the regular files of layers which are identical
+	// to files in other layers, in their contents, owners, permissions,
+	// modification times and extended attributes, with hard links to
+	// them, and reports how much space that saved.  Files are matched by
+	// the digests recorded in the layers' chunked manifests, or computed,
+	// and compared before they are replaced.  The layers of containers and
+	// mounted layers, whose files could be modified, are left alone, and
+	// so are files which already have other links.  It requires a driver
+	// which exposes the directories of layers, such as vfs or overlay.
+	DedupLayers(options DedupOptions) (DedupReport, error)
+
+	// ExportMetadata writes the records of all of the layers, images and
+	// containers to w, along with their big data items, such as chunked
+	// manifests and image manifests and configurations, but not the
+	// contents of the layers, in a versioned JSON format which
+	// ImportMetadata can read.
+	ExportMetadata(w io.Writer) error
+
+	// StreamContainerChanges starts watching the directory where the
+	// storage driver keeps the files written to the container's layer,
+	// such as the upper directory of an overlay mount, and sends the
+	// changes made in it to the returned channel as they happen, until
+	// the returned function is called.  Files which are copied up from
+	// lower layers to be modified are reported as added, and whiteouts
+	// as deletions.  Directories which can't be watched, because the
+	// limit of inotify watches was reached, are reported as modified
+	// once.  If the driver doesn't keep such a directory, or the
+	// platform can't watch it, the returned error wraps ErrNotSupported.
+	StreamContainerChanges(id string) (<-chan archive.Change, func(), error)
+
+	// Check looks for records which refer to layers which don't exist,
+	// namely images whose top layers are missing, containers whose layers
+	// are missing, and layers whose parents are missing, and for
+	// directories and files which were left behind for layers, images, and
+	// containers which no longer exist.  If options.Repair is set, the
+	// problems which are found are fixed by removing the dangling records
+	// and the leftover directories and files.
+	Check(options *CheckOptions) (CheckReport, error)
+
 	// Layers returns a list of the currently known layers.
 	Layers() ([]Layer, error)
 
 	// Images returns a list of the currently known images.
 	Images() ([]Image, error)
 
+	// ImagesWithChunkedLayers returns the currently known images which
+	// have at least one layer that was pulled from a chunked blob, and
+	// has its chunked manifest stored with it, so that it can be
+	// deduplicated or partially pulled or pushed again.
+	ImagesWithChunkedLayers() ([]Image, error)
+
 	// Containers returns a list of the currently known containers.
 	Containers() ([]Container, error)
 
@@ -367,15 +641,35 @@ type Store interface {
 	Free()
 
 	// SetNames changes the list of names for a layer, image, or container.
-	// Duplicate names are removed from the list automatically.
+	// Duplicate names are removed from the list automatically.  Unlike
+	// AddNames, SetNames doesn't reject the names which are used by other
+	// items of the same kind, but removes them from those items: callers
+	// rely on it to move a tag from the image which had it to one which
+	// was just pulled, so it keeps doing that for compatibility.  Callers
+	// who want a conflict to be reported should use AddNames.
 	SetNames(id string, names []string) error
 
+	// AddNames adds names to the list of names for a layer, image, or
+	// container.  If any of the names is already used by another item of
+	// the same kind, an error wrapping ErrDuplicateName is returned and no
+	// name is changed.  Names are only unique among the items of the same
+	// kind, so an image and a container can have the same name, as they
+	// always could.
+	AddNames(id string, names []string) error
+
+	// RemoveNames removes names from the list of names for a layer, image,
+	// or container.
+	RemoveNames(id string, names []string) error
+
 	// ListImageBigData retrieves a list of the (possibly large) chunks of
 	// named data associated with an image.
 	ListImageBigData(id string) ([]string, error)
 
 	// ImageBigData retrieves a (possibly large) chunk of named data
-	// associated with an image.
+	// associated with an image.  If the image is specified by its full ID
+	// and the name of the data is the digest of its contents, as is the
+	// case for an image's configuration, the data is read without locking
+	// the image stores.
 	ImageBigData(id, key string) ([]byte, error)
 
 	// ImageBigDataSize retrieves the size of a (possibly large) chunk
@@ -392,6 +686,18 @@ type Store interface {
 	// allow ImagesByDigest to find images by their correct digests.
 	SetImageBigData(id, key string, data []byte, digestManifest func([]byte) (digest.Digest, error)) error
 
+	// SetImageBinds replaces the list of directories which are bind
+	// mounted, read-only, into an image when it is first mounted with
+	// MountImage, and which containers created from it inherit.  The
+	// sources of the binds must be directories under the store's
+	// BindRoots.
+	SetImageBinds(id string, binds []ReadOnlyBind) error
+
+	// SetContainerBinds replaces the list of directories which are bind
+	// mounted, read-only, into a container's layer when it is first
+	// mounted, with the same checks as SetImageBinds.
+	SetContainerBinds(id string, binds []ReadOnlyBind) error
+
 	// ListLayerBigData retrieves a list of the (possibly large) chunks of
 	// named data associated with an layer.
 	ListLayerBigData(id string) ([]string, error)
@@ -431,9 +737,29 @@ type Store interface {
 	// data.  Warning:  this is a potentially expensive operation.
 	ContainerSize(id string) (int64, error)
 
+	// ContainerDiskUsage computes the disk space which is attributable to
+	// a container: the space used by the writable part of its layer, as
+	// reported by the storage driver, plus, for each of the layers below
+	// it, the space used by that layer divided by the number of containers
+	// whose layers are built on top of it, plus the size of the same
+	// ancillary data as ContainerSize.  Adding up the values returned for
+	// all of the containers gives at most the space used by them and by
+	// the layers of the images they use.  What a layer uses depends on
+	// the driver: with overlay it is the size of the layer's upper
+	// directory, which only holds what changed from the layers below, while
+	// with vfs every layer holds a full copy of the files of its parents.
+	// Warning:  this is a potentially expensive operation.
+	ContainerDiskUsage(id string) (int64, error)
+
 	// Layer returns a specific layer.
 	Layer(id string) (*Layer, error)
 
+	// LayersByIDs returns the layers with the specified IDs or names, in
+	// the same order, looking them all up while holding the layer stores'
+	// locks only once.  The entries for layers which are not known are
+	// nil.
+	LayersByIDs(ids []string) ([]*Layer, error)
+
 	// Image returns a specific image.
 	Image(id string) (*Image, error)
 
@@ -557,7 +883,23 @@ type LayerOptions struct {
 	// and reliably known by the caller.
 	// Use the default "" if this fields is not applicable or the value is not known.
 	UncompressedDigest digest.Digest
-}
+	// TTL, if not zero, is how long the layer should be kept.  Once it has
+	// passed, the layer can be removed by the Store's ExpireStale() method.
+	TTL time.Duration
+	// ReuseExisting, if set along with UncompressedDigest, makes PutLayer()
+	// return the layer which was already created from a diff with the same
+	// UncompressedDigest on top of the same parent layer, with the same ID
+	// mappings, instead of creating another one, after adding the requested
+	// names to it.  The layer store is locked while a layer is created, so
+	// callers which create the same layer at the same time, in the same
+	// process or not, wait for the first one and get its layer.  The
+	// returned layer can have a different ID than the one requested.
+	ReuseExisting bool
+}
+
+// LazyLayerFetcher is called to obtain the diff for a layer which was
+// registered with a Store's RegisterLazyLayer() method.
+type LazyLayerFetcher func(layerID string) (io.ReadCloser, error)
 
 // ImageOptions is used for passing options to a Store's CreateImage() method.
 type ImageOptions struct {
@@ -566,6 +908,73 @@ type ImageOptions struct {
 	CreationDate time.Time
 	// Digest is a hard-coded digest value that we can use to look up the image.  It is optional.
 	Digest digest.Digest
+	// BigData lists big data items to be stored with the image, such as
+	// its manifest and configuration.  If any of them can't be stored,
+	// the image isn't created.
+	BigData []ImageBigDataOption
+}
+
+// ImageBigDataOption is a big data item which is stored along with the image
+// created by CreateImage.
+type ImageBigDataOption struct {
+	Key  string
+	Data []byte
+	// Digest is the digest of Data.  It must be set for manifests, and is
+	// computed for the other items if it isn't.
+	Digest digest.Digest
+}
+
+// CloneImageOptions is used for passing options to a Store's CloneImage() method.
+type CloneImageOptions struct {
+	// NewTopLayer, if set, causes a new, empty, writeable layer to be
+	// created on top of the original image's top layer, and used as the
+	// clone's top layer.
+	NewTopLayer bool
+}
+
+// DeleteLayerOptions is used for passing options to a Store's
+// DeleteLayerWithOptions() method.
+type DeleteLayerOptions struct {
+	// Force, if set, causes the layer to be removed even if it is pinned.
+	Force bool
+}
+
+// CheckOptions is used for passing options to a Store's Check() method.
+type CheckOptions struct {
+	// Repair, if set, causes the problems which are found to be fixed.
+	// Layers whose parents are missing are deleted along with the layers
+	// which are based on them, then images whose top layers are missing
+	// are deleted, mapped top layers which are missing are removed from
+	// the images which list them, and containers whose layers are missing
+	// are deleted.  Records in read-only stores are never changed.
+	Repair bool
+}
+
+// CheckReport lists the problems found by a Store's Check() method.
+type CheckReport struct {
+	// LayersWithMissingParents maps the IDs of layers to the IDs of
+	// their parents, which don't exist.
+	LayersWithMissingParents map[string]string
+	// ImagesWithMissingLayers maps the IDs of images to the IDs of the
+	// top layers and mapped top layers they list which don't exist.
+	ImagesWithMissingLayers map[string][]string
+	// ContainersWithMissingLayers maps the IDs of containers to the IDs
+	// of their layers, which don't exist.
+	ContainersWithMissingLayers map[string]string
+	// OrphanedPaths lists the directories and files which were kept for
+	// layers, images, or containers which don't exist.
+	OrphanedPaths []string
+	// RemovedLayers, RemovedImages, and RemovedContainers list the IDs of
+	// the records which were deleted while repairing the store.
+	RemovedLayers     []string
+	RemovedImages     []string
+	RemovedContainers []string
+}
+
+// Consistent returns true if the report doesn't list any problems.
+func (r *CheckReport) Consistent() bool {
+	return len(r.LayersWithMissingParents) == 0 && len(r.ImagesWithMissingLayers) == 0 &&
+		len(r.ContainersWithMissingLayers) == 0 && len(r.OrphanedPaths) == 0
 }
 
 // ContainerOptions is used for passing options to a Store's CreateContainer() method.
@@ -575,11 +984,29 @@ type ContainerOptions struct {
 	// container's layer will inherit settings from the image's top layer
 	// or, if it is not being created based on an image, the Store object.
 	types.IDMappingOptions
-	LabelOpts  []string
-	Flags      map[string]interface{}
-	MountOpts  []string
+	LabelOpts []string
+	Flags     map[string]interface{}
+	MountOpts []string
+	// Volatile, if set, causes the container's layer to be mounted
+	// without syncing changes to disk, if the driver and the kernel
+	// support it.  This makes writing to it, and unmounting it, faster,
+	// but its contents can be lost or corrupted if the host crashes, so
+	// it is only suitable for containers which are thrown away.
 	Volatile   bool
 	StorageOpt map[string]string
+	// TTL, if not zero, is how long the container should be kept.  Once it
+	// has passed, the container and its layer can be removed by the
+	// Store's ExpireStale() method.
+	TTL time.Duration
+	// Binds, if not nil, replaces the list of directories which are
+	// bind mounted into the container's layer, which is otherwise
+	// inherited from the image.
+	Binds []ReadOnlyBind
+	// SizeLimit, if not zero, is the number of bytes which the
+	// container's layer may grow to, as described for the Store's
+	// SetContainerSizeLimit() method.  It is meant for drivers which
+	// can't enforce a quota with the "size" storage option.
+	SizeLimit int64
 }
 
 type store struct {
@@ -601,10 +1028,37 @@ type store struct {
 	layerStore      LayerStore
 	roLayerStores   []ROLayerStore
 	imageStore      ImageStore
-	roImageStores   []ROImageStore
-	containerStore  ContainerStore
-	digestLockRoot  string
-	disableVolatile bool
+	// roImageStoresLock guards roImageStores, which is replaced when
+	// the additional image stores are changed.
+	roImageStoresLock sync.RWMutex
+	roImageStores     []ROImageStore
+	// additionalImageStores, if not nil, replaces the driver's list of
+	// additional image stores, after they were changed with
+	// AddAdditionalStore or RemoveAdditionalStore.
+	additionalImageStores []string
+	containerStore        ContainerStore
+	digestLockRoot        string
+	disableVolatile       bool
+	prefetchOnMount       bool
+	bindRoots             []string
+	syncPolicy            string
+	// namespace and namespaceSharedBase are set from the StoreOptions
+	// fields of the same names.
+	namespace           string
+	namespaceSharedBase bool
+	// layerHooks is the StoreOptions' LayerHooks.
+	layerHooks *types.LayerHooks
+	// lazyFetchers maps the IDs of layers registered with
+	// RegisterLazyLayer, which haven't been populated yet, to their
+	// fetchers.
+	lazyLock     sync.Mutex
+	lazyFetchers map[string]LazyLayerFetcher
+	// prefetches tracks the read aheads started by
+	// prefetchMountedLayer, by layer ID.
+	prefetchLock sync.Mutex
+	prefetches   map[string]*layerPrefetch
+	// journalCrash is shared with the read-write layer and image stores.
+	journalCrash *journalCrashHook
 }
 
 // GetStore attempts to find an already-created Store object matching the
@@ -644,11 +1098,20 @@ func GetStore(options types.StoreOptions) (Store, error) {
 		options.RunRoot = dir
 	}
 
+	if options.Namespace != "" && (options.Namespace == "." || options.Namespace == ".." || strings.ContainsRune(options.Namespace, os.PathSeparator)) {
+		return nil, errors.Errorf("invalid store namespace %q", options.Namespace)
+	}
+	switch options.SyncPolicy {
+	case "", SyncPolicyAlways, SyncPolicyMetadataOnly, SyncPolicyNone:
+	default:
+		return nil, errors.Errorf("unknown sync policy %q", options.SyncPolicy)
+	}
+
 	storesLock.Lock()
 	defer storesLock.Unlock()
 
 	for _, s := range stores {
-		if s.graphRoot == options.GraphRoot && (options.GraphDriverName == "" || s.graphDriverName == options.GraphDriverName) {
+		if s.graphRoot == options.GraphRoot && s.namespace == options.Namespace && (options.GraphDriverName == "" || s.graphDriverName == options.GraphDriverName) {
 			return s, nil
 		}
 	}
@@ -705,10 +1168,22 @@ func GetStore(options types.StoreOptions) (Store, error) {
 		additionalGIDs:  nil,
 		usernsLock:      usernsLock,
 		disableVolatile: options.DisableVolatile,
+		prefetchOnMount: options.PrefetchOnMount,
+		bindRoots:       copyStringSlice(options.BindRoots),
+		syncPolicy:      options.SyncPolicy,
+
+		namespace:           options.Namespace,
+		namespaceSharedBase: options.Namespace != "" && options.NamespaceSharedBase,
+
+		layerHooks:   options.LayerHooks,
+		journalCrash: &journalCrashHook{},
 	}
 	if err := s.load(); err != nil {
 		return nil, err
 	}
+	if err := s.recoverJournal(); err != nil {
+		return nil, err
+	}
 
 	stores = append(stores, s)
 
@@ -763,6 +1238,16 @@ func (s *store) GIDMap() []idtools.IDMap {
 	return copyIDMap(s.gidMap)
 }
 
+// metadataDir returns the directory under root, which is either the store's
+// graph root or its run root, where the metadata for the store's namespace
+// is kept.
+func (s *store) metadataDir(root string) string {
+	if s.namespace == "" {
+		return root
+	}
+	return filepath.Join(root, "namespaces", s.namespace)
+}
+
 func (s *store) load() error {
 	driver, err := s.GraphDriver()
 	if err != nil {
@@ -772,11 +1257,11 @@ func (s *store) load() error {
 	s.graphDriverName = driver.String()
 	driverPrefix := s.graphDriverName + "-"
 
-	gipath := filepath.Join(s.graphRoot, driverPrefix+"images")
+	gipath := filepath.Join(s.metadataDir(s.graphRoot), driverPrefix+"images")
 	if err := os.MkdirAll(gipath, 0700); err != nil {
 		return err
 	}
-	ris, err := newImageStore(gipath)
+	ris, err := newImageStore(gipath, s.journalCrash)
 	if err != nil {
 		return err
 	}
@@ -785,7 +1270,7 @@ func (s *store) load() error {
 		return err
 	}
 
-	gcpath := filepath.Join(s.graphRoot, driverPrefix+"containers")
+	gcpath := filepath.Join(s.metadataDir(s.graphRoot), driverPrefix+"containers")
 	if err := os.MkdirAll(gcpath, 0700); err != nil {
 		return err
 	}
@@ -793,27 +1278,134 @@ func (s *store) load() error {
 	if err != nil {
 		return err
 	}
-	rcpath := filepath.Join(s.runRoot, driverPrefix+"containers")
+	rcpath := filepath.Join(s.metadataDir(s.runRoot), driverPrefix+"containers")
 	if err := os.MkdirAll(rcpath, 0700); err != nil {
 		return err
 	}
 	s.containerStore = rcs
 
-	for _, store := range driver.AdditionalImageStores() {
+	roImageStores, err := s.newROImageStores(driver.AdditionalImageStores())
+	if err != nil {
+		return err
+	}
+	s.roImageStores = roImageStores
+
+	s.digestLockRoot = filepath.Join(s.runRoot, driverPrefix+"locks")
+	if err := os.MkdirAll(s.digestLockRoot, 0700); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// newROImageStores returns the read-only image stores of the shared base
+// namespace, if the store uses one, and of the additional image stores.
+func (s *store) newROImageStores(additionalImageStores []string) ([]ROImageStore, error) {
+	driverPrefix := s.graphDriverName + "-"
+	var roImageStores []ROImageStore
+	if s.namespaceSharedBase {
+		gipath := filepath.Join(s.graphRoot, driverPrefix+"images")
+		if err := os.MkdirAll(gipath, 0700); err != nil {
+			return nil, err
+		}
+		ris, err := newSharedROImageStore(gipath)
+		if err != nil {
+			return nil, err
+		}
+		roImageStores = append(roImageStores, ris)
+	}
+	for _, store := range additionalImageStores {
 		gipath := filepath.Join(store, driverPrefix+"images")
 		ris, err := newROImageStore(gipath)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		s.roImageStores = append(s.roImageStores, ris)
+		roImageStores = append(roImageStores, ris)
 	}
+	return roImageStores, nil
+}
 
-	s.digestLockRoot = filepath.Join(s.runRoot, driverPrefix+"locks")
-	if err := os.MkdirAll(s.digestLockRoot, 0700); err != nil {
+// namespaceLayerUsers returns, for each of the layers of a store without a
+// namespace which is the parent of a layer or the top layer of an image of a
+// store which uses the same graph root with a namespace, and so could be used
+// as a shared base layer by it, an error which describes its first user.  The
+// layers of the containers of a namespace are among its layers, so they are
+// covered by their parents.  Each namespace's stores are read once, so that
+// the result can be used to check all of the layers of an image.
+func (s *store) namespaceLayerUsers() (map[string]error, error) {
+	namespaces, err := ioutil.ReadDir(filepath.Join(s.graphRoot, "namespaces"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	driverPrefix := s.graphDriverName + "-"
+	// the stores are opened read-only, so they don't look at the mounts
+	// recorded in the run root
+	rlpath := filepath.Join(s.runRoot, driverPrefix+"layers")
+	users := make(map[string]error)
+	for _, namespace := range namespaces {
+		if !namespace.IsDir() {
+			continue
+		}
+		glpath := filepath.Join(s.graphRoot, "namespaces", namespace.Name(), driverPrefix+"layers")
+		if _, err := os.Stat(glpath); err == nil {
+			rls, err := newSharedROLayerStore(rlpath, glpath, s.graphDriver)
+			if err != nil {
+				return nil, err
+			}
+			layers, err := readOnlyLayers(rls)
+			if err != nil {
+				return nil, err
+			}
+			for _, layer := range layers {
+				if _, ok := users[layer.Parent]; !ok && layer.Parent != "" {
+					users[layer.Parent] = errors.Wrapf(ErrLayerHasChildren, "used by layer %v in namespace %q", layer.ID, namespace.Name())
+				}
+			}
+		}
+		gipath := filepath.Join(s.graphRoot, "namespaces", namespace.Name(), driverPrefix+"images")
+		if _, err := os.Stat(gipath); err == nil {
+			ris, err := newSharedROImageStore(gipath)
+			if err != nil {
+				return nil, err
+			}
+			images, err := ris.Images()
+			if err != nil {
+				return nil, err
+			}
+			for _, image := range images {
+				for _, id := range append([]string{image.TopLayer}, image.MappedTopLayers...) {
+					if _, ok := users[id]; !ok && id != "" {
+						users[id] = errors.Wrapf(ErrLayerUsedByImage, "layer %v used by image %v in namespace %q", id, image.ID, namespace.Name())
+					}
+				}
+			}
+		}
+	}
+	return users, nil
+}
+
+// checkNamespaceUsers returns the error which namespaceLayerUsers returns
+// for the layer with the specified ID, if it has a user in a namespace.
+func (s *store) checkNamespaceUsers(id string) error {
+	users, err := s.namespaceLayerUsers()
+	if err != nil {
 		return err
 	}
+	return users[id]
+}
 
-	return nil
+// readOnlyLayers returns the layers of a read-only layer store, reloading
+// them if they changed.
+func readOnlyLayers(store ROLayerStore) ([]Layer, error) {
+	store.RLock()
+	defer store.Unlock()
+	if err := store.ReloadIfChanged(); err != nil {
+		return nil, err
+	}
+	return store.Layers()
 }
 
 // GetDigestLock returns a digest-specific Locker.
@@ -836,6 +1428,11 @@ func (s *store) getGraphDriver() (drivers.Driver, error) {
 	if err != nil {
 		return nil, err
 	}
+	if s.additionalImageStores != nil {
+		if err := setAdditionalImageStores(driver, s.additionalImageStores); err != nil {
+			return nil, err
+		}
+	}
 	s.graphDriver = driver
 	s.graphDriverName = driver.String()
 	return driver, nil
@@ -852,6 +1449,17 @@ func (s *store) GraphDriver() (drivers.Driver, error) {
 	return s.getGraphDriver()
 }
 
+func (s *store) DriverCapabilities() (DriverCaps, error) {
+	driver, err := s.GraphDriver()
+	if err != nil {
+		return DriverCaps{}, err
+	}
+	if cdriver, ok := driver.(drivers.CapabilityDriver); ok {
+		return cdriver.Capabilities(), nil
+	}
+	return DriverCaps{IDShifting: driver.SupportsShifting()}, nil
+}
+
 // LayerStore obtains and returns a handle to the writeable layer store object
 // used by the Store.  Accessing this store directly will bypass locking and
 // synchronization, so it is not a part of the exported Store interface.
@@ -871,11 +1479,11 @@ func (s *store) LayerStore() (LayerStore, error) {
 		return nil, err
 	}
 	driverPrefix := s.graphDriverName + "-"
-	rlpath := filepath.Join(s.runRoot, driverPrefix+"layers")
+	rlpath := filepath.Join(s.metadataDir(s.runRoot), driverPrefix+"layers")
 	if err := os.MkdirAll(rlpath, 0700); err != nil {
 		return nil, err
 	}
-	glpath := filepath.Join(s.graphRoot, driverPrefix+"layers")
+	glpath := filepath.Join(s.metadataDir(s.graphRoot), driverPrefix+"layers")
 	if err := os.MkdirAll(glpath, 0700); err != nil {
 		return nil, err
 	}
@@ -901,10 +1509,21 @@ func (s *store) ROLayerStores() ([]ROLayerStore, error) {
 		return nil, err
 	}
 	driverPrefix := s.graphDriverName + "-"
-	rlpath := filepath.Join(s.runRoot, driverPrefix+"layers")
+	rlpath := filepath.Join(s.metadataDir(s.runRoot), driverPrefix+"layers")
 	if err := os.MkdirAll(rlpath, 0700); err != nil {
 		return nil, err
 	}
+	if s.namespaceSharedBase {
+		glpath := filepath.Join(s.graphRoot, driverPrefix+"layers")
+		if err := os.MkdirAll(glpath, 0700); err != nil {
+			return nil, err
+		}
+		rls, err := newSharedROLayerStore(rlpath, glpath, driver)
+		if err != nil {
+			return nil, err
+		}
+		s.roLayerStores = append(s.roLayerStores, rls)
+	}
 	for _, store := range driver.AdditionalImageStores() {
 		glpath := filepath.Join(store, driverPrefix+"layers")
 		rls, err := newROLayerStore(rlpath, glpath, driver)
@@ -934,9 +1553,128 @@ func (s *store) ROImageStores() ([]ROImageStore, error) {
 		return nil, ErrLoadError
 	}
 
+	s.roImageStoresLock.RLock()
+	defer s.roImageStoresLock.RUnlock()
 	return s.roImageStores, nil
 }
 
+// setAdditionalImageStores replaces the additional image stores of driver.
+func setAdditionalImageStores(driver drivers.Driver, stores []string) error {
+	d, ok := driver.(drivers.AdditionalImageStoreDriver)
+	if !ok {
+		return errors.Wrapf(ErrNotSupported, "changing the additional image stores of the %q driver", driver.String())
+	}
+	return d.SetAdditionalImageStores(stores)
+}
+
+func (s *store) AdditionalStores() ([]string, error) {
+	driver, err := s.GraphDriver()
+	if err != nil {
+		return nil, err
+	}
+	return driver.AdditionalImageStores(), nil
+}
+
+func (s *store) AddAdditionalStore(path string) error {
+	if !filepath.IsAbs(path) {
+		return errors.Errorf("the path of an additional image store must be absolute, not %q", path)
+	}
+	path = filepath.Clean(path)
+	if path == filepath.Clean(s.graphRoot) {
+		return errors.Errorf("%q is the store's own graph root", path)
+	}
+	return s.updateAdditionalStores(func(stores []string) ([]string, error) {
+		for _, store := range stores {
+			if filepath.Clean(store) == path {
+				return nil, errors.Errorf("%q is already an additional image store", path)
+			}
+		}
+		return append(stores, path), nil
+	})
+}
+
+func (s *store) RemoveAdditionalStore(path string) error {
+	path = filepath.Clean(path)
+	// the layers which are based on the store's layers
+	rlstore, err := s.LayerStore()
+	if err != nil {
+		return err
+	}
+	rlstore.RLock()
+	defer rlstore.Unlock()
+	if err := rlstore.ReloadIfChanged(); err != nil {
+		return err
+	}
+	layers, err := rlstore.Layers()
+	if err != nil {
+		return err
+	}
+	return s.updateAdditionalStores(func(stores []string) ([]string, error) {
+		var remaining []string
+		for _, store := range stores {
+			if filepath.Clean(store) != path {
+				remaining = append(remaining, store)
+			}
+		}
+		if len(remaining) == len(stores) {
+			return nil, errors.Errorf("%q is not an additional image store", path)
+		}
+		driverPrefix := s.graphDriverName + "-"
+		rlpath := filepath.Join(s.metadataDir(s.runRoot), driverPrefix+"layers")
+		removed, err := newROLayerStore(rlpath, filepath.Join(path, driverPrefix+"layers"), s.graphDriver)
+		if err != nil {
+			return nil, err
+		}
+		for _, layer := range layers {
+			if layer.Parent == "" || rlstore.Exists(layer.Parent) || !removed.Exists(layer.Parent) {
+				continue
+			}
+			return nil, errors.Errorf("layer %q is based on layer %q, in the additional image store %q", layer.ID, layer.Parent, path)
+		}
+		if remaining == nil {
+			// no longer the configured list, but an empty one
+			remaining = []string{}
+		}
+		return remaining, nil
+	})
+}
+
+// updateAdditionalStores replaces the list of additional image stores with
+// the one which update returns, given the current one, and replaces the
+// read-only image and layer stores to match it.
+func (s *store) updateAdditionalStores(update func(stores []string) ([]string, error)) error {
+	s.graphLock.Lock()
+	defer s.graphLock.Unlock()
+	if s.imageStore == nil {
+		return ErrLoadError
+	}
+	driver, err := s.getGraphDriver()
+	if err != nil {
+		return err
+	}
+	if _, ok := driver.(drivers.AdditionalImageStoreDriver); !ok {
+		return errors.Wrapf(ErrNotSupported, "changing the additional image stores of the %q driver", driver.String())
+	}
+	stores, err := update(driver.AdditionalImageStores())
+	if err != nil {
+		return err
+	}
+	roImageStores, err := s.newROImageStores(stores)
+	if err != nil {
+		return err
+	}
+	if err := setAdditionalImageStores(driver, stores); err != nil {
+		return err
+	}
+	s.additionalImageStores = stores
+	s.roImageStoresLock.Lock()
+	s.roImageStores = roImageStores
+	s.roImageStoresLock.Unlock()
+	// loaded again from the new list when they are next used
+	s.roLayerStores = nil
+	return nil
+}
+
 // ContainerStore obtains and returns a handle to the container store object
 // used by the Store.  Accessing this store directly will bypass locking and
 // synchronization, so it is not a part of the exported Store interface.
@@ -961,6 +1699,10 @@ func (s *store) canUseShifting(uidmap, gidmap []idtools.IDMap) bool {
 }
 
 func (s *store) PutLayer(id, parent string, names []string, mountLabel string, writeable bool, options *LayerOptions, diff io.Reader) (*Layer, int64, error) {
+	return s.putLayer(id, parent, names, mountLabel, writeable, options, nil, diff)
+}
+
+func (s *store) putLayer(id, parent string, names []string, mountLabel string, writeable bool, options *LayerOptions, flags map[string]interface{}, diff io.Reader) (*Layer, int64, error) {
 	var parentLayer *Layer
 	rlstore, err := s.LayerStore()
 	if err != nil {
@@ -996,6 +1738,9 @@ func (s *store) PutLayer(id, parent string, names []string, mountLabel string, w
 	if options.HostGIDMapping {
 		options.GIDMap = nil
 	}
+	if options.TTL != 0 {
+		flags = withExpiry(flags, options.TTL)
+	}
 	uidMap := options.UIDMap
 	gidMap := options.GIDMap
 	if parent != "" {
@@ -1056,7 +1801,52 @@ func (s *store) PutLayer(id, parent string, names []string, mountLabel string, w
 			GIDMap:         copyIDMap(gidMap),
 		}
 	}
-	return rlstore.Put(id, parentLayer, names, mountLabel, nil, &layerOptions, writeable, nil, diff)
+	if options.ReuseExisting && options.UncompressedDigest != "" && !writeable {
+		if layer := reusableLayer(rlstore, parent, options.UncompressedDigest, &layerOptions.IDMappingOptions); layer != nil {
+			if len(names) > 0 {
+				if err := rlstore.SetNames(layer.ID, append(layer.Names, names...)); err != nil {
+					return nil, -1, err
+				}
+				if layer, err = rlstore.Get(layer.ID); err != nil {
+					return nil, -1, err
+				}
+			}
+			return layer, layer.UncompressedSize, nil
+		}
+	}
+	if l, err := rlstore.Get(id); err == nil && l.ID == id {
+		// fails without changing anything
+		return rlstore.Put(id, parentLayer, names, mountLabel, nil, &layerOptions, writeable, flags, diff)
+	}
+	record, err := s.beginJournal(journalEntry{Operation: journalCreateLayer, Layers: []string{id}})
+	if err != nil {
+		return nil, -1, err
+	}
+	layer, size, err := rlstore.Put(id, parentLayer, names, mountLabel, nil, &layerOptions, writeable, flags, diff)
+	if err == nil && s.journalCrash.at("layer-saved") {
+		layer, size, err = nil, -1, errJournalCrash
+	}
+	record.finish(err)
+	return layer, size, err
+}
+
+// reusableLayer returns the layer in rlstore which was created from a diff
+// whose uncompressed digest is d on top of parent, with the ID mappings in
+// idMappings, or nil if there is none.
+func reusableLayer(rlstore LayerStore, parent string, d digest.Digest, idMappings *types.IDMappingOptions) *Layer {
+	layers, err := rlstore.LayersByUncompressedDigest(d)
+	if err != nil {
+		return nil
+	}
+	for i := range layers {
+		layer := &layers[i]
+		if layer.Parent == parent &&
+			reflect.DeepEqual(copyIDMap(layer.UIDMap), copyIDMap(idMappings.UIDMap)) &&
+			reflect.DeepEqual(copyIDMap(layer.GIDMap), copyIDMap(idMappings.GIDMap)) {
+			return layer
+		}
+	}
+	return nil
 }
 
 func (s *store) CreateLayer(id, parent string, names []string, mountLabel string, writeable bool, options *LayerOptions) (*Layer, error) {
@@ -1064,6 +1854,81 @@ func (s *store) CreateLayer(id, parent string, names []string, mountLabel string
 	return layer, err
 }
 
+func (s *store) RegisterLazyLayer(id, parent string, names []string, options *LayerOptions, fetch LazyLayerFetcher) (*Layer, error) {
+	if fetch == nil {
+		return nil, errors.Errorf("no fetcher specified for lazy layer %q", id)
+	}
+	if id == "" {
+		id = stringid.GenerateRandomID()
+	}
+	// Record the fetcher first, so that the layer can't be mounted
+	// before it's known.
+	s.lazyLock.Lock()
+	if _, ok := s.lazyFetchers[id]; ok {
+		s.lazyLock.Unlock()
+		return nil, errors.Wrapf(ErrDuplicateID, "layer %q", id)
+	}
+	if s.lazyFetchers == nil {
+		s.lazyFetchers = make(map[string]LazyLayerFetcher)
+	}
+	s.lazyFetchers[id] = fetch
+	s.lazyLock.Unlock()
+
+	layer, _, err := s.putLayer(id, parent, names, "", false, options, map[string]interface{}{lazyFlag: true}, nil)
+	if err != nil {
+		s.lazyLock.Lock()
+		delete(s.lazyFetchers, id)
+		s.lazyLock.Unlock()
+		return nil, err
+	}
+	return layer, nil
+}
+
+// materializeLazyLayers populates the specified layer and any of its parents
+// which were registered with RegisterLazyLayer and haven't been populated
+// yet, starting with the bottommost one.  The caller must hold the write lock
+// on rlstore, which keeps other mounts, in this process or in others, from
+// fetching the same layer at the same time.
+func (s *store) materializeLazyLayers(rlstore LayerStore, id string) error {
+	var pending []*Layer
+	for id != "" {
+		layer, err := rlstore.Get(id)
+		if err != nil {
+			// the parent is in a read-only layer store
+			break
+		}
+		if _, ok := layer.Flags[lazyFlag]; ok {
+			pending = append(pending, layer)
+		}
+		id = layer.Parent
+	}
+	for i := len(pending) - 1; i >= 0; i-- {
+		layer := pending[i]
+		s.lazyLock.Lock()
+		fetch := s.lazyFetchers[layer.ID]
+		s.lazyLock.Unlock()
+		if fetch == nil {
+			return errors.Wrapf(ErrLayerNotMaterialized, "layer %q", layer.ID)
+		}
+		diff, err := fetch(layer.ID)
+		if err != nil {
+			return errors.Wrapf(err, "fetching the contents of layer %q", layer.ID)
+		}
+		_, err = rlstore.ApplyDiff(layer.ID, diff)
+		diff.Close()
+		if err != nil {
+			return errors.Wrapf(err, "populating layer %q", layer.ID)
+		}
+		if err := rlstore.ClearFlag(layer.ID, lazyFlag); err != nil {
+			return err
+		}
+		s.lazyLock.Lock()
+		delete(s.lazyFetchers, layer.ID)
+		s.lazyLock.Unlock()
+	}
+	return nil
+}
+
 func (s *store) CreateImage(id string, names []string, layer, metadata string, options *ImageOptions) (*Image, error) {
 	if id == "" {
 		id = stringid.GenerateRandomID()
@@ -1074,6 +1939,11 @@ func (s *store) CreateImage(id string, names []string, layer, metadata string, o
 		if err != nil {
 			return nil, err
 		}
+		lstore.Lock()
+		defer lstore.Unlock()
+		if err := lstore.ReloadIfChanged(); err != nil {
+			return nil, err
+		}
 		lstores, err := s.ROLayerStores()
 		if err != nil {
 			return nil, err
@@ -1081,15 +1951,12 @@ func (s *store) CreateImage(id string, names []string, layer, metadata string, o
 		var ilayer *Layer
 		for _, s := range append([]ROLayerStore{lstore}, lstores...) {
 			store := s
-			if store == lstore {
-				store.Lock()
-			} else {
+			if store != lstore {
 				store.RLock()
-			}
-			defer store.Unlock()
-			err := store.ReloadIfChanged()
-			if err != nil {
-				return nil, err
+				defer store.Unlock()
+				if err := store.ReloadIfChanged(); err != nil {
+					return nil, err
+				}
 			}
 			ilayer, err = store.Get(layer)
 			if err == nil {
@@ -1112,12 +1979,95 @@ func (s *store) CreateImage(id string, names []string, layer, metadata string, o
 		return nil, err
 	}
 
+	if options == nil {
+		options = &ImageOptions{}
+	}
 	creationDate := time.Now().UTC()
-	if options != nil && !options.CreationDate.IsZero() {
+	if !options.CreationDate.IsZero() {
 		creationDate = options.CreationDate
 	}
 
-	return ristore.Create(id, names, layer, metadata, creationDate, options.Digest)
+	if i, err := ristore.Get(id); err == nil && i.ID == id {
+		// fails without changing anything
+		return ristore.CreateWithBigData(id, names, layer, metadata, creationDate, options.Digest, options.BigData)
+	}
+	// the image store's lock is enough for the journal, since the
+	// creation of an image only changes its files
+	record, err := s.beginJournal(journalEntry{Operation: journalCreateImage, Images: []string{id}})
+	if err != nil {
+		return nil, err
+	}
+	image, err := ristore.CreateWithBigData(id, names, layer, metadata, creationDate, options.Digest, options.BigData)
+	if err == nil && s.journalCrash.at("image-saved") {
+		image, err = nil, errJournalCrash
+	}
+	record.finish(err)
+	return image, err
+}
+
+func (s *store) CloneImage(id, newName string, options *CloneImageOptions) (string, error) {
+	if options == nil {
+		options = &CloneImageOptions{}
+	}
+	image, err := s.Image(id)
+	if err != nil {
+		return "", err
+	}
+
+	topLayer := image.TopLayer
+	if options.NewTopLayer {
+		var layerOptions *LayerOptions
+		if topLayer != "" {
+			parent, err := s.Layer(topLayer)
+			if err != nil {
+				return "", err
+			}
+			layerOptions = &LayerOptions{
+				IDMappingOptions: types.IDMappingOptions{
+					UIDMap: copyIDMap(parent.UIDMap),
+					GIDMap: copyIDMap(parent.GIDMap),
+				},
+			}
+		}
+		layer, err := s.CreateLayer("", topLayer, nil, "", true, layerOptions)
+		if err != nil {
+			return "", errors.Wrapf(err, "error creating the top layer for the clone of image %q", image.ID)
+		}
+		topLayer = layer.ID
+	}
+
+	var names []string
+	if newName != "" {
+		names = []string{newName}
+	}
+	clone, err := s.CreateImage("", names, topLayer, image.Metadata, &ImageOptions{Digest: image.Digest})
+	if err != nil {
+		if topLayer != image.TopLayer {
+			_ = s.DeleteLayer(topLayer)
+		}
+		return "", err
+	}
+
+	for _, key := range image.BigDataNames {
+		data, err := s.ImageBigData(image.ID, key)
+		if err == nil {
+			// Keep the digests which were recorded for the original,
+			// which the caller may have computed differently.
+			recorded := image.BigDataDigests[key]
+			err = s.SetImageBigData(clone.ID, key, data, func(data []byte) (digest.Digest, error) {
+				if recorded != "" {
+					return recorded, nil
+				}
+				return digest.Canonical.FromBytes(data), nil
+			})
+		}
+		if err != nil {
+			// this also removes the new top layer, if we created one
+			_, _ = s.DeleteImage(clone.ID, true)
+			return "", errors.Wrapf(err, "error copying data item %q of image %q", key, image.ID)
+		}
+	}
+	return clone.ID, nil
 }
 
 func (s *store) imageTopLayerForMapping(image *Image, ristore ROImageStore, createMappedLayer bool, rlstore LayerStore, lstores []ROLayerStore, options types.IDMappingOptions) (*Layer, error) {
@@ -1385,7 +2335,24 @@ func (s *store) CreateContainer(id string, names []string, image, layer, metadat
 		options.Flags["MountLabel"] = mountLabel
 	}
 
-	clayer, err := rlstore.Create(layer, imageTopLayer, nil, options.Flags["MountLabel"].(string), options.StorageOpt, layerOptions, true)
+	if options.Binds == nil && cimage != nil {
+		options.Binds = cimage.Binds
+	}
+	if err := s.validateBinds(options.Binds); err != nil {
+		return nil, err
+	}
+
+	var layerFlags map[string]interface{}
+	if options.TTL != 0 {
+		layerFlags = withExpiry(nil, options.TTL)
+	}
+	if options.SizeLimit < 0 {
+		return nil, errors.Errorf("invalid container size limit %d", options.SizeLimit)
+	}
+	if options.SizeLimit > 0 {
+		layerFlags = withSizeLimit(layerFlags, options.SizeLimit)
+	}
+	clayer, err := rlstore.CreateWithFlags(layer, imageTopLayer, nil, options.Flags["MountLabel"].(string), options.StorageOpt, layerOptions, true, layerFlags)
 	if err != nil {
 		return nil, err
 	}
@@ -1583,6 +2550,31 @@ func (s *store) ImageBigDataDigest(id, key string) (digest.Digest, error) {
 	return "", ErrDigestUnknown
 }
 
+// immutableImageBigData is a fast path for ImageBigData, which reads the big
+// data item without locking the image stores if the item is named after the
+// digest of its contents, and the image is specified by its full ID, so that
+// neither can refer to something else after the item is found.  The image
+// could have been deleted while the item was read, so the store is only
+// locked afterwards, to check that it still has the image.
+func (s *store) immutableImageBigData(istores []ROImageStore, id, key string) ([]byte, bool) {
+	d, err := digest.Parse(key)
+	if err != nil || !d.Algorithm().Available() || stringid.ValidateID(id) != nil {
+		return nil, false
+	}
+	for _, store := range istores {
+		if istore, ok := store.(*imageStore); ok {
+			if data, ok := istore.immutableBigData(id, d); ok {
+				store.RLock()
+				err := store.ReloadIfChanged()
+				exists := err == nil && store.Exists(id)
+				store.Unlock()
+				return data, exists
+			}
+		}
+	}
+	return nil, false
+}
+
 func (s *store) ImageBigData(id, key string) ([]byte, error) {
 	istore, err := s.ImageStore()
 	if err != nil {
@@ -1592,6 +2584,9 @@ func (s *store) ImageBigData(id, key string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	if data, ok := s.immutableImageBigData(append([]ROImageStore{istore}, istores...), id, key); ok {
+		return data, nil
+	}
 	foundImage := false
 	for _, s := range append([]ROImageStore{istore}, istores...) {
 		store := s
@@ -1910,6 +2905,137 @@ func (s *store) ContainerSize(id string) (int64, error) {
 	return size, nil
 }
 
+func (s *store) ContainerDiskUsage(id string) (int64, error) {
+	driver, err := s.GraphDriver()
+	if err != nil {
+		return -1, err
+	}
+	lstore, err := s.LayerStore()
+	if err != nil {
+		return -1, err
+	}
+	lstores, err := s.ROLayerStores()
+	if err != nil {
+		return -1, err
+	}
+	for _, s := range append([]ROLayerStore{lstore}, lstores...) {
+		store := s
+		store.RLock()
+		defer store.Unlock()
+		if err := store.ReloadIfChanged(); err != nil {
+			return -1, err
+		}
+	}
+	// parent returns the ID of the parent of the layer with the specified
+	// ID, looking it up in all of the layer stores.
+	parent := func(layerID string) (string, error) {
+		for _, store := range append([]ROLayerStore{lstore}, lstores...) {
+			if layer, err := store.Get(layerID); err == nil {
+				return layer.Parent, nil
+			}
+		}
+		return "", errors.Wrapf(ErrLayerUnknown, "error locating layer with ID %q", layerID)
+	}
+
+	// Get the location of the container directory and container run directory.
+	// Do it before we lock the container store because they do, too.
+	cdir, err := s.ContainerDirectory(id)
+	if err != nil {
+		return -1, err
+	}
+	rdir, err := s.ContainerRunDirectory(id)
+	if err != nil {
+		return -1, err
+	}
+
+	rcstore, err := s.ContainerStore()
+	if err != nil {
+		return -1, err
+	}
+	rcstore.RLock()
+	defer rcstore.Unlock()
+	if err := rcstore.ReloadIfChanged(); err != nil {
+		return -1, err
+	}
+	container, err := rcstore.Get(id)
+	if err != nil {
+		return -1, err
+	}
+
+	// Count the containers which use each of the layers below this
+	// container's layer.
+	var chain []string
+	users := make(map[string]int64)
+	for layerID := container.LayerID; ; {
+		if layerID, err = parent(layerID); err != nil {
+			return -1, err
+		}
+		if layerID == "" {
+			break
+		}
+		chain = append(chain, layerID)
+		users[layerID] = 0
+	}
+	containers, err := rcstore.Containers()
+	if err != nil {
+		return -1, err
+	}
+	for _, c := range containers {
+		for layerID := c.LayerID; layerID != ""; {
+			if layerID, err = parent(layerID); err != nil {
+				// Another container's layer may be missing, but
+				// it doesn't use the layers we are interested in.
+				break
+			}
+			if _, ok := users[layerID]; ok {
+				users[layerID]++
+			}
+		}
+	}
+
+	// Count the writable part of the container's layer, and the
+	// container's share of each of the layers below it.
+	usage, err := driver.ReadWriteDiskUsage(container.LayerID)
+	if err != nil {
+		return -1, errors.Wrapf(err, "error determining disk usage of layer with ID %q", container.LayerID)
+	}
+	size := usage.Size
+	for _, layerID := range chain {
+		usage, err := driver.ReadWriteDiskUsage(layerID)
+		if err != nil {
+			return -1, errors.Wrapf(err, "error determining disk usage of layer with ID %q", layerID)
+		}
+		size += usage.Size / users[layerID]
+	}
+
+	// Count big data items.
+	names, err := rcstore.BigDataNames(id)
+	if err != nil {
+		return -1, errors.Wrapf(err, "error reading list of big data items for container %q", container.ID)
+	}
+	for _, name := range names {
+		n, err := rcstore.BigDataSize(id, name)
+		if err != nil {
+			return -1, errors.Wrapf(err, "error reading size of big data item %q for container %q", name, id)
+		}
+		size += n
+	}
+
+	// Count the size of our container directory and container run directory.
+	n, err := directory.Size(cdir)
+	if err != nil {
+		return -1, err
+	}
+	size += n
+	n, err = directory.Size(rdir)
+	if err != nil {
+		return -1, err
+	}
+	size += n
+
+	return size, nil
+}
+
 func (s *store) ListContainerBigData(id string) ([]string, error) {
 	rcstore, err := s.ContainerStore()
 	if err != nil {
@@ -2046,9 +3172,67 @@ func dedupeNames(names []string) []string {
 	return deduped
 }
 
+// nameOperation selects how updateNames combines the names which an item
+// already has with the ones it is passed.
+type nameOperation int
+
+const (
+	setNamesOp nameOperation = iota
+	addNamesOp
+	removeNamesOp
+)
+
+// apply returns the list of names that an item which currently has oldNames
+// has once the operation is carried out.
+func (op nameOperation) apply(oldNames, names []string) []string {
+	switch op {
+	case addNamesOp:
+		return dedupeNames(append(append([]string{}, oldNames...), names...))
+	case removeNamesOp:
+		result := append([]string{}, oldNames...)
+		for _, name := range names {
+			result = stringSliceWithoutValue(result, name)
+		}
+		return result
+	}
+	return dedupeNames(names)
+}
+
+// checkNames returns ErrDuplicateName, when adding names, if any of names is
+// assigned to an item other than the one with the specified ID, according to
+// owners, which maps names to the IDs of the items they are assigned to.
+// Setting names moves the ones which are in use to the item instead.
+func (op nameOperation) checkNames(kind, id string, names []string, owners map[string]string) error {
+	if op != addNamesOp {
+		return nil
+	}
+	for _, name := range names {
+		if owner, ok := owners[name]; ok && owner != id {
+			return errors.Wrapf(ErrDuplicateName, "%s name %q is already associated with %s %q", kind, name, kind, owner)
+		}
+	}
+	return nil
+}
+
 func (s *store) SetNames(id string, names []string) error {
-	deduped := dedupeNames(names)
+	return s.updateNames(id, names, setNamesOp)
+}
+
+func (s *store) AddNames(id string, names []string) error {
+	return s.updateNames(id, names, addNamesOp)
+}
+
+func (s *store) RemoveNames(id string, names []string) error {
+	return s.updateNames(id, names, removeNamesOp)
+}
 
+// updateNames changes the list of names of the layer, image, or container
+// with the specified ID.  The names which are added by AddNames are checked
+// against the ones of all of the items of the same kind, in the read-write
+// store and in the read-only ones, while holding their locks, so that either
+// all of the names are assigned to the item or, if any of them is already
+// taken, none are.
+func (s *store) updateNames(id string, names []string, op nameOperation) error {
 	rlstore, err := s.LayerStore()
 	if err != nil {
 		return err
@@ -2059,7 +3243,39 @@ func (s *store) SetNames(id string, names []string) error {
 		return err
 	}
 	if rlstore.Exists(id) {
-		return rlstore.SetNames(id, deduped)
+		layer, err := rlstore.Get(id)
+		if err != nil {
+			return err
+		}
+		rlstores, err := s.ROLayerStores()
+		if err != nil {
+			return err
+		}
+		owners := make(map[string]string)
+		for _, s := range append([]ROLayerStore{rlstore}, rlstores...) {
+			store := s
+			if store != rlstore {
+				store.RLock()
+				defer store.Unlock()
+				if err := store.ReloadIfChanged(); err != nil {
+					return err
+				}
+			}
+			layers, err := store.Layers()
+			if err != nil {
+				return err
+			}
+			for _, l := range layers {
+				for _, name := range l.Names {
+					owners[name] = l.ID
+				}
+			}
+		}
+		newNames := op.apply(layer.Names, names)
+		if err := op.checkNames("layer", layer.ID, newNames, owners); err != nil {
+			return err
+		}
+		return rlstore.SetNames(layer.ID, newNames)
 	}
 
 	ristore, err := s.ImageStore()
@@ -2071,28 +3287,60 @@ func (s *store) SetNames(id string, names []string) error {
 	if err := ristore.ReloadIfChanged(); err != nil {
 		return err
 	}
-	if ristore.Exists(id) {
-		return ristore.SetNames(id, deduped)
-	}
-
-	// Check is id refers to a RO Store
 	ristores, err := s.ROImageStores()
 	if err != nil {
 		return err
 	}
-	for _, s := range ristores {
+	imageOwners := make(map[string]string)
+	for _, s := range append([]ROImageStore{ristore}, ristores...) {
 		store := s
-		store.RLock()
-		defer store.Unlock()
-		if err := store.ReloadIfChanged(); err != nil {
+		if store != ristore {
+			store.RLock()
+			defer store.Unlock()
+			if err := store.ReloadIfChanged(); err != nil {
+				return err
+			}
+		}
+		images, err := store.Images()
+		if err != nil {
 			return err
 		}
+		for _, i := range images {
+			for _, name := range i.Names {
+				imageOwners[name] = i.ID
+			}
+		}
+	}
+	if ristore.Exists(id) {
+		image, err := ristore.Get(id)
+		if err != nil {
+			return err
+		}
+		newNames := op.apply(image.Names, names)
+		if err := op.checkNames("image", image.ID, newNames, imageOwners); err != nil {
+			return err
+		}
+		return ristore.SetNames(image.ID, newNames)
+	}
+
+	// Check is id refers to a RO Store
+	for _, store := range ristores {
 		if i, err := store.Get(id); err == nil {
-			if len(deduped) > 1 {
+			if op == removeNamesOp {
+				return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to remove names of image %q from a read-only store", i.ID)
+			}
+			newNames := op.apply(i.Names, names)
+			if err := op.checkNames("image", i.ID, newNames, imageOwners); err != nil {
+				return err
+			}
+			if op == addNamesOp {
+				// The names the image already has stay in the read-only store
+				newNames = newNames[len(i.Names):]
+			} else if len(newNames) > 1 {
 				// Do not want to create image name in R/W storage
-				deduped = deduped[1:]
+				newNames = newNames[1:]
 			}
-			_, err := ristore.Create(id, deduped, i.TopLayer, i.Metadata, i.Created, i.Digest)
+			_, err = ristore.Create(i.ID, newNames, i.TopLayer, i.Metadata, i.Created, i.Digest)
 			if err == nil {
 				return ristore.Save()
 			}
@@ -2110,7 +3358,25 @@ func (s *store) SetNames(id string, names []string) error {
 		return err
 	}
 	if rcstore.Exists(id) {
-		return rcstore.SetNames(id, deduped)
+		container, err := rcstore.Get(id)
+		if err != nil {
+			return err
+		}
+		containers, err := rcstore.Containers()
+		if err != nil {
+			return err
+		}
+		owners := make(map[string]string)
+		for _, c := range containers {
+			for _, name := range c.Names {
+				owners[name] = c.ID
+			}
+		}
+		newNames := op.apply(container.Names, names)
+		if err := op.checkNames("container", container.ID, newNames, owners); err != nil {
+			return err
+		}
+		return rcstore.SetNames(container.ID, newNames)
 	}
 	return ErrLayerUnknown
 }
@@ -2229,6 +3495,13 @@ func (s *store) Lookup(name string) (string, error) {
 }
 
 func (s *store) DeleteLayer(id string) error {
+	return s.DeleteLayerWithOptions(id, nil)
+}
+
+func (s *store) DeleteLayerWithOptions(id string, options *DeleteLayerOptions) error {
+	if options == nil {
+		options = &DeleteLayerOptions{}
+	}
 	rlstore, err := s.LayerStore()
 	if err != nil {
 		return err
@@ -2261,6 +3534,8 @@ func (s *store) DeleteLayer(id string) error {
 	if rlstore.Exists(id) {
 		if l, err := rlstore.Get(id); err != nil {
 			id = l.ID
+		} else if layerIsPinned(l) && !options.Force {
+			return errors.Wrapf(ErrLayerPinned, "layer %v", l.ID)
 		}
 		layers, err := rlstore.Layers()
 		if err != nil {
@@ -2296,24 +3571,39 @@ func (s *store) DeleteLayer(id string) error {
 				return errors.Wrapf(ErrLayerUsedByContainer, "layer %v used by container %v", id, container.ID)
 			}
 		}
-		if err := rlstore.Delete(id); err != nil {
-			return errors.Wrapf(err, "delete layer %v", id)
+		record, err := s.beginJournal(journalEntry{Operation: journalDeleteLayers, Layers: []string{id}})
+		if err != nil {
+			return err
 		}
+		err = s.deleteLayerAndMappings(rlstore, ristore, images, id)
+		record.finish(err)
+		return err
+	}
+	return ErrNotALayer
+}
 
-		// The check here is used to avoid iterating the images if we don't need to.
-		// There is already a check above for the imageStore to be writeable when the layer is part of MappedTopLayers.
-		if istore, ok := ristore.(*imageStore); ok {
-			for _, image := range images {
-				if stringutils.InSlice(image.MappedTopLayers, id) {
-					if err = istore.removeMappedTopLayer(image.ID, id); err != nil {
-						return errors.Wrapf(err, "remove mapped top layer %v from image %v", id, image.ID)
-					}
+// deleteLayerAndMappings deletes a layer, and removes it from the images
+// which list it as a mapped top layer.
+func (s *store) deleteLayerAndMappings(rlstore LayerStore, ristore ImageStore, images []Image, id string) error {
+	if err := rlstore.Delete(id); err != nil {
+		return errors.Wrapf(err, "delete layer %v", id)
+	}
+	if s.journalCrash.at("layer-deleted") {
+		return errJournalCrash
+	}
+
+	// The check here is used to avoid iterating the images if we don't need to.
+	// There is already a check above for the imageStore to be writeable when the layer is part of MappedTopLayers.
+	if istore, ok := ristore.(*imageStore); ok {
+		for _, image := range images {
+			if stringutils.InSlice(image.MappedTopLayers, id) {
+				if err := istore.removeMappedTopLayer(image.ID, id); err != nil {
+					return errors.Wrapf(err, "remove mapped top layer %v from image %v", id, image.ID)
 				}
 			}
 		}
-		return nil
 	}
-	return ErrNotALayer
+	return nil
 }
 
 func (s *store) DeleteImage(id string, commit bool) (layers []string, err error) {
@@ -2384,8 +3674,11 @@ func (s *store) DeleteImage(id string, commit bool) (layers []string, err error)
 				}
 			}
 		}
-		if commit {
-			if err = ristore.Delete(id); err != nil {
+		// the layers of a store without a namespace can be the shared
+		// base layers of the stores which use its graph root with one
+		var namespaceUsers map[string]error
+		if s.namespace == "" {
+			if namespaceUsers, err = s.namespaceLayerUsers(); err != nil {
 				return nil, err
 			}
 		}
@@ -2398,8 +3691,29 @@ func (s *store) DeleteImage(id string, commit bool) (layers []string, err error)
 			if _, used := otherImagesTopLayers[layer]; used {
 				break
 			}
+			usedByNamespaces := func() bool {
+				layersToCheck := []string{layer}
+				if layer == image.TopLayer {
+					layersToCheck = append(layersToCheck, image.MappedTopLayers...)
+				}
+				for _, layer := range layersToCheck {
+					if err, used := namespaceUsers[layer]; used {
+						logrus.Debugf("Keeping layer %q: %v", layer, err)
+						return true
+					}
+				}
+				return false
+			}
+			if usedByNamespaces() {
+				// it is a shared base layer of a namespaced store
+				break
+			}
 			parent := ""
 			if l, err := rlstore.Get(layer); err == nil {
+				if layerIsPinned(l) {
+					// it is kept, and so are the layers it is based on
+					break
+				}
 				parent = l.Parent
 			}
 			hasChildrenNotBeingRemoved := func() bool {
@@ -2436,10 +3750,23 @@ func (s *store) DeleteImage(id string, commit bool) (layers []string, err error)
 		return nil, ErrNotAnImage
 	}
 	if commit {
-		for _, layer := range layersToRemove {
-			if err = rlstore.Delete(layer); err != nil {
-				return nil, err
-			}
+		var record *journalRecord
+		if record, err = s.beginJournal(journalEntry{Operation: journalDeleteImage, Images: []string{id}, Layers: layersToRemove}); err != nil {
+			return nil, err
+		}
+		defer func() {
+			record.finish(err)
+		}()
+		if err = ristore.Delete(id); err != nil {
+			return nil, err
+		}
+		if s.journalCrash.at("image-deleted") {
+			return nil, errJournalCrash
+		}
+		for _, layer := range layersToRemove {
+			if err = rlstore.Delete(layer); err != nil {
+				return nil, err
+			}
 		}
 	}
 	return layersToRemove, nil
@@ -2477,6 +3804,22 @@ func (s *store) DeleteContainer(id string) error {
 
 	if rcstore.Exists(id) {
 		if container, err := rcstore.Get(id); err == nil {
+			if l, err := rlstore.Get(container.LayerID); err == nil && layerIsPinned(l) {
+				return errors.Wrapf(ErrLayerPinned, "layer %v of container %v", l.ID, container.ID)
+			}
+			if l, err := rlstore.Get(container.LayerID); err == nil && l.MountCount > 0 {
+				if err := unmountBinds(l.MountPoint, container.Binds); err != nil {
+					return err
+				}
+			}
+			entry := journalEntry{Operation: journalDeleteContainer, Containers: []string{container.ID}}
+			if rlstore.Exists(container.LayerID) {
+				entry.Layers = []string{container.LayerID}
+			}
+			record, err := s.beginJournal(entry)
+			if err != nil {
+				return err
+			}
 			errChan := make(chan error)
 			var wg sync.WaitGroup
 
@@ -2526,7 +3869,9 @@ func (s *store) DeleteContainer(id string) error {
 				select {
 				case err, ok := <-errChan:
 					if !ok {
-						return multierror.Append(nil, errors...).ErrorOrNil()
+						err := multierror.Append(nil, errors...).ErrorOrNil()
+						record.finish(err)
+						return err
 					}
 					if err != nil {
 						errors = append(errors, err)
@@ -2571,6 +3916,9 @@ func (s *store) Delete(id string) error {
 	if rcstore.Exists(id) {
 		if container, err := rcstore.Get(id); err == nil {
 			if rlstore.Exists(container.LayerID) {
+				if l, err := rlstore.Get(container.LayerID); err == nil && layerIsPinned(l) {
+					return errors.Wrapf(ErrLayerPinned, "layer %v of container %v", l.ID, container.ID)
+				}
 				if err = rlstore.Delete(container.LayerID); err != nil {
 					return err
 				}
@@ -2595,11 +3943,168 @@ func (s *store) Delete(id string) error {
 		return ristore.Delete(id)
 	}
 	if rlstore.Exists(id) {
+		if l, err := rlstore.Get(id); err == nil && layerIsPinned(l) {
+			return errors.Wrapf(ErrLayerPinned, "layer %v", l.ID)
+		}
 		return rlstore.Delete(id)
 	}
 	return ErrLayerUnknown
 }
 
+// layerIsPinned checks if the layer was pinned with PinLayer.
+func layerIsPinned(layer *Layer) bool {
+	_, pinned := layer.Flags[pinnedFlag]
+	return pinned
+}
+
+func (s *store) PinLayer(id string) error {
+	rlstore, err := s.LayerStore()
+	if err != nil {
+		return err
+	}
+	rlstore.Lock()
+	defer rlstore.Unlock()
+	if err := rlstore.ReloadIfChanged(); err != nil {
+		return err
+	}
+	return rlstore.SetFlag(id, pinnedFlag, true)
+}
+
+func (s *store) UnpinLayer(id string) error {
+	rlstore, err := s.LayerStore()
+	if err != nil {
+		return err
+	}
+	rlstore.Lock()
+	defer rlstore.Unlock()
+	if err := rlstore.ReloadIfChanged(); err != nil {
+		return err
+	}
+	return rlstore.ClearFlag(id, pinnedFlag)
+}
+
+// withExpiry returns a copy of flags which records that a layer expires once
+// ttl has passed.
+func withExpiry(flags map[string]interface{}, ttl time.Duration) map[string]interface{} {
+	result := make(map[string]interface{}, len(flags)+1)
+	for k, v := range flags {
+		result[k] = v
+	}
+	result[expiresFlag] = time.Now().Add(ttl).UTC().Format(time.RFC3339Nano)
+	return result
+}
+
+// layerExpired checks if the layer was created with a TTL which has passed
+// at the specified time.
+func layerExpired(layer *Layer, now time.Time) bool {
+	value, ok := layer.Flags[expiresFlag].(string)
+	if !ok {
+		return false
+	}
+	expires, err := time.Parse(time.RFC3339Nano, value)
+	return err == nil && now.After(expires)
+}
+
+func (s *store) ExpireStale() ([]string, error) {
+	rlstore, err := s.LayerStore()
+	if err != nil {
+		return nil, err
+	}
+	ristore, err := s.ImageStore()
+	if err != nil {
+		return nil, err
+	}
+	rcstore, err := s.ContainerStore()
+	if err != nil {
+		return nil, err
+	}
+
+	rlstore.Lock()
+	defer rlstore.Unlock()
+	if err := rlstore.ReloadIfChanged(); err != nil {
+		return nil, err
+	}
+	ristore.Lock()
+	defer ristore.Unlock()
+	if err := ristore.ReloadIfChanged(); err != nil {
+		return nil, err
+	}
+	rcstore.Lock()
+	defer rcstore.Unlock()
+	if err := rcstore.ReloadIfChanged(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var removed []string
+	// Removing a layer can leave its parent unused, so keep going until
+	// there's nothing left to remove.
+	for {
+		layers, err := rlstore.Layers()
+		if err != nil {
+			return removed, err
+		}
+		images, err := ristore.Images()
+		if err != nil {
+			return removed, err
+		}
+		containers, err := rcstore.Containers()
+		if err != nil {
+			return removed, err
+		}
+		inUse := make(map[string]bool)
+		for _, layer := range layers {
+			if layer.Parent != "" {
+				inUse[layer.Parent] = true
+			}
+		}
+		for _, image := range images {
+			inUse[image.TopLayer] = true
+			for _, layerID := range image.MappedTopLayers {
+				inUse[layerID] = true
+			}
+		}
+		layerContainers := make(map[string]string)
+		for _, container := range containers {
+			layerContainers[container.LayerID] = container.ID
+		}
+
+		done := true
+		for i := range layers {
+			layer := &layers[i]
+			if !layerExpired(layer, now) || layerIsPinned(layer) || inUse[layer.ID] {
+				continue
+			}
+			mounted, err := rlstore.Mounted(layer.ID)
+			if err != nil {
+				return removed, err
+			}
+			if mounted > 0 {
+				continue
+			}
+			if err := rlstore.Delete(layer.ID); err != nil {
+				return removed, errors.Wrapf(err, "removing expired layer %q", layer.ID)
+			}
+			removed = append(removed, layer.ID)
+			done = false
+			if containerID, ok := layerContainers[layer.ID]; ok {
+				if err := rcstore.Delete(containerID); err != nil {
+					return removed, errors.Wrapf(err, "removing container %q of expired layer %q", containerID, layer.ID)
+				}
+				middleDir := s.graphDriverName + "-containers"
+				for _, dir := range []string{s.GraphRoot(), s.RunRoot()} {
+					if err := os.RemoveAll(filepath.Join(dir, middleDir, containerID)); err != nil {
+						return removed, err
+					}
+				}
+			}
+		}
+		if done {
+			return removed, nil
+		}
+	}
+}
+
 func (s *store) Wipe() error {
 	rcstore, err := s.ContainerStore()
 	if err != nil {
@@ -2651,7 +4156,9 @@ func (s *store) Version() ([][2]string, error) {
 	return [][2]string{}, nil
 }
 
-func (s *store) mount(id string, options drivers.MountOpts) (string, error) {
+// mount mounts the layer with the specified ID and, if it was not already
+// mounted, mounts binds in it.
+func (s *store) mount(id string, options drivers.MountOpts, binds []ReadOnlyBind) (string, error) {
 	rlstore, err := s.LayerStore()
 	if err != nil {
 		return "", err
@@ -2686,7 +4193,27 @@ func (s *store) mount(id string, options drivers.MountOpts) (string, error) {
 	}
 
 	if rlstore.Exists(id) {
-		return rlstore.Mount(id, options)
+		if err := s.materializeLazyLayers(rlstore, id); err != nil {
+			return "", err
+		}
+		mountPoint, err := rlstore.Mount(id, options)
+		if err != nil {
+			return "", err
+		}
+		if len(binds) > 0 {
+			if mounted, err := rlstore.Mounted(id); err == nil && mounted == 1 {
+				if err := s.mountBinds(mountPoint, binds); err != nil {
+					if _, err2 := rlstore.Unmount(id, false); err2 != nil {
+						logrus.Errorf("Unmounting layer %q: %v", id, err2)
+					}
+					return "", err
+				}
+			}
+		}
+		if s.prefetchOnMount {
+			s.prefetchMountedLayer(rlstore, id, mountPoint)
+		}
+		return mountPoint, nil
 	}
 	return "", ErrLayerUnknown
 }
@@ -2706,27 +4233,51 @@ func (s *store) MountImage(id string, mountOpts []string, mountLabel string) (st
 		Options:    append(mountOpts, "ro"),
 	}
 
-	return s.mount(img.TopLayer, options)
+	return s.mount(img.TopLayer, options, img.Binds)
+}
+
+func (s *store) MountReadOnly(id string) (string, error) {
+	options := drivers.MountOpts{
+		Options: []string{"ro"},
+	}
+	return s.mount(id, options, nil)
 }
 
 func (s *store) Mount(id, mountLabel string) (string, error) {
+	return s.MountWithOptions(id, mountLabel, nil)
+}
+
+func (s *store) MountWithOptions(id, mountLabel string, mountOpts []string) (string, error) {
 	options := drivers.MountOpts{
 		MountLabel: mountLabel,
 	}
+	var binds []ReadOnlyBind
 	// check if `id` is a container, then grab the LayerID, uidmap and gidmap, along with
 	// otherwise we assume the id is a LayerID and attempt to mount it.
 	if container, err := s.Container(id); err == nil {
 		id = container.LayerID
 		options.UidMaps = container.UIDMap
 		options.GidMaps = container.GIDMap
-		options.Options = container.MountOpts()
+		options.Options = copyStringSlice(container.MountOpts())
+		binds = container.Binds
 		if !s.disableVolatile {
 			if v, found := container.Flags["Volatile"]; found {
 				options.Volatile = v.(bool)
 			}
 		}
 	}
-	return s.mount(id, options)
+	for _, opt := range mountOpts {
+		if opt == "volatile" {
+			// Let the driver decide how to honor this, the same
+			// way it does for volatile containers.
+			if !s.disableVolatile {
+				options.Volatile = true
+			}
+			continue
+		}
+		options.Options = append(options.Options, opt)
+	}
+	return s.mount(id, options, binds)
 }
 
 func (s *store) Mounted(id string) (int, error) {
@@ -2768,6 +4319,20 @@ func (s *store) Unmount(id string, force bool) (bool, error) {
 		return false, err
 	}
 	if rlstore.Exists(id) {
+		layer, err := rlstore.Get(id)
+		if err != nil {
+			return false, err
+		}
+		if layer.MountCount > 0 && (force || layer.MountCount == 1) {
+			s.stopPrefetch(layer.ID)
+			binds, err := s.layerBinds(layer.ID)
+			if err != nil {
+				return false, err
+			}
+			if err := unmountBinds(layer.MountPoint, binds); err != nil {
+				return true, err
+			}
+		}
 		return rlstore.Unmount(id, force)
 	}
 	return false, ErrLayerUnknown
@@ -2819,7 +4384,11 @@ func (s *store) DiffSize(from, to string) (int64, error) {
 	return -1, ErrLayerUnknown
 }
 
-func (s *store) Diff(from, to string, options *DiffOptions) (io.ReadCloser, error) {
+// layerReadCloser calls f with the first layer store which contains the layer
+// id, and returns the resulting stream, which keeps the layer store locked
+// until it is closed.  The graph lock is held while f runs, since reading a
+// layer's contents could require mounting it.
+func (s *store) layerReadCloser(id string, f func(ROLayerStore) (io.ReadCloser, error)) (io.ReadCloser, error) {
 	lstore, err := s.LayerStore()
 	if err != nil {
 		return nil, err
@@ -2857,8 +4426,8 @@ func (s *store) Diff(from, to string, options *DiffOptions) (io.ReadCloser, erro
 			store.Unlock()
 			return nil, err
 		}
-		if store.Exists(to) {
-			rc, err := store.Diff(from, to, options)
+		if store.Exists(id) {
+			rc, err := f(store)
 			if rc != nil && err == nil {
 				wrapped := ioutils.NewReadCloserWrapper(rc, func() error {
 					err := rc.Close()
@@ -2875,6 +4444,24 @@ func (s *store) Diff(from, to string, options *DiffOptions) (io.ReadCloser, erro
 	return nil, ErrLayerUnknown
 }
 
+func (s *store) Diff(from, to string, options *DiffOptions) (io.ReadCloser, error) {
+	return s.layerReadCloser(to, func(store ROLayerStore) (io.ReadCloser, error) {
+		return store.Diff(from, to, options)
+	})
+}
+
+func (s *store) TarSplitStream(id string) (io.ReadCloser, error) {
+	return s.layerReadCloser(id, func(store ROLayerStore) (io.ReadCloser, error) {
+		return store.TarSplit(id)
+	})
+}
+
+func (s *store) AssembleTar(id string) (io.ReadCloser, error) {
+	return s.layerReadCloser(id, func(store ROLayerStore) (io.ReadCloser, error) {
+		return store.AssembleTar(id)
+	})
+}
+
 func (s *store) ApplyDiffFromStagingDirectory(to, stagingDirectory string, diffOutput *drivers.DriverWithDifferOutput, options *drivers.ApplyDiffOpts) error {
 	rlstore, err := s.LayerStore()
 	if err != nil {
@@ -2955,7 +4542,11 @@ func (s *store) ApplyDiff(to string, diff io.Reader) (int64, error) {
 		return -1, err
 	}
 	if rlstore.Exists(to) {
-		return rlstore.ApplyDiff(to, diff)
+		size, err := rlstore.ApplyDiff(to, diff)
+		if err != nil {
+			return size, err
+		}
+		return size, checkSizeLimit(rlstore, to)
 	}
 	return -1, ErrLayerUnknown
 }
@@ -3007,6 +4598,53 @@ func (s *store) LayersByUncompressedDigest(d digest.Digest) ([]Layer, error) {
 	return s.layersByMappedDigest(func(r ROLayerStore, d digest.Digest) ([]Layer, error) { return r.LayersByUncompressedDigest(d) }, d)
 }
 
+func (s *store) MissingLayers(diffIDs []digest.Digest) ([]digest.Digest, error) {
+	for _, d := range diffIDs {
+		if err := d.Validate(); err != nil {
+			return nil, errors.Wrapf(err, "error looking for layers matching digest %q", d)
+		}
+	}
+	lstore, err := s.LayerStore()
+	if err != nil {
+		return nil, err
+	}
+	lstores, err := s.ROLayerStores()
+	if err != nil {
+		return nil, err
+	}
+	present := make(map[digest.Digest]bool)
+	for _, s := range append([]ROLayerStore{lstore}, lstores...) {
+		store := s
+		store.RLock()
+		defer store.Unlock()
+		if err := store.ReloadIfChanged(); err != nil {
+			return nil, err
+		}
+		for _, d := range diffIDs {
+			if present[d] {
+				continue
+			}
+			layers, err := store.LayersByUncompressedDigest(d)
+			if err != nil {
+				if errors.Cause(err) != ErrLayerUnknown {
+					return nil, err
+				}
+				continue
+			}
+			present[d] = len(layers) > 0
+		}
+	}
+	var missing []digest.Digest
+	for _, d := range diffIDs {
+		if !present[d] {
+			missing = append(missing, d)
+			// only listed once
+			present[d] = true
+		}
+	}
+	return missing, nil
+}
+
 func (s *store) LayerSize(id string) (int64, error) {
 	lstore, err := s.LayerStore()
 	if err != nil {
@@ -3046,6 +4684,405 @@ func (s *store) LayerParentOwners(id string) ([]int, []int, error) {
 	return nil, nil, ErrLayerUnknown
 }
 
+func (s *store) VerifyLayer(id string) error {
+	return s.verifyLayer(id, nil)
+}
+
+// verifyLayer is VerifyLayer, which ends early if stop is closed.
+func (s *store) verifyLayer(id string, stop <-chan struct{}) error {
+	lstore, err := s.LayerStore()
+	if err != nil {
+		return err
+	}
+	lstores, err := s.ROLayerStores()
+	if err != nil {
+		return err
+	}
+	for _, s := range append([]ROLayerStore{lstore}, lstores...) {
+		store := s
+		store.RLock()
+		defer store.Unlock()
+		if err := store.ReloadIfChanged(); err != nil {
+			return err
+		}
+		if store.Exists(id) {
+			return store.Verify(id, stop)
+		}
+	}
+	return ErrLayerUnknown
+}
+
+func (s *store) RepairLayers() ([]string, error) {
+	driver, err := s.GraphDriver()
+	if err != nil {
+		return nil, err
+	}
+	repairer, ok := driver.(drivers.RepairDriver)
+	if !ok {
+		return nil, errors.Wrapf(ErrNotSupported, "repairing layers with the %q driver", driver.String())
+	}
+	rlstore, err := s.LayerStore()
+	if err != nil {
+		return nil, err
+	}
+	rlstore.Lock()
+	defer rlstore.Unlock()
+	if err := rlstore.ReloadIfChanged(); err != nil {
+		return nil, err
+	}
+	layers, err := rlstore.Layers()
+	if err != nil {
+		return nil, err
+	}
+
+	lstores, err := s.ROLayerStores()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range lstores {
+		store := s
+		store.RLock()
+		defer store.Unlock()
+		if err := store.ReloadIfChanged(); err != nil {
+			return nil, err
+		}
+		storeLayers, err := store.Layers()
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, storeLayers...)
+	}
+
+	parents := make(map[string]string, len(layers))
+	for _, layer := range layers {
+		parents[layer.ID] = layer.Parent
+	}
+	return repairer.Repair(parents)
+}
+
+func (s *store) Check(options *CheckOptions) (CheckReport, error) {
+	var report CheckReport
+	if options == nil {
+		options = &CheckOptions{}
+	}
+	rlstore, err := s.LayerStore()
+	if err != nil {
+		return report, err
+	}
+	ristore, err := s.ImageStore()
+	if err != nil {
+		return report, err
+	}
+	rcstore, err := s.ContainerStore()
+	if err != nil {
+		return report, err
+	}
+
+	rlstore.Lock()
+	defer rlstore.Unlock()
+	if err := rlstore.ReloadIfChanged(); err != nil {
+		return report, err
+	}
+	ristore.Lock()
+	defer ristore.Unlock()
+	if err := ristore.ReloadIfChanged(); err != nil {
+		return report, err
+	}
+	rcstore.Lock()
+	defer rcstore.Unlock()
+	if err := rcstore.ReloadIfChanged(); err != nil {
+		return report, err
+	}
+
+	layers, err := rlstore.Layers()
+	if err != nil {
+		return report, err
+	}
+	allLayers := layers
+	lstores, err := s.ROLayerStores()
+	if err != nil {
+		return report, err
+	}
+	for _, s := range lstores {
+		store := s
+		store.RLock()
+		defer store.Unlock()
+		if err := store.ReloadIfChanged(); err != nil {
+			return report, err
+		}
+		storeLayers, err := store.Layers()
+		if err != nil {
+			return report, err
+		}
+		allLayers = append(allLayers, storeLayers...)
+	}
+	images, err := ristore.Images()
+	if err != nil {
+		return report, err
+	}
+	allImages := images
+	istores, err := s.ROImageStores()
+	if err != nil {
+		return report, err
+	}
+	for _, s := range istores {
+		store := s
+		store.RLock()
+		defer store.Unlock()
+		if err := store.ReloadIfChanged(); err != nil {
+			return report, err
+		}
+		storeImages, err := store.Images()
+		if err != nil {
+			return report, err
+		}
+		allImages = append(allImages, storeImages...)
+	}
+	containers, err := rcstore.Containers()
+	if err != nil {
+		return report, err
+	}
+
+	// A layer is usable if it and all of its ancestors exist.
+	parents := make(map[string]string, len(allLayers))
+	for _, layer := range allLayers {
+		parents[layer.ID] = layer.Parent
+	}
+	broken := make(map[string]bool)
+	var isBroken func(id string) bool
+	isBroken = func(id string) bool {
+		if b, ok := broken[id]; ok {
+			return b
+		}
+		// guard against loops while we walk up
+		broken[id] = false
+		parent := parents[id]
+		_, parentExists := parents[parent]
+		b := parent != "" && (!parentExists || isBroken(parent))
+		broken[id] = b
+		return b
+	}
+	for _, layer := range allLayers {
+		if _, ok := parents[layer.Parent]; layer.Parent != "" && !ok {
+			if report.LayersWithMissingParents == nil {
+				report.LayersWithMissingParents = make(map[string]string)
+			}
+			report.LayersWithMissingParents[layer.ID] = layer.Parent
+		}
+		isBroken(layer.ID)
+	}
+	for _, image := range allImages {
+		for _, layer := range append([]string{image.TopLayer}, image.MappedTopLayers...) {
+			if _, ok := parents[layer]; layer != "" && !ok {
+				if report.ImagesWithMissingLayers == nil {
+					report.ImagesWithMissingLayers = make(map[string][]string)
+				}
+				report.ImagesWithMissingLayers[image.ID] = append(report.ImagesWithMissingLayers[image.ID], layer)
+			}
+		}
+	}
+	for _, container := range containers {
+		if _, ok := parents[container.LayerID]; !ok {
+			if report.ContainersWithMissingLayers == nil {
+				report.ContainersWithMissingLayers = make(map[string]string)
+			}
+			report.ContainersWithMissingLayers[container.ID] = container.LayerID
+		}
+	}
+
+	if report.OrphanedPaths, err = s.orphanedPaths(layers, allLayers, images, containers); err != nil {
+		return report, err
+	}
+
+	if !options.Repair {
+		return report, nil
+	}
+
+	// Delete the unusable layers, children before their parents.
+	remaining := 0
+	for _, layer := range layers {
+		if broken[layer.ID] {
+			remaining++
+		}
+	}
+	for remaining > 0 {
+		deleted := 0
+		for _, layer := range layers {
+			if !broken[layer.ID] || !rlstore.Exists(layer.ID) || layerIsPinned(&layer) {
+				continue
+			}
+			hasChildren := false
+			for _, child := range layers {
+				if child.Parent == layer.ID && rlstore.Exists(child.ID) {
+					hasChildren = true
+					break
+				}
+			}
+			if hasChildren {
+				continue
+			}
+			if err := rlstore.Delete(layer.ID); err != nil {
+				return report, errors.Wrapf(err, "delete layer %v", layer.ID)
+			}
+			delete(parents, layer.ID)
+			report.RemovedLayers = append(report.RemovedLayers, layer.ID)
+			deleted++
+		}
+		if deleted == 0 {
+			// the rest have children which we aren't allowed to remove
+			break
+		}
+		remaining -= deleted
+	}
+
+	for _, image := range images {
+		if _, ok := parents[image.TopLayer]; image.TopLayer != "" && !ok {
+			if err := ristore.Delete(image.ID); err != nil {
+				return report, errors.Wrapf(err, "delete image %v", image.ID)
+			}
+			report.RemovedImages = append(report.RemovedImages, image.ID)
+			continue
+		}
+		for _, layer := range image.MappedTopLayers {
+			if _, ok := parents[layer]; ok {
+				continue
+			}
+			istore, ok := ristore.(*imageStore)
+			if !ok {
+				break
+			}
+			if err := istore.removeMappedTopLayer(image.ID, layer); err != nil {
+				return report, errors.Wrapf(err, "remove mapped top layer %v from image %v", layer, image.ID)
+			}
+		}
+	}
+
+	middleDir := s.graphDriverName + "-containers"
+	for _, container := range containers {
+		if _, ok := parents[container.LayerID]; ok {
+			continue
+		}
+		if err := rcstore.Delete(container.ID); err != nil {
+			return report, errors.Wrapf(err, "delete container %v", container.ID)
+		}
+		if err := os.RemoveAll(filepath.Join(s.GraphRoot(), middleDir, container.ID)); err != nil {
+			return report, err
+		}
+		if err := os.RemoveAll(filepath.Join(s.RunRoot(), middleDir, container.ID)); err != nil {
+			return report, err
+		}
+		report.RemovedContainers = append(report.RemovedContainers, container.ID)
+	}
+
+	for _, path := range report.OrphanedPaths {
+		if err := os.RemoveAll(path); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// driverLayerDirs maps the names of the drivers whose per-layer directories
+// we know how to find to the subdirectory of the driver's home directory
+// which holds them, and to the names of the other directories kept there.
+var driverLayerDirs = map[string]struct {
+	subdir   string
+	reserved []string
+}{
+	"overlay": {"", []string{"l", "trash", "staging"}},
+	"vfs":     {"dir", nil},
+	"btrfs":   {"subvolumes", nil},
+}
+
+// orphanedPaths returns the directories and files in the store's metadata
+// directories which are named after layers, images, or containers which
+// aren't in the read-write stores' lists, and the directories in the graph
+// driver's home directory which are named after layers which aren't in the
+// lists of any of the layer stores.
+func (s *store) orphanedPaths(layers, allLayers []Layer, images []Image, containers []Container) ([]string, error) {
+	layerIDs := make(map[string]bool, len(layers))
+	for _, layer := range layers {
+		layerIDs[layer.ID] = true
+	}
+	// the driver can be asked to look for layers in the additional
+	// stores, so don't flag any layer we know of
+	driverLayerIDs := make(map[string]bool, len(allLayers))
+	for _, layer := range allLayers {
+		driverLayerIDs[layer.ID] = true
+	}
+	imageIDs := make(map[string]bool, len(images))
+	for _, image := range images {
+		imageIDs[image.ID] = true
+	}
+	// the data of new images is staged there, next to theirs
+	imageIDs[imageStagingDir] = true
+	containerIDs := make(map[string]bool, len(containers))
+	for _, container := range containers {
+		containerIDs[container.ID] = true
+	}
+
+	var orphaned []string
+	scan := func(dir string, known map[string]bool, suffix string) error {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		for _, entry := range entries {
+			var id string
+			switch {
+			case suffix == "" && entry.IsDir():
+				id = entry.Name()
+			case suffix != "" && !entry.IsDir() && strings.HasSuffix(entry.Name(), suffix):
+				id = strings.TrimSuffix(entry.Name(), suffix)
+			default:
+				continue
+			}
+			if !known[id] {
+				orphaned = append(orphaned, filepath.Join(dir, entry.Name()))
+			}
+		}
+		return nil
+	}
+
+	driverPrefix := s.graphDriverName + "-"
+	layerDir := filepath.Join(s.metadataDir(s.graphRoot), driverPrefix+"layers")
+	if err := scan(layerDir, layerIDs, ""); err != nil {
+		return nil, err
+	}
+	if err := scan(layerDir, layerIDs, tarSplitSuffix); err != nil {
+		return nil, err
+	}
+	if err := scan(filepath.Join(s.metadataDir(s.graphRoot), driverPrefix+"images"), imageIDs, ""); err != nil {
+		return nil, err
+	}
+	// The per-container directories and the driver's per-layer
+	// directories of every namespace are kept under the graph root and
+	// the run root, so we can't tell which of them are orphaned once
+	// namespaces are in use.
+	if _, err := os.Stat(filepath.Join(s.graphRoot, "namespaces")); err == nil {
+		return orphaned, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if dirs, ok := driverLayerDirs[s.graphDriverName]; ok {
+		for _, name := range dirs.reserved {
+			driverLayerIDs[name] = true
+		}
+		if err := scan(filepath.Join(s.graphRoot, s.graphDriverName, dirs.subdir), driverLayerIDs, ""); err != nil {
+			return nil, err
+		}
+	}
+	for _, root := range []string{s.graphRoot, s.runRoot} {
+		if err := scan(filepath.Join(root, driverPrefix+"containers"), containerIDs, ""); err != nil {
+			return nil, err
+		}
+	}
+	return orphaned, nil
+}
+
 func (s *store) ContainerParentOwners(id string) ([]int, []int, error) {
 	rlstore, err := s.LayerStore()
 	if err != nil {
@@ -3141,6 +5178,31 @@ func (s *store) Images() ([]Image, error) {
 	return images, nil
 }
 
+func (s *store) ImagesWithChunkedLayers() ([]Image, error) {
+	layers, err := s.Layers()
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]*Layer, len(layers))
+	for i := range layers {
+		byID[layers[i].ID] = &layers[i]
+	}
+	images, err := s.Images()
+	if err != nil {
+		return nil, err
+	}
+	var matches []Image
+	for _, image := range images {
+		for layer := byID[image.TopLayer]; layer != nil; layer = byID[layer.Parent] {
+			if stringutils.InSlice(layer.BigDataNames, chunkedManifestBigDataKey) {
+				matches = append(matches, image)
+				break
+			}
+		}
+	}
+	return matches, nil
+}
+
 func (s *store) Containers() ([]Container, error) {
 	rcstore, err := s.ContainerStore()
 	if err != nil {
@@ -3180,6 +5242,36 @@ func (s *store) Layer(id string) (*Layer, error) {
 	return nil, ErrLayerUnknown
 }
 
+func (s *store) LayersByIDs(ids []string) ([]*Layer, error) {
+	lstore, err := s.LayerStore()
+	if err != nil {
+		return nil, err
+	}
+	lstores, err := s.ROLayerStores()
+	if err != nil {
+		return nil, err
+	}
+	stores := append([]ROLayerStore{lstore}, lstores...)
+	for _, s := range stores {
+		store := s
+		store.RLock()
+		defer store.Unlock()
+		if err := store.ReloadIfChanged(); err != nil {
+			return nil, err
+		}
+	}
+	layers := make([]*Layer, len(ids))
+	for i, id := range ids {
+		for _, store := range stores {
+			if layer, err := store.Get(id); err == nil {
+				layers[i] = layer
+				break
+			}
+		}
+	}
+	return layers, nil
+}
+
 func (s *store) LookupAdditionalLayer(d digest.Digest, imageref string) (AdditionalLayer, error) {
 	adriver, ok := s.graphDriver.(drivers.AdditionalLayerStoreDriver)
 	if !ok {
@@ -3507,6 +5599,8 @@ func (s *store) Shutdown(force bool) ([]string, error) {
 	s.graphLock.Lock()
 	defer s.graphLock.Unlock()
 
+	s.stopAllPrefetches()
+
 	rlstore.Lock()
 	defer rlstore.Unlock()
 	if err := rlstore.ReloadIfChanged(); err != nil {
@@ -3523,6 +5617,16 @@ func (s *store) Shutdown(force bool) ([]string, error) {
 		}
 		mounted = append(mounted, layer.ID)
 		if force {
+			binds, err2 := s.layerBinds(layer.ID)
+			if err2 == nil {
+				err2 = unmountBinds(layer.MountPoint, binds)
+			}
+			if err2 != nil {
+				if err == nil {
+					err = err2
+				}
+				continue
+			}
 			for layer.MountCount > 0 {
 				_, err2 := rlstore.Unmount(layer.ID, force)
 				if err2 != nil {
@@ -1,11 +1,20 @@
 package storage
 
 import (
+	"bytes"
+	"errors"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	drivercopy "github.com/containers/storage/drivers/copy"
+	"github.com/containers/storage/pkg/archive"
 	"github.com/containers/storage/pkg/idtools"
 	digest "github.com/opencontainers/go-digest"
 	"github.com/stretchr/testify/assert"
@@ -244,3 +253,856 @@ func TestStore(t *testing.T) {
 	store.Free()
 	store.Free()
 }
+
+func TestStoreNamespaces(t *testing.T) {
+	wd, err := ioutil.TempDir("", "testStorageNamespaces")
+	require.NoError(t, err)
+	defer os.RemoveAll(wd)
+
+	getStore := func(namespace string, sharedBase bool) Store {
+		store, err := GetStore(StoreOptions{
+			RunRoot:             filepath.Join(wd, "run"),
+			GraphRoot:           filepath.Join(wd, "root"),
+			GraphDriverName:     "vfs",
+			Namespace:           namespace,
+			NamespaceSharedBase: sharedBase,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_, _ = store.Shutdown(true)
+			store.Free()
+		})
+		return store
+	}
+
+	base := getStore("", false)
+	tenantA := getStore("a", true)
+	tenantB := getStore("b", true)
+	isolated := getStore("c", false)
+	require.NotEqual(t, tenantA, tenantB)
+
+	_, err = GetStore(StoreOptions{
+		RunRoot:   filepath.Join(wd, "run"),
+		GraphRoot: filepath.Join(wd, "root"),
+		Namespace: "../escape",
+	})
+	require.Error(t, err)
+
+	baseLayer, err := base.CreateLayer("", "", nil, "", false, nil)
+	require.NoError(t, err)
+	baseImage, err := base.CreateImage("", []string{"base"}, baseLayer.ID, "", &ImageOptions{})
+	require.NoError(t, err)
+
+	// Both tenants can use the shared base image.
+	containerA, err := tenantA.CreateContainer("", []string{"ctr-a"}, baseImage.ID, "", "", nil)
+	require.NoError(t, err)
+	containerB, err := tenantB.CreateContainer("", []string{"ctr-b"}, baseImage.ID, "", "", nil)
+	require.NoError(t, err)
+	img, err := tenantA.Image("base")
+	require.NoError(t, err)
+	require.Equal(t, baseImage.ID, img.ID)
+
+	// Neither can see the other's containers or layers.
+	for _, c := range []struct {
+		store     Store
+		own       *Container
+		other     *Container
+		otherName string
+	}{
+		{tenantA, containerA, containerB, "ctr-b"},
+		{tenantB, containerB, containerA, "ctr-a"},
+	} {
+		containers, err := c.store.Containers()
+		require.NoError(t, err)
+		require.Len(t, containers, 1)
+		require.Equal(t, c.own.ID, containers[0].ID)
+
+		_, err = c.store.Container(c.other.ID)
+		require.Error(t, err)
+		_, err = c.store.Container(c.otherName)
+		require.Error(t, err)
+		require.False(t, c.store.Exists(c.other.LayerID))
+		_, err = c.store.Layer(c.other.LayerID)
+		require.Error(t, err)
+
+		layers, err := c.store.Layers()
+		require.NoError(t, err)
+		var ids []string
+		for _, l := range layers {
+			ids = append(ids, l.ID)
+		}
+		require.ElementsMatch(t, []string{baseLayer.ID, c.own.LayerID}, ids)
+	}
+
+	// The store without a namespace doesn't see the tenants' containers,
+	// and a namespace which didn't opt in doesn't see the base.
+	containers, err := base.Containers()
+	require.NoError(t, err)
+	require.Empty(t, containers)
+	_, err = isolated.Image("base")
+	require.Error(t, err)
+	layers, err := isolated.Layers()
+	require.NoError(t, err)
+	require.Empty(t, layers)
+
+	// The shared base can't be modified through a tenant.
+	_, err = tenantA.DeleteImage(baseImage.ID, true)
+	require.Error(t, err)
+
+	// Nor can the layers which the tenants use be deleted from the base:
+	// deleting the base image keeps its layer.
+	removed, err := base.DeleteImage(baseImage.ID, true)
+	require.NoError(t, err)
+	require.Empty(t, removed)
+	require.True(t, base.Exists(baseLayer.ID))
+	err = base.DeleteLayer(baseLayer.ID)
+	require.True(t, errors.Is(err, ErrLayerHasChildren), "%v", err)
+	otherBaseLayer, err := base.CreateLayer("", "", nil, "", false, nil)
+	require.NoError(t, err)
+	_, err = tenantB.CreateImage("", nil, otherBaseLayer.ID, "", &ImageOptions{})
+	require.NoError(t, err)
+	err = base.DeleteLayer(otherBaseLayer.ID)
+	require.True(t, errors.Is(err, ErrLayerUsedByImage), "%v", err)
+
+	// Once they are no longer used, they can be.
+	require.NoError(t, tenantA.DeleteContainer(containerA.ID))
+	require.NoError(t, tenantB.DeleteContainer(containerB.ID))
+	require.NoError(t, base.DeleteLayer(baseLayer.ID))
+}
+
+func TestCheck(t *testing.T) {
+	s := newTestStore(t)
+	graphRoot := s.GraphRoot()
+
+	// deleteLayerRecord removes a layer without updating anything which
+	// refers to it, like a crash in the middle of a deletion might.
+	deleteLayerRecord := func(id string) {
+		rlstore, err := s.(*store).LayerStore()
+		require.NoError(t, err)
+		rlstore.Lock()
+		defer rlstore.Unlock()
+		require.NoError(t, rlstore.Delete(id))
+	}
+
+	good, err := s.CreateLayer("", "", nil, "", false, nil)
+	require.NoError(t, err)
+	goodImage, err := s.CreateImage("", nil, good.ID, "", &ImageOptions{})
+	require.NoError(t, err)
+
+	// A layer whose parent is missing, an image and a container based on it.
+	base, err := s.CreateLayer("", "", nil, "", false, nil)
+	require.NoError(t, err)
+	child, err := s.CreateLayer("", base.ID, nil, "", false, nil)
+	require.NoError(t, err)
+	childImage, err := s.CreateImage("", nil, child.ID, "", &ImageOptions{})
+	require.NoError(t, err)
+	childContainer, err := s.CreateContainer("", nil, childImage.ID, "", "", nil)
+	require.NoError(t, err)
+	deleteLayerRecord(base.ID)
+
+	// An image whose top layer is missing.
+	top, err := s.CreateLayer("", "", nil, "", false, nil)
+	require.NoError(t, err)
+	danglingImage, err := s.CreateImage("", nil, top.ID, "", &ImageOptions{})
+	require.NoError(t, err)
+	deleteLayerRecord(top.ID)
+
+	// A container whose layer is missing.
+	danglingContainer, err := s.CreateContainer("", nil, "", "", "", nil)
+	require.NoError(t, err)
+	deleteLayerRecord(danglingContainer.LayerID)
+
+	// Directories and files left behind by records which are gone.
+	orphans := []string{
+		filepath.Join(graphRoot, "vfs-layers", "orphaned-layer"),
+		filepath.Join(graphRoot, "vfs", "dir", "orphaned-layer"),
+		filepath.Join(graphRoot, "vfs-images", "orphaned-image"),
+		filepath.Join(graphRoot, "vfs-containers", "orphaned-container"),
+		filepath.Join(s.RunRoot(), "vfs-containers", "orphaned-container"),
+	}
+	for _, dir := range orphans {
+		require.NoError(t, os.MkdirAll(dir, 0700))
+	}
+	orphanedTarSplit := filepath.Join(graphRoot, "vfs-layers", "orphaned-layer"+tarSplitSuffix)
+	require.NoError(t, ioutil.WriteFile(orphanedTarSplit, nil, 0600))
+	orphans = append(orphans, orphanedTarSplit)
+
+	report, err := s.Check(nil)
+	require.NoError(t, err)
+	assert.False(t, report.Consistent())
+	assert.Equal(t, map[string]string{child.ID: base.ID}, report.LayersWithMissingParents)
+	assert.Equal(t, map[string][]string{danglingImage.ID: {top.ID}}, report.ImagesWithMissingLayers)
+	assert.Equal(t, map[string]string{danglingContainer.ID: danglingContainer.LayerID}, report.ContainersWithMissingLayers)
+	assert.ElementsMatch(t, orphans, report.OrphanedPaths)
+	assert.Empty(t, report.RemovedLayers)
+	assert.Empty(t, report.RemovedImages)
+	assert.Empty(t, report.RemovedContainers)
+
+	// Without Repair, nothing was changed.
+	_, err = s.Image(danglingImage.ID)
+	require.NoError(t, err)
+	for _, path := range orphans {
+		_, err := os.Stat(path)
+		require.NoError(t, err)
+	}
+
+	report, err = s.Check(&CheckOptions{Repair: true})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{child.ID, childContainer.LayerID}, report.RemovedLayers)
+	assert.ElementsMatch(t, []string{childImage.ID, danglingImage.ID}, report.RemovedImages)
+	assert.ElementsMatch(t, []string{childContainer.ID, danglingContainer.ID}, report.RemovedContainers)
+	for _, path := range orphans {
+		_, err := os.Stat(path)
+		assert.True(t, os.IsNotExist(err), "%s was not removed", path)
+	}
+
+	report, err = s.Check(nil)
+	require.NoError(t, err)
+	assert.True(t, report.Consistent(), "%+v", report)
+
+	// The consistent records were left alone.
+	_, err = s.Image(goodImage.ID)
+	require.NoError(t, err)
+	assert.True(t, s.Exists(good.ID))
+	for _, id := range []string{child.ID, childImage.ID, childContainer.ID, danglingImage.ID, danglingContainer.ID} {
+		assert.False(t, s.Exists(id), "%s was not removed", id)
+	}
+}
+
+func TestRegisterLazyLayer(t *testing.T) {
+	s := newTestStore(t)
+
+	var fetches int32
+	failNext := true
+	fetch := func(layerID string) (io.ReadCloser, error) {
+		if failNext {
+			failNext = false
+			return nil, errors.New("remote is unavailable")
+		}
+		atomic.AddInt32(&fetches, 1)
+		// give the other mounts a chance to race with this one
+		time.Sleep(50 * time.Millisecond)
+		return ioutil.NopCloser(makeTestLayerTar(t, map[string]string{"file": layerID})), nil
+	}
+	_, err := s.RegisterLazyLayer("", "", nil, nil, nil)
+	assert.Error(t, err)
+	layer, err := s.RegisterLazyLayer("lazy", "", []string{"lazy-layer"}, nil, fetch)
+	require.NoError(t, err)
+	_, err = s.RegisterLazyLayer("lazy", "", nil, nil, fetch)
+	assert.Error(t, err)
+	_, err = s.CreateImage("", nil, layer.ID, "", &ImageOptions{})
+	require.NoError(t, err)
+
+	// a failed fetch is retried on the next mount
+	_, err = s.Mount(layer.ID, "")
+	assert.Error(t, err)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&fetches))
+
+	const mounts = 8
+	var wg sync.WaitGroup
+	errs := make([]error, mounts)
+	mountpoints := make([]string, mounts)
+	for i := 0; i < mounts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			mountpoints[i], errs[i] = s.Mount(layer.ID, "")
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < mounts; i++ {
+		require.NoError(t, errs[i])
+		contents, err := ioutil.ReadFile(filepath.Join(mountpoints[i], "file"))
+		require.NoError(t, err)
+		assert.Equal(t, layer.ID, string(contents))
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+	for i := 0; i < mounts; i++ {
+		_, err := s.Unmount(layer.ID, false)
+		require.NoError(t, err)
+	}
+
+	layer, err = s.Layer(layer.ID)
+	require.NoError(t, err)
+	assert.NotContains(t, layer.Flags, lazyFlag)
+	_, err = s.Mount(layer.ID, "")
+	require.NoError(t, err)
+	_, err = s.Unmount(layer.ID, false)
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+
+	// without a fetcher, a layer whose contents are missing can't be mounted
+	pending, err := s.RegisterLazyLayer("", "", nil, nil, fetch)
+	require.NoError(t, err)
+	ls := s.(*store)
+	ls.lazyLock.Lock()
+	delete(ls.lazyFetchers, pending.ID)
+	ls.lazyLock.Unlock()
+	_, err = s.Mount(pending.ID, "")
+	assert.True(t, errors.Is(err, ErrLayerNotMaterialized))
+}
+
+func TestPinLayer(t *testing.T) {
+	s := newTestStore(t)
+
+	base, _, err := s.PutLayer("", "", nil, "", false, nil, makeTestLayerTar(t, map[string]string{"base": "base"}))
+	require.NoError(t, err)
+	child, _, err := s.PutLayer("", base.ID, nil, "", false, nil, makeTestLayerTar(t, map[string]string{"child": "child"}))
+	require.NoError(t, err)
+	image, err := s.CreateImage("", nil, child.ID, "", &ImageOptions{})
+	require.NoError(t, err)
+
+	assert.Equal(t, ErrLayerUnknown, s.PinLayer("no-such-layer"))
+	require.NoError(t, s.PinLayer(base.ID))
+	layer, err := s.Layer(base.ID)
+	require.NoError(t, err)
+	assert.True(t, layerIsPinned(layer))
+
+	// removing the image keeps the pinned layer
+	removed, err := s.DeleteImage(image.ID, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{child.ID}, removed)
+	assert.True(t, s.Exists(base.ID))
+
+	// and it can't be removed without forcing it
+	err = s.DeleteLayer(base.ID)
+	assert.True(t, errors.Is(err, ErrLayerPinned), "unexpected error %v", err)
+	err = s.Delete(base.ID)
+	assert.True(t, errors.Is(err, ErrLayerPinned), "unexpected error %v", err)
+	assert.True(t, s.Exists(base.ID))
+	require.NoError(t, s.DeleteLayerWithOptions(base.ID, &DeleteLayerOptions{Force: true}))
+	assert.False(t, s.Exists(base.ID))
+
+	// a container whose layer is pinned can't be removed either
+	base, _, err = s.PutLayer("", "", nil, "", false, nil, makeTestLayerTar(t, map[string]string{"base": "base"}))
+	require.NoError(t, err)
+	image, err = s.CreateImage("", nil, base.ID, "", &ImageOptions{})
+	require.NoError(t, err)
+	container, err := s.CreateContainer("", nil, image.ID, "", "", nil)
+	require.NoError(t, err)
+	require.NoError(t, s.PinLayer(container.LayerID))
+	err = s.DeleteContainer(container.ID)
+	assert.True(t, errors.Is(err, ErrLayerPinned), "unexpected error %v", err)
+	require.NoError(t, s.UnpinLayer(container.LayerID))
+	layer, err = s.Layer(container.LayerID)
+	require.NoError(t, err)
+	assert.False(t, layerIsPinned(layer))
+	require.NoError(t, s.DeleteContainer(container.ID))
+}
+
+func TestExpireStale(t *testing.T) {
+	s := newTestStore(t)
+
+	const ttl = 50 * time.Millisecond
+	expiring := &LayerOptions{TTL: ttl}
+	expired, err := s.CreateLayer("", "", nil, "", true, expiring)
+	require.NoError(t, err)
+	kept, err := s.CreateLayer("", "", nil, "", true, &LayerOptions{TTL: time.Hour})
+	require.NoError(t, err)
+	permanent, err := s.CreateLayer("", "", nil, "", true, nil)
+	require.NoError(t, err)
+	pinned, err := s.CreateLayer("", "", nil, "", true, expiring)
+	require.NoError(t, err)
+	require.NoError(t, s.PinLayer(pinned.ID))
+	// the parent can only be removed after its expired child
+	parent, err := s.CreateLayer("", "", nil, "", false, expiring)
+	require.NoError(t, err)
+	child, err := s.CreateLayer("", parent.ID, nil, "", true, expiring)
+	require.NoError(t, err)
+	// a parent whose child is kept stays too
+	usedParent, err := s.CreateLayer("", "", nil, "", false, expiring)
+	require.NoError(t, err)
+	_, err = s.CreateLayer("", usedParent.ID, nil, "", true, nil)
+	require.NoError(t, err)
+
+	container, err := s.CreateContainer("", nil, "", "", "", &ContainerOptions{TTL: ttl})
+	require.NoError(t, err)
+	mountedContainer, err := s.CreateContainer("", nil, "", "", "", &ContainerOptions{TTL: ttl})
+	require.NoError(t, err)
+	_, err = s.Mount(mountedContainer.LayerID, "")
+	require.NoError(t, err)
+
+	// nothing has expired yet
+	removed, err := s.ExpireStale()
+	require.NoError(t, err)
+	assert.Empty(t, removed)
+
+	time.Sleep(2 * ttl)
+	removed, err = s.ExpireStale()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{expired.ID, parent.ID, child.ID, container.LayerID}, removed)
+	for _, id := range removed {
+		assert.False(t, s.Exists(id), "layer %q not removed", id)
+	}
+	assert.False(t, s.Exists(container.ID))
+	for _, id := range []string{kept.ID, permanent.ID, pinned.ID, usedParent.ID, mountedContainer.ID, mountedContainer.LayerID} {
+		assert.True(t, s.Exists(id), "%q removed", id)
+	}
+
+	_, err = s.Unmount(mountedContainer.LayerID, false)
+	require.NoError(t, err)
+	removed, err = s.ExpireStale()
+	require.NoError(t, err)
+	assert.Equal(t, []string{mountedContainer.LayerID}, removed)
+	assert.False(t, s.Exists(mountedContainer.ID))
+}
+
+func TestDriverCapabilities(t *testing.T) {
+	s := newTestStore(t)
+
+	caps, err := s.DriverCapabilities()
+	require.NoError(t, err)
+	reflinks, err := drivercopy.SupportsReflinks(s.GraphRoot())
+	require.NoError(t, err)
+	assert.Equal(t, DriverCaps{Reflinks: reflinks}, caps)
+}
+
+func TestImageBigDataImmutable(t *testing.T) {
+	s := newTestStore(t)
+
+	image, err := s.CreateImage("", []string{"image"}, "", "", &ImageOptions{})
+	require.NoError(t, err)
+	config := []byte(`{"architecture":"amd64"}`)
+	configKey := digest.FromBytes(config).String()
+	require.NoError(t, s.SetImageBigData(image.ID, configKey, config, nil))
+	require.NoError(t, s.SetImageBigData(image.ID, "signature", []byte("signature"), nil))
+
+	rs := s.(*store)
+	istore, err := rs.ImageStore()
+	require.NoError(t, err)
+	istores := []ROImageStore{istore}
+
+	data, ok := rs.immutableImageBigData(istores, image.ID, configKey)
+	assert.True(t, ok)
+	assert.Equal(t, config, data)
+	data, err = s.ImageBigData(image.ID, configKey)
+	require.NoError(t, err)
+	assert.Equal(t, config, data)
+
+	// names, and keys which aren't digests, go through the locked path
+	_, ok = rs.immutableImageBigData(istores, "image", configKey)
+	assert.False(t, ok)
+	data, err = s.ImageBigData("image", configKey)
+	require.NoError(t, err)
+	assert.Equal(t, config, data)
+	_, ok = rs.immutableImageBigData(istores, image.ID, "signature")
+	assert.False(t, ok)
+	data, err = s.ImageBigData(image.ID, "signature")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("signature"), data)
+
+	// contents which don't match their digest aren't trusted
+	path := istore.(*imageStore).datapath(image.ID, configKey)
+	require.NoError(t, ioutil.WriteFile(path, []byte("corrupted"), 0600))
+	_, ok = rs.immutableImageBigData(istores, image.ID, configKey)
+	assert.False(t, ok)
+
+	// and the data goes away with the image
+	require.NoError(t, ioutil.WriteFile(path, config, 0600))
+	_, err = s.DeleteImage(image.ID, true)
+	require.NoError(t, err)
+	_, err = s.ImageBigData(image.ID, configKey)
+	assert.True(t, errors.Is(err, ErrImageUnknown), "unexpected error %v", err)
+
+	// even if it is read before the image's directory is removed
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0700))
+	require.NoError(t, ioutil.WriteFile(path, config, 0600))
+	_, ok = rs.immutableImageBigData(istores, image.ID, configKey)
+	assert.False(t, ok)
+}
+
+func BenchmarkImageBigData(b *testing.B) {
+	s := newTestStore(b)
+
+	image, err := s.CreateImage("", nil, "", "", &ImageOptions{})
+	require.NoError(b, err)
+	config := []byte(`{"architecture":"amd64"}`)
+	configKey := digest.FromBytes(config).String()
+	require.NoError(b, s.SetImageBigData(image.ID, configKey, config, nil))
+	require.NoError(b, s.SetImageBigData(image.ID, "config", config, nil))
+
+	for _, key := range []string{configKey, "config"} {
+		name := "digest"
+		if key == "config" {
+			name = "name"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := s.ImageBigData(image.ID, key); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestExportImportLayer(t *testing.T) {
+	src := newTestStore(t)
+	dest := newTestStore(t)
+
+	base, _, err := src.PutLayer("", "", []string{"base"}, "", false, nil, makeTestLayerTar(t, map[string]string{"base": "base contents"}))
+	require.NoError(t, err)
+	layer, _, err := src.PutLayer("", base.ID, []string{"layer"}, "", false, nil, makeTestLayerTar(t, map[string]string{"file": "file contents"}))
+	require.NoError(t, err)
+	require.NoError(t, src.SetLayerBigData(layer.ID, chunkedManifestBigDataKey, strings.NewReader("manifest")))
+	require.NoError(t, src.SetMetadata(layer.ID, "metadata"))
+	layer, err = src.Layer(layer.ID)
+	require.NoError(t, err)
+
+	export := func(id string) []byte {
+		var buf bytes.Buffer
+		require.NoError(t, src.ExportLayer(id, &buf))
+		return buf.Bytes()
+	}
+	readAll := func(rc io.ReadCloser, err error) []byte {
+		require.NoError(t, err)
+		defer rc.Close()
+		data, err := ioutil.ReadAll(rc)
+		require.NoError(t, err)
+		return data
+	}
+
+	// the parent has to be imported first
+	archive := export(layer.ID)
+	_, err = dest.ImportLayer(bytes.NewReader(archive))
+	assert.True(t, errors.Is(err, ErrLayerUnknown), "unexpected error %v", err)
+	assert.False(t, dest.Exists(layer.ID))
+
+	_, err = dest.ImportLayer(bytes.NewReader(export(base.ID)))
+	require.NoError(t, err)
+	imported, err := dest.ImportLayer(bytes.NewReader(archive))
+	require.NoError(t, err)
+	assert.Equal(t, layer.ID, imported.ID)
+	assert.Equal(t, layer.Names, imported.Names)
+	assert.Equal(t, base.ID, imported.Parent)
+	assert.Equal(t, "metadata", imported.Metadata)
+	assert.Equal(t, layer.CompressedDigest, imported.CompressedDigest)
+	assert.Equal(t, layer.CompressedSize, imported.CompressedSize)
+	assert.Equal(t, layer.UncompressedDigest, imported.UncompressedDigest)
+	assert.Equal(t, layer.UncompressedSize, imported.UncompressedSize)
+	assert.Equal(t, layer.BigDataNames, imported.BigDataNames)
+	assert.Equal(t, []byte("manifest"), readAll(dest.LayerBigData(imported.ID, chunkedManifestBigDataKey)))
+	assert.Equal(t, readAll(src.TarSplitStream(layer.ID)), readAll(dest.TarSplitStream(imported.ID)))
+	assert.Equal(t, readAll(src.AssembleTar(layer.ID)), readAll(dest.AssembleTar(imported.ID)))
+
+	// a diff which doesn't match its digest is rejected
+	require.NoError(t, dest.DeleteLayer(imported.ID))
+	corrupted := bytes.Replace(archive, []byte("file contents"), []byte("FILE CONTENTS"), 1)
+	_, err = dest.ImportLayer(bytes.NewReader(corrupted))
+	assert.True(t, errors.Is(err, ErrLayerCorrupted), "unexpected error %v", err)
+	assert.False(t, dest.Exists(layer.ID))
+}
+
+func TestAsyncLayerRemoval(t *testing.T) {
+	wd, err := ioutil.TempDir("", "testStorageAsyncRemove")
+	require.NoError(t, err)
+	defer os.RemoveAll(wd)
+	// something left in the trash by a previous process
+	leftover := filepath.Join(wd, "root", "vfs", "trash", "leftover")
+	require.NoError(t, os.MkdirAll(filepath.Join(leftover, "dir"), 0700))
+
+	s, err := GetStore(StoreOptions{
+		RunRoot:            filepath.Join(wd, "run"),
+		GraphRoot:          filepath.Join(wd, "root"),
+		GraphDriverName:    "vfs",
+		GraphDriverOptions: []string{"vfs.async_remove=true"},
+	})
+	require.NoError(t, err)
+	defer func() {
+		_, _ = s.Shutdown(true)
+		s.Free()
+	}()
+
+	layer, _, err := s.PutLayer("", "", nil, "", false, nil, makeTestLayerTar(t, map[string]string{"file": "contents"}))
+	require.NoError(t, err)
+	layerDir := filepath.Join(wd, "root", "vfs", "dir", layer.ID)
+	_, err = os.Stat(layerDir)
+	require.NoError(t, err)
+
+	require.NoError(t, s.DeleteLayer(layer.ID))
+	assert.False(t, s.Exists(layer.ID))
+	_, err = os.Stat(layerDir)
+	assert.True(t, os.IsNotExist(err), "unexpected error %v", err)
+
+	trash := filepath.Dir(leftover)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		entries, err := ioutil.ReadDir(trash)
+		require.NoError(t, err)
+		if len(entries) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("trash not emptied, still holds %d entries", len(entries))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestImagesWithChunkedLayers(t *testing.T) {
+	s := newTestStore(t)
+
+	putLayer := func(parent string, chunked bool) string {
+		layer, _, err := s.PutLayer("", parent, nil, "", false, nil, makeTestLayerTar(t, map[string]string{"file": parent}))
+		require.NoError(t, err)
+		if chunked {
+			require.NoError(t, s.SetLayerBigData(layer.ID, chunkedManifestBigDataKey, strings.NewReader("manifest")))
+		}
+		return layer.ID
+	}
+	createImage := func(topLayer string) string {
+		image, err := s.CreateImage("", nil, topLayer, "", nil)
+		require.NoError(t, err)
+		return image.ID
+	}
+
+	plainBase := putLayer("", false)
+	chunkedBase := putLayer("", true)
+	chunkedTop := createImage(putLayer(plainBase, true))
+	chunkedBelow := createImage(putLayer(chunkedBase, false))
+	createImage(plainBase)
+	createImage(putLayer(plainBase, false))
+	createImage("")
+	chunkedOnly := createImage(chunkedBase)
+
+	images, err := s.ImagesWithChunkedLayers()
+	require.NoError(t, err)
+	var ids []string
+	for _, image := range images {
+		ids = append(ids, image.ID)
+	}
+	assert.ElementsMatch(t, []string{chunkedTop, chunkedBelow, chunkedOnly}, ids)
+}
+
+func TestNameConflicts(t *testing.T) {
+	s := newTestStore(t)
+
+	layerA, err := s.CreateLayer("", "", []string{"layer-a"}, "", false, nil)
+	require.NoError(t, err)
+	layerB, err := s.CreateLayer("", "", []string{"layer-b"}, "", false, nil)
+	require.NoError(t, err)
+	image, err := s.CreateImage("", []string{"image"}, layerA.ID, "", nil)
+	require.NoError(t, err)
+	container, err := s.CreateContainer("", []string{"container"}, image.ID, "", "", nil)
+	require.NoError(t, err)
+
+	// a name which belongs to another item of the same kind is rejected
+	// by AddNames, and none of the names are changed
+	err = s.AddNames(layerB.ID, []string{"new", "layer-a"})
+	assert.True(t, errors.Is(err, ErrDuplicateName), "unexpected error %v", err)
+	names, err := s.Names(layerB.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"layer-b"}, names)
+	names, err = s.Names(layerA.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"layer-a"}, names)
+
+	// names only have to be unique among the items of the same kind
+	require.NoError(t, s.AddNames(layerB.ID, []string{"image", "container", "layer-b"}))
+	names, err = s.Names(layerB.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"layer-b", "image", "container"}, names)
+	require.NoError(t, s.RemoveNames(layerB.ID, []string{"image", "container", "unknown"}))
+	names, err = s.Names(layerB.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"layer-b"}, names)
+
+	// SetNames moves the names from the item which has them
+	require.NoError(t, s.SetNames(layerB.ID, []string{"layer-a", "layer-a"}))
+	names, err = s.Names(layerB.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"layer-a"}, names)
+	names, err = s.Names(layerA.ID)
+	require.NoError(t, err)
+	assert.Empty(t, names)
+
+	other, err := s.CreateImage("", []string{"other"}, layerA.ID, "", nil)
+	require.NoError(t, err)
+	err = s.AddNames(other.ID, []string{"image"})
+	assert.True(t, errors.Is(err, ErrDuplicateName), "unexpected error %v", err)
+	require.NoError(t, s.AddNames(image.ID, []string{"image:latest"}))
+	names, err = s.Names(image.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"image", "image:latest"}, names)
+
+	otherContainer, err := s.CreateContainer("", nil, image.ID, "", "", nil)
+	require.NoError(t, err)
+	err = s.AddNames(otherContainer.ID, []string{"container"})
+	assert.True(t, errors.Is(err, ErrDuplicateName), "unexpected error %v", err)
+	names, err = s.Names(container.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"container"}, names)
+	require.NoError(t, s.SetNames(otherContainer.ID, []string{"container"}))
+	names, err = s.Names(container.ID)
+	require.NoError(t, err)
+	assert.Empty(t, names)
+
+	assert.True(t, errors.Is(s.AddNames("unknown", []string{"name"}), ErrLayerUnknown))
+}
+
+func TestAddNamesConcurrent(t *testing.T) {
+	s := newTestStore(t)
+
+	const attempts = 8
+	layers := make([]*Layer, attempts)
+	for i := range layers {
+		layer, err := s.CreateLayer("", "", nil, "", false, nil)
+		require.NoError(t, err)
+		layers[i] = layer
+	}
+
+	// only one of the layers gets the name
+	var wg sync.WaitGroup
+	errs := make([]error, attempts)
+	for i := range layers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = s.AddNames(layers[i].ID, []string{"contended"})
+		}(i)
+	}
+	wg.Wait()
+
+	winner := -1
+	for i, err := range errs {
+		if err == nil {
+			assert.Equal(t, -1, winner, "name assigned to layers %d and %d", winner, i)
+			winner = i
+			continue
+		}
+		assert.True(t, errors.Is(err, ErrDuplicateName), "unexpected error %v", err)
+	}
+	require.NotEqual(t, -1, winner)
+	layer, err := s.Layer("contended")
+	require.NoError(t, err)
+	assert.Equal(t, layers[winner].ID, layer.ID)
+	for i := range layers {
+		names, err := s.Names(layers[i].ID)
+		require.NoError(t, err)
+		if i == winner {
+			assert.Equal(t, []string{"contended"}, names)
+		} else {
+			assert.Empty(t, names)
+		}
+	}
+}
+
+func TestContainerDiskUsage(t *testing.T) {
+	s := newTestStore(t)
+
+	base, _, err := s.PutLayer("", "", nil, "", false, nil, makeTestLayerTar(t, map[string]string{
+		"base": strings.Repeat("b", 1000),
+	}))
+	require.NoError(t, err)
+	top, _, err := s.PutLayer("", base.ID, nil, "", false, nil, makeTestLayerTar(t, map[string]string{
+		"top": strings.Repeat("t", 300),
+	}))
+	require.NoError(t, err)
+	image, err := s.CreateImage("", nil, top.ID, "", nil)
+	require.NoError(t, err)
+	other, err := s.CreateImage("", nil, base.ID, "", nil)
+	require.NoError(t, err)
+
+	first, err := s.CreateContainer("", nil, image.ID, "", "", nil)
+	require.NoError(t, err)
+	second, err := s.CreateContainer("", nil, image.ID, "", "", nil)
+	require.NoError(t, err)
+	third, err := s.CreateContainer("", nil, other.ID, "", "", nil)
+	require.NoError(t, err)
+	require.NoError(t, s.SetContainerBigData(third.ID, "data", []byte("12345")))
+	mountPoint, err := s.Mount(second.ID, "")
+	require.NoError(t, err)
+	defer func() {
+		_, err := s.Unmount(second.ID, true)
+		assert.NoError(t, err)
+	}()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(mountPoint, "written"), []byte(strings.Repeat("w", 50)), 0644))
+
+	// With vfs, each layer holds a full copy of the files of the layers
+	// below it.  The top layer is shared by the first two containers, and
+	// the base layer by all of them.
+	usage, err := s.ContainerDiskUsage(first.ID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1300+1300/2+1000/3), usage)
+	usage, err = s.ContainerDiskUsage(second.ID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1350+1300/2+1000/3), usage)
+	usage, err = s.ContainerDiskUsage(third.ID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1000+1000/3+5), usage)
+
+	_, err = s.ContainerDiskUsage("unknown")
+	assert.Error(t, err)
+}
+
+func TestAdditionalStoresAtRuntime(t *testing.T) {
+	wd, err := ioutil.TempDir("", "testStorageAdditionalStores")
+	require.NoError(t, err)
+	defer os.RemoveAll(wd)
+	roRoot := filepath.Join(wd, "ro")
+
+	// populate what becomes the additional image store
+	ro, err := GetStore(StoreOptions{
+		RunRoot:         filepath.Join(wd, "ro-run"),
+		GraphRoot:       roRoot,
+		GraphDriverName: "vfs",
+	})
+	require.NoError(t, err)
+	layer, _, err := ro.PutLayer("", "", nil, "", false, nil, makeTestLayerTar(t, map[string]string{"file": "contents"}))
+	require.NoError(t, err)
+	image, err := ro.CreateImage("", []string{"ro-image"}, layer.ID, "", nil)
+	require.NoError(t, err)
+	_, err = ro.Shutdown(true)
+	require.NoError(t, err)
+	ro.Free()
+	// lock files are cached by this process, which opened these ones for
+	// writing, so the store is copied to where it is read from
+	roRoot = filepath.Join(wd, "ro-copy")
+	require.NoError(t, archive.NewDefaultArchiver().CopyWithTar(filepath.Join(wd, "ro"), roRoot))
+
+	s := newTestStore(t)
+	stores, err := s.AdditionalStores()
+	require.NoError(t, err)
+	assert.Empty(t, stores)
+	_, err = s.Layer(layer.ID)
+	assert.Error(t, err)
+
+	assert.Error(t, s.AddAdditionalStore("relative"))
+	require.NoError(t, s.AddAdditionalStore(roRoot))
+	assert.Error(t, s.AddAdditionalStore(roRoot), "added twice")
+	stores, err = s.AdditionalStores()
+	require.NoError(t, err)
+	assert.Equal(t, []string{roRoot}, stores)
+
+	// the layer and the image are found, and can be used
+	found, err := s.Layer(layer.ID)
+	require.NoError(t, err)
+	assert.Equal(t, layer.UncompressedDigest, found.UncompressedDigest)
+	img, err := s.Image("ro-image")
+	require.NoError(t, err)
+	assert.Equal(t, image.ID, img.ID)
+	container, err := s.CreateContainer("", nil, image.ID, "", "", nil)
+	require.NoError(t, err)
+	dir, err := s.Mount(container.ID, "")
+	require.NoError(t, err)
+	contents, err := ioutil.ReadFile(filepath.Join(dir, "file"))
+	require.NoError(t, err)
+	assert.Equal(t, "contents", string(contents))
+	_, err = s.Unmount(container.ID, true)
+	require.NoError(t, err)
+
+	// the container's layer still needs the store
+	assert.Error(t, s.RemoveAdditionalStore(roRoot))
+	require.NoError(t, s.DeleteContainer(container.ID))
+	require.NoError(t, s.RemoveAdditionalStore(roRoot))
+	assert.Error(t, s.RemoveAdditionalStore(roRoot), "removed twice")
+	stores, err = s.AdditionalStores()
+	require.NoError(t, err)
+	assert.Empty(t, stores)
+	_, err = s.Layer(layer.ID)
+	assert.Error(t, err)
+	_, err = s.Image("ro-image")
+	assert.Error(t, err)
+}
@@ -0,0 +1,20 @@
+package storage
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// syncFilesystem flushes to disk the filesystem which holds dir.  It can be
+// replaced by tests.
+var syncFilesystem = func(dir string) error {
+	fd, err := unix.Open(dir, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return errors.Wrapf(err, "opening %q to flush it to disk", dir)
+	}
+	defer unix.Close(fd)
+	if err := unix.Syncfs(fd); err != nil {
+		return errors.Wrapf(err, "flushing %q to disk", dir)
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+// +build !linux
+
+package storage
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// syncFilesystem flushes to disk the regular files under dir, since there is
+// no way to flush a whole filesystem.  It can be replaced by tests.
+var syncFilesystem = func(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := f.Sync(); err != nil {
+			return errors.Wrapf(err, "flushing %q to disk", path)
+		}
+		return nil
+	})
+}
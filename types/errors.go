@@ -55,4 +55,16 @@ var (
 	ErrStoreIsReadOnly = errors.New("called a write method on a read-only store")
 	// ErrNotSupported is returned when the requested functionality is not supported.
 	ErrNotSupported = errors.New("not supported")
+	// ErrLayerCorrupted is returned when the contents of a layer don't match the digests which were recorded for it.
+	ErrLayerCorrupted = errors.New("layer contents do not match their recorded digests")
+	// ErrLayerMountOptionsConflict is returned when the caller attempts to mount a layer with options which differ from those of its current mount.
+	ErrLayerMountOptionsConflict = errors.New("layer is already mounted with different options")
+	// ErrLayerHasNoTarSplit is returned when the original tarball of a layer is requested, but no tar-split metadata was recorded for it.
+	ErrLayerHasNoTarSplit = errors.New("no tar-split metadata was recorded for layer")
+	// ErrLayerNotMaterialized is returned when a layer which was registered with RegisterLazyLayer is needed, but its contents haven't been fetched and no fetcher for them is known.
+	ErrLayerNotMaterialized = errors.New("layer contents have not been fetched")
+	// ErrLayerPinned is returned when the caller attempts to delete a layer which was pinned with PinLayer.
+	ErrLayerPinned = errors.New("layer is pinned")
+	// ErrContainerSizeLimitExceeded is returned when the layer of a container has grown past the size limit which was set for it.
+	ErrContainerSizeLimitExceeded = errors.New("container layer exceeds its size limit")
 )
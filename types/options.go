@@ -183,6 +183,73 @@ type StoreOptions struct {
 	PullOptions map[string]string `toml:"pull_options"`
 	// DisableVolatile doesn't allow volatile mounts when it is set.
 	DisableVolatile bool `json:"disable-volatile,omitempty"`
+	// PrefetchOnMount, if set, makes the store read ahead, in the
+	// background, the files of a layer when it is first mounted, starting
+	// with the ones listed in the prefetch list of the manifests of
+	// partially pulled layers, so that the first accesses to them don't
+	// wait for the disk.
+	PrefetchOnMount bool `json:"prefetch-on-mount,omitempty"`
+	// BindRoots are the directories under which the sources of the
+	// read-only binds of images and containers must be.  Without them,
+	// images and containers can't have binds.
+	BindRoots []string `json:"bind-roots,omitempty"`
+	// SyncPolicy is how the store makes the layers it writes durable:
+	// SyncPolicyAlways, SyncPolicyMetadataOnly, which is the default if it
+	// is empty, or SyncPolicyNone.
+	SyncPolicy string `json:"sync-policy,omitempty"`
+	// Namespace, if set, gives the store its own sets of layers, images,
+	// and containers, which are not visible to stores which use the same
+	// GraphRoot with a different Namespace, or with none.  The storage
+	// driver, and the data it keeps for layers, are shared among them.
+	Namespace string `json:"namespace,omitempty"`
+	// NamespaceSharedBase, if set along with Namespace, makes the layers
+	// and images of the store which uses the same GraphRoot without a
+	// Namespace available, read-only, so that they can be used as shared
+	// base layers.  That store refuses to delete the layers which are the
+	// parents of layers or the top layers of images of any namespace.
+	NamespaceSharedBase bool `json:"namespace-shared-base,omitempty"`
+	// LayerHooks, if set, has functions which the store calls when layers
+	// are created, mounted and unmounted.
+	LayerHooks *LayerHooks `json:"-" toml:"-"`
+}
+
+const (
+	// SyncPolicyAlways flushes the contents of each layer to disk once
+	// they are written, along with the store's records of the layer, so
+	// that a layer which was created survives a crash of the host.
+	SyncPolicyAlways = "always"
+	// SyncPolicyMetadataOnly flushes the store's records of the layers to
+	// disk, but not their contents, which may be lost or incomplete after
+	// a crash of the host, while the layers are still listed.
+	SyncPolicyMetadataOnly = "metadata-only"
+	// SyncPolicyNone flushes nothing to disk, leaving it to the kernel,
+	// so that both the contents of the layers and the store's records of
+	// them may be lost or damaged after a crash of the host.  It is only
+	// meant for stores which don't need to outlive the host, e.g. on
+	// ephemeral CI hosts.
+	SyncPolicyNone = "none"
+)
+
+// LayerHooks has functions which the store calls synchronously at points of
+// the life of the layers it manages, but not of those in additional image
+// stores, e.g. to audit them or to set them up.
+// Any of them can be nil.  If one returns an error, the operation fails with
+// that error, and what it did is undone.
+type LayerHooks struct {
+	// OnLayerCreate is called when the layer with the specified ID,
+	// whose parent is the layer with the ID parent, or none if it is
+	// empty, was created and its contents, if any, were applied.  If it
+	// fails, the layer is deleted.
+	OnLayerCreate func(id, parent string) error
+	// OnMount is called when the layer with the specified ID was mounted
+	// at mountPoint, but not when a layer which is already mounted is
+	// mounted again.  If it fails, the layer is unmounted.
+	OnMount func(id, mountPoint string) error
+	// OnUnmount is called before the layer with the specified ID, which is
+	// mounted at mountPoint, is unmounted, but not when it stays mounted
+	// because it was mounted more than once.  If it fails, the layer stays
+	// mounted.
+	OnUnmount func(id, mountPoint string) error
 }
 
 // isRootlessDriver returns true if the given storage driver is valid for containers running as non root
@@ -410,6 +477,9 @@ func ReloadConfigurationFile(configFile string, storeOptions *StoreOptions) {
 	}
 
 	storeOptions.DisableVolatile = config.Storage.Options.DisableVolatile
+	storeOptions.PrefetchOnMount = config.Storage.Options.PrefetchOnMount
+	storeOptions.BindRoots = config.Storage.Options.BindRoots
+	storeOptions.SyncPolicy = config.Storage.Options.SyncPolicy
 
 	storeOptions.GraphDriverOptions = append(storeOptions.GraphDriverOptions, cfg.GetGraphDriverOptions(storeOptions.GraphDriverName, config.Storage.Options)...)
 